@@ -2,6 +2,7 @@ package main
 
 import (
         "bytes"
+        "context"
         "encoding/base64"
         "encoding/json"
         "fmt"
@@ -10,9 +11,11 @@ import (
         "net/http"
         "os"
         "strconv"
+        "strings"
         "time"
 
         "github.com/gin-gonic/gin"
+        "gorm.io/gorm"
 )
 
 type YooKassaService struct {
@@ -31,6 +34,7 @@ type YooKassaPaymentRequest struct {
         Confirmation      map[string]string      `json:"confirmation"`
         Metadata          map[string]interface{} `json:"metadata"`
         SavePaymentMethod bool                   `json:"save_payment_method,omitempty"`
+        Receipt           *YooKassaReceipt       `json:"receipt,omitempty"`
 }
 
 type YooKassaPaymentResponse struct {
@@ -51,6 +55,7 @@ type YooKassaPaymentResponse struct {
                 ID    string `json:"id"`
                 Saved bool   `json:"saved"`
         } `json:"payment_method"`
+        Metadata map[string]interface{} `json:"metadata"`
 }
 
 type YooKassaRefundRequest struct {
@@ -70,15 +75,24 @@ func InitBillingSystem() {
         shopID := os.Getenv("YOOKASSA_SHOP_ID")
         secretKey := os.Getenv("YOOKASSA_SECRET_KEY")
 
-        if shopID == "" || secretKey == "" {
-                log.Println("[Billing] YooKassa credentials not configured, billing features limited")
-                return
+        if shopID != "" && secretKey != "" {
+                apiEndpoint := os.Getenv("YOOKASSA_API_URL")
+                if apiEndpoint == "" {
+                        apiEndpoint = "https://api.yookassa.ru/v3"
+                }
+
+                yookassaService = &YooKassaService{
+                        ShopID:      shopID,
+                        SecretKey:   secretKey,
+                        APIEndpoint: strings.TrimRight(apiEndpoint, "/"),
+                }
+                registerPaymentProvider(&yookassaProvider{svc: yookassaService})
         }
+        initPaymentProviders()
 
-        yookassaService = &YooKassaService{
-                ShopID:      shopID,
-                SecretKey:   secretKey,
-                APIEndpoint: "https://api.yookassa.ru/v3",
+        if len(paymentProviders) == 0 {
+                log.Println("[Billing] No payment provider configured, billing features limited")
+                return
         }
 
         billingTicker = time.NewTicker(1 * time.Hour)
@@ -94,9 +108,6 @@ func InitBillingSystem() {
                                 if hour == 0 {
                                         processAutoRenewals()
                                 }
-                                if hour%6 == 0 {
-                                        retryFailedPayments()
-                                }
                                 if hour == 8 {
                                         sendExpirationReminders()
                                 }
@@ -104,7 +115,7 @@ func InitBillingSystem() {
                 }
         }()
 
-        log.Println("[Billing] Scheduler started with auto-renewal, retry, and reminder jobs")
+        log.Println("[Billing] Scheduler started with auto-renewal and reminder jobs")
 }
 
 func StopBillingSystem() {
@@ -128,6 +139,7 @@ func (yk *YooKassaService) CreatePayment(transactionID uint, amount float64, des
                 Metadata: map[string]interface{}{
                         "transaction_id": strconv.FormatUint(uint64(transactionID), 10),
                 },
+                Receipt: yookassaReceiptForTransaction(transactionID, description),
         }
         paymentReq.Amount.Value = fmt.Sprintf("%.2f", amount)
         paymentReq.Amount.Currency = "RUB"
@@ -178,6 +190,7 @@ func (yk *YooKassaService) CreatePaymentWithSavedMethod(transactionID uint, amou
                 Description     string                 `json:"description"`
                 PaymentMethodID string                 `json:"payment_method_id"`
                 Metadata        map[string]interface{} `json:"metadata"`
+                Receipt         *YooKassaReceipt       `json:"receipt,omitempty"`
         }
 
         paymentReq := AutoPaymentRequest{
@@ -187,6 +200,7 @@ func (yk *YooKassaService) CreatePaymentWithSavedMethod(transactionID uint, amou
                 Metadata: map[string]interface{}{
                         "transaction_id": strconv.FormatUint(uint64(transactionID), 10),
                 },
+                Receipt: yookassaReceiptForTransaction(transactionID, description),
         }
         paymentReq.Amount.Value = fmt.Sprintf("%.2f", amount)
         paymentReq.Amount.Currency = "RUB"
@@ -228,7 +242,9 @@ func (yk *YooKassaService) CreatePaymentWithSavedMethod(transactionID uint, amou
         return &paymentResp, nil
 }
 
-func (yk *YooKassaService) CreateRefund(paymentID string, amount float64, description string) error {
+// CreateRefund sends a refund under idempotencyKey. Errors from before the
+// request went out wrap errRefundDeclined.
+func (yk *YooKassaService) CreateRefund(ctx context.Context, paymentID string, amount float64, description, idempotencyKey string) error {
         refundReq := YooKassaRefundRequest{
                 PaymentID:   paymentID,
                 Description: description,
@@ -238,15 +254,15 @@ func (yk *YooKassaService) CreateRefund(paymentID string, amount float64, descri
 
         payloadBytes, _ := json.Marshal(refundReq)
 
-        req, err := http.NewRequest("POST", yk.APIEndpoint+"/refunds", bytes.NewBuffer(payloadBytes))
+        req, err := http.NewRequestWithContext(ctx, "POST", yk.APIEndpoint+"/refunds", bytes.NewBuffer(payloadBytes))
         if err != nil {
-                return err
+                return fmt.Errorf("%w: %v", errRefundDeclined, err)
         }
 
         auth := base64.StdEncoding.EncodeToString([]byte(yk.ShopID + ":" + yk.SecretKey))
         req.Header.Set("Authorization", "Basic "+auth)
         req.Header.Set("Content-Type", "application/json")
-        req.Header.Set("Idempotence-Key", fmt.Sprintf("refund-%s-%d", paymentID, time.Now().Unix()))
+        req.Header.Set("Idempotence-Key", idempotencyKey)
 
         client := &http.Client{Timeout: 30 * time.Second}
         resp, err := client.Do(req)
@@ -257,7 +273,7 @@ func (yk *YooKassaService) CreateRefund(paymentID string, amount float64, descri
 
         if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
                 body, _ := io.ReadAll(resp.Body)
-                return fmt.Errorf("refund error %d: %s", resp.StatusCode, string(body))
+                return &paymentAPIError{Provider: "yookassa", StatusCode: resp.StatusCode, Body: string(body)}
         }
 
         return nil
@@ -273,9 +289,12 @@ func processAutoRenewals() {
                 Find(&subscriptions)
 
         for _, sub := range subscriptions {
+                if pollPendingRenewal(&sub) != "" {
+                        continue
+                }
                 if err := processRenewal(&sub); err != nil {
                         log.Printf("[Billing] Renewal failed for user %d: %v", sub.UserID, err)
-                        markRenewalFailed(&sub)
+                        enterPremiumPastDue(&sub, err.Error())
                 }
         }
 
@@ -283,19 +302,29 @@ func processAutoRenewals() {
 }
 
 func processRenewal(sub *PremiumSubscription) error {
+        currency := ledgerCurrency(sub.Currency)
+        amount, ok := premiumPlanPrice(&sub.Plan, currency)
+        if !ok {
+                return fmt.Errorf("plan %d has no %s price", sub.PlanID, currency)
+        }
+        provider := paymentProviderByName(sub.PaymentProvider)
         transaction := PremiumTransaction{
                 UserID:          sub.UserID,
                 SubscriptionID:  &sub.ID,
                 PlanID:          sub.PlanID,
-                AmountRub:       sub.Plan.PriceRub,
+                AmountRub:       float64(amount) / 100,
+                Currency:        currency,
                 Status:          "pending",
-                PaymentProvider: "yookassa",
+                PaymentProvider: sub.PaymentProvider,
                 Description:     fmt.Sprintf("Auto-renewal: %s", sub.Plan.Name),
         }
+        if transaction.PaymentProvider == "" {
+                transaction.PaymentProvider = "yookassa"
+        }
         db.Create(&transaction)
 
-        if yookassaService == nil {
-                return fmt.Errorf("yookassa not configured")
+        if provider == nil {
+                return fmt.Errorf("%s not configured", transaction.PaymentProvider)
         }
 
         if sub.PaymentMethodID == "" {
@@ -303,15 +332,16 @@ func processRenewal(sub *PremiumSubscription) error {
                 return fmt.Errorf("no saved payment method for subscription %d", sub.ID)
         }
 
-        payment, err := yookassaService.CreatePaymentWithSavedMethod(
-                transaction.ID,
-                sub.Plan.PriceRub,
-                fmt.Sprintf("Продление подписки %s", sub.Plan.Name),
-                sub.PaymentMethodID,
-        )
+        ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+        defer cancel()
+        payment, err := provider.ChargeSaved(ctx, &paymentRequest{
+                TransactionID: transaction.ID,
+                Amount:        amount,
+                Currency:      currency,
+                Description:   fmt.Sprintf("Продление подписки %s", sub.Plan.Name),
+        }, sub.PaymentMethodID)
         if err != nil {
                 db.Model(&transaction).Update("status", "failed")
-                go SendPaymentFailed(sub.UserID, err.Error())
                 return err
         }
 
@@ -329,13 +359,24 @@ func processRenewal(sub *PremiumSubscription) error {
                         "provider_payment_id": payment.ID,
                         "completed_at":        now,
                 })
+                transaction.ProviderPaymentID = payment.ID
+                transaction.CompletedAt = &now
+                if err := postPremiumPaymentLedger(db, &transaction); err != nil {
+                        log.Printf("[Ledger] Failed to post renewal %d: %v", transaction.ID, err)
+                }
+                setTransactionInvoiceStatus(db, transaction.ID, "paid", now)
 
-                db.Model(sub).Updates(map[string]interface{}{
+                db.Model(sub).Updates(withDunningCleared(map[string]interface{}{
                         "current_period_start": now,
                         "current_period_end":   periodEnd,
-                })
+                }))
+                if sub.Status != "active" {
+                        notifyPremiumDunning(sub, "reactivated", now)
+                }
 
-                go SendPaymentConfirmation(sub.UserID, sub.Plan.Name, sub.Plan.PriceRub)
+                go notifyBilling(sub.UserID, "renewal_succeeded", map[string]interface{}{
+                        "Plan": sub.Plan.Name, "Amount": amount, "Currency": currency, "Date": periodEnd,
+                }, "")
                 log.Printf("[Billing] Auto-renewal succeeded for user %d, subscription %d", sub.UserID, sub.ID)
         } else {
                 db.Model(&transaction).Updates(map[string]interface{}{
@@ -347,111 +388,6 @@ func processRenewal(sub *PremiumSubscription) error {
         return nil
 }
 
-func markRenewalFailed(sub *PremiumSubscription) {
-        var failedCount int64
-        db.Model(&PremiumTransaction{}).
-                Where("subscription_id = ? AND status = ? AND created_at > ?",
-                        sub.ID, "failed", time.Now().Add(-72*time.Hour)).
-                Count(&failedCount)
-
-        if failedCount >= 3 {
-                db.Model(sub).Updates(map[string]interface{}{
-                        "status":     "expired",
-                        "auto_renew": false,
-                })
-                log.Printf("[Billing] Subscription %d expired after 3 failed renewals", sub.ID)
-        }
-}
-
-func retryFailedPayments() {
-        log.Println("[Billing] Retrying failed payments...")
-
-        var transactions []PremiumTransaction
-        db.Where("status = ? AND created_at > ?", "failed", time.Now().Add(-72*time.Hour)).
-                Find(&transactions)
-
-        for _, tx := range transactions {
-                if tx.SubscriptionID == nil {
-                        continue
-                }
-
-                var sub PremiumSubscription
-                if db.Preload("Plan").First(&sub, *tx.SubscriptionID).RowsAffected == 0 || sub.Status != "active" {
-                        continue
-                }
-
-                if sub.PaymentMethodID == "" {
-                        log.Printf("[Billing] No saved payment method for subscription %d, skipping retry", sub.ID)
-                        continue
-                }
-
-                var retryCount int64
-                db.Model(&PremiumTransaction{}).
-                        Where("subscription_id = ? AND status IN ? AND created_at > ?",
-                                tx.SubscriptionID, []string{"pending", "succeeded"}, time.Now().Add(-24*time.Hour)).
-                        Count(&retryCount)
-
-                if retryCount > 0 {
-                        continue
-                }
-
-                newTx := PremiumTransaction{
-                        UserID:          tx.UserID,
-                        SubscriptionID:  tx.SubscriptionID,
-                        PlanID:          tx.PlanID,
-                        AmountRub:       tx.AmountRub,
-                        Status:          "pending",
-                        PaymentProvider: "yookassa",
-                        Description:     "Retry: " + tx.Description,
-                }
-                db.Create(&newTx)
-
-                if yookassaService != nil {
-                        payment, err := yookassaService.CreatePaymentWithSavedMethod(
-                                newTx.ID,
-                                tx.AmountRub,
-                                newTx.Description,
-                                sub.PaymentMethodID,
-                        )
-                        if err != nil {
-                                db.Model(&newTx).Update("status", "failed")
-                                log.Printf("[Billing] Retry payment failed for tx %d: %v", newTx.ID, err)
-                                continue
-                        }
-
-                        if payment.Status == "succeeded" {
-                                now := time.Now()
-                                periodEnd := now.AddDate(0, 1, 0)
-                                if sub.Plan.BillingCycle == "quarterly" {
-                                        periodEnd = now.AddDate(0, 3, 0)
-                                } else if sub.Plan.BillingCycle == "annual" {
-                                        periodEnd = now.AddDate(1, 0, 0)
-                                }
-
-                                db.Model(&newTx).Updates(map[string]interface{}{
-                                        "status":              "succeeded",
-                                        "provider_payment_id": payment.ID,
-                                        "completed_at":        now,
-                                })
-
-                                db.Model(&sub).Updates(map[string]interface{}{
-                                        "current_period_start": now,
-                                        "current_period_end":   periodEnd,
-                                })
-
-                                go SendPaymentConfirmation(sub.UserID, sub.Plan.Name, sub.Plan.PriceRub)
-                                log.Printf("[Billing] Retry succeeded for user %d, subscription %d", sub.UserID, sub.ID)
-                        } else {
-                                db.Model(&newTx).Updates(map[string]interface{}{
-                                        "provider_payment_id": payment.ID,
-                                })
-                        }
-                }
-
-                log.Printf("[Billing] Created retry transaction %d for failed tx %d", newTx.ID, tx.ID)
-        }
-}
-
 func sendExpirationReminders() {
         log.Println("[Billing] Sending expiration reminders...")
 
@@ -465,11 +401,49 @@ func sendExpirationReminders() {
                 Find(&subscriptions)
 
         for _, sub := range subscriptions {
-                go SendSubscriptionExpiring(sub.UserID, sub.Plan.Name, sub.CurrentPeriodEnd)
-                log.Printf("[Billing] Sent expiration reminder for subscription %d, user %d", sub.ID, sub.UserID)
+                go notifyBilling(sub.UserID, "subscription_expiring", map[string]interface{}{
+                        "Plan": sub.Plan.Name, "Date": sub.CurrentPeriodEnd,
+                }, fmt.Sprintf("subscription_expiring:%d:%s", sub.ID, sub.CurrentPeriodEnd.Format("2006-01-02")))
+        }
+
+        var trials []PremiumSubscription
+        db.Preload("Plan").
+                Where("status = ? AND trial_end BETWEEN ? AND ?", "trialing", expiringIn1Day, expiringIn3Days).
+                Find(&trials)
+        for _, sub := range trials {
+                go notifyBilling(sub.UserID, "trial_ending", map[string]interface{}{
+                        "Plan": sub.Plan.Name, "Date": *sub.TrialEnd,
+                }, fmt.Sprintf("trial_ending:%d", sub.ID))
+        }
+
+        // A promo discount covers the period it was bought for; the renewal
+        // is charged at the full price
+        var renewing []PremiumSubscription
+        db.Preload("Plan").
+                Where("status = ? AND auto_renew = ? AND cancel_at_period_end = ? AND current_period_end BETWEEN ? AND ?",
+                        "active", true, false, expiringIn1Day, expiringIn3Days).
+                Find(&renewing)
+        for _, sub := range renewing {
+                var last PremiumTransaction
+                if db.Where("subscription_id = ? AND status = ?", sub.ID, "succeeded").Order("completed_at DESC").First(&last).Error != nil || last.PromoCodeID == nil {
+                        continue
+                }
+                var promo PromoCode
+                if db.First(&promo, *last.PromoCodeID).Error != nil {
+                        continue
+                }
+                go notifyBilling(sub.UserID, "promo_expiring", map[string]interface{}{
+                        "Code": promo.Code, "Plan": sub.Plan.Name, "Date": sub.CurrentPeriodEnd, "Amount": rubToKopecks(sub.Plan.PriceRub),
+                }, fmt.Sprintf("promo_expiring:%d:%s", sub.ID, sub.CurrentPeriodEnd.Format("2006-01-02")))
         }
 }
 
+// premiumRefundKey is the same for every attempt at refunding t, so a
+// retried refund is not made twice.
+func premiumRefundKey(t *PremiumTransaction) string {
+        return fmt.Sprintf("refund-premium-%d-%d", t.ID, rubToKopecks(t.AmountRub))
+}
+
 func refundPremiumHandler(c *gin.Context) {
         userID, _ := c.Get("user_id")
         uid := uint(userID.(float64))
@@ -500,22 +474,43 @@ func refundPremiumHandler(c *gin.Context) {
                 return
         }
 
-        if yookassaService != nil && transaction.ProviderPaymentID != "" {
-                if err := yookassaService.CreateRefund(transaction.ProviderPaymentID, transaction.AmountRub, req.Reason); err != nil {
+        if provider := paymentProviderByName(transaction.PaymentProvider); provider != nil && transaction.ProviderPaymentID != "" {
+                if err := provider.Refund(c.Request.Context(), &refundRequest{
+                        PaymentID: transaction.ProviderPaymentID, Amount: rubToKopecks(transaction.AmountRub),
+                        Currency: transaction.Currency, Reason: req.Reason,
+                        Key: premiumRefundKey(&transaction),
+                }); err != nil {
                         log.Printf("[Billing] Refund API error: %v", err)
                 }
         }
 
         now := time.Now()
-        db.Model(&transaction).Updates(map[string]interface{}{
-                "status":       "refunded",
-                "completed_at": now,
+        err := db.Transaction(func(tx *gorm.DB) error {
+                if err := tx.Model(&transaction).Updates(map[string]interface{}{
+                        "status":       "refunded",
+                        "completed_at": now,
+                }).Error; err != nil {
+                        return err
+                }
+                if err := setTransactionInvoiceStatus(tx, transaction.ID, "refunded", now); err != nil {
+                        return err
+                }
+                return postPremiumRefundLedger(tx, &transaction, now)
         })
+        if err != nil {
+                log.Printf("[Billing] Failed to record refund for transaction %d: %v", transaction.ID, err)
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record refund"})
+                return
+        }
 
         if transaction.SubscriptionID != nil {
                 db.Model(&PremiumSubscription{}).Where("id = ?", *transaction.SubscriptionID).
                         Update("status", "cancelled")
         }
+        go notifyBilling(transaction.UserID, "refund_issued", map[string]interface{}{
+                "Amount": rubToKopecks(transaction.AmountRub), "Currency": ledgerCurrency(transaction.Currency),
+                "Description": transaction.Description, "Reason": req.Reason,
+        }, fmt.Sprintf("refund_issued:premium:%d", transaction.ID))
 
         c.JSON(http.StatusOK, gin.H{"status": "refunded"})
 }
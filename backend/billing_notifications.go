@@ -0,0 +1,639 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
+)
+
+// Billing notifications. Every billing event has a template per language;
+// notifyBilling renders it in the user's language and delivers it over the
+// channels the user keeps enabled for billing: email, Telegram and the
+// in-app feed. Critical notices, the ones about losing access, always
+// reach the in-app feed. Events sent by periodic jobs pass a dedupe key so
+// each reminder goes out once.
+
+const billingSiteURL = "https://nemaks.com"
+
+var billingLanguages = []string{"ru", "en"}
+
+type billingTemplateText struct {
+	Subject string
+	Title   string
+	Body    string // paragraphs separated by blank lines
+	Action  string
+}
+
+type billingTemplate struct {
+	Accent   string
+	Critical bool
+	Path     string // action link below billingSiteURL
+	Text     map[string]billingTemplateText
+	Sample   map[string]interface{}
+}
+
+var billingTemplates = map[string]billingTemplate{
+	"trial_started": {
+		Accent: "#a855f7", Path: "/premium",
+		Sample: map[string]interface{}{"Plan": "Premium", "Date": sampleNoticeDate},
+		Text: map[string]billingTemplateText{
+			"ru": {"Пробный период начался", "Добро пожаловать в {{.Plan}}!", "Пробный период {{.Plan}} действует до {{date .Date}}. Все возможности Premium уже доступны.", "Открыть Premium"},
+			"en": {"Your trial has started", "Welcome to {{.Plan}}!", "Your {{.Plan}} trial runs until {{date .Date}}. All Premium features are already unlocked.", "Open Premium"},
+		},
+	},
+	"trial_ending": {
+		Accent: "#f59e0b", Path: "/premium",
+		Sample: map[string]interface{}{"Plan": "Premium", "Date": sampleNoticeDate},
+		Text: map[string]billingTemplateText{
+			"ru": {"Пробный период скоро закончится", "Пробный период заканчивается", "Пробный период {{.Plan}} закончится {{date .Date}}. Оформите подписку, чтобы не потерять доступ к Premium.", "Оформить подписку"},
+			"en": {"Your trial ends soon", "Your trial is ending", "Your {{.Plan}} trial ends on {{date .Date}}. Subscribe to keep your Premium features.", "Subscribe"},
+		},
+	},
+	"payment_succeeded": {
+		Accent: "#a855f7", Path: "/premium",
+		Sample: map[string]interface{}{"Plan": "Premium", "Amount": int64(29900), "Currency": "RUB"},
+		Text: map[string]billingTemplateText{
+			"ru": {"Подтверждение оплаты Premium", "Спасибо за подписку!", "Ваша подписка {{.Plan}} успешно активирована.\n\nСумма: {{money .Amount .Currency}}", "Открыть Premium"},
+			"en": {"Premium payment confirmed", "Thank you for subscribing!", "Your {{.Plan}} subscription is active.\n\nAmount: {{money .Amount .Currency}}", "Open Premium"},
+		},
+	},
+	"renewal_succeeded": {
+		Accent: "#a855f7", Path: "/premium",
+		Sample: map[string]interface{}{"Plan": "Premium", "Amount": int64(29900), "Currency": "RUB", "Date": sampleNoticeDate},
+		Text: map[string]billingTemplateText{
+			"ru": {"Подписка продлена", "Подписка продлена", "Подписка {{.Plan}} продлена до {{date .Date}}.\n\nСписано: {{money .Amount .Currency}}", "Открыть Premium"},
+			"en": {"Subscription renewed", "Subscription renewed", "Your {{.Plan}} subscription is renewed until {{date .Date}}.\n\nCharged: {{money .Amount .Currency}}", "Open Premium"},
+		},
+	},
+	"renewal_failed": {
+		Accent: "#ef4444", Critical: true, Path: "/premium",
+		Sample: map[string]interface{}{"Plan": "Premium", "Date": sampleNoticeDate},
+		Text: map[string]billingTemplateText{
+			"ru": {"Не удалось оплатить подписку", "Оплата не прошла", "Не удалось списать оплату за подписку {{.Plan}}. Мы повторим попытку {{date .Date}}, доступ к Premium пока сохраняется. Проверьте карту или оплатите вручную.", "Открыть оплату"},
+			"en": {"We couldn't charge your subscription", "Payment failed", "We couldn't charge you for {{.Plan}}. We'll retry on {{date .Date}} and you keep Premium until then. Please check your card or pay manually.", "Go to payment"},
+		},
+	},
+	"renewal_retry_failed": {
+		Accent: "#ef4444", Critical: true, Path: "/premium",
+		Sample: map[string]interface{}{"Plan": "Premium", "Date": sampleNoticeDate},
+		Text: map[string]billingTemplateText{
+			"ru": {"Повторная оплата не прошла", "Повторная оплата не прошла", "Повторная попытка оплатить подписку {{.Plan}} не удалась. Следующая попытка — {{date .Date}}.", "Открыть оплату"},
+			"en": {"Payment retry failed", "Payment retry failed", "Another attempt to charge for {{.Plan}} failed. The next attempt is on {{date .Date}}.", "Go to payment"},
+		},
+	},
+	"premium_grace": {
+		Accent: "#ef4444", Critical: true, Path: "/premium",
+		Sample: map[string]interface{}{"Plan": "Premium", "Date": sampleNoticeDate},
+		Text: map[string]billingTemplateText{
+			"ru": {"Подписка ограничена", "Подписка ограничена", "Оплата подписки {{.Plan}} так и не прошла. До {{date .Date}} Premium доступен только для просмотра, затем подписка будет отключена.", "Открыть оплату"},
+			"en": {"Subscription restricted", "Subscription restricted", "We still couldn't charge for {{.Plan}}. Premium is read-only until {{date .Date}}, then the subscription ends.", "Go to payment"},
+		},
+	},
+	"premium_expired": {
+		Accent: "#ef4444", Critical: true, Path: "/premium",
+		Sample: map[string]interface{}{"Plan": "Premium"},
+		Text: map[string]billingTemplateText{
+			"ru": {"Подписка отключена", "Подписка отключена", "Подписка {{.Plan}} отключена из-за неоплаты. Оформите её снова, чтобы вернуть Premium.", "Оформить снова"},
+			"en": {"Subscription ended", "Subscription ended", "Your {{.Plan}} subscription ended because it wasn't paid. Subscribe again to get Premium back.", "Subscribe again"},
+		},
+	},
+	"premium_reactivated": {
+		Accent: "#22c55e", Path: "/premium",
+		Sample: map[string]interface{}{"Plan": "Premium"},
+		Text: map[string]billingTemplateText{
+			"ru": {"Подписка снова активна", "Подписка снова активна", "Оплата получена, подписка {{.Plan}} снова активна.", "Открыть Premium"},
+			"en": {"Subscription active again", "Subscription active again", "Payment received, your {{.Plan}} subscription is active again.", "Open Premium"},
+		},
+	},
+	"subscription_expiring": {
+		Accent: "#f59e0b", Path: "/premium",
+		Sample: map[string]interface{}{"Plan": "Premium", "Date": sampleNoticeDate},
+		Text: map[string]billingTemplateText{
+			"ru": {"Подписка скоро истекает", "Подписка скоро истекает", "Ваша подписка {{.Plan}} истекает {{date .Date}}.\n\nЧтобы продолжить пользоваться всеми преимуществами Premium, продлите подписку.", "Продлить подписку"},
+			"en": {"Your subscription expires soon", "Your subscription expires soon", "Your {{.Plan}} subscription expires on {{date .Date}}.\n\nRenew it to keep all Premium features.", "Renew subscription"},
+		},
+	},
+	"subscription_cancelled": {
+		Accent: "#f59e0b", Path: "/premium",
+		Sample: map[string]interface{}{"Plan": "Premium", "Date": sampleNoticeDate},
+		Text: map[string]billingTemplateText{
+			"ru": {"Подписка отменена", "Подписка отменена", "Подписка {{.Plan}} отменена. Premium останется доступен до {{date .Date}}, после этого списаний не будет.", "Возобновить подписку"},
+			"en": {"Subscription cancelled", "Subscription cancelled", "Your {{.Plan}} subscription is cancelled. You keep Premium until {{date .Date}} and won't be charged again.", "Resume subscription"},
+		},
+	},
+	"refund_issued": {
+		Accent: "#a855f7", Path: "/settings/billing",
+		Sample: map[string]interface{}{"Amount": int64(29900), "Currency": "RUB", "Description": "Premium", "Reason": ""},
+		Text: map[string]billingTemplateText{
+			"ru": {"Возврат оформлен", "Возврат оформлен", "Мы вернули {{money .Amount .Currency}} за «{{.Description}}». Деньги поступят на карту в течение нескольких рабочих дней.{{if .Reason}}\n\nПричина: {{.Reason}}{{end}}", "История платежей"},
+			"en": {"Refund issued", "Refund issued", "We refunded {{money .Amount .Currency}} for \"{{.Description}}\". It will reach your card within a few business days.{{if .Reason}}\n\nReason: {{.Reason}}{{end}}", "Payment history"},
+		},
+	},
+	"gift_received": {
+		Accent: "#ec4899", Path: "/premium/gifts",
+		Sample: map[string]interface{}{"Plan": "Premium", "Days": 30, "From": "alice", "Code": "GIFT-1234", "Message": "С днём рождения!"},
+		Text: map[string]billingTemplateText{
+			"ru": {"Вам подарили Premium", "Вам подарок!", "{{.From}} дарит вам {{.Plan}} на {{.Days}} дн.{{if .Message}}\n\n«{{.Message}}»{{end}}\n\nКод подарка: {{.Code}}", "Активировать подарок"},
+			"en": {"You've been gifted Premium", "You've got a gift!", "{{.From}} gave you {{.Plan}} for {{.Days}} days.{{if .Message}}\n\n\"{{.Message}}\"{{end}}\n\nGift code: {{.Code}}", "Redeem gift"},
+		},
+	},
+	"promo_expiring": {
+		Accent: "#f59e0b", Path: "/premium",
+		Sample: map[string]interface{}{"Code": "SPRING25", "Plan": "Premium", "Date": sampleNoticeDate, "Amount": int64(29900)},
+		Text: map[string]billingTemplateText{
+			"ru": {"Скидка по промокоду заканчивается", "Скидка заканчивается", "Скидка по промокоду {{.Code}} на {{.Plan}} действует до {{date .Date}}. Следующее продление — по полной цене {{rub .Amount}}.", "Управлять подпиской"},
+			"en": {"Your promo discount ends soon", "Your discount is ending", "Your {{.Code}} discount on {{.Plan}} lasts until {{date .Date}}. The next renewal is at the full price of {{rub .Amount}}.", "Manage subscription"},
+		},
+	},
+	"seat_limit_reached": {
+		Accent: "#f59e0b", Path: "/org/{{.OrgID}}/billing",
+		Sample: map[string]interface{}{"Org": "Школа №1", "OrgID": 1, "SeatType": "student_editor", "Seats": 30},
+		Text: map[string]billingTemplateText{
+			"ru": {"Места в организации закончились", "Места закончились", "В организации «{{.Org}}» заняты все {{.Seats}} мест типа «{{seat .SeatType}}». Новые участники будут оплачиваться сверх тарифа — добавьте места заранее.", "Управлять местами"},
+			"en": {"Your organization is out of seats", "Out of seats", "All {{.Seats}} {{seat .SeatType}} seats in \"{{.Org}}\" are taken. New members will be billed on top of your plan, so consider adding seats.", "Manage seats"},
+		},
+	},
+	"org_invoice": {
+		Accent: "#a855f7", Path: "/org/{{.OrgID}}/billing",
+		Sample: map[string]interface{}{"Org": "Школа №1", "OrgID": 1, "Invoice": "NMX-2026-000042", "Date": sampleNoticeDate},
+		Text: map[string]billingTemplateText{
+			"ru": {"Счёт на продление подписки", "Новый счёт", "Выставлен счёт {{.Invoice}} на продление подписки организации «{{.Org}}». Оплатите его до {{date .Date}}.", "Перейти к оплате"},
+			"en": {"Subscription renewal invoice", "New invoice", "Invoice {{.Invoice}} for renewing \"{{.Org}}\" has been issued. Please pay it by {{date .Date}}.", "Go to payment"},
+		},
+	},
+	"org_past_due": {
+		Accent: "#ef4444", Critical: true, Path: "/org/{{.OrgID}}/billing",
+		Sample: map[string]interface{}{"Org": "Школа №1", "OrgID": 1, "Invoice": "NMX-2026-000042", "Date": sampleNoticeDate},
+		Text: map[string]billingTemplateText{
+			"ru": {"Счёт не оплачен", "Счёт не оплачен", "Счёт {{.Invoice}} организации «{{.Org}}» не оплачен в срок. Пожалуйста, оплатите его до {{date .Date}}, чтобы избежать ограничений.", "Перейти к оплате"},
+			"en": {"Invoice overdue", "Invoice overdue", "Invoice {{.Invoice}} for \"{{.Org}}\" is overdue. Please pay it by {{date .Date}} to avoid restrictions.", "Go to payment"},
+		},
+	},
+	"org_reminder": {
+		Accent: "#ef4444", Critical: true, Path: "/org/{{.OrgID}}/billing",
+		Sample: map[string]interface{}{"Org": "Школа №1", "OrgID": 1, "Invoice": "NMX-2026-000042", "Date": sampleNoticeDate},
+		Text: map[string]billingTemplateText{
+			"ru": {"Напоминание об оплате", "Напоминание об оплате", "Счёт {{.Invoice}} организации «{{.Org}}» всё ещё не оплачен. Следующее напоминание — {{date .Date}}.", "Перейти к оплате"},
+			"en": {"Payment reminder", "Payment reminder", "Invoice {{.Invoice}} for \"{{.Org}}\" is still unpaid. The next reminder is on {{date .Date}}.", "Go to payment"},
+		},
+	},
+	"org_grace": {
+		Accent: "#ef4444", Critical: true, Path: "/org/{{.OrgID}}/billing",
+		Sample: map[string]interface{}{"Org": "Школа №1", "OrgID": 1, "Invoice": "NMX-2026-000042", "Date": sampleNoticeDate},
+		Text: map[string]billingTemplateText{
+			"ru": {"Организация в режиме только чтения", "Только чтение", "Счёт {{.Invoice}} не оплачен, организация «{{.Org}}» переведена в режим только для чтения до {{date .Date}}. Затем она перейдёт на бесплатный тариф.", "Перейти к оплате"},
+			"en": {"Organization is read-only", "Read-only mode", "Invoice {{.Invoice}} is unpaid, so \"{{.Org}}\" is read-only until {{date .Date}}. After that it moves to the free plan.", "Go to payment"},
+		},
+	},
+	"org_expired": {
+		Accent: "#ef4444", Critical: true, Path: "/org/{{.OrgID}}/billing",
+		Sample: map[string]interface{}{"Org": "Школа №1", "OrgID": 1},
+		Text: map[string]billingTemplateText{
+			"ru": {"Подписка организации отключена", "Подписка отключена", "Подписка организации «{{.Org}}» отключена из-за неоплаты, действует бесплатный тариф. Оплата счёта вернёт прежний тариф.", "Перейти к оплате"},
+			"en": {"Organization subscription ended", "Subscription ended", "The subscription of \"{{.Org}}\" ended because it wasn't paid, and the free plan applies. Paying the invoice restores your plan.", "Go to payment"},
+		},
+	},
+	"org_ended": {
+		Accent: "#f59e0b", Path: "/org/{{.OrgID}}/billing",
+		Sample: map[string]interface{}{"Org": "Школа №1", "OrgID": 1},
+		Text: map[string]billingTemplateText{
+			"ru": {"Подписка организации закончилась", "Подписка закончилась", "Подписка организации «{{.Org}}» закончилась, действует бесплатный тариф.", "Выбрать тариф"},
+			"en": {"Organization subscription ended", "Subscription ended", "The subscription of \"{{.Org}}\" has ended and the free plan applies.", "Choose a plan"},
+		},
+	},
+	"org_reactivated": {
+		Accent: "#22c55e", Path: "/org/{{.OrgID}}/billing",
+		Sample: map[string]interface{}{"Org": "Школа №1", "OrgID": 1},
+		Text: map[string]billingTemplateText{
+			"ru": {"Подписка организации снова активна", "Подписка снова активна", "Оплата получена, подписка организации «{{.Org}}» снова активна.", "Открыть организацию"},
+			"en": {"Organization subscription active again", "Subscription active again", "Payment received, the subscription of \"{{.Org}}\" is active again.", "Open organization"},
+		},
+	},
+	"payout_paid": {
+		Accent: "#22c55e", Path: "/settings/payouts",
+		Sample: map[string]interface{}{"Amount": int64(150000), "Destination": "ЮMoney •••• 6746"},
+		Text: map[string]billingTemplateText{
+			"ru": {"Выплата отправлена", "Выплата отправлена", "Выплата {{rub .Amount}} отправлена на {{.Destination}}.", "Открыть выплаты"},
+			"en": {"Payout sent", "Payout sent", "Your payout of {{rub .Amount}} was sent to {{.Destination}}.", "Open payouts"},
+		},
+	},
+	"payout_failed": {
+		Accent: "#ef4444", Path: "/settings/payouts",
+		Sample: map[string]interface{}{"Amount": int64(150000), "Destination": "ЮMoney •••• 6746", "Reason": "one_time_limit_exceeded"},
+		Text: map[string]billingTemplateText{
+			"ru": {"Выплата не прошла", "Выплата не прошла", "Выплата {{rub .Amount}} на {{.Destination}} не прошла. Сумма вернулась на баланс, запросите выплату повторно.{{if .Reason}}\n\nПричина: {{.Reason}}{{end}}", "Открыть выплаты"},
+			"en": {"Payout failed", "Payout failed", "Your payout of {{rub .Amount}} to {{.Destination}} failed. The amount is back on your balance, please request it again.{{if .Reason}}\n\nReason: {{.Reason}}{{end}}", "Open payouts"},
+		},
+	},
+	"payout_rejected": {
+		Accent: "#ef4444", Path: "/settings/payouts",
+		Sample: map[string]interface{}{"Amount": int64(150000), "Reason": ""},
+		Text: map[string]billingTemplateText{
+			"ru": {"Выплата отклонена", "Выплата отклонена", "Запрос на выплату {{rub .Amount}} отклонён. Сумма вернулась на баланс.{{if .Reason}}\n\nПричина: {{.Reason}}{{end}}", "Открыть выплаты"},
+			"en": {"Payout rejected", "Payout rejected", "Your payout request of {{rub .Amount}} was rejected. The amount is back on your balance.{{if .Reason}}\n\nReason: {{.Reason}}{{end}}", "Open payouts"},
+		},
+	},
+}
+
+var sampleNoticeDate = time.Date(2026, 11, 15, 12, 0, 0, 0, time.UTC)
+
+// BillingNotificationPreference holds a user's billing channels. Users
+// without a row get email and in-app, and Telegram when they enabled
+// Telegram notifications in their settings.
+type BillingNotificationPreference struct {
+	ID        uint      `gorm:"primaryKey" json:"-"`
+	UserID    uint      `gorm:"uniqueIndex" json:"user_id"`
+	Email     bool      `json:"email"`
+	Telegram  bool      `json:"telegram"`
+	InApp     bool      `json:"in_app"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// BillingNotificationLog records sent notices. DedupeKey is set for
+// reminders so each goes out once.
+type BillingNotificationLog struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"index" json:"user_id"`
+	Event     string    `gorm:"size:40" json:"event"`
+	DedupeKey *string   `gorm:"uniqueIndex;size:150" json:"dedupe_key,omitempty"`
+	Language  string    `gorm:"size:5" json:"language"`
+	Channels  string    `gorm:"size:40" json:"channels"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type renderedBillingNotice struct {
+	Subject     string `json:"subject"`
+	Title       string `json:"title"`
+	Text        string `json:"text"`
+	HTML        string `json:"html"`
+	ActionURL   string `json:"action_url"`
+	ActionLabel string `json:"action_label"`
+}
+
+// billingLanguage maps a language setting such as "en-US" to a template
+// language, Russian by default.
+func billingLanguage(setting string) string {
+	setting = strings.ToLower(strings.TrimSpace(setting))
+	for _, lang := range billingLanguages {
+		if setting == lang || strings.HasPrefix(setting, lang+"-") || strings.HasPrefix(setting, lang+"_") {
+			return lang
+		}
+	}
+	return "ru"
+}
+
+func userBillingLanguage(uid uint) string {
+	var settings Settings
+	if db.Select("language").Where("user_id = ?", uid).First(&settings).Error == nil && settings.Language != "" {
+		return billingLanguage(settings.Language)
+	}
+	var userSettings UserSettings
+	if db.Select("language").Where("user_id = ?", uid).First(&userSettings).Error == nil {
+		return billingLanguage(userSettings.Language)
+	}
+	return "ru"
+}
+
+func userBillingPreference(uid uint) BillingNotificationPreference {
+	var pref BillingNotificationPreference
+	if db.Where("user_id = ?", uid).First(&pref).Error == nil {
+		return pref
+	}
+	pref = BillingNotificationPreference{UserID: uid, Email: true, InApp: true}
+	var settings UserSettings
+	if db.Select("telegram_notifications").Where("user_id = ?", uid).First(&settings).Error == nil {
+		pref.Telegram = settings.TelegramNotifications
+	}
+	return pref
+}
+
+func billingTemplateFuncs(lang string) template.FuncMap {
+	return template.FuncMap{
+		"date": func(t time.Time) string {
+			if lang == "en" {
+				return t.Format("January 2, 2006")
+			}
+			return t.Format("02.01.2006")
+		},
+		"rub": formatRub,
+		// money is rub with the currency code for payments in other currencies
+		"money": func(amount int64, currency string) string {
+			if currency == "" || currency == "RUB" {
+				return formatRub(amount)
+			}
+			return formatRub(amount) + " " + currency
+		},
+		"seat": func(seatType string) string {
+			labels := billingSeatLabels[seatType]
+			if labels[lang] == "" {
+				return seatType
+			}
+			return labels[lang]
+		},
+	}
+}
+
+var billingSeatLabels = map[string]map[string]string{
+	"student_editor": {"ru": "ученик/редактор", "en": "student/editor"},
+	"staff":          {"ru": "сотрудник", "en": "staff"},
+}
+
+func executeBillingText(name, text, lang string, data map[string]interface{}) (string, error) {
+	tmpl, err := template.New(name).Funcs(billingTemplateFuncs(lang)).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+var billingEmailLayout = htmltemplate.Must(htmltemplate.New("billing_email").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="UTF-8"></head>
+<body style="font-family: Arial, sans-serif; background-color: #1a1a2e; color: #ffffff; padding: 20px;">
+<div style="max-width: 600px; margin: 0 auto; background-color: #16213e; border-radius: 10px; padding: 30px;">
+<h1 style="color: {{.Accent}};">{{.Title}}</h1>
+<p>{{.Greeting}}</p>
+{{range .Paragraphs}}<p>{{.}}</p>
+{{end}}<a href="{{.ActionURL}}" style="display: inline-block; background-color: #a855f7; color: white; padding: 12px 24px; text-decoration: none; border-radius: 6px; margin-top: 15px;">{{.ActionLabel}}</a>
+<hr style="border-color: #4a4a6a;">
+<p style="color: #888;">{{.Footer}}</p>
+</div>
+</body>
+</html>
+`))
+
+// renderBillingNotice renders event for a user named username.
+func renderBillingNotice(event, lang, username string, data map[string]interface{}) (*renderedBillingNotice, error) {
+	tmpl, ok := billingTemplates[event]
+	if !ok {
+		return nil, fmt.Errorf("unknown billing event %q", event)
+	}
+	text, ok := tmpl.Text[lang]
+	if !ok {
+		text = tmpl.Text["ru"]
+	}
+	// Optional fields the caller left out render as their zero values
+	filled := make(map[string]interface{}, len(tmpl.Sample))
+	for k, v := range tmpl.Sample {
+		filled[k] = reflect.Zero(reflect.TypeOf(v)).Interface()
+	}
+	for k, v := range data {
+		filled[k] = v
+	}
+	data = filled
+
+	out := &renderedBillingNotice{}
+	for _, part := range []struct {
+		dst *string
+		src string
+	}{
+		{&out.Subject, text.Subject}, {&out.Title, text.Title}, {&out.Text, text.Body},
+		{&out.ActionLabel, text.Action}, {&out.ActionURL, billingSiteURL + tmpl.Path},
+	} {
+		rendered, err := executeBillingText(event, part.src, lang, data)
+		if err != nil {
+			return nil, fmt.Errorf("%s/%s: %w", event, lang, err)
+		}
+		*part.dst = rendered
+	}
+
+	greeting, footer := "Здравствуйте, "+username+"!", "Если у вас есть вопросы, свяжитесь с нашей поддержкой."
+	if lang == "en" {
+		greeting, footer = "Hello, "+username+"!", "If you have any questions, please contact our support."
+	}
+	var html bytes.Buffer
+	err := billingEmailLayout.Execute(&html, map[string]interface{}{
+		"Accent":      htmltemplate.CSS(tmpl.Accent),
+		"Title":       out.Title,
+		"Greeting":    greeting,
+		"Paragraphs":  strings.Split(out.Text, "\n\n"),
+		"ActionURL":   out.ActionURL,
+		"ActionLabel": out.ActionLabel,
+		"Footer":      footer,
+	})
+	if err != nil {
+		return nil, err
+	}
+	out.HTML = html.String()
+	return out, nil
+}
+
+// notifyBilling sends a billing event to uid. A non-empty dedupeKey that
+// was already used makes this a no-op. Callers usually run it in a
+// goroutine.
+func notifyBilling(uid uint, event string, data map[string]interface{}, dedupeKey string) {
+	if db == nil {
+		return
+	}
+	tmpl, ok := billingTemplates[event]
+	if !ok {
+		log.Printf("[BillingNotify] Unknown event %s", event)
+		return
+	}
+	var user User
+	if db.Select("id", "username", "email").First(&user, uid).RowsAffected == 0 {
+		return
+	}
+
+	entry := BillingNotificationLog{UserID: uid, Event: event, Language: userBillingLanguage(uid)}
+	if dedupeKey != "" {
+		entry.DedupeKey = &dedupeKey
+		result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&entry)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return
+		}
+	}
+
+	notice, err := renderBillingNotice(event, entry.Language, user.Username, data)
+	if err != nil {
+		log.Printf("[BillingNotify] Failed to render %s for user %d: %v", event, uid, err)
+		return
+	}
+
+	pref := userBillingPreference(uid)
+	var channels []string
+	if pref.Email && emailService != nil {
+		if user.Email == nil || *user.Email == "" {
+			log.Printf("[BillingNotify] User %d has no email address, %s is not emailed", uid, event)
+		} else if emailService.SendEmail(*user.Email, notice.Subject, notice.HTML) == nil {
+			channels = append(channels, "email")
+		}
+	}
+	message := notice.Title + "\n\n" + notice.Text
+	if pref.Telegram {
+		sendTelegramNotification(uid, message+"\n\n"+notice.ActionURL)
+		channels = append(channels, "telegram")
+	}
+	if pref.InApp || tmpl.Critical || len(channels) == 0 {
+		db.Create(&TelegramNotification{
+			UserID:         uid,
+			Type:           "billing",
+			Content:        message,
+			SentToTelegram: pref.Telegram,
+			SentToSite:     true,
+			CreatedAt:      time.Now(),
+		})
+		channels = append(channels, "in_app")
+	}
+
+	entry.Channels = strings.Join(channels, ",")
+	if entry.ID != 0 {
+		db.Model(&entry).Update("channels", entry.Channels)
+	} else {
+		db.Create(&entry)
+	}
+}
+
+func getBillingNotificationPreferencesHandler(c *gin.Context) {
+	uid, ok := getUserIDFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"preferences": userBillingPreference(uid), "language": userBillingLanguage(uid)})
+}
+
+func updateBillingNotificationPreferencesHandler(c *gin.Context) {
+	uid, ok := getUserIDFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	var req struct {
+		Email    *bool `json:"email"`
+		Telegram *bool `json:"telegram"`
+		InApp    *bool `json:"in_app"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	pref := userBillingPreference(uid)
+	if req.Email != nil {
+		pref.Email = *req.Email
+	}
+	if req.Telegram != nil {
+		pref.Telegram = *req.Telegram
+	}
+	if req.InApp != nil {
+		pref.InApp = *req.InApp
+	}
+	pref.UpdatedAt = time.Now()
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"email", "telegram", "in_app", "updated_at"}),
+	}).Create(&pref).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save preferences"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"preferences": pref})
+}
+
+// getBillingNotificationTemplatesHandler lists the billing events for the
+// admin preview.
+func getBillingNotificationTemplatesHandler(c *gin.Context) {
+	events := make([]gin.H, 0, len(billingTemplates))
+	for name, tmpl := range billingTemplates {
+		events = append(events, gin.H{"event": name, "critical": tmpl.Critical, "sample": tmpl.Sample})
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i]["event"].(string) < events[j]["event"].(string) })
+	c.JSON(http.StatusOK, gin.H{"events": events, "languages": billingLanguages})
+}
+
+// previewBillingNotificationHandler renders an event with its sample data,
+// or with data posted as JSON. format=html returns the email itself.
+func previewBillingNotificationHandler(c *gin.Context) {
+	event := c.Param("event")
+	tmpl, ok := billingTemplates[event]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown event"})
+		return
+	}
+	data := tmpl.Sample
+	if c.Request.Method == http.MethodPost {
+		var posted map[string]interface{}
+		if err := c.ShouldBindJSON(&posted); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		data = make(map[string]interface{}, len(tmpl.Sample))
+		for k, v := range tmpl.Sample {
+			data[k] = v
+		}
+		for k, v := range posted {
+			// JSON numbers arrive as float64; dates as RFC 3339 strings
+			if s, ok := v.(string); ok {
+				if t, err := time.Parse(time.RFC3339, s); err == nil {
+					v = t
+				}
+			}
+			if f, ok := v.(float64); ok && f == float64(int64(f)) {
+				v = int64(f)
+			}
+			data[k] = v
+		}
+	}
+
+	notice, err := renderBillingNotice(event, billingLanguage(c.DefaultQuery("lang", "ru")), "username", data)
+	if err != nil {
+		var execErr template.ExecError
+		if errors.As(err, &execErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if c.Query("format") == "html" {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(notice.HTML))
+		return
+	}
+	c.JSON(http.StatusOK, notice)
+}
+
+// checkOrgSeatLimit tells the org admins once per billing period when the
+// active members of a seat type fill the seats the subscription reserves.
+func checkOrgSeatLimit(orgID int, seatType string) {
+	var sub OrgSubscription
+	if db.Where("org_id = ? AND status IN ?", orgID, orgServingStatuses).First(&sub).Error != nil {
+		return
+	}
+	seats := 0
+	switch seatType {
+	case "student_editor":
+		seats = sub.SeatsStudentEditor
+	case "staff":
+		seats = sub.SeatsStaff
+	}
+	if seats <= 0 {
+		return
+	}
+	var used int64
+	db.Model(&OrgMember{}).Where("org_id = ? AND seat_type = ? AND state = ?", orgID, seatType, "active").Count(&used)
+	if used < int64(seats) {
+		return
+	}
+	var org Org
+	db.Select("id", "name").First(&org, orgID)
+	data := map[string]interface{}{"Org": org.Name, "OrgID": orgID, "SeatType": seatType, "Seats": seats}
+	for _, uid := range orgAdminIDs(orgID) {
+		notifyBilling(uid, "seat_limit_reached", data,
+			fmt.Sprintf("seat_limit:%d:%s:%d:%s:%d", orgID, seatType, seats, sub.EndsAt.Format("2006-01-02"), uid))
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBillingTemplatesRender(t *testing.T) {
+	for event, tmpl := range billingTemplates {
+		for _, lang := range billingLanguages {
+			notice, err := renderBillingNotice(event, lang, "alice", tmpl.Sample)
+			if err != nil {
+				t.Errorf("%s/%s: %v", event, lang, err)
+				continue
+			}
+			if notice.Subject == "" || notice.Text == "" || !strings.HasPrefix(notice.ActionURL, billingSiteURL+"/") {
+				t.Errorf("%s/%s: incomplete notice %+v", event, lang, notice)
+			}
+			if strings.Contains(notice.HTML, "<no value>") || strings.Contains(notice.Text, "{{") {
+				t.Errorf("%s/%s: unrendered placeholder", event, lang)
+			}
+		}
+	}
+}
+
+func TestRenderBillingNoticeFillsMissingData(t *testing.T) {
+	notice, err := renderBillingNotice("refund_issued", "en", "alice", map[string]interface{}{"Amount": int64(12345)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(notice.Text, formatRub(12345)) {
+		t.Errorf("text = %q", notice.Text)
+	}
+}
+
+func TestRenderBillingNoticeEscapesHTML(t *testing.T) {
+	data := map[string]interface{}{"Org": `<script>alert(1)</script>`, "OrgID": 3, "SeatType": "staff", "Seats": 5}
+	notice, err := renderBillingNotice("seat_limit_reached", "ru", "bob", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(notice.HTML, "<script>") {
+		t.Error("org name was not escaped in the email")
+	}
+	if notice.ActionURL != billingSiteURL+"/org/3/billing" {
+		t.Errorf("action url = %s", notice.ActionURL)
+	}
+	if !strings.Contains(notice.Text, "сотрудник") {
+		t.Errorf("seat type label missing: %q", notice.Text)
+	}
+}
+
+func TestBillingLanguage(t *testing.T) {
+	for setting, want := range map[string]string{
+		"en": "en", "EN-us": "en", "en_GB": "en", "ru": "ru", "ru-RU": "ru", "": "ru", "de": "ru", "english": "ru",
+	} {
+		if got := billingLanguage(setting); got != want {
+			t.Errorf("billingLanguage(%q) = %q, want %q", setting, got, want)
+		}
+	}
+}
+
+// Users without an address are not emailed at a made-up one; they still
+// get the notice in the app.
+func TestNotifyBillingSkipsEmailWithoutAddress(t *testing.T) {
+	testDB(t, &User{}, &Settings{}, &UserSettings{}, &BillingNotificationLog{}, &BillingNotificationPreference{}, &TelegramNotification{})
+	saved := emailService
+	t.Cleanup(func() { emailService = saved })
+	emailService = &EmailService{} // disabled: sends succeed without SMTP
+
+	address := "alice@example.com"
+	alice := User{Username: "alice", Password: "x", Email: &address}
+	bob := User{Username: "bob", Password: "x"}
+	db.Create(&alice)
+	db.Create(&bob)
+	for user, want := range map[uint]string{alice.ID: "email,in_app", bob.ID: "in_app"} {
+		notifyBilling(user, "refund_issued", map[string]interface{}{"Amount": int64(50000)}, "")
+		var entry BillingNotificationLog
+		if err := db.Where("user_id = ?", user).First(&entry).Error; err != nil {
+			t.Fatal(err)
+		}
+		if entry.Channels != want {
+			t.Errorf("user %d notified through %q, want %q", user, entry.Channels, want)
+		}
+	}
+}
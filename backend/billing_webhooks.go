@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// YooKassaWebhookEvent is the inbox of raw payment notifications, named for
+// the provider it started with. Providers send each event for an object
+// once (and retry until they get a 200), so the event name and object id
+// make a stable key for deduplication.
+type YooKassaWebhookEvent struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	EventKey      string     `gorm:"uniqueIndex;size:200" json:"event_key"`
+	Provider      string     `gorm:"size:20;default:'yookassa';index" json:"provider"`
+	Event         string     `gorm:"size:60;index" json:"event"`
+	ObjectID      string     `gorm:"size:64;index" json:"object_id"`
+	TransactionID *uint      `gorm:"index" json:"transaction_id,omitempty"`
+	Payload       string     `gorm:"type:text" json:"payload"`
+	RemoteIP      string     `gorm:"size:64" json:"remote_ip"`
+	Status        string     `gorm:"size:20;default:'received';index" json:"status"` // received, processed, ignored, rejected, failed
+	Attempts      int        `gorm:"default:0" json:"attempts"`
+	Error         string     `gorm:"type:text" json:"error,omitempty"`
+	ProcessedAt   *time.Time `json:"processed_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// yookassaNotificationRanges are the addresses YooKassa sends notifications
+// from. They are only enforced with YOOKASSA_WEBHOOK_CHECK_IP=1 since the
+// payment is re-fetched from the API anyway and proxies may hide the peer.
+var yookassaNotificationRanges = []netip.Prefix{
+	netip.MustParsePrefix("185.71.76.0/27"),
+	netip.MustParsePrefix("185.71.77.0/27"),
+	netip.MustParsePrefix("77.75.153.0/25"),
+	netip.MustParsePrefix("77.75.156.11/32"),
+	netip.MustParsePrefix("77.75.156.35/32"),
+	netip.MustParsePrefix("77.75.154.128/25"),
+	netip.MustParsePrefix("2a02:5180::/32"),
+}
+
+func yookassaSourceAllowed(ip string) bool {
+	if os.Getenv("YOOKASSA_WEBHOOK_CHECK_IP") != "1" {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range yookassaNotificationRanges {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type yookassaNotification struct {
+	Type   string `json:"type"`
+	Event  string `json:"event"`
+	Object struct {
+		ID string `json:"id"`
+	} `json:"object"`
+}
+
+// GetPayment fetches the payment from the API. Notifications are not signed,
+// so this is what proves a webhook is genuine.
+func (yk *YooKassaService) GetPayment(ctx context.Context, paymentID string) (*YooKassaPaymentResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, yk.APIEndpoint+"/payments/"+url.PathEscape(paymentID), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(yk.ShopID+":"+yk.SecretKey)))
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, paymentWebhookMaxBody))
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: payment %s not found", errPaymentRejected, paymentID)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("yookassa error %d: %s", resp.StatusCode, string(body))
+	}
+
+	var payment YooKassaPaymentResponse
+	if err := json.Unmarshal(body, &payment); err != nil {
+		return nil, err
+	}
+	if payment.ID != paymentID {
+		return nil, fmt.Errorf("%w: asked for payment %s, got %s", errPaymentRejected, paymentID, payment.ID)
+	}
+	return &payment, nil
+}
+
+// CreateDonationPayment starts a payment for a CreatorDonation. The webhook
+// finds the donation through the donation_id metadata.
+func (yk *YooKassaService) CreateDonationPayment(donationID uint, amount float64, description string, returnURL string) (*YooKassaPaymentResponse, error) {
+	paymentReq := YooKassaPaymentRequest{
+		Capture:     true,
+		Description: description,
+		Confirmation: map[string]string{
+			"type":       "redirect",
+			"return_url": returnURL,
+		},
+		Metadata: map[string]interface{}{
+			"donation_id": strconv.FormatUint(uint64(donationID), 10),
+		},
+		Receipt: yookassaReceiptForDonation(donationID),
+	}
+	paymentReq.Amount.Value = fmt.Sprintf("%.2f", amount)
+	paymentReq.Amount.Currency = "RUB"
+
+	payloadBytes, err := json.Marshal(paymentReq)
+	if err != nil {
+		return nil, fmt.Errorf("marshal error: %w", err)
+	}
+	req, err := http.NewRequest("POST", yk.APIEndpoint+"/payments", bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(yk.ShopID+":"+yk.SecretKey)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotence-Key", fmt.Sprintf("donation-%d", donationID))
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("yookassa error %d: %s", resp.StatusCode, string(body))
+	}
+	var paymentResp YooKassaPaymentResponse
+	if err := json.Unmarshal(body, &paymentResp); err != nil {
+		return nil, err
+	}
+	return &paymentResp, nil
+}
+
+// parseYooKassaAmount turns "199.00" into kopecks without going through
+// floating point.
+func parseYooKassaAmount(value string) (int64, error) {
+	whole, frac, _ := strings.Cut(strings.TrimSpace(value), ".")
+	if whole == "" || len(frac) > 2 || strings.ContainsAny(whole, "+-") {
+		return 0, fmt.Errorf("invalid amount %q", value)
+	}
+	for len(frac) < 2 {
+		frac += "0"
+	}
+	rub, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || rub < 0 {
+		return 0, fmt.Errorf("invalid amount %q", value)
+	}
+	kop, err := strconv.ParseInt(frac, 10, 64)
+	if err != nil || kop < 0 {
+		return 0, fmt.Errorf("invalid amount %q", value)
+	}
+	return rub*100 + kop, nil
+}
+
+func rubToKopecks(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+func metadataID(metadata map[string]interface{}, key string) (uint, bool) {
+	raw, ok := metadata[key]
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(fmt.Sprint(raw), 10, 32)
+	if err != nil || id == 0 {
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// yookassaWebhookHandler takes YooKassa notifications into the inbox.
+func yookassaWebhookHandler(c *gin.Context) {
+	ip := c.ClientIP()
+	if !yookassaSourceAllowed(ip) {
+		log.Printf("[Billing] Webhook from unexpected address %s", ip)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, paymentWebhookMaxBody))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload"})
+		return
+	}
+	notification, err := (&yookassaProvider{}).ParseWebhook(c.Request, body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload"})
+		return
+	}
+
+	event := YooKassaWebhookEvent{
+		EventKey: notification.Event + ":" + notification.PaymentID,
+		Provider: "yookassa",
+		Event:    notification.Event,
+		ObjectID: notification.PaymentID,
+		Payload:  string(body),
+		RemoteIP: ip,
+		Status:   "received",
+	}
+	receivePaymentEvent(c, &event)
+}
+
+// processPaymentEvent verifies the event against the provider's API and
+// applies it. The event row is locked for the whole transaction, so
+// concurrent deliveries and replays apply an event once.
+func processPaymentEvent(ctx context.Context, event *YooKassaWebhookEvent) error {
+	switch event.Event {
+	case "payment.succeeded", "payment.canceled":
+	default:
+		return finishPaymentEvent(event, "ignored", nil)
+	}
+	provider := paymentProviderByName(event.Provider)
+	if provider == nil {
+		return finishPaymentEvent(event, "", fmt.Errorf("payment provider %q is not configured", event.Provider))
+	}
+	payment, err := verifyProviderPayment(ctx, provider, event.Event, event.ObjectID)
+	if err != nil {
+		return finishPaymentEvent(event, "", err)
+	}
+
+	var after func()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var locked YooKassaWebhookEvent
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&locked, event.ID).Error; err != nil {
+			return err
+		}
+		if locked.Status == "processed" {
+			*event = locked
+			return nil
+		}
+
+		var applyErr error
+		if donationID, ok := metadataID(payment.Metadata, "donation_id"); ok {
+			applyErr = applyDonationPayment(tx, donationID, provider.Name(), payment)
+		} else if transactionID, ok := metadataID(payment.Metadata, "transaction_id"); ok {
+			event.TransactionID = &transactionID
+			after, applyErr = applyPaymentTransaction(tx, transactionID, provider.Name(), payment)
+		} else {
+			applyErr = fmt.Errorf("%w: payment %s has no known metadata", errPaymentRejected, payment.ID)
+		}
+		if applyErr != nil {
+			return applyErr
+		}
+
+		now := time.Now()
+		event.Status = "processed"
+		event.Error = ""
+		event.ProcessedAt = &now
+		return tx.Model(&YooKassaWebhookEvent{}).Where("id = ?", event.ID).Updates(map[string]interface{}{
+			"status":         event.Status,
+			"error":          "",
+			"transaction_id": event.TransactionID,
+			"attempts":       gorm.Expr("attempts + 1"),
+			"processed_at":   now,
+		}).Error
+	})
+	if err != nil {
+		return finishPaymentEvent(event, "", err)
+	}
+	if after != nil {
+		after()
+	}
+	return nil
+}
+
+// finishPaymentEvent records an outcome that is not a successful apply.
+func finishPaymentEvent(event *YooKassaWebhookEvent, status string, err error) error {
+	if status == "" {
+		status = "failed"
+		if errors.Is(err, errPaymentRejected) {
+			status = "rejected"
+		}
+	}
+	updates := map[string]interface{}{
+		"status":   status,
+		"attempts": gorm.Expr("attempts + 1"),
+		"error":    "",
+	}
+	if err != nil {
+		updates["error"] = err.Error()
+		log.Printf("[Billing] Webhook %s %s: %v", event.EventKey, status, err)
+	}
+	if status == "ignored" {
+		updates["processed_at"] = time.Now()
+	}
+	db.Model(&YooKassaWebhookEvent{}).Where("id = ?", event.ID).Updates(updates)
+	event.Status = status
+	if err != nil {
+		event.Error = err.Error()
+	}
+	return err
+}
+
+// applyPaymentTransaction settles a PremiumTransaction. It returns the side
+// effects to run once the transaction has committed.
+func applyPaymentTransaction(tx *gorm.DB, transactionID uint, provider string, payment *providerPayment) (func(), error) {
+	var transaction PremiumTransaction
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&transaction, transactionID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("%w: transaction %d not found", errPaymentRejected, transactionID)
+		}
+		return nil, err
+	}
+	if transaction.PaymentProvider != "" && transaction.PaymentProvider != provider {
+		return nil, fmt.Errorf("%w: transaction %d is paid through %s", errPaymentRejected, transaction.ID, transaction.PaymentProvider)
+	}
+	if transaction.ProviderPaymentID != "" && transaction.ProviderPaymentID != payment.ID {
+		return nil, fmt.Errorf("%w: transaction %d belongs to payment %s", errPaymentRejected, transaction.ID, transaction.ProviderPaymentID)
+	}
+	if err := checkPaymentAmount(payment, rubToKopecks(transaction.AmountRub), transaction.Currency); err != nil {
+		return nil, err
+	}
+
+	if payment.Status == "canceled" {
+		if transaction.Status != "pending" {
+			return nil, nil
+		}
+		if err := tx.Model(&transaction).Updates(map[string]interface{}{
+			"status":              "failed",
+			"provider_payment_id": payment.ID,
+		}).Error; err != nil {
+			return nil, err
+		}
+		if err := tx.Model(&PostBoost{}).Where("transaction_id = ? AND status = ?", transaction.ID, "pending").
+			Update("status", "cancelled").Error; err != nil {
+			return nil, err
+		}
+		if transaction.SubscriptionID == nil {
+			return nil, nil
+		}
+		// Renewals and retries carry the subscription; a decline starts dunning
+		subscriptionID := *transaction.SubscriptionID
+		return func() { premiumRenewalCanceled(subscriptionID) }, nil
+	}
+
+	if transaction.Status == "succeeded" {
+		// Already settled, e.g. by a synchronous auto-renewal
+		return nil, nil
+	}
+	now := time.Now()
+	if err := tx.Model(&transaction).Updates(map[string]interface{}{
+		"status":              "succeeded",
+		"provider_payment_id": payment.ID,
+		"completed_at":        now,
+	}).Error; err != nil {
+		return nil, err
+	}
+	transaction.ProviderPaymentID = payment.ID
+	transaction.CompletedAt = &now
+	if err := postPremiumPaymentLedger(tx, &transaction); err != nil {
+		return nil, err
+	}
+	if err := setTransactionInvoiceStatus(tx, transaction.ID, "paid", now); err != nil {
+		return nil, err
+	}
+
+	var gift GiftSubscription
+	if tx.Preload("Plan").Where("transaction_id = ?", transaction.ID).Limit(1).Find(&gift); gift.ID != 0 {
+		// The gift becomes redeemable now that its transaction has succeeded
+		log.Printf("[Billing] Gift transaction %d paid by user %d", transaction.ID, transaction.UserID)
+		if gift.ToUserID == nil {
+			return nil, nil
+		}
+		var from User
+		tx.Select("id", "username").First(&from, gift.FromUserID)
+		return func() {
+			notifyBilling(*gift.ToUserID, "gift_received", map[string]interface{}{
+				"Plan": gift.Plan.Name, "Days": gift.DurationDays, "From": from.Username, "Code": gift.Code, "Message": gift.Message,
+			}, fmt.Sprintf("gift_received:%d", gift.ID))
+		}, nil
+	}
+	var count int64
+	tx.Model(&PostBoost{}).Where("transaction_id = ?", transaction.ID).Count(&count)
+	if count > 0 {
+		return nil, activateBoostFromWebhook(tx, transaction.ID)
+	}
+	return activatePremiumFromPayment(tx, &transaction, payment, now)
+}
+
+func activatePremiumFromPayment(tx *gorm.DB, transaction *PremiumTransaction, payment *providerPayment, now time.Time) (func(), error) {
+	var plan PremiumPlan
+	if err := tx.First(&plan, transaction.PlanID).Error; err != nil {
+		return nil, fmt.Errorf("%w: plan %d for transaction %d: %v", errPaymentRejected, transaction.PlanID, transaction.ID, err)
+	}
+
+	periodEnd := now.AddDate(0, 1, 0)
+	if plan.BillingCycle == "quarterly" {
+		periodEnd = now.AddDate(0, 3, 0)
+	} else if plan.BillingCycle == "annual" {
+		periodEnd = now.AddDate(1, 0, 0)
+	}
+
+	paymentMethodID := payment.MethodID
+	if paymentMethodID != "" {
+		log.Printf("[Billing] Saved payment method %s for user %d", paymentMethodID, transaction.UserID)
+	}
+
+	var existingSub PremiumSubscription
+	reactivated := false
+	if tx.Where("user_id = ?", transaction.UserID).First(&existingSub).RowsAffected > 0 {
+		reactivated = existingSub.Status == "past_due" || existingSub.Status == "grace"
+		updates := withDunningCleared(map[string]interface{}{
+			"plan_id":              transaction.PlanID,
+			"current_period_start": now,
+			"current_period_end":   periodEnd,
+			"auto_renew":           true,
+			"cancel_at_period_end": false,
+			"cancelled_at":         nil,
+			"currency":             ledgerCurrency(transaction.Currency),
+		})
+		if paymentMethodID != "" {
+			// Renewals go through the provider that holds the method
+			updates["payment_method_id"] = paymentMethodID
+			updates["payment_provider"] = transaction.PaymentProvider
+		}
+		if err := tx.Model(&existingSub).Updates(updates).Error; err != nil {
+			return nil, err
+		}
+		if err := tx.Model(transaction).Update("subscription_id", existingSub.ID).Error; err != nil {
+			return nil, err
+		}
+	} else {
+		sub := PremiumSubscription{
+			UserID:             transaction.UserID,
+			PlanID:             transaction.PlanID,
+			Status:             "active",
+			CurrentPeriodStart: now,
+			CurrentPeriodEnd:   periodEnd,
+			AutoRenew:          true,
+			PaymentMethodID:    paymentMethodID,
+			PaymentProvider:    transaction.PaymentProvider,
+			Currency:           ledgerCurrency(transaction.Currency),
+		}
+		if err := tx.Create(&sub).Error; err != nil {
+			return nil, err
+		}
+		if err := tx.Model(transaction).Update("subscription_id", sub.ID).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("Premium subscription activated for user %d, plan %d", transaction.UserID, transaction.PlanID)
+	userID := transaction.UserID
+	return func() {
+		go notifyBilling(userID, "payment_succeeded", map[string]interface{}{
+			"Plan": plan.Name, "Amount": rubToKopecks(transaction.AmountRub), "Currency": ledgerCurrency(transaction.Currency),
+		}, "")
+		if promoAllowsReferralBonus(transaction.PromoCodeID) {
+			go grantReferralBonus(userID, 7, "premium_subscription")
+		}
+		if reactivated {
+			notifyPremiumDunning(&PremiumSubscription{UserID: userID, Plan: plan}, "reactivated", now)
+		}
+	}, nil
+}
+
+func applyDonationPayment(tx *gorm.DB, donationID uint, provider string, payment *providerPayment) error {
+	var donation CreatorDonation
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&donation, donationID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("%w: donation %d not found", errPaymentRejected, donationID)
+		}
+		return err
+	}
+	if donation.PaymentID != "" && donation.PaymentID != payment.ID {
+		return fmt.Errorf("%w: donation %d belongs to payment %s", errPaymentRejected, donation.ID, donation.PaymentID)
+	}
+	if provider != "yookassa" {
+		return fmt.Errorf("%w: donations are paid through yookassa, not %s", errPaymentRejected, provider)
+	}
+	if err := checkPaymentAmount(payment, rubToKopecks(donation.AmountRub), "RUB"); err != nil {
+		return err
+	}
+	if donation.Status != "pending" {
+		return nil
+	}
+	if payment.Status == "canceled" {
+		return tx.Model(&donation).Updates(map[string]interface{}{
+			"status":     "failed",
+			"payment_id": payment.ID,
+		}).Error
+	}
+	now := time.Now()
+	if err := tx.Model(&donation).Updates(map[string]interface{}{
+		"status":     "succeeded",
+		"payment_id": payment.ID,
+		"paid_at":    now,
+	}).Error; err != nil {
+		return err
+	}
+	donation.PaymentID = payment.ID
+	donation.PaidAt = &now
+	return postDonationLedger(tx, &donation, now)
+}
+
+// getYooKassaWebhookEventsHandler lists inbox events for admins, newest
+// first, optionally filtered by status and provider.
+func getYooKassaWebhookEventsHandler(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	query := db.Order("id DESC").Limit(limit)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if provider := c.Query("provider"); provider != "" {
+		query = query.Where("provider = ?", provider)
+	}
+	var events []YooKassaWebhookEvent
+	query.Find(&events)
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
+
+// replayYooKassaWebhookEventHandler runs an inbox event through processing
+// again. Events that were already applied stay applied.
+func replayYooKassaWebhookEventHandler(c *gin.Context) {
+	uid, _ := getUserIDFromContext(c)
+	var event YooKassaWebhookEvent
+	if err := db.First(&event, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
+		return
+	}
+	if event.Status == "processed" {
+		c.JSON(http.StatusOK, gin.H{"status": event.Status, "event": event})
+		return
+	}
+
+	err := processPaymentEvent(c.Request.Context(), &event)
+	details, _ := json.Marshal(map[string]interface{}{"event_key": event.EventKey, "status": event.Status})
+	logExtendedAudit(uid, "yookassa_webhook_replay", "yookassa_webhook_event", strconv.FormatUint(uint64(event.ID), 10), "admin", string(details), c.ClientIP(), c.Request.UserAgent())
+
+	db.First(&event, event.ID)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "event": event})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": event.Status, "event": event})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeYooKassa serves GET /payments/{id} from a fixed set of payments and
+// insists on the shop credentials, like the real API.
+type fakeYooKassa struct {
+	payments map[string]map[string]interface{}
+	paths    []string
+}
+
+func (f *fakeYooKassa) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.paths = append(f.paths, r.URL.EscapedPath())
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("shop:secret"))
+	if r.Header.Get("Authorization") != want {
+		http.Error(w, `{"type":"error","code":"invalid_credentials"}`, http.StatusUnauthorized)
+		return
+	}
+	id, ok := strings.CutPrefix(r.URL.Path, "/payments/")
+	if r.Method != http.MethodGet || !ok {
+		http.Error(w, `{"type":"error","code":"not_found"}`, http.StatusNotFound)
+		return
+	}
+	if id == "broken" {
+		http.Error(w, `{"type":"error","code":"internal_server_error"}`, http.StatusInternalServerError)
+		return
+	}
+	payment, ok := f.payments[id]
+	if !ok {
+		http.Error(w, `{"type":"error","code":"not_found"}`, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payment)
+}
+
+func fakePayment(id, status string, paid bool, value, currency string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":       id,
+		"status":   status,
+		"paid":     paid,
+		"amount":   map[string]string{"value": value, "currency": currency},
+		"metadata": map[string]string{"transaction_id": "42"},
+	}
+}
+
+func TestVerifyYooKassaPaymentAgainstFakeAPI(t *testing.T) {
+	fake := &fakeYooKassa{payments: map[string]map[string]interface{}{
+		"pay-ok":      fakePayment("pay-ok", "succeeded", true, "199.00", "RUB"),
+		"pay-pending": fakePayment("pay-pending", "pending", false, "199.00", "RUB"),
+		"pay-cancel":  fakePayment("pay-cancel", "canceled", false, "199.00", "RUB"),
+	}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	yk := &yookassaProvider{svc: &YooKassaService{ShopID: "shop", SecretKey: "secret", APIEndpoint: srv.URL}}
+	ctx := context.Background()
+
+	payment, err := verifyProviderPayment(ctx, yk, "payment.succeeded", "pay-ok")
+	if err != nil {
+		t.Fatalf("genuine event: %v", err)
+	}
+	if id, ok := metadataID(payment.Metadata, "transaction_id"); !ok || id != 42 {
+		t.Fatalf("transaction_id = %d, %v", id, ok)
+	}
+	if _, err := verifyProviderPayment(ctx, yk, "payment.canceled", "pay-cancel"); err != nil {
+		t.Fatalf("canceled event: %v", err)
+	}
+
+	rejected := []struct{ event, id string }{
+		{"payment.succeeded", "pay-pending"}, // forged status
+		{"payment.succeeded", "pay-cancel"},
+		{"payment.succeeded", "pay-missing"}, // forged id
+	}
+	for _, tc := range rejected {
+		if _, err := verifyProviderPayment(ctx, yk, tc.event, tc.id); !errors.Is(err, errPaymentRejected) {
+			t.Errorf("%s %s: err = %v, want rejected", tc.event, tc.id, err)
+		}
+	}
+
+	// API outages must stay retryable rather than rejecting the event
+	if _, err := verifyProviderPayment(ctx, yk, "payment.succeeded", "broken"); err == nil || errors.Is(err, errPaymentRejected) {
+		t.Errorf("outage: err = %v, want a retryable error", err)
+	}
+	if _, err := verifyProviderPayment(ctx, &yookassaProvider{svc: &YooKassaService{ShopID: "shop", SecretKey: "wrong", APIEndpoint: srv.URL}}, "payment.succeeded", "pay-ok"); err == nil || errors.Is(err, errPaymentRejected) {
+		t.Errorf("bad credentials: err = %v, want a retryable error", err)
+	}
+
+	// Object ids from the notification must not be able to leave /payments/
+	fake.paths = nil
+	verifyProviderPayment(ctx, yk, "payment.succeeded", "../refunds/x")
+	if len(fake.paths) != 1 || fake.paths[0] != "/payments/..%2Frefunds%2Fx" {
+		t.Errorf("request paths = %v", fake.paths)
+	}
+}
+
+func TestCheckYooKassaAmount(t *testing.T) {
+	payment := func(value, currency string) *YooKassaPaymentResponse {
+		p := &YooKassaPaymentResponse{}
+		p.Amount.Value = value
+		p.Amount.Currency = currency
+		return p
+	}
+	tests := []struct {
+		value, currency string
+		wantRub         float64
+		wantCurrency    string
+		ok              bool
+	}{
+		{"199.00", "RUB", 199, "RUB", true},
+		{"199.9", "RUB", 199.9, "", true},
+		{"0.30", "RUB", 0.1 + 0.2, "RUB", true},
+		{"198.99", "RUB", 199, "RUB", false},
+		{"1.00", "RUB", 199, "RUB", false},
+		{"199.00", "USD", 199, "RUB", false},
+		{"199.001", "RUB", 199, "RUB", false},
+		{"-199.00", "RUB", -199, "RUB", false},
+		{"-0.50", "RUB", 0.5, "RUB", false},
+		{"", "RUB", 0, "RUB", false},
+	}
+	for _, tc := range tests {
+		p, err := yookassaPayment(payment(tc.value, tc.currency))
+		if err == nil {
+			err = checkPaymentAmount(p, rubToKopecks(tc.wantRub), tc.wantCurrency)
+		}
+		if tc.ok && err != nil {
+			t.Errorf("%s %s vs %.2f: unexpected error %v", tc.value, tc.currency, tc.wantRub, err)
+		}
+		if !tc.ok && !errors.Is(err, errPaymentRejected) {
+			t.Errorf("%s %s vs %.2f: err = %v, want rejected", tc.value, tc.currency, tc.wantRub, err)
+		}
+	}
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Dunning moves unpaid subscriptions through
+//
+//	active -> past_due -> grace -> expired
+//
+// Premium subscriptions are retried with the saved payment method at the
+// offsets of the retry schedule, counted from the first failure. Org
+// subscriptions are paid by invoice, so past_due starts when an invoice is
+// overdue and the schedule drives reminders instead. After the last
+// attempt the subscription enters a read-only grace period, and when that
+// ends it expires; orgs fall back to the free plan. A successful payment
+// at any point reactivates the subscription.
+var (
+	dunningSchedule    = []time.Duration{24 * time.Hour, 72 * time.Hour, 120 * time.Hour}
+	dunningGracePeriod = 7 * 24 * time.Hour
+	orgInvoiceDueDays  = 10
+)
+
+// orgServingStatuses are the org subscription statuses that still belong
+// to the current subscription, even if it is not fully usable.
+var orgServingStatuses = []string{"active", "past_due", "grace"}
+
+const orgFreePlanSlug = "start"
+
+func InitDunning() {
+	if raw := os.Getenv("BILLING_DUNNING_SCHEDULE"); raw != "" {
+		if schedule, err := parseDunningSchedule(raw); err == nil {
+			dunningSchedule = schedule
+		} else {
+			log.Printf("[Dunning] Ignoring BILLING_DUNNING_SCHEDULE: %v", err)
+		}
+	}
+	if days, err := strconv.Atoi(os.Getenv("BILLING_GRACE_DAYS")); err == nil && days >= 0 {
+		dunningGracePeriod = time.Duration(days) * 24 * time.Hour
+	}
+	if days, err := strconv.Atoi(os.Getenv("BILLING_ORG_INVOICE_DUE_DAYS")); err == nil && days > 0 {
+		orgInvoiceDueDays = days
+	}
+
+	if db == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(1 * time.Hour)
+		defer ticker.Stop()
+		processDunning()
+		for range ticker.C {
+			processDunning()
+		}
+	}()
+}
+
+// parseDunningSchedule reads retry offsets in days after the first failure,
+// e.g. "1,3,5". Offsets must increase.
+func parseDunningSchedule(raw string) ([]time.Duration, error) {
+	var schedule []time.Duration
+	for _, part := range strings.Split(raw, ",") {
+		days, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || days <= 0 {
+			return nil, fmt.Errorf("invalid retry offset %q", part)
+		}
+		offset := time.Duration(days * float64(24*time.Hour))
+		if len(schedule) > 0 && offset <= schedule[len(schedule)-1] {
+			return nil, fmt.Errorf("retry offsets must increase")
+		}
+		schedule = append(schedule, offset)
+	}
+	return schedule, nil
+}
+
+// nextDunningStep decides what follows the attempts-th failed attempt: the
+// next retry, or the end of the grace period once the schedule is used up.
+func nextDunningStep(attempts int, pastDueSince, now time.Time) (nextRetry, graceUntil *time.Time) {
+	if attempts <= len(dunningSchedule) {
+		at := pastDueSince.Add(dunningSchedule[attempts-1])
+		if at.Before(now) {
+			at = now
+		}
+		return &at, nil
+	}
+	until := now.Add(dunningGracePeriod)
+	return nil, &until
+}
+
+// dunningAccess is what an owner can do in a given subscription status.
+func dunningAccess(status string) string {
+	switch status {
+	case "active", "trialing", "past_due":
+		return "full"
+	case "grace":
+		return "read_only"
+	}
+	return "none"
+}
+
+// withDunningCleared adds the resets for a paid subscription to updates.
+func withDunningCleared(updates map[string]interface{}) map[string]interface{} {
+	updates["status"] = "active"
+	updates["past_due_since"] = nil
+	updates["dunning_attempts"] = 0
+	updates["next_retry_at"] = nil
+	updates["grace_until"] = nil
+	return updates
+}
+
+func processDunning() {
+	if len(paymentProviders) > 0 {
+		processPremiumDunning()
+	}
+	renewOrgSubscriptions()
+	processOrgDunning()
+}
+
+// Premium subscriptions
+
+func enterPremiumPastDue(sub *PremiumSubscription, reason string) {
+	if sub.Status != "active" {
+		return
+	}
+	now := time.Now()
+	updates := map[string]interface{}{
+		"status":           "past_due",
+		"past_due_since":   now,
+		"dunning_attempts": 1,
+	}
+	next, grace := nextDunningStep(1, now, now)
+	if grace != nil {
+		updates["status"], updates["grace_until"] = "grace", *grace
+	} else {
+		updates["next_retry_at"] = *next
+	}
+	if err := db.Model(sub).Where("status = ?", "active").Updates(updates).Error; err != nil {
+		log.Printf("[Dunning] Failed to mark subscription %d past due: %v", sub.ID, err)
+		return
+	}
+	log.Printf("[Dunning] Subscription %d is past due: %s", sub.ID, reason)
+	if grace != nil {
+		notifyPremiumDunning(sub, "grace", *grace)
+	} else {
+		notifyPremiumDunning(sub, "past_due", *next)
+	}
+}
+
+// premiumRenewalCanceled handles a renewal payment the provider declined
+// after the fact.
+func premiumRenewalCanceled(subscriptionID uint) {
+	var sub PremiumSubscription
+	if db.Preload("Plan").First(&sub, subscriptionID).Error == nil {
+		enterPremiumPastDue(&sub, "renewal payment canceled")
+	}
+}
+
+func processPremiumDunning() {
+	now := time.Now()
+
+	var due []PremiumSubscription
+	db.Preload("Plan").Where("status = ? AND next_retry_at <= ?", "past_due", now).Find(&due)
+	for _, sub := range due {
+		switch pollPendingRenewal(&sub) {
+		case "":
+		case "canceled":
+			recordPremiumDunningFailure(&sub, now, "renewal payment canceled")
+			continue
+		default:
+			continue
+		}
+		err := processRenewal(&sub)
+		var fresh PremiumSubscription
+		if db.First(&fresh, sub.ID).Error == nil && fresh.Status == "active" {
+			continue
+		}
+		if err == nil {
+			// The provider is still processing the charge; the next pass
+			// polls it instead of charging again
+			log.Printf("[Dunning] Retry for subscription %d is pending with the provider", sub.ID)
+			continue
+		}
+		recordPremiumDunningFailure(&sub, now, err.Error())
+	}
+
+	var expired []PremiumSubscription
+	db.Preload("Plan").Where("status = ? AND grace_until <= ?", "grace", now).Find(&expired)
+	for _, sub := range expired {
+		res := db.Model(&sub).Where("status = ?", "grace").Updates(map[string]interface{}{
+			"status":        "expired",
+			"auto_renew":    false,
+			"next_retry_at": nil,
+		})
+		if res.RowsAffected == 0 {
+			continue
+		}
+		log.Printf("[Dunning] Subscription %d expired after the grace period", sub.ID)
+		notifyPremiumDunning(&sub, "expired", now)
+	}
+}
+
+// pollPendingRenewal looks up a renewal charge of sub that an earlier pass
+// left pending and returns its state at the provider: "" when there is none,
+// otherwise pending, succeeded or canceled. Only with "" may sub be charged
+// again. A charge that has settled is applied as its webhook would apply it;
+// one that cannot be polled counts as pending.
+func pollPendingRenewal(sub *PremiumSubscription) string {
+	var pending PremiumTransaction
+	if db.Where("subscription_id = ? AND status = ? AND provider_payment_id <> ?", sub.ID, "pending", "").
+		Order("id DESC").Limit(1).Find(&pending).RowsAffected == 0 {
+		return ""
+	}
+	provider := paymentProviderByName(pending.PaymentProvider)
+	if provider == nil {
+		return "pending"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	payment, err := provider.GetPayment(ctx, pending.ProviderPaymentID)
+	if err != nil {
+		log.Printf("[Dunning] Failed to poll renewal %d of subscription %d: %v", pending.ID, sub.ID, err)
+		return "pending"
+	}
+	if payment.Status == "pending" || (payment.Status == "succeeded" && !payment.Paid) {
+		return "pending"
+	}
+
+	var after func()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		after, err = applyPaymentTransaction(tx, pending.ID, pending.PaymentProvider, payment)
+		return err
+	})
+	if err != nil {
+		log.Printf("[Dunning] Failed to settle renewal %d of subscription %d: %v", pending.ID, sub.ID, err)
+		return "pending"
+	}
+	if after != nil {
+		after()
+	}
+	log.Printf("[Dunning] Renewal %d of subscription %d settled as %s", pending.ID, sub.ID, payment.Status)
+	return payment.Status
+}
+
+func recordPremiumDunningFailure(sub *PremiumSubscription, now time.Time, reason string) {
+	attempts := sub.DunningAttempts + 1
+	since := now
+	if sub.PastDueSince != nil {
+		since = *sub.PastDueSince
+	}
+	next, grace := nextDunningStep(attempts, since, now)
+	updates := map[string]interface{}{"dunning_attempts": attempts}
+	if grace != nil {
+		updates["status"], updates["grace_until"], updates["next_retry_at"] = "grace", *grace, nil
+	} else {
+		updates["next_retry_at"] = *next
+	}
+	if err := db.Model(sub).Where("status = ?", "past_due").Updates(updates).Error; err != nil {
+		log.Printf("[Dunning] Failed to record retry for subscription %d: %v", sub.ID, err)
+		return
+	}
+	log.Printf("[Dunning] Retry %d for subscription %d failed: %s", attempts, sub.ID, reason)
+	if grace != nil {
+		notifyPremiumDunning(sub, "grace", *grace)
+	} else {
+		notifyPremiumDunning(sub, "retry_failed", *next)
+	}
+}
+
+// notifyPremiumDunning sends the notice for a dunning step; at is the next
+// retry or the end of the grace period.
+func notifyPremiumDunning(sub *PremiumSubscription, step string, at time.Time) {
+	event := "premium_" + step
+	switch step {
+	case "past_due":
+		event = "renewal_failed"
+	case "retry_failed":
+		event = "renewal_retry_failed"
+	}
+	go notifyBilling(sub.UserID, event, map[string]interface{}{"Plan": sub.Plan.Name, "Date": at}, "")
+}
+
+// Org subscriptions
+
+// renewOrgSubscriptions rolls auto-renewing org subscriptions into the next
+// period and invoices it; the others expire at the end of the period.
+func renewOrgSubscriptions() {
+	now := time.Now()
+	var subs []OrgSubscription
+	db.Where("status = ? AND ends_at <= ?", "active", now).Find(&subs)
+	for _, sub := range subs {
+		if !sub.AutoRenew {
+			if db.Model(&sub).Where("status = ?", "active").Update("status", "expired").RowsAffected > 0 {
+				downgradeOrgToFreePlan(sub.OrgID)
+				notifyOrgDunning(sub.OrgID, "ended", "", now)
+			}
+			continue
+		}
+		if err := renewOrgSubscription(sub.ID, now); err != nil {
+			log.Printf("[Dunning] Failed to renew subscription of org %d: %v", sub.OrgID, err)
+		}
+	}
+}
+
+// renewOrgSubscription applies the changes scheduled for the end of the
+// period, invoices the next period and moves the subscription into it. All
+// of it happens under the subscription's row lock, so a scheduled change
+// can never land between the invoice and the new period.
+func renewOrgSubscription(subID int, now time.Time) error {
+	var sub OrgSubscription
+	var inv *Invoice
+	planChanged := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&sub, subID).Error; err != nil {
+			return err
+		}
+		// Renewed, cancelled or switched off since it was listed
+		if sub.Status != "active" || !sub.AutoRenew || sub.EndsAt.After(now) {
+			return nil
+		}
+
+		var scheduled []OrgSubscriptionChange
+		if err := tx.Where("subscription_id = ? AND status = ? AND effective_at <= ?", sub.ID, "scheduled", sub.EndsAt).
+			Order("id").Find(&scheduled).Error; err != nil {
+			return err
+		}
+		for i := range scheduled {
+			fromPlan := sub.PlanID
+			applied, err := applyScheduledOrgChange(tx, &sub, &scheduled[i], now)
+			if err != nil {
+				return err
+			}
+			planChanged = planChanged || (applied && sub.PlanID != fromPlan)
+		}
+
+		periodStart := sub.EndsAt
+		periodEnd := periodStart.AddDate(0, orgInvoiceMonths(sub.BillingPeriod), 0)
+		var existing int64
+		tx.Model(&Invoice{}).Where("org_id = ? AND period_start = ? AND status <> ?", sub.OrgID, periodStart, "void").Count(&existing)
+		if existing == 0 {
+			if built, err := buildOrgSubscriptionInvoice(tx, &sub, periodStart); err == nil {
+				copyOrgBuyer(sub.OrgID, built)
+				due := now.AddDate(0, 0, orgInvoiceDueDays)
+				built.DueAt = &due
+				if err := issueInvoice(tx, built); err != nil {
+					return fmt.Errorf("invoice renewal: %w", err)
+				}
+				inv = built
+			}
+		}
+		return tx.Model(&sub).Updates(map[string]interface{}{"starts_at": periodStart, "ends_at": periodEnd, "updated_at": now}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	if planChanged {
+		var plan SubscriptionPlan
+		if db.First(&plan, sub.PlanID).Error == nil {
+			grantOrgEntitlements(sub.OrgID, &plan)
+		}
+	}
+	if inv != nil {
+		notifyOrgDunning(sub.OrgID, "invoice", inv.Number, *inv.DueAt)
+	}
+	return nil
+}
+
+// copyOrgBuyer reuses the requisites of the org's last invoice.
+func copyOrgBuyer(orgID int, inv *Invoice) {
+	var last Invoice
+	if db.Where("org_id = ? AND buyer_name <> ''", orgID).Order("issued_at DESC").First(&last).Error == nil {
+		inv.BuyerName, inv.BuyerINN, inv.BuyerKPP = last.BuyerName, last.BuyerINN, last.BuyerKPP
+		inv.BuyerAddress, inv.BuyerEmail = last.BuyerAddress, last.BuyerEmail
+		return
+	}
+	var org Org
+	db.Select("id", "name").First(&org, orgID)
+	inv.BuyerName = org.Name
+}
+
+func overdueOrgInvoice(orgID int, now time.Time) (*Invoice, bool) {
+	var inv Invoice
+	if db.Where("org_id = ? AND status = ? AND due_at < ?", orgID, "issued", now).Order("due_at").First(&inv).Error != nil {
+		return nil, false
+	}
+	return &inv, true
+}
+
+func processOrgDunning() {
+	now := time.Now()
+
+	var active []OrgSubscription
+	db.Where("status = ? AND org_id IN (?)", "active",
+		db.Model(&Invoice{}).Select("org_id").Where("org_id IS NOT NULL AND status = ? AND due_at < ?", "issued", now)).
+		Find(&active)
+	for _, sub := range active {
+		inv, ok := overdueOrgInvoice(sub.OrgID, now)
+		if !ok {
+			continue
+		}
+		updates := map[string]interface{}{"status": "past_due", "past_due_since": now, "dunning_attempts": 1}
+		next, grace := nextDunningStep(1, now, now)
+		if grace != nil {
+			updates["status"], updates["grace_until"] = "grace", *grace
+		} else {
+			updates["next_retry_at"] = *next
+		}
+		if db.Model(&sub).Where("status = ?", "active").Updates(updates).RowsAffected == 0 {
+			continue
+		}
+		if grace != nil {
+			enterOrgGrace(sub.OrgID, inv.Number, *grace)
+		} else {
+			notifyOrgDunning(sub.OrgID, "past_due", inv.Number, *next)
+		}
+	}
+
+	var due []OrgSubscription
+	db.Where("status = ? AND next_retry_at <= ?", "past_due", now).Find(&due)
+	for _, sub := range due {
+		inv, ok := overdueOrgInvoice(sub.OrgID, now)
+		if !ok {
+			reactivateOrgSubscription(sub.OrgID)
+			continue
+		}
+		attempts := sub.DunningAttempts + 1
+		since := now
+		if sub.PastDueSince != nil {
+			since = *sub.PastDueSince
+		}
+		next, grace := nextDunningStep(attempts, since, now)
+		updates := map[string]interface{}{"dunning_attempts": attempts}
+		if grace != nil {
+			updates["status"], updates["grace_until"], updates["next_retry_at"] = "grace", *grace, nil
+		} else {
+			updates["next_retry_at"] = *next
+		}
+		if db.Model(&sub).Where("status = ?", "past_due").Updates(updates).RowsAffected == 0 {
+			continue
+		}
+		if grace != nil {
+			enterOrgGrace(sub.OrgID, inv.Number, *grace)
+		} else {
+			notifyOrgDunning(sub.OrgID, "reminder", inv.Number, *next)
+		}
+	}
+
+	var expired []OrgSubscription
+	db.Where("status = ? AND grace_until <= ?", "grace", now).Find(&expired)
+	for _, sub := range expired {
+		if db.Model(&sub).Where("status = ?", "grace").Updates(map[string]interface{}{
+			"status":        "expired",
+			"auto_renew":    false,
+			"next_retry_at": nil,
+		}).RowsAffected == 0 {
+			continue
+		}
+		downgradeOrgToFreePlan(sub.OrgID)
+		log.Printf("[Dunning] Org %d subscription expired after the grace period", sub.OrgID)
+		notifyOrgDunning(sub.OrgID, "expired", "", now)
+	}
+}
+
+// enterOrgGrace marks the org read-only through an entitlement that
+// grantOrgEntitlements drops again on reactivation.
+func enterOrgGrace(orgID int, invoiceNumber string, until time.Time) {
+	db.Where("org_id = ? AND feature_key = ?", orgID, "read_only").Delete(&OrgEntitlement{})
+	db.Create(&OrgEntitlement{
+		OrgID:      orgID,
+		FeatureKey: "read_only",
+		Enabled:    true,
+		LimitsJSON: fmt.Sprintf(`{"until": %q}`, until.Format(time.RFC3339)),
+		CreatedAt:  time.Now(),
+		UpdatedAt:  time.Now(),
+	})
+	notifyOrgDunning(orgID, "grace", invoiceNumber, until)
+}
+
+func downgradeOrgToFreePlan(orgID int) {
+	var plan SubscriptionPlan
+	if err := db.Where("slug = ?", orgFreePlanSlug).First(&plan).Error; err != nil {
+		log.Printf("[Dunning] Free plan %q not found, org %d keeps its entitlements: %v", orgFreePlanSlug, orgID, err)
+		return
+	}
+	grantOrgEntitlements(orgID, &plan)
+}
+
+// reactivateOrgSubscription restores the latest unpaid subscription of the
+// org once nothing is overdue any more.
+func reactivateOrgSubscription(orgID int) {
+	if _, overdue := overdueOrgInvoice(orgID, time.Now()); overdue {
+		return
+	}
+	var sub OrgSubscription
+	if err := db.Where("org_id = ? AND status IN ?", orgID, []string{"past_due", "grace", "expired"}).
+		Order("updated_at DESC").First(&sub).Error; err != nil {
+		return
+	}
+	if sub.Status == "expired" {
+		// Only dunning expiries come back; a subscription that simply ended
+		// without auto-renewal needs a new subscribe
+		if sub.PastDueSince == nil {
+			return
+		}
+		var current int64
+		db.Model(&OrgSubscription{}).Where("org_id = ? AND status IN ?", orgID, orgServingStatuses).Count(&current)
+		if current > 0 {
+			return
+		}
+	}
+	updates := withDunningCleared(map[string]interface{}{"auto_renew": true, "updated_at": time.Now()})
+	if db.Model(&sub).Updates(updates).Error != nil {
+		return
+	}
+	var plan SubscriptionPlan
+	if db.First(&plan, sub.PlanID).Error == nil {
+		grantOrgEntitlements(orgID, &plan)
+	}
+	log.Printf("[Dunning] Org %d subscription reactivated", orgID)
+	notifyOrgDunning(orgID, "reactivated", "", time.Now())
+}
+
+// notifyOrgDunning tells the org admins about a dunning step.
+func notifyOrgDunning(orgID int, step, invoiceNumber string, at time.Time) {
+	var org Org
+	db.Select("id", "name").First(&org, orgID)
+	data := map[string]interface{}{"Org": org.Name, "OrgID": orgID, "Invoice": invoiceNumber, "Date": at}
+	for _, uid := range orgAdminIDs(orgID) {
+		go notifyBilling(uid, "org_"+step, data, "")
+	}
+}
+
+// orgAdminIDs lists the active admins of an org.
+func orgAdminIDs(orgID int) []uint {
+	var admins []OrgMember
+	db.Where("org_id = ? AND org_role = ? AND state = ?", orgID, "admin", "active").Find(&admins)
+	ids := make([]uint, 0, len(admins))
+	for _, m := range admins {
+		ids = append(ids, uint(m.UserID))
+	}
+	return ids
+}
+
+// premiumAccess is what uid's premium subscription allows, "none" without one.
+func premiumAccess(uid uint) string {
+	var sub PremiumSubscription
+	if err := db.Select("status").Where("user_id = ?", uid).First(&sub).Error; err != nil {
+		return "none"
+	}
+	return dunningAccess(sub.Status)
+}
+
+// orgAccess is what the org's current subscription allows, "none" without one.
+func orgAccess(orgID int) string {
+	var sub OrgSubscription
+	if err := db.Select("status").Where("org_id = ? AND status IN ?", orgID, orgServingStatuses).
+		Order("id DESC").First(&sub).Error; err != nil {
+		return "none"
+	}
+	return dunningAccess(sub.Status)
+}
+
+// premiumReadOnlyGuard rejects changes through premium features while the
+// user's subscription is in its grace period.
+func premiumReadOnlyGuard() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := getUserIDFromContext(c)
+		if c.Request.Method == http.MethodGet || !ok || premiumAccess(uid) != "read_only" {
+			c.Next()
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusPaymentRequired, gin.H{"error": "Premium features are read-only until the subscription is paid"})
+	}
+}
+
+// orgReadOnlyGuard rejects changes to an org in its grace period, except
+// the billing calls needed to pay.
+func orgReadOnlyGuard() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodGet || c.Param("id") == "" {
+			c.Next()
+			return
+		}
+		path := c.FullPath()
+		for _, allowed := range []string{"/subscribe", "/subscription", "/invoices", "/billing"} {
+			if strings.Contains(path, allowed) {
+				c.Next()
+				return
+			}
+		}
+		if orgAccess(parseInt(c.Param("id"))) == "read_only" {
+			c.AbortWithStatusJSON(http.StatusPaymentRequired, gin.H{"error": "Organization is read-only until its invoice is paid"})
+			return
+		}
+		c.Next()
+	}
+}
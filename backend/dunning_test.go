@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseDunningSchedule(t *testing.T) {
+	got, err := parseDunningSchedule("1, 3,5.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Duration{24 * time.Hour, 72 * time.Hour, 132 * time.Hour}
+	if len(got) != len(want) {
+		t.Fatalf("schedule = %v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("schedule = %v, want %v", got, want)
+		}
+	}
+	for _, bad := range []string{"", "1,,3", "3,1", "0", "-1", "x"} {
+		if _, err := parseDunningSchedule(bad); err == nil {
+			t.Errorf("parseDunningSchedule(%q) accepted", bad)
+		}
+	}
+}
+
+func TestNextDunningStep(t *testing.T) {
+	defer func(s []time.Duration, g time.Duration) { dunningSchedule, dunningGracePeriod = s, g }(dunningSchedule, dunningGracePeriod)
+	dunningSchedule = []time.Duration{24 * time.Hour, 72 * time.Hour}
+	dunningGracePeriod = 7 * 24 * time.Hour
+
+	since := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	next, grace := nextDunningStep(1, since, since)
+	if grace != nil || next == nil || !next.Equal(since.Add(24*time.Hour)) {
+		t.Fatalf("after first failure: next %v, grace %v", next, grace)
+	}
+	// Retries are counted from the first failure, not from the last retry
+	next, grace = nextDunningStep(2, since, since.Add(25*time.Hour))
+	if grace != nil || !next.Equal(since.Add(72*time.Hour)) {
+		t.Fatalf("after second failure: next %v, grace %v", next, grace)
+	}
+	// A late tick never schedules a retry in the past
+	late := since.Add(100 * time.Hour)
+	next, _ = nextDunningStep(2, since, late)
+	if !next.Equal(late) {
+		t.Fatalf("late retry at %v, want %v", next, late)
+	}
+	next, grace = nextDunningStep(3, since, late)
+	if next != nil || grace == nil || !grace.Equal(late.Add(7*24*time.Hour)) {
+		t.Fatalf("schedule used up: next %v, grace %v", next, grace)
+	}
+}
+
+func TestDunningAccess(t *testing.T) {
+	for status, want := range map[string]string{
+		"active": "full", "trialing": "full", "past_due": "full",
+		"grace": "read_only", "expired": "none", "cancelled": "none",
+	} {
+		if got := dunningAccess(status); got != want {
+			t.Errorf("dunningAccess(%s) = %s, want %s", status, got, want)
+		}
+	}
+}
+
+// stubPaymentProvider charges saved methods with chargeStatus, reports
+// each payment in the state the test last set for it and records refunds,
+// failing them with refundErr.
+type stubPaymentProvider struct {
+	mu           sync.Mutex
+	chargeStatus string
+	charges      int
+	payments     map[string]*providerPayment
+	refunds      []refundRequest
+	refundErr    error
+}
+
+func (p *stubPaymentProvider) Name() string             { return "stub" }
+func (p *stubPaymentProvider) Supports(cur string) bool { return true }
+
+func (p *stubPaymentProvider) CreatePayment(ctx context.Context, req *paymentRequest) (*providerPayment, error) {
+	return nil, errors.New("not supported")
+}
+
+func (p *stubPaymentProvider) ChargeSaved(ctx context.Context, req *paymentRequest, methodID string) (*providerPayment, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.charges++
+	payment := &providerPayment{ID: fmt.Sprintf("stub-%d", p.charges), Amount: req.Amount, Currency: req.Currency}
+	p.payments[payment.ID] = payment
+	p.settle(payment.ID, p.chargeStatus)
+	copied := *payment
+	return &copied, nil
+}
+
+func (p *stubPaymentProvider) Refund(ctx context.Context, req *refundRequest) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refunds = append(p.refunds, *req)
+	return p.refundErr
+}
+
+func (p *stubPaymentProvider) GetPayment(ctx context.Context, paymentID string) (*providerPayment, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	payment, ok := p.payments[paymentID]
+	if !ok {
+		return nil, errors.New("no such payment")
+	}
+	copied := *payment
+	return &copied, nil
+}
+
+func (p *stubPaymentProvider) ParseWebhook(r *http.Request, body []byte) (*paymentNotification, error) {
+	return nil, nil
+}
+
+// settle must be called with mu held.
+func (p *stubPaymentProvider) settle(id, status string) {
+	p.payments[id].Status = status
+	p.payments[id].Paid = status == "succeeded"
+}
+
+func (p *stubPaymentProvider) set(id, status string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.settle(id, status)
+}
+
+// A retry the provider leaves pending is not a failure and is not charged
+// again; the next passes poll it until it settles either way.
+func TestProcessPremiumDunningPendingRetry(t *testing.T) {
+	testDB(t, &User{}, &PremiumPlan{}, &PremiumSubscription{}, &PremiumTransaction{}, &PlanPrice{}, &Invoice{},
+		&PostBoost{}, &GiftSubscription{}, &LedgerAccount{}, &LedgerEntry{}, &LedgerLine{},
+		&BillingNotificationLog{}, &UserSettings{}, &TelegramNotification{})
+	stub := &stubPaymentProvider{chargeStatus: "pending", payments: map[string]*providerPayment{}}
+	saved := paymentProviders
+	t.Cleanup(func() { paymentProviders = saved })
+	paymentProviders = map[string]paymentProvider{"stub": stub}
+
+	plan := PremiumPlan{Slug: "pro", Name: "Pro", PriceRub: 299, BillingCycle: "monthly", IsActive: true}
+	db.Create(&plan)
+	since := time.Now().Add(-30 * time.Hour)
+	retry := time.Now().Add(-time.Minute)
+	subscribe := func(name string) PremiumSubscription {
+		user := User{Username: name, Password: "x"}
+		db.Create(&user)
+		sub := PremiumSubscription{
+			UserID: user.ID, PlanID: plan.ID, Status: "past_due", CurrentPeriodEnd: since, AutoRenew: true,
+			PaymentMethodID: "pm_1", PaymentProvider: "stub", Currency: "RUB",
+			PastDueSince: &since, DunningAttempts: 1, NextRetryAt: &retry,
+		}
+		db.Create(&sub)
+		return sub
+	}
+	paid, declined := subscribe("alice"), subscribe("bob")
+	reload := func(sub PremiumSubscription) PremiumSubscription {
+		var fresh PremiumSubscription
+		db.First(&fresh, sub.ID)
+		return fresh
+	}
+
+	processPremiumDunning()
+	processPremiumDunning()
+	if stub.charges != 2 {
+		t.Fatalf("%d charges after two passes, want one per subscription", stub.charges)
+	}
+	for _, sub := range []PremiumSubscription{paid, declined} {
+		if fresh := reload(sub); fresh.Status != "past_due" || fresh.DunningAttempts != 1 {
+			t.Errorf("pending retry counted: %+v", fresh)
+		}
+	}
+
+	var transactions []PremiumTransaction
+	db.Order("id").Find(&transactions)
+	if len(transactions) != 2 {
+		t.Fatalf("%d transactions", len(transactions))
+	}
+	byUser := map[uint]PremiumTransaction{}
+	for _, tx := range transactions {
+		byUser[tx.UserID] = tx
+	}
+	stub.set(byUser[paid.UserID].ProviderPaymentID, "succeeded")
+	stub.set(byUser[declined.UserID].ProviderPaymentID, "canceled")
+
+	processPremiumDunning()
+	if stub.charges != 2 {
+		t.Errorf("charged again while settling: %d charges", stub.charges)
+	}
+	if fresh := reload(paid); fresh.Status != "active" || fresh.NextRetryAt != nil || !fresh.CurrentPeriodEnd.After(time.Now()) {
+		t.Errorf("paid retry did not reactivate: %+v", fresh)
+	}
+	if fresh := reload(declined); fresh.Status != "past_due" || fresh.DunningAttempts != 2 {
+		t.Errorf("declined retry not counted: %+v", fresh)
+	}
+	for user, want := range map[uint]string{paid.UserID: "succeeded", declined.UserID: "failed"} {
+		var tx PremiumTransaction
+		db.First(&tx, byUser[user].ID)
+		if tx.Status != want {
+			t.Errorf("transaction of user %d is %s, want %s", user, tx.Status, want)
+		}
+	}
+}
+
+// During grace the premium and org gates let reads through and refuse
+// writes, and the org's Jarvis pool is no longer drawn from.
+func TestReadOnlyGraceGates(t *testing.T) {
+	testDB(t, &PremiumSubscription{}, &OrgSubscription{}, &OrgMember{}, &SubscriptionPlan{}, &UserPremium{})
+	db.Create(&PremiumSubscription{UserID: 1, Status: "grace"})
+	db.Create(&PremiumSubscription{UserID: 2, Status: "past_due"})
+	plan := SubscriptionPlan{Slug: "school", JarvisDailyLimit: 20, JarvisOrgDailyLimit: 200}
+	db.Create(&plan)
+	db.Create(&OrgSubscription{OrgID: 10, PlanID: plan.ID, Status: "grace"})
+	db.Create(&OrgSubscription{OrgID: 11, PlanID: plan.ID, Status: "past_due"})
+	db.Create(&OrgMember{OrgID: 10, UserID: 5, State: "active"})
+	db.Create(&OrgMember{OrgID: 11, UserID: 6, State: "active"})
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("user_id", float64(parseInt(c.GetHeader("X-User"))))
+	})
+	ok := func(c *gin.Context) { c.Status(http.StatusNoContent) }
+	r.Any("/tools", premiumReadOnlyGuard(), ok)
+	r.Any("/api/org/:id/members", orgReadOnlyGuard(), ok)
+	r.Any("/api/org/:id/subscribe", orgReadOnlyGuard(), ok)
+
+	for _, tc := range []struct {
+		method, path, user string
+		want               int
+	}{
+		{http.MethodGet, "/tools", "1", http.StatusNoContent},
+		{http.MethodPost, "/tools", "1", http.StatusPaymentRequired},
+		{http.MethodPut, "/tools", "1", http.StatusPaymentRequired},
+		{http.MethodPost, "/tools", "2", http.StatusNoContent},
+		{http.MethodPost, "/tools", "3", http.StatusNoContent}, // no subscription
+		{http.MethodGet, "/api/org/10/members", "1", http.StatusNoContent},
+		{http.MethodPost, "/api/org/10/members", "1", http.StatusPaymentRequired},
+		{http.MethodPost, "/api/org/10/subscribe", "1", http.StatusNoContent},
+		{http.MethodPost, "/api/org/11/members", "1", http.StatusNoContent},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		req.Header.Set("X-User", tc.user)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s %s as %s: %d, want %d", tc.method, tc.path, tc.user, w.Code, tc.want)
+		}
+	}
+
+	if q := resolveJarvisQuota(5, time.Now()); q.OrgID != nil {
+		t.Errorf("a member of an org in grace draws on its pool: %+v", q)
+	}
+	if q := resolveJarvisQuota(6, time.Now()); q.OrgID == nil || *q.OrgID != 11 {
+		t.Errorf("a member of a past-due org lost its pool: %+v", q)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
         "fmt"
+        "html"
         "log"
         "net/smtp"
         "os"
@@ -81,7 +82,7 @@ func (es *EmailService) SendEmail(toEmail, subject, htmlBody string) error {
         return nil
 }
 
-func SendPaymentConfirmation(userID uint, planName string, amount float64) {
+func SendAccountDeletionScheduled(userID uint, scheduledFor time.Time) {
         var user User
         if db.First(&user, userID).RowsAffected == 0 {
                 return
@@ -92,34 +93,32 @@ func SendPaymentConfirmation(userID uint, planName string, amount float64) {
                 email = *user.Email
         }
 
-        subject := "Подтверждение оплаты Premium"
+        subject := "Удаление аккаунта запланировано"
         body := fmt.Sprintf(`
 <!DOCTYPE html>
 <html>
 <head><meta charset="UTF-8"></head>
 <body style="font-family: Arial, sans-serif; background-color: #1a1a2e; color: #ffffff; padding: 20px;">
 <div style="max-width: 600px; margin: 0 auto; background-color: #16213e; border-radius: 10px; padding: 30px;">
-<h1 style="color: #a855f7;">Спасибо за подписку!</h1>
+<h1 style="color: #ef4444;">Удаление аккаунта</h1>
 <p>Здравствуйте, %s!</p>
-<p>Ваша подписка <strong>%s</strong> успешно активирована.</p>
-<p>Сумма: <strong>%.0f ₽</strong></p>
-<p>Дата: %s</p>
-<hr style="border-color: #4a4a6a;">
-<p style="color: #888;">Если у вас есть вопросы, свяжитесь с нашей поддержкой.</p>
+<p>Мы получили запрос на удаление вашего аккаунта. Он будет удалён <strong>%s</strong>.</p>
+<p>До этого момента вы можете отменить удаление в настройках аккаунта.</p>
+<p style="color: #888;">Если вы не запрашивали удаление, срочно смените пароль и свяжитесь с поддержкой.</p>
 </div>
 </body>
 </html>
-`, user.Username, planName, amount, time.Now().Format("02.01.2006 15:04"))
+`, user.Username, scheduledFor.Format("02.01.2006 15:04"))
 
         if emailService != nil {
                 emailService.SendEmail(email, subject, body)
         }
 }
 
-func SendSubscriptionExpiring(userID uint, planName string, expiresAt time.Time) {
+func SendJarvisReminder(userID uint, content string, remindAt time.Time) error {
         var user User
         if db.First(&user, userID).RowsAffected == 0 {
-                return
+                return nil
         }
 
         email := user.Username + "@nemaks.com"
@@ -127,92 +126,26 @@ func SendSubscriptionExpiring(userID uint, planName string, expiresAt time.Time)
                 email = *user.Email
         }
 
-        daysLeft := int(time.Until(expiresAt).Hours() / 24)
-        subject := fmt.Sprintf("Подписка истекает через %d дн.", daysLeft)
+        subject := "Напоминание от Jarvis"
         body := fmt.Sprintf(`
 <!DOCTYPE html>
 <html>
 <head><meta charset="UTF-8"></head>
 <body style="font-family: Arial, sans-serif; background-color: #1a1a2e; color: #ffffff; padding: 20px;">
 <div style="max-width: 600px; margin: 0 auto; background-color: #16213e; border-radius: 10px; padding: 30px;">
-<h1 style="color: #f59e0b;">Подписка скоро истекает</h1>
+<h1 style="color: #a855f7;">Напоминание</h1>
 <p>Здравствуйте, %s!</p>
-<p>Ваша подписка <strong>%s</strong> истекает %s.</p>
-<p>Чтобы продолжить пользоваться всеми преимуществами Premium, продлите подписку.</p>
-<a href="https://nemaks.com/premium" style="display: inline-block; background-color: #a855f7; color: white; padding: 12px 24px; text-decoration: none; border-radius: 6px; margin-top: 15px;">Продлить подписку</a>
+<p>Вы просили напомнить:</p>
+<p style="font-size: 18px;"><strong>%s</strong></p>
+<p style="color: #888;">Запланировано на %s</p>
 </div>
 </body>
 </html>
-`, user.Username, planName, expiresAt.Format("02.01.2006"))
+`, user.Username, html.EscapeString(content), remindAt.Format("02.01.2006 15:04"))
 
         if emailService != nil {
-                emailService.SendEmail(email, subject, body)
-        }
-}
-
-func SendSubscriptionCancelled(userID uint, endsAt time.Time) {
-        var user User
-        if db.First(&user, userID).RowsAffected == 0 {
-                return
-        }
-
-        email := user.Username + "@nemaks.com"
-        if user.Email != nil && *user.Email != "" {
-                email = *user.Email
-        }
-
-        subject := "Подписка отменена"
-        body := fmt.Sprintf(`
-<!DOCTYPE html>
-<html>
-<head><meta charset="UTF-8"></head>
-<body style="font-family: Arial, sans-serif; background-color: #1a1a2e; color: #ffffff; padding: 20px;">
-<div style="max-width: 600px; margin: 0 auto; background-color: #16213e; border-radius: 10px; padding: 30px;">
-<h1 style="color: #ef4444;">Подписка отменена</h1>
-<p>Здравствуйте, %s!</p>
-<p>Ваша Premium подписка была отменена.</p>
-<p>Вы сохраните доступ до <strong>%s</strong>.</p>
-<p>Мы будем рады, если вы вернётесь!</p>
-<a href="https://nemaks.com/premium" style="display: inline-block; background-color: #a855f7; color: white; padding: 12px 24px; text-decoration: none; border-radius: 6px; margin-top: 15px;">Возобновить подписку</a>
-</div>
-</body>
-</html>
-`, user.Username, endsAt.Format("02.01.2006"))
-
-        if emailService != nil {
-                emailService.SendEmail(email, subject, body)
+                return emailService.SendEmail(email, subject, body)
         }
+        return nil
 }
 
-func SendPaymentFailed(userID uint, reason string) {
-        var user User
-        if db.First(&user, userID).RowsAffected == 0 {
-                return
-        }
-
-        email := user.Username + "@nemaks.com"
-        if user.Email != nil && *user.Email != "" {
-                email = *user.Email
-        }
-
-        subject := "Ошибка оплаты"
-        body := fmt.Sprintf(`
-<!DOCTYPE html>
-<html>
-<head><meta charset="UTF-8"></head>
-<body style="font-family: Arial, sans-serif; background-color: #1a1a2e; color: #ffffff; padding: 20px;">
-<div style="max-width: 600px; margin: 0 auto; background-color: #16213e; border-radius: 10px; padding: 30px;">
-<h1 style="color: #ef4444;">Ошибка оплаты</h1>
-<p>Здравствуйте, %s!</p>
-<p>Не удалось провести платёж за Premium подписку.</p>
-<p>Пожалуйста, проверьте платёжные данные и попробуйте снова.</p>
-<a href="https://nemaks.com/premium" style="display: inline-block; background-color: #a855f7; color: white; padding: 12px 24px; text-decoration: none; border-radius: 6px; margin-top: 15px;">Повторить оплату</a>
-</div>
-</body>
-</html>
-`, user.Username)
-
-        if emailService != nil {
-                emailService.SendEmail(email, subject, body)
-        }
-}
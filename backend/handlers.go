@@ -91,8 +91,12 @@ func initDB() {
                 &TelegramLink{}, &TelegramNotification{},
                 &UserReferral{}, &ReferralUse{},
                 &Video{}, &VideoChapter{}, &VideoLike{}, &VideoBookmark{},
-                &PremiumPlan{}, &UserPremium{}, &CreatorDonation{},
-                &UserRequest{}, &PremiumSubscription{}, &PremiumTransaction{},
+                &PremiumPlan{}, &PlanPrice{}, &UserPremium{}, &CreatorDonation{},
+                &UserRequest{}, &PremiumSubscription{}, &PremiumTransaction{}, &YooKassaWebhookEvent{},
+                &LedgerAccount{}, &LedgerEntry{}, &LedgerLine{},
+                &Invoice{}, &InvoiceLine{}, &InvoiceCounter{}, &OrgSubscriptionChange{},
+                &UsageEvent{}, &OrgUsagePeriod{}, &CreatorPayout{},
+                &BillingNotificationPreference{}, &BillingNotificationLog{},
                 &PromoCode{}, &PromoCodeUsage{}, &GiftSubscription{}, &ReferralBonus{}, &PostBoost{},
                 &SubscriptionPlan{}, &SeatPricing{}, &OveragePricing{},
                 &Org{}, &OrgSubscription{}, &OrgEntitlement{}, &OrgMember{}, &ChannelACL{},
@@ -101,7 +105,9 @@ func initDB() {
                 &JarvisUsage{}, &ManualPayment{}, &GuildMember{},
                 &ModerationCase{}, &ModerationVerdict{}, &ModerationActionLog{},
                 &Appeal{}, &JarvisAudioResponse{}, &JarvisVoiceCommand{}, &Voicemail{}, &JarvisCallSession{},
-                &ChannelTool{},
+                &ChannelTool{}, &ExportJob{}, &AccountDeletion{}, &ExtendedAuditLog{},
+                &ScheduledMessage{}, &ScheduledMessageRun{}, &JarvisConversation{}, &JarvisConversationMessage{},
+                &GuildJarvisSettings{}, &ChannelJarvisPrompt{}, &JarvisSummary{},
         )
         log.Println("DB connected")
 
@@ -336,6 +342,12 @@ func authMiddleware() gin.HandlerFunc {
                         return
                 }
 
+                // Tokens outlive an account erasure, so the account is checked too
+                if uid, _ := extractUserID(claims["user_id"]); accountErased(uid) {
+                        c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Account deleted"})
+                        return
+                }
+
                 c.Set("user_id", claims["user_id"])
                 c.Next()
         }
@@ -360,7 +372,9 @@ func optionalAuthMiddleware() gin.HandlerFunc {
 
                 if err == nil && token.Valid {
                         if claims, ok := token.Claims.(jwt.MapClaims); ok {
-                                c.Set("user_id", claims["user_id"])
+                                if uid, _ := extractUserID(claims["user_id"]); !accountErased(uid) {
+                                        c.Set("user_id", claims["user_id"])
+                                }
                         }
                 }
                 c.Next()
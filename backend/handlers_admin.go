@@ -487,6 +487,15 @@ func updateUserSettingsHandler(c *gin.Context) {
                 c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
                 return
         }
+        if country, ok := req["country"]; ok {
+                code, _ := country.(string)
+                code = strings.ToUpper(strings.TrimSpace(code))
+                if code != "" && (len(code) != 2 || strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "") {
+                        c.JSON(http.StatusBadRequest, gin.H{"error": "Country must be a two-letter code"})
+                        return
+                }
+                req["country"] = code
+        }
 
         var settings UserSettings
         if db.Where("user_id = ?", uid).First(&settings).RowsAffected == 0 {
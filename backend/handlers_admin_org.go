@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 func setupAdminOrgRoutes(r *gin.Engine, auth, adminAuth gin.HandlerFunc) {
@@ -23,9 +24,26 @@ func setupAdminOrgRoutes(r *gin.Engine, auth, adminAuth gin.HandlerFunc) {
 		admin.PUT("/manual-payments/:id/verify", verifyManualPaymentHandler)
 		admin.PUT("/manual-payments/:id/reject", rejectManualPaymentHandler)
 
+		admin.GET("/ledger/accounts", getLedgerAccountsHandler)
+		admin.GET("/ledger/entries", getLedgerEntriesHandler)
+		admin.GET("/ledger/reconciliation", getLedgerReconciliationHandler)
+		admin.POST("/invoices/:id/void", voidInvoiceHandler)
+
 		admin.GET("/donations", getAdminDonationsHandler)
+		admin.POST("/creator-donations/:id/refund", refundCreatorDonationHandler)
+		admin.GET("/payouts", getAdminPayoutsHandler)
+		admin.PUT("/payouts/:id/approve", approveCreatorPayoutHandler)
+		admin.PUT("/payouts/:id/reject", rejectCreatorPayoutHandler)
+		admin.PUT("/payouts/:id/mark-paid", markCreatorPayoutPaidHandler)
 		admin.PUT("/donation-settings", updateDonationSettingsHandler)
 
+		admin.GET("/billing-notifications", getBillingNotificationTemplatesHandler)
+		admin.GET("/billing-notifications/:event/preview", previewBillingNotificationHandler)
+		admin.POST("/billing-notifications/:event/preview", previewBillingNotificationHandler)
+
+		admin.GET("/plan-prices", getPlanPricesHandler)
+		admin.PUT("/plan-prices", setPlanPriceHandler)
+
 		admin.GET("/subscription-plans", getAdminSubscriptionPlansHandler)
 		admin.POST("/subscription-plans", createSubscriptionPlanHandler)
 		admin.PUT("/subscription-plans/:id", updateSubscriptionPlanHandler)
@@ -212,13 +230,33 @@ func verifyManualPaymentHandler(c *gin.Context) {
 	}
 	c.ShouldBindJSON(&req)
 
+	if payment.Status == "verified" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Payment already verified"})
+		return
+	}
+
 	now := time.Now()
 	payment.Status = "verified"
 	payment.VerifiedBy = ptrInt(int(userID))
 	payment.VerifiedAt = &now
 	payment.AdminNotes = req.AdminNotes
 	payment.UpdatedAt = now
-	db.Save(&payment)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&payment).Error; err != nil {
+			return err
+		}
+		if payment.InvoiceID != nil {
+			if err := tx.Model(&Invoice{}).Where("id = ? AND status = ?", *payment.InvoiceID, "issued").
+				Updates(map[string]interface{}{"status": "paid", "paid_at": now}).Error; err != nil {
+				return err
+			}
+		}
+		return postManualPaymentLedger(tx, &payment)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify payment"})
+		return
+	}
 
 	if payment.OrgID != nil {
 		var sub OrgSubscription
@@ -229,6 +267,7 @@ func verifyManualPaymentHandler(c *gin.Context) {
 			sub.UpdatedAt = now
 			db.Save(&sub)
 		}
+		reactivateOrgSubscription(*payment.OrgID)
 	}
 
 	c.JSON(http.StatusOK, gin.H{
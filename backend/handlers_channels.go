@@ -128,6 +128,7 @@ func deleteChannelHandler(c *gin.Context) {
         db.Where("channel_id = ?", channelID).Delete(&ChannelMember{})
         db.Where("channel_id = ?", channelID).Delete(&ChannelPermission{})
         db.Where("channel_id = ?", channelID).Delete(&PinnedMessage{})
+        db.Where("channel_id = ?", channelID).Delete(&ChannelJarvisPrompt{})
         db.Delete(&channel)
 
         c.JSON(http.StatusOK, gin.H{"status": "deleted"})
@@ -1,135 +1,961 @@
 package main
 
 import (
+	"archive/zip"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"io"
+	"log"
 	"net/http"
 	"os"
+	"path"
+	"path/filepath"
 	"strconv"
-	"time"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
-// Export Chat (Download CSV/JSON)
+const (
+	exportBatchSize   = 500
+	exportDir         = "./exports"
+	exportWriteWindow = 30 * time.Second
+	exportMaxWorkers  = 2
+)
+
+var (
+	exportFileTTL = 24 * time.Hour
+	exportWorkers = make(chan struct{}, exportMaxWorkers)
+)
+
+// exportContentTypes doubles as the list of supported formats.
+var exportContentTypes = map[string]string{
+	"json":  "application/json",
+	"jsonl": "application/x-ndjson",
+	"csv":   "text/csv; charset=utf-8",
+	"html":  "text/html; charset=utf-8",
+}
+
+type exportParams struct {
+	ChannelID uint   `form:"channel_id" json:"channel_id"`
+	UserID    uint   `form:"user_id" json:"user_id"`
+	Format    string `form:"format" json:"format"`
+	Bundle    bool   `form:"bundle" json:"bundle"`
+	From      string `form:"from" json:"from"`
+	To        string `form:"to" json:"to"`
+}
+
+// exportRequest is a validated, permission-checked export description shared
+// by the streaming download and the background job.
+type exportRequest struct {
+	Scope     string
+	ChannelID uint
+	PeerID    uint
+	UserID    uint
+	Format    string
+	Bundle    bool
+	From      *time.Time
+	To        *time.Time
+	Title     string
+}
+
+type exportAttachment struct {
+	ID       uint   `json:"id"`
+	FileName string `json:"file_name"`
+	FileType string `json:"file_type"`
+	FileSize int64  `json:"file_size"`
+	URL      string `json:"url"`
+	Path     string `json:"path,omitempty"`
+}
+
+type exportRow struct {
+	ID          uint               `json:"id"`
+	AuthorID    uint               `json:"author_id"`
+	Author      string             `json:"author"`
+	Content     string             `json:"content"`
+	Edited      bool               `json:"edited"`
+	CreatedAt   time.Time          `json:"created_at"`
+	Attachments []exportAttachment `json:"attachments,omitempty"`
+}
+
+type exportManifest struct {
+	Version         int        `json:"version"`
+	GeneratedAt     time.Time  `json:"generated_at"`
+	Scope           string     `json:"scope"`
+	ChannelID       uint       `json:"channel_id,omitempty"`
+	PeerID          uint       `json:"peer_id,omitempty"`
+	Title           string     `json:"title"`
+	Format          string     `json:"format"`
+	From            *time.Time `json:"from,omitempty"`
+	To              *time.Time `json:"to,omitempty"`
+	MessagesFile    string     `json:"messages_file"`
+	Messages        int64      `json:"messages"`
+	Attachments     int        `json:"attachments"`
+	AttachmentBytes int64      `json:"attachment_bytes"`
+	Missing         []string   `json:"missing,omitempty"`
+}
+
+func setupExportRoutes(r *gin.Engine, auth gin.HandlerFunc) {
+	export := r.Group("/api/export")
+	export.Use(auth)
+	{
+		export.GET("/chat", exportChatDownloadHandler)
+		export.POST("/jobs", exportChatStorageHandler)
+		export.GET("/jobs", listExportJobsHandler)
+		export.GET("/jobs/:id", getExportJobHandler)
+		export.GET("/jobs/:id/download", downloadExportJobHandler)
+		export.DELETE("/jobs/:id", deleteExportJobHandler)
+	}
+}
+
+// InitExportJobs prepares the export directory, fails jobs interrupted by a
+// restart and starts the TTL sweeper.
+func InitExportJobs() {
+	if hours, err := strconv.Atoi(os.Getenv("EXPORT_TTL_HOURS")); err == nil && hours > 0 {
+		exportFileTTL = time.Duration(hours) * time.Hour
+	}
+	os.MkdirAll(exportDir, 0750)
+
+	if db == nil {
+		return
+	}
+
+	db.Model(&ExportJob{}).Where("status IN ?", []string{"queued", "running"}).Updates(map[string]interface{}{
+		"status": "failed",
+		"error":  "interrupted by server restart",
+	})
+
+	go func() {
+		ticker := time.NewTicker(15 * time.Minute)
+		defer ticker.Stop()
+		cleanupExpiredExports()
+		for range ticker.C {
+			cleanupExpiredExports()
+		}
+	}()
+}
+
+func cleanupExpiredExports() {
+	var jobs []ExportJob
+	db.Where("status = ? AND expires_at < ?", "completed", time.Now()).Find(&jobs)
+
+	for _, job := range jobs {
+		if job.FilePath != "" {
+			if err := os.Remove(job.FilePath); err != nil && !os.IsNotExist(err) {
+				log.Printf("[Export] Failed to remove %s: %v", job.FilePath, err)
+				continue
+			}
+		}
+		db.Model(&job).Updates(map[string]interface{}{"status": "expired", "file_path": ""})
+	}
+
+	if len(jobs) > 0 {
+		log.Printf("[Export] Removed %d expired export files", len(jobs))
+	}
+}
+
+// Export Chat (streaming download)
 func exportChatDownloadHandler(c *gin.Context) {
-	handleExport(c, false)
+	userIDRaw, _ := c.Get("user_id")
+	userID, _ := extractUserID(userIDRaw)
+
+	var params exportParams
+	if err := c.ShouldBindQuery(&params); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	req, status, err := resolveExportRequest(userID, params)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	filename := exportFileName(req, time.Now())
+	contentType := exportContentTypes[req.Format]
+	if req.Bundle {
+		contentType = "application/zip"
+	}
+	c.Header("Content-Disposition", "attachment; filename="+filename)
+	c.Header("Content-Type", contentType)
+	c.Status(http.StatusOK)
+
+	// The server-wide WriteTimeout is far too short for a large channel, so the
+	// deadline is pushed forward after every batch instead.
+	rc := http.NewResponseController(c.Writer)
+	rc.SetWriteDeadline(time.Now().Add(exportWriteWindow))
+
+	count, err := writeExport(c.Writer, req, func(processed int64) {
+		rc.SetWriteDeadline(time.Now().Add(exportWriteWindow))
+		rc.Flush()
+	})
+	if err != nil {
+		// Headers are already sent; the client sees a truncated body.
+		log.Printf("[Export] Streaming export for user %d failed after %d messages: %v", userID, count, err)
+		return
+	}
+
+	go LogAuditViaGRPC(userID, "chat_export_download", req.Scope, exportTargetID(req), "export",
+		fmt.Sprintf("format:%s bundle:%t count:%d", req.Format, req.Bundle, count), c.ClientIP(), c.Request.UserAgent())
 }
 
-// Export Chat (To Server Storage)
+// Export Chat (background job to server storage)
 func exportChatStorageHandler(c *gin.Context) {
-	handleExport(c, true)
+	userIDRaw, _ := c.Get("user_id")
+	userID, _ := extractUserID(userIDRaw)
+
+	var params exportParams
+	if err := c.ShouldBind(&params); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	req, status, err := resolveExportRequest(userID, params)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	var active int64
+	db.Model(&ExportJob{}).Where("user_id = ? AND status IN ?", userID, []string{"queued", "running"}).Count(&active)
+	if active >= 3 {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many exports in progress"})
+		return
+	}
+
+	job := ExportJob{
+		UserID: userID,
+		Scope:  req.Scope,
+		Format: req.Format,
+		Bundle: req.Bundle,
+		From:   req.From,
+		To:     req.To,
+		Status: "queued",
+	}
+	if req.Scope == "channel" {
+		job.ChannelID = &req.ChannelID
+	} else {
+		job.PeerID = &req.PeerID
+	}
+	if err := db.Create(&job).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create export job"})
+		return
+	}
+
+	go runExportJob(job.ID, req)
+
+	go LogAuditViaGRPC(userID, "chat_export_storage", req.Scope, exportTargetID(req), "export",
+		fmt.Sprintf("format:%s bundle:%t job:%d", req.Format, req.Bundle, job.ID), c.ClientIP(), c.Request.UserAgent())
+
+	c.JSON(http.StatusAccepted, job)
 }
 
-func handleExport(c *gin.Context, toStorage bool) {
-	// 1. Auth
+func listExportJobsHandler(c *gin.Context) {
 	userIDRaw, _ := c.Get("user_id")
 	userID, _ := extractUserID(userIDRaw)
-	
-	channelIDStr := c.Query("channel_id")
-	format := c.DefaultQuery("format", "json")
-	format = strings.ToLower(format)
-	if format != "json" && format != "csv" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid format"})
+
+	var jobs []ExportJob
+	db.Where("user_id = ?", userID).Order("created_at DESC").Limit(50).Find(&jobs)
+
+	c.JSON(http.StatusOK, jobs)
+}
+
+func getExportJobHandler(c *gin.Context) {
+	job, ok := loadOwnExportJob(c)
+	if !ok {
 		return
 	}
-	// Map validated format to a safe file extension to avoid using raw user input in paths.
-	ext := "json"
-	if format == "csv" {
-		ext = "csv"
+	c.JSON(http.StatusOK, job)
+}
+
+func downloadExportJobHandler(c *gin.Context) {
+	job, ok := loadOwnExportJob(c)
+	if !ok {
+		return
 	}
 
-	if channelIDStr == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "channel_id required"})
+	if job.Status != "completed" || job.FilePath == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Export is not ready", "status": job.Status})
+		return
+	}
+	if job.ExpiresAt != nil && job.ExpiresAt.Before(time.Now()) {
+		c.JSON(http.StatusGone, gin.H{"error": "Export has expired"})
 		return
 	}
 
-	cid, _ := strconv.ParseUint(channelIDStr, 10, 32)
-	var channel Channel
-	if err := db.First(&channel, cid).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Now().Add(10 * time.Minute))
+	c.FileAttachment(job.FilePath, job.FileName)
+}
+
+func deleteExportJobHandler(c *gin.Context) {
+	job, ok := loadOwnExportJob(c)
+	if !ok {
 		return
 	}
 
-	// 2. Permission: ManageMessages or Global Admin
-	allowed := false
-	if hasGlobalRole(userID, "admin") {
-		allowed = true
-	} else {
-		perms, _ := calculateGuildPermissions(userID, channel.GuildID)
-		if (perms & PermManageMessages) != 0 || (perms & PermAdministrator) != 0 {
-			allowed = true
+	if job.Status == "queued" || job.Status == "running" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Export is still in progress"})
+		return
+	}
+
+	if job.FilePath != "" {
+		os.Remove(job.FilePath)
+	}
+	db.Delete(&job)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Export deleted"})
+}
+
+func loadOwnExportJob(c *gin.Context) (ExportJob, bool) {
+	userIDRaw, _ := c.Get("user_id")
+	userID, _ := extractUserID(userIDRaw)
+
+	var job ExportJob
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return job, false
+	}
+	if db.Where("id = ? AND user_id = ?", id, userID).First(&job).RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
+		return job, false
+	}
+	return job, true
+}
+
+// resolveExportRequest validates the parameters and checks that the user may
+// export the requested conversation. The returned status is meaningful only
+// when err is non-nil.
+func resolveExportRequest(userID uint, params exportParams) (*exportRequest, int, error) {
+	format := strings.ToLower(params.Format)
+	if format == "" {
+		format = "json"
+	}
+	if _, ok := exportContentTypes[format]; !ok {
+		return nil, http.StatusBadRequest, errors.New("invalid format")
+	}
+
+	req := &exportRequest{UserID: userID, Format: format, Bundle: params.Bundle}
+
+	var err error
+	if req.From, err = parseExportTime(params.From, false); err != nil {
+		return nil, http.StatusBadRequest, errors.New("invalid from date")
+	}
+	if req.To, err = parseExportTime(params.To, true); err != nil {
+		return nil, http.StatusBadRequest, errors.New("invalid to date")
+	}
+	if req.From != nil && req.To != nil && req.To.Before(*req.From) {
+		return nil, http.StatusBadRequest, errors.New("to must not be before from")
+	}
+
+	switch {
+	case params.ChannelID != 0:
+		var channel Channel
+		if err := db.First(&channel, params.ChannelID).Error; err != nil {
+			return nil, http.StatusNotFound, errors.New("Channel not found")
 		}
+
+		// Permission: ManageMessages or Global Admin
+		allowed := hasGlobalRole(userID, "admin")
+		if !allowed {
+			perms, _ := calculateGuildPermissions(userID, channel.GuildID)
+			allowed = (perms&PermManageMessages) != 0 || (perms&PermAdministrator) != 0
+		}
+		if !allowed {
+			return nil, http.StatusForbidden, errors.New("Insufficient permissions to export")
+		}
+
+		req.Scope = "channel"
+		req.ChannelID = channel.ID
+		req.Title = "#" + channel.Name
+	case params.UserID != 0:
+		var peer User
+		if db.First(&peer, params.UserID).RowsAffected == 0 {
+			return nil, http.StatusNotFound, errors.New("User not found")
+		}
+
+		req.Scope = "dm"
+		req.PeerID = peer.ID
+		req.Title = "@" + peer.Username
+	default:
+		return nil, http.StatusBadRequest, errors.New("channel_id or user_id required")
+	}
+
+	return req, 0, nil
+}
+
+// parseExportTime accepts RFC3339 or a plain date. A plain date used as the
+// upper bound covers the whole day.
+func parseExportTime(value string, endOfDay bool) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return nil, err
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return &t, nil
+}
+
+func exportTargetID(req *exportRequest) string {
+	switch req.Scope {
+	case "channel":
+		return strconv.FormatUint(uint64(req.ChannelID), 10)
+	case "account":
+		return strconv.FormatUint(uint64(req.UserID), 10)
+	}
+	return strconv.FormatUint(uint64(req.PeerID), 10)
+}
+
+func exportFileName(req *exportRequest, now time.Time) string {
+	ext := req.Format
+	if req.Bundle {
+		ext = "zip"
+	}
+	return fmt.Sprintf("export_%s_%s_%d.%s", req.Scope, exportTargetID(req), now.Unix(), ext)
+}
+
+func runExportJob(jobID uint, req *exportRequest) {
+	exportWorkers <- struct{}{}
+	defer func() { <-exportWorkers }()
+
+	var job ExportJob
+	if db.First(&job, jobID).RowsAffected == 0 {
+		return
 	}
 
-	if !allowed {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions to export"})
+	job.Status = "running"
+	job.Total = countExportRows(req)
+	db.Model(&job).Updates(map[string]interface{}{"status": job.Status, "total": job.Total})
+
+	fail := func(err error) {
+		log.Printf("[Export] Job %d failed: %v", job.ID, err)
+		job.Status = "failed"
+		db.Model(&job).Updates(map[string]interface{}{"status": job.Status, "error": err.Error()})
+		notifyExportJob(&job)
+	}
+
+	os.MkdirAll(exportDir, 0750)
+	filename := exportFileName(req, time.Now())
+	filePath := filepath.Join(exportDir, fmt.Sprintf("%d_%s", job.ID, filename))
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		fail(err)
 		return
 	}
 
-	// 3. Fetch Data
-	var messages []Message
-	db.Where("channel_id = ?", cid).Order("created_at ASC").Preload("Author").Find(&messages)
+	lastNotify := time.Now()
+	_, err = writeExport(file, req, func(processed int64) {
+		job.Processed = processed
+		db.Model(&job).Update("processed", processed)
+		if time.Since(lastNotify) > 2*time.Second {
+			lastNotify = time.Now()
+			notifyExportJob(&job)
+		}
+	})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filePath)
+		fail(err)
+		return
+	}
 
-	// 4. Process Export
-	if toStorage {
-		filename := fmt.Sprintf("export_%d_%d.%s", cid, time.Now().Unix(), ext)
-		filepath := "./uploads/exports/" + filename
-		os.MkdirAll("./uploads/exports", 0750)
+	var size int64
+	if info, err := os.Stat(filePath); err == nil {
+		size = info.Size()
+	}
 
-		file, err := os.Create(filepath)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create export file"})
-			return
+	now := time.Now()
+	expiresAt := now.Add(exportFileTTL)
+	job.Status = "completed"
+	db.Model(&job).Updates(map[string]interface{}{
+		"status":       job.Status,
+		"file_name":    filename,
+		"file_path":    filePath,
+		"file_size":    size,
+		"completed_at": now,
+		"expires_at":   expiresAt,
+	})
+
+	uid := job.UserID
+	if err := recordUsage(UsageEvent{
+		IdempotencyKey: fmt.Sprintf("export_job:%d", job.ID),
+		UserID:         &uid,
+		Metric:         usageExportJobs,
+		Quantity:       1,
+		Source:         "export",
+		OccurredAt:     now,
+	}); err != nil {
+		log.Printf("[Export] Failed to meter job %d: %v", job.ID, err)
+	}
+
+	notifyExportJob(&job)
+	go createNotificationHandler(job.UserID, "export_ready",
+		fmt.Sprintf("Экспорт %s готов и доступен до %s", req.Title, expiresAt.Format("02.01.2006 15:04")))
+}
+
+func notifyExportJob(job *ExportJob) {
+	hub.sendToUser(strconv.FormatUint(uint64(job.UserID), 10), map[string]interface{}{
+		"type":      "export_job",
+		"id":        job.ID,
+		"status":    job.Status,
+		"total":     job.Total,
+		"processed": job.Processed,
+	})
+}
+
+// writeExport streams the conversation to w, wrapping it in a ZIP bundle with
+// attachments and a manifest when requested. progress is called after every
+// batch with the number of messages walked so far; a bundle walks them twice.
+func writeExport(w io.Writer, req *exportRequest, progress func(processed int64)) (int64, error) {
+	if req.Scope == "account" {
+		return writeAccountExport(w, req, progress)
+	}
+	if !req.Bundle {
+		return writeExportMessages(w, req, progress)
+	}
+
+	zw := zip.NewWriter(w)
+	manifest := exportManifest{
+		Version:      1,
+		GeneratedAt:  time.Now().UTC(),
+		Scope:        req.Scope,
+		ChannelID:    req.ChannelID,
+		PeerID:       req.PeerID,
+		Title:        req.Title,
+		Format:       req.Format,
+		From:         req.From,
+		To:           req.To,
+		MessagesFile: "messages." + req.Format,
+	}
+
+	entry, err := zw.Create(manifest.MessagesFile)
+	if err != nil {
+		return 0, err
+	}
+	count, err := writeExportMessages(entry, req, progress)
+	if err != nil {
+		return count, err
+	}
+	manifest.Messages = count
+
+	// zip.Writer allows one open entry at a time, so attachments are copied in
+	// a second pass rather than collected while the messages are written.
+	walked := count
+	err = streamExportRows(req, func(batch []exportRow) error {
+		for _, row := range batch {
+			for _, att := range row.Attachments {
+				n, err := copyExportAttachment(zw, att)
+				if err != nil {
+					manifest.Missing = append(manifest.Missing, att.URL)
+					continue
+				}
+				manifest.Attachments++
+				manifest.AttachmentBytes += n
+			}
 		}
-		defer file.Close()
+		walked += int64(len(batch))
+		progress(walked)
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+
+	entry, err = zw.Create("manifest.json")
+	if err != nil {
+		return count, err
+	}
+	enc := json.NewEncoder(entry)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return count, err
+	}
+
+	return count, zw.Close()
+}
+
+func writeExportMessages(w io.Writer, req *exportRequest, progress func(processed int64)) (int64, error) {
+	enc := newExportEncoder(req.Format, w)
+	if err := enc.Begin(req); err != nil {
+		return 0, err
+	}
 
-		if format == "csv" {
-			writer := csv.NewWriter(file)
-			writer.Write([]string{"ID", "Author", "Content", "Date"})
-			for _, m := range messages {
-				writer.Write([]string{
-					strconv.Itoa(int(m.ID)),
-					m.Author.Username,
-					m.Content,
-					m.CreatedAt.Format(time.RFC3339),
-				})
+	var count int64
+	err := streamExportRows(req, func(batch []exportRow) error {
+		for i := range batch {
+			if err := enc.Row(&batch[i]); err != nil {
+				return err
 			}
-			writer.Flush()
-		} else {
-			enc := json.NewEncoder(file)
-			enc.SetIndent("", "  ")
-			enc.Encode(messages)
 		}
+		count += int64(len(batch))
+		progress(count)
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+
+	return count, enc.End()
+}
+
+func copyExportAttachment(zw *zip.Writer, att exportAttachment) (int64, error) {
+	return copyUploadToZip(zw, att.URL, att.Path)
+}
 
-		go LogAuditViaGRPC(userID, "chat_export_storage", "channel", channelIDStr, 
-			fmt.Sprintf("format:%s file:%s", format, filename), "", c.ClientIP(), c.Request.UserAgent())
+// copyUploadToZip copies a local upload into the archive under name. Only
+// regular files inside ./uploads are accepted.
+func copyUploadToZip(zw *zip.Writer, url, name string) (int64, error) {
+	local, ok := localUploadPath(url)
+	if !ok {
+		return 0, errors.New("not a local upload")
+	}
+
+	info, err := os.Lstat(local)
+	if err != nil {
+		return 0, err
+	}
+	if !info.Mode().IsRegular() {
+		return 0, errors.New("not a regular file")
+	}
 
-		c.JSON(http.StatusOK, gin.H{"url": "/uploads/exports/" + filename, "count": len(messages)})
+	src, err := os.Open(local)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	dst, err := zw.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(dst, src)
+}
+
+// localUploadPath maps a /uploads/ URL to a path inside ./uploads, rejecting
+// anything that would escape it.
+func localUploadPath(url string) (string, bool) {
+	if !strings.HasPrefix(url, "/uploads/") {
+		return "", false
+	}
+	rel := path.Clean("/" + strings.TrimPrefix(url, "/uploads/"))
+	if rel == "/" || strings.HasPrefix(rel, "/exports/") {
+		return "", false
+	}
+	return filepath.Join("./uploads", filepath.FromSlash(rel)), true
+}
 
+// exportAttachmentPath is the location of an attachment inside a bundle; plain
+// exports only carry the original URL.
+func exportAttachmentPath(req *exportRequest, messageID, attachmentID uint, url string) string {
+	if !req.Bundle {
+		return ""
+	}
+	return fmt.Sprintf("attachments/%d_%d_%s", messageID, attachmentID, path.Base(url))
+}
+
+// countExportRows is the total progress counts up to: the messages, twice
+// for a bundle as its attachments are copied in a second pass.
+func countExportRows(req *exportRequest) int64 {
+	var total int64
+	if req.Scope == "account" {
+		return int64(len(accountExportEntities(req.UserID)))
+	}
+	if req.Scope == "channel" {
+		applyExportRange(db.Model(&Message{}).Where("channel_id = ?", req.ChannelID), req).Count(&total)
 	} else {
-		go LogAuditViaGRPC(userID, "chat_export_download", "channel", channelIDStr, 
-			fmt.Sprintf("format:%s count:%d", format, len(messages)), "", c.ClientIP(), c.Request.UserAgent())
-
-		if format == "csv" {
-			c.Header("Content-Disposition", "attachment; filename=chat_export.csv")
-			c.Header("Content-Type", "text/csv")
-			writer := csv.NewWriter(c.Writer)
-			writer.Write([]string{"ID", "Author", "Content", "Date"})
-			for _, m := range messages {
-				writer.Write([]string{
-					strconv.Itoa(int(m.ID)),
-					m.Author.Username,
-					m.Content,
-					m.CreatedAt.Format(time.RFC3339),
-				})
+		applyExportRange(db.Model(&DirectMessage{}).Where(
+			"(sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)",
+			req.UserID, req.PeerID, req.PeerID, req.UserID), req).Count(&total)
+	}
+	if req.Bundle {
+		total *= 2
+	}
+	return total
+}
+
+// streamExportRows walks the conversation in id order using a keyset cursor so
+// that only one batch is held in memory at a time.
+func streamExportRows(req *exportRequest, fn func(batch []exportRow) error) error {
+	if req.Scope == "channel" {
+		return streamChannelExportRows(req, fn)
+	}
+	return streamDirectExportRows(req, fn)
+}
+
+func streamChannelExportRows(req *exportRequest, fn func(batch []exportRow) error) error {
+	var lastID uint
+	for {
+		var messages []Message
+		q := db.Where("channel_id = ? AND id > ?", req.ChannelID, lastID)
+		if err := applyExportRange(q, req).Order("id ASC").Limit(exportBatchSize).
+			Preload("Author").Find(&messages).Error; err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			return nil
+		}
+
+		ids := make([]uint, len(messages))
+		for i, m := range messages {
+			ids[i] = m.ID
+		}
+		var attachments []FileAttachment
+		db.Where("message_id IN ?", ids).Order("id ASC").Find(&attachments)
+		byMessage := make(map[uint][]exportAttachment)
+		for _, a := range attachments {
+			byMessage[a.MessageID] = append(byMessage[a.MessageID], exportAttachment{
+				ID:       a.ID,
+				FileName: a.FileName,
+				FileType: a.FileType,
+				FileSize: a.FileSize,
+				URL:      a.URL,
+				Path:     exportAttachmentPath(req, a.MessageID, a.ID, a.URL),
+			})
+		}
+
+		batch := make([]exportRow, len(messages))
+		for i, m := range messages {
+			batch[i] = exportRow{
+				ID:          m.ID,
+				AuthorID:    m.AuthorID,
+				Author:      m.Author.Username,
+				Content:     m.Content,
+				Edited:      m.Edited,
+				CreatedAt:   m.CreatedAt,
+				Attachments: byMessage[m.ID],
 			}
-			writer.Flush()
-		} else {
-			c.Header("Content-Disposition", "attachment; filename=chat_export.json")
-			c.JSON(http.StatusOK, messages)
+		}
+		if err := fn(batch); err != nil {
+			return err
+		}
+
+		lastID = messages[len(messages)-1].ID
+		if len(messages) < exportBatchSize {
+			return nil
 		}
 	}
 }
+
+func streamDirectExportRows(req *exportRequest, fn func(batch []exportRow) error) error {
+	names := make(map[uint]string)
+	var users []User
+	db.Where("id IN ?", []uint{req.UserID, req.PeerID}).Find(&users)
+	for _, u := range users {
+		names[u.ID] = u.Username
+	}
+
+	var lastID uint
+	for {
+		var messages []DirectMessage
+		q := db.Where("((sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)) AND id > ?",
+			req.UserID, req.PeerID, req.PeerID, req.UserID, lastID)
+		if err := applyExportRange(q, req).Order("id ASC").Limit(exportBatchSize).Find(&messages).Error; err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			return nil
+		}
+
+		batch := make([]exportRow, len(messages))
+		for i, m := range messages {
+			batch[i] = exportRow{
+				ID:        m.ID,
+				AuthorID:  m.SenderID,
+				Author:    names[m.SenderID],
+				Content:   m.Content,
+				Edited:    m.Edited,
+				CreatedAt: m.CreatedAt,
+			}
+			if m.VoiceURL != nil && *m.VoiceURL != "" {
+				batch[i].Attachments = []exportAttachment{{
+					FileName: path.Base(*m.VoiceURL),
+					FileType: "audio",
+					URL:      *m.VoiceURL,
+					Path:     exportAttachmentPath(req, m.ID, 0, *m.VoiceURL),
+				}}
+			}
+		}
+		if err := fn(batch); err != nil {
+			return err
+		}
+
+		lastID = messages[len(messages)-1].ID
+		if len(messages) < exportBatchSize {
+			return nil
+		}
+	}
+}
+
+func applyExportRange(q *gorm.DB, req *exportRequest) *gorm.DB {
+	if req.From != nil {
+		q = q.Where("created_at >= ?", *req.From)
+	}
+	if req.To != nil {
+		q = q.Where("created_at <= ?", *req.To)
+	}
+	return q
+}
+
+// exportEncoder writes one message format incrementally.
+type exportEncoder interface {
+	Begin(req *exportRequest) error
+	Row(row *exportRow) error
+	End() error
+}
+
+func newExportEncoder(format string, w io.Writer) exportEncoder {
+	switch format {
+	case "jsonl":
+		return &jsonlExportEncoder{w: w}
+	case "csv":
+		return &csvExportEncoder{w: csv.NewWriter(w)}
+	case "html":
+		return &htmlExportEncoder{w: w}
+	default:
+		return &jsonExportEncoder{w: w}
+	}
+}
+
+type jsonExportEncoder struct {
+	w     io.Writer
+	count int
+}
+
+func (e *jsonExportEncoder) Begin(req *exportRequest) error {
+	_, err := io.WriteString(e.w, "[\n")
+	return err
+}
+
+func (e *jsonExportEncoder) Row(row *exportRow) error {
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	if e.count > 0 {
+		if _, err := io.WriteString(e.w, ",\n"); err != nil {
+			return err
+		}
+	}
+	e.count++
+	_, err = e.w.Write(data)
+	return err
+}
+
+func (e *jsonExportEncoder) End() error {
+	_, err := io.WriteString(e.w, "\n]\n")
+	return err
+}
+
+type jsonlExportEncoder struct {
+	w io.Writer
+}
+
+func (e *jsonlExportEncoder) Begin(req *exportRequest) error { return nil }
+
+func (e *jsonlExportEncoder) Row(row *exportRow) error {
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	_, err = e.w.Write(data)
+	return err
+}
+
+func (e *jsonlExportEncoder) End() error { return nil }
+
+type csvExportEncoder struct {
+	w *csv.Writer
+}
+
+func (e *csvExportEncoder) Begin(req *exportRequest) error {
+	return e.w.Write([]string{"ID", "Author", "Content", "Date", "Edited", "Attachments"})
+}
+
+func (e *csvExportEncoder) Row(row *exportRow) error {
+	urls := make([]string, len(row.Attachments))
+	for i, a := range row.Attachments {
+		urls[i] = a.URL
+	}
+	if err := e.w.Write([]string{
+		strconv.Itoa(int(row.ID)),
+		row.Author,
+		row.Content,
+		row.CreatedAt.Format(time.RFC3339),
+		strconv.FormatBool(row.Edited),
+		strings.Join(urls, " "),
+	}); err != nil {
+		return err
+	}
+	// Flush per row so nothing accumulates in the csv buffer between batches.
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvExportEncoder) End() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type htmlExportEncoder struct {
+	w io.Writer
+}
+
+func (e *htmlExportEncoder) Begin(req *exportRequest) error {
+	title := html.EscapeString(req.Title)
+	_, err := fmt.Fprintf(e.w, `<!DOCTYPE html>
+<html lang="ru">
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body{font-family:sans-serif;max-width:860px;margin:2em auto;color:#222}
+.msg{padding:.4em 0;border-bottom:1px solid #eee}
+.author{font-weight:bold}
+.date{color:#888;font-size:.85em;margin-left:.5em}
+.content{white-space:pre-wrap;margin-top:.2em}
+</style>
+</head>
+<body>
+<h1>%s</h1>
+`, title, title)
+	return err
+}
+
+func (e *htmlExportEncoder) Row(row *exportRow) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<div class="msg" id="m%d"><span class="author">%s</span><span class="date">%s</span>`,
+		row.ID, html.EscapeString(row.Author), row.CreatedAt.Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(&b, `<div class="content">%s</div>`, html.EscapeString(row.Content))
+	for _, a := range row.Attachments {
+		href := a.URL
+		if a.Path != "" {
+			href = a.Path
+		}
+		fmt.Fprintf(&b, `<div class="attachment"><a href="%s">%s</a></div>`,
+			html.EscapeString(href), html.EscapeString(a.FileName))
+	}
+	b.WriteString("</div>\n")
+	_, err := io.WriteString(e.w, b.String())
+	return err
+}
+
+func (e *htmlExportEncoder) End() error {
+	_, err := io.WriteString(e.w, "</body>\n</html>\n")
+	return err
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestWriteExportBundle(t *testing.T) {
+	t.Chdir(t.TempDir())
+	testDB(t, &User{}, &Message{}, &FileAttachment{})
+	if err := os.MkdirAll(filepath.Join("uploads", "att"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("uploads", "att", "a.txt"), []byte("attached"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := User{Username: "alice", Password: "x"}
+	db.Create(&alice)
+	messages := []Message{
+		{ChannelID: 7, AuthorID: alice.ID, Content: "first"},
+		{ChannelID: 7, AuthorID: alice.ID, Content: "second"},
+		{ChannelID: 7, AuthorID: alice.ID, Content: "third"},
+		{ChannelID: 8, AuthorID: alice.ID, Content: "other channel"},
+	}
+	db.Create(&messages)
+	present := FileAttachment{MessageID: messages[0].ID, FileName: "a.txt", URL: "/uploads/att/a.txt"}
+	missing := FileAttachment{MessageID: messages[1].ID, FileName: "gone.txt", URL: "/uploads/att/gone.txt"}
+	db.Create(&present)
+	db.Create(&missing)
+
+	req := &exportRequest{Scope: "channel", ChannelID: 7, UserID: alice.ID, Format: "jsonl", Bundle: true, Title: "#general"}
+	var buf bytes.Buffer
+	var progress []int64
+	count, err := writeExport(&buf, req, func(n int64) { progress = append(progress, n) })
+	if err != nil || count != 3 {
+		t.Fatalf("writeExport = %d, %v", count, err)
+	}
+	if want := []int64{3, 6}; !reflect.DeepEqual(progress, want) {
+		t.Errorf("progress = %v, want %v", progress, want)
+	}
+	if total := countExportRows(req); total != 6 {
+		t.Errorf("bundle total = %d, want both passes", total)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(data)
+	}
+	attachmentPath := exportAttachmentPath(req, messages[0].ID, present.ID, present.URL)
+	if files[attachmentPath] != "attached" {
+		t.Errorf("attachment %s = %q", attachmentPath, files[attachmentPath])
+	}
+	if len(files) != 3 {
+		t.Errorf("bundle has %d entries, want messages, one attachment and the manifest", len(files))
+	}
+
+	var rows []exportRow
+	sc := bufio.NewScanner(bytes.NewReader([]byte(files["messages.jsonl"])))
+	for sc.Scan() {
+		var row exportRow
+		if err := json.Unmarshal(sc.Bytes(), &row); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) != 3 || rows[0].Content != "first" || rows[2].Content != "third" || rows[0].Author != "alice" {
+		t.Fatalf("messages = %+v", rows)
+	}
+	if len(rows[0].Attachments) != 1 || rows[0].Attachments[0].Path != attachmentPath {
+		t.Errorf("first message attachments = %+v", rows[0].Attachments)
+	}
+
+	var manifest exportManifest
+	if err := json.Unmarshal([]byte(files["manifest.json"]), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Messages != 3 || manifest.Attachments != 1 || manifest.AttachmentBytes != 8 ||
+		!reflect.DeepEqual(manifest.Missing, []string{missing.URL}) || manifest.MessagesFile != "messages.jsonl" {
+		t.Errorf("manifest = %+v", manifest)
+	}
+}
+
+// More messages than a batch are written in order, batch by batch, and the
+// date range and channel are applied to every batch.
+func TestWriteExportStreamsBatches(t *testing.T) {
+	testDB(t, &User{}, &Message{}, &FileAttachment{})
+	alice := User{Username: "alice", Password: "x"}
+	db.Create(&alice)
+
+	start := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	messages := []Message{{ChannelID: 7, AuthorID: alice.ID, Content: "too early", CreatedAt: start.AddDate(0, 0, -1)}}
+	for i := 0; i < 2*exportBatchSize+1; i++ {
+		messages = append(messages, Message{ChannelID: 7, AuthorID: alice.ID, Content: strconv.Itoa(i), CreatedAt: start.Add(time.Duration(i) * time.Second)})
+	}
+	messages = append(messages, Message{ChannelID: 8, AuthorID: alice.ID, Content: "other channel", CreatedAt: start})
+	if err := db.CreateInBatches(&messages, 200).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	req := &exportRequest{Scope: "channel", ChannelID: 7, UserID: alice.ID, Format: "json", From: &start}
+	var buf bytes.Buffer
+	var progress []int64
+	count, err := writeExport(&buf, req, func(n int64) { progress = append(progress, n) })
+	if err != nil || count != 2*exportBatchSize+1 {
+		t.Fatalf("writeExport = %d, %v", count, err)
+	}
+	if want := []int64{exportBatchSize, 2 * exportBatchSize, 2*exportBatchSize + 1}; !reflect.DeepEqual(progress, want) {
+		t.Errorf("progress = %v, want %v", progress, want)
+	}
+	if total := countExportRows(req); total != count {
+		t.Errorf("total = %d, want %d", total, count)
+	}
+
+	var rows []exportRow
+	if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	for i, row := range rows {
+		if row.Content != strconv.Itoa(i) {
+			t.Fatalf("row %d = %q", i, row.Content)
+		}
+	}
+}
+
+// A finished job is downloadable for exportFileTTL and swept afterwards.
+func TestRunExportJobTTL(t *testing.T) {
+	t.Chdir(t.TempDir())
+	testDB(t, &User{}, &Message{}, &FileAttachment{}, &ExportJob{}, &UsageEvent{}, &OrgMember{}, &UserSettings{}, &TelegramNotification{})
+	saved := exportFileTTL
+	t.Cleanup(func() { exportFileTTL = saved })
+	exportFileTTL = 2 * time.Hour
+
+	alice := User{Username: "alice", Password: "x"}
+	db.Create(&alice)
+	db.Create(&Message{ChannelID: 7, AuthorID: alice.ID, Content: "hello"})
+	job := ExportJob{UserID: alice.ID, Scope: "channel", Format: "json", Status: "queued"}
+	db.Create(&job)
+
+	before := time.Now()
+	runExportJob(job.ID, &exportRequest{Scope: "channel", ChannelID: 7, UserID: alice.ID, Format: "json", Title: "#general"})
+	db.First(&job, job.ID)
+	if job.Status != "completed" || job.Total != 1 || job.Processed != 1 || job.ExpiresAt == nil {
+		t.Fatalf("job = %+v", job)
+	}
+	if ttl := job.ExpiresAt.Sub(before); ttl < 2*time.Hour || ttl > 2*time.Hour+time.Minute {
+		t.Errorf("expires after %s, want the configured TTL", ttl)
+	}
+	if data, err := os.ReadFile(job.FilePath); err != nil || !bytes.Contains(data, []byte("hello")) {
+		t.Fatalf("export file = %q, %v", data, err)
+	}
+
+	cleanupExpiredExports()
+	if _, err := os.Stat(job.FilePath); err != nil {
+		t.Fatalf("swept before expiry: %v", err)
+	}
+	db.Model(&job).Update("expires_at", time.Now().Add(-time.Second))
+	cleanupExpiredExports()
+	if _, err := os.Stat(job.FilePath); !os.IsNotExist(err) {
+		t.Error("the file outlived its TTL")
+	}
+}
+
+func TestCleanupExpiredExports(t *testing.T) {
+	dir := t.TempDir()
+	testDB(t, &ExportJob{})
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+
+	oldPath, freshPath := filepath.Join(dir, "old.zip"), filepath.Join(dir, "fresh.zip")
+	for _, p := range []string{oldPath, freshPath} {
+		if err := os.WriteFile(p, []byte("zip"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := ExportJob{UserID: 1, Scope: "channel", Format: "json", Status: "completed", FilePath: oldPath, ExpiresAt: &past}
+	fresh := ExportJob{UserID: 1, Scope: "channel", Format: "json", Status: "completed", FilePath: freshPath, ExpiresAt: &future}
+	failed := ExportJob{UserID: 1, Scope: "channel", Format: "json", Status: "failed", ExpiresAt: &past}
+	db.Create(&old)
+	db.Create(&fresh)
+	db.Create(&failed)
+
+	cleanupExpiredExports()
+
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Error("the expired file was kept")
+	}
+	if _, err := os.Stat(freshPath); err != nil {
+		t.Errorf("the fresh file was removed: %v", err)
+	}
+	for id, want := range map[uint]string{old.ID: "expired", fresh.ID: "completed", failed.ID: "failed"} {
+		var job ExportJob
+		db.First(&job, id)
+		if job.Status != want {
+			t.Errorf("job %d status = %s, want %s", id, job.Status, want)
+		}
+		if want == "expired" && job.FilePath != "" {
+			t.Errorf("job %d still points at %s", id, job.FilePath)
+		}
+	}
+}
+
+func TestDownloadExportJobAccess(t *testing.T) {
+	dir := t.TempDir()
+	testDB(t, &ExportJob{})
+	path := filepath.Join(dir, "export.json")
+	if err := os.WriteFile(path, []byte(`[{"id":1}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	ready := ExportJob{UserID: 1, Scope: "channel", Format: "json", Status: "completed", FileName: "export.json", FilePath: path, ExpiresAt: &future}
+	running := ExportJob{UserID: 1, Scope: "channel", Format: "json", Status: "running"}
+	expired := ExportJob{UserID: 1, Scope: "channel", Format: "json", Status: "completed", FileName: "export.json", FilePath: path, ExpiresAt: &past}
+	db.Create(&ready)
+	db.Create(&running)
+	db.Create(&expired)
+
+	download := func(uid uint, id string) *bytes.Buffer {
+		c, w := testContext(http.MethodGet, "/api/export/jobs/"+id+"/download", nil, uid)
+		c.Params = gin.Params{{Key: "id", Value: id}}
+		downloadExportJobHandler(c)
+		c.Writer.WriteHeaderNow()
+		if w.Code != http.StatusOK {
+			return bytes.NewBufferString(strconv.Itoa(w.Code))
+		}
+		return w.Body
+	}
+	id := func(job ExportJob) string { return strconv.FormatUint(uint64(job.ID), 10) }
+
+	if got := download(1, id(ready)).String(); got != `[{"id":1}]` {
+		t.Errorf("owner download = %q", got)
+	}
+	for _, tc := range []struct {
+		uid  uint
+		id   string
+		want string
+	}{
+		{2, id(ready), "404"}, // someone else's export
+		{1, id(running), "409"},
+		{1, id(expired), "410"},
+		{1, "abc", "400"},
+	} {
+		if got := download(tc.uid, tc.id).String(); got != tc.want {
+			t.Errorf("user %d, job %s: %s, want %s", tc.uid, tc.id, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,860 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// guildTemplateVersion is the current GuildTemplateDocument format. Importers
+// accept every version up to and including this one.
+const guildTemplateVersion = 1
+
+const (
+	guildTemplateMaxRoles      = 100
+	guildTemplateMaxCategories = 50
+	guildTemplateMaxChannels   = 200
+	guildTemplateMaxTools      = 10
+	guildTemplateMaxContent    = 1 << 20
+	guildTemplateMaxBody       = 16 << 20
+	guildTemplateEveryone      = "@everyone"
+)
+
+var (
+	guildTemplateChannelTypes = map[string]bool{"text": true, "voice": true, "video": true, "board": true, "notebook": true}
+	guildTemplateToolTypes    = map[string]bool{"board": true, "notebook": true}
+	guildTemplateVisibility   = map[string]bool{"all": true, "moderators": true, "owner": true}
+	guildTemplateColor        = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+	errGuildImportDryRun = errors.New("dry run")
+)
+
+// GuildTemplateDocument is the portable, versioned snapshot of a guild's
+// structure. Keys are opaque references used to link channels to categories
+// and overwrites to roles inside the document; they are not database IDs.
+type GuildTemplateDocument struct {
+	Version     int                     `json:"version"`
+	Name        string                  `json:"name"`
+	Description string                  `json:"description,omitempty"`
+	ExportedAt  time.Time               `json:"exported_at"`
+	Roles       []GuildTemplateRole     `json:"roles"`
+	Categories  []GuildTemplateCategory `json:"categories"`
+	Channels    []GuildTemplateChannel  `json:"channels"`
+}
+
+type GuildTemplateRole struct {
+	Key         string `json:"key"`
+	Name        string `json:"name"`
+	Color       string `json:"color,omitempty"`
+	Position    int    `json:"position"`
+	Permissions int64  `json:"permissions"`
+	Mentionable bool   `json:"mentionable"`
+}
+
+type GuildTemplateCategory struct {
+	Key      string `json:"key"`
+	Name     string `json:"name"`
+	Position int    `json:"position"`
+}
+
+type GuildTemplateChannel struct {
+	Key         string                   `json:"key"`
+	Name        string                   `json:"name"`
+	Description string                   `json:"description,omitempty"`
+	Type        string                   `json:"type"`
+	Position    int                      `json:"position"`
+	IsPrivate   bool                     `json:"is_private"`
+	Category    string                   `json:"category,omitempty"`
+	Overwrites  []GuildTemplateOverwrite `json:"overwrites,omitempty"`
+	Tools       []GuildTemplateTool      `json:"tools,omitempty"`
+}
+
+// GuildTemplateOverwrite is a role-level channel permission. User-level
+// overwrites are not portable and are never exported.
+type GuildTemplateOverwrite struct {
+	Role  string `json:"role"` // role key or @everyone
+	Allow int64  `json:"allow"`
+	Deny  int64  `json:"deny"`
+}
+
+type GuildTemplateTool struct {
+	ToolType  string  `json:"tool_type"`
+	Title     string  `json:"title"`
+	VisibleTo string  `json:"visible_to"`
+	Content   *string `json:"content,omitempty"`
+}
+
+type guildImportOptions struct {
+	OnConflict string // skip, rename, overwrite
+	DryRun     bool
+	UserID     uint
+}
+
+type guildImportCounts struct {
+	Roles      int `json:"roles"`
+	Categories int `json:"categories"`
+	Channels   int `json:"channels"`
+	Overwrites int `json:"overwrites"`
+	Tools      int `json:"tools"`
+}
+
+type guildImportResult struct {
+	GuildID uint              `json:"guild_id"`
+	DryRun  bool              `json:"dry_run"`
+	Created guildImportCounts `json:"created"`
+	Updated guildImportCounts `json:"updated"`
+	Skipped guildImportCounts `json:"skipped"`
+	Renamed []string          `json:"renamed,omitempty"`
+}
+
+func setupGuildTemplateRoutes(r *gin.Engine, auth gin.HandlerFunc) {
+	guilds := r.Group("/api/guilds")
+	guilds.Use(auth)
+	{
+		guilds.GET("/:id/template", exportGuildTemplateHandler)
+		guilds.POST("/:id/template", saveGuildTemplateHandler)
+		guilds.POST("/:id/import", importIntoGuildHandler)
+		guilds.POST("/import", importNewGuildHandler)
+	}
+
+	r.GET("/api/templates/guilds/mine", auth, getMyGuildTemplatesHandler)
+	r.DELETE("/api/templates/guilds/mine/:id", auth, deleteMyGuildTemplateHandler)
+}
+
+func exportGuildTemplateHandler(c *gin.Context) {
+	userID, _ := getUserIDFromContext(c)
+
+	guild, ok := loadManageableGuild(c, userID)
+	if !ok {
+		return
+	}
+
+	doc := buildGuildTemplateDocument(guild, c.Query("include_content") == "true")
+
+	go LogAuditViaGRPC(userID, "guild_template_export", "guild", strconv.FormatUint(uint64(guild.ID), 10),
+		fmt.Sprintf("guild:%d", guild.ID), fmt.Sprintf("channels:%d roles:%d", len(doc.Channels), len(doc.Roles)),
+		c.ClientIP(), c.Request.UserAgent())
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=guild_%d_template.json", guild.ID))
+	c.JSON(http.StatusOK, doc)
+}
+
+func saveGuildTemplateHandler(c *gin.Context) {
+	userID, _ := getUserIDFromContext(c)
+
+	guild, ok := loadManageableGuild(c, userID)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name           string `json:"name"`
+		Description    string `json:"description"`
+		Category       string `json:"category"`
+		IncludeContent bool   `json:"include_content"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Name == "" {
+		req.Name = guild.Name
+	}
+	if req.Category == "" {
+		req.Category = "community"
+	}
+
+	doc := buildGuildTemplateDocument(guild, req.IncludeContent)
+	docJSON, err := json.Marshal(doc)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build template"})
+		return
+	}
+
+	// Legacy columns are filled too so older clients can still preview it.
+	channels := make([]map[string]string, len(doc.Channels))
+	for i, ch := range doc.Channels {
+		channels[i] = map[string]string{"name": ch.Name, "type": ch.Type}
+	}
+	roles := make([]map[string]string, len(doc.Roles))
+	for i, role := range doc.Roles {
+		roles[i] = map[string]string{"name": role.Name, "color": role.Color}
+	}
+	channelsJSON, _ := json.Marshal(channels)
+	rolesJSON, _ := json.Marshal(roles)
+
+	template := GuildTemplate{
+		Slug:          fmt.Sprintf("u%d-%s", userID, strings.ToLower(generateRandomString(8))),
+		Name:          req.Name,
+		Description:   req.Description,
+		Category:      req.Category,
+		ChannelsJSON:  string(channelsJSON),
+		RolesJSON:     string(rolesJSON),
+		SettingsJSON:  `{}`,
+		RequiredPlan:  "free",
+		IsActive:      true,
+		OwnerID:       &userID,
+		SourceGuildID: &guild.ID,
+		Version:       doc.Version,
+		DocumentJSON:  string(docJSON),
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
+	}
+	if err := db.Create(&template).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save template"})
+		return
+	}
+
+	go LogAuditViaGRPC(userID, "guild_template_save", "guild_template", strconv.Itoa(template.ID),
+		fmt.Sprintf("guild:%d", guild.ID), fmt.Sprintf("slug:%s include_content:%t", template.Slug, req.IncludeContent),
+		c.ClientIP(), c.Request.UserAgent())
+
+	c.JSON(http.StatusCreated, template)
+}
+
+func getMyGuildTemplatesHandler(c *gin.Context) {
+	userID, _ := getUserIDFromContext(c)
+
+	var templates []GuildTemplate
+	db.Where("owner_id = ?", userID).Order("created_at DESC").Find(&templates)
+
+	c.JSON(http.StatusOK, templates)
+}
+
+func deleteMyGuildTemplateHandler(c *gin.Context) {
+	userID, _ := getUserIDFromContext(c)
+
+	result := db.Where("id = ? AND owner_id = ?", c.Param("id"), userID).Delete(&GuildTemplate{})
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Template deleted"})
+}
+
+// Import a template document as a brand new guild owned by the caller.
+func importNewGuildHandler(c *gin.Context) {
+	userID, _ := getUserIDFromContext(c)
+
+	var req struct {
+		GuildName string                `json:"guild_name"`
+		Template  GuildTemplateDocument `json:"template"`
+		DryRun    bool                  `json:"dry_run"`
+	}
+	if !bindGuildImportRequest(c, &req) {
+		return
+	}
+
+	if errs := validateGuildTemplateDocument(&req.Template); len(errs) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Invalid template", "errors": errs})
+		return
+	}
+
+	name := req.GuildName
+	if name == "" {
+		name = req.Template.Name
+	}
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "guild_name required"})
+		return
+	}
+
+	var guild Guild
+	var result *guildImportResult
+	err := db.Transaction(func(tx *gorm.DB) error {
+		guild = Guild{Name: name, OwnerID: userID}
+		if req.Template.Description != "" {
+			guild.Description = &req.Template.Description
+		}
+		if err := tx.Create(&guild).Error; err != nil {
+			return err
+		}
+
+		var err error
+		result, err = importGuildTemplate(tx, guild.ID, &req.Template, guildImportOptions{UserID: userID, DryRun: req.DryRun})
+		if err != nil {
+			return err
+		}
+		if req.DryRun {
+			return errGuildImportDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errGuildImportDryRun) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import template: " + err.Error()})
+		return
+	}
+
+	if req.DryRun {
+		result.GuildID = 0
+		c.JSON(http.StatusOK, gin.H{"result": result})
+		return
+	}
+
+	go LogAuditViaGRPC(userID, "guild_template_import", "guild", strconv.FormatUint(uint64(guild.ID), 10),
+		fmt.Sprintf("guild:%d", guild.ID), fmt.Sprintf("new_guild version:%d", req.Template.Version),
+		c.ClientIP(), c.Request.UserAgent())
+
+	c.JSON(http.StatusCreated, gin.H{"guild": guild, "result": result})
+}
+
+// Import a template document into an existing guild, resolving name clashes
+// according to on_conflict.
+func importIntoGuildHandler(c *gin.Context) {
+	userID, _ := getUserIDFromContext(c)
+
+	guild, ok := loadManageableGuild(c, userID)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Template   GuildTemplateDocument `json:"template"`
+		OnConflict string                `json:"on_conflict"`
+		DryRun     bool                  `json:"dry_run"`
+	}
+	if !bindGuildImportRequest(c, &req) {
+		return
+	}
+
+	switch req.OnConflict {
+	case "":
+		req.OnConflict = "skip"
+	case "skip", "rename", "overwrite":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "on_conflict must be skip, rename or overwrite"})
+		return
+	}
+
+	if errs := validateGuildTemplateDocument(&req.Template); len(errs) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Invalid template", "errors": errs})
+		return
+	}
+
+	var result *guildImportResult
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		result, err = importGuildTemplate(tx, guild.ID, &req.Template, guildImportOptions{
+			OnConflict: req.OnConflict,
+			DryRun:     req.DryRun,
+			UserID:     userID,
+		})
+		if err != nil {
+			return err
+		}
+		if req.DryRun {
+			return errGuildImportDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errGuildImportDryRun) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import template: " + err.Error()})
+		return
+	}
+
+	if !req.DryRun {
+		go LogAuditViaGRPC(userID, "guild_template_import", "guild", strconv.FormatUint(uint64(guild.ID), 10),
+			fmt.Sprintf("guild:%d", guild.ID), fmt.Sprintf("on_conflict:%s version:%d", req.OnConflict, req.Template.Version),
+			c.ClientIP(), c.Request.UserAgent())
+	}
+
+	c.JSON(http.StatusOK, gin.H{"result": result})
+}
+
+// bindGuildImportRequest binds an import body of at most guildTemplateMaxBody
+// bytes; the document limits only apply once it has been read.
+func bindGuildImportRequest(c *gin.Context, req interface{}) bool {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, guildTemplateMaxBody)
+	if err := c.ShouldBindJSON(req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("template exceeds %d bytes", guildTemplateMaxBody)})
+			return false
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// loadManageableGuild loads the :id guild and checks that the user may export
+// or restructure it (owner, guild administrator or platform admin).
+func loadManageableGuild(c *gin.Context, userID uint) (Guild, bool) {
+	var guild Guild
+	if err := db.First(&guild, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Guild not found"})
+		return guild, false
+	}
+
+	if guild.OwnerID == userID || hasGlobalRole(userID, "admin") {
+		return guild, true
+	}
+
+	var user User
+	if db.First(&user, userID).RowsAffected > 0 && user.Role == "admin" {
+		return guild, true
+	}
+
+	perms, _ := calculateGuildPermissions(userID, guild.ID)
+	if perms&(PermAdministrator|PermManageGuild) != 0 {
+		return guild, true
+	}
+
+	c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+	return guild, false
+}
+
+func buildGuildTemplateDocument(guild Guild, includeContent bool) *GuildTemplateDocument {
+	doc := &GuildTemplateDocument{
+		Version:    guildTemplateVersion,
+		Name:       guild.Name,
+		ExportedAt: time.Now().UTC(),
+		Roles:      []GuildTemplateRole{},
+		Categories: []GuildTemplateCategory{},
+		Channels:   []GuildTemplateChannel{},
+	}
+	if guild.Description != nil {
+		doc.Description = *guild.Description
+	}
+
+	var roles []GuildRole
+	db.Where("guild_id = ?", guild.ID).Order("position ASC, id ASC").Find(&roles)
+	roleKeys := make(map[uint]string, len(roles))
+	for _, role := range roles {
+		key := fmt.Sprintf("role-%d", role.ID)
+		roleKeys[role.ID] = key
+		doc.Roles = append(doc.Roles, GuildTemplateRole{
+			Key:         key,
+			Name:        role.Name,
+			Color:       role.Color,
+			Position:    role.Position,
+			Permissions: role.Permissions,
+			Mentionable: role.Mentionable,
+		})
+	}
+
+	var categories []ChannelCategory
+	db.Where("guild_id = ?", guild.ID).Order("position ASC, id ASC").Find(&categories)
+	categoryKeys := make(map[uint]string, len(categories))
+	for _, cat := range categories {
+		key := fmt.Sprintf("category-%d", cat.ID)
+		categoryKeys[cat.ID] = key
+		doc.Categories = append(doc.Categories, GuildTemplateCategory{Key: key, Name: cat.Name, Position: cat.Position})
+	}
+
+	var channels []Channel
+	db.Where("guild_id = ?", guild.ID).Order("position ASC, id ASC").Find(&channels)
+	for _, ch := range channels {
+		entry := GuildTemplateChannel{
+			Key:       fmt.Sprintf("channel-%d", ch.ID),
+			Name:      ch.Name,
+			Type:      ch.Type,
+			Position:  ch.Position,
+			IsPrivate: ch.IsPrivate,
+		}
+		if ch.Description != nil {
+			entry.Description = *ch.Description
+		}
+		if ch.CategoryID != nil {
+			entry.Category = categoryKeys[*ch.CategoryID]
+		}
+
+		var perms []ChannelPermission
+		db.Where("channel_id = ? AND user_id IS NULL", ch.ID).Order("id ASC").Find(&perms)
+		for _, p := range perms {
+			role := guildTemplateEveryone
+			if p.RoleID != nil {
+				key, ok := roleKeys[*p.RoleID]
+				if !ok {
+					continue
+				}
+				role = key
+			}
+			entry.Overwrites = append(entry.Overwrites, GuildTemplateOverwrite{Role: role, Allow: p.Allow, Deny: p.Deny})
+		}
+
+		var tools []ChannelTool
+		db.Where("channel_id = ?", ch.ID).Order("id ASC").Find(&tools)
+		for _, t := range tools {
+			tool := GuildTemplateTool{ToolType: t.ToolType, Title: t.Title, VisibleTo: t.VisibleTo}
+			if includeContent {
+				content := t.Content
+				tool.Content = &content
+			}
+			entry.Tools = append(entry.Tools, tool)
+		}
+
+		doc.Channels = append(doc.Channels, entry)
+	}
+
+	return doc
+}
+
+// validateGuildTemplateDocument checks a document before anything is written
+// and fills in defaults (missing keys fall back to names, empty channel types
+// to text). It returns every problem found rather than stopping at the first.
+func validateGuildTemplateDocument(doc *GuildTemplateDocument) []string {
+	var errs []string
+	addErr := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if doc.Version < 1 || doc.Version > guildTemplateVersion {
+		addErr("unsupported template version %d (supported: 1-%d)", doc.Version, guildTemplateVersion)
+		return errs
+	}
+	if len(doc.Roles) > guildTemplateMaxRoles {
+		addErr("too many roles: %d (max %d)", len(doc.Roles), guildTemplateMaxRoles)
+	}
+	if len(doc.Categories) > guildTemplateMaxCategories {
+		addErr("too many categories: %d (max %d)", len(doc.Categories), guildTemplateMaxCategories)
+	}
+	if len(doc.Channels) > guildTemplateMaxChannels {
+		addErr("too many channels: %d (max %d)", len(doc.Channels), guildTemplateMaxChannels)
+	}
+
+	validName := func(name string) bool {
+		name = strings.TrimSpace(name)
+		return name != "" && len([]rune(name)) <= 100
+	}
+
+	roleKeys := map[string]bool{guildTemplateEveryone: true}
+	for i := range doc.Roles {
+		role := &doc.Roles[i]
+		if !validName(role.Name) {
+			addErr("roles[%d]: name must be 1-100 characters", i)
+		}
+		if role.Key == "" {
+			role.Key = role.Name
+		}
+		if roleKeys[role.Key] {
+			addErr("roles[%d]: duplicate key %q", i, role.Key)
+		}
+		roleKeys[role.Key] = true
+		if role.Color != "" && !guildTemplateColor.MatchString(role.Color) {
+			addErr("roles[%d]: color must look like #RRGGBB", i)
+		}
+		if role.Permissions < 0 {
+			addErr("roles[%d]: permissions must not be negative", i)
+		}
+	}
+
+	categoryKeys := make(map[string]bool)
+	for i := range doc.Categories {
+		cat := &doc.Categories[i]
+		if !validName(cat.Name) {
+			addErr("categories[%d]: name must be 1-100 characters", i)
+		}
+		if cat.Key == "" {
+			cat.Key = cat.Name
+		}
+		if categoryKeys[cat.Key] {
+			addErr("categories[%d]: duplicate key %q", i, cat.Key)
+		}
+		categoryKeys[cat.Key] = true
+	}
+
+	channelKeys := make(map[string]bool)
+	for i := range doc.Channels {
+		ch := &doc.Channels[i]
+		if !validName(ch.Name) {
+			addErr("channels[%d]: name must be 1-100 characters", i)
+		}
+		if ch.Key == "" {
+			ch.Key = ch.Name
+		}
+		if channelKeys[ch.Key] {
+			addErr("channels[%d]: duplicate key %q", i, ch.Key)
+		}
+		channelKeys[ch.Key] = true
+		if ch.Type == "" {
+			ch.Type = "text"
+		}
+		if !guildTemplateChannelTypes[ch.Type] {
+			addErr("channels[%d]: unknown type %q", i, ch.Type)
+		}
+		if ch.Category != "" && !categoryKeys[ch.Category] {
+			addErr("channels[%d]: unknown category %q", i, ch.Category)
+		}
+		for j, ow := range ch.Overwrites {
+			if !roleKeys[ow.Role] {
+				addErr("channels[%d].overwrites[%d]: unknown role %q", i, j, ow.Role)
+			}
+		}
+		if len(ch.Tools) > guildTemplateMaxTools {
+			addErr("channels[%d]: too many tools (max %d)", i, guildTemplateMaxTools)
+		}
+		for j := range ch.Tools {
+			tool := &ch.Tools[j]
+			if !guildTemplateToolTypes[tool.ToolType] {
+				addErr("channels[%d].tools[%d]: unknown tool type %q", i, j, tool.ToolType)
+			}
+			if tool.VisibleTo == "" {
+				tool.VisibleTo = "all"
+			}
+			if !guildTemplateVisibility[tool.VisibleTo] {
+				addErr("channels[%d].tools[%d]: unknown visibility %q", i, j, tool.VisibleTo)
+			}
+			if tool.Content != nil && len(*tool.Content) > guildTemplateMaxContent {
+				addErr("channels[%d].tools[%d]: content exceeds %d bytes", i, j, guildTemplateMaxContent)
+			}
+		}
+	}
+
+	return errs
+}
+
+// importGuildTemplate writes a validated document into guildID using tx.
+// Existing roles, categories and channels are matched by name
+// (case-insensitive; channels also by type) and handled per opts.OnConflict:
+// skip reuses the existing object untouched, rename creates a copy under a
+// free name and overwrite updates the existing object from the template.
+func importGuildTemplate(tx *gorm.DB, guildID uint, doc *GuildTemplateDocument, opts guildImportOptions) (*guildImportResult, error) {
+	if opts.OnConflict == "" {
+		opts.OnConflict = "skip"
+	}
+	result := &guildImportResult{GuildID: guildID, DryRun: opts.DryRun}
+
+	// Roles
+	var existingRoles []GuildRole
+	tx.Where("guild_id = ?", guildID).Find(&existingRoles)
+	roleByName := make(map[string]*GuildRole, len(existingRoles))
+	roleNames := make(map[string]bool, len(existingRoles))
+	for i := range existingRoles {
+		name := strings.ToLower(existingRoles[i].Name)
+		roleByName[name] = &existingRoles[i]
+		roleNames[name] = true
+	}
+
+	roleIDs := make(map[string]uint, len(doc.Roles))
+	for _, tr := range doc.Roles {
+		name := strings.TrimSpace(tr.Name)
+		if existing, ok := roleByName[strings.ToLower(name)]; ok {
+			switch opts.OnConflict {
+			case "skip":
+				roleIDs[tr.Key] = existing.ID
+				result.Skipped.Roles++
+				continue
+			case "overwrite":
+				if err := tx.Model(existing).Updates(map[string]interface{}{
+					"color":       tr.Color,
+					"permissions": tr.Permissions,
+					"mentionable": tr.Mentionable,
+				}).Error; err != nil {
+					return nil, err
+				}
+				roleIDs[tr.Key] = existing.ID
+				result.Updated.Roles++
+				continue
+			case "rename":
+				renamed := uniqueTemplateName(name, roleNames)
+				result.Renamed = append(result.Renamed, fmt.Sprintf("role %s -> %s", name, renamed))
+				name = renamed
+			}
+		}
+
+		role := GuildRole{
+			GuildID:     guildID,
+			Name:        name,
+			Color:       tr.Color,
+			Position:    tr.Position,
+			Permissions: tr.Permissions,
+			Mentionable: tr.Mentionable,
+		}
+		if err := tx.Create(&role).Error; err != nil {
+			return nil, err
+		}
+		roleNames[strings.ToLower(name)] = true
+		roleIDs[tr.Key] = role.ID
+		result.Created.Roles++
+	}
+
+	// Categories
+	var existingCategories []ChannelCategory
+	tx.Where("guild_id = ?", guildID).Find(&existingCategories)
+	categoryByName := make(map[string]*ChannelCategory, len(existingCategories))
+	categoryNames := make(map[string]bool, len(existingCategories))
+	for i := range existingCategories {
+		name := strings.ToLower(existingCategories[i].Name)
+		categoryByName[name] = &existingCategories[i]
+		categoryNames[name] = true
+	}
+
+	categoryIDs := make(map[string]uint, len(doc.Categories))
+	for _, tc := range doc.Categories {
+		name := strings.TrimSpace(tc.Name)
+		if existing, ok := categoryByName[strings.ToLower(name)]; ok {
+			switch opts.OnConflict {
+			case "skip":
+				categoryIDs[tc.Key] = existing.ID
+				result.Skipped.Categories++
+				continue
+			case "overwrite":
+				if err := tx.Model(existing).Update("position", tc.Position).Error; err != nil {
+					return nil, err
+				}
+				categoryIDs[tc.Key] = existing.ID
+				result.Updated.Categories++
+				continue
+			case "rename":
+				renamed := uniqueTemplateName(name, categoryNames)
+				result.Renamed = append(result.Renamed, fmt.Sprintf("category %s -> %s", name, renamed))
+				name = renamed
+			}
+		}
+
+		category := ChannelCategory{GuildID: guildID, Name: name, Position: tc.Position}
+		if err := tx.Create(&category).Error; err != nil {
+			return nil, err
+		}
+		categoryNames[strings.ToLower(name)] = true
+		categoryIDs[tc.Key] = category.ID
+		result.Created.Categories++
+	}
+
+	// Channels, with their overwrites and tools
+	var existingChannels []Channel
+	tx.Where("guild_id = ?", guildID).Find(&existingChannels)
+	channelByName := make(map[string]*Channel, len(existingChannels))
+	channelNames := make(map[string]bool, len(existingChannels))
+	for i := range existingChannels {
+		channelByName[existingChannels[i].Type+":"+strings.ToLower(existingChannels[i].Name)] = &existingChannels[i]
+		channelNames[strings.ToLower(existingChannels[i].Name)] = true
+	}
+
+	for _, tch := range doc.Channels {
+		var categoryID *uint
+		if tch.Category != "" {
+			id := categoryIDs[tch.Category]
+			categoryID = &id
+		}
+		var description *string
+		if tch.Description != "" {
+			d := tch.Description
+			description = &d
+		}
+
+		name := strings.TrimSpace(tch.Name)
+		var channel *Channel
+		if existing, ok := channelByName[tch.Type+":"+strings.ToLower(name)]; ok {
+			switch opts.OnConflict {
+			case "skip":
+				result.Skipped.Channels++
+				continue
+			case "overwrite":
+				if err := tx.Model(existing).Updates(map[string]interface{}{
+					"description": description,
+					"position":    tch.Position,
+					"is_private":  tch.IsPrivate,
+					"category_id": categoryID,
+				}).Error; err != nil {
+					return nil, err
+				}
+				channel = existing
+				result.Updated.Channels++
+			case "rename":
+				renamed := uniqueTemplateName(name, channelNames)
+				result.Renamed = append(result.Renamed, fmt.Sprintf("channel %s -> %s", name, renamed))
+				name = renamed
+			}
+		}
+
+		if channel == nil {
+			channel = &Channel{
+				GuildID:     guildID,
+				CategoryID:  categoryID,
+				Name:        name,
+				Description: description,
+				Type:        tch.Type,
+				Position:    tch.Position,
+				IsPrivate:   tch.IsPrivate,
+			}
+			if err := tx.Create(channel).Error; err != nil {
+				return nil, err
+			}
+			channelNames[strings.ToLower(name)] = true
+			result.Created.Channels++
+		}
+
+		for _, ow := range tch.Overwrites {
+			var roleID *uint
+			if ow.Role != guildTemplateEveryone {
+				id := roleIDs[ow.Role]
+				roleID = &id
+			}
+
+			existing := tx.Where("channel_id = ? AND user_id IS NULL", channel.ID)
+			if roleID == nil {
+				existing = existing.Where("role_id IS NULL")
+			} else {
+				existing = existing.Where("role_id = ?", *roleID)
+			}
+			var perm ChannelPermission
+			if existing.First(&perm).RowsAffected > 0 {
+				if err := tx.Model(&perm).Updates(map[string]interface{}{"allow": ow.Allow, "deny": ow.Deny}).Error; err != nil {
+					return nil, err
+				}
+				result.Updated.Overwrites++
+				continue
+			}
+
+			perm = ChannelPermission{ChannelID: channel.ID, RoleID: roleID, Allow: ow.Allow, Deny: ow.Deny}
+			if err := tx.Create(&perm).Error; err != nil {
+				return nil, err
+			}
+			result.Created.Overwrites++
+		}
+
+		var existingTools []ChannelTool
+		tx.Where("channel_id = ?", channel.ID).Find(&existingTools)
+		toolTitles := make(map[string]bool, len(existingTools))
+		for _, t := range existingTools {
+			toolTitles[t.ToolType+":"+strings.ToLower(t.Title)] = true
+		}
+
+		for _, tt := range tch.Tools {
+			if toolTitles[tt.ToolType+":"+strings.ToLower(tt.Title)] {
+				result.Skipped.Tools++
+				continue
+			}
+			tool := ChannelTool{
+				ChannelID: channel.ID,
+				ToolType:  tt.ToolType,
+				Title:     tt.Title,
+				OwnerID:   opts.UserID,
+				VisibleTo: tt.VisibleTo,
+				CreatedAt: GetCurrentTimestamp(),
+				UpdatedAt: GetCurrentTimestamp(),
+			}
+			if tt.Content != nil {
+				tool.Content = *tt.Content
+			}
+			if err := tx.Create(&tool).Error; err != nil {
+				return nil, err
+			}
+			result.Created.Tools++
+		}
+	}
+
+	return result, nil
+}
+
+// uniqueTemplateName returns the first of "name (2)", "name (3)"... that is
+// not yet in taken.
+func uniqueTemplateName(name string, taken map[string]bool) string {
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)", name, i)
+		if !taken[strings.ToLower(candidate)] {
+			return candidate
+		}
+	}
+}
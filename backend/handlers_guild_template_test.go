@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func guildTemplateTestModels() []interface{} {
+	return []interface{}{
+		&User{}, &Guild{}, &GuildRole{}, &GuildMemberRole{}, &GlobalRoleAssignment{}, &ChannelCategory{},
+		&Channel{}, &ChannelPermission{}, &ChannelTool{},
+	}
+}
+
+// callGuildImport posts body to handler as uid, with guildID as :id when set.
+func callGuildImport(handler gin.HandlerFunc, uid, guildID uint, body string) *httptest.ResponseRecorder {
+	c, w := testContext(http.MethodPost, "/api/guilds/import", strings.NewReader(body), uid)
+	if guildID != 0 {
+		c.Params = gin.Params{{Key: "id", Value: strconv.FormatUint(uint64(guildID), 10)}}
+	}
+	handler(c)
+	return w
+}
+
+func guildImportBody(t *testing.T, onConflict string, dryRun bool, doc GuildTemplateDocument) string {
+	t.Helper()
+	body, err := json.Marshal(gin.H{"template": doc, "on_conflict": onConflict, "dry_run": dryRun})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+// An existing guild with a Mods role, an Info category and a #general text
+// channel holding a Plan board; the template below clashes with all three.
+func TestImportGuildTemplateConflicts(t *testing.T) {
+	content := `{"cards":[]}`
+	doc := GuildTemplateDocument{
+		Version:    1,
+		Name:       "Study group",
+		Roles:      []GuildTemplateRole{{Key: "mods", Name: "mods", Color: "#ff0000", Permissions: 8}},
+		Categories: []GuildTemplateCategory{{Key: "info", Name: "Info", Position: 5}},
+		Channels: []GuildTemplateChannel{
+			{
+				Key: "general", Name: "general", Type: "text", Position: 3, Category: "info",
+				Overwrites: []GuildTemplateOverwrite{{Role: "mods", Allow: 1}},
+				Tools: []GuildTemplateTool{
+					{ToolType: "board", Title: "Plan", Content: &content},
+					{ToolType: "notebook", Title: "Notes"},
+				},
+			},
+			{Key: "general-voice", Name: "general", Type: "voice"}, // same name, other type: no clash
+		},
+	}
+
+	type counts struct{ roles, categories, channels int }
+	for _, tc := range []struct {
+		mode                      string
+		created, updated, skipped counts
+		renamed                   int
+		rolePermissions           int64
+		categoryPosition          int
+		overwrites, tools         int64
+	}{
+		{mode: "skip", created: counts{0, 0, 1}, skipped: counts{1, 1, 1}, rolePermissions: 1, overwrites: 0, tools: 1},
+		{mode: "overwrite", created: counts{0, 0, 1}, updated: counts{1, 1, 1}, rolePermissions: 8, categoryPosition: 5, overwrites: 1, tools: 2},
+		{mode: "rename", created: counts{1, 1, 2}, renamed: 3, rolePermissions: 1, overwrites: 1, tools: 3},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			testDB(t, guildTemplateTestModels()...)
+			owner := User{Username: "owner", Password: "x"}
+			db.Create(&owner)
+			guild := Guild{Name: "Existing", OwnerID: owner.ID}
+			db.Create(&guild)
+			role := GuildRole{GuildID: guild.ID, Name: "Mods", Color: "#000000", Permissions: 1}
+			db.Create(&role)
+			category := ChannelCategory{GuildID: guild.ID, Name: "Info"}
+			db.Create(&category)
+			general := Channel{GuildID: guild.ID, Name: "general", Type: "text"}
+			db.Create(&general)
+			db.Create(&ChannelTool{ChannelID: general.ID, ToolType: "board", Title: "plan", VisibleTo: "all"})
+
+			w := callGuildImport(importIntoGuildHandler, owner.ID, guild.ID, guildImportBody(t, tc.mode, false, doc))
+			if w.Code != http.StatusOK {
+				t.Fatalf("import: %d %s", w.Code, w.Body)
+			}
+			var resp struct{ Result guildImportResult }
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			r := resp.Result
+			if got := (counts{r.Created.Roles, r.Created.Categories, r.Created.Channels}); got != tc.created {
+				t.Errorf("created %+v, want %+v", got, tc.created)
+			}
+			if got := (counts{r.Updated.Roles, r.Updated.Categories, r.Updated.Channels}); got != tc.updated {
+				t.Errorf("updated %+v, want %+v", got, tc.updated)
+			}
+			if got := (counts{r.Skipped.Roles, r.Skipped.Categories, r.Skipped.Channels}); got != tc.skipped {
+				t.Errorf("skipped %+v, want %+v", got, tc.skipped)
+			}
+			if len(r.Renamed) != tc.renamed {
+				t.Errorf("renamed %v", r.Renamed)
+			}
+
+			db.First(&role, role.ID)
+			if role.Permissions != tc.rolePermissions || role.Name != "Mods" {
+				t.Errorf("existing role = %+v", role)
+			}
+			db.First(&category, category.ID)
+			if category.Position != tc.categoryPosition {
+				t.Errorf("existing category position = %d", category.Position)
+			}
+			var overwrites, tools int64
+			db.Model(&ChannelPermission{}).Count(&overwrites)
+			db.Model(&ChannelTool{}).Count(&tools)
+			if overwrites != tc.overwrites || tools != tc.tools {
+				t.Errorf("%d overwrites and %d tools, want %d and %d", overwrites, tools, tc.overwrites, tc.tools)
+			}
+
+			if tc.mode == "rename" {
+				var roles, channels int64
+				db.Model(&GuildRole{}).Where("name = ?", "mods (2)").Count(&roles)
+				db.Model(&Channel{}).Where("name = ? AND type = ?", "general (2)", "text").Count(&channels)
+				if roles != 1 || channels != 1 {
+					t.Errorf("renamed copies: %d roles, %d channels", roles, channels)
+				}
+			}
+		})
+	}
+}
+
+func TestImportGuildTemplateDryRun(t *testing.T) {
+	testDB(t, guildTemplateTestModels()...)
+	owner := User{Username: "owner", Password: "x"}
+	db.Create(&owner)
+	doc := GuildTemplateDocument{
+		Version:  1,
+		Name:     "Study group",
+		Roles:    []GuildTemplateRole{{Name: "Mods"}},
+		Channels: []GuildTemplateChannel{{Name: "general"}},
+	}
+
+	w := callGuildImport(importNewGuildHandler, owner.ID, 0, guildImportBody(t, "", true, doc))
+	if w.Code != http.StatusOK {
+		t.Fatalf("dry run: %d %s", w.Code, w.Body)
+	}
+	var resp struct{ Result guildImportResult }
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if !resp.Result.DryRun || resp.Result.GuildID != 0 || resp.Result.Created.Roles != 1 || resp.Result.Created.Channels != 1 {
+		t.Errorf("result = %+v", resp.Result)
+	}
+	for _, model := range []interface{}{&Guild{}, &GuildRole{}, &Channel{}} {
+		var n int64
+		db.Model(model).Count(&n)
+		if n != 0 {
+			t.Errorf("a dry run wrote %d %T rows", n, model)
+		}
+	}
+}
+
+func TestImportGuildTemplateMalformed(t *testing.T) {
+	testDB(t, guildTemplateTestModels()...)
+	owner := User{Username: "owner", Password: "x"}
+	db.Create(&owner)
+	guild := Guild{Name: "Existing", OwnerID: owner.ID}
+	db.Create(&guild)
+
+	valid := `{"version":1,"name":"ok","channels":[{"name":"general"}]}`
+	for _, tc := range []struct {
+		name    string
+		guildID uint
+		body    string
+		want    int
+		errors  []string
+	}{
+		{name: "not json", body: `{"template":`, want: http.StatusBadRequest},
+		{name: "wrong shape", body: `{"template":{"version":"one"}}`, want: http.StatusBadRequest},
+		{name: "future version", body: `{"template":{"version":2,"name":"x"}}`, want: http.StatusUnprocessableEntity,
+			errors: []string{"unsupported template version 2"}},
+		{name: "missing version", body: `{"template":{"name":"x"}}`, want: http.StatusUnprocessableEntity,
+			errors: []string{"unsupported template version 0"}},
+		{name: "dangling references", body: `{"template":{"version":1,"name":"x","roles":[{"name":"a"},{"name":"a"}],` +
+			`"channels":[{"name":"c","type":"forum","category":"nope","overwrites":[{"role":"ghost"}],"tools":[{"tool_type":"wiki"}]}]}}`,
+			want: http.StatusUnprocessableEntity,
+			errors: []string{`roles[1]: duplicate key "a"`, `channels[0]: unknown type "forum"`, `channels[0]: unknown category "nope"`,
+				`channels[0].overwrites[0]: unknown role "ghost"`, `channels[0].tools[0]: unknown tool type "wiki"`}},
+		{name: "bad role color", body: `{"template":{"version":1,"name":"x","roles":[{"name":"a","color":"red"}]}}`,
+			want: http.StatusUnprocessableEntity, errors: []string{"roles[0]: color must look like #RRGGBB"}},
+		{name: "unknown conflict mode", guildID: guild.ID, body: `{"on_conflict":"merge","template":` + valid + `}`,
+			want: http.StatusBadRequest},
+	} {
+		handler := importNewGuildHandler
+		if tc.guildID != 0 {
+			handler = importIntoGuildHandler
+		}
+		w := callGuildImport(handler, owner.ID, tc.guildID, tc.body)
+		if w.Code != tc.want {
+			t.Errorf("%s: %d %s, want %d", tc.name, w.Code, w.Body, tc.want)
+			continue
+		}
+		var resp struct{ Errors []string }
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		for _, want := range tc.errors {
+			if !strings.Contains(strings.Join(resp.Errors, "\n"), want) {
+				t.Errorf("%s: errors %q lack %q", tc.name, resp.Errors, want)
+			}
+		}
+	}
+
+	var guilds, channels int64
+	db.Model(&Guild{}).Count(&guilds)
+	db.Model(&Channel{}).Count(&channels)
+	if guilds != 1 || channels != 0 {
+		t.Errorf("malformed imports left %d guilds and %d channels", guilds, channels)
+	}
+}
+
+func TestGuildTemplateSizeLimits(t *testing.T) {
+	doc := GuildTemplateDocument{Version: 1, Name: "big"}
+	for i := 0; i <= guildTemplateMaxChannels; i++ {
+		doc.Channels = append(doc.Channels, GuildTemplateChannel{Name: "c" + strconv.Itoa(i)})
+	}
+	for i := 0; i <= guildTemplateMaxRoles; i++ {
+		doc.Roles = append(doc.Roles, GuildTemplateRole{Name: "r" + strconv.Itoa(i)})
+	}
+	tooLong := strings.Repeat("a", guildTemplateMaxContent+1)
+	doc.Channels[0].Name = strings.Repeat("я", 101)
+	doc.Channels[1].Tools = []GuildTemplateTool{{ToolType: "notebook", Title: "n", Content: &tooLong}}
+	for i := 0; i <= guildTemplateMaxTools; i++ {
+		doc.Channels[2].Tools = append(doc.Channels[2].Tools, GuildTemplateTool{ToolType: "board", Title: "b" + strconv.Itoa(i)})
+	}
+
+	errs := strings.Join(validateGuildTemplateDocument(&doc), "\n")
+	for _, want := range []string{
+		"too many roles: 101 (max 100)",
+		"too many channels: 201 (max 200)",
+		"channels[0]: name must be 1-100 characters",
+		"channels[1].tools[0]: content exceeds 1048576 bytes",
+		"channels[2]: too many tools (max 10)",
+	} {
+		if !strings.Contains(errs, want) {
+			t.Errorf("errors lack %q:\n%s", want, errs)
+		}
+	}
+
+	// A body over the limit is refused before it is parsed.
+	var body bytes.Buffer
+	body.WriteString(`{"template":{"version":1,"name":"x","description":"`)
+	body.WriteString(strings.Repeat("a", guildTemplateMaxBody))
+	body.WriteString(`"}}`)
+	if w := callGuildImport(importNewGuildHandler, 1, 0, body.String()); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: %d", w.Code)
+	}
+}
@@ -1,15 +1,10 @@
 package main
 
 import (
-        "bytes"
         "encoding/json"
-        "fmt"
-        "io"
+        "errors"
         "log"
         "net/http"
-        "os"
-        "strings"
-        "sync"
         "time"
 
         "github.com/gin-gonic/gin"
@@ -21,6 +16,10 @@ type JarvisRequest struct {
                 Role    string `json:"role"`
                 Content string `json:"content"`
         } `json:"history"`
+        Timezone string `json:"timezone"`
+        Provider string `json:"provider"` // openai, deepseek, huggingface, ollama or auto
+        // ConversationID continues a stored thread; History is then ignored.
+        ConversationID *uint `json:"conversation_id"`
 }
 
 type JarvisResponse struct {
@@ -28,11 +27,39 @@ type JarvisResponse struct {
         Provider    string `json:"provider"`
         TokensUsed  int    `json:"tokens_used"`
         Model       string `json:"model"`
+        Reminder    *JarvisReminder `json:"reminder,omitempty"`
+        ConversationID *uint `json:"conversation_id,omitempty"`
+        ToolsUsed   []string `json:"tools_used,omitempty"`
 }
 
 type ChatMessage struct {
-        Role    string `json:"role"`
-        Content string `json:"content"`
+        Role       string `json:"role"`
+        Content    string `json:"content"`
+        // ToolCalls is set on assistant messages that ask for tools; tool
+        // results go back as role "tool" messages with ToolCallID.
+        ToolCalls  []ChatToolCall `json:"tool_calls,omitempty"`
+        ToolCallID string         `json:"tool_call_id,omitempty"`
+}
+
+// ChatTool describes a function the model may call (OpenAI tools format).
+type ChatTool struct {
+        Type     string           `json:"type"`
+        Function ChatToolFunction `json:"function"`
+}
+
+type ChatToolFunction struct {
+        Name        string          `json:"name"`
+        Description string          `json:"description,omitempty"`
+        Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+type ChatToolCall struct {
+        ID       string `json:"id"`
+        Type     string `json:"type"`
+        Function struct {
+                Name      string `json:"name"`
+                Arguments string `json:"arguments"`
+        } `json:"function"`
 }
 
 type ChatCompletionRequest struct {
@@ -41,27 +68,29 @@ type ChatCompletionRequest struct {
         MaxTokens   int           `json:"max_tokens,omitempty"`
         Temperature float64       `json:"temperature,omitempty"`
         Stream      bool          `json:"stream"`
+        StreamOptions *ChatStreamOptions `json:"stream_options,omitempty"`
+        Tools       []ChatTool    `json:"tools,omitempty"`
+}
+
+type ChatStreamOptions struct {
+        IncludeUsage bool `json:"include_usage"`
 }
 
 type ChatCompletionResponse struct {
         ID      string `json:"id"`
         Choices []struct {
                 Message struct {
-                        Content string `json:"content"`
+                        Content   string         `json:"content"`
+                        ToolCalls []ChatToolCall `json:"tool_calls"`
                 } `json:"message"`
         } `json:"choices"`
         Usage struct {
-                TotalTokens int `json:"total_tokens"`
+                PromptTokens     int `json:"prompt_tokens"`
+                CompletionTokens int `json:"completion_tokens"`
+                TotalTokens      int `json:"total_tokens"`
         } `json:"usage"`
 }
 
-var (
-        tokenUsage      int
-        tokenLimit      = 100000
-        tokenUsageMutex sync.Mutex
-        lastResetTime   = time.Now()
-)
-
 const jarvisSystemPrompt = `You are J.A.R.V.I.S. (Just A Rather Very Intelligent System), the advanced AI assistant from Iron Man.
 
 PERSONALITY & SPEECH PATTERNS:
@@ -107,170 +136,6 @@ CAPABILITIES:
 
 Remember: You ARE Jarvis - sophisticated, loyal, brilliant, with impeccable British manners and subtle humor.`
 
-func checkAndResetTokens() {
-        tokenUsageMutex.Lock()
-        defer tokenUsageMutex.Unlock()
-        
-        if time.Since(lastResetTime) > 24*time.Hour {
-                tokenUsage = 0
-                lastResetTime = time.Now()
-        }
-}
-
-func addTokenUsage(tokens int) bool {
-        tokenUsageMutex.Lock()
-        defer tokenUsageMutex.Unlock()
-        
-        if tokenUsage+tokens > tokenLimit {
-                return false
-        }
-        tokenUsage += tokens
-        return true
-}
-
-func getCurrentTokenUsage() int {
-        tokenUsageMutex.Lock()
-        defer tokenUsageMutex.Unlock()
-        return tokenUsage
-}
-
-func contains(s, substr string) bool {
-        s, substr = strings.ToLower(s), strings.ToLower(substr)
-        return strings.Contains(s, substr)
-}
-
-func callHuggingFace(messages []ChatMessage) (*ChatCompletionResponse, error) {
-        return callHuggingFaceModel(messages, "mistralai/Mistral-7B-Instruct-v0.3")
-}
-
-func callHuggingFaceModel(messages []ChatMessage, modelID string) (*ChatCompletionResponse, error) {
-        apiKey := os.Getenv("HUGGINGFACE_API_KEY")
-        if apiKey == "" {
-                return nil, nil
-        }
-
-        prompt := ""
-        for _, msg := range messages {
-                if msg.Role == "system" {
-                        prompt += msg.Content + "\n\n"
-                } else if msg.Role == "user" {
-                        prompt += "User: " + msg.Content + "\n"
-                } else if msg.Role == "assistant" {
-                        prompt += "Assistant: " + msg.Content + "\n"
-                }
-        }
-        prompt += "Assistant: "
-
-        reqBody := map[string]interface{}{
-                "inputs": prompt,
-                "parameters": map[string]interface{}{
-                        "max_new_tokens": 1024,
-                        "temperature":    0.7,
-                        "return_full_text": false,
-                },
-        }
-
-        jsonBody, err := json.Marshal(reqBody)
-        if err != nil {
-                return nil, err
-        }
-
-        apiURL := fmt.Sprintf("https://api-inference.huggingface.co/models/%s", modelID)
-        req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(jsonBody))
-        if err != nil {
-                return nil, err
-        }
-
-        req.Header.Set("Content-Type", "application/json")
-        req.Header.Set("Authorization", "Bearer "+apiKey)
-
-        client := &http.Client{Timeout: 120 * time.Second}
-        resp, err := client.Do(req)
-        if err != nil {
-                return nil, err
-        }
-        defer resp.Body.Close()
-
-        if resp.StatusCode != http.StatusOK {
-                body, _ := io.ReadAll(resp.Body)
-                return nil, &APIError{StatusCode: resp.StatusCode, Message: string(body)}
-        }
-
-        var hfResp []struct {
-                GeneratedText string `json:"generated_text"`
-        }
-        if err := json.NewDecoder(resp.Body).Decode(&hfResp); err != nil {
-                return nil, err
-        }
-
-        if len(hfResp) == 0 {
-                return nil, nil
-        }
-
-        return &ChatCompletionResponse{
-                Choices: []struct {
-                        Message struct {
-                                Content string `json:"content"`
-                        } `json:"message"`
-                }{
-                        {Message: struct {
-                                Content string `json:"content"`
-                        }{Content: hfResp[0].GeneratedText}},
-                },
-                Usage: struct {
-                        TotalTokens int `json:"total_tokens"`
-                }{TotalTokens: len(hfResp[0].GeneratedText) / 4},
-        }, nil
-}
-
-func callDeepSeek(messages []ChatMessage) (*ChatCompletionResponse, error) {
-        apiKey := os.Getenv("DEEPSEEK_API_KEY")
-        if apiKey == "" {
-                return nil, nil
-        }
-
-        reqBody := ChatCompletionRequest{
-                Model:       "deepseek-chat",
-                Messages:    messages,
-                MaxTokens:   2048,
-                Temperature: 0.7,
-                Stream:      false,
-        }
-
-        jsonBody, err := json.Marshal(reqBody)
-        if err != nil {
-                return nil, err
-        }
-
-        req, err := http.NewRequest("POST", "https://api.deepseek.com/chat/completions", bytes.NewBuffer(jsonBody))
-        if err != nil {
-                return nil, err
-        }
-
-        req.Header.Set("Content-Type", "application/json")
-        req.Header.Set("Authorization", "Bearer "+apiKey)
-
-        client := &http.Client{Timeout: 60 * time.Second}
-        resp, err := client.Do(req)
-        if err != nil {
-                return nil, err
-        }
-        defer resp.Body.Close()
-
-        if resp.StatusCode != http.StatusOK {
-                body, _ := io.ReadAll(resp.Body)
-                return nil, &APIError{StatusCode: resp.StatusCode, Message: string(body)}
-        }
-
-        var result ChatCompletionResponse
-        if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-                return nil, err
-        }
-
-        return &result, nil
-}
-
-
 type APIError struct {
         StatusCode int
         Message    string
@@ -280,8 +145,22 @@ func (e *APIError) Error() string {
         return e.Message
 }
 
+// HandleJarvisChat answers with the default provider chain, or with the
+// provider named in the request body.
 func HandleJarvisChat(c *gin.Context) {
-userIDVal, ok := c.Get("user_id")
+        handleJarvisChat(c, "")
+}
+
+// jarvisChatHandler pins the chat to one provider family, e.g. for
+// /api/jarvis/chat/ollama.
+func jarvisChatHandler(provider string) gin.HandlerFunc {
+        return func(c *gin.Context) {
+                handleJarvisChat(c, provider)
+        }
+}
+
+func handleJarvisChat(c *gin.Context, route string) {
+        userIDVal, ok := c.Get("user_id")
         if !ok || userIDVal == nil {
                 c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
                 return
@@ -302,112 +181,166 @@ userIDVal, ok := c.Get("user_id")
                 return
         }
 
-        checkAndResetTokens()
+        turn, err := prepareJarvisTurn(uid, &req)
+        if err != nil {
+                if errors.Is(err, errJarvisConversationNotFound) {
+                        c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+                        return
+                }
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start conversation"})
+                return
+        }
 
-        messages := []ChatMessage{
-                {Role: "system", Content: jarvisSystemPrompt},
+        // Reminders and memory commands are handled locally instead of going to the model
+        if reply, ok := jarvisShortcutReply(uid, &req); ok {
+                turn.save(req.Message, reply.Response, reply.Provider, reply.Model, 0, nil)
+                reply.ConversationID = req.ConversationID
+                c.JSON(http.StatusOK, reply)
+                return
         }
 
-        for _, h := range req.History {
-                messages = append(messages, ChatMessage{
-                        Role:    h.Role,
-                        Content: h.Content,
-                })
+        ticket, err := reserveJarvisRequest(uid, time.Now())
+        if err != nil {
+                if quotaErr, ok := jarvisQuotaErrorFrom(err); ok {
+                        abortJarvisQuota(c, quotaErr)
+                        return
+                }
+                log.Printf("[Jarvis] Failed to reserve quota for user %d: %v", uid, err)
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check Jarvis quota"})
+                return
         }
 
-        messages = append(messages, ChatMessage{
-                Role:    "user",
-                Content: req.Message,
+        only := route
+        if only == "" && isLLMProviderName(req.Provider) {
+                only = req.Provider
+        }
+        chain := buildLLMChain(&userSettings, only)
+
+        var user User
+        db.Select("id", "role").First(&user, uid)
+        caller := &jarvisToolCaller{
+                UserID:    uid,
+                Role:      mcpEffectiveRole(user),
+                Timezone:  req.Timezone,
+                IP:        c.ClientIP(),
+                UserAgent: c.Request.UserAgent(),
+        }
+        response, toolsUsed, err := runJarvisTools(c.Request.Context(), chain, LLMRequest{
+                Messages:    turn.Messages,
+                MaxTokens:   2048,
+                Temperature: 0.7,
+        }, caller)
+        if err != nil {
+                ticket.Finish(response.TotalTokens, false)
+                if c.Request.Context().Err() != nil {
+                        return
+                }
+                log.Printf("[Jarvis] All providers failed: %v", err)
+                status := http.StatusServiceUnavailable
+                if errors.Is(err, errNoLLMProviders) {
+                        status = http.StatusNotImplemented
+                }
+                c.JSON(status, gin.H{"error": "AI providers are unavailable, please try again later"})
+                return
+        }
+        ticket.Finish(response.TotalTokens, true)
+
+        content := response.Content
+        turn.save(req.Message, content, response.Provider, response.Model, response.TotalTokens, &userSettings)
+
+        c.JSON(http.StatusOK, JarvisResponse{
+                Response:   content,
+                Provider:   response.Provider,
+                TokensUsed: response.TotalTokens,
+                Model:      response.Model,
+                ConversationID: req.ConversationID,
+                ToolsUsed:   toolsUsed,
         })
+}
 
-        var response *ChatCompletionResponse
-        var provider string
-        var model string
-        var err error
-
-        // Try user-provided keys first
-        if userSettings.OpenAIKey != "" {
-                // Implementation for OpenAI call would go here
-                // For now, let's prioritize HuggingFace with user key
+// jarvisShortcutReply answers reminder and memory commands without the model.
+func jarvisShortcutReply(uid uint, req *JarvisRequest) (*JarvisResponse, bool) {
+        if reply, ok := jarvisReminderReply(uid, req); ok {
+                return reply, true
         }
+        return jarvisMemoryReply(uid, req)
+}
 
-        if userSettings.HuggingFaceKey != "" {
-                // Temporarily override env for this call
-                originalKey := os.Getenv("HUGGINGFACE_API_KEY")
-                os.Setenv("HUGGINGFACE_API_KEY", userSettings.HuggingFaceKey)
-                response, err = callHuggingFace(messages)
-                os.Setenv("HUGGINGFACE_API_KEY", originalKey)
-                
-                if err == nil && response != nil {
-                        provider = "huggingface (user key)"
-                        model = "mistral-7b"
-                }
+// jarvisReminderReply creates a reminder when the message asks for one and
+// returns Jarvis' answer. ok is false for ordinary chat messages, including
+// ones that start with "напомни" but name no time ("напомни, что такое
+// HTTP"); those go to the model.
+func jarvisReminderReply(uid uint, req *JarvisRequest) (*JarvisResponse, bool) {
+        if !isReminderRequest(req.Message) {
+                return nil, false
         }
 
-        // Fallback to system key
-        if response == nil && os.Getenv("HUGGINGFACE_API_KEY") != "" {
-                // Try Qwen 2.5 Instruct first as it's superior for general tasks and multilingual
-                model = "Qwen/Qwen2.5-72B-Instruct"
-                response, err = callHuggingFaceModel(messages, model)
-                if err != nil {
-                        log.Printf("Qwen 2.5 API error: %v, falling back to Mistral", err)
-                        model = "mistralai/Mistral-7B-Instruct-v0.3"
-                        response, err = callHuggingFaceModel(messages, model)
+        russian := hasCyrillic(req.Message)
+        loc := jarvisLocation(req.Timezone)
+        parsed, err := parseReminderRequest(req.Message, time.Now().In(loc))
+        if errors.Is(err, errReminderNoTime) {
+                return nil, false
+        }
+        reply := &JarvisResponse{Provider: "jarvis", Model: "reminders"}
+        if err != nil {
+                reply.Response = "There is no such date, Sir."
+                if russian {
+                        reply.Response = "Такой даты нет, сэр."
                 }
-                
-                if err != nil {
-                        log.Printf("HuggingFace API error: %v", err)
-                } else if response != nil {
-                        provider = "huggingface"
+                return reply, true
+        }
+        reminder, err := createJarvisReminder(uid, parsed.Content, parsed.RemindAt, "chat", time.Now())
+        if err != nil {
+                reply.Response = "I'm afraid I couldn't set that reminder, Sir: " + err.Error()
+                if russian {
+                        reply.Response = "Боюсь, не получилось поставить напоминание, сэр: " + err.Error()
                 }
+                return reply, true
         }
 
-        if response != nil && response.Choices != nil && len(response.Choices) > 0 {
-                content := response.Choices[0].Message.Content
-                // Basic intent detection for MCP tools
-                if jarvisMCP != nil && jarvisMCP.isRunning {
-                        // Check for file listing intent
-                        if (contains(req.Message, "список") || contains(req.Message, "файлы")) && contains(req.Message, "папке") {
-                                resp, mcpErr := jarvisMCP.ExecuteMCPTool("list-directory", map[string]interface{}{"path": "."})
-                                if mcpErr == nil && resp.Success {
-                                        dataJson, _ := json.MarshalIndent(resp.Data, "", "  ")
-                                        content += "\n\n[Системный отчет]: Я проверил директорию. Вот список файлов:\n" + string(dataJson)
-                                }
+        reply.Response = reminderConfirmation(reminder, loc, russian)
+        reply.Reminder = reminder
+        return reply, true
+}
+
+// HandleJarvisStatus lists the configured providers. With a token it also
+// reports the caller's quota.
+func HandleJarvisStatus(c *gin.Context) {
+        now := time.Now()
+        var providers []gin.H
+        activeProvider := "none"
+        huggingfaceAvailable := false
+        for _, name := range llmProviderOrder() {
+                for _, cfg := range llmEnvConfig(name) {
+                        if !llmConfigured(cfg) {
+                                continue
+                        }
+                        if activeProvider == "none" {
+                                activeProvider = cfg.Name
                         }
-                        // Check for config intent
-                        if contains(req.Message, "конфиг") || contains(req.Message, "настройки") {
-                                resp, mcpErr := jarvisMCP.ExecuteMCPTool("get-config", nil)
-                                if mcpErr == nil && resp.Success {
-                                        dataJson, _ := json.MarshalIndent(resp.Data, "", "  ")
-                                        content += "\n\n[Системный отчет]: Вот текущие настройки системы:\n" + string(dataJson)
-                                }
+                        if cfg.Name == "huggingface" {
+                                huggingfaceAvailable = true
                         }
+                        providers = append(providers, gin.H{
+                                "name":    cfg.Name,
+                                "model":   cfg.Model,
+                                "timeout": cfg.Timeout.Seconds(),
+                                "circuit": llmBreakerFor(cfg.key()).state(now),
+                        })
                 }
-                
-                c.JSON(http.StatusOK, JarvisResponse{
-                        Response:   content,
-                        Provider:   provider,
-                        TokensUsed: response.Usage.TotalTokens,
-                        Model:      model,
-                })
-                return
         }
-}
-
-func HandleJarvisStatus(c *gin.Context) {
-        checkAndResetTokens()
-        
-        huggingfaceAvailable := os.Getenv("HUGGINGFACE_API_KEY") != ""
 
-        c.JSON(http.StatusOK, gin.H{
+        status := gin.H{
                 "huggingface_available": huggingfaceAvailable,
-                "tokens_used":           getCurrentTokenUsage(),
-                "token_limit":           tokenLimit,
-                "active_provider": func() string {
-                        if huggingfaceAvailable {
-                                return "huggingface"
-                        }
-                        return "none"
-                }(),
-        })
+                "active_provider":       activeProvider,
+                "providers":             providers,
+        }
+        if uid, ok := getUserIDFromContext(c); ok {
+                quota := jarvisQuotaSnapshot(uid, now)
+                tokens := quota["user"].(gin.H)["tokens"].(gin.H)
+                status["tokens_used"] = tokens["used"]
+                status["token_limit"] = tokens["limit"]
+                status["quota"] = quota
+        }
+        c.JSON(http.StatusOK, status)
 }
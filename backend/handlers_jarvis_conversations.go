@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	jarvisMemoryMaxFacts    = 100
+	jarvisMemoryMaxLength   = 500
+	jarvisMemoryPromptFacts = 30
+	jarvisTitleMaxLength    = 200
+	jarvisHistoryLoadLimit  = 200
+	jarvisSummaryTimeout    = 60 * time.Second
+)
+
+// jarvisContextTokens is the prompt budget (system prompt, memory, summary and
+// recent turns). Override with JARVIS_CONTEXT_TOKENS for larger models.
+var jarvisContextTokens = 6000
+
+var errJarvisConversationNotFound = errors.New("conversation not found")
+
+func setupJarvisConversationRoutes(r *gin.Engine, auth gin.HandlerFunc) {
+	if v, err := strconv.Atoi(os.Getenv("JARVIS_CONTEXT_TOKENS")); err == nil && v >= 1000 {
+		jarvisContextTokens = v
+	}
+
+	jarvis := r.Group("/api/jarvis")
+	jarvis.Use(auth)
+	{
+		jarvis.GET("/conversations", listJarvisConversationsHandler)
+		jarvis.POST("/conversations", createJarvisConversationHandler)
+		jarvis.GET("/conversations/:id", getJarvisConversationHandler)
+		jarvis.PATCH("/conversations/:id", renameJarvisConversationHandler)
+		jarvis.DELETE("/conversations/:id", deleteJarvisConversationHandler)
+		jarvis.GET("/conversations/:id/export", exportJarvisConversationHandler)
+
+		jarvis.GET("/memory", listJarvisMemoryHandler)
+		jarvis.POST("/memory", createJarvisMemoryHandler)
+		jarvis.DELETE("/memory", clearJarvisMemoryHandler)
+		jarvis.DELETE("/memory/:id", deleteJarvisMemoryHandler)
+	}
+}
+
+// Conversations
+
+func listJarvisConversationsHandler(c *gin.Context) {
+	userIDRaw, _ := c.Get("user_id")
+	userID, _ := extractUserID(userIDRaw)
+
+	var conversations []JarvisConversation
+	db.Where("user_id = ?", userID).Order("COALESCE(last_message_at, created_at) DESC").Limit(200).Find(&conversations)
+	c.JSON(http.StatusOK, conversations)
+}
+
+func createJarvisConversationHandler(c *gin.Context) {
+	userIDRaw, _ := c.Get("user_id")
+	userID, _ := extractUserID(userIDRaw)
+
+	var req struct {
+		Title string `json:"title"`
+	}
+	c.ShouldBindJSON(&req)
+
+	conversation := JarvisConversation{UserID: userID, Title: jarvisConversationTitle(req.Title)}
+	if conversation.Title == "" {
+		conversation.Title = "Новый разговор"
+	}
+	if err := db.Create(&conversation).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create conversation"})
+		return
+	}
+	c.JSON(http.StatusCreated, conversation)
+}
+
+func getJarvisConversationHandler(c *gin.Context) {
+	conversation, ok := loadOwnJarvisConversation(c)
+	if !ok {
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	q := db.Where("conversation_id = ?", conversation.ID)
+	if beforeID := c.Query("before_id"); beforeID != "" {
+		q = q.Where("id < ?", beforeID)
+	}
+
+	var messages []JarvisConversationMessage
+	q.Order("id DESC").Limit(limit).Find(&messages)
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"conversation": conversation,
+		"messages":     messages,
+		"has_more":     len(messages) == limit,
+	})
+}
+
+func renameJarvisConversationHandler(c *gin.Context) {
+	conversation, ok := loadOwnJarvisConversation(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Title string `json:"title" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Title is required"})
+		return
+	}
+	title := jarvisConversationTitle(req.Title)
+	if title == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Title is required"})
+		return
+	}
+
+	db.Model(conversation).Update("title", title)
+	c.JSON(http.StatusOK, conversation)
+}
+
+func deleteJarvisConversationHandler(c *gin.Context) {
+	conversation, ok := loadOwnJarvisConversation(c)
+	if !ok {
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("conversation_id = ?", conversation.ID).Delete(&JarvisConversationMessage{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(conversation).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete conversation"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Conversation deleted"})
+}
+
+func exportJarvisConversationHandler(c *gin.Context) {
+	conversation, ok := loadOwnJarvisConversation(c)
+	if !ok {
+		return
+	}
+
+	// The body is assembled first so a database failure halfway through is
+	// reported as an error instead of a truncated file with status 200.
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", conversation.Title)
+	fmt.Fprintf(&b, "_Создан: %s_\n\n", conversation.CreatedAt.Format("02.01.2006 15:04"))
+	if conversation.Summary != "" {
+		fmt.Fprintf(&b, "> **Краткое содержание ранних сообщений:** %s\n\n", strings.ReplaceAll(conversation.Summary, "\n", "\n> "))
+	}
+
+	var batch []JarvisConversationMessage
+	err := db.Where("conversation_id = ?", conversation.ID).FindInBatches(&batch, exportBatchSize, func(tx *gorm.DB, _ int) error {
+		for _, m := range batch {
+			speaker := "**Вы**"
+			if m.Role == "assistant" {
+				speaker = "**Jarvis**"
+			}
+			fmt.Fprintf(&b, "### %s · %s\n\n%s\n\n", speaker, m.CreatedAt.Format("02.01.2006 15:04"), m.Content)
+		}
+		return nil
+	}).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export conversation"})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=jarvis_conversation_%d.md", conversation.ID))
+	c.Data(http.StatusOK, "text/markdown; charset=utf-8", []byte(b.String()))
+}
+
+func loadOwnJarvisConversation(c *gin.Context) (*JarvisConversation, bool) {
+	userIDRaw, _ := c.Get("user_id")
+	userID, _ := extractUserID(userIDRaw)
+
+	var conversation JarvisConversation
+	if err := db.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&conversation).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return nil, false
+	}
+	return &conversation, true
+}
+
+func jarvisConversationTitle(title string) string {
+	title = strings.Join(strings.Fields(title), " ")
+	if utf8.RuneCountInString(title) > jarvisTitleMaxLength {
+		title = string([]rune(title)[:jarvisTitleMaxLength])
+	}
+	return title
+}
+
+// Memory
+
+func listJarvisMemoryHandler(c *gin.Context) {
+	userIDRaw, _ := c.Get("user_id")
+	userID, _ := extractUserID(userIDRaw)
+
+	var facts []JarvisContext
+	db.Where("user_id = ?", userID).Order("created_at DESC").Find(&facts)
+	c.JSON(http.StatusOK, facts)
+}
+
+func createJarvisMemoryHandler(c *gin.Context) {
+	userIDRaw, _ := c.Get("user_id")
+	userID, _ := extractUserID(userIDRaw)
+
+	var req struct {
+		Content string `json:"content" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Content is required"})
+		return
+	}
+
+	fact, err := rememberJarvisFact(userID, req.Content, "api", nil)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, fact)
+}
+
+func deleteJarvisMemoryHandler(c *gin.Context) {
+	userIDRaw, _ := c.Get("user_id")
+	userID, _ := extractUserID(userIDRaw)
+
+	if db.Where("id = ? AND user_id = ?", c.Param("id"), userID).Delete(&JarvisContext{}).RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Memory not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Memory deleted"})
+}
+
+func clearJarvisMemoryHandler(c *gin.Context) {
+	userIDRaw, _ := c.Get("user_id")
+	userID, _ := extractUserID(userIDRaw)
+
+	res := db.Where("user_id = ?", userID).Delete(&JarvisContext{})
+	c.JSON(http.StatusOK, gin.H{"message": "Memory cleared", "deleted": res.RowsAffected})
+}
+
+func rememberJarvisFact(userID uint, content, source string, conversationID *uint) (*JarvisContext, error) {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return nil, errors.New("content is required")
+	}
+	if utf8.RuneCountInString(content) > jarvisMemoryMaxLength {
+		return nil, fmt.Errorf("a memory must be at most %d characters", jarvisMemoryMaxLength)
+	}
+
+	var count int64
+	db.Model(&JarvisContext{}).Where("user_id = ?", userID).Count(&count)
+	if count >= jarvisMemoryMaxFacts {
+		return nil, fmt.Errorf("no more than %d memories allowed, delete some first", jarvisMemoryMaxFacts)
+	}
+
+	fact := JarvisContext{UserID: userID, Content: content, Source: source, ConversationID: conversationID}
+	if err := db.Create(&fact).Error; err != nil {
+		return nil, errors.New("failed to save memory")
+	}
+	return &fact, nil
+}
+
+// jarvisRememberRe only accepts the explicit "запомни, что ..." / "remember
+// that ..." form so that "remember when ..." or "запомни это?" reach the model.
+var jarvisRememberRe = regexp.MustCompile(`(?i)^\s*(?:(?:джарвис|jarvis)[,!.]?\s+)?(?:пожалуйста,?\s+)?(?:запомни(?:те)?,?\s+что|remember\s+that)[,:]?\s+(.+)$`)
+
+// jarvisMemoryReply stores a fact when the user says "запомни, что ..." or
+// "remember that ...". ok is false for other messages.
+func jarvisMemoryReply(uid uint, req *JarvisRequest) (*JarvisResponse, bool) {
+	m := jarvisRememberRe.FindStringSubmatch(req.Message)
+	if m == nil || strings.HasSuffix(strings.TrimSpace(req.Message), "?") {
+		return nil, false
+	}
+
+	russian := hasCyrillic(req.Message)
+	reply := &JarvisResponse{Provider: "jarvis", Model: "memory", ConversationID: req.ConversationID}
+	if _, err := rememberJarvisFact(uid, m[1], "chat", req.ConversationID); err != nil {
+		reply.Response = "I'm afraid I couldn't remember that, Sir: " + err.Error()
+		if russian {
+			reply.Response = "Боюсь, не получилось запомнить, сэр: " + err.Error()
+		}
+		return reply, true
+	}
+
+	reply.Response = "Noted, Sir. I shall keep that in mind."
+	if russian {
+		reply.Response = "Принято, сэр. Я это запомню."
+	}
+	return reply, true
+}
+
+// Context assembly
+
+// jarvisTurn is one chat exchange being prepared. Conversation is nil in the
+// legacy stateless mode where the client sends the history itself.
+type jarvisTurn struct {
+	UserID       uint
+	Conversation *JarvisConversation
+	Messages     []ChatMessage
+	// NeedsSummary is set when unsummarized turns were left out of Messages.
+	NeedsSummary bool
+}
+
+// prepareJarvisTurn resolves the conversation for req and builds the prompt.
+// With conversation_id the stored thread is continued; without it and without
+// client history a new thread is started.
+func prepareJarvisTurn(uid uint, req *JarvisRequest) (*jarvisTurn, error) {
+	turn := &jarvisTurn{UserID: uid}
+
+	var facts []JarvisContext
+	db.Where("user_id = ?", uid).Order("created_at DESC").Limit(jarvisMemoryPromptFacts).Find(&facts)
+	system := jarvisSystemPrompt
+	if len(facts) > 0 {
+		var b strings.Builder
+		b.WriteString("\n\nLONG-TERM MEMORY (facts the user asked you to remember):\n")
+		for i := len(facts) - 1; i >= 0; i-- {
+			b.WriteString("- " + facts[i].Content + "\n")
+		}
+		system += b.String()
+	}
+
+	var history []ChatMessage
+	switch {
+	case req.ConversationID != nil:
+		var conversation JarvisConversation
+		if err := db.Where("id = ? AND user_id = ?", *req.ConversationID, uid).First(&conversation).Error; err != nil {
+			return nil, errJarvisConversationNotFound
+		}
+		turn.Conversation = &conversation
+		if conversation.Summary != "" {
+			system += "\n\nSUMMARY OF THE EARLIER CONVERSATION:\n" + conversation.Summary
+		}
+
+		var stored []JarvisConversationMessage
+		db.Where("conversation_id = ? AND id > ?", conversation.ID, conversation.SummarizedUpTo).
+			Order("id DESC").Limit(jarvisHistoryLoadLimit).Find(&stored)
+		for i := len(stored) - 1; i >= 0; i-- {
+			history = append(history, ChatMessage{Role: stored[i].Role, Content: stored[i].Content})
+		}
+	case len(req.History) == 0:
+		conversation := JarvisConversation{UserID: uid, Title: jarvisConversationTitle(firstLine(req.Message, 60))}
+		if err := db.Create(&conversation).Error; err != nil {
+			return nil, err
+		}
+		turn.Conversation = &conversation
+		req.ConversationID = &conversation.ID
+	default:
+		for _, h := range req.History {
+			history = append(history, ChatMessage{Role: h.Role, Content: h.Content})
+		}
+	}
+
+	turn.Messages, turn.NeedsSummary = fitJarvisContext(system, history, req.Message, jarvisContextTokens)
+	return turn, nil
+}
+
+// fitJarvisContext keeps the newest history turns that fit into budget
+// tokens. truncated reports whether older turns had to be dropped.
+func fitJarvisContext(system string, history []ChatMessage, message string, budget int) ([]ChatMessage, bool) {
+	remaining := budget - estimateTokens(system) - estimateTokens(message)
+	start := len(history)
+	for start > 0 {
+		cost := estimateTokens(history[start-1].Content) + 4
+		if cost > remaining {
+			break
+		}
+		remaining -= cost
+		start--
+	}
+
+	messages := make([]ChatMessage, 0, len(history)-start+2)
+	messages = append(messages, ChatMessage{Role: "system", Content: system})
+	messages = append(messages, history[start:]...)
+	messages = append(messages, ChatMessage{Role: "user", Content: message})
+	return messages, start > 0
+}
+
+// save stores the exchange in the conversation and, when old turns fell out
+// of the context window, folds them into the summary in the background.
+func (t *jarvisTurn) save(userMessage, reply, provider, model string, tokens int, settings *Settings) {
+	if t.Conversation == nil {
+		return
+	}
+
+	now := time.Now()
+	messages := []JarvisConversationMessage{
+		{ConversationID: t.Conversation.ID, Role: "user", Content: userMessage, CreatedAt: now},
+	}
+	if reply != "" {
+		messages = append(messages, JarvisConversationMessage{
+			ConversationID: t.Conversation.ID, Role: "assistant", Content: reply,
+			Provider: provider, Model: model, Tokens: tokens, CreatedAt: now,
+		})
+	}
+	if err := db.Create(&messages).Error; err != nil {
+		log.Printf("[Jarvis] Failed to save conversation %d: %v", t.Conversation.ID, err)
+		return
+	}
+	db.Model(&JarvisConversation{}).Where("id = ?", t.Conversation.ID).Updates(map[string]interface{}{
+		"message_count":   gorm.Expr("message_count + ?", len(messages)),
+		"last_message_at": now,
+	})
+
+	if t.NeedsSummary && settings != nil {
+		go summarizeJarvisConversation(t.Conversation.ID, *settings)
+	}
+}
+
+var jarvisSummarizing sync.Map
+
+// summarizeJarvisConversation folds turns that no longer fit into the
+// context window into the rolling summary. Only one run per conversation at
+// a time; the update is conditional on SummarizedUpTo so a stale run cannot
+// overwrite a newer summary.
+func summarizeJarvisConversation(conversationID uint, settings Settings) {
+	if _, busy := jarvisSummarizing.LoadOrStore(conversationID, true); busy {
+		return
+	}
+	defer jarvisSummarizing.Delete(conversationID)
+
+	var conversation JarvisConversation
+	if db.First(&conversation, conversationID).Error != nil {
+		return
+	}
+	var stored []JarvisConversationMessage
+	db.Where("conversation_id = ? AND id > ?", conversation.ID, conversation.SummarizedUpTo).
+		Order("id ASC").Find(&stored)
+
+	// Keep the newest turns that fill half of the budget verbatim
+	keep := jarvisContextTokens / 2
+	cut := len(stored)
+	for cut > 0 && keep-estimateTokens(stored[cut-1].Content) >= 0 {
+		keep -= estimateTokens(stored[cut-1].Content)
+		cut--
+	}
+	if cut == 0 {
+		return
+	}
+
+	var transcript strings.Builder
+	if conversation.Summary != "" {
+		transcript.WriteString("Previous summary:\n" + conversation.Summary + "\n\nNew messages:\n")
+	}
+	for _, m := range stored[:cut] {
+		transcript.WriteString(m.Role + ": " + m.Content + "\n")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), jarvisSummaryTimeout)
+	defer cancel()
+	resp, err := buildLLMChain(&settings, "").Complete(ctx, LLMRequest{
+		Messages: []ChatMessage{
+			{Role: "system", Content: "Summarize the conversation below for your own future reference. Keep facts about the user, decisions, open questions and anything you promised. At most 200 words, in the language of the conversation."},
+			{Role: "user", Content: transcript.String()},
+		},
+		MaxTokens:   400,
+		Temperature: 0.2,
+	})
+	if err != nil {
+		log.Printf("[Jarvis] Failed to summarize conversation %d: %v", conversation.ID, err)
+		return
+	}
+	recordJarvisTokens(conversation.UserID, resp.TotalTokens)
+
+	db.Model(&JarvisConversation{}).
+		Where("id = ? AND summarized_up_to = ?", conversation.ID, conversation.SummarizedUpTo).
+		Updates(map[string]interface{}{
+			"summary":          strings.TrimSpace(resp.Content),
+			"summarized_up_to": stored[cut-1].ID,
+		})
+}
+
+func firstLine(s string, maxRunes int) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	if utf8.RuneCountInString(s) > maxRunes {
+		s = string([]rune(s)[:maxRunes]) + "…"
+	}
+	return s
+}
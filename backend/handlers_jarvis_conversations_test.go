@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestJarvisRememberRe(t *testing.T) {
+	for text, want := range map[string]string{
+		"запомни, что я люблю чай без сахара":            "я люблю чай без сахара",
+		"Джарвис, запомните что мой день рождения 5 мая": "мой день рождения 5 мая",
+		"Jarvis, remember that I prefer Go":              "I prefer Go",
+		"please remember that":                           "",
+	} {
+		m := jarvisRememberRe.FindStringSubmatch(text)
+		got := ""
+		if m != nil {
+			got = m[1]
+		}
+		if got != want {
+			t.Errorf("%q captured %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestJarvisMemoryReplyIgnoresQuestions(t *testing.T) {
+	for _, text := range []string{
+		"remember when we talked about Rust?",
+		"Remember the milk",
+		"запомни это",
+		"запомни, что я сказал?",
+		"remember that thing I told you yesterday?",
+	} {
+		if _, ok := jarvisMemoryReply(1, &JarvisRequest{Message: text}); ok {
+			t.Errorf("%q was stored as a memory", text)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Jarvis in guild channels. A channel message mentioning @jarvis gets an
+// answer from the Jarvis bot user, posted as a reply to the question. The
+// channel's recent messages are the context; the asker must be able to see
+// the channel and the request is counted against the guild's own daily
+// allowance, so busy guilds don't use up the owner's personal quota.
+
+const (
+	jarvisMentionHistory      = 30
+	jarvisMentionTimeout      = 90 * time.Second
+	jarvisChannelPromptMaxLen = 4000
+	jarvisBotUsername         = "jarvis"
+)
+
+var jarvisMentionRe = regexp.MustCompile(`(?i)(?:^|[^\p{L}\p{N}_])@(?:jarvis|джарвис)(?:$|[^\p{L}\p{N}_])`)
+
+func jarvisMentioned(content string) bool {
+	return jarvisMentionRe.MatchString(content)
+}
+
+func setupJarvisMentionRoutes(r *gin.Engine, auth gin.HandlerFunc) {
+	guilds := r.Group("/api/guilds/:id/jarvis")
+	guilds.Use(auth)
+	{
+		guilds.GET("", getGuildJarvisSettingsHandler)
+		guilds.PUT("", updateGuildJarvisSettingsHandler)
+		guilds.PUT("/channels/:channel_id", setChannelJarvisPromptHandler)
+		guilds.DELETE("/channels/:channel_id", deleteChannelJarvisPromptHandler)
+	}
+}
+
+// Settings
+
+func getGuildJarvisSettingsHandler(c *gin.Context) {
+	userID, _ := getUserIDFromContext(c)
+	guild, ok := loadManageableGuild(c, userID)
+	if !ok {
+		return
+	}
+
+	var settings GuildJarvisSettings
+	db.Where("guild_id = ?", guild.ID).First(&settings)
+	var prompts []ChannelJarvisPrompt
+	db.Where("guild_id = ?", guild.ID).Find(&prompts)
+
+	c.JSON(http.StatusOK, gin.H{
+		"guild_id":        guild.ID,
+		"enabled":         settings.Enabled,
+		"channel_prompts": prompts,
+	})
+}
+
+func updateGuildJarvisSettingsHandler(c *gin.Context) {
+	userID, _ := getUserIDFromContext(c)
+	guild, ok := loadManageableGuild(c, userID)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Enabled *bool `json:"enabled" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "enabled is required"})
+		return
+	}
+
+	settings := GuildJarvisSettings{GuildID: guild.ID}
+	db.Where("guild_id = ?", guild.ID).FirstOrCreate(&settings)
+	db.Model(&settings).Updates(map[string]interface{}{
+		"enabled":    *req.Enabled,
+		"updated_by": userID,
+	})
+
+	go LogAuditViaGRPC(userID, "guild_jarvis_update", "guild", strconv.FormatUint(uint64(guild.ID), 10), "guild", fmt.Sprintf("enabled=%t", *req.Enabled), c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusOK, settings)
+}
+
+func setChannelJarvisPromptHandler(c *gin.Context) {
+	userID, _ := getUserIDFromContext(c)
+	guild, ok := loadManageableGuild(c, userID)
+	if !ok {
+		return
+	}
+	channel, ok := loadGuildChannel(c, guild.ID)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		SystemPrompt string `json:"system_prompt" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.SystemPrompt) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "system_prompt is required"})
+		return
+	}
+	if utf8.RuneCountInString(req.SystemPrompt) > jarvisChannelPromptMaxLen {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("system_prompt must be at most %d characters", jarvisChannelPromptMaxLen)})
+		return
+	}
+
+	prompt := ChannelJarvisPrompt{ChannelID: channel.ID, GuildID: guild.ID}
+	db.Where("channel_id = ?", channel.ID).FirstOrCreate(&prompt)
+	db.Model(&prompt).Updates(map[string]interface{}{
+		"system_prompt": strings.TrimSpace(req.SystemPrompt),
+		"updated_by":    userID,
+	})
+
+	go LogAuditViaGRPC(userID, "channel_jarvis_prompt_update", "channel", strconv.FormatUint(uint64(channel.ID), 10), "guild", "", c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusOK, prompt)
+}
+
+func deleteChannelJarvisPromptHandler(c *gin.Context) {
+	userID, _ := getUserIDFromContext(c)
+	guild, ok := loadManageableGuild(c, userID)
+	if !ok {
+		return
+	}
+	channel, ok := loadGuildChannel(c, guild.ID)
+	if !ok {
+		return
+	}
+
+	db.Where("channel_id = ?", channel.ID).Delete(&ChannelJarvisPrompt{})
+	go LogAuditViaGRPC(userID, "channel_jarvis_prompt_delete", "channel", strconv.FormatUint(uint64(channel.ID), 10), "guild", "", c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusOK, gin.H{"message": "Channel prompt removed"})
+}
+
+func loadGuildChannel(c *gin.Context, guildID uint) (Channel, bool) {
+	var channel Channel
+	if err := db.Where("id = ? AND guild_id = ?", c.Param("channel_id"), guildID).First(&channel).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
+		return channel, false
+	}
+	return channel, true
+}
+
+// Answering
+
+var (
+	jarvisBotMu sync.Mutex
+	jarvisBotID uint
+)
+
+// jarvisBotUserID returns the user that authors Jarvis' channel replies,
+// creating it on first use.
+func jarvisBotUserID() (uint, error) {
+	jarvisBotMu.Lock()
+	defer jarvisBotMu.Unlock()
+	if jarvisBotID != 0 {
+		return jarvisBotID, nil
+	}
+
+	var bot User
+	if err := db.Where("role = ? AND username IN ?", "bot", []string{jarvisBotUsername, jarvisBotUsername + "-bot"}).First(&bot).Error; err != nil {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(generateSecurePassword()), bcrypt.DefaultCost)
+		if err != nil {
+			return 0, err
+		}
+		bot = User{Username: jarvisBotUsername, Password: string(hashed), Role: "bot", Status: "online"}
+		var taken int64
+		db.Model(&User{}).Where("username = ?", bot.Username).Count(&taken)
+		if taken > 0 {
+			bot.Username = jarvisBotUsername + "-bot"
+		}
+		if err := db.Create(&bot).Error; err != nil {
+			return 0, err
+		}
+	}
+	jarvisBotID = bot.ID
+	return jarvisBotID, nil
+}
+
+// answerJarvisMention runs in the background after msg has been published.
+// Failures are reported only to the asker.
+func answerJarvisMention(askerID uint, channel Channel, msg Message) {
+	botID, err := jarvisBotUserID()
+	if err != nil {
+		log.Printf("[Jarvis] Failed to load bot user: %v", err)
+		return
+	}
+	if msg.AuthorID == botID {
+		return
+	}
+
+	var settings GuildJarvisSettings
+	if db.Where("guild_id = ? AND enabled = true", channel.GuildID).First(&settings).Error != nil {
+		return
+	}
+	if !hasChannelAccess(askerID, channel) {
+		return
+	}
+
+	ticket, err := reserveGuildJarvisRequest(channel.GuildID, time.Now())
+	if err != nil {
+		if quotaErr, ok := jarvisQuotaErrorFrom(err); ok {
+			notifyJarvisMentionError(askerID, channel, msg, quotaErr.body())
+			return
+		}
+		log.Printf("[Jarvis] Failed to reserve quota for guild %d: %v", channel.GuildID, err)
+		return
+	}
+
+	hub.sendToUser(strconv.FormatUint(uint64(askerID), 10), gin.H{
+		"type":         "typing",
+		"channel_id":   channel.ID,
+		"from_user_id": strconv.FormatUint(uint64(botID), 10),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), jarvisMentionTimeout)
+	defer cancel()
+	resp, err := buildLLMChain(nil, "").Complete(ctx, LLMRequest{
+		Messages:    buildJarvisMentionMessages(channel, msg, botID),
+		MaxTokens:   1024,
+		Temperature: 0.6,
+	})
+	if err != nil {
+		ticket.Finish(0, false)
+		log.Printf("[Jarvis] Mention in channel %d failed: %v", channel.ID, err)
+		notifyJarvisMentionError(askerID, channel, msg, gin.H{"error": "AI providers are unavailable, please try again later"})
+		return
+	}
+	ticket.Finish(resp.TotalTokens, true)
+
+	reply, err := createChannelMessage(db, botID, channel, strings.TrimSpace(resp.Content), &msg.ID)
+	if err != nil {
+		var forbidden *forbiddenContentError
+		if errors.As(err, &forbidden) {
+			log.Printf("[Jarvis] Reply in channel %d blocked by the content filter", channel.ID)
+		} else if !errors.Is(err, errEmptyMessage) {
+			log.Printf("[Jarvis] Failed to store reply in channel %d: %v", channel.ID, err)
+		}
+		notifyJarvisMentionError(askerID, channel, msg, gin.H{"error": "Jarvis could not answer this message"})
+		return
+	}
+	publishChannelMessage(channel, reply)
+}
+
+// buildJarvisMentionMessages turns the channel's latest messages up to msg
+// into a chat history.
+func buildJarvisMentionMessages(channel Channel, msg Message, botID uint) []ChatMessage {
+	var prompt ChannelJarvisPrompt
+	db.Where("channel_id = ?", channel.ID).First(&prompt)
+
+	var recent []Message
+	db.Preload("Author").Where("channel_id = ? AND id < ?", channel.ID, msg.ID).
+		Order("id DESC").Limit(jarvisMentionHistory).Find(&recent)
+
+	var author User
+	db.First(&author, msg.AuthorID)
+	return jarvisMentionMessages(prompt.SystemPrompt, channel, recent, author.Username, msg, botID)
+}
+
+// jarvisMentionMessages assembles the prompt from already loaded rows; recent
+// is newest first. Other people's messages are prefixed with their name and
+// the bot's own replies become assistant turns.
+func jarvisMentionMessages(channelPrompt string, channel Channel, recent []Message, asker string, msg Message, botID uint) []ChatMessage {
+	system := jarvisSystemPrompt
+	if channelPrompt != "" {
+		system = channelPrompt
+	}
+	system += fmt.Sprintf("\n\nYou are taking part in the group channel #%s. Messages are prefixed with their author's name. Answer the latest message that mentions you; keep it concise.", channel.Name)
+
+	history := make([]ChatMessage, 0, len(recent))
+	for i := len(recent) - 1; i >= 0; i-- {
+		m := recent[i]
+		if m.AuthorID == botID {
+			history = append(history, ChatMessage{Role: "assistant", Content: m.Content})
+			continue
+		}
+		history = append(history, ChatMessage{Role: "user", Content: m.Author.Username + ": " + m.Content})
+	}
+
+	messages, _ := fitJarvisContext(system, history, asker+": "+msg.Content, jarvisContextTokens)
+	return messages
+}
+
+func notifyJarvisMentionError(askerID uint, channel Channel, msg Message, body gin.H) {
+	payload := gin.H{
+		"type":       "jarvis-mention-error",
+		"channel_id": channel.ID,
+		"message_id": msg.ID,
+	}
+	for k, v := range body {
+		payload[k] = v
+	}
+	hub.sendToUser(strconv.FormatUint(uint64(askerID), 10), payload)
+}
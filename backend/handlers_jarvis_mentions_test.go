@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJarvisMentioned(t *testing.T) {
+	for content, want := range map[string]bool{
+		"@jarvis what time is it":        true,
+		"hey @Jarvis, help":              true,
+		"@джарвис, привет":               true,
+		"спроси у @Джарвис":              true,
+		"@jarvis":                        true,
+		"jarvis without the at sign":     false,
+		"mail me at bob@jarvis.dev":      false,
+		"@jarvisbot is a different user": false,
+		"@jarvis_fan hi":                 false,
+		"@джарвисик":                     false,
+	} {
+		if got := jarvisMentioned(content); got != want {
+			t.Errorf("jarvisMentioned(%q) = %t, want %t", content, got, want)
+		}
+	}
+}
+
+func TestJarvisMentionMessages(t *testing.T) {
+	const botID = 99
+	channel := Channel{Name: "general"}
+	alice, bob := User{Username: "alice"}, User{Username: "bob"}
+	recent := []Message{ // newest first, as loaded
+		{ID: 3, AuthorID: botID, Content: "It is noon."},
+		{ID: 2, AuthorID: 2, Author: bob, Content: "@jarvis what time is it?"},
+		{ID: 1, AuthorID: 1, Author: alice, Content: "hello"},
+	}
+	msg := Message{ID: 4, AuthorID: 1, Content: "@jarvis and the date?"}
+
+	got := jarvisMentionMessages("", channel, recent, "alice", msg, botID)
+	want := []ChatMessage{
+		{Role: "user", Content: "alice: hello"},
+		{Role: "user", Content: "bob: @jarvis what time is it?"},
+		{Role: "assistant", Content: "It is noon."},
+		{Role: "user", Content: "alice: @jarvis and the date?"},
+	}
+	if len(got) != len(want)+1 {
+		t.Fatalf("got %d messages, want %d: %+v", len(got), len(want)+1, got)
+	}
+	if got[0].Role != "system" || !strings.HasPrefix(got[0].Content, jarvisSystemPrompt) || !strings.Contains(got[0].Content, "#general") {
+		t.Errorf("system prompt = %q", got[0].Content)
+	}
+	for i, w := range want {
+		if got[i+1].Role != w.Role || got[i+1].Content != w.Content {
+			t.Errorf("message %d = %+v, want %+v", i+1, got[i+1], w)
+		}
+	}
+
+	got = jarvisMentionMessages("You are a strict math tutor.", channel, nil, "alice", msg, botID)
+	if !strings.HasPrefix(got[0].Content, "You are a strict math tutor.") || strings.Contains(got[0].Content, jarvisSystemPrompt) {
+		t.Errorf("channel prompt not used: %q", got[0].Content)
+	}
+	if len(got) != 2 {
+		t.Errorf("got %d messages without history, want 2", len(got))
+	}
+}
+
+func TestJarvisMentionMessagesDropsOldHistory(t *testing.T) {
+	long := strings.Repeat("word ", jarvisContextTokens)
+	recent := []Message{
+		{ID: 2, AuthorID: 2, Author: User{Username: "bob"}, Content: "short"},
+		{ID: 1, AuthorID: 1, Author: User{Username: "alice"}, Content: long},
+	}
+	got := jarvisMentionMessages("", Channel{Name: "general"}, recent, "alice", Message{ID: 3, Content: "@jarvis?"}, 99)
+	if len(got) != 3 || got[1].Content != "bob: short" {
+		t.Errorf("oldest oversized turn was kept: %d messages", len(got))
+	}
+}
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	jarvisReminderTick        = 30 * time.Second
+	jarvisReminderBatch       = 100
+	jarvisReminderLease       = 2 * time.Minute
+	jarvisReminderMaxAttempts = 8
+	jarvisReminderMaxPending  = 100
+	jarvisReminderMaxLength   = 1000
+	jarvisReminderMaxAhead    = 366 * 24 * time.Hour
+	jarvisReminderSnooze      = 10 * time.Minute
+)
+
+var (
+	errReminderNoTime  = errors.New("reminder time not recognized")
+	errReminderBadDate = errors.New("no such date")
+)
+
+func setupJarvisReminderRoutes(r *gin.Engine, auth gin.HandlerFunc) {
+	reminders := r.Group("/api/jarvis/reminders")
+	reminders.Use(auth)
+	{
+		reminders.GET("", listJarvisRemindersHandler)
+		reminders.POST("", createJarvisReminderHandler)
+		reminders.GET("/:id", getJarvisReminderHandler)
+		reminders.PATCH("/:id", updateJarvisReminderHandler)
+		reminders.DELETE("/:id", deleteJarvisReminderHandler)
+		reminders.POST("/:id/snooze", snoozeJarvisReminderHandler)
+		reminders.POST("/:id/dismiss", dismissJarvisReminderHandler)
+	}
+}
+
+// InitJarvisReminders starts the dispatcher that delivers due reminders.
+func InitJarvisReminders() {
+	if db == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(jarvisReminderTick)
+		defer ticker.Stop()
+		dispatchDueJarvisReminders()
+		for range ticker.C {
+			dispatchDueJarvisReminders()
+		}
+	}()
+}
+
+func listJarvisRemindersHandler(c *gin.Context) {
+	userIDRaw, _ := c.Get("user_id")
+	userID, _ := extractUserID(userIDRaw)
+
+	q := db.Where("user_id = ?", userID)
+	switch c.Query("status") {
+	case "pending":
+		q = q.Where("is_sent = ? AND dismissed_at IS NULL", false)
+	case "sent":
+		q = q.Where("is_sent = ? AND dismissed_at IS NULL", true)
+	case "dismissed":
+		q = q.Where("dismissed_at IS NOT NULL")
+	}
+
+	var reminders []JarvisReminder
+	q.Order("remind_at ASC").Limit(200).Find(&reminders)
+	c.JSON(http.StatusOK, reminders)
+}
+
+func createJarvisReminderHandler(c *gin.Context) {
+	userIDRaw, _ := c.Get("user_id")
+	userID, _ := extractUserID(userIDRaw)
+
+	var req struct {
+		Content  string `json:"content"`
+		RemindAt string `json:"remind_at"`
+		Text     string `json:"text"` // natural language, e.g. "напомни завтра в 9 позвонить маме"
+		Timezone string `json:"timezone"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	loc := jarvisLocation(req.Timezone)
+	content := strings.TrimSpace(req.Content)
+	var remindAt time.Time
+	if req.Text != "" && req.RemindAt == "" {
+		parsed, err := parseReminderRequest(req.Text, now.In(loc))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Could not understand when to remind you"})
+			return
+		}
+		remindAt = parsed.RemindAt
+		if content == "" {
+			content = parsed.Content
+		}
+	} else {
+		t, err := parseScheduledTime(strings.TrimSpace(req.RemindAt), loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid remind_at, use RFC3339 or YYYY-MM-DDTHH:MM"})
+			return
+		}
+		remindAt = t
+	}
+
+	reminder, err := createJarvisReminder(userID, content, remindAt, "api", now)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, reminder)
+}
+
+func getJarvisReminderHandler(c *gin.Context) {
+	reminder, ok := loadOwnJarvisReminder(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, reminder)
+}
+
+func updateJarvisReminderHandler(c *gin.Context) {
+	reminder, ok := loadOwnJarvisReminder(c)
+	if !ok {
+		return
+	}
+	if reminder.DismissedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Reminder is dismissed"})
+		return
+	}
+
+	var req struct {
+		Content  *string `json:"content"`
+		RemindAt *string `json:"remind_at"`
+		Timezone string  `json:"timezone"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updates := map[string]interface{}{}
+	if req.Content != nil {
+		content := strings.TrimSpace(*req.Content)
+		if err := validateJarvisReminderContent(content); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		updates["content"] = content
+	}
+	if req.RemindAt != nil {
+		remindAt, err := parseScheduledTime(strings.TrimSpace(*req.RemindAt), jarvisLocation(req.Timezone))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid remind_at, use RFC3339 or YYYY-MM-DDTHH:MM"})
+			return
+		}
+		if err := validateJarvisReminderTime(remindAt, time.Now()); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		for k, v := range rearmJarvisReminder(remindAt) {
+			updates[k] = v
+		}
+	}
+	if len(updates) == 0 {
+		c.JSON(http.StatusOK, reminder)
+		return
+	}
+
+	db.Model(reminder).Updates(updates)
+	db.First(reminder, reminder.ID)
+	c.JSON(http.StatusOK, reminder)
+}
+
+func deleteJarvisReminderHandler(c *gin.Context) {
+	reminder, ok := loadOwnJarvisReminder(c)
+	if !ok {
+		return
+	}
+	db.Delete(reminder)
+	c.JSON(http.StatusOK, gin.H{"message": "Reminder deleted"})
+}
+
+func snoozeJarvisReminderHandler(c *gin.Context) {
+	reminder, ok := loadOwnJarvisReminder(c)
+	if !ok {
+		return
+	}
+	if reminder.DismissedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Reminder is dismissed"})
+		return
+	}
+
+	var req struct {
+		Minutes  int    `json:"minutes"`
+		Until    string `json:"until"`
+		Timezone string `json:"timezone"`
+	}
+	c.ShouldBindJSON(&req)
+
+	now := time.Now()
+	remindAt := now.Add(jarvisReminderSnooze)
+	switch {
+	case req.Until != "":
+		t, err := parseScheduledTime(req.Until, jarvisLocation(req.Timezone))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid until, use RFC3339 or YYYY-MM-DDTHH:MM"})
+			return
+		}
+		remindAt = t
+	case req.Minutes > 0:
+		remindAt = now.Add(time.Duration(req.Minutes) * time.Minute)
+	}
+	if err := validateJarvisReminderTime(remindAt, now); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updates := rearmJarvisReminder(remindAt)
+	updates["snooze_count"] = gorm.Expr("snooze_count + 1")
+	db.Model(reminder).Updates(updates)
+	db.First(reminder, reminder.ID)
+	c.JSON(http.StatusOK, reminder)
+}
+
+func dismissJarvisReminderHandler(c *gin.Context) {
+	reminder, ok := loadOwnJarvisReminder(c)
+	if !ok {
+		return
+	}
+	if reminder.DismissedAt == nil {
+		db.Model(reminder).Updates(map[string]interface{}{
+			"dismissed_at": time.Now(),
+			"locked_until": nil,
+		})
+		db.First(reminder, reminder.ID)
+	}
+	c.JSON(http.StatusOK, reminder)
+}
+
+func loadOwnJarvisReminder(c *gin.Context) (*JarvisReminder, bool) {
+	userIDRaw, _ := c.Get("user_id")
+	userID, _ := extractUserID(userIDRaw)
+
+	var reminder JarvisReminder
+	if err := db.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&reminder).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reminder not found"})
+		return nil, false
+	}
+	return &reminder, true
+}
+
+// rearmJarvisReminder returns the updates that make a reminder due again at
+// remindAt with all delivery state cleared.
+func rearmJarvisReminder(remindAt time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"remind_at":    remindAt,
+		"is_sent":      false,
+		"attempts":     0,
+		"last_error":   "",
+		"locked_until": nil,
+		"notified_at":  nil,
+		"emailed_at":   nil,
+		"sent_at":      nil,
+	}
+}
+
+func createJarvisReminder(userID uint, content string, remindAt time.Time, source string, now time.Time) (*JarvisReminder, error) {
+	if err := validateJarvisReminderContent(content); err != nil {
+		return nil, err
+	}
+	if err := validateJarvisReminderTime(remindAt, now); err != nil {
+		return nil, err
+	}
+
+	var pending int64
+	db.Model(&JarvisReminder{}).Where("user_id = ? AND is_sent = ? AND dismissed_at IS NULL", userID, false).Count(&pending)
+	if pending >= jarvisReminderMaxPending {
+		return nil, fmt.Errorf("no more than %d pending reminders allowed", jarvisReminderMaxPending)
+	}
+
+	reminder := JarvisReminder{
+		UserID:   userID,
+		Content:  content,
+		RemindAt: remindAt,
+		Source:   source,
+	}
+	if err := db.Create(&reminder).Error; err != nil {
+		return nil, errors.New("failed to create reminder")
+	}
+	return &reminder, nil
+}
+
+func validateJarvisReminderContent(content string) error {
+	if content == "" {
+		return errors.New("content is required")
+	}
+	if utf8.RuneCountInString(content) > jarvisReminderMaxLength {
+		return fmt.Errorf("content must be at most %d characters", jarvisReminderMaxLength)
+	}
+	return nil
+}
+
+func validateJarvisReminderTime(remindAt, now time.Time) error {
+	if !remindAt.After(now) {
+		return errors.New("reminder time must be in the future")
+	}
+	if remindAt.After(now.Add(jarvisReminderMaxAhead)) {
+		return errors.New("reminder time is too far in the future")
+	}
+	return nil
+}
+
+// jarvisLocation resolves the client's time zone for reminders. Requests
+// without one fall back to JARVIS_TIMEZONE, then Moscow time.
+func jarvisLocation(tz string) *time.Location {
+	for _, name := range []string{tz, os.Getenv("JARVIS_TIMEZONE"), "Europe/Moscow"} {
+		if name == "" {
+			continue
+		}
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc
+		}
+	}
+	return time.UTC
+}
+
+// Dispatcher
+
+func dispatchDueJarvisReminders() {
+	now := time.Now()
+	var due []JarvisReminder
+	if err := db.Where("is_sent = ? AND dismissed_at IS NULL AND remind_at <= ? AND (locked_until IS NULL OR locked_until < ?)", false, now, now).
+		Order("remind_at ASC").Limit(jarvisReminderBatch).Find(&due).Error; err != nil {
+		log.Printf("[Jarvis] Failed to load due reminders: %v", err)
+		return
+	}
+
+	for i := range due {
+		deliverJarvisReminder(&due[i], now)
+	}
+}
+
+// deliverJarvisReminder takes a lease on the reminder and pushes it out. A
+// reminder is only marked sent after every channel succeeded, so a crash or a
+// failing mail server leads to a retry once the lease expires: delivery is
+// at-least-once. Channels that already went through are not repeated.
+func deliverJarvisReminder(reminder *JarvisReminder, now time.Time) {
+	res := db.Model(&JarvisReminder{}).
+		Where("id = ? AND is_sent = ? AND dismissed_at IS NULL AND (locked_until IS NULL OR locked_until < ?)", reminder.ID, false, now).
+		Updates(map[string]interface{}{
+			"locked_until": now.Add(jarvisReminderLease),
+			"attempts":     gorm.Expr("attempts + 1"),
+		})
+	if res.Error != nil || res.RowsAffected == 0 {
+		return
+	}
+	attempts := reminder.Attempts + 1
+
+	updates := map[string]interface{}{"locked_until": nil}
+	if reminder.NotifiedAt == nil {
+		hub.sendToUser(strconv.FormatUint(uint64(reminder.UserID), 10), map[string]interface{}{
+			"type":     "jarvis_reminder",
+			"reminder": reminder,
+			"actions":  []string{"snooze", "dismiss"},
+		})
+		createNotificationHandler(reminder.UserID, "jarvis_reminder", "⏰ Напоминание: "+reminder.Content)
+		updates["notified_at"] = now
+	}
+
+	var emailErr error
+	if reminder.EmailedAt == nil {
+		if emailErr = SendJarvisReminder(reminder.UserID, reminder.Content, reminder.RemindAt); emailErr == nil {
+			updates["emailed_at"] = now
+		}
+	}
+
+	switch {
+	case emailErr == nil:
+		updates["is_sent"] = true
+		updates["sent_at"] = now
+		updates["last_error"] = ""
+	case attempts >= jarvisReminderMaxAttempts:
+		log.Printf("[Jarvis] Giving up on email for reminder %d: %v", reminder.ID, emailErr)
+		updates["is_sent"] = true
+		updates["sent_at"] = now
+		updates["last_error"] = emailErr.Error()
+	default:
+		// Keep the lease as a backoff before the next attempt.
+		updates["locked_until"] = now.Add(time.Duration(attempts*attempts) * time.Minute)
+		updates["last_error"] = emailErr.Error()
+	}
+
+	if err := db.Model(&JarvisReminder{}).Where("id = ?", reminder.ID).Updates(updates).Error; err != nil {
+		log.Printf("[Jarvis] Failed to record delivery of reminder %d: %v", reminder.ID, err)
+	}
+}
+
+// Natural language parsing
+
+type parsedReminder struct {
+	Content  string
+	RemindAt time.Time
+}
+
+var (
+	reminderTriggerRe  = regexp.MustCompile(`^(?:(?:джарвис|jarvis)[,!.]?\s+)?(?:пожалуйста,?\s+)?(?:напомни(?:те)?|remind\s+me)(?:\s|$)`)
+	reminderRelativeRe = regexp.MustCompile(`(?:^|\s)(?:через|in)\s+(полчаса|half\s+an\s+hour|(?:(\d+|an?|one)\s+)?(минуту|минуты|минут|мин|часа|часов|час|дня|дней|день|недели|недель|неделю|minutes?|mins?|hours?|days?|weeks?))(?:\s|$|[,.!])`)
+	reminderDayRe      = regexp.MustCompile(`(?:^|\s)(послезавтра|завтра|сегодня|tomorrow|today)(?:\s|$|[,.!])`)
+	reminderWeekdayRe  = regexp.MustCompile(`(?:^|\s)(?:во?|on)\s+(понедельник|вторник|среду|четверг|пятницу|субботу|воскресенье|monday|tuesday|wednesday|thursday|friday|saturday|sunday)(?:\s|$|[,.!])`)
+	reminderDateRe     = regexp.MustCompile(`(?:^|\s)(?:(на|к|до|on|by)\s+)?(\d{1,2})\.(\d{1,2})(?:\.(\d{2,4}))?(?:\s|$|[,!])`)
+	reminderClockRe    = regexp.MustCompile(`(?:^|\s)(?:в|at)\s+(\d{1,2})(?:[:.](\d{2}))?(?:\s*(?:часов|часа|час|ч))?(?:\s*(утра|дня|вечера|ночи|am|pm))?(?:\s|$|[,.!])`)
+	reminderFillerRe   = regexp.MustCompile(`(?i)^(?:(?:мне|нам|что|чтобы|о|об|про|me|to|that|about)(?:\s+|$))+`)
+)
+
+var reminderWeekdays = map[string]time.Weekday{
+	"понедельник": time.Monday, "вторник": time.Tuesday, "среду": time.Wednesday, "четверг": time.Thursday,
+	"пятницу": time.Friday, "субботу": time.Saturday, "воскресенье": time.Sunday,
+	"monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday, "thursday": time.Thursday,
+	"friday": time.Friday, "saturday": time.Saturday, "sunday": time.Sunday,
+}
+
+// isReminderRequest reports whether a chat message asks Jarvis for a reminder.
+func isReminderRequest(text string) bool {
+	return reminderTriggerRe.MatchString(strings.ToLower(strings.TrimSpace(text)))
+}
+
+// parseReminderRequest understands phrases like "напомни мне завтра в 9
+// позвонить маме", "напомни через 15 минут про созвон" or "remind me tomorrow
+// at 7pm to call mom". now carries the user's location. What is left after
+// removing the time expressions becomes the reminder text.
+func parseReminderRequest(text string, now time.Time) (*parsedReminder, error) {
+	original := strings.TrimSpace(text)
+	lower := strings.ToLower(original)
+	if len(lower) != len(original) {
+		original = lower
+	}
+
+	cut := make([]bool, len(lower))
+	remove := func(loc []int) {
+		for i := loc[0]; i < loc[1]; i++ {
+			cut[i] = true
+		}
+	}
+
+	if loc := reminderTriggerRe.FindStringIndex(lower); loc != nil {
+		remove(loc)
+	}
+
+	var (
+		day     *time.Time
+		offset  time.Duration
+		hour    = -1
+		minute  int
+		matched bool
+	)
+	startOfDay := func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	}
+
+	if m := reminderRelativeRe.FindStringSubmatchIndex(lower); m != nil {
+		phrase := lower[m[2]:m[3]]
+		n := 1
+		if m[4] >= 0 {
+			if v, err := strconv.Atoi(lower[m[4]:m[5]]); err == nil {
+				n = v
+			}
+		}
+		if strings.HasPrefix(phrase, "пол") || strings.HasPrefix(phrase, "half") {
+			offset = 30 * time.Minute
+		} else {
+			switch unit := lower[m[6]:m[7]]; {
+			case strings.HasPrefix(unit, "мин") || strings.HasPrefix(unit, "min"):
+				offset = time.Duration(n) * time.Minute
+			case strings.HasPrefix(unit, "час") || strings.HasPrefix(unit, "hour"):
+				offset = time.Duration(n) * time.Hour
+			case strings.HasPrefix(unit, "д") || strings.HasPrefix(unit, "day"):
+				d := startOfDay(now).AddDate(0, 0, n)
+				day = &d
+			default:
+				d := startOfDay(now).AddDate(0, 0, 7*n)
+				day = &d
+			}
+		}
+		remove([]int{m[0], m[1]})
+		matched = true
+	}
+
+	// The clock goes first so that "в 9.30" is a time, not the 9th of a
+	// thirtieth month
+	clock := false
+	if m := reminderClockRe.FindStringSubmatchIndex(lower); m != nil {
+		hour, _ = strconv.Atoi(lower[m[2]:m[3]])
+		if m[4] >= 0 {
+			minute, _ = strconv.Atoi(lower[m[4]:m[5]])
+		}
+		if m[6] >= 0 {
+			switch lower[m[6]:m[7]] {
+			case "дня", "вечера", "pm":
+				if hour < 12 {
+					hour += 12
+				}
+			case "утра", "ночи", "am":
+				if hour == 12 {
+					hour = 0
+				}
+			}
+		}
+		if hour > 23 || minute > 59 {
+			return nil, errReminderNoTime
+		}
+		remove([]int{m[0], m[1]})
+		matched, clock = true, true
+	}
+
+	if m := reminderDayRe.FindStringSubmatchIndex(lower); m != nil {
+		d := startOfDay(now)
+		switch lower[m[2]:m[3]] {
+		case "завтра", "tomorrow":
+			d = d.AddDate(0, 0, 1)
+		case "послезавтра":
+			d = d.AddDate(0, 0, 2)
+		}
+		day = &d
+		remove([]int{m[0], m[1]})
+		matched = true
+	} else if m := reminderWeekdayRe.FindStringSubmatchIndex(lower); m != nil {
+		ahead := (int(reminderWeekdays[lower[m[2]:m[3]]]) - int(now.Weekday()) + 7) % 7
+		if ahead == 0 {
+			ahead = 7
+		}
+		d := startOfDay(now).AddDate(0, 0, ahead)
+		day = &d
+		remove([]int{m[0], m[1]})
+		matched = true
+	} else if m := reminderDate(lower, cut, clock); m != nil {
+		dd, _ := strconv.Atoi(lower[m[4]:m[5]])
+		mm, _ := strconv.Atoi(lower[m[6]:m[7]])
+		year := now.Year()
+		if m[8] >= 0 {
+			year, _ = strconv.Atoi(lower[m[8]:m[9]])
+			if year < 100 {
+				year += 2000
+			}
+		}
+		d := time.Date(year, time.Month(mm), dd, 0, 0, 0, 0, now.Location())
+		// time.Date turns 31.02 into the 3rd of March
+		if d.Day() != dd || int(d.Month()) != mm {
+			return nil, errReminderBadDate
+		}
+		if m[8] < 0 && d.Before(startOfDay(now)) {
+			d = d.AddDate(1, 0, 0)
+			if d.Day() != dd {
+				// 29.02 rolled into a year without one
+				return nil, errReminderBadDate
+			}
+		}
+		day = &d
+		remove([]int{m[0], m[1]})
+		matched = true
+	}
+
+	if !matched {
+		return nil, errReminderNoTime
+	}
+
+	var at time.Time
+	switch {
+	case offset > 0:
+		at = now.Add(offset)
+	case day != nil && hour >= 0:
+		at = time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, now.Location())
+	case day != nil:
+		at = time.Date(day.Year(), day.Month(), day.Day(), 9, 0, 0, 0, now.Location())
+	default:
+		at = time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 1)
+		}
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(original); i++ {
+		if cut[i] {
+			if b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			continue
+		}
+		b.WriteByte(original[i])
+	}
+	content := strings.Join(strings.Fields(b.String()), " ")
+	content = strings.TrimFunc(content, func(r rune) bool { return unicode.IsPunct(r) || unicode.IsSpace(r) })
+	content = strings.TrimSpace(reminderFillerRe.ReplaceAllString(content, ""))
+	if content == "" {
+		content = "Напоминание"
+	}
+
+	return &parsedReminder{Content: content, RemindAt: at}, nil
+}
+
+// reminderDate finds a dd.mm date that is not part of an expression already
+// parsed. A bare dd.mm is only a date with a year, a preposition ("на
+// 15.03") or a clock time next to it; otherwise it is as likely a time or
+// a version number.
+func reminderDate(lower string, cut []bool, clock bool) []int {
+	for _, m := range reminderDateRe.FindAllStringSubmatchIndex(lower, -1) {
+		if slices.Contains(cut[m[4]:m[7]], true) {
+			continue
+		}
+		if m[2] >= 0 || m[8] >= 0 || clock {
+			return m
+		}
+	}
+	return nil
+}
+
+// reminderConfirmation is Jarvis' reply after creating a reminder from chat.
+func reminderConfirmation(reminder *JarvisReminder, loc *time.Location, russian bool) string {
+	at := reminder.RemindAt.In(loc)
+	if russian {
+		return fmt.Sprintf("Будет исполнено, сэр. Напомню «%s» %s в %s.", reminder.Content, at.Format("02.01.2006"), at.Format("15:04"))
+	}
+	return fmt.Sprintf("Very well, Sir. I shall remind you: \"%s\" on %s at %s.", reminder.Content, at.Format("Jan 2, 2006"), at.Format("15:04"))
+}
+
+func hasCyrillic(s string) bool {
+	for _, r := range s {
+		if unicode.Is(unicode.Cyrillic, r) {
+			return true
+		}
+	}
+	return false
+}
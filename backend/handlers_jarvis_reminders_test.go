@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseReminderRequest(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	at := func(month time.Month, day, hour, min int, year ...int) time.Time {
+		y := 2026
+		if len(year) > 0 {
+			y = year[0]
+		}
+		return time.Date(y, month, day, hour, min, 0, 0, time.UTC)
+	}
+	for _, tc := range []struct {
+		text    string
+		want    time.Time
+		content string
+	}{
+		{"напомни завтра в 9 позвонить маме", at(10, 19, 9, 0), "позвонить маме"},
+		{"напомни через 15 минут про созвон", at(10, 18, 12, 15), "созвон"},
+		{"remind me tomorrow at 7pm to call mom", at(10, 19, 19, 0), "call mom"},
+		{"напомни в 14:45 выпить чай", at(10, 18, 14, 45), "выпить чай"},
+		{"напомни в 9.30 созвон", at(10, 19, 9, 30), "созвон"}, // a time, not the 9th of month 30
+		{"напомни в 18.05 забрать посылку", at(10, 18, 18, 5), "забрать посылку"},
+		{"напомни на 15.03 оплатить счёт", at(3, 15, 9, 0, 2027), "оплатить счёт"},
+		{"напомни 15.03 в 10 оплатить счёт", at(3, 15, 10, 0, 2027), "оплатить счёт"},
+		{"напомни 25.12.2026 поздравить", at(12, 25, 9, 0), "поздравить"},
+		{"напомни до 29.02.2028 продлить", at(2, 29, 9, 0, 2028), "продлить"},
+	} {
+		got, err := parseReminderRequest(tc.text, now)
+		if err != nil {
+			t.Errorf("%q: %v", tc.text, err)
+			continue
+		}
+		if !got.RemindAt.Equal(tc.want) || got.Content != tc.content {
+			t.Errorf("%q = %s %q, want %s %q", tc.text, got.RemindAt, got.Content, tc.want, tc.content)
+		}
+	}
+
+	for _, tc := range []struct {
+		text string
+		want error
+	}{
+		{"напомни на 31.02 заплатить за квартиру", errReminderBadDate},
+		{"напомни 31.04.2027 в 10 отчёт", errReminderBadDate},
+		{"напомни на 29.02 продлить", errReminderBadDate}, // 2027 has no 29 February
+		{"Напомни мне, что такое HTTP", errReminderNoTime},
+		{"напомни 10.11 про встречу", errReminderNoTime}, // no date context
+		{"напомни в 25 часов", errReminderNoTime},
+	} {
+		if _, err := parseReminderRequest(tc.text, now); !errors.Is(err, tc.want) {
+			t.Errorf("%q: err = %v, want %v", tc.text, err, tc.want)
+		}
+	}
+}
+
+func TestJarvisReminderReplyFallsThroughWithoutTime(t *testing.T) {
+	for _, text := range []string{"Напомни мне, что такое HTTP", "remind me what a mutex is", "как дела?"} {
+		if _, ok := jarvisReminderReply(1, &JarvisRequest{Message: text}); ok {
+			t.Errorf("%q was answered as a reminder", text)
+		}
+	}
+	reply, ok := jarvisReminderReply(1, &JarvisRequest{Message: "напомни на 31.02 заплатить"})
+	if !ok || reply.Response != "Такой даты нет, сэр." {
+		t.Errorf("impossible date: %+v, %v", reply, ok)
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// "Catch me up" summaries of a channel or a DM thread. The range defaults to
+// everything after the user's last read message; since/until narrow it down.
+// Long ranges are summarised map-reduce style: every chunk that fits the
+// context window is summarised on its own, then the partial summaries are
+// merged. Summaries cite message ids as [#id].
+
+const (
+	jarvisSummaryMaxMessages = 2000
+	jarvisSummaryParallel    = 3
+	jarvisSummaryDeadline    = 3 * time.Minute
+	jarvisSummaryWriteSlack  = 15 * time.Second
+	// Room left in the context window for instructions and the answer.
+	jarvisSummaryOverhead      = 1500
+	jarvisSummaryPartialTokens = 700
+)
+
+var jarvisCitationRe = regexp.MustCompile(`\[#(\d+)\]`)
+
+const jarvisSummaryMapPrompt = `You summarise chat history for someone who missed it. Write concise bullet points covering decisions, questions that still need an answer, deadlines, tasks and anything addressed to the reader. After every point cite the messages it is based on as [#id], using the ids from the transcript. Do not invent ids. Answer in the language of the conversation.`
+
+const jarvisSummaryReducePrompt = `Merge these partial summaries of consecutive parts of one conversation into a single summary. Keep the bullet point format, remove duplicates, keep the most important points first and keep every [#id] citation that supports a point you keep. Answer in the language of the summaries.`
+
+// jarvisSummaryLine is one message prepared for the transcript.
+type jarvisSummaryLine struct {
+	ID        uint
+	Author    string
+	Content   string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (l jarvisSummaryLine) text() string {
+	return fmt.Sprintf("[#%d] %s (%s): %s\n", l.ID, l.Author, l.CreatedAt.UTC().Format("2006-01-02 15:04"), l.Content)
+}
+
+type jarvisSummaryRequest struct {
+	Since string `json:"since"`
+	Until string `json:"until"`
+}
+
+func setupJarvisSummaryRoutes(r *gin.Engine, auth gin.HandlerFunc) {
+	r.POST("/api/channels/:channel_id/summarize", auth, summarizeChannelHandler)
+	r.POST("/api/messages/with/:user_id/summarize", auth, summarizeDirectMessagesHandler)
+}
+
+func summarizeChannelHandler(c *gin.Context) {
+	uid, ok := getUserIDFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var channel Channel
+	if err := db.First(&channel, c.Param("channel_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
+		return
+	}
+	if !hasChannelAccess(uid, channel) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "No access to this channel"})
+		return
+	}
+
+	since, until, ok := bindJarvisSummaryRange(c)
+	if !ok {
+		return
+	}
+
+	q := db.Model(&Message{}).Where("channel_id = ?", channel.ID)
+	if since == nil {
+		// Last read message in this channel, if any
+		var lastRead uint
+		db.Model(&ReadReceipt{}).
+			Joins("JOIN messages ON messages.id = read_receipts.message_id").
+			Where("read_receipts.user_id = ? AND messages.channel_id = ?", uid, channel.ID).
+			Select("COALESCE(MAX(read_receipts.message_id), 0)").Scan(&lastRead)
+		q = q.Where("id > ?", lastRead)
+	}
+	q = applyJarvisSummaryRange(q, "created_at", since, until)
+
+	var messages []Message
+	q.Preload("Author").Order("id DESC").Limit(jarvisSummaryMaxMessages + 1).Find(&messages)
+
+	lines := make([]jarvisSummaryLine, 0, len(messages))
+	for i := len(messages) - 1; i >= 0; i-- {
+		m := messages[i]
+		lines = append(lines, jarvisSummaryLine{ID: m.ID, Author: m.Author.Username, Content: m.Content, CreatedAt: m.CreatedAt, UpdatedAt: m.UpdatedAt})
+	}
+
+	respondJarvisSummary(c, uid, JarvisSummary{Scope: "channel", ChannelID: channel.ID}, lines)
+}
+
+func summarizeDirectMessagesHandler(c *gin.Context) {
+	uid, ok := getUserIDFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	otherID, err := strconv.ParseUint(c.Param("user_id"), 10, 32)
+	if err != nil || uint(otherID) == uid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	peer := uint(otherID)
+
+	since, until, ok := bindJarvisSummaryRange(c)
+	if !ok {
+		return
+	}
+
+	q := db.Model(&DirectMessage{}).Where(
+		"(sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)",
+		uid, peer, peer, uid,
+	)
+	if since == nil {
+		// Start at the first unread message sent to the user
+		var firstUnread uint
+		db.Model(&DirectMessage{}).
+			Where("sender_id = ? AND receiver_id = ? AND read = false", peer, uid).
+			Select("COALESCE(MIN(id), 0)").Scan(&firstUnread)
+		if firstUnread == 0 {
+			respondJarvisSummary(c, uid, jarvisDMSummaryKey(uid, peer), nil)
+			return
+		}
+		q = q.Where("id >= ?", firstUnread)
+	}
+	q = applyJarvisSummaryRange(q, "created_at", since, until)
+
+	var messages []DirectMessage
+	q.Order("id DESC").Limit(jarvisSummaryMaxMessages + 1).Find(&messages)
+
+	names := map[uint]string{}
+	var users []User
+	db.Where("id IN ?", []uint{uid, peer}).Find(&users)
+	for _, u := range users {
+		names[u.ID] = u.Username
+	}
+
+	lines := make([]jarvisSummaryLine, 0, len(messages))
+	for i := len(messages) - 1; i >= 0; i-- {
+		m := messages[i]
+		content := m.Content
+		if content == "" && m.VoiceURL != nil {
+			content = "(voice message)"
+		}
+		lines = append(lines, jarvisSummaryLine{ID: m.ID, Author: names[m.SenderID], Content: content, CreatedAt: m.CreatedAt, UpdatedAt: m.UpdatedAt})
+	}
+
+	respondJarvisSummary(c, uid, jarvisDMSummaryKey(uid, peer), lines)
+}
+
+func jarvisDMSummaryKey(a, b uint) JarvisSummary {
+	if a > b {
+		a, b = b, a
+	}
+	return JarvisSummary{Scope: "dm", UserAID: a, UserBID: b}
+}
+
+func bindJarvisSummaryRange(c *gin.Context) (since, until *time.Time, ok bool) {
+	var req jarvisSummaryRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return nil, nil, false
+		}
+	}
+	var err error
+	if since, err = parseExportTime(req.Since, false); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid since, use RFC3339 or YYYY-MM-DD"})
+		return nil, nil, false
+	}
+	if until, err = parseExportTime(req.Until, true); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid until, use RFC3339 or YYYY-MM-DD"})
+		return nil, nil, false
+	}
+	if since != nil && until != nil && until.Before(*since) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "until must be after since"})
+		return nil, nil, false
+	}
+	return since, until, true
+}
+
+func applyJarvisSummaryRange(q *gorm.DB, column string, since, until *time.Time) *gorm.DB {
+	if since != nil {
+		q = q.Where(column+" >= ?", *since)
+	}
+	if until != nil {
+		q = q.Where(column+" <= ?", *until)
+	}
+	return q
+}
+
+// respondJarvisSummary serves key's range from the cache or summarises lines.
+func respondJarvisSummary(c *gin.Context, uid uint, key JarvisSummary, lines []jarvisSummaryLine) {
+	if len(lines) == 0 {
+		c.JSON(http.StatusOK, gin.H{"summary": "", "message_count": 0, "cached": false, "cited_message_ids": []uint{}})
+		return
+	}
+
+	truncated := len(lines) > jarvisSummaryMaxMessages
+	if truncated {
+		// The oldest messages are dropped; the newest ones matter most
+		lines = lines[len(lines)-jarvisSummaryMaxMessages:]
+	}
+
+	key.FromMessageID = lines[0].ID
+	key.ToMessageID = lines[len(lines)-1].ID
+	key.Fingerprint = jarvisSummaryFingerprint(lines)
+
+	var cached JarvisSummary
+	if err := db.Where(&key).First(&cached).Error; err == nil {
+		c.JSON(http.StatusOK, jarvisSummaryResponse(&cached, lines, true))
+		return
+	}
+
+	ticket, err := reserveJarvisRequest(uid, time.Now())
+	if err != nil {
+		if quotaErr, ok := jarvisQuotaErrorFrom(err); ok {
+			abortJarvisQuota(c, quotaErr)
+			return
+		}
+		log.Printf("[Jarvis] Failed to reserve quota for user %d: %v", uid, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check Jarvis quota"})
+		return
+	}
+
+	var settings Settings
+	db.Where("user_id = ?", uid).First(&settings)
+
+	// The server-wide WriteTimeout would close the connection long before a
+	// large map-reduce finishes, leaving the user charged for a summary they
+	// never receive.
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Now().Add(jarvisSummaryDeadline + jarvisSummaryWriteSlack))
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), jarvisSummaryDeadline)
+	defer cancel()
+	result, err := summarizeJarvisLines(ctx, buildLLMChain(&settings, ""), lines)
+	if err != nil {
+		ticket.Finish(result.TotalTokens, false)
+		if c.Request.Context().Err() != nil {
+			return
+		}
+		log.Printf("[Jarvis] Summary for user %d failed: %v", uid, err)
+		status := http.StatusServiceUnavailable
+		if errors.Is(err, errNoLLMProviders) {
+			status = http.StatusNotImplemented
+		}
+		c.JSON(status, gin.H{"error": "AI providers are unavailable, please try again later"})
+		return
+	}
+	ticket.Finish(result.TotalTokens, true)
+
+	summary := key
+	summary.UserID = uid
+	summary.MessageCount = len(lines)
+	summary.Truncated = truncated
+	summary.Summary = result.Content
+	summary.Provider = result.Provider
+	summary.Model = result.Model
+	summary.Tokens = result.TotalTokens
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&summary).Error; err != nil {
+		log.Printf("[Jarvis] Failed to cache summary: %v", err)
+	}
+
+	c.JSON(http.StatusOK, jarvisSummaryResponse(&summary, lines, false))
+}
+
+func jarvisSummaryResponse(summary *JarvisSummary, lines []jarvisSummaryLine, cached bool) gin.H {
+	return gin.H{
+		"summary":           summary.Summary,
+		"from_message_id":   summary.FromMessageID,
+		"to_message_id":     summary.ToMessageID,
+		"message_count":     summary.MessageCount,
+		"truncated":         summary.Truncated,
+		"cited_message_ids": jarvisCitedMessageIDs(summary.Summary, lines),
+		"provider":          summary.Provider,
+		"model":             summary.Model,
+		"tokens_used":       summary.Tokens,
+		"cached":            cached,
+		"created_at":        summary.CreatedAt,
+	}
+}
+
+func jarvisSummaryFingerprint(lines []jarvisSummaryLine) string {
+	h := sha256.New()
+	for _, l := range lines {
+		fmt.Fprintf(h, "%d:%d;", l.ID, l.UpdatedAt.UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// jarvisCitedMessageIDs lists the [#id] citations that point into lines.
+func jarvisCitedMessageIDs(summary string, lines []jarvisSummaryLine) []uint {
+	known := make(map[uint]bool, len(lines))
+	for _, l := range lines {
+		known[l.ID] = true
+	}
+	seen := map[uint]bool{}
+	ids := []uint{}
+	for _, m := range jarvisCitationRe.FindAllStringSubmatch(summary, -1) {
+		id, err := strconv.ParseUint(m[1], 10, 32)
+		if err != nil || !known[uint(id)] || seen[uint(id)] {
+			continue
+		}
+		seen[uint(id)] = true
+		ids = append(ids, uint(id))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// chunkJarvisTranscript splits texts into chunks of at most budget tokens.
+// A single text larger than the budget becomes its own chunk.
+func chunkJarvisTranscript(texts []string, budget int) []string {
+	var chunks []string
+	var b strings.Builder
+	used := 0
+	for _, t := range texts {
+		cost := estimateTokens(t)
+		if used > 0 && used+cost > budget {
+			chunks = append(chunks, b.String())
+			b.Reset()
+			used = 0
+		}
+		b.WriteString(t)
+		used += cost
+	}
+	if used > 0 {
+		chunks = append(chunks, b.String())
+	}
+	return chunks
+}
+
+// summarizeJarvisLines runs the map step over transcript chunks and reduces
+// the partial summaries until one is left. The returned response carries the
+// tokens of every call, also on error.
+func summarizeJarvisLines(ctx context.Context, chain llmChain, lines []jarvisSummaryLine) (*LLMResponse, error) {
+	// Each partial is capped at jarvisSummaryPartialTokens, so a chunk always
+	// holds at least two of them and every reduce round makes progress.
+	budget := max(jarvisContextTokens-jarvisSummaryOverhead, 3*jarvisSummaryPartialTokens)
+
+	texts := make([]string, len(lines))
+	for i, l := range lines {
+		texts[i] = l.text()
+	}
+
+	total := &LLMResponse{}
+	prompt := jarvisSummaryMapPrompt
+	chunks := chunkJarvisTranscript(texts, budget)
+	for {
+		partials, err := runJarvisSummaryStep(ctx, chain, prompt, chunks, total)
+		if err != nil {
+			return total, err
+		}
+		if len(partials) == 1 {
+			total.Content = strings.TrimSpace(partials[0])
+			return total, nil
+		}
+
+		prompt = jarvisSummaryReducePrompt
+		for i := range partials {
+			partials[i] = fmt.Sprintf("Part %d:\n%s\n\n", i+1, strings.TrimSpace(partials[i]))
+		}
+		chunks = chunkJarvisTranscript(partials, budget)
+	}
+}
+
+func runJarvisSummaryStep(ctx context.Context, chain llmChain, prompt string, chunks []string, total *LLMResponse) ([]string, error) {
+	results := make([]string, len(chunks))
+	errs := make([]error, len(chunks))
+	sem := make(chan struct{}, jarvisSummaryParallel)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func(i int, chunk string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			resp, err := chain.Complete(ctx, LLMRequest{
+				Messages: []ChatMessage{
+					{Role: "system", Content: prompt},
+					{Role: "user", Content: chunk},
+				},
+				MaxTokens:   jarvisSummaryPartialTokens,
+				Temperature: 0.2,
+			})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			results[i] = resp.Content
+
+			mu.Lock()
+			total.Provider, total.Model = resp.Provider, resp.Model
+			total.PromptTokens += resp.PromptTokens
+			total.CompletionTokens += resp.CompletionTokens
+			total.TotalTokens += resp.TotalTokens
+			mu.Unlock()
+		}(i, chunk)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChunkJarvisTranscript(t *testing.T) {
+	// Each line costs 10 tokens.
+	a, b, c := strings.Repeat("a", 40), strings.Repeat("b", 40), strings.Repeat("c", 40)
+	huge := strings.Repeat("h", 400)
+	for _, tc := range []struct {
+		name   string
+		texts  []string
+		budget int
+		want   []string
+	}{
+		{"empty", nil, 100, nil},
+		{"fits", []string{a, b, c}, 30, []string{a + b + c}},
+		{"splits at budget", []string{a, b, c}, 20, []string{a + b, c}},
+		{"oversized text is its own chunk", []string{a, huge, b}, 20, []string{a, huge, b}},
+	} {
+		if got := chunkJarvisTranscript(tc.texts, tc.budget); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %d chunks %q, want %d", tc.name, len(got), got, len(tc.want))
+		}
+	}
+}
+
+func TestJarvisCitedMessageIDs(t *testing.T) {
+	lines := []jarvisSummaryLine{{ID: 10}, {ID: 11}, {ID: 25}}
+	for _, tc := range []struct {
+		summary string
+		want    []uint
+	}{
+		{"", []uint{}},
+		{"- release on Friday [#25]\n- Bob owns the docs [#10][#11]", []uint{10, 11, 25}},
+		{"- repeated [#11] and again [#11]", []uint{11}},
+		{"- invented [#12], out of range [#99999999999]", []uint{}},
+		{"- not citations: #10, [10], [# 10], [#abc]", []uint{}},
+		{"- mixed [#25] [#3] [#10]", []uint{10, 25}},
+	} {
+		if got := jarvisCitedMessageIDs(tc.summary, lines); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %v, want %v", tc.summary, got, tc.want)
+		}
+	}
+}
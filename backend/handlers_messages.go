@@ -1,6 +1,7 @@
 package main
 
 import (
+        "errors"
         "net/http"
         "strconv"
         "time"
@@ -38,18 +39,6 @@ func createMessageHandler(c *gin.Context) {
     return
   }
 
-  if req.Content != "" {
-    filterResult := checkContentFilter(req.Content, senderID, "direct_message")
-    if filterResult.IsForbidden {
-      c.JSON(http.StatusForbidden, gin.H{
-        "error":         "Message contains forbidden content",
-        "matched_words": filterResult.MatchedWords,
-        "blocked":       true,
-      })
-      return
-    }
-  }
-
   message := DirectMessage{
     SenderID:        senderID,
     ReceiverID:      uint(receiverID),
@@ -58,47 +47,23 @@ func createMessageHandler(c *gin.Context) {
     ForwardedFromID: req.ForwardedFromID,
     VoiceURL:        req.VoiceURL,
     VoiceDuration:   req.VoiceDuration,
-    CreatedAt:       time.Now(),
-    UpdatedAt:       time.Now(),
   }
 
-  if err := db.Create(&message).Error; err != nil {
+  if err := createDirectMessage(db, &message); err != nil {
+    var forbidden *forbiddenContentError
+    if errors.As(err, &forbidden) {
+      c.JSON(http.StatusForbidden, gin.H{
+        "error":         "Message contains forbidden content",
+        "matched_words": forbidden.MatchedWords,
+        "blocked":       true,
+      })
+      return
+    }
     c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create message"})
     return
   }
 
-  // Get sender info for WebSocket notification
-  var sender User
-  db.First(&sender, senderID)
-
-  // Send real-time notification via WebSocket - include both camelCase and snake_case for compatibility
-  senderIDStr := strconv.FormatUint(uint64(senderID), 10)
-  wsMessage := map[string]interface{}{
-    "type":         "direct_message",
-    "id":           message.ID,
-    "content":      message.Content,
-    "fromUserId":   senderIDStr,
-    "from_user_id": senderIDStr,
-    "toUserId":     req.ToUserID,
-    "to_user_id":   req.ToUserID,
-    "createdAt":    message.CreatedAt.Format(time.RFC3339),
-    "created_at":   message.CreatedAt.Format(time.RFC3339),
-    "username":     sender.Username,
-    "sender_id":    senderID,
-  }
-  if sender.Avatar != nil && *sender.Avatar != "" {
-    wsMessage["avatar"] = *sender.Avatar
-  }
-  if message.VoiceURL != nil && *message.VoiceURL != "" {
-    wsMessage["voice_url"] = *message.VoiceURL
-    wsMessage["voice_duration"] = message.VoiceDuration
-  }
-  if message.ReplyToID != nil {
-    wsMessage["reply_to_id"] = *message.ReplyToID
-  }
-  hub.sendToUser(req.ToUserID, wsMessage)
-
-  go createNotificationHandler(uint(receiverID), "new_message", "New message from user")
+  publishDirectMessage(&message)
 
   c.JSON(http.StatusCreated, message)
 }
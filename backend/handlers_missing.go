@@ -1,9 +1,12 @@
 package main
 
 import (
+        "errors"
+        "fmt"
         "log"
         "net/http"
         "os"
+        "slices"
         "strconv"
         "strings"
         "time"
@@ -24,6 +27,7 @@ func getMessagesByChannelHandler(c *gin.Context) {
 func createChannelMessageHandler(c *gin.Context) {
         channelID, _ := strconv.ParseUint(c.Param("channel_id"), 10, 32)
         userID, _ := c.Get("user_id")
+        uid := uint(userID.(float64))
 
         var req struct {
                 Content string `json:"content" binding:"required"`
@@ -33,12 +37,35 @@ func createChannelMessageHandler(c *gin.Context) {
                 return
         }
 
-        msg := Message{
-                ChannelID: uint(channelID),
-                AuthorID:  uint(userID.(float64)),
-                Content:   req.Content,
+        var channel Channel
+        if err := db.First(&channel, channelID).Error; err != nil {
+                c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
+                return
+        }
+        if !hasChannelAccess(uid, channel) {
+                c.JSON(http.StatusForbidden, gin.H{"error": "No access to this channel"})
+                return
+        }
+
+        msg, err := createChannelMessage(db, uid, channel, req.Content, nil)
+        if err != nil {
+                var forbidden *forbiddenContentError
+                if errors.As(err, &forbidden) {
+                        c.JSON(http.StatusForbidden, gin.H{
+                                "error":         "Message contains forbidden content",
+                                "matched_words": forbidden.MatchedWords,
+                                "blocked":       true,
+                        })
+                        return
+                }
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create message"})
+                return
+        }
+
+        publishChannelMessage(channel, msg)
+        if jarvisMentioned(msg.Content) {
+                go answerJarvisMention(uid, channel, *msg)
         }
-        db.Create(&msg)
         c.JSON(http.StatusCreated, msg)
 }
 
@@ -253,7 +280,7 @@ func getVideoHandler(c *gin.Context) {
                                         // Check if user has premium subscription
                                         var sub PremiumSubscription
                                         if err := db.Preload("Plan").Where("user_id = ? AND status IN ?", 
-                                                user.ID, []string{"active", "trialing"}).First(&sub).Error; err == nil {
+                                                user.ID, []string{"active", "trialing", "past_due"}).First(&sub).Error; err == nil {
                                                 // Pro and Premium plans get 1080p
                                                 if sub.Plan.Slug == "pro" || sub.Plan.Slug == "premium" || sub.Plan.Slug == "vip" {
                                                         maxQuality = "1080p"
@@ -663,6 +690,36 @@ func createDonationHandler(c *gin.Context) {
                 return
         }
         
+        // Donations settle to rubles through YooKassa only
+        if provider := paymentProviderByName("yookassa"); provider != nil {
+                returnURL := os.Getenv("APP_URL")
+                if returnURL == "" {
+                        returnURL = "https://nemaks.com"
+                }
+                
+                payment, err := provider.CreatePayment(c.Request.Context(), &paymentRequest{
+                        DonationID:  donation.ID,
+                        Amount:      rubToKopecks(donation.AmountRub),
+                        Currency:    "RUB",
+                        Description: "Донат автору",
+                        ReturnURL:   returnURL + "/users/" + toUserIDParam,
+                })
+                if err != nil {
+                        log.Printf("[Billing] Donation payment failed for donation %d: %v", donation.ID, err)
+                        c.JSON(http.StatusBadGateway, gin.H{"error": "failed to create payment"})
+                        return
+                }
+                
+                db.Model(&donation).Update("payment_id", payment.ID)
+                
+                c.JSON(http.StatusCreated, gin.H{
+                        "id":               donation.ID,
+                        "status":           "pending",
+                        "confirmation_url": payment.ConfirmationURL,
+                })
+                return
+        }
+        
         c.JSON(http.StatusCreated, gin.H{
                 "id":      donation.ID,
                 "status":  "pending",
@@ -703,10 +760,15 @@ func getPremiumSubscriptionHandler(c *gin.Context) {
         uid := uint(userID.(float64))
         
         var sub PremiumSubscription
-        if err := db.Preload("Plan").Where("user_id = ? AND status IN ?", uid, []string{"active", "cancelled"}).Order("current_period_end DESC").First(&sub).Error; err != nil {
+        if err := db.Preload("Plan").Where("user_id = ? AND status IN ?", uid, []string{"active", "cancelled", "past_due", "grace"}).Order("current_period_end DESC").First(&sub).Error; err != nil {
                 c.JSON(http.StatusOK, gin.H{})
                 return
         }
+
+        access := dunningAccess(sub.Status)
+        if sub.Status == "cancelled" && sub.CurrentPeriodEnd.After(time.Now()) {
+                access = "full"
+        }
         
         c.JSON(http.StatusOK, gin.H{
                 "id":                   sub.ID,
@@ -717,6 +779,9 @@ func getPremiumSubscriptionHandler(c *gin.Context) {
                 "current_period_end":   sub.CurrentPeriodEnd,
                 "auto_renew":           sub.AutoRenew,
                 "cancel_at_period_end": sub.CancelAtPeriodEnd,
+                "access":               access,
+                "next_retry_at":        sub.NextRetryAt,
+                "grace_until":          sub.GraceUntil,
         })
 }
 
@@ -727,6 +792,7 @@ func checkoutPremiumHandler(c *gin.Context) {
         var req struct {
                 PlanID    int    `json:"plan_id" binding:"required"`
                 PromoCode string `json:"promo_code"`
+                Currency  string `json:"currency"`
         }
         if err := c.BindJSON(&req); err != nil {
                 c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -745,20 +811,39 @@ func checkoutPremiumHandler(c *gin.Context) {
                 return
         }
         
-        finalAmount := plan.PriceRub
+        // Prices outside Russia are in the region's currency when the plan
+        // has one, through the provider that takes it
+        region := paymentRegion(c, uid)
+        currency, price, err := checkoutCurrency(&plan, req.Currency, region)
+        if err != nil {
+                c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+                return
+        }
+        provider := selectPaymentProvider(region, currency)
+        providerName := "yookassa"
+        if provider != nil {
+                providerName = provider.Name()
+        }
+        
+        finalAmount := float64(price) / 100
         var discountRub float64
         var promoCodeID *uint
+        var promo *PromoCode
+        cycleMonths := orgInvoiceMonths(plan.BillingCycle)
         
         if req.PromoCode != "" {
-                discount, promo, _ := applyPromoCode(req.PromoCode, uint(req.PlanID), uid)
-                if promo != nil {
-                        discountRub = discount
-                        finalAmount = plan.PriceRub - discount
-                        promoCodeID = &promo.ID
-                        if finalAmount < 0 {
-                                finalAmount = 0
-                        }
+                var discount int64
+                promo, discount, err = applyPromoCode(req.PromoCode, promoPurchase{
+                        Product: "premium", UserID: uid, PremiumPlanID: plan.ID,
+                        AmountKopecks: price, Currency: currency, Months: cycleMonths,
+                })
+                if err != nil {
+                        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+                        return
                 }
+                discountRub = float64(discount) / 100
+                finalAmount = float64(price-discount) / 100
+                promoCodeID = &promo.ID
         }
         
         transaction := PremiumTransaction{
@@ -767,19 +852,36 @@ func checkoutPremiumHandler(c *gin.Context) {
                 AmountRub:       finalAmount,
                 DiscountRub:     discountRub,
                 PromoCodeID:     promoCodeID,
+                Currency:        currency,
                 Status:          "pending",
-                PaymentProvider: "yookassa",
+                PaymentProvider: providerName,
                 Description:     "Premium subscription: " + plan.Name,
         }
         db.Create(&transaction)
         
+        if promo != nil {
+                err := redeemPromoCode(db, promo, &PromoCodeUsage{
+                        UserID:        uid,
+                        TransactionID: transaction.ID,
+                        Product:       "premium",
+                        DiscountRub:   discountRub,
+                        AmountRub:     finalAmount,
+                        Currency:      currency,
+                })
+                if err != nil {
+                        db.Model(&transaction).Update("status", "failed")
+                        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+                        return
+                }
+        }
+        
         if finalAmount == 0 && promoCodeID != nil {
                 now := time.Now()
-                periodEnd := now.AddDate(0, 1, 0)
-                if plan.BillingCycle == "quarterly" {
-                        periodEnd = now.AddDate(0, 3, 0)
-                } else if plan.BillingCycle == "annual" {
-                        periodEnd = now.AddDate(1, 0, 0)
+                // Free months longer than the billing cycle stretch the
+                // first period
+                periodEnd := now.AddDate(0, cycleMonths, 0)
+                if promo.DiscountType == "free_months" && int(promo.DiscountValue) > cycleMonths {
+                        periodEnd = now.AddDate(0, int(promo.DiscountValue), 0)
                 }
                 
                 db.Model(&transaction).Updates(map[string]interface{}{
@@ -787,25 +889,33 @@ func checkoutPremiumHandler(c *gin.Context) {
                         "completed_at": now,
                 })
                 
-                sub := PremiumSubscription{
-                        UserID:             uid,
-                        PlanID:             uint(req.PlanID),
-                        Status:             "active",
-                        CurrentPeriodStart: now,
-                        CurrentPeriodEnd:   periodEnd,
-                        AutoRenew:          true,
+                // A user has one subscription row, which dunning may have
+                // left expired or in grace
+                var sub PremiumSubscription
+                if db.Where("user_id = ?", uid).First(&sub).RowsAffected > 0 {
+                        db.Model(&sub).Updates(withDunningCleared(map[string]interface{}{
+                                "plan_id":              uint(req.PlanID),
+                                "current_period_start": now,
+                                "current_period_end":   periodEnd,
+                                "auto_renew":           true,
+                                "cancel_at_period_end": false,
+                                "cancelled_at":         nil,
+                                "currency":             currency,
+                        }))
+                } else {
+                        sub = PremiumSubscription{
+                                UserID:             uid,
+                                PlanID:             uint(req.PlanID),
+                                Status:             "active",
+                                CurrentPeriodStart: now,
+                                CurrentPeriodEnd:   periodEnd,
+                                AutoRenew:          true,
+                                Currency:           currency,
+                        }
+                        db.Create(&sub)
                 }
-                db.Create(&sub)
                 db.Model(&transaction).Update("subscription_id", sub.ID)
                 
-                db.Model(&PromoCode{}).Where("id = ?", *promoCodeID).Update("used_count", gorm.Expr("used_count + 1"))
-                db.Create(&PromoCodeUsage{
-                        PromoCodeID:   *promoCodeID,
-                        UserID:        uid,
-                        TransactionID: transaction.ID,
-                        DiscountRub:   discountRub,
-                })
-                
                 c.JSON(http.StatusOK, gin.H{
                         "payment_id": transaction.ID,
                         "status":     "free_with_promo",
@@ -814,11 +924,12 @@ func checkoutPremiumHandler(c *gin.Context) {
                 return
         }
         
-        if yookassaService == nil {
+        if provider == nil {
+                releasePromoCode(transaction.ID)
                 c.JSON(http.StatusOK, gin.H{
                         "payment_id":       transaction.ID,
                         "confirmation_url": "",
-                        "message":          "YooKassa not configured. Please contact admin.",
+                        "message":          "No payment provider for " + currency + ". Please contact admin.",
                 })
                 return
         }
@@ -828,41 +939,35 @@ func checkoutPremiumHandler(c *gin.Context) {
                 returnURL = "https://nemaks.com"
         }
         
-        payment, err := yookassaService.CreatePayment(
-                transaction.ID,
-                finalAmount,
-                "Подписка "+plan.Name,
-                returnURL+"/premium?status=success",
-                true,
-        )
+        payment, err := provider.CreatePayment(c.Request.Context(), &paymentRequest{
+                TransactionID: transaction.ID,
+                Amount:        rubToKopecks(finalAmount),
+                Currency:      currency,
+                Description:   "Подписка " + plan.Name,
+                ReturnURL:     returnURL + "/premium?status=success",
+                SaveMethod:    true,
+        })
         if err != nil {
-                log.Printf("[Billing] YooKassa payment error: %v", err)
+                log.Printf("[Billing] %s payment error: %v", provider.Name(), err)
                 db.Model(&transaction).Update("status", "failed")
+                releasePromoCode(transaction.ID)
                 c.JSON(http.StatusInternalServerError, gin.H{"error": "Payment creation failed"})
                 return
         }
         
         db.Model(&transaction).Updates(map[string]interface{}{
                 "provider_payment_id": payment.ID,
-                "confirmation_url":    payment.Confirmation.ConfirmationURL,
+                "confirmation_url":    payment.ConfirmationURL,
         })
         
-        if promoCodeID != nil {
-                db.Model(&PromoCode{}).Where("id = ?", *promoCodeID).Update("used_count", gorm.Expr("used_count + 1"))
-                db.Create(&PromoCodeUsage{
-                        PromoCodeID:   *promoCodeID,
-                        UserID:        uid,
-                        TransactionID: transaction.ID,
-                        DiscountRub:   discountRub,
-                })
-        }
-        
         c.JSON(http.StatusOK, gin.H{
                 "payment_id":       transaction.ID,
-                "confirmation_url": payment.Confirmation.ConfirmationURL,
-                "original_price":   plan.PriceRub,
+                "confirmation_url": payment.ConfirmationURL,
+                "original_price":   float64(price) / 100,
                 "discount":         discountRub,
                 "final_price":      finalAmount,
+                "currency":         currency,
+                "provider":         provider.Name(),
         })
 }
 
@@ -884,7 +989,9 @@ func cancelPremiumHandler(c *gin.Context) {
                 "auto_renew":           false,
         })
         
-        go SendSubscriptionCancelled(uid, sub.CurrentPeriodEnd)
+        var plan PremiumPlan
+        db.First(&plan, sub.PlanID)
+        go notifyBilling(uid, "subscription_cancelled", map[string]interface{}{"Plan": plan.Name, "Date": sub.CurrentPeriodEnd}, "")
         
         c.JSON(http.StatusOK, gin.H{"status": "cancelled", "ends_at": sub.CurrentPeriodEnd})
 }
@@ -912,111 +1019,6 @@ func getPremiumTransactionsHandler(c *gin.Context) {
         c.JSON(http.StatusOK, result)
 }
 
-func yookassaWebhookHandler(c *gin.Context) {
-        var payload struct {
-                Type   string `json:"type"`
-                Event  string `json:"event"`
-                Object struct {
-                        ID       string `json:"id"`
-                        Status   string `json:"status"`
-                        Metadata struct {
-                                TransactionID string `json:"transaction_id"`
-                        } `json:"metadata"`
-                        PaymentMethod struct {
-                                Type  string `json:"type"`
-                                ID    string `json:"id"`
-                                Saved bool   `json:"saved"`
-                        } `json:"payment_method"`
-                } `json:"object"`
-        }
-        
-        if err := c.BindJSON(&payload); err != nil {
-                c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload"})
-                return
-        }
-        
-        if payload.Object.Status == "succeeded" {
-                transactionID, err := strconv.ParseUint(payload.Object.Metadata.TransactionID, 10, 32)
-                if err != nil {
-                        log.Printf("Invalid transaction ID in webhook: %s", payload.Object.Metadata.TransactionID)
-                        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid transaction ID"})
-                        return
-                }
-                
-                var transaction PremiumTransaction
-                if db.First(&transaction, transactionID).RowsAffected == 0 {
-                        log.Printf("Transaction not found: %d", transactionID)
-                        c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
-                        return
-                }
-                
-                if transaction.Status == "succeeded" {
-                        c.JSON(http.StatusOK, gin.H{"status": "already_processed"})
-                        return
-                }
-                
-                now := time.Now()
-                transaction.Status = "succeeded"
-                transaction.CompletedAt = &now
-                transaction.ProviderPaymentID = payload.Object.ID
-                db.Save(&transaction)
-                
-                var plan PremiumPlan
-                db.First(&plan, transaction.PlanID)
-                
-                periodEnd := now.AddDate(0, 1, 0)
-                if plan.BillingCycle == "quarterly" {
-                        periodEnd = now.AddDate(0, 3, 0)
-                } else if plan.BillingCycle == "annual" {
-                        periodEnd = now.AddDate(1, 0, 0)
-                }
-                
-                paymentMethodID := ""
-                if payload.Object.PaymentMethod.Saved && payload.Object.PaymentMethod.ID != "" {
-                        paymentMethodID = payload.Object.PaymentMethod.ID
-                        log.Printf("[Billing] Saved payment method %s for user %d", paymentMethodID, transaction.UserID)
-                }
-                
-                var existingSub PremiumSubscription
-                if db.Where("user_id = ?", transaction.UserID).First(&existingSub).RowsAffected > 0 {
-                        updates := map[string]interface{}{
-                                "plan_id":              transaction.PlanID,
-                                "status":               "active",
-                                "current_period_start": now,
-                                "current_period_end":   periodEnd,
-                                "auto_renew":           true,
-                                "cancel_at_period_end": false,
-                                "cancelled_at":         nil,
-                        }
-                        if paymentMethodID != "" {
-                                updates["payment_method_id"] = paymentMethodID
-                        }
-                        db.Model(&existingSub).Updates(updates)
-                        db.Model(&transaction).Update("subscription_id", existingSub.ID)
-                } else {
-                        sub := PremiumSubscription{
-                                UserID:             transaction.UserID,
-                                PlanID:             transaction.PlanID,
-                                Status:             "active",
-                                CurrentPeriodStart: now,
-                                CurrentPeriodEnd:   periodEnd,
-                                AutoRenew:          true,
-                                PaymentMethodID:    paymentMethodID,
-                        }
-                        db.Create(&sub)
-                        db.Model(&transaction).Update("subscription_id", sub.ID)
-                }
-                
-                go SendPaymentConfirmation(transaction.UserID, plan.Name, plan.PriceRub)
-                go grantReferralBonus(transaction.UserID, 7, "premium_subscription")
-                go activateBoostFromWebhook(transaction.ID)
-                
-                log.Printf("Premium subscription activated for user %d, plan %d", transaction.UserID, transaction.PlanID)
-        }
-        
-        c.JSON(http.StatusOK, gin.H{"status": "ok"})
-}
-
 // Seed premium plans
 func seedPremiumPlans() {
         plans := []PremiumPlan{
@@ -1128,17 +1130,22 @@ func getAdminBillingStatsHandler(c *gin.Context) {
         var activeSubscriptions int64
         db.Model(&PremiumSubscription{}).Where("status = ?", "active").Count(&activeSubscriptions)
         
-        var monthlyRevenue float64
-        db.Model(&PremiumTransaction{}).
-                Select("COALESCE(SUM(amount_rub), 0)").
-                Where("status = ? AND created_at >= ?", "succeeded", startOfMonth).
-                Scan(&monthlyRevenue)
-        
-        var totalRevenue float64
-        db.Model(&PremiumTransaction{}).
-                Select("COALESCE(SUM(amount_rub), 0)").
-                Where("status = ?", "succeeded").
-                Scan(&totalRevenue)
+        // Revenue comes from the ledger, net of refunds. Each currency is
+        // reported on its own; monthly_revenue and total_revenue stay in rubles
+        monthly, total := ledgerNetRevenue(startOfMonth), ledgerNetRevenue(time.Time{})
+        currencies := make([]string, 0, len(total))
+        for currency := range total {
+                currencies = append(currencies, currency)
+        }
+        slices.Sort(currencies)
+        revenue := make([]gin.H, len(currencies))
+        for i, currency := range currencies {
+                revenue[i] = gin.H{
+                        "currency":        currency,
+                        "monthly_revenue": float64(monthly[currency]) / 100,
+                        "total_revenue":   float64(total[currency]) / 100,
+                }
+        }
         
         var newSubscriptions int64
         db.Model(&PremiumSubscription{}).Where("created_at >= ?", startOfMonth).Count(&newSubscriptions)
@@ -1164,7 +1171,8 @@ func getAdminBillingStatsHandler(c *gin.Context) {
                         "id":           tx.ID,
                         "user_id":      tx.UserID,
                         "username":     username,
-                        "amount_rub":   tx.AmountRub,
+                        "amount":       tx.AmountRub,
+                        "currency":     ledgerCurrency(tx.Currency),
                         "status":       tx.Status,
                         "created_at":   tx.CreatedAt,
                         "completed_at": tx.CompletedAt,
@@ -1173,8 +1181,9 @@ func getAdminBillingStatsHandler(c *gin.Context) {
         
         c.JSON(http.StatusOK, gin.H{
                 "active_subscriptions":    activeSubscriptions,
-                "monthly_revenue":         monthlyRevenue,
-                "total_revenue":           totalRevenue,
+                "monthly_revenue":         float64(monthly["RUB"]) / 100,
+                "total_revenue":           float64(total["RUB"]) / 100,
+                "revenue_by_currency":     revenue,
                 "new_subscriptions":       newSubscriptions,
                 "cancelled_subscriptions": cancelledSubscriptions,
                 "churn_rate":              churnRate,
@@ -1183,92 +1192,75 @@ func getAdminBillingStatsHandler(c *gin.Context) {
 }
 
 // Promo Code Handlers
+// validatePromoCodeHandler checks a code before checkout. With the plan (or
+// boost) it also prices the discount.
 func validatePromoCodeHandler(c *gin.Context) {
         code := c.Query("code")
-        planIDStr := c.Query("plan_id")
-        
         if code == "" {
                 c.JSON(http.StatusBadRequest, gin.H{"error": "Promo code required"})
                 return
         }
         
-        var promo PromoCode
-        if db.Where("code = ? AND is_active = ?", code, true).First(&promo).RowsAffected == 0 {
-                c.JSON(http.StatusNotFound, gin.H{"error": "Invalid promo code"})
+        promo, err := findPromoCode(code)
+        if err != nil {
+                status := http.StatusBadRequest
+                if errors.Is(err, errPromoNotFound) {
+                        status = http.StatusNotFound
+                }
+                c.JSON(status, gin.H{"error": err.Error()})
                 return
         }
         
-        now := time.Now()
-        if now.Before(promo.ValidFrom) || now.After(promo.ValidUntil) {
-                c.JSON(http.StatusBadRequest, gin.H{"error": "Promo code expired"})
+        pp := promoPurchase{Product: c.DefaultQuery("product", "premium")}
+        switch pp.Product {
+        case "premium", "gift":
+                var plan PremiumPlan
+                if db.First(&plan, c.Query("plan_id")).RowsAffected > 0 {
+                        pp.PremiumPlanID = plan.ID
+                        pp.AmountKopecks = rubToKopecks(plan.PriceRub)
+                        pp.Months = orgInvoiceMonths(plan.BillingCycle)
+                }
+        case "org_plan":
+                var plan SubscriptionPlan
+                if db.Where("slug = ? AND is_active = true", c.Query("plan_slug")).First(&plan).RowsAffected > 0 {
+                        pp.OrgPlanSlug = plan.Slug
+                        pp.Months = orgInvoiceMonths(c.Query("billing_period"))
+                        pp.AmountKopecks = rubToKopecks(plan.BasePriceRub) * int64(pp.Months)
+                }
+        case "boost":
+                hours, _ := strconv.Atoi(c.Query("duration_hours"))
+                if price, ok := boostPrices[c.Query("boost_type")][hours]; ok {
+                        pp.AmountKopecks = rubToKopecks(price)
+                }
+        default:
+                c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown product"})
                 return
         }
         
-        if promo.MaxUses > 0 && promo.UsedCount >= promo.MaxUses {
-                c.JSON(http.StatusBadRequest, gin.H{"error": "Promo code usage limit reached"})
-                return
+        resp := gin.H{
+                "valid":               true,
+                "discount_type":       promo.DiscountType,
+                "discount_value":      promo.DiscountValue,
+                "description":         promo.Description,
+                "products":            promo.productList(),
+                "first_purchase_only": promo.FirstPurchaseOnly,
         }
-        
-        var plan PremiumPlan
-        if planIDStr != "" {
-                planID, _ := strconv.ParseUint(planIDStr, 10, 32)
-                if db.First(&plan, planID).RowsAffected > 0 {
-                        if plan.PriceRub < promo.MinPurchase {
-                                c.JSON(http.StatusBadRequest, gin.H{"error": "Minimum purchase not met"})
-                                return
-                        }
+        if pp.AmountKopecks == 0 {
+                if !promo.appliesTo(pp) {
+                        c.JSON(http.StatusBadRequest, gin.H{"error": errPromoNotApplicable.Error()})
+                        return
                 }
+                c.JSON(http.StatusOK, resp)
+                return
         }
-        
-        c.JSON(http.StatusOK, gin.H{
-                "valid":          true,
-                "discount_type":  promo.DiscountType,
-                "discount_value": promo.DiscountValue,
-                "description":    promo.Description,
-        })
-}
-
-func applyPromoCode(code string, planID uint, userID uint) (float64, *PromoCode, error) {
-        var promo PromoCode
-        if db.Where("code = ? AND is_active = ?", code, true).First(&promo).RowsAffected == 0 {
-                return 0, nil, nil
-        }
-        
-        now := time.Now()
-        if now.Before(promo.ValidFrom) || now.After(promo.ValidUntil) {
-                return 0, nil, nil
-        }
-        
-        if promo.MaxUses > 0 && promo.UsedCount >= promo.MaxUses {
-                return 0, nil, nil
-        }
-        
-        var existing PromoCodeUsage
-        if db.Where("promo_code_id = ? AND user_id = ?", promo.ID, userID).First(&existing).RowsAffected > 0 {
-                return 0, nil, nil
-        }
-        
-        var plan PremiumPlan
-        if db.First(&plan, planID).RowsAffected == 0 {
-                return 0, nil, nil
-        }
-        
-        if plan.PriceRub < promo.MinPurchase {
-                return 0, nil, nil
-        }
-        
-        var discount float64
-        if promo.DiscountType == "percent" {
-                discount = plan.PriceRub * (promo.DiscountValue / 100)
-        } else {
-                discount = promo.DiscountValue
-        }
-        
-        if discount > plan.PriceRub {
-                discount = plan.PriceRub
+        discount, err := checkPromoCode(promo, pp)
+        if err != nil {
+                c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+                return
         }
-        
-        return discount, &promo, nil
+        resp["discount_kopecks"] = discount
+        resp["final_kopecks"] = pp.AmountKopecks - discount
+        c.JSON(http.StatusOK, resp)
 }
 
 func createPromoCodeHandler(c *gin.Context) {
@@ -1291,12 +1283,38 @@ func createPromoCodeHandler(c *gin.Context) {
                 ValidFrom       string  `json:"valid_from"`
                 ValidUntil      string  `json:"valid_until"`
                 ApplicablePlans string  `json:"applicable_plans"`
+                OrgPlans        string  `json:"org_plans"`
+                Products        []string `json:"products"`
+                Campaign        string  `json:"campaign"`
+                FirstPurchaseOnly bool  `json:"first_purchase_only"`
+                MaxUsesPerUser  int     `json:"max_uses_per_user"`
+                ExcludesReferral bool   `json:"excludes_referral"`
         }
         if err := c.BindJSON(&req); err != nil {
                 c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
                 return
         }
         
+        if !slices.Contains(promoDiscountTypes, req.DiscountType) {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "discount_type must be one of " + strings.Join(promoDiscountTypes, ", ")})
+                return
+        }
+        if req.DiscountValue <= 0 || (req.DiscountType == "percent" && req.DiscountValue > 100) ||
+                (req.DiscountType == "free_months" && req.DiscountValue != float64(int(req.DiscountValue))) {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid discount_value"})
+                return
+        }
+        for _, product := range req.Products {
+                if !slices.Contains(promoProducts, product) {
+                        c.JSON(http.StatusBadRequest, gin.H{"error": "products must be among " + strings.Join(promoProducts, ", ")})
+                        return
+                }
+        }
+        if req.DiscountType == "free_months" && slices.Contains(req.Products, "boost") {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "Free months do not apply to boosts"})
+                return
+        }
+        
         validFrom := time.Now()
         validUntil := time.Now().AddDate(1, 0, 0)
         
@@ -1321,6 +1339,12 @@ func createPromoCodeHandler(c *gin.Context) {
                 ValidFrom:       validFrom,
                 ValidUntil:      validUntil,
                 ApplicablePlans: req.ApplicablePlans,
+                OrgPlans:        req.OrgPlans,
+                Products:        strings.Join(req.Products, ","),
+                Campaign:        req.Campaign,
+                FirstPurchaseOnly: req.FirstPurchaseOnly,
+                MaxUsesPerUser:  req.MaxUsesPerUser,
+                ExcludesReferral: req.ExcludesReferral,
                 IsActive:        true,
                 CreatedBy:       uid,
         }
@@ -1402,6 +1426,7 @@ func startTrialHandler(c *gin.Context) {
                 AutoRenew:          false,
         }
         db.Create(&sub)
+        go notifyBilling(uid, "trial_started", map[string]interface{}{"Plan": plan.Name, "Date": trialEnd}, "")
         
         c.JSON(http.StatusCreated, gin.H{
                 "message":   "Trial started",
@@ -1420,6 +1445,7 @@ func purchaseGiftHandler(c *gin.Context) {
                 DurationDays int    `json:"duration_days"`
                 Message      string `json:"message"`
                 RecipientID  *uint  `json:"recipient_id"`
+                PromoCode    string `json:"promo_code"`
         }
         if err := c.BindJSON(&req); err != nil {
                 c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -1442,6 +1468,22 @@ func purchaseGiftHandler(c *gin.Context) {
                 }
         }
         
+        amountRub := plan.PriceRub
+        var promo *PromoCode
+        var discount int64
+        if req.PromoCode != "" {
+                var err error
+                promo, discount, err = applyPromoCode(req.PromoCode, promoPurchase{
+                        Product: "gift", UserID: uid, PremiumPlanID: plan.ID,
+                        AmountKopecks: rubToKopecks(plan.PriceRub), Months: orgInvoiceMonths(plan.BillingCycle),
+                })
+                if err != nil {
+                        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+                        return
+                }
+                amountRub = float64(rubToKopecks(plan.PriceRub)-discount) / 100
+        }
+        
         giftCode := generateGiftCode()
         
         gift := GiftSubscription{
@@ -1458,46 +1500,85 @@ func purchaseGiftHandler(c *gin.Context) {
         transaction := PremiumTransaction{
                 UserID:          uid,
                 PlanID:          req.PlanID,
-                AmountRub:       plan.PriceRub,
+                AmountRub:       amountRub,
+                DiscountRub:     float64(discount) / 100,
                 Status:          "pending",
                 PaymentProvider: "yookassa",
                 Description:     "Gift: " + plan.Name,
         }
+        if promo != nil {
+                transaction.PromoCodeID = &promo.ID
+        }
         db.Create(&transaction)
         
         gift.TransactionID = &transaction.ID
         db.Create(&gift)
         
-        if yookassaService != nil {
+        if promo != nil {
+                err := redeemPromoCode(db, promo, &PromoCodeUsage{
+                        UserID:        uid,
+                        TransactionID: transaction.ID,
+                        Product:       "gift",
+                        DiscountRub:   transaction.DiscountRub,
+                        AmountRub:     amountRub,
+                })
+                if err != nil {
+                        db.Model(&transaction).Update("status", "failed")
+                        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+                        return
+                }
+                if amountRub == 0 {
+                        now := time.Now()
+                        db.Model(&transaction).Updates(map[string]interface{}{"status": "succeeded", "completed_at": now})
+                        if gift.ToUserID != nil {
+                                var from User
+                                db.Select("id", "username").First(&from, uid)
+                                go notifyBilling(*gift.ToUserID, "gift_received", map[string]interface{}{
+                                        "Plan": plan.Name, "Days": gift.DurationDays, "From": from.Username, "Code": gift.Code, "Message": gift.Message,
+                                }, fmt.Sprintf("gift_received:%d", gift.ID))
+                        }
+                        c.JSON(http.StatusOK, gin.H{
+                                "gift_code": giftCode,
+                                "status":    "free_with_promo",
+                        })
+                        return
+                }
+        }
+        
+        // Gifts and boosts are priced in rubles only
+        if provider := paymentProviderByName("yookassa"); provider != nil {
                 returnURL := os.Getenv("APP_URL")
                 if returnURL == "" {
                         returnURL = "https://nemaks.com"
                 }
                 
-                payment, err := yookassaService.CreatePayment(
-                        transaction.ID,
-                        plan.PriceRub,
-                        "Подарочная подписка "+plan.Name,
-                        returnURL+"/gifts?code="+giftCode,
-                        false,
-                )
+                payment, err := provider.CreatePayment(c.Request.Context(), &paymentRequest{
+                        TransactionID: transaction.ID,
+                        Amount:        rubToKopecks(amountRub),
+                        Currency:      "RUB",
+                        Description:   "Подарочная подписка " + plan.Name,
+                        ReturnURL:     returnURL + "/gifts?code=" + giftCode,
+                })
                 if err != nil {
+                        db.Model(&transaction).Update("status", "failed")
+                        releasePromoCode(transaction.ID)
                         c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
                         return
                 }
                 
                 db.Model(&transaction).Updates(map[string]interface{}{
                         "provider_payment_id": payment.ID,
-                        "confirmation_url":    payment.Confirmation.ConfirmationURL,
+                        "confirmation_url":    payment.ConfirmationURL,
                 })
                 
                 c.JSON(http.StatusOK, gin.H{
                         "gift_code":        giftCode,
-                        "confirmation_url": payment.Confirmation.ConfirmationURL,
+                        "confirmation_url": payment.ConfirmationURL,
                 })
                 return
         }
         
+        releasePromoCode(transaction.ID)
         c.JSON(http.StatusOK, gin.H{
                 "gift_code": giftCode,
                 "message":   "Payment system not configured",
@@ -1622,6 +1703,13 @@ func getBoostPricingHandler(c *gin.Context) {
         })
 }
 
+// boostPrices are boost prices in rubles by type and duration in hours.
+var boostPrices = map[string]map[int]float64{
+        "featured": {24: 99, 72: 249},
+        "trending": {24: 199, 72: 499},
+        "top":      {24: 399, 72: 999},
+}
+
 func createPostBoostHandler(c *gin.Context) {
         userID, _ := c.Get("user_id")
         uid := uint(userID.(float64))
@@ -1630,6 +1718,7 @@ func createPostBoostHandler(c *gin.Context) {
                 PostID        uint   `json:"post_id" binding:"required"`
                 BoostType     string `json:"boost_type" binding:"required"`
                 DurationHours int    `json:"duration_hours" binding:"required"`
+                PromoCode     string `json:"promo_code"`
         }
         if err := c.BindJSON(&req); err != nil {
                 c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -1653,31 +1742,43 @@ func createPostBoostHandler(c *gin.Context) {
                 return
         }
         
-        priceMap := map[string]map[int]float64{
-                "featured": {24: 99, 72: 249},
-                "trending": {24: 199, 72: 499},
-                "top":      {24: 399, 72: 999},
-        }
-        
-        price, ok := priceMap[req.BoostType][req.DurationHours]
+        price, ok := boostPrices[req.BoostType][req.DurationHours]
         if !ok {
                 c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid boost type or duration"})
                 return
         }
         
-        var sub PremiumSubscription
-        isPremium := db.Where("user_id = ? AND status = ?", uid, "active").First(&sub).RowsAffected > 0
-        if isPremium {
+        // The premium discount is not given during the read-only grace period
+        if premiumAccess(uid) == "full" {
                 price = price * 0.8
         }
         
+        // A promo code stacks on top of the premium discount
+        var promo *PromoCode
+        var discount int64
+        if req.PromoCode != "" {
+                var err error
+                promo, discount, err = applyPromoCode(req.PromoCode, promoPurchase{
+                        Product: "boost", UserID: uid, AmountKopecks: rubToKopecks(price),
+                })
+                if err != nil {
+                        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+                        return
+                }
+                price = float64(rubToKopecks(price)-discount) / 100
+        }
+        
         transaction := PremiumTransaction{
                 UserID:          uid,
                 AmountRub:       price,
+                DiscountRub:     float64(discount) / 100,
                 Status:          "pending",
                 PaymentProvider: "yookassa",
                 Description:     "Post boost: " + req.BoostType,
         }
+        if promo != nil {
+                transaction.PromoCodeID = &promo.ID
+        }
         db.Create(&transaction)
         
         boost := PostBoost{
@@ -1691,37 +1792,65 @@ func createPostBoostHandler(c *gin.Context) {
         }
         db.Create(&boost)
         
-        if yookassaService != nil {
+        if promo != nil {
+                err := redeemPromoCode(db, promo, &PromoCodeUsage{
+                        UserID:        uid,
+                        TransactionID: transaction.ID,
+                        Product:       "boost",
+                        DiscountRub:   transaction.DiscountRub,
+                        AmountRub:     price,
+                })
+                if err != nil {
+                        db.Model(&transaction).Update("status", "failed")
+                        db.Model(&boost).Update("status", "cancelled")
+                        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+                        return
+                }
+                if price == 0 {
+                        db.Model(&transaction).Updates(map[string]interface{}{"status": "succeeded", "completed_at": time.Now()})
+                        activateBoostFromWebhook(db, transaction.ID)
+                        c.JSON(http.StatusOK, gin.H{
+                                "boost_id": boost.ID,
+                                "status":   "free_with_promo",
+                        })
+                        return
+                }
+        }
+        
+        if provider := paymentProviderByName("yookassa"); provider != nil {
                 returnURL := os.Getenv("APP_URL")
                 if returnURL == "" {
                         returnURL = "https://nemaks.com"
                 }
                 
-                payment, err := yookassaService.CreatePayment(
-                        transaction.ID,
-                        price,
-                        "Буст публикации",
-                        returnURL+"/feed?boosted="+strconv.FormatUint(uint64(boost.ID), 10),
-                        false,
-                )
+                payment, err := provider.CreatePayment(c.Request.Context(), &paymentRequest{
+                        TransactionID: transaction.ID,
+                        Amount:        rubToKopecks(price),
+                        Currency:      "RUB",
+                        Description:   "Буст публикации",
+                        ReturnURL:     returnURL + "/feed?boosted=" + strconv.FormatUint(uint64(boost.ID), 10),
+                })
                 if err != nil {
+                        db.Model(&transaction).Update("status", "failed")
+                        releasePromoCode(transaction.ID)
                         c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
                         return
                 }
                 
                 db.Model(&transaction).Updates(map[string]interface{}{
                         "provider_payment_id": payment.ID,
-                        "confirmation_url":    payment.Confirmation.ConfirmationURL,
+                        "confirmation_url":    payment.ConfirmationURL,
                 })
                 
                 c.JSON(http.StatusOK, gin.H{
                         "boost_id":         boost.ID,
-                        "confirmation_url": payment.Confirmation.ConfirmationURL,
+                        "confirmation_url": payment.ConfirmationURL,
                         "price":            price,
                 })
                 return
         }
         
+        releasePromoCode(transaction.ID)
         c.JSON(http.StatusOK, gin.H{
                 "boost_id": boost.ID,
                 "message":  "Payment system not configured",
@@ -1766,21 +1895,24 @@ func getBoostedPostsHandler(c *gin.Context) {
         })
 }
 
-func activateBoostFromWebhook(transactionID uint) {
+func activateBoostFromWebhook(tx *gorm.DB, transactionID uint) error {
         var boost PostBoost
-        if db.Where("transaction_id = ? AND status = ?", transactionID, "pending").First(&boost).RowsAffected == 0 {
-                return
+        if tx.Where("transaction_id = ? AND status = ?", transactionID, "pending").First(&boost).RowsAffected == 0 {
+                return nil
         }
         
         now := time.Now()
         expiresAt := now.Add(time.Duration(boost.DurationHours) * time.Hour)
         
-        db.Model(&boost).Updates(map[string]interface{}{
+        if err := tx.Model(&boost).Updates(map[string]interface{}{
                 "status":     "active",
                 "started_at": now,
                 "expires_at": expiresAt,
-        })
+        }).Error; err != nil {
+                return err
+        }
         
         log.Printf("[Boost] Post %d boosted until %v", boost.PostID, expiresAt)
+        return nil
 }
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+        "encoding/json"
         "fmt"
         "net/http"
         "strconv"
@@ -244,13 +245,23 @@ func jarvisReviewCaseHandler(c *gin.Context) {
 
         logModerationAction(modCase.ID, "review_started", "jarvis", nil, "Jarvis начал рассмотрение", c.ClientIP())
 
-        verdictType, reason, confidence := analyzeContentWithJarvis(modCase)
+        var report AbuseReport
+        db.First(&report, modCase.ReportID)
+        result := classifyModerationCase(c.Request.Context(), report.Reason, modCase.ContentPreview)
+        verdictType, confidence := result.VerdictType(), result.Confidence
+        spansJSON, _ := json.Marshal(result.Spans)
 
         verdict := ModerationVerdict{
                 CaseID:          modCase.ID,
                 VerdictType:     verdictType,
-                Reason:          reason,
+                Reason:          result.Rationale,
                 ConfidenceScore: confidence,
+                Category:        result.Category,
+                Severity:        result.Severity,
+                QuotedSpansJSON: string(spansJSON),
+                Classifier:      result.Classifier,
+                PromptVersion:   result.PromptVersion,
+                ModelVersion:    result.ModelVersion,
                 IsAutomatic:     true,
         }
 
@@ -268,12 +279,18 @@ func jarvisReviewCaseHandler(c *gin.Context) {
         }
 
         now := time.Now()
-        modCase.Status = "resolved"
-        modCase.ResolvedAt = &now
+        if verdictType == "escalate" {
+                // Low confidence: hand the case over to a human moderator
+                modCase.Status = "escalated"
+                modCase.AssignedToAI = false
+        } else {
+                modCase.Status = "resolved"
+                modCase.ResolvedAt = &now
+        }
         db.Save(&modCase)
 
         logModerationAction(modCase.ID, "verdict_issued", "jarvis", nil,
-                fmt.Sprintf("Вердикт: %s (уверенность: %.2f)", verdictType, confidence), c.ClientIP())
+                fmt.Sprintf("Вердикт: %s (уверенность: %.2f, %s, %s %s)", verdictType, confidence, result.Classifier, result.PromptVersion, result.ModelVersion), c.ClientIP())
 
         if verdictType == "ban" || verdictType == "warn" {
                 applyModeratorPenalty(modCase.TargetUserID, verdictType, verdict.PenaltyDuration)
@@ -287,70 +304,6 @@ func jarvisReviewCaseHandler(c *gin.Context) {
         })
 }
 
-func analyzeContentWithJarvis(modCase ModerationCase) (verdictType string, reason string, confidence float64) {
-        var report AbuseReport
-        db.First(&report, modCase.ReportID)
-
-        severity := assessContentSeverity(report.Reason, modCase.ContentPreview)
-
-        switch {
-        case severity >= 0.8:
-                return "ban", "Серьёзное нарушение правил сообщества обнаружено автоматически", severity
-        case severity >= 0.5:
-                return "warn", "Незначительное нарушение правил сообщества", severity
-        case severity >= 0.3:
-                return "escalate", "Требуется ручная проверка администратором", severity
-        default:
-                return "dismiss", "Нарушений не обнаружено", 1.0 - severity
-        }
-}
-
-func assessContentSeverity(reason, content string) float64 {
-        severity := 0.2
-
-        var forbiddenWords []ForbiddenWord
-        db.Where("is_active = ?", true).Find(&forbiddenWords)
-
-        for _, fw := range forbiddenWords {
-                if containsModerationWord(content, fw.Word) {
-                        switch fw.Category {
-                        case "critical", "illegal":
-                                severity += 0.5
-                        case "offensive", "harassment":
-                                severity += 0.3
-                        case "spam":
-                                severity += 0.2
-                        default:
-                                severity += 0.15
-                        }
-                }
-        }
-
-        switch reason {
-        case "spam":
-                severity += 0.3
-        case "harassment":
-                severity += 0.5
-        case "hate_speech":
-                severity += 0.6
-        case "violence":
-                severity += 0.7
-        case "illegal":
-                severity += 0.8
-        }
-
-        if severity > 1.0 {
-                severity = 1.0
-        }
-
-        return severity
-}
-
-func containsModerationWord(content, word string) bool {
-        return len(content) > 0 && len(word) > 0 && 
-                (content == word || len(content) >= len(word))
-}
-
 func applyModeratorPenalty(userID uint, penaltyType string, duration *int) {
         if penaltyType == "ban" {
                 ban := Ban{
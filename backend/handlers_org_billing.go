@@ -2,17 +2,19 @@ package main
 
 import (
         "encoding/json"
+        "errors"
         "fmt"
-        "math"
+        "log"
         "net/http"
         "time"
 
         "github.com/gin-gonic/gin"
+        "gorm.io/gorm"
 )
 
 func setupOrgBillingRoutes(r *gin.Engine, auth gin.HandlerFunc) {
         org := r.Group("/api/org")
-        org.Use(auth)
+        org.Use(auth, orgReadOnlyGuard())
         {
                 org.POST("", createOrgHandler)
                 org.GET("", listUserOrgsHandler)
@@ -28,9 +30,16 @@ func setupOrgBillingRoutes(r *gin.Engine, auth gin.HandlerFunc) {
                 org.GET("/:id/subscription", getOrgSubscriptionHandler)
                 org.POST("/:id/subscribe", subscribeOrgHandler)
                 org.PUT("/:id/subscription", updateOrgSubscriptionHandler)
+                org.POST("/:id/subscription/preview", previewOrgSubscriptionChangeHandler)
+                org.GET("/:id/subscription/changes", getOrgSubscriptionChangesHandler)
+                org.DELETE("/:id/subscription/changes/:changeId", cancelOrgSubscriptionChangeHandler)
                 org.POST("/:id/subscription/cancel", cancelOrgSubscriptionHandler)
 
                 org.GET("/:id/billing", getOrgBillingHandler)
+                org.GET("/:id/invoices", getOrgInvoicesHandler)
+                org.POST("/:id/invoices", createOrgInvoiceHandler)
+                org.GET("/:id/invoices/:invoiceId/pdf", getOrgInvoicePDFHandler)
+                org.GET("/:id/usage", getOrgUsageHandler)
                 org.GET("/:id/entitlements", getOrgEntitlementsHandler)
         }
 
@@ -211,6 +220,7 @@ func addOrgMemberHandler(c *gin.Context) {
                 c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add member"})
                 return
         }
+        go checkOrgSeatLimit(member.OrgID, member.SeatType)
 
         c.JSON(http.StatusCreated, member)
 }
@@ -244,6 +254,9 @@ func updateOrgMemberHandler(c *gin.Context) {
         member.UpdatedAt = time.Now()
 
         db.Save(&member)
+        if member.State == "active" {
+                go checkOrgSeatLimit(member.OrgID, member.SeatType)
+        }
         c.JSON(http.StatusOK, member)
 }
 
@@ -263,7 +276,7 @@ func removeOrgMemberHandler(c *gin.Context) {
 
 func getOrgSubscriptionHandler(c *gin.Context) {
         var sub OrgSubscription
-        if err := db.Where("org_id = ? AND status = 'active'", c.Param("id")).First(&sub).Error; err != nil {
+        if err := db.Where("org_id = ? AND status IN ?", c.Param("id"), orgServingStatuses).First(&sub).Error; err != nil {
                 c.JSON(http.StatusNotFound, gin.H{"error": "No active subscription"})
                 return
         }
@@ -271,12 +284,14 @@ func getOrgSubscriptionHandler(c *gin.Context) {
 }
 
 func subscribeOrgHandler(c *gin.Context) {
+        uid, _ := getUserIDFromContext(c)
         orgID := parseInt(c.Param("id"))
 
         var req struct {
                 PlanSlug      string `json:"plan_slug" binding:"required"`
                 BillingPeriod string `json:"billing_period"`
                 PaymentMethod string `json:"payment_method"`
+                PromoCode     string `json:"promo_code"`
         }
         if err := c.ShouldBindJSON(&req); err != nil {
                 c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -304,6 +319,21 @@ func subscribeOrgHandler(c *gin.Context) {
                 endsAt = time.Now().AddDate(0, 1, 0)
         }
 
+        // The code is redeemed now and discounts the org's next invoice
+        var promo *PromoCode
+        if req.PromoCode != "" {
+                months := orgInvoiceMonths(billingPeriod)
+                var err error
+                promo, _, err = applyPromoCode(req.PromoCode, promoPurchase{
+                        Product: "org_plan", UserID: uid, OrgID: orgID, OrgPlanSlug: plan.Slug,
+                        AmountKopecks: rubToKopecks(plan.BasePriceRub) * int64(months), Months: months,
+                })
+                if err != nil {
+                        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+                        return
+                }
+        }
+
         db.Model(&OrgSubscription{}).Where("org_id = ? AND status = 'active'", orgID).
                 Update("status", "cancelled")
 
@@ -320,7 +350,20 @@ func subscribeOrgHandler(c *gin.Context) {
                 UpdatedAt:     time.Now(),
         }
 
-        if err := db.Create(&sub).Error; err != nil {
+        err := db.Transaction(func(tx *gorm.DB) error {
+                if err := tx.Create(&sub).Error; err != nil {
+                        return err
+                }
+                if promo == nil {
+                        return nil
+                }
+                return redeemPromoCode(tx, promo, &PromoCodeUsage{UserID: uid, OrgID: &orgID, Product: "org_plan"})
+        })
+        if errors.Is(err, errPromoExhausted) {
+                c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+                return
+        }
+        if err != nil {
                 c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create subscription"})
                 return
         }
@@ -330,41 +373,72 @@ func subscribeOrgHandler(c *gin.Context) {
         c.JSON(http.StatusCreated, sub)
 }
 
+// updateOrgSubscriptionHandler changes auto-renewal, plan and seats. Plan
+// and seat changes are priced by previewOrgSubscriptionChange: increases
+// apply now with a prorated invoice, decreases wait for the period end.
 func updateOrgSubscriptionHandler(c *gin.Context) {
+        uid, _ := getUserIDFromContext(c)
+        orgID := parseInt(c.Param("id"))
+        if !canManageOrgBilling(uid, orgID) {
+                c.JSON(http.StatusForbidden, gin.H{"error": "Org admin access required"})
+                return
+        }
+
         var sub OrgSubscription
-        if err := db.Where("org_id = ? AND status = 'active'", c.Param("id")).First(&sub).Error; err != nil {
+        if err := db.Where("org_id = ? AND status = 'active'", orgID).First(&sub).Error; err != nil {
                 c.JSON(http.StatusNotFound, gin.H{"error": "No active subscription"})
                 return
         }
 
-        var req struct {
-                AutoRenew     *bool `json:"auto_renew"`
-                SeatsStudent  *int  `json:"seats_student_editor"`
-                SeatsStaff    *int  `json:"seats_staff"`
-        }
+        var req orgSubscriptionChangeRequest
         if err := c.ShouldBindJSON(&req); err != nil {
                 c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
                 return
         }
 
-        if req.AutoRenew != nil {
-                sub.AutoRenew = *req.AutoRenew
+        proration, err := previewOrgSubscriptionChange(&sub, &req, time.Now())
+        if err != nil {
+                c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+                return
         }
-        if req.SeatsStudent != nil {
-                sub.SeatsStudentEditor = *req.SeatsStudent
+        if proration != nil && req.ExpectedNetKopecks != nil && *req.ExpectedNetKopecks != proration.NetKopecks {
+                c.JSON(http.StatusConflict, gin.H{"error": "Price changed, please review the new amount", "proration": proration})
+                return
         }
-        if req.SeatsStaff != nil {
-                sub.SeatsStaff = *req.SeatsStaff
+
+        if req.AutoRenew != nil {
+                db.Model(&sub).Updates(map[string]interface{}{"auto_renew": *req.AutoRenew, "updated_at": time.Now()})
         }
-        sub.UpdatedAt = time.Now()
 
-        db.Save(&sub)
-        c.JSON(http.StatusOK, sub)
+        resp := gin.H{}
+        if proration != nil {
+                change, inv, err := applyOrgSubscriptionChange(&sub, proration, uid)
+                if err != nil {
+                        log.Printf("[Billing] Failed to change subscription of org %d: %v", orgID, err)
+                        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change subscription"})
+                        return
+                }
+                if proration.Immediate && proration.To.PlanID != proration.From.PlanID {
+                        var plan SubscriptionPlan
+                        if db.First(&plan, proration.To.PlanID).Error == nil {
+                                grantOrgEntitlements(orgID, &plan)
+                        }
+                }
+                resp["change"] = change
+                resp["proration"] = proration
+                if inv != nil {
+                        resp["invoice"] = inv
+                }
+        }
+
+        db.First(&sub, sub.ID)
+        resp["subscription"] = sub
+        c.JSON(http.StatusOK, resp)
 }
 
 func cancelOrgSubscriptionHandler(c *gin.Context) {
         var sub OrgSubscription
-        if err := db.Where("org_id = ? AND status = 'active'", c.Param("id")).First(&sub).Error; err != nil {
+        if err := db.Where("org_id = ? AND status IN ?", c.Param("id"), orgServingStatuses).First(&sub).Error; err != nil {
                 c.JSON(http.StatusNotFound, gin.H{"error": "No active subscription"})
                 return
         }
@@ -381,7 +455,7 @@ func getOrgBillingHandler(c *gin.Context) {
         orgID := parseInt(c.Param("id"))
 
         var sub OrgSubscription
-        if err := db.Where("org_id = ? AND status = 'active'", orgID).First(&sub).Error; err != nil {
+        if err := db.Where("org_id = ? AND status IN ?", orgID, orgServingStatuses).First(&sub).Error; err != nil {
                 c.JSON(http.StatusNotFound, gin.H{"error": "No active subscription"})
                 return
         }
@@ -406,24 +480,20 @@ func getOrgBillingHandler(c *gin.Context) {
                 }
         }
 
-        var overageTotal float64
-        startOfMonth := time.Date(time.Now().Year(), time.Now().Month(), 1, 0, 0, 0, 0, time.UTC)
-        var overageRecords []StorageOverageDaily
-        db.Where("org_id = ? AND date >= ?", orgID, startOfMonth).Find(&overageRecords)
-
-        if len(overageRecords) > 0 {
-                var totalBytes int64
-                for _, r := range overageRecords {
-                        totalBytes += r.BytesOverRetention
-                }
-                gbMonth := float64(totalBytes) / (1024 * 1024 * 1024) / float64(len(overageRecords)) * 30.0
-                overageTotal = gbMonth * 50.0
+        // Overage accrued so far in the current period, from usage metering
+        var overageKopecks int64
+        for _, u := range computeOrgUsage(orgID, plan, sub.StartsAt, time.Now(), orgInvoiceMonths(sub.BillingPeriod)) {
+                overageKopecks += u.AmountKopecks
         }
+        overageTotal := float64(overageKopecks) / 100
 
         baseCost := plan.BasePriceRub
         seatsCost := float64(studentCount)*studentPrice + float64(staffCount)*staffPrice
         totalCost := baseCost + seatsCost + overageTotal
 
+        var invoices []Invoice
+        db.Where("org_id = ?", orgID).Order("issued_at DESC").Limit(20).Find(&invoices)
+
         c.JSON(http.StatusOK, gin.H{
                 "plan":           plan,
                 "student_count":  studentCount,
@@ -436,6 +506,10 @@ func getOrgBillingHandler(c *gin.Context) {
                 "total_monthly":  totalCost,
                 "billing_period": sub.BillingPeriod,
                 "ends_at":        sub.EndsAt,
+                "status":         sub.Status,
+                "access":         dunningAccess(sub.Status),
+                "grace_until":    sub.GraceUntil,
+                "invoices":       invoices,
         })
 }
 
@@ -534,7 +608,7 @@ func getGuildTemplatesHandler(c *gin.Context) {
         requiredPlan := c.Query("plan")
         category := c.Query("category")
 
-        query := db.Model(&GuildTemplate{}).Where("is_active = true")
+        query := db.Model(&GuildTemplate{}).Where("is_active = true AND owner_id IS NULL")
 
         if requiredPlan != "" {
                 query = query.Where("required_plan = ? OR required_plan = 'free'", requiredPlan)
@@ -584,6 +658,23 @@ func applyGuildTemplateHandler(c *gin.Context) {
                 c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
                 return
         }
+        // Templates saved from a user's guild are private to that user
+        if template.OwnerID != nil && *template.OwnerID != userID {
+                c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+                return
+        }
+
+        var doc GuildTemplateDocument
+        if template.DocumentJSON != "" {
+                if err := json.Unmarshal([]byte(template.DocumentJSON), &doc); err != nil {
+                        c.JSON(http.StatusInternalServerError, gin.H{"error": "Template is corrupted"})
+                        return
+                }
+                if errs := validateGuildTemplateDocument(&doc); len(errs) > 0 {
+                        c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Invalid template", "errors": errs})
+                        return
+                }
+        }
 
         var req struct {
                 GuildName string `json:"guild_name" binding:"required"`
@@ -621,7 +712,16 @@ func applyGuildTemplateHandler(c *gin.Context) {
         }
 
         var channels []map[string]interface{}
-        if err := json.Unmarshal([]byte(template.ChannelsJSON), &channels); err == nil {
+        if template.DocumentJSON != "" {
+                if err := db.Transaction(func(tx *gorm.DB) error {
+                        _, err := importGuildTemplate(tx, guild.ID, &doc, guildImportOptions{UserID: userID})
+                        return err
+                }); err != nil {
+                        db.Delete(&guild)
+                        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply template"})
+                        return
+                }
+        } else if err := json.Unmarshal([]byte(template.ChannelsJSON), &channels); err == nil {
                 for _, ch := range channels {
                         channel := Channel{
                                 GuildID:   guild.ID,
@@ -802,6 +902,7 @@ func createManualPaymentHandler(c *gin.Context) {
 
         var req struct {
                 OrgID       *int    `json:"org_id"`
+                InvoiceID   *uint   `json:"invoice_id"`
                 Amount      float64 `json:"amount" binding:"required"`
                 Last4Digits string  `json:"last_4_digits" binding:"required,len=4"`
                 PayerName   string  `json:"payer_name"`
@@ -811,8 +912,26 @@ func createManualPaymentHandler(c *gin.Context) {
                 return
         }
 
+        if req.InvoiceID != nil {
+                var inv Invoice
+                if err := db.First(&inv, *req.InvoiceID).Error; err != nil || inv.Status != "issued" {
+                        c.JSON(http.StatusBadRequest, gin.H{"error": "Invoice not found or not payable"})
+                        return
+                }
+                if inv.OrgID != nil && !canManageOrgBilling(userID, *inv.OrgID) {
+                        c.JSON(http.StatusForbidden, gin.H{"error": "Org admin access required"})
+                        return
+                }
+                if inv.OrgID == nil && (inv.UserID == nil || *inv.UserID != userID) {
+                        c.JSON(http.StatusBadRequest, gin.H{"error": "Invoice not found or not payable"})
+                        return
+                }
+                req.OrgID = inv.OrgID
+        }
+
         payment := ManualPayment{
                 OrgID:       req.OrgID,
+                InvoiceID:   req.InvoiceID,
                 UserID:      ptrInt(int(userID)),
                 Amount:      req.Amount,
                 Last4Digits: req.Last4Digits,
@@ -852,27 +971,11 @@ func getJarvisUsageHandler(c *gin.Context) {
                 return
         }
 
-        today := time.Date(time.Now().Year(), time.Now().Month(), time.Now().Day(), 0, 0, 0, 0, time.UTC)
-
-        var usage JarvisUsage
-        if err := db.Where("user_id = ? AND date = ?", userID, today).First(&usage).Error; err != nil {
-                usage = JarvisUsage{
-                        UserID:       int(userID),
-                        Date:         today,
-                        RequestCount: 0,
-                }
-        }
-
-        limit := getJarvisLimitForUser(userID)
-
-        c.JSON(http.StatusOK, gin.H{
-                "used":      usage.RequestCount,
-                "limit":     limit,
-                "remaining": int(math.Max(0, float64(limit-usage.RequestCount))),
-                "date":      today,
-        })
+        c.JSON(http.StatusOK, jarvisUsageResponse(userID))
 }
 
+// checkJarvisLimitHandler only reports whether the next request would be
+// accepted. Requests are counted by the chat endpoints themselves.
 func checkJarvisLimitHandler(c *gin.Context) {
         userID, ok := getUserIDFromContext(c)
         if !ok {
@@ -880,54 +983,24 @@ func checkJarvisLimitHandler(c *gin.Context) {
                 return
         }
 
-        today := time.Date(time.Now().Year(), time.Now().Month(), time.Now().Day(), 0, 0, 0, 0, time.UTC)
-        limit := getJarvisLimitForUser(userID)
-
-        var usage JarvisUsage
-        if err := db.Where("user_id = ? AND date = ?", userID, today).First(&usage).Error; err != nil {
-                usage = JarvisUsage{
-                        UserID:       int(userID),
-                        Date:         today,
-                        RequestCount: 0,
-                        CreatedAt:    time.Now(),
-                        UpdatedAt:    time.Now(),
-                }
-                db.Create(&usage)
-        }
-
-        canUse := usage.RequestCount < limit
-        if canUse {
-                usage.RequestCount++
-                usage.UpdatedAt = time.Now()
-                db.Save(&usage)
+        usage := jarvisUsageResponse(userID)
+        canUse := usage["user"].(gin.H)["can_use"].(bool)
+        if org, ok := usage["org"].(gin.H); ok {
+                canUse = canUse && org["can_use"].(bool)
         }
-
-        c.JSON(http.StatusOK, gin.H{
-                "can_use":   canUse,
-                "used":      usage.RequestCount,
-                "limit":     limit,
-                "remaining": int(math.Max(0, float64(limit-usage.RequestCount))),
-        })
+        usage["can_use"] = canUse
+        c.JSON(http.StatusOK, usage)
 }
 
-func getJarvisLimitForUser(userID uint) int {
-        var member OrgMember
-        if err := db.Where("user_id = ? AND state = 'active'", userID).First(&member).Error; err == nil {
-                var sub OrgSubscription
-                if err := db.Where("org_id = ? AND status = 'active'", member.OrgID).First(&sub).Error; err == nil {
-                        var plan SubscriptionPlan
-                        if err := db.First(&plan, sub.PlanID).Error; err == nil {
-                                return plan.JarvisDailyLimit
-                        }
-                }
-        }
-
-        var premium UserPremium
-        if err := db.Where("user_id = ? AND is_active = true", userID).First(&premium).Error; err == nil {
-                return 50
-        }
-
-        return 3
+// jarvisUsageResponse is the quota snapshot plus the flat used/limit/remaining
+// fields older clients read.
+func jarvisUsageResponse(userID uint) gin.H {
+        usage := jarvisQuotaSnapshot(userID, time.Now())
+        requests := usage["user"].(gin.H)["requests"].(gin.H)
+        usage["used"] = requests["used"]
+        usage["limit"] = requests["limit"]
+        usage["remaining"] = requests["remaining"]
+        return usage
 }
 
 func ptrInt(i int) *int {
@@ -0,0 +1,651 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+var accountDeletionGrace = 30 * 24 * time.Hour
+
+const (
+	accountDeletionMaxBackoff    = 24 * time.Hour
+	accountDeletionAlertAttempts = 5
+)
+
+// erasedAccounts caches accounts known to be erased; erasure is final.
+var erasedAccounts sync.Map
+
+func setupPrivacyRoutes(r *gin.Engine, auth gin.HandlerFunc) {
+	account := r.Group("/api/account")
+	account.Use(auth)
+	{
+		account.POST("/export", requestAccountExportHandler)
+		account.GET("/deletion", getAccountDeletionHandler)
+		account.POST("/deletion", requestAccountDeletionHandler)
+		account.DELETE("/deletion", cancelAccountDeletionHandler)
+	}
+}
+
+// InitAccountDeletions starts the job that erases accounts whose grace period
+// has run out.
+func InitAccountDeletions() {
+	if days, err := strconv.Atoi(os.Getenv("ACCOUNT_DELETION_GRACE_DAYS")); err == nil && days >= 0 {
+		accountDeletionGrace = time.Duration(days) * 24 * time.Hour
+	}
+
+	if db == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(1 * time.Hour)
+		defer ticker.Stop()
+		processDueAccountDeletions(time.Now())
+		for now := range ticker.C {
+			processDueAccountDeletions(now)
+		}
+	}()
+}
+
+// Personal data export. The archive is built by the export job worker and
+// downloaded through /api/export/jobs/:id/download like any other export.
+func requestAccountExportHandler(c *gin.Context) {
+	userIDRaw, _ := c.Get("user_id")
+	userID, _ := extractUserID(userIDRaw)
+
+	var recent int64
+	db.Model(&ExportJob{}).Where("user_id = ? AND scope = ? AND created_at > ? AND status <> ?",
+		userID, "account", time.Now().Add(-24*time.Hour), "failed").Count(&recent)
+	if recent > 0 {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "A personal data export was already requested in the last 24 hours"})
+		return
+	}
+
+	req := &exportRequest{
+		Scope:  "account",
+		UserID: userID,
+		Format: "json",
+		Bundle: true,
+		Title:  "персональных данных",
+	}
+	job := ExportJob{
+		UserID: userID,
+		Scope:  req.Scope,
+		Format: req.Format,
+		Bundle: true,
+		Status: "queued",
+	}
+	if err := db.Create(&job).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create export job"})
+		return
+	}
+
+	go runExportJob(job.ID, req)
+
+	go LogAuditViaGRPC(userID, "account_export_requested", "user", strconv.FormatUint(uint64(userID), 10), "privacy",
+		fmt.Sprintf("job:%d", job.ID), c.ClientIP(), c.Request.UserAgent())
+
+	c.JSON(http.StatusAccepted, job)
+}
+
+func getAccountDeletionHandler(c *gin.Context) {
+	userIDRaw, _ := c.Get("user_id")
+	userID, _ := extractUserID(userIDRaw)
+
+	var deletion AccountDeletion
+	if db.Where("user_id = ? AND status = ?", userID, "pending").First(&deletion).RowsAffected == 0 {
+		c.JSON(http.StatusOK, gin.H{"pending": false})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"pending": true, "deletion": deletion})
+}
+
+func requestAccountDeletionHandler(c *gin.Context) {
+	userIDRaw, _ := c.Get("user_id")
+	userID, _ := extractUserID(userIDRaw)
+
+	var req struct {
+		Password string `json:"password" binding:"required"`
+		Reason   string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	deletion, status, body := scheduleAccountDeletion(userID, req.Password, req.Reason, c.ClientIP(), time.Now())
+	if body != nil {
+		c.JSON(status, body)
+		return
+	}
+
+	logExtendedAudit(userID, "account_deletion_requested", "user", strconv.FormatUint(uint64(userID), 10), "privacy",
+		fmt.Sprintf("scheduled_for:%s", deletion.ScheduledFor.Format(time.RFC3339)), c.ClientIP(), c.Request.UserAgent())
+
+	go SendAccountDeletionScheduled(userID, deletion.ScheduledFor)
+	go createNotificationHandler(userID, "account_deletion",
+		fmt.Sprintf("Аккаунт будет удалён %s. До этого момента удаление можно отменить в настройках.",
+			deletion.ScheduledFor.Format("02.01.2006 15:04")))
+
+	c.JSON(http.StatusAccepted, deletion)
+}
+
+// scheduleAccountDeletion checks the password and that nothing stands in the
+// way, and records the request. On refusal it returns the status and body
+// to answer with.
+func scheduleAccountDeletion(userID uint, password, reason, ip string, now time.Time) (*AccountDeletion, int, gin.H) {
+	var user User
+	if db.First(&user, userID).RowsAffected == 0 {
+		return nil, http.StatusNotFound, gin.H{"error": "User not found"}
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		return nil, http.StatusForbidden, gin.H{"error": "Invalid password"}
+	}
+
+	var existing AccountDeletion
+	if db.Where("user_id = ? AND status = ?", userID, "pending").First(&existing).RowsAffected > 0 {
+		return nil, http.StatusConflict, gin.H{"error": "Account deletion already scheduled", "deletion": existing}
+	}
+
+	// Guild ownership has to be handed over first, otherwise the guild would be
+	// left without anyone able to manage it.
+	var owned []Guild
+	db.Where("owner_id = ?", userID).Find(&owned)
+	if len(owned) > 0 {
+		names := make([]string, len(owned))
+		for i, g := range owned {
+			names[i] = g.Name
+		}
+		return nil, http.StatusConflict, gin.H{"error": "Transfer ownership of your guilds before deleting the account", "guilds": names}
+	}
+
+	deletion := AccountDeletion{
+		UserID:       userID,
+		Status:       "pending",
+		Reason:       reason,
+		ScheduledFor: now.Add(accountDeletionGrace),
+		IPAddress:    ip,
+	}
+	if err := db.Create(&deletion).Error; err != nil {
+		return nil, http.StatusInternalServerError, gin.H{"error": "Failed to schedule deletion"}
+	}
+	return &deletion, http.StatusAccepted, nil
+}
+
+func cancelAccountDeletionHandler(c *gin.Context) {
+	userIDRaw, _ := c.Get("user_id")
+	userID, _ := extractUserID(userIDRaw)
+
+	var deletion AccountDeletion
+	if db.Where("user_id = ? AND status = ?", userID, "pending").First(&deletion).RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No pending deletion"})
+		return
+	}
+
+	now := time.Now()
+	db.Model(&deletion).Updates(map[string]interface{}{
+		"status":       "cancelled",
+		"cancelled_at": now,
+	})
+
+	logExtendedAudit(userID, "account_deletion_cancelled", "user", strconv.FormatUint(uint64(userID), 10), "privacy",
+		fmt.Sprintf("deletion:%d", deletion.ID), c.ClientIP(), c.Request.UserAgent())
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account deletion cancelled"})
+}
+
+// processDueAccountDeletions erases the accounts whose grace period is over.
+// A failed erasure stays pending and is retried with a growing backoff;
+// admins are alerted once it keeps failing.
+func processDueAccountDeletions(now time.Time) {
+	var due []AccountDeletion
+	db.Where("status = ? AND scheduled_for <= ? AND (next_attempt_at IS NULL OR next_attempt_at <= ?)", "pending", now, now).Find(&due)
+
+	for _, deletion := range due {
+		if err := eraseUserAccount(deletion.UserID); err != nil {
+			attempts := deletion.Attempts + 1
+			next := now.Add(accountDeletionBackoff(attempts))
+			log.Printf("[Privacy] Failed to erase account %d (attempt %d, retry at %s): %v",
+				deletion.UserID, attempts, next.Format(time.RFC3339), err)
+			db.Model(&deletion).Updates(map[string]interface{}{
+				"attempts":        attempts,
+				"next_attempt_at": next,
+				"error":           err.Error(),
+			})
+			if attempts == accountDeletionAlertAttempts {
+				alertAccountDeletionFailure(&deletion, attempts, err)
+			}
+			continue
+		}
+
+		db.Model(&deletion).Updates(map[string]interface{}{"status": "completed", "completed_at": now, "error": ""})
+		logExtendedAudit(deletion.UserID, "account_deleted", "user", strconv.FormatUint(uint64(deletion.UserID), 10), "privacy",
+			fmt.Sprintf("deletion:%d requested:%s", deletion.ID, deletion.CreatedAt.Format(time.RFC3339)), "system", "privacy_job")
+		log.Printf("[Privacy] Account %d erased", deletion.UserID)
+	}
+}
+
+// accountDeletionBackoff is the wait after the attempts-th failed erasure:
+// an hour, doubling up to a day.
+func accountDeletionBackoff(attempts int) time.Duration {
+	backoff := time.Hour
+	for i := 1; i < attempts && backoff < accountDeletionMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, accountDeletionMaxBackoff)
+}
+
+// alertAccountDeletionFailure tells the admins that an erasure owed to a
+// user keeps failing; it is still retried.
+func alertAccountDeletionFailure(deletion *AccountDeletion, attempts int, err error) {
+	log.Printf("[Privacy] ALERT: erasing account %d has failed %d times: %v", deletion.UserID, attempts, err)
+	var admins []uint
+	db.Model(&User{}).Where("role = ?", "admin").Pluck("id", &admins)
+	for _, id := range admins {
+		createNotificationHandler(id, "account_deletion_failed",
+			fmt.Sprintf("Удаление аккаунта %d не удаётся уже %d раз: %v", deletion.UserID, attempts, err))
+	}
+}
+
+// accountErased reports whether uid belongs to an erased account. Tokens
+// issued before the erasure are still signed and unexpired, so the auth
+// middleware asks on every request.
+func accountErased(uid uint) bool {
+	if db == nil || uid == 0 {
+		return false
+	}
+	if _, ok := erasedAccounts.Load(uid); ok {
+		return true
+	}
+	var erased int64
+	db.Model(&User{}).Where("id = ? AND status = ?", uid, "deleted").Count(&erased)
+	if erased > 0 {
+		erasedAccounts.Store(uid, true)
+	}
+	return erased > 0
+}
+
+// accountPrivateTables lists data that only concerns the user and is removed
+// outright. Conditions use the named parameter @id.
+var accountPrivateTables = []struct {
+	model interface{}
+	where string
+}{
+	{&Settings{}, "user_id = @id"},
+	{&UserSettings{}, "user_id = @id"},
+	{&UserPresence{}, "user_id = @id"},
+	{&TypingIndicator{}, "user_id = @id OR chat_user_id = @id"},
+	{&ReadReceipt{}, "user_id = @id"},
+	{&TelegramLink{}, "user_id = @id"},
+	{&TelegramNotification{}, "user_id = @id"},
+	{&UserNote{}, "user_id = @id OR target_id = @id"},
+	{&BlockedUser{}, "user_id = @id OR blocked_user_id = @id"},
+	{&Friend{}, "user_id = @id OR friend_id = @id"},
+	{&FriendRequest{}, "requester_id = @id OR addressee_id = @id"},
+	{&Subscription{}, "follower_id = @id OR following_id = @id"},
+	{&PostLike{}, "user_id = @id"},
+	{&PostRating{}, "user_id = @id"},
+	{&PostBookmark{}, "user_id = @id"},
+	{&VideoLike{}, "user_id = @id"},
+	{&VideoBookmark{}, "user_id = @id"},
+	{&MessageReaction{}, "user_id = @id"},
+	{&ChannelMessageReaction{}, "user_id = @id"},
+	{&StoryView{}, "viewer_id = @id OR story_id IN (SELECT id FROM stories WHERE user_id = @id)"},
+	{&Story{}, "user_id = @id"},
+	{&JarvisContext{}, "user_id = @id"},
+	{&JarvisConversationMessage{}, "conversation_id IN (SELECT id FROM jarvis_conversations WHERE user_id = @id)"},
+	{&JarvisConversation{}, "user_id = @id"},
+	{&JarvisSummary{}, "user_id = @id OR user_a_id = @id OR user_b_id = @id"},
+	{&JarvisReminder{}, "user_id = @id"},
+	{&JarvisSession{}, "user_id = @id"},
+	{&JarvisVoiceCommand{}, "user_id = @id"},
+	{&JarvisUsage{}, "user_id = @id"},
+	{&GuildMember{}, "user_id = @id"},
+	{&GuildMemberRole{}, "user_id = @id"},
+	{&ChannelMember{}, "user_id = @id"},
+	{&ChannelPermission{}, "user_id = @id"},
+	{&OrgMember{}, "user_id = @id"},
+	{&QRLoginSession{}, "user_id = @id"},
+	{&UserReferral{}, "user_id = @id"},
+	{&AdminUserRole{}, "user_id = @id"},
+	{&Voicemail{}, "to_user_id = @id"},
+	{&OnlineNotebook{}, "user_id = @id"},
+	{&UserRequest{}, "user_id = @id"},
+	{&ExportJob{}, "user_id = @id"},
+	{&ScheduledMessageRun{}, "schedule_id IN (SELECT id FROM scheduled_messages WHERE user_id = @id OR recipient_id = @id)"},
+	{&ScheduledMessage{}, "user_id = @id OR recipient_id = @id"},
+}
+
+// eraseUserAccount removes private data and anonymizes the user row. Messages,
+// posts, comments and videos stay in place under the anonymous name so that
+// conversations remain readable for other participants. Payment records
+// (transactions, subscriptions, donations, gifts, promo usages, boosts, manual
+// payments) are kept as required for accounting.
+func eraseUserAccount(uid uint) error {
+	var user User
+	if err := db.First(&user, uid).Error; err != nil {
+		return err
+	}
+
+	var files []string
+	if user.Avatar != nil {
+		files = append(files, *user.Avatar)
+	}
+	var stories []Story
+	db.Where("user_id = ? AND media_url IS NOT NULL", uid).Find(&stories)
+	for _, s := range stories {
+		files = append(files, *s.MediaURL)
+	}
+	var exports []ExportJob
+	db.Where("user_id = ? AND file_path <> ''", uid).Find(&exports)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		params := map[string]interface{}{"id": uid}
+		for _, t := range accountPrivateTables {
+			if err := tx.Unscoped().Where(t.where, params).Delete(t.model).Error; err != nil {
+				return fmt.Errorf("%T: %w", t.model, err)
+			}
+		}
+
+		if err := tx.Model(&PremiumSubscription{}).Where("user_id = ?", uid).Updates(map[string]interface{}{
+			"status":            "cancelled",
+			"auto_renew":        false,
+			"payment_method_id": "",
+			"cancelled_at":      time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+
+		// Not a valid bcrypt hash, so the password check always fails.
+		return tx.Model(&user).Updates(map[string]interface{}{
+			"username":  fmt.Sprintf("deleted_%d", uid),
+			"email":     nil,
+			"password":  "!",
+			"avatar":    nil,
+			"bio":       nil,
+			"status":    "deleted",
+			"role":      "user",
+			"last_seen": nil,
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	erasedAccounts.Store(uid, true)
+	hub.disconnectUser(strconv.FormatUint(uint64(uid), 10))
+
+	for _, url := range files {
+		if local, ok := localUploadPath(url); ok {
+			os.Remove(local)
+		}
+	}
+	for _, job := range exports {
+		os.Remove(job.FilePath)
+	}
+
+	return nil
+}
+
+// Personal data export
+
+type accountEntity struct {
+	name  string
+	write func(zw *zip.Writer) (int64, error)
+}
+
+// accountTable streams every row matched by q into <name>.json as a JSON array.
+func accountTable[T any](name string, q *gorm.DB) accountEntity {
+	return accountEntity{name: name, write: func(zw *zip.Writer) (int64, error) {
+		entry, err := zw.Create(name + ".json")
+		if err != nil {
+			return 0, err
+		}
+		if _, err := io.WriteString(entry, "["); err != nil {
+			return 0, err
+		}
+
+		var count int64
+		var batch []T
+		res := q.FindInBatches(&batch, exportBatchSize, func(tx *gorm.DB, _ int) error {
+			for i := range batch {
+				data, err := json.Marshal(batch[i])
+				if err != nil {
+					return err
+				}
+				sep := ",\n"
+				if count == 0 {
+					sep = "\n"
+				}
+				if _, err := io.WriteString(entry, sep); err != nil {
+					return err
+				}
+				if _, err := entry.Write(data); err != nil {
+					return err
+				}
+				count++
+			}
+			return nil
+		})
+		if res.Error != nil {
+			return count, res.Error
+		}
+
+		_, err = io.WriteString(entry, "\n]\n")
+		return count, err
+	}}
+}
+
+// Projections without embedded associations or secrets.
+
+type accountMessageRecord struct {
+	ID        uint      `json:"id"`
+	ChannelID uint      `json:"channel_id"`
+	Content   string    `json:"content"`
+	Edited    bool      `json:"edited"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (accountMessageRecord) TableName() string { return "messages" }
+
+type accountPostRecord struct {
+	ID        uint      `json:"id"`
+	Title     string    `json:"title"`
+	Content   string    `json:"content"`
+	Tags      []string  `json:"tags,omitempty" gorm:"type:text[]"`
+	Likes     int       `json:"likes"`
+	Comments  int       `json:"comments"`
+	Shares    int       `json:"shares"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (accountPostRecord) TableName() string { return "posts" }
+
+type accountUserSettingsRecord struct {
+	ID                    uint   `json:"id"`
+	Language              string `json:"language"`
+	Theme                 string `json:"theme"`
+	NotificationsEnabled  bool   `json:"notifications_enabled"`
+	SoundEnabled          bool   `json:"sound_enabled"`
+	VoiceEnabled          bool   `json:"voice_enabled"`
+	NoiseReduction        bool   `json:"noise_reduction"`
+	TelegramNotifications bool   `json:"telegram_notifications"`
+	JarvisPersonality     string `json:"jarvis_personality"`
+	JarvisWakeWord        string `json:"jarvis_wake_word"`
+	ProfileVisibility     string `json:"profile_visibility"`
+	MessagePrivacy        string `json:"message_privacy"`
+}
+
+func (accountUserSettingsRecord) TableName() string { return "user_settings" }
+
+type accountVoicemailRecord struct {
+	ID            uint      `json:"id"`
+	FromUserID    *uint     `json:"from_user_id,omitempty"`
+	AudioURL      string    `json:"audio_url"`
+	Duration      int       `json:"duration"`
+	Transcription string    `json:"transcription,omitempty"`
+	IsRead        bool      `json:"is_read"`
+	CallerNumber  string    `json:"caller_number,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func (accountVoicemailRecord) TableName() string { return "voicemails" }
+
+func accountExportEntities(uid uint) []accountEntity {
+	byUser := func() *gorm.DB { return db.Where("user_id = ?", uid) }
+
+	return []accountEntity{
+		accountTable[User]("profile", db.Where("id = ?", uid)),
+		accountTable[Settings]("settings", byUser()),
+		accountTable[accountUserSettingsRecord]("user_settings", byUser()),
+		accountTable[UserPresence]("presence", byUser()),
+		accountTable[TelegramLink]("telegram_link", byUser()),
+		accountTable[TelegramNotification]("notifications", byUser()),
+		accountTable[DirectMessage]("direct_messages", db.Where("sender_id = ? OR receiver_id = ?", uid, uid)),
+		accountTable[accountMessageRecord]("channel_messages", db.Where("author_id = ?", uid)),
+		accountTable[accountPostRecord]("posts", db.Where("author_id = ?", uid)),
+		accountTable[PostComment]("post_comments", byUser()),
+		accountTable[PostLike]("post_likes", byUser()),
+		accountTable[PostRating]("post_ratings", byUser()),
+		accountTable[PostBookmark]("post_bookmarks", byUser()),
+		accountTable[Story]("stories", byUser()),
+		accountTable[Video]("videos", db.Where("author_id = ?", uid)),
+		accountTable[VideoLike]("video_likes", byUser()),
+		accountTable[VideoBookmark]("video_bookmarks", byUser()),
+		accountTable[Friend]("friends", db.Where("user_id = ? OR friend_id = ?", uid, uid)),
+		accountTable[FriendRequest]("friend_requests", db.Where("requester_id = ? OR addressee_id = ?", uid, uid)),
+		accountTable[BlockedUser]("blocked_users", byUser()),
+		accountTable[Subscription]("follows", db.Where("follower_id = ? OR following_id = ?", uid, uid)),
+		accountTable[GuildMember]("guild_memberships", byUser()),
+		accountTable[OrgMember]("org_memberships", byUser()),
+		accountTable[UserNote]("user_notes", byUser()),
+		accountTable[UserReferral]("referral", byUser()),
+		accountTable[ReferralBonus]("referral_bonuses", byUser()),
+		accountTable[PremiumSubscription]("premium_subscriptions", db.Preload("User").Preload("Plan").Where("user_id = ?", uid)),
+		accountTable[PremiumTransaction]("premium_transactions", byUser()),
+		accountTable[PromoCodeUsage]("promo_code_usages", byUser()),
+		accountTable[GiftSubscription]("gifts", db.Preload("Plan").Where("from_user_id = ? OR to_user_id = ?", uid, uid)),
+		accountTable[CreatorDonation]("donations", db.Where("from_user_id = ? OR to_user_id = ?", uid, uid)),
+		accountTable[CreatorPayout]("creator_payouts", byUser()),
+		accountTable[BillingNotificationPreference]("billing_notification_preferences", byUser()),
+		accountTable[BillingNotificationLog]("billing_notifications", byUser()),
+		accountTable[PostBoost]("post_boosts", byUser()),
+		accountTable[ManualPayment]("manual_payments", byUser()),
+		accountTable[Invoice]("invoices", db.Preload("Lines").Where("user_id = ?", uid)),
+		accountTable[LedgerLine]("ledger_lines", db.Preload("Account").Where("account_id IN (?)", db.Model(&LedgerAccount{}).Select("id").Where("owner_id = ?", uid))),
+		accountTable[JarvisUsage]("jarvis_usage", byUser()),
+		accountTable[JarvisContext]("jarvis_contexts", byUser()),
+		accountTable[JarvisConversation]("jarvis_conversations", byUser()),
+		accountTable[JarvisConversationMessage]("jarvis_conversation_messages", db.Where("conversation_id IN (?)", db.Model(&JarvisConversation{}).Select("id").Where("user_id = ?", uid))),
+		accountTable[JarvisReminder]("jarvis_reminders", byUser()),
+		accountTable[JarvisSummary]("jarvis_summaries", byUser()),
+		accountTable[ScheduledMessage]("scheduled_messages", byUser()),
+		accountTable[accountVoicemailRecord]("voicemails", db.Where("to_user_id = ?", uid)),
+		accountTable[ChannelTool]("channel_tools", db.Where("owner_id = ?", uid)),
+		accountTable[OnlineNotebook]("notebooks", byUser()),
+		accountTable[Appeal]("appeals", db.Preload("User").Preload("Verdict").Where("user_id = ?", uid)),
+		accountTable[AbuseReport]("reports", db.Where("reporter_id = ?", uid)),
+		accountTable[UserRequest]("requests", db.Preload("User").Where("user_id = ?", uid)),
+		accountTable[ExtendedAuditLog]("audit_log", byUser()),
+	}
+}
+
+type accountExportManifest struct {
+	Version     int              `json:"version"`
+	GeneratedAt time.Time        `json:"generated_at"`
+	UserID      uint             `json:"user_id"`
+	Entities    map[string]int64 `json:"entities"`
+	Media       int              `json:"media"`
+	MediaBytes  int64            `json:"media_bytes"`
+	Missing     []string         `json:"missing,omitempty"`
+}
+
+// writeAccountExport builds the personal data archive: one JSON file per
+// entity, the user's uploaded media under media/ and a manifest. progress
+// reports the number of entities written.
+func writeAccountExport(w io.Writer, req *exportRequest, progress func(processed int64)) (int64, error) {
+	uid := req.UserID
+	zw := zip.NewWriter(w)
+	manifest := accountExportManifest{
+		Version:     1,
+		GeneratedAt: time.Now().UTC(),
+		UserID:      uid,
+		Entities:    make(map[string]int64),
+	}
+
+	var done int64
+	for _, entity := range accountExportEntities(uid) {
+		n, err := entity.write(zw)
+		if err != nil {
+			return done, fmt.Errorf("%s: %w", entity.name, err)
+		}
+		manifest.Entities[entity.name] = n
+		done++
+		progress(done)
+	}
+
+	seen := make(map[string]bool)
+	addMedia := func(url string) {
+		if url == "" || seen[url] {
+			return
+		}
+		seen[url] = true
+		n, err := copyUploadToZip(zw, url, "media/"+path.Base(url))
+		if err != nil {
+			manifest.Missing = append(manifest.Missing, url)
+			return
+		}
+		manifest.Media++
+		manifest.MediaBytes += n
+	}
+
+	var user User
+	if db.First(&user, uid).RowsAffected > 0 && user.Avatar != nil {
+		addMedia(*user.Avatar)
+	}
+
+	var urls []string
+	db.Model(&Story{}).Where("user_id = ? AND media_url IS NOT NULL", uid).Pluck("media_url", &urls)
+	for _, u := range urls {
+		addMedia(u)
+	}
+	urls = nil
+	db.Model(&DirectMessage{}).Where("sender_id = ? AND voice_url IS NOT NULL", uid).Pluck("voice_url", &urls)
+	for _, u := range urls {
+		addMedia(u)
+	}
+	var videos []Video
+	db.Select("id", "video_url", "thumbnail").Where("author_id = ?", uid).Find(&videos)
+	for _, v := range videos {
+		addMedia(v.VideoURL)
+		addMedia(v.Thumbnail)
+	}
+
+	entry, err := zw.Create("manifest.json")
+	if err != nil {
+		return done, err
+	}
+	enc := json.NewEncoder(entry)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return done, err
+	}
+
+	return done, zw.Close()
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// accountTestModels are the tables eraseUserAccount touches.
+func accountTestModels() []interface{} {
+	models := []interface{}{
+		&User{}, &Guild{}, &AccountDeletion{}, &PremiumSubscription{}, &Message{}, &ExtendedAuditLog{},
+		&TelegramNotification{},
+	}
+	for _, t := range accountPrivateTables {
+		models = append(models, t.model)
+	}
+	return models
+}
+
+func createTestUser(t *testing.T, name, password string) User {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := name + "@example.com"
+	user := User{Username: name, Email: &email, Password: string(hash)}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestAccountDeletionBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1: time.Hour, 2: 2 * time.Hour, 3: 4 * time.Hour, 5: 16 * time.Hour, 6: 24 * time.Hour, 30: 24 * time.Hour,
+	} {
+		if got := accountDeletionBackoff(attempts); got != want {
+			t.Errorf("backoff after %d attempts = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestScheduleAccountDeletion(t *testing.T) {
+	testDB(t, accountTestModels()...)
+	alice := createTestUser(t, "alice", "secret")
+	guild := Guild{Name: "Clan", OwnerID: alice.ID}
+	db.Create(&guild)
+	now := time.Now()
+
+	if _, status, _ := scheduleAccountDeletion(alice.ID, "wrong", "", "", now); status != http.StatusForbidden {
+		t.Errorf("wrong password: %d", status)
+	}
+	_, status, body := scheduleAccountDeletion(alice.ID, "secret", "", "", now)
+	if status != http.StatusConflict || body["guilds"].([]string)[0] != "Clan" {
+		t.Errorf("guild owner: %d %v", status, body)
+	}
+	var pending int64
+	db.Model(&AccountDeletion{}).Count(&pending)
+	if pending != 0 {
+		t.Fatal("a deletion was scheduled for a guild owner")
+	}
+
+	db.Model(&guild).Update("owner_id", alice.ID+100)
+	deletion, status, body := scheduleAccountDeletion(alice.ID, "secret", "moving on", "10.0.0.1", now)
+	if status != http.StatusAccepted || body != nil || !deletion.ScheduledFor.Equal(now.Add(accountDeletionGrace)) {
+		t.Fatalf("schedule = %+v, %d %v", deletion, status, body)
+	}
+	if _, status, _ := scheduleAccountDeletion(alice.ID, "secret", "", "", now); status != http.StatusConflict {
+		t.Errorf("second request: %d", status)
+	}
+}
+
+func TestCancelAccountDeletionWithinGrace(t *testing.T) {
+	testDB(t, accountTestModels()...)
+	alice := createTestUser(t, "alice", "secret")
+	now := time.Now()
+	deletion, _, body := scheduleAccountDeletion(alice.ID, "secret", "", "", now)
+	if body != nil {
+		t.Fatal(body)
+	}
+
+	c, w := testContext(http.MethodDelete, "/api/account/deletion", nil, alice.ID)
+	cancelAccountDeletionHandler(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("cancel: %d %s", w.Code, w.Body)
+	}
+	db.First(deletion, deletion.ID)
+	if deletion.Status != "cancelled" || deletion.CancelledAt == nil {
+		t.Errorf("deletion = %+v", deletion)
+	}
+
+	processDueAccountDeletions(now.Add(accountDeletionGrace + time.Hour))
+	var user User
+	db.First(&user, alice.ID)
+	if user.Username != "alice" || user.Status == "deleted" {
+		t.Errorf("a cancelled deletion erased the account: %+v", user)
+	}
+
+	c, w = testContext(http.MethodDelete, "/api/account/deletion", nil, alice.ID)
+	cancelAccountDeletionHandler(c)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("cancelling twice: %d", w.Code)
+	}
+}
+
+func TestEraseUserAccountCascade(t *testing.T) {
+	t.Chdir(t.TempDir())
+	testDB(t, accountTestModels()...)
+	if err := os.MkdirAll(filepath.Join("uploads", "avatars"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	avatarPath := filepath.Join("uploads", "avatars", "alice.png")
+	if err := os.WriteFile(avatarPath, []byte("png"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := createTestUser(t, "alice", "secret")
+	bob := createTestUser(t, "bob", "secret")
+	carol := createTestUser(t, "carol", "secret")
+	avatar := "/uploads/avatars/alice.png"
+	db.Model(&alice).Update("avatar", avatar)
+
+	db.Create(&Settings{UserID: alice.ID})
+	db.Create(&Settings{UserID: bob.ID})
+	db.Create(&Friend{UserID: alice.ID, FriendID: bob.ID})
+	db.Create(&Friend{UserID: bob.ID, FriendID: alice.ID})
+	db.Create(&Friend{UserID: bob.ID, FriendID: carol.ID})
+	db.Create(&GuildMember{GuildID: 1, UserID: alice.ID})
+	conversation := JarvisConversation{UserID: alice.ID, Title: "plans"}
+	db.Create(&conversation)
+	db.Create(&JarvisConversationMessage{ConversationID: conversation.ID, Role: "user", Content: "my secrets"})
+	schedule := ScheduledMessage{UserID: bob.ID, RecipientID: &alice.ID, Content: "hi"}
+	db.Create(&schedule)
+	db.Create(&ScheduledMessageRun{ScheduleID: schedule.ID, RunAt: time.Now(), Status: "sent"})
+	message := Message{ChannelID: 1, AuthorID: alice.ID, Content: "public post"}
+	db.Create(&message)
+	db.Create(&PremiumSubscription{UserID: alice.ID, PlanID: 1, Status: "active", AutoRenew: true, PaymentMethodID: "pm_1"})
+
+	db.Create(&AccountDeletion{UserID: alice.ID, Status: "pending", ScheduledFor: time.Now().Add(-time.Minute)})
+	processDueAccountDeletions(time.Now())
+
+	var deletion AccountDeletion
+	db.Where("user_id = ?", alice.ID).First(&deletion)
+	if deletion.Status != "completed" || deletion.CompletedAt == nil {
+		t.Fatalf("deletion = %+v", deletion)
+	}
+
+	var user User
+	db.First(&user, alice.ID)
+	if user.Username != "deleted_"+strconv.FormatUint(uint64(alice.ID), 10) || user.Email != nil || user.Avatar != nil || user.Status != "deleted" {
+		t.Errorf("user = %+v", user)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte("secret")) == nil {
+		t.Error("the old password still works")
+	}
+	if _, err := os.Stat(avatarPath); !os.IsNotExist(err) {
+		t.Error("the avatar file was kept")
+	}
+
+	for _, tc := range []struct {
+		model interface{}
+		where string
+		want  int64
+	}{
+		{&Settings{}, "user_id = @id", 0},
+		{&Friend{}, "user_id = @id OR friend_id = @id", 0},
+		{&GuildMember{}, "user_id = @id", 0},
+		{&JarvisConversation{}, "user_id = @id", 0},
+		{&JarvisConversationMessage{}, "conversation_id = @conversation", 0},
+		{&ScheduledMessage{}, "recipient_id = @id", 0},
+		{&ScheduledMessageRun{}, "schedule_id = @schedule", 0},
+		{&Settings{}, "user_id = @bob", 1},
+		{&Friend{}, "user_id = @bob AND friend_id = @carol", 1},
+		{&Message{}, "author_id = @id", 1}, // authored content stays, anonymized
+	} {
+		var n int64
+		db.Unscoped().Model(tc.model).Where(tc.where, map[string]interface{}{
+			"id": alice.ID, "bob": bob.ID, "carol": carol.ID, "conversation": conversation.ID, "schedule": schedule.ID,
+		}).Count(&n)
+		if n != tc.want {
+			t.Errorf("%T where %s: %d rows, want %d", tc.model, tc.where, n, tc.want)
+		}
+	}
+
+	var sub PremiumSubscription
+	db.Where("user_id = ?", alice.ID).First(&sub)
+	if sub.Status != "cancelled" || sub.AutoRenew || sub.PaymentMethodID != "" {
+		t.Errorf("subscription = %+v", sub)
+	}
+	if !accountErased(alice.ID) || accountErased(bob.ID) {
+		t.Error("accountErased does not match the erasure")
+	}
+}
+
+// A failing erasure stays pending, backs off and alerts the admins once it
+// keeps failing; it goes through once the cause is gone.
+func TestProcessDueAccountDeletionsRetries(t *testing.T) {
+	testDB(t, accountTestModels()...)
+	alice := createTestUser(t, "alice", "secret")
+	admin := createTestUser(t, "root", "secret")
+	db.Model(&admin).Update("role", "admin")
+	deletion := AccountDeletion{UserID: alice.ID, Status: "pending", ScheduledFor: time.Now().Add(-time.Minute)}
+	db.Create(&deletion)
+
+	// A missing table stands in for a database outage.
+	if err := db.Migrator().DropTable(&JarvisUsage{}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	processDueAccountDeletions(now)
+	db.First(&deletion, deletion.ID)
+	if deletion.Status != "pending" || deletion.Attempts != 1 || deletion.Error == "" ||
+		deletion.NextAttemptAt == nil || !deletion.NextAttemptAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("after a failure: %+v", deletion)
+	}
+
+	processDueAccountDeletions(now.Add(30 * time.Minute))
+	db.First(&deletion, deletion.ID)
+	if deletion.Attempts != 1 {
+		t.Errorf("retried before the backoff: %d attempts", deletion.Attempts)
+	}
+
+	for deletion.Attempts < accountDeletionAlertAttempts {
+		now = *deletion.NextAttemptAt
+		processDueAccountDeletions(now)
+		db.First(&deletion, deletion.ID)
+	}
+	var alerts int64
+	db.Model(&TelegramNotification{}).Where("user_id = ? AND type = ?", admin.ID, "account_deletion_failed").Count(&alerts)
+	if alerts != 1 {
+		t.Errorf("%d admin alerts, want 1", alerts)
+	}
+
+	if err := db.AutoMigrate(&JarvisUsage{}); err != nil {
+		t.Fatal(err)
+	}
+	processDueAccountDeletions(deletion.NextAttemptAt.Add(time.Second))
+	db.First(&deletion, deletion.ID)
+	if deletion.Status != "completed" || deletion.Error != "" {
+		t.Errorf("after recovery: %+v", deletion)
+	}
+	if !accountErased(alice.ID) {
+		t.Error("the account was not erased after recovery")
+	}
+}
+
+func TestAuthMiddlewareRejectsErasedAccount(t *testing.T) {
+	testDB(t, accountTestModels()...)
+	alice := createTestUser(t, "alice", "secret")
+	bob := createTestUser(t, "bob", "secret")
+	aliceToken, err := generateToken(&alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobToken, _ := generateToken(&bob)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/me", authMiddleware(), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	call := func(token string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/me", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := call(aliceToken); code != http.StatusNoContent {
+		t.Fatalf("before erasure: %d", code)
+	}
+	if err := eraseUserAccount(alice.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := call(aliceToken); code != http.StatusUnauthorized {
+		t.Errorf("token of an erased account: %d", code)
+	}
+	if code := call(bobToken); code != http.StatusNoContent {
+		t.Errorf("another account: %d", code)
+	}
+}
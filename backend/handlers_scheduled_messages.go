@@ -0,0 +1,541 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/robfig/cron/v3"
+	"gorm.io/gorm"
+)
+
+const (
+	scheduledMessageTick        = 20 * time.Second
+	scheduledMessageBatch       = 100
+	scheduledMessageMaxActive   = 50
+	scheduledMessageMaxLength   = 4000
+	scheduledMessageMinInterval = 5 * time.Minute
+	scheduledMessageMaxAhead    = 366 * 24 * time.Hour
+	// Recurring occurrences missed for longer than this (e.g. during an outage)
+	// are recorded as skipped instead of being posted hours late.
+	scheduledMessageMaxLag = 6 * time.Hour
+)
+
+var (
+	errScheduleClaimed       = errors.New("schedule already claimed")
+	errScheduleUndeliverable = errors.New("cannot deliver")
+)
+
+func setupScheduledMessageRoutes(r *gin.Engine, auth gin.HandlerFunc) {
+	scheduled := r.Group("/api/scheduled-messages")
+	scheduled.Use(auth)
+	{
+		scheduled.GET("", listScheduledMessagesHandler)
+		scheduled.POST("", createScheduledMessageHandler)
+		scheduled.GET("/:id", getScheduledMessageHandler)
+		scheduled.PATCH("/:id", updateScheduledMessageHandler)
+		scheduled.DELETE("/:id", cancelScheduledMessageHandler)
+		scheduled.GET("/:id/runs", getScheduledMessageRunsHandler)
+	}
+}
+
+// InitScheduledMessages starts the delivery loop. All state lives in the
+// database, so schedules due while the server was down are picked up on start.
+func InitScheduledMessages() {
+	if db == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(scheduledMessageTick)
+		defer ticker.Stop()
+		processDueScheduledMessages()
+		for range ticker.C {
+			processDueScheduledMessages()
+		}
+	}()
+}
+
+type scheduledMessageInput struct {
+	ChannelID   *uint   `json:"channel_id"`
+	RecipientID *uint   `json:"recipient_id"`
+	Content     *string `json:"content"`
+	RunAt       *string `json:"run_at"`
+	CronExpr    *string `json:"cron_expr"`
+	Timezone    *string `json:"timezone"`
+}
+
+func listScheduledMessagesHandler(c *gin.Context) {
+	userIDRaw, _ := c.Get("user_id")
+	userID, _ := extractUserID(userIDRaw)
+
+	q := db.Where("user_id = ?", userID)
+	if status := c.Query("status"); status != "" {
+		q = q.Where("status = ?", status)
+	}
+	if channelID := c.Query("channel_id"); channelID != "" {
+		q = q.Where("channel_id = ?", channelID)
+	}
+	if recipientID := c.Query("recipient_id"); recipientID != "" {
+		q = q.Where("recipient_id = ?", recipientID)
+	}
+
+	var schedules []ScheduledMessage
+	q.Order("status = 'active' DESC, next_run_at ASC, created_at DESC").Limit(200).Find(&schedules)
+	c.JSON(http.StatusOK, schedules)
+}
+
+func createScheduledMessageHandler(c *gin.Context) {
+	userIDRaw, _ := c.Get("user_id")
+	userID, _ := extractUserID(userIDRaw)
+
+	var req scheduledMessageInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var active int64
+	db.Model(&ScheduledMessage{}).Where("user_id = ? AND status = ?", userID, "active").Count(&active)
+	if active >= scheduledMessageMaxActive {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("No more than %d active scheduled messages allowed", scheduledMessageMaxActive)})
+		return
+	}
+
+	schedule := ScheduledMessage{UserID: userID, Timezone: "UTC", Status: "active"}
+	if status, err := applyScheduledMessageInput(&schedule, &req, time.Now()); err != nil {
+		respondScheduledMessageError(c, status, err)
+		return
+	}
+
+	if err := db.Create(&schedule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create scheduled message"})
+		return
+	}
+
+	go LogAuditViaGRPC(userID, "scheduled_message_created", "scheduled_message", strconv.FormatUint(uint64(schedule.ID), 10), "messages",
+		fmt.Sprintf("cron=%q next_run_at=%s", schedule.CronExpr, schedule.NextRunAt.Format(time.RFC3339)), c.ClientIP(), c.Request.UserAgent())
+
+	c.JSON(http.StatusCreated, schedule)
+}
+
+func getScheduledMessageHandler(c *gin.Context) {
+	schedule, ok := loadOwnScheduledMessage(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, schedule)
+}
+
+func updateScheduledMessageHandler(c *gin.Context) {
+	schedule, ok := loadOwnScheduledMessage(c)
+	if !ok {
+		return
+	}
+	if schedule.Status != "active" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only active scheduled messages can be edited"})
+		return
+	}
+
+	var req scheduledMessageInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	claimedAt := schedule.NextRunAt
+	if status, err := applyScheduledMessageInput(schedule, &req, time.Now()); err != nil {
+		respondScheduledMessageError(c, status, err)
+		return
+	}
+
+	// Guard on the previous next_run_at so an edit never races with the
+	// scheduler claiming the same occurrence.
+	res := db.Model(&ScheduledMessage{}).
+		Where("id = ? AND status = ? AND next_run_at = ?", schedule.ID, "active", claimedAt).
+		Updates(map[string]interface{}{
+			"channel_id":   schedule.ChannelID,
+			"recipient_id": schedule.RecipientID,
+			"content":      schedule.Content,
+			"run_at":       schedule.RunAt,
+			"cron_expr":    schedule.CronExpr,
+			"timezone":     schedule.Timezone,
+			"next_run_at":  schedule.NextRunAt,
+			"last_error":   "",
+		})
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update scheduled message"})
+		return
+	}
+	if res.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Scheduled message is being delivered, try again"})
+		return
+	}
+
+	db.First(schedule, schedule.ID)
+	c.JSON(http.StatusOK, schedule)
+}
+
+func cancelScheduledMessageHandler(c *gin.Context) {
+	schedule, ok := loadOwnScheduledMessage(c)
+	if !ok {
+		return
+	}
+	if schedule.Status != "active" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Scheduled message is not active"})
+		return
+	}
+
+	db.Model(&ScheduledMessage{}).Where("id = ? AND status = ?", schedule.ID, "active").Updates(map[string]interface{}{
+		"status":      "cancelled",
+		"next_run_at": nil,
+	})
+
+	go LogAuditViaGRPC(schedule.UserID, "scheduled_message_cancelled", "scheduled_message", strconv.FormatUint(uint64(schedule.ID), 10), "messages",
+		"", c.ClientIP(), c.Request.UserAgent())
+
+	c.JSON(http.StatusOK, gin.H{"message": "Scheduled message cancelled"})
+}
+
+func getScheduledMessageRunsHandler(c *gin.Context) {
+	schedule, ok := loadOwnScheduledMessage(c)
+	if !ok {
+		return
+	}
+
+	var runs []ScheduledMessageRun
+	db.Where("schedule_id = ?", schedule.ID).Order("run_at DESC").Limit(100).Find(&runs)
+	c.JSON(http.StatusOK, runs)
+}
+
+func loadOwnScheduledMessage(c *gin.Context) (*ScheduledMessage, bool) {
+	userIDRaw, _ := c.Get("user_id")
+	userID, _ := extractUserID(userIDRaw)
+
+	var schedule ScheduledMessage
+	if err := db.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&schedule).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scheduled message not found"})
+		return nil, false
+	}
+	return &schedule, true
+}
+
+func respondScheduledMessageError(c *gin.Context, status int, err error) {
+	var forbidden *forbiddenContentError
+	if errors.As(err, &forbidden) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":         "Message contains forbidden content",
+			"matched_words": forbidden.MatchedWords,
+			"blocked":       true,
+		})
+		return
+	}
+	c.JSON(status, gin.H{"error": err.Error()})
+}
+
+// applyScheduledMessageInput merges the request into schedule, validates the
+// result and recomputes NextRunAt. Fields missing from the request keep their
+// current values, so the same code serves create and edit.
+func applyScheduledMessageInput(schedule *ScheduledMessage, req *scheduledMessageInput, now time.Time) (int, error) {
+	if req.ChannelID != nil || req.RecipientID != nil {
+		schedule.ChannelID = req.ChannelID
+		schedule.RecipientID = req.RecipientID
+	}
+	if req.Content != nil {
+		schedule.Content = strings.TrimSpace(*req.Content)
+	}
+	if req.Timezone != nil {
+		schedule.Timezone = strings.TrimSpace(*req.Timezone)
+		if schedule.Timezone == "" {
+			schedule.Timezone = "UTC"
+		}
+	}
+
+	loc, err := time.LoadLocation(schedule.Timezone)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("unknown timezone %q", schedule.Timezone)
+	}
+
+	if req.CronExpr != nil && strings.TrimSpace(*req.CronExpr) != "" &&
+		req.RunAt != nil && strings.TrimSpace(*req.RunAt) != "" {
+		return http.StatusBadRequest, errors.New("set either run_at or cron_expr, not both")
+	}
+	if req.CronExpr != nil {
+		schedule.CronExpr = strings.TrimSpace(*req.CronExpr)
+		if schedule.CronExpr != "" {
+			schedule.RunAt = nil
+		}
+	}
+	if req.RunAt != nil {
+		schedule.RunAt = nil
+		if value := strings.TrimSpace(*req.RunAt); value != "" {
+			runAt, err := parseScheduledTime(value, loc)
+			if err != nil {
+				return http.StatusBadRequest, errors.New("invalid run_at, use RFC3339 or YYYY-MM-DDTHH:MM")
+			}
+			schedule.RunAt = &runAt
+			schedule.CronExpr = ""
+		}
+	}
+
+	if schedule.Content == "" {
+		return http.StatusBadRequest, errors.New("content is required")
+	}
+	if utf8.RuneCountInString(schedule.Content) > scheduledMessageMaxLength {
+		return http.StatusBadRequest, fmt.Errorf("content must be at most %d characters", scheduledMessageMaxLength)
+	}
+	if err := checkScheduledMessageTarget(schedule); err != nil {
+		if errors.Is(err, errScheduleUndeliverable) {
+			return http.StatusForbidden, err
+		}
+		return http.StatusBadRequest, err
+	}
+	context := "channel_message"
+	if schedule.RecipientID != nil {
+		context = "direct_message"
+	}
+	if err := filterMessageContent(schedule.Content, schedule.UserID, context); err != nil {
+		return http.StatusForbidden, err
+	}
+
+	switch {
+	case schedule.CronExpr != "":
+		sched, err := parseScheduleCron(schedule.CronExpr)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		first := sched.Next(now.In(loc))
+		if first.IsZero() {
+			return http.StatusBadRequest, errors.New("cron_expr never fires")
+		}
+		if sched.Next(first).Sub(first) < scheduledMessageMinInterval {
+			return http.StatusBadRequest, fmt.Errorf("recurring messages may fire at most every %s", scheduledMessageMinInterval)
+		}
+		schedule.NextRunAt = &first
+	case schedule.RunAt != nil:
+		if !schedule.RunAt.After(now) {
+			return http.StatusBadRequest, errors.New("run_at must be in the future")
+		}
+		if schedule.RunAt.After(now.Add(scheduledMessageMaxAhead)) {
+			return http.StatusBadRequest, errors.New("run_at is too far in the future")
+		}
+		runAt := *schedule.RunAt
+		schedule.NextRunAt = &runAt
+	default:
+		return http.StatusBadRequest, errors.New("run_at or cron_expr is required")
+	}
+
+	return http.StatusOK, nil
+}
+
+// parseScheduledTime accepts RFC3339 or a wall-clock time in loc.
+func parseScheduledTime(value string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("invalid time")
+}
+
+// parseScheduleCron parses a standard five-field expression or a descriptor
+// such as @daily. The time zone comes from the schedule, not the expression.
+func parseScheduleCron(expr string) (cron.Schedule, error) {
+	if strings.Contains(expr, "TZ=") {
+		return nil, errors.New("set the timezone field instead of TZ= in cron_expr")
+	}
+	if strings.HasPrefix(expr, "@every") {
+		return nil, errors.New("@every is not supported, use a calendar expression")
+	}
+	sched, err := cron.ParseStandard(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cron_expr: %v", err)
+	}
+	return sched, nil
+}
+
+// checkScheduledMessageTarget verifies the author may still post to the target.
+// Permission problems wrap errScheduleUndeliverable.
+func checkScheduledMessageTarget(schedule *ScheduledMessage) error {
+	if (schedule.ChannelID == nil) == (schedule.RecipientID == nil) {
+		return errors.New("exactly one of channel_id or recipient_id is required")
+	}
+
+	if schedule.ChannelID != nil {
+		var channel Channel
+		if err := db.First(&channel, *schedule.ChannelID).Error; err != nil {
+			return fmt.Errorf("%w: channel not found", errScheduleUndeliverable)
+		}
+		if !hasChannelAccess(schedule.UserID, channel) {
+			return fmt.Errorf("%w: no access to this channel", errScheduleUndeliverable)
+		}
+		return nil
+	}
+
+	if *schedule.RecipientID == schedule.UserID {
+		return errors.New("cannot schedule a message to yourself")
+	}
+	var recipient User
+	if err := db.First(&recipient, *schedule.RecipientID).Error; err != nil || recipient.Status == "deleted" {
+		return fmt.Errorf("%w: recipient not found", errScheduleUndeliverable)
+	}
+	var blocked int64
+	db.Model(&BlockedUser{}).Where("user_id = ? AND blocked_user_id = ?", recipient.ID, schedule.UserID).Count(&blocked)
+	if blocked > 0 {
+		return fmt.Errorf("%w: recipient does not accept messages from you", errScheduleUndeliverable)
+	}
+	return nil
+}
+
+func processDueScheduledMessages() {
+	now := time.Now()
+	var due []ScheduledMessage
+	if err := db.Where("status = ? AND next_run_at <= ?", "active", now).
+		Order("next_run_at ASC").Limit(scheduledMessageBatch).Find(&due).Error; err != nil {
+		log.Printf("[Scheduler] Failed to load due messages: %v", err)
+		return
+	}
+
+	for i := range due {
+		runScheduledMessage(&due[i], now)
+	}
+}
+
+// runScheduledMessage delivers one occurrence. Advancing next_run_at, writing
+// the run record and inserting the message happen in one transaction guarded
+// by the old next_run_at, so concurrent workers or a crash mid-delivery can
+// never post the same occurrence twice. WebSocket fan-out follows the commit.
+func runScheduledMessage(schedule *ScheduledMessage, now time.Time) {
+	runAt := *schedule.NextRunAt
+	updates := map[string]interface{}{
+		"last_run_at": now,
+		"run_count":   gorm.Expr("run_count + 1"),
+		"last_error":  "",
+	}
+	if schedule.CronExpr != "" {
+		next, err := nextScheduledRun(schedule, now)
+		if err != nil {
+			updates["status"] = "failed"
+			updates["next_run_at"] = nil
+			updates["last_error"] = err.Error()
+		} else {
+			updates["next_run_at"] = next
+		}
+	} else {
+		updates["status"] = "completed"
+		updates["next_run_at"] = nil
+	}
+
+	run := ScheduledMessageRun{ScheduleID: schedule.ID, RunAt: runAt, Status: "sent"}
+	var publish func()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if schedule.CronExpr != "" && now.Sub(runAt) > scheduledMessageMaxLag {
+			run.Status = "skipped"
+			run.Error = fmt.Sprintf("missed by %s", now.Sub(runAt).Round(time.Minute))
+		} else {
+			var err error
+			publish, err = deliverScheduledMessage(tx, schedule, &run)
+			if err != nil {
+				var forbidden *forbiddenContentError
+				if !errors.Is(err, errScheduleUndeliverable) && !errors.As(err, &forbidden) {
+					return err
+				}
+				run.Status = "failed"
+				run.Error = err.Error()
+				updates["last_error"] = err.Error()
+				if schedule.CronExpr == "" {
+					updates["status"] = "failed"
+				}
+			}
+		}
+
+		res := tx.Model(&ScheduledMessage{}).
+			Where("id = ? AND status = ? AND next_run_at = ?", schedule.ID, "active", runAt).
+			Updates(updates)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errScheduleClaimed
+		}
+		return tx.Create(&run).Error
+	})
+	if errors.Is(err, errScheduleClaimed) {
+		return
+	}
+	if err != nil {
+		log.Printf("[Scheduler] Scheduled message %d will be retried: %v", schedule.ID, err)
+		return
+	}
+
+	if publish != nil {
+		publish()
+	}
+	if run.Status == "failed" {
+		log.Printf("[Scheduler] Scheduled message %d failed: %s", schedule.ID, run.Error)
+		go createNotificationHandler(schedule.UserID, "scheduled_message_failed",
+			fmt.Sprintf("Scheduled message could not be sent: %s", run.Error))
+	}
+}
+
+// deliverScheduledMessage inserts the message through the regular creation
+// path and returns the fan-out to run after commit.
+func deliverScheduledMessage(tx *gorm.DB, schedule *ScheduledMessage, run *ScheduledMessageRun) (func(), error) {
+	if err := checkScheduledMessageTarget(schedule); err != nil {
+		if errors.Is(err, errScheduleUndeliverable) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %w", errScheduleUndeliverable, err)
+	}
+
+	if schedule.ChannelID != nil {
+		var channel Channel
+		if err := tx.First(&channel, *schedule.ChannelID).Error; err != nil {
+			return nil, err
+		}
+		msg, err := createChannelMessage(tx, schedule.UserID, channel, schedule.Content, nil)
+		if err != nil {
+			return nil, err
+		}
+		run.MessageID = &msg.ID
+		return func() { publishChannelMessage(channel, msg) }, nil
+	}
+
+	message := DirectMessage{
+		SenderID:   schedule.UserID,
+		ReceiverID: *schedule.RecipientID,
+		Content:    schedule.Content,
+	}
+	if err := createDirectMessage(tx, &message); err != nil {
+		return nil, err
+	}
+	run.DirectMessageID = &message.ID
+	return func() { publishDirectMessage(&message) }, nil
+}
+
+// nextScheduledRun returns the first occurrence of a recurring schedule after
+// now, evaluated in the schedule's time zone so DST shifts are respected.
+func nextScheduledRun(schedule *ScheduledMessage, now time.Time) (*time.Time, error) {
+	loc, err := time.LoadLocation(schedule.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	sched, err := parseScheduleCron(schedule.CronExpr)
+	if err != nil {
+		return nil, err
+	}
+	next := sched.Next(now.In(loc))
+	if next.IsZero() {
+		return nil, errors.New("cron_expr never fires")
+	}
+	return &next, nil
+}
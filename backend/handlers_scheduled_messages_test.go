@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// Workers that loaded the same due schedule race to run it; exactly one of
+// them delivers the occurrence.
+func TestRunScheduledMessageClaimsOnce(t *testing.T) {
+	for _, cronExpr := range []string{"", "*/5 * * * *"} {
+		testDB(t, &User{}, &BlockedUser{}, &ForbiddenWord{}, &DirectMessage{}, &ScheduledMessage{},
+			&ScheduledMessageRun{}, &UserSettings{}, &TelegramNotification{})
+		alice := User{Username: "alice", Password: "x"}
+		bob := User{Username: "bob", Password: "x"}
+		db.Create(&alice)
+		db.Create(&bob)
+		due := time.Now().Add(-time.Second).Truncate(time.Second)
+		schedule := ScheduledMessage{
+			UserID: alice.ID, RecipientID: &bob.ID, Content: "standup", CronExpr: cronExpr,
+			Timezone: "UTC", NextRunAt: &due, Status: "active",
+		}
+		if cronExpr == "" {
+			schedule.RunAt = &due
+		}
+		db.Create(&schedule)
+
+		const workers = 8
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for i := 0; i < workers; i++ {
+			var loaded ScheduledMessage
+			db.First(&loaded, schedule.ID)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				runScheduledMessage(&loaded, time.Now())
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		var messages, runs int64
+		db.Model(&DirectMessage{}).Where("sender_id = ? AND receiver_id = ?", alice.ID, bob.ID).Count(&messages)
+		db.Model(&ScheduledMessageRun{}).Where("schedule_id = ?", schedule.ID).Count(&runs)
+		if messages != 1 || runs != 1 {
+			t.Errorf("cron %q: %d messages and %d runs, want one each", cronExpr, messages, runs)
+		}
+		var after ScheduledMessage
+		db.First(&after, schedule.ID)
+		if after.RunCount != 1 {
+			t.Errorf("cron %q: run_count = %d", cronExpr, after.RunCount)
+		}
+		if cronExpr == "" && (after.Status != "completed" || after.NextRunAt != nil) {
+			t.Errorf("one-off schedule = %+v", after)
+		}
+		if cronExpr != "" && (after.Status != "active" || after.NextRunAt == nil || !after.NextRunAt.After(due)) {
+			t.Errorf("recurring schedule = %+v", after)
+		}
+	}
+}
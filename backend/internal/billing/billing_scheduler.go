@@ -97,7 +97,7 @@ func (bs *BillingScheduler) chargePlan(ctx context.Context, sub *Subscription) e
 		sub.UserID,
 		sub.PlanID,
 		fmt.Sprintf("%.2f", plan.Price),
-		fmt.Sprintf("Monthly subscription renewal - %s", plan.Name),
+		fmt.Sprintf("Subscription renewal - %s", plan.Name),
 		"https://example.com/billing/success",
 	)
 	if err != nil {
@@ -106,7 +106,7 @@ func (bs *BillingScheduler) chargePlan(ctx context.Context, sub *Subscription) e
 
 	// Update subscription period
 	newStart := sub.CurrentPeriodEnd
-	newEnd := newStart.AddDate(0, 1, 0) // Add 1 month
+	newEnd := nextPeriodEnd(newStart, plan.BillingCycle)
 
 	if err := bs.db.Model(sub).Updates(map[string]interface{}{
 		"current_period_start": newStart,
@@ -119,3 +119,14 @@ func (bs *BillingScheduler) chargePlan(ctx context.Context, sub *Subscription) e
 	log.Printf("Charged subscription %d for plan %d", sub.ID, sub.PlanID)
 	return nil
 }
+
+// nextPeriodEnd advances start by one billing cycle of the plan.
+func nextPeriodEnd(start time.Time, cycle string) time.Time {
+	switch cycle {
+	case "annual":
+		return start.AddDate(1, 0, 0)
+	case "quarterly":
+		return start.AddDate(0, 3, 0)
+	}
+	return start.AddDate(0, 1, 0)
+}
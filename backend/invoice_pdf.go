@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+// A minimal PDF writer for invoices. Text is set in the Go fonts, embedded
+// whole as CID TrueType fonts so Cyrillic renders without system fonts and
+// stays searchable through a ToUnicode map.
+
+const (
+	pdfPageWidth  = 595.28 // A4 in points
+	pdfPageHeight = 841.89
+)
+
+type pdfFont struct {
+	name string
+	raw  []byte
+	sfnt *sfnt.Font
+
+	mu     sync.Mutex
+	buf    sfnt.Buffer
+	glyphs map[rune]sfnt.GlyphIndex
+	widths map[sfnt.GlyphIndex]int
+}
+
+var (
+	invoiceFontsOnce            sync.Once
+	invoiceRegular, invoiceBold *pdfFont
+	invoiceFontErr              error
+)
+
+func loadInvoiceFonts() (*pdfFont, *pdfFont, error) {
+	invoiceFontsOnce.Do(func() {
+		invoiceRegular, invoiceFontErr = newPDFFont("GoRegular", goregular.TTF)
+		if invoiceFontErr == nil {
+			invoiceBold, invoiceFontErr = newPDFFont("GoBold", gobold.TTF)
+		}
+	})
+	return invoiceRegular, invoiceBold, invoiceFontErr
+}
+
+func newPDFFont(name string, raw []byte) (*pdfFont, error) {
+	f, err := sfnt.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &pdfFont{name: name, raw: raw, sfnt: f, glyphs: map[rune]sfnt.GlyphIndex{}, widths: map[sfnt.GlyphIndex]int{}}, nil
+}
+
+// glyph returns the glyph for r and its advance in 1/1000 em. Runes the font
+// lacks are drawn as '?'.
+func (f *pdfFont) glyph(r rune) (sfnt.GlyphIndex, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.glyphLocked(r)
+}
+
+func (f *pdfFont) glyphLocked(r rune) (sfnt.GlyphIndex, int) {
+	if g, ok := f.glyphs[r]; ok {
+		return g, f.widths[g]
+	}
+	g, err := f.sfnt.GlyphIndex(&f.buf, r)
+	if (err != nil || g == 0) && r != '?' {
+		// Not cached under r, so the ToUnicode map keeps '?' for it
+		return f.glyphLocked('?')
+	}
+	adv, err := f.sfnt.GlyphAdvance(&f.buf, g, fixed.I(1000), font.HintingNone)
+	if err != nil {
+		adv = fixed.I(500)
+	}
+	f.glyphs[r] = g
+	f.widths[g] = adv.Round()
+	return g, f.widths[g]
+}
+
+// textWidth is the width of s in points at size.
+func (f *pdfFont) textWidth(s string, size float64) float64 {
+	total := 0
+	for _, r := range s {
+		_, w := f.glyph(r)
+		total += w
+	}
+	return float64(total) * size / 1000
+}
+
+func (f *pdfFont) encode(s string) string {
+	var b strings.Builder
+	b.WriteByte('<')
+	for _, r := range s {
+		g, _ := f.glyph(r)
+		fmt.Fprintf(&b, "%04X", uint16(g))
+	}
+	b.WriteByte('>')
+	return b.String()
+}
+
+// pdfPage collects drawing operators for one page.
+type pdfPage struct {
+	content bytes.Buffer
+	fonts   map[*pdfFont]string
+}
+
+func (p *pdfPage) text(f *pdfFont, size, x, y float64, s string) {
+	fmt.Fprintf(&p.content, "BT /%s %.2f Tf %.2f %.2f Td %s Tj ET\n", p.fonts[f], size, x, y, f.encode(s))
+}
+
+// textRight draws s so that it ends at x.
+func (p *pdfPage) textRight(f *pdfFont, size, x, y float64, s string) {
+	p.text(f, size, x-f.textWidth(s, size), y, s)
+}
+
+func (p *pdfPage) line(x1, y1, x2, y2, width float64) {
+	fmt.Fprintf(&p.content, "%.2f w %.2f %.2f m %.2f %.2f l S\n", width, x1, y1, x2, y2)
+}
+
+func (p *pdfPage) rect(x, y, w, h, width float64) {
+	fmt.Fprintf(&p.content, "%.2f w %.2f %.2f %.2f %.2f re S\n", width, x, y, w, h)
+}
+
+type pdfDocument struct {
+	title string
+	fonts []*pdfFont
+	pages []*pdfPage
+}
+
+func newPDFDocument(title string, fonts ...*pdfFont) *pdfDocument {
+	return &pdfDocument{title: title, fonts: fonts}
+}
+
+func (d *pdfDocument) newPage() *pdfPage {
+	p := &pdfPage{fonts: map[*pdfFont]string{}}
+	for i, f := range d.fonts {
+		p.fonts[f] = fmt.Sprintf("F%d", i+1)
+	}
+	d.pages = append(d.pages, p)
+	return p
+}
+
+func pdfDeflate(data []byte) []byte {
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	w.Write(data)
+	w.Close()
+	return b.Bytes()
+}
+
+// pdfString escapes s as a PDF text string in UTF-16BE.
+func pdfString(s string) string {
+	var b strings.Builder
+	b.WriteString("<FEFF")
+	for _, u := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&b, "%04X", u)
+	}
+	b.WriteByte('>')
+	return b.String()
+}
+
+// Bytes serialises the document. Fonts only list the glyphs that were used.
+func (d *pdfDocument) Bytes() []byte {
+	var out bytes.Buffer
+	var offsets []int
+	// Object numbers: 1 catalog, 2 pages, 3 info, then fonts (5 objects
+	// each), then a content stream and a page object per page.
+	fontBase := 4
+	pageBase := fontBase + 5*len(d.fonts)
+
+	object := func(body string, stream []byte) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\n", len(offsets), body)
+		if stream != nil {
+			out.WriteString("stream\n")
+			out.Write(stream)
+			out.WriteString("\nendstream\n")
+		}
+		out.WriteString("endobj\n")
+	}
+
+	out.WriteString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	var kids []string
+	for i := range d.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", pageBase+2*i+1))
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>", nil)
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)), nil)
+	object(fmt.Sprintf("<< /Title %s /Producer (Nemaks) /CreationDate (D:%s) >>", pdfString(d.title), time.Now().UTC().Format("20060102150405Z")), nil)
+
+	var fontRefs []string
+	for i, f := range d.fonts {
+		n := fontBase + 5*i
+		fontRefs = append(fontRefs, fmt.Sprintf("/F%d %d 0 R", i+1, n))
+		d.writeFont(f, n, object)
+	}
+
+	resources := fmt.Sprintf("<< /Font << %s >> >>", strings.Join(fontRefs, " "))
+	for _, p := range d.pages {
+		stream := pdfDeflate(p.content.Bytes())
+		object(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>", len(stream)), stream)
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources %s /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, resources, len(offsets)), nil)
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info 3 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
+
+// writeFont emits a Type0 font as objects n..n+4: the font, its CID font,
+// descriptor, font file and ToUnicode map.
+func (d *pdfDocument) writeFont(f *pdfFont, n int, object func(string, []byte)) {
+	f.mu.Lock()
+	type used struct {
+		gid sfnt.GlyphIndex
+		r   rune
+	}
+	var glyphs []used
+	seen := map[sfnt.GlyphIndex]bool{}
+	for r, g := range f.glyphs {
+		if !seen[g] {
+			seen[g] = true
+			glyphs = append(glyphs, used{g, r})
+		}
+	}
+	sort.Slice(glyphs, func(i, j int) bool { return glyphs[i].gid < glyphs[j].gid })
+	var widths strings.Builder
+	for _, u := range glyphs {
+		fmt.Fprintf(&widths, "%d [%d] ", u.gid, f.widths[u.gid])
+	}
+	metrics, _ := f.sfnt.Metrics(&f.buf, fixed.I(1000), font.HintingNone)
+	bounds, _ := f.sfnt.Bounds(&f.buf, fixed.I(1000), font.HintingNone)
+	f.mu.Unlock()
+
+	object(fmt.Sprintf("<< /Type /Font /Subtype /Type0 /BaseFont /%s /Encoding /Identity-H /DescendantFonts [%d 0 R] /ToUnicode %d 0 R >>",
+		f.name, n+1, n+4), nil)
+	object(fmt.Sprintf("<< /Type /Font /Subtype /CIDFontType2 /BaseFont /%s /CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >> /FontDescriptor %d 0 R /CIDToGIDMap /Identity /DW 500 /W [%s] >>",
+		f.name, n+2, widths.String()), nil)
+	object(fmt.Sprintf("<< /Type /FontDescriptor /FontName /%s /Flags 32 /FontBBox [%d %d %d %d] /ItalicAngle 0 /Ascent %d /Descent %d /CapHeight %d /StemV 80 /FontFile2 %d 0 R >>",
+		f.name, bounds.Min.X.Round(), -bounds.Max.Y.Round(), bounds.Max.X.Round(), -bounds.Min.Y.Round(),
+		metrics.Ascent.Round(), -metrics.Descent.Round(), metrics.CapHeight.Round(), n+3), nil)
+	fontFile := pdfDeflate(f.raw)
+	object(fmt.Sprintf("<< /Length %d /Length1 %d /Filter /FlateDecode >>", len(fontFile), len(f.raw)), fontFile)
+
+	var cmap bytes.Buffer
+	cmap.WriteString("/CIDInit /ProcSet findresource begin\n12 dict begin\nbegincmap\n")
+	cmap.WriteString("/CIDSystemInfo << /Registry (Adobe) /Ordering (UCS) /Supplement 0 >> def\n")
+	cmap.WriteString("/CMapName /Adobe-Identity-UCS def\n/CMapType 2 def\n")
+	cmap.WriteString("1 begincodespacerange\n<0000> <FFFF>\nendcodespacerange\n")
+	for start := 0; start < len(glyphs); start += 100 {
+		end := min(start+100, len(glyphs))
+		fmt.Fprintf(&cmap, "%d beginbfchar\n", end-start)
+		for _, u := range glyphs[start:end] {
+			fmt.Fprintf(&cmap, "<%04X> <", uint16(u.gid))
+			for _, c := range utf16.Encode([]rune{u.r}) {
+				fmt.Fprintf(&cmap, "%04X", c)
+			}
+			cmap.WriteString(">\n")
+		}
+		cmap.WriteString("endbfchar\n")
+	}
+	cmap.WriteString("endcmap\nCMapName currentdict /CMap defineresource pop\nend\nend\n")
+	object(fmt.Sprintf("<< /Length %d >>", cmap.Len()), cmap.Bytes())
+}
+
+// wrapText splits s into lines no wider than width points.
+func wrapText(f *pdfFont, size, width float64, s string) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(s, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			candidate := word
+			if line != "" {
+				candidate = line + " " + word
+			}
+			if line != "" && f.textWidth(candidate, size) > width {
+				lines = append(lines, line)
+				candidate = word
+			}
+			// Words longer than the column are cut by rune
+			for f.textWidth(candidate, size) > width && len([]rune(candidate)) > 1 {
+				runes := []rune(candidate)
+				cut := len(runes) - 1
+				for cut > 1 && f.textWidth(string(runes[:cut]), size) > width {
+					cut--
+				}
+				lines = append(lines, string(runes[:cut]))
+				candidate = string(runes[cut:])
+			}
+			line = candidate
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,835 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Invoice is a numbered bill (счёт) for a user or an org. Amounts are
+// kopecks and include VAT when a rate applies.
+type Invoice struct {
+	ID            uint          `gorm:"primaryKey" json:"id"`
+	Number        string        `gorm:"uniqueIndex;size:40" json:"number"`
+	OrgID         *int          `gorm:"index" json:"org_id,omitempty"`
+	UserID        *uint         `gorm:"index" json:"user_id,omitempty"`
+	TransactionID *uint         `gorm:"index" json:"transaction_id,omitempty"`
+	Status        string        `gorm:"size:20;default:'issued';index" json:"status"` // issued, paid, refunded, void
+	Currency      string        `gorm:"size:3;default:'RUB'" json:"currency"`
+	VATRate       string        `gorm:"size:10" json:"vat_rate"` // none, 0, 5, 7, 10, 20, 22
+	TotalKopecks  int64         `json:"total_kopecks"`
+	VATKopecks    int64         `json:"vat_kopecks"`
+	BuyerName     string        `json:"buyer_name"`
+	BuyerINN      string        `gorm:"size:12" json:"buyer_inn,omitempty"`
+	BuyerKPP      string        `gorm:"size:9" json:"buyer_kpp,omitempty"`
+	BuyerAddress  string        `json:"buyer_address,omitempty"`
+	BuyerEmail    string        `json:"buyer_email,omitempty"`
+	PeriodStart   *time.Time    `json:"period_start,omitempty"`
+	PeriodEnd     *time.Time    `json:"period_end,omitempty"`
+	IssuedAt      time.Time     `json:"issued_at"`
+	DueAt         *time.Time    `json:"due_at,omitempty"`
+	PaidAt        *time.Time    `json:"paid_at,omitempty"`
+	CreatedAt     time.Time     `json:"created_at"`
+	UpdatedAt     time.Time     `json:"updated_at"`
+	Lines         []InvoiceLine `gorm:"foreignKey:InvoiceID" json:"lines,omitempty"`
+
+	// Metered usage billed by this invoice, closed when it is issued.
+	usage              []orgUsageLine
+	usageFrom, usageTo time.Time
+	// The org's promo code redemption this invoice discounts.
+	promoUsage *PromoCodeUsage
+}
+
+type InvoiceLine struct {
+	ID               uint    `gorm:"primaryKey" json:"id"`
+	InvoiceID        uint    `gorm:"index" json:"invoice_id"`
+	Position         int     `json:"position"`
+	Kind             string  `gorm:"size:30" json:"kind"` // plan, seat, discount, overage, proration, premium, gift, boost
+	Description      string  `json:"description"`
+	Quantity         float64 `json:"quantity"`
+	Unit             string  `gorm:"size:30" json:"unit"`
+	UnitPriceKopecks int64   `json:"unit_price_kopecks"`
+	AmountKopecks    int64   `json:"amount_kopecks"`
+	VATKopecks       int64   `json:"vat_kopecks"`
+}
+
+// InvoiceCounter hands out invoice numbers, one sequence per year.
+type InvoiceCounter struct {
+	Year int `gorm:"primaryKey;autoIncrement:false"`
+	Last int
+}
+
+// vatRates maps BILLING_VAT_RATE values to percentages and YooKassa
+// vat_code values for VAT-inclusive prices.
+var vatRates = map[string]struct {
+	percent      int64
+	yookassaCode int
+}{
+	"none": {0, 1},
+	"0":    {0, 2},
+	"10":   {10, 3},
+	"20":   {20, 4},
+	"5":    {5, 7},
+	"7":    {7, 8},
+	"22":   {22, 11},
+}
+
+func billingVATRate() string {
+	rate := strings.TrimSuffix(strings.TrimSpace(os.Getenv("BILLING_VAT_RATE")), "%")
+	if _, ok := vatRates[rate]; !ok {
+		return "none"
+	}
+	return rate
+}
+
+// includedVAT is the VAT contained in a VAT-inclusive amount, rounded half
+// up to the kopeck.
+func includedVAT(amount int64, rate string) int64 {
+	pct := vatRates[rate].percent
+	if pct == 0 || amount <= 0 {
+		return 0
+	}
+	return (amount*pct*2 + 100 + pct) / (2 * (100 + pct))
+}
+
+// finalizeInvoice numbers the lines and fills in amounts, VAT and totals.
+func finalizeInvoice(inv *Invoice) {
+	if inv.VATRate == "" {
+		inv.VATRate = billingVATRate()
+	}
+	inv.TotalKopecks, inv.VATKopecks = 0, 0
+	for i := range inv.Lines {
+		l := &inv.Lines[i]
+		l.Position = i + 1
+		if l.AmountKopecks == 0 {
+			l.AmountKopecks = int64(math.Round(float64(l.UnitPriceKopecks) * l.Quantity))
+		}
+		l.VATKopecks = includedVAT(l.AmountKopecks, inv.VATRate)
+		inv.TotalKopecks += l.AmountKopecks
+		inv.VATKopecks += l.VATKopecks
+	}
+}
+
+func nextInvoiceNumber(tx *gorm.DB, issuedAt time.Time) (string, error) {
+	year := issuedAt.Year()
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&InvoiceCounter{Year: year}).Error; err != nil {
+		return "", err
+	}
+	var counter InvoiceCounter
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&counter, "year = ?", year).Error; err != nil {
+		return "", err
+	}
+	counter.Last++
+	if err := tx.Model(&InvoiceCounter{}).Where("year = ?", year).Update("last", counter.Last).Error; err != nil {
+		return "", err
+	}
+	prefix := os.Getenv("BILLING_INVOICE_PREFIX")
+	if prefix == "" {
+		prefix = "NMX"
+	}
+	return fmt.Sprintf("%s-%d-%06d", prefix, year, counter.Last), nil
+}
+
+// issueInvoice numbers and stores inv with its lines.
+func issueInvoice(tx *gorm.DB, inv *Invoice) error {
+	if len(inv.Lines) == 0 {
+		return errors.New("an invoice needs at least one line")
+	}
+	if inv.IssuedAt.IsZero() {
+		inv.IssuedAt = time.Now()
+	}
+	if inv.Status == "" {
+		inv.Status = "issued"
+	}
+	finalizeInvoice(inv)
+	number, err := nextInvoiceNumber(tx, inv.IssuedAt)
+	if err != nil {
+		return err
+	}
+	inv.Number = number
+	if err := tx.Create(inv).Error; err != nil {
+		return err
+	}
+	if inv.promoUsage != nil {
+		var discount int64
+		for _, l := range inv.Lines {
+			if l.Kind == "discount" {
+				discount -= l.AmountKopecks
+			}
+		}
+		err := tx.Model(&PromoCodeUsage{}).Where("id = ? AND invoice_id IS NULL", inv.promoUsage.ID).Updates(map[string]interface{}{
+			"invoice_id":   inv.ID,
+			"discount_rub": float64(discount) / 100,
+			"amount_rub":   float64(inv.TotalKopecks) / 100,
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	if inv.usage != nil && inv.OrgID != nil {
+		return closeOrgUsage(tx, *inv.OrgID, inv.usageFrom, inv.usageTo, inv.usage, inv.ID)
+	}
+	return nil
+}
+
+// ensureTransactionInvoice returns the invoice of a PremiumTransaction,
+// issuing it on first use.
+func ensureTransactionInvoice(tx *gorm.DB, t *PremiumTransaction, description string) (*Invoice, error) {
+	var inv Invoice
+	err := tx.Preload("Lines").Where("transaction_id = ?", t.ID).First(&inv).Error
+	if err == nil {
+		return &inv, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	var user User
+	tx.Select("id", "username", "email").First(&user, t.UserID)
+	if description == "" {
+		description = t.Description
+	}
+	kind := "premium"
+	switch {
+	case strings.HasPrefix(t.Description, "Gift:"):
+		kind = "gift"
+	case strings.HasPrefix(t.Description, "Post boost:"):
+		kind = "boost"
+	}
+	userID, transactionID := t.UserID, t.ID
+	inv = Invoice{
+		UserID:        &userID,
+		TransactionID: &transactionID,
+		Currency:      ledgerCurrency(t.Currency),
+		BuyerName:     user.Username,
+		Lines: []InvoiceLine{{
+			Kind:             kind,
+			Description:      description,
+			Quantity:         1,
+			Unit:             "шт.",
+			UnitPriceKopecks: rubToKopecks(t.AmountRub),
+		}},
+	}
+	if user.Email != nil {
+		inv.BuyerEmail = *user.Email
+	}
+	if err := issueInvoice(tx, &inv); err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// setTransactionInvoiceStatus follows the transaction's payment state.
+func setTransactionInvoiceStatus(tx *gorm.DB, transactionID uint, status string, at time.Time) error {
+	updates := map[string]interface{}{"status": status}
+	if status == "paid" {
+		updates["paid_at"] = at
+	}
+	return tx.Model(&Invoice{}).Where("transaction_id = ? AND status <> ?", transactionID, "void").Updates(updates).Error
+}
+
+// orgInvoiceMonths is the number of months a billing period covers.
+func orgInvoiceMonths(billingPeriod string) int {
+	switch billingPeriod {
+	case "annual":
+		return 12
+	case "quarterly":
+		return 3
+	}
+	return 1
+}
+
+// buildOrgInvoice prices the org's active subscription for the period
+// starting at periodStart: the base plan and seats in advance, and storage
+// overage for the calendar month before it in arrears.
+func buildOrgInvoice(orgID int, periodStart time.Time) (*Invoice, error) {
+	var sub OrgSubscription
+	if err := db.Where("org_id = ? AND status IN ?", orgID, orgServingStatuses).First(&sub).Error; err != nil {
+		return nil, errors.New("no active subscription")
+	}
+	return buildOrgSubscriptionInvoice(db, &sub, periodStart)
+}
+
+// buildOrgSubscriptionInvoice prices sub's plan and seats through tx, so a
+// caller holding the subscription's row lock sees its own updates.
+func buildOrgSubscriptionInvoice(tx *gorm.DB, sub *OrgSubscription, periodStart time.Time) (*Invoice, error) {
+	orgID := sub.OrgID
+	var plan SubscriptionPlan
+	if err := tx.First(&plan, sub.PlanID).Error; err != nil {
+		return nil, errors.New("subscription plan not found")
+	}
+	months := orgInvoiceMonths(sub.BillingPeriod)
+	periodEnd := periodStart.AddDate(0, months, 0).Add(-time.Second)
+	orgIDCopy := orgID
+	inv := &Invoice{OrgID: &orgIDCopy, PeriodStart: &periodStart, PeriodEnd: &periodEnd, Currency: "RUB"}
+
+	if plan.BasePriceRub > 0 {
+		inv.Lines = append(inv.Lines, InvoiceLine{
+			Kind:             "plan",
+			Description:      fmt.Sprintf("Тариф «%s»", plan.Name),
+			Quantity:         float64(months),
+			Unit:             "мес.",
+			UnitPriceKopecks: rubToKopecks(plan.BasePriceRub),
+		})
+	}
+
+	var seatPrices []SeatPricing
+	tx.Where("plan_id = ? AND is_active = true AND is_billable = true", plan.ID).Order("id").Find(&seatPrices)
+	for _, sp := range seatPrices {
+		var active int64
+		tx.Model(&OrgMember{}).Where("org_id = ? AND seat_type = ? AND state = 'active'", orgID, sp.SeatType).Count(&active)
+		seats := int(active)
+		switch sp.SeatType {
+		case "student_editor":
+			seats = max(seats, sub.SeatsStudentEditor)
+		case "staff":
+			seats = max(seats, sub.SeatsStaff)
+		}
+		seats = max(seats, sp.MinSeats)
+		if sp.MaxSeats != nil && seats > *sp.MaxSeats {
+			seats = *sp.MaxSeats
+		}
+		if seats == 0 || sp.PricePerMonthRub <= 0 {
+			continue
+		}
+		description := sp.Description
+		if description == "" {
+			description = "Места: " + sp.SeatType
+		}
+		inv.Lines = append(inv.Lines, InvoiceLine{
+			Kind:             "seat",
+			Description:      fmt.Sprintf("%s (%d × %d мес.)", description, seats, months),
+			Quantity:         float64(seats * months),
+			Unit:             "место·мес.",
+			UnitPriceKopecks: rubToKopecks(sp.PricePerMonthRub),
+		})
+	}
+
+	if usage, promo := pendingOrgPromo(orgID); promo != nil {
+		if line, ok := orgPromoLine(promo, inv.Lines, months); ok {
+			inv.Lines = append(inv.Lines, line)
+			inv.promoUsage = usage
+		}
+	}
+
+	// Usage of the previous period is billed once, on the first invoice
+	// after it ends.
+	usageFrom, usageTo := periodStart.AddDate(0, -months, 0), periodStart
+	if !orgUsageClosed(orgID, usageFrom) {
+		inv.usage = computeOrgUsage(orgID, plan, usageFrom, usageTo, months)
+		inv.usageFrom, inv.usageTo = usageFrom, usageTo
+		inv.Lines = append(inv.Lines, orgUsageOverageLines(inv.usage, usageFrom, usageTo)...)
+	}
+
+	if len(inv.Lines) == 0 {
+		return nil, errors.New("nothing to bill for this period")
+	}
+	return inv, nil
+}
+
+// YooKassaReceipt is the 54-FZ receipt sent with a payment.
+type YooKassaReceipt struct {
+	Customer struct {
+		FullName string `json:"full_name,omitempty"`
+		INN      string `json:"inn,omitempty"`
+		Email    string `json:"email,omitempty"`
+		Phone    string `json:"phone,omitempty"`
+	} `json:"customer"`
+	Items         []YooKassaReceiptItem `json:"items"`
+	TaxSystemCode int                   `json:"tax_system_code,omitempty"`
+}
+
+type YooKassaReceiptItem struct {
+	Description string `json:"description"`
+	Quantity    string `json:"quantity"`
+	Amount      struct {
+		Value    string `json:"value"`
+		Currency string `json:"currency"`
+	} `json:"amount"`
+	VATCode        int    `json:"vat_code"`
+	PaymentMode    string `json:"payment_mode"`
+	PaymentSubject string `json:"payment_subject"`
+}
+
+func formatYooKassaAmount(kopecks int64) string {
+	return fmt.Sprintf("%d.%02d", kopecks/100, kopecks%100)
+}
+
+// yookassaReceiptItems turns invoice lines into receipt items. Lines whose
+// unit price does not multiply out exactly (fractional quantities) are sent
+// as a single unit so the receipt adds up to the payment.
+func yookassaReceiptItems(lines []InvoiceLine, vatRate, currency, subject string) []YooKassaReceiptItem {
+	items := make([]YooKassaReceiptItem, 0, len(lines))
+	for _, l := range lines {
+		item := YooKassaReceiptItem{
+			Description:    l.Description,
+			Quantity:       strconv.FormatFloat(l.Quantity, 'f', -1, 64),
+			VATCode:        vatRates[vatRate].yookassaCode,
+			PaymentMode:    "full_payment",
+			PaymentSubject: subject,
+		}
+		if r := []rune(item.Description); len(r) > 128 {
+			item.Description = string(r[:128])
+		}
+		unit := l.UnitPriceKopecks
+		if float64(unit)*l.Quantity != float64(l.AmountKopecks) {
+			item.Quantity = "1"
+			unit = l.AmountKopecks
+		}
+		item.Amount.Value = formatYooKassaAmount(unit)
+		item.Amount.Currency = ledgerCurrency(currency)
+		items = append(items, item)
+	}
+	return items
+}
+
+// newYooKassaReceipt builds a receipt, or returns nil when receipts are
+// disabled (YOOKASSA_RECEIPTS=0) or there is no contact to send it to.
+// YOOKASSA_RECEIPT_EMAIL is used for buyers without an email.
+func newYooKassaReceipt(email string, items []YooKassaReceiptItem) *YooKassaReceipt {
+	if os.Getenv("YOOKASSA_RECEIPTS") == "0" || len(items) == 0 {
+		return nil
+	}
+	if email == "" {
+		email = os.Getenv("YOOKASSA_RECEIPT_EMAIL")
+	}
+	if email == "" {
+		return nil
+	}
+	receipt := &YooKassaReceipt{Items: items}
+	receipt.Customer.Email = email
+	receipt.TaxSystemCode, _ = strconv.Atoi(os.Getenv("YOOKASSA_TAX_SYSTEM_CODE"))
+	return receipt
+}
+
+// yookassaReceiptForTransaction issues the transaction's invoice if needed
+// and returns the matching receipt.
+func yookassaReceiptForTransaction(transactionID uint, description string) *YooKassaReceipt {
+	var t PremiumTransaction
+	if err := db.First(&t, transactionID).Error; err != nil {
+		log.Printf("[Billing] No receipt for transaction %d: %v", transactionID, err)
+		return nil
+	}
+	inv, err := ensureTransactionInvoice(db, &t, description)
+	if err != nil {
+		log.Printf("[Billing] Failed to issue invoice for transaction %d: %v", transactionID, err)
+		return nil
+	}
+	receipt := newYooKassaReceipt(inv.BuyerEmail, yookassaReceiptItems(inv.Lines, inv.VATRate, inv.Currency, "service"))
+	if receipt == nil && os.Getenv("YOOKASSA_RECEIPTS") != "0" {
+		log.Printf("[Billing] Transaction %d has no receipt contact", transactionID)
+	}
+	return receipt
+}
+
+// yookassaReceiptForDonation describes a donation; the platform collects it
+// on the creator's behalf, so it is not a service of ours.
+func yookassaReceiptForDonation(donationID uint) *YooKassaReceipt {
+	var donation CreatorDonation
+	if err := db.First(&donation, donationID).Error; err != nil {
+		log.Printf("[Billing] No receipt for donation %d: %v", donationID, err)
+		return nil
+	}
+	email := ""
+	if donation.FromUserID != nil {
+		var user User
+		if db.Select("id", "email").First(&user, *donation.FromUserID).Error == nil && user.Email != nil {
+			email = *user.Email
+		}
+	}
+	lines := []InvoiceLine{{Description: "Донат автору", Quantity: 1, UnitPriceKopecks: rubToKopecks(donation.AmountRub), AmountKopecks: rubToKopecks(donation.AmountRub)}}
+	return newYooKassaReceipt(email, yookassaReceiptItems(lines, "none", "RUB", "another"))
+}
+
+// invoiceSeller holds the seller's requisites for printed invoices.
+type invoiceSeller struct {
+	Name, INN, KPP, Address, Bank string
+}
+
+func billingSeller() invoiceSeller {
+	name := os.Getenv("BILLING_SELLER_NAME")
+	if name == "" {
+		name = "Nemaks"
+	}
+	return invoiceSeller{
+		Name:    name,
+		INN:     os.Getenv("BILLING_SELLER_INN"),
+		KPP:     os.Getenv("BILLING_SELLER_KPP"),
+		Address: os.Getenv("BILLING_SELLER_ADDRESS"),
+		Bank:    os.Getenv("BILLING_SELLER_BANK"),
+	}
+}
+
+// formatRub prints kopecks as "1 234,56".
+func formatRub(kopecks int64) string {
+	sign := ""
+	if kopecks < 0 {
+		sign, kopecks = "-", -kopecks
+	}
+	whole := strconv.FormatInt(kopecks/100, 10)
+	var b strings.Builder
+	for i, r := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteRune(' ')
+		}
+		b.WriteRune(r)
+	}
+	return fmt.Sprintf("%s%s,%02d", sign, b.String(), kopecks%100)
+}
+
+func formatQuantity(q float64) string {
+	return strings.Replace(strconv.FormatFloat(q, 'f', -1, 64), ".", ",", 1)
+}
+
+// renderInvoicePDF prints the invoice on A4 pages.
+func renderInvoicePDF(inv *Invoice, seller invoiceSeller) ([]byte, error) {
+	regular, bold, err := loadInvoiceFonts()
+	if err != nil {
+		return nil, err
+	}
+	doc := newPDFDocument("Счёт "+inv.Number, regular, bold)
+	const left, right = 40.0, pdfPageWidth - 40
+	page := doc.newPage()
+	y := pdfPageHeight - 60
+
+	para := func(f *pdfFont, size float64, s string) {
+		for _, line := range wrapText(f, size, right-left, s) {
+			page.text(f, size, left, y, line)
+			y -= size * 1.35
+		}
+	}
+
+	para(bold, 16, fmt.Sprintf("Счёт № %s от %s", inv.Number, inv.IssuedAt.Format("02.01.2006")))
+	y -= 8
+	sellerLine := "Поставщик: " + seller.Name
+	if seller.INN != "" {
+		sellerLine += ", ИНН " + seller.INN
+	}
+	if seller.KPP != "" {
+		sellerLine += ", КПП " + seller.KPP
+	}
+	if seller.Address != "" {
+		sellerLine += ", " + seller.Address
+	}
+	para(regular, 10, sellerLine)
+	if seller.Bank != "" {
+		para(regular, 10, "Банковские реквизиты: "+seller.Bank)
+	}
+	y -= 4
+	buyerLine := "Покупатель: " + inv.BuyerName
+	if inv.BuyerINN != "" {
+		buyerLine += ", ИНН " + inv.BuyerINN
+	}
+	if inv.BuyerKPP != "" {
+		buyerLine += ", КПП " + inv.BuyerKPP
+	}
+	if inv.BuyerAddress != "" {
+		buyerLine += ", " + inv.BuyerAddress
+	}
+	if inv.BuyerEmail != "" {
+		buyerLine += ", " + inv.BuyerEmail
+	}
+	para(regular, 10, buyerLine)
+	if inv.PeriodStart != nil && inv.PeriodEnd != nil {
+		para(regular, 10, fmt.Sprintf("Период: %s – %s", inv.PeriodStart.Format("02.01.2006"), inv.PeriodEnd.Format("02.01.2006")))
+	}
+	y -= 10
+
+	// Column right edges: №, description, quantity, unit, price, amount
+	cols := []float64{left + 24, left + 270, left + 330, left + 395, left + 455, right}
+	header := func() {
+		page.line(left, y+12, right, y+12, 0.8)
+		page.text(bold, 9, left+4, y, "№")
+		page.text(bold, 9, cols[0]+4, y, "Наименование")
+		page.textRight(bold, 9, cols[2]-4, y, "Кол-во")
+		page.text(bold, 9, cols[2]+4, y, "Ед.")
+		page.textRight(bold, 9, cols[4]-4, y, "Цена")
+		page.textRight(bold, 9, cols[5]-4, y, "Сумма")
+		y -= 6
+		page.line(left, y, right, y, 0.8)
+		y -= 12
+	}
+	header()
+	for _, l := range inv.Lines {
+		desc := wrapText(regular, 9, cols[1]-cols[0]-8, l.Description)
+		height := float64(len(desc)) * 12
+		if y-height < 120 {
+			page = doc.newPage()
+			y = pdfPageHeight - 60
+			header()
+		}
+		page.text(regular, 9, left+4, y, strconv.Itoa(l.Position))
+		for i, line := range desc {
+			page.text(regular, 9, cols[0]+4, y-float64(i)*12, line)
+		}
+		page.textRight(regular, 9, cols[2]-4, y, formatQuantity(l.Quantity))
+		page.text(regular, 9, cols[2]+4, y, l.Unit)
+		page.textRight(regular, 9, cols[4]-4, y, formatRub(l.UnitPriceKopecks))
+		page.textRight(regular, 9, cols[5]-4, y, formatRub(l.AmountKopecks))
+		y -= height
+		page.line(left, y+8, right, y+8, 0.3)
+		y -= 4
+	}
+
+	y -= 8
+	page.textRight(bold, 10, right, y, "Итого: "+formatRub(inv.TotalKopecks)+" "+inv.Currency)
+	y -= 14
+	vatLine := "Без НДС"
+	if pct := vatRates[inv.VATRate].percent; pct > 0 || inv.VATRate == "0" {
+		vatLine = fmt.Sprintf("В том числе НДС %d%%: %s %s", pct, formatRub(inv.VATKopecks), inv.Currency)
+	}
+	page.textRight(regular, 10, right, y, vatLine)
+	y -= 16
+	page.textRight(bold, 12, right, y, "Всего к оплате: "+formatRub(inv.TotalKopecks)+" "+inv.Currency)
+	y -= 24
+	switch inv.Status {
+	case "paid":
+		if inv.PaidAt != nil {
+			para(bold, 10, "Оплачен "+inv.PaidAt.Format("02.01.2006"))
+		}
+	case "void":
+		para(bold, 10, "Счёт аннулирован")
+	case "refunded":
+		para(bold, 10, "Оплата возвращена")
+	}
+	if inv.DueAt != nil && inv.Status == "issued" {
+		para(regular, 10, "Оплатить до "+inv.DueAt.Format("02.01.2006"))
+	}
+	if inv.OrgID != nil {
+		para(regular, 9, "В назначении платежа укажите номер счёта.")
+	}
+	return doc.Bytes(), nil
+}
+
+// canManageOrgBilling allows org admins and platform admins.
+func canManageOrgBilling(uid uint, orgID int) bool {
+	var count int64
+	db.Model(&OrgMember{}).Where("org_id = ? AND user_id = ? AND org_role = 'admin' AND state = 'active'", orgID, uid).Count(&count)
+	if count > 0 {
+		return true
+	}
+	return isBillingAdmin(uid)
+}
+
+func isBillingAdmin(uid uint) bool {
+	var user User
+	if db.Select("id", "role").First(&user, uid).Error == nil && user.Role == "admin" {
+		return true
+	}
+	return hasGlobalRole(uid, "admin")
+}
+
+func getMyInvoicesHandler(c *gin.Context) {
+	uid, ok := getUserIDFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	var invoices []Invoice
+	db.Preload("Lines").Where("user_id = ? AND org_id IS NULL", uid).Order("issued_at DESC").Limit(100).Find(&invoices)
+	c.JSON(http.StatusOK, gin.H{"invoices": invoices})
+}
+
+func getInvoicePDFHandler(c *gin.Context) {
+	uid, ok := getUserIDFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	var inv Invoice
+	if err := db.Preload("Lines", func(tx *gorm.DB) *gorm.DB { return tx.Order("position") }).First(&inv, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+		return
+	}
+	allowed := inv.UserID != nil && *inv.UserID == uid
+	if !allowed && inv.OrgID != nil {
+		allowed = canManageOrgBilling(uid, *inv.OrgID)
+	}
+	if !allowed && !isBillingAdmin(uid) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+		return
+	}
+	writeInvoicePDF(c, &inv)
+}
+
+func getOrgInvoicePDFHandler(c *gin.Context) {
+	uid, _ := getUserIDFromContext(c)
+	orgID := parseInt(c.Param("id"))
+	if !canManageOrgBilling(uid, orgID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Org admin access required"})
+		return
+	}
+	var inv Invoice
+	if err := db.Preload("Lines", func(tx *gorm.DB) *gorm.DB { return tx.Order("position") }).
+		Where("org_id = ?", orgID).First(&inv, c.Param("invoiceId")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+		return
+	}
+	writeInvoicePDF(c, &inv)
+}
+
+func writeInvoicePDF(c *gin.Context, inv *Invoice) {
+	pdf, err := renderInvoicePDF(inv, billingSeller())
+	if err != nil {
+		log.Printf("[Billing] Failed to render invoice %s: %v", inv.Number, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render invoice"})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="invoice-%s.pdf"`, inv.Number))
+	c.Data(http.StatusOK, "application/pdf", pdf)
+}
+
+func getOrgInvoicesHandler(c *gin.Context) {
+	uid, _ := getUserIDFromContext(c)
+	orgID := parseInt(c.Param("id"))
+	if !canManageOrgBilling(uid, orgID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Org admin access required"})
+		return
+	}
+	var invoices []Invoice
+	db.Preload("Lines").Where("org_id = ?", orgID).Order("issued_at DESC").Limit(100).Find(&invoices)
+	c.JSON(http.StatusOK, gin.H{"invoices": invoices})
+}
+
+// createOrgInvoiceHandler issues the invoice for a billing period
+// ("YYYY-MM", the current month by default). A period is only invoiced once
+// unless the earlier invoice was voided.
+func createOrgInvoiceHandler(c *gin.Context) {
+	uid, _ := getUserIDFromContext(c)
+	orgID := parseInt(c.Param("id"))
+	if !canManageOrgBilling(uid, orgID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Org admin access required"})
+		return
+	}
+	var req struct {
+		Period       string `json:"period"`
+		BuyerName    string `json:"buyer_name"`
+		BuyerINN     string `json:"buyer_inn"`
+		BuyerKPP     string `json:"buyer_kpp"`
+		BuyerAddress string `json:"buyer_address"`
+		BuyerEmail   string `json:"buyer_email"`
+		DueDays      int    `json:"due_days"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.BuyerINN != "" && !validINN(req.BuyerINN) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid INN"})
+		return
+	}
+
+	now := time.Now()
+	periodStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if req.Period != "" {
+		p, err := time.Parse("2006-01", req.Period)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "period must be YYYY-MM"})
+			return
+		}
+		periodStart = p
+	}
+
+	var org Org
+	if err := db.First(&org, orgID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+		return
+	}
+	var existing Invoice
+	if db.Where("org_id = ? AND period_start = ? AND status <> ?", orgID, periodStart, "void").First(&existing).Error == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Period already invoiced", "invoice": existing})
+		return
+	}
+
+	inv, err := buildOrgInvoice(orgID, periodStart)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	inv.BuyerName = req.BuyerName
+	if inv.BuyerName == "" {
+		inv.BuyerName = org.Name
+	}
+	inv.BuyerINN, inv.BuyerKPP, inv.BuyerAddress, inv.BuyerEmail = req.BuyerINN, req.BuyerKPP, req.BuyerAddress, req.BuyerEmail
+	if req.DueDays <= 0 {
+		req.DueDays = 10
+	}
+	due := now.AddDate(0, 0, req.DueDays)
+	inv.DueAt = &due
+	inv.UserID = &uid
+
+	if err := db.Transaction(func(tx *gorm.DB) error { return issueInvoice(tx, inv) }); err != nil {
+		log.Printf("[Billing] Failed to issue invoice for org %d: %v", orgID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue invoice"})
+		return
+	}
+	c.JSON(http.StatusCreated, inv)
+}
+
+// validINN checks the length and control digits of a 10- or 12-digit INN.
+func validINN(inn string) bool {
+	digits := make([]int, len(inn))
+	for i, r := range inn {
+		if r < '0' || r > '9' {
+			return false
+		}
+		digits[i] = int(r - '0')
+	}
+	check := func(weights []int) int {
+		sum := 0
+		for i, w := range weights {
+			sum += w * digits[i]
+		}
+		return sum % 11 % 10
+	}
+	switch len(inn) {
+	case 10:
+		return check([]int{2, 4, 10, 3, 5, 9, 4, 6, 8}) == digits[9]
+	case 12:
+		return check([]int{7, 2, 4, 10, 3, 5, 9, 4, 6, 8}) == digits[10] &&
+			check([]int{3, 7, 2, 4, 10, 3, 5, 9, 4, 6, 8}) == digits[11]
+	}
+	return false
+}
+
+func voidInvoiceHandler(c *gin.Context) {
+	var inv Invoice
+	if err := db.First(&inv, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+		return
+	}
+	if inv.Status != "issued" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only unpaid invoices can be voided"})
+		return
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&inv).Update("status", "void").Error; err != nil {
+			return err
+		}
+		// Reopen the usage and promo code it billed so the next invoice
+		// picks them up again
+		err := tx.Model(&PromoCodeUsage{}).Where("invoice_id = ?", inv.ID).
+			Updates(map[string]interface{}{"invoice_id": nil, "discount_rub": 0, "amount_rub": 0}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("invoice_id = ?", inv.ID).Delete(&OrgUsagePeriod{}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to void invoice"})
+		return
+	}
+	uid, _ := getUserIDFromContext(c)
+	logExtendedAudit(uid, "invoice_void", "invoice", strconv.FormatUint(uint64(inv.ID), 10), "admin", inv.Number, c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusOK, inv)
+}
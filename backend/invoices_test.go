@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInvoiceVAT(t *testing.T) {
+	tests := []struct {
+		amount int64
+		rate   string
+		want   int64
+	}{
+		{12000, "20", 2000},
+		{12200, "22", 2200},
+		{100, "20", 17}, // 16.67
+		{11000, "10", 1000},
+		{10000, "none", 0},
+		{10000, "0", 0},
+		{-100, "20", 0},
+	}
+	for _, tc := range tests {
+		if got := includedVAT(tc.amount, tc.rate); got != tc.want {
+			t.Errorf("includedVAT(%d, %s) = %d, want %d", tc.amount, tc.rate, got, tc.want)
+		}
+	}
+
+	inv := &Invoice{VATRate: "20", Lines: []InvoiceLine{
+		{Quantity: 3, UnitPriceKopecks: 19900},
+		{Quantity: 1.5, UnitPriceKopecks: 5001},
+	}}
+	finalizeInvoice(inv)
+	if inv.Lines[0].AmountKopecks != 59700 || inv.Lines[1].AmountKopecks != 7502 {
+		t.Fatalf("line amounts = %d, %d", inv.Lines[0].AmountKopecks, inv.Lines[1].AmountKopecks)
+	}
+	if inv.TotalKopecks != 67202 || inv.VATKopecks != 9950+1250 {
+		t.Fatalf("total = %d, vat = %d", inv.TotalKopecks, inv.VATKopecks)
+	}
+	if inv.Lines[1].Position != 2 {
+		t.Fatalf("position = %d", inv.Lines[1].Position)
+	}
+}
+
+func TestYooKassaReceiptItems(t *testing.T) {
+	lines := []InvoiceLine{
+		{Description: "Места", Quantity: 3, UnitPriceKopecks: 19900, AmountKopecks: 59700},
+		{Description: strings.Repeat("я", 200), Quantity: 1.5, UnitPriceKopecks: 5001, AmountKopecks: 7502},
+	}
+	items := yookassaReceiptItems(lines, "22", "rub", "service")
+	if items[0].Quantity != "3" || items[0].Amount.Value != "199.00" || items[0].Amount.Currency != "RUB" || items[0].VATCode != 11 {
+		t.Errorf("item 0 = %+v", items[0])
+	}
+	// Fractional quantities collapse to one unit so the receipt adds up
+	if items[1].Quantity != "1" || items[1].Amount.Value != "75.02" {
+		t.Errorf("item 1 = %+v", items[1])
+	}
+	if n := len([]rune(items[1].Description)); n != 128 {
+		t.Errorf("description has %d characters", n)
+	}
+
+	t.Setenv("YOOKASSA_RECEIPT_EMAIL", "")
+	if r := newYooKassaReceipt("", items); r != nil {
+		t.Errorf("receipt without contact = %+v", r)
+	}
+	t.Setenv("YOOKASSA_RECEIPT_EMAIL", "receipts@example.com")
+	t.Setenv("YOOKASSA_TAX_SYSTEM_CODE", "2")
+	r := newYooKassaReceipt("", items)
+	if r == nil || r.Customer.Email != "receipts@example.com" || r.TaxSystemCode != 2 {
+		t.Errorf("receipt = %+v", r)
+	}
+	t.Setenv("YOOKASSA_RECEIPTS", "0")
+	if r := newYooKassaReceipt("user@example.com", items); r != nil {
+		t.Errorf("disabled receipts = %+v", r)
+	}
+}
+
+func TestValidINN(t *testing.T) {
+	for inn, want := range map[string]bool{
+		"7707083893":   true,
+		"7707083894":   false,
+		"500100732259": true,
+		"500100732250": false,
+		"77070838":     false,
+		"770708389a":   false,
+	} {
+		if got := validINN(inn); got != want {
+			t.Errorf("validINN(%s) = %v", inn, got)
+		}
+	}
+}
+
+func TestFormatRub(t *testing.T) {
+	for k, want := range map[int64]string{0: "0,00", 5: "0,05", 19900: "199,00", 123456789: "1 234 567,89", -1050: "-10,50"} {
+		if got := formatRub(k); got != want {
+			t.Errorf("formatRub(%d) = %q, want %q", k, got, want)
+		}
+	}
+}
+
+func TestRenderInvoicePDF(t *testing.T) {
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0).Add(-time.Second)
+	inv := &Invoice{
+		Number:      "NMX-2026-000042",
+		Status:      "issued",
+		Currency:    "RUB",
+		VATRate:     "22",
+		BuyerName:   "ГБОУ Школа № 1",
+		BuyerINN:    "7707083893",
+		PeriodStart: &start,
+		PeriodEnd:   &end,
+		IssuedAt:    start,
+	}
+	for i := 0; i < 60; i++ {
+		inv.Lines = append(inv.Lines, InvoiceLine{Description: "Места учеников с длинным названием позиции " + strconv.Itoa(i), Quantity: 2, Unit: "место·мес.", UnitPriceKopecks: 15000})
+	}
+	finalizeInvoice(inv)
+
+	pdf, err := renderInvoicePDF(inv, invoiceSeller{Name: "ООО «Немакс»", INN: "7707083893"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF-")) || !bytes.HasSuffix(bytes.TrimSpace(pdf), []byte("%%EOF")) {
+		t.Fatal("not a PDF file")
+	}
+	if !bytes.Contains(pdf, []byte("/ToUnicode")) {
+		t.Error("fonts have no ToUnicode map")
+	}
+	if pages := regexp.MustCompile(`/Type\s*/Page\b`).FindAll(pdf, -1); len(pages) < 2 {
+		t.Errorf("got %d pages, want the table to break across pages", len(pages))
+	}
+
+	// startxref must point at the xref table
+	m := regexp.MustCompile(`startxref\s+(\d+)`).FindSubmatch(pdf)
+	if m == nil {
+		t.Fatal("no startxref")
+	}
+	off, _ := strconv.Atoi(string(m[1]))
+	if off >= len(pdf) || !bytes.HasPrefix(pdf[off:], []byte("xref")) {
+		t.Fatalf("startxref %d does not point at xref", off)
+	}
+}
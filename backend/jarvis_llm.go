@@ -0,0 +1,795 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LLM providers used by Jarvis. Every backend implements LLMProvider; a
+// request is served by an llmChain that tries providers in order and skips
+// the ones whose circuit breaker is open. Credentials travel with the
+// provider value, so a user's own key never leaks into other requests.
+
+// LLMProvider is a chat-completion backend.
+type LLMProvider interface {
+	// Name is the provider family: openai, deepseek, huggingface or ollama.
+	Name() string
+	// Key identifies the backend for circuit breaking (family, endpoint,
+	// model and whether the key is the user's or the system's).
+	Key() string
+	Model() string
+	Complete(ctx context.Context, req LLMRequest) (*LLMResponse, error)
+	// Stream calls onDelta for every chunk of generated text and returns the
+	// full response with usage. If the stream breaks after it started, the
+	// partial response is returned together with the error so the tokens
+	// already spent can still be accounted for.
+	Stream(ctx context.Context, req LLMRequest, onDelta func(string) error) (*LLMResponse, error)
+}
+
+type LLMRequest struct {
+	Messages    []ChatMessage
+	MaxTokens   int
+	Temperature float64
+	// Tools are offered to the model on Complete. Providers without function
+	// calling ignore them and answer in text.
+	Tools []ChatTool
+}
+
+type LLMResponse struct {
+	Content          string
+	ToolCalls        []ChatToolCall
+	Provider         string
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+}
+
+// llmProviderConfig is shared by all implementations.
+type llmProviderConfig struct {
+	Name    string
+	BaseURL string
+	APIKey  string
+	Model   string
+	Timeout time.Duration
+	UserKey bool
+	Client  *http.Client
+}
+
+func (c llmProviderConfig) key() string {
+	source := "system"
+	if c.UserKey {
+		source = "user"
+	}
+	return c.Name + "|" + c.BaseURL + "|" + c.Model + "|" + source
+}
+
+func (c llmProviderConfig) httpClient() *http.Client {
+	if c.Client != nil {
+		return c.Client
+	}
+	return http.DefaultClient
+}
+
+// withTimeout bounds a single upstream call by the provider's own timeout.
+func (c llmProviderConfig) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.Timeout)
+}
+
+func (c llmProviderConfig) postJSON(ctx context.Context, url string, body interface{}) (*http.Response, error) {
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(jsonBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &APIError{StatusCode: resp.StatusCode, Message: string(body)}
+	}
+	return resp, nil
+}
+
+// OpenAI-compatible chat completions (OpenAI, DeepSeek and any gateway that
+// speaks POST {base}/chat/completions).
+type openAICompatibleProvider struct {
+	llmProviderConfig
+}
+
+func newOpenAICompatibleProvider(cfg llmProviderConfig) *openAICompatibleProvider {
+	cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+	return &openAICompatibleProvider{cfg}
+}
+
+func (p *openAICompatibleProvider) Name() string  { return p.llmProviderConfig.Name }
+func (p *openAICompatibleProvider) Key() string   { return p.key() }
+func (p *openAICompatibleProvider) Model() string { return p.llmProviderConfig.Model }
+
+func (p *openAICompatibleProvider) Complete(ctx context.Context, req LLMRequest) (*LLMResponse, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	resp, err := p.postJSON(ctx, p.BaseURL+"/chat/completions", ChatCompletionRequest{
+		Model:       p.llmProviderConfig.Model,
+		Messages:    req.Messages,
+		MaxTokens:   req.MaxTokens,
+		Temperature: req.Temperature,
+		Stream:      false,
+		Tools:       req.Tools,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result ChatCompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if len(result.Choices) == 0 {
+		return nil, errors.New("empty completion")
+	}
+
+	out := &LLMResponse{
+		Content:          result.Choices[0].Message.Content,
+		ToolCalls:        result.Choices[0].Message.ToolCalls,
+		Provider:         p.Name(),
+		Model:            p.llmProviderConfig.Model,
+		PromptTokens:     result.Usage.PromptTokens,
+		CompletionTokens: result.Usage.CompletionTokens,
+		TotalTokens:      result.Usage.TotalTokens,
+	}
+	if out.TotalTokens == 0 {
+		out.TotalTokens = out.PromptTokens + out.CompletionTokens
+	}
+	return out, nil
+}
+
+func (p *openAICompatibleProvider) Stream(ctx context.Context, req LLMRequest, onDelta func(string) error) (*LLMResponse, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	resp, err := p.postJSON(ctx, p.BaseURL+"/chat/completions", ChatCompletionRequest{
+		Model:         p.llmProviderConfig.Model,
+		Messages:      req.Messages,
+		MaxTokens:     req.MaxTokens,
+		Temperature:   req.Temperature,
+		Stream:        true,
+		StreamOptions: &ChatStreamOptions{IncludeUsage: true},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	out := &LLMResponse{Provider: p.Name(), Model: p.llmProviderConfig.Model}
+	var content strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+			Usage *struct {
+				PromptTokens     int `json:"prompt_tokens"`
+				CompletionTokens int `json:"completion_tokens"`
+				TotalTokens      int `json:"total_tokens"`
+			} `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return finishLLMStream(out, req, content.String()), err
+		}
+		if chunk.Usage != nil {
+			out.PromptTokens = chunk.Usage.PromptTokens
+			out.CompletionTokens = chunk.Usage.CompletionTokens
+			out.TotalTokens = chunk.Usage.TotalTokens
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content == "" {
+				continue
+			}
+			content.WriteString(choice.Delta.Content)
+			if err := onDelta(choice.Delta.Content); err != nil {
+				return finishLLMStream(out, req, content.String()), err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return finishLLMStream(out, req, content.String()), err
+	}
+	if content.Len() == 0 {
+		return nil, errors.New("empty completion")
+	}
+	return finishLLMStream(out, req, content.String()), nil
+}
+
+// finishLLMStream fills in the text and, when the upstream did not report
+// usage, an estimate of it.
+func finishLLMStream(out *LLMResponse, req LLMRequest, content string) *LLMResponse {
+	out.Content = content
+	if out.TotalTokens == 0 {
+		if out.PromptTokens == 0 {
+			for _, m := range req.Messages {
+				out.PromptTokens += estimateTokens(m.Content)
+			}
+		}
+		if out.CompletionTokens == 0 {
+			out.CompletionTokens = estimateTokens(content)
+		}
+		out.TotalTokens = out.PromptTokens + out.CompletionTokens
+	}
+	return out
+}
+
+// estimateTokens approximates token usage at ~4 characters per token for
+// backends that do not report it.
+func estimateTokens(s string) int {
+	return (len(s) + 3) / 4
+}
+
+// HuggingFace text-generation inference API.
+type huggingFaceProvider struct {
+	llmProviderConfig
+}
+
+func (p *huggingFaceProvider) Name() string  { return p.llmProviderConfig.Name }
+func (p *huggingFaceProvider) Key() string   { return p.key() }
+func (p *huggingFaceProvider) Model() string { return p.llmProviderConfig.Model }
+
+func (p *huggingFaceProvider) Complete(ctx context.Context, req LLMRequest) (*LLMResponse, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	prompt := ""
+	for _, msg := range req.Messages {
+		switch msg.Role {
+		case "system":
+			prompt += msg.Content + "\n\n"
+		case "user":
+			prompt += "User: " + msg.Content + "\n"
+		case "assistant":
+			if msg.Content != "" {
+				prompt += "Assistant: " + msg.Content + "\n"
+			}
+		case "tool":
+			prompt += "Tool result: " + msg.Content + "\n"
+		}
+	}
+	prompt += "Assistant: "
+
+	maxTokens := req.MaxTokens
+	if maxTokens == 0 {
+		maxTokens = 1024
+	}
+	resp, err := p.postJSON(ctx, strings.TrimRight(p.BaseURL, "/")+"/models/"+p.llmProviderConfig.Model, map[string]interface{}{
+		"inputs": prompt,
+		"parameters": map[string]interface{}{
+			"max_new_tokens":   maxTokens,
+			"temperature":      req.Temperature,
+			"return_full_text": false,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var hfResp []struct {
+		GeneratedText string `json:"generated_text"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&hfResp); err != nil {
+		return nil, err
+	}
+	if len(hfResp) == 0 || hfResp[0].GeneratedText == "" {
+		return nil, errors.New("empty completion")
+	}
+
+	// The inference API does not report usage
+	promptTokens := estimateTokens(prompt)
+	completionTokens := estimateTokens(hfResp[0].GeneratedText)
+	return &LLMResponse{
+		Content:          hfResp[0].GeneratedText,
+		Provider:         p.Name(),
+		Model:            p.llmProviderConfig.Model,
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+	}, nil
+}
+
+// Stream falls back to a single chunk: the inference API answers in one piece.
+func (p *huggingFaceProvider) Stream(ctx context.Context, req LLMRequest, onDelta func(string) error) (*LLMResponse, error) {
+	resp, err := p.Complete(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp, onDelta(resp.Content)
+}
+
+// Local Ollama server (POST {base}/api/chat).
+type ollamaProvider struct {
+	llmProviderConfig
+}
+
+func (p *ollamaProvider) Name() string  { return p.llmProviderConfig.Name }
+func (p *ollamaProvider) Key() string   { return p.key() }
+func (p *ollamaProvider) Model() string { return p.llmProviderConfig.Model }
+
+func (p *ollamaProvider) Complete(ctx context.Context, req LLMRequest) (*LLMResponse, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	options := map[string]interface{}{"temperature": req.Temperature}
+	if req.MaxTokens > 0 {
+		options["num_predict"] = req.MaxTokens
+	}
+	body := map[string]interface{}{
+		"model":    p.llmProviderConfig.Model,
+		"messages": ollamaMessages(req.Messages),
+		"stream":   false,
+		"options":  options,
+	}
+	if len(req.Tools) > 0 {
+		body["tools"] = req.Tools
+	}
+	resp, err := p.postJSON(ctx, strings.TrimRight(p.BaseURL, "/")+"/api/chat", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Message struct {
+			Content   string `json:"content"`
+			ToolCalls []struct {
+				Function struct {
+					Name      string          `json:"name"`
+					Arguments json.RawMessage `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"message"`
+		PromptEvalCount int `json:"prompt_eval_count"`
+		EvalCount       int `json:"eval_count"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.Message.Content == "" && len(result.Message.ToolCalls) == 0 {
+		return nil, errors.New("empty completion")
+	}
+
+	// Ollama has no call ids and passes arguments as an object
+	var toolCalls []ChatToolCall
+	for i, tc := range result.Message.ToolCalls {
+		call := ChatToolCall{ID: fmt.Sprintf("call_%d", i), Type: "function"}
+		call.Function.Name = tc.Function.Name
+		call.Function.Arguments = string(tc.Function.Arguments)
+		toolCalls = append(toolCalls, call)
+	}
+
+	return &LLMResponse{
+		Content:          result.Message.Content,
+		ToolCalls:        toolCalls,
+		Provider:         p.Name(),
+		Model:            p.llmProviderConfig.Model,
+		PromptTokens:     result.PromptEvalCount,
+		CompletionTokens: result.EvalCount,
+		TotalTokens:      result.PromptEvalCount + result.EvalCount,
+	}, nil
+}
+
+func (p *ollamaProvider) Stream(ctx context.Context, req LLMRequest, onDelta func(string) error) (*LLMResponse, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	options := map[string]interface{}{"temperature": req.Temperature}
+	if req.MaxTokens > 0 {
+		options["num_predict"] = req.MaxTokens
+	}
+	resp, err := p.postJSON(ctx, strings.TrimRight(p.BaseURL, "/")+"/api/chat", map[string]interface{}{
+		"model":    p.llmProviderConfig.Model,
+		"messages": ollamaMessages(req.Messages),
+		"stream":   true,
+		"options":  options,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Ollama streams newline-delimited JSON objects; the last one has done=true
+	// and carries the token counts.
+	out := &LLMResponse{Provider: p.Name(), Model: p.llmProviderConfig.Model}
+	var content strings.Builder
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var chunk struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+			Done            bool `json:"done"`
+			PromptEvalCount int  `json:"prompt_eval_count"`
+			EvalCount       int  `json:"eval_count"`
+		}
+		if err := decoder.Decode(&chunk); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return finishLLMStream(out, req, content.String()), err
+		}
+		if chunk.Message.Content != "" {
+			content.WriteString(chunk.Message.Content)
+			if err := onDelta(chunk.Message.Content); err != nil {
+				return finishLLMStream(out, req, content.String()), err
+			}
+		}
+		if chunk.Done {
+			out.PromptTokens = chunk.PromptEvalCount
+			out.CompletionTokens = chunk.EvalCount
+			out.TotalTokens = chunk.PromptEvalCount + chunk.EvalCount
+			break
+		}
+	}
+	if content.Len() == 0 {
+		return nil, errors.New("empty completion")
+	}
+	return finishLLMStream(out, req, content.String()), nil
+}
+
+// ollamaMessages converts tool calls to Ollama's shape, where arguments are
+// a JSON object rather than an encoded string.
+func ollamaMessages(messages []ChatMessage) []map[string]interface{} {
+	out := make([]map[string]interface{}, 0, len(messages))
+	for _, m := range messages {
+		msg := map[string]interface{}{"role": m.Role, "content": m.Content}
+		if len(m.ToolCalls) > 0 {
+			calls := make([]map[string]interface{}, 0, len(m.ToolCalls))
+			for _, tc := range m.ToolCalls {
+				args := json.RawMessage(tc.Function.Arguments)
+				if !json.Valid(args) {
+					args = json.RawMessage("{}")
+				}
+				calls = append(calls, map[string]interface{}{
+					"function": map[string]interface{}{"name": tc.Function.Name, "arguments": args},
+				})
+			}
+			msg["tool_calls"] = calls
+		}
+		out = append(out, msg)
+	}
+	return out
+}
+
+// Circuit breakers
+
+const (
+	llmBreakerThreshold = 3
+	llmBreakerCooldown  = 60 * time.Second
+)
+
+// llmBreaker opens after llmBreakerThreshold consecutive upstream failures
+// and lets a single probe through once the cooldown has passed.
+type llmBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+var (
+	llmBreakers   = map[string]*llmBreaker{}
+	llmBreakersMu sync.Mutex
+)
+
+func llmBreakerFor(key string) *llmBreaker {
+	llmBreakersMu.Lock()
+	defer llmBreakersMu.Unlock()
+	b, ok := llmBreakers[key]
+	if !ok {
+		b = &llmBreaker{}
+		llmBreakers[key] = b
+	}
+	return b
+}
+
+func (b *llmBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < llmBreakerThreshold {
+		return true
+	}
+	if now.Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *llmBreaker) record(ok bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if ok {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= llmBreakerThreshold {
+		b.openUntil = now.Add(llmBreakerCooldown)
+	}
+}
+
+func (b *llmBreaker) state(now time.Time) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.failures < llmBreakerThreshold:
+		return "closed"
+	case now.Before(b.openUntil):
+		return "open"
+	}
+	return "half-open"
+}
+
+// isUpstreamFailure reports whether err says something about the provider's
+// health. Client errors such as a rejected user key do not trip the breaker.
+func isUpstreamFailure(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= 500 || apiErr.StatusCode == http.StatusTooManyRequests
+	}
+	// Network errors, timeouts and malformed responses
+	return true
+}
+
+// Chains
+
+var errNoLLMProviders = errors.New("no AI providers configured")
+
+type llmChain []LLMProvider
+
+// Complete asks each provider in turn until one answers. A cancelled request
+// context stops the chain immediately.
+func (ch llmChain) Complete(ctx context.Context, req LLMRequest) (*LLMResponse, error) {
+	if len(ch) == 0 {
+		return nil, errNoLLMProviders
+	}
+
+	var errs []error
+	for _, p := range ch {
+		breaker := llmBreakerFor(p.Key())
+		if !breaker.allow(time.Now()) {
+			errs = append(errs, fmt.Errorf("%s (%s): circuit open", p.Name(), p.Model()))
+			continue
+		}
+
+		resp, err := p.Complete(ctx, req)
+		if err == nil {
+			breaker.record(true, time.Now())
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			breaker.record(true, time.Now())
+			return nil, ctx.Err()
+		}
+		breaker.record(!isUpstreamFailure(err), time.Now())
+		errs = append(errs, fmt.Errorf("%s (%s): %w", p.Name(), p.Model(), err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Stream works like Complete but only falls back while nothing has been sent
+// to the client yet; once text went out, an error ends the stream. The
+// returned response may be partial when err is non-nil.
+func (ch llmChain) Stream(ctx context.Context, req LLMRequest, onDelta func(string) error) (*LLMResponse, error) {
+	if len(ch) == 0 {
+		return nil, errNoLLMProviders
+	}
+
+	var errs []error
+	for _, p := range ch {
+		breaker := llmBreakerFor(p.Key())
+		if !breaker.allow(time.Now()) {
+			errs = append(errs, fmt.Errorf("%s (%s): circuit open", p.Name(), p.Model()))
+			continue
+		}
+
+		started := false
+		var clientErr error
+		resp, err := p.Stream(ctx, req, func(delta string) error {
+			started = true
+			clientErr = onDelta(delta)
+			return clientErr
+		})
+		if err == nil {
+			breaker.record(true, time.Now())
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			breaker.record(true, time.Now())
+			return resp, ctx.Err()
+		}
+		if clientErr != nil {
+			// The receiving side failed, not the provider
+			breaker.record(true, time.Now())
+			return resp, clientErr
+		}
+		breaker.record(!isUpstreamFailure(err), time.Now())
+		if started {
+			return resp, fmt.Errorf("%s (%s): %w", p.Name(), p.Model(), err)
+		}
+		errs = append(errs, fmt.Errorf("%s (%s): %w", p.Name(), p.Model(), err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// llmProviderNames is the default fallback order, overridable with
+// JARVIS_PROVIDER_ORDER.
+var llmProviderNames = []string{"openai", "deepseek", "huggingface", "ollama"}
+
+// llmEnvConfig holds the system-wide provider settings read from the
+// environment. It is a variable so tests can point providers at fake servers.
+var llmEnvConfig = func(name string) []llmProviderConfig {
+	timeout := func(def time.Duration) time.Duration {
+		if v, err := strconv.Atoi(os.Getenv("JARVIS_TIMEOUT_" + strings.ToUpper(name))); err == nil && v > 0 {
+			return time.Duration(v) * time.Second
+		}
+		return def
+	}
+	env := func(key, def string) string {
+		if v := os.Getenv(key); v != "" {
+			return v
+		}
+		return def
+	}
+
+	switch name {
+	case "openai":
+		return []llmProviderConfig{{
+			Name:    "openai",
+			BaseURL: env("OPENAI_BASE_URL", "https://api.openai.com/v1"),
+			APIKey:  os.Getenv("OPENAI_API_KEY"),
+			Model:   env("OPENAI_MODEL", "gpt-4o-mini"),
+			Timeout: timeout(60 * time.Second),
+		}}
+	case "deepseek":
+		return []llmProviderConfig{{
+			Name:    "deepseek",
+			BaseURL: env("DEEPSEEK_BASE_URL", "https://api.deepseek.com"),
+			APIKey:  os.Getenv("DEEPSEEK_API_KEY"),
+			Model:   env("DEEPSEEK_MODEL", "deepseek-chat"),
+			Timeout: timeout(60 * time.Second),
+		}}
+	case "huggingface":
+		// Qwen 2.5 first as it is better for general and multilingual tasks
+		base := env("HUGGINGFACE_BASE_URL", "https://api-inference.huggingface.co")
+		key := os.Getenv("HUGGINGFACE_API_KEY")
+		return []llmProviderConfig{
+			{Name: "huggingface", BaseURL: base, APIKey: key, Model: "Qwen/Qwen2.5-72B-Instruct", Timeout: timeout(90 * time.Second)},
+			{Name: "huggingface", BaseURL: base, APIKey: key, Model: "mistralai/Mistral-7B-Instruct-v0.3", Timeout: timeout(90 * time.Second)},
+		}
+	case "ollama":
+		return []llmProviderConfig{{
+			Name:    "ollama",
+			BaseURL: os.Getenv("OLLAMA_URL"),
+			Model:   env("OLLAMA_MODEL", "llama3.1"),
+			Timeout: timeout(120 * time.Second),
+		}}
+	}
+	return nil
+}
+
+func newLLMProvider(cfg llmProviderConfig) LLMProvider {
+	switch cfg.Name {
+	case "huggingface":
+		return &huggingFaceProvider{cfg}
+	case "ollama":
+		return &ollamaProvider{cfg}
+	}
+	return newOpenAICompatibleProvider(cfg)
+}
+
+func llmProviderOrder() []string {
+	if v := os.Getenv("JARVIS_PROVIDER_ORDER"); v != "" {
+		var names []string
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(strings.ToLower(name)); name != "" {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	return llmProviderNames
+}
+
+// buildLLMChain assembles the fallback chain for one request. only restricts
+// the chain to a single provider family (route-selected providers). A user's
+// own key for a provider is tried before the system key.
+func buildLLMChain(settings *Settings, only string) llmChain {
+	names := llmProviderOrder()
+	if only != "" {
+		names = []string{only}
+	}
+
+	var chain llmChain
+	for _, name := range names {
+		userKey := ""
+		if settings != nil {
+			switch name {
+			case "openai":
+				userKey = settings.OpenAIKey
+			case "deepseek":
+				userKey = settings.DeepSeekKey
+			case "huggingface":
+				userKey = settings.HuggingFaceKey
+			}
+		}
+
+		for _, cfg := range llmEnvConfig(name) {
+			if userKey != "" {
+				userCfg := cfg
+				userCfg.APIKey = userKey
+				userCfg.UserKey = true
+				chain = append(chain, newLLMProvider(userCfg))
+			}
+			if llmConfigured(cfg) {
+				chain = append(chain, newLLMProvider(cfg))
+			}
+		}
+	}
+	return chain
+}
+
+func llmConfigured(cfg llmProviderConfig) bool {
+	if cfg.Name == "ollama" {
+		return cfg.BaseURL != ""
+	}
+	return cfg.APIKey != "" && cfg.BaseURL != ""
+}
+
+func isLLMProviderName(name string) bool {
+	for _, n := range llmProviderNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
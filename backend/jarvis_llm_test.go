@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeOpenAIServer emulates POST /chat/completions of an OpenAI-compatible
+// API. status overrides the response code; delay holds the reply back.
+func fakeOpenAIServer(t *testing.T, status int, delay time.Duration, hits *int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits != nil {
+			atomic.AddInt32(hits, 1)
+		}
+		if r.URL.Path != "/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if status != http.StatusOK {
+			http.Error(w, `{"error":{"message":"upstream failure"}}`, status)
+			return
+		}
+
+		var req ChatCompletionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		last := req.Messages[len(req.Messages)-1].Content
+		if req.Stream {
+			writeFakeOpenAIStream(w, r, []string{"Hello", ", ", last}, req.StreamOptions != nil && req.StreamOptions.IncludeUsage)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id": "chatcmpl-test",
+			"choices": []map[string]interface{}{
+				{"message": map[string]string{"role": "assistant", "content": req.Model + ":" + r.Header.Get("Authorization") + ":" + last}},
+			},
+			"usage": map[string]int{"prompt_tokens": 7, "completion_tokens": 5, "total_tokens": 12},
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// writeFakeOpenAIStream answers in the chat.completion.chunk SSE format. A
+// "hang" chunk blocks until the client goes away.
+func writeFakeOpenAIStream(w http.ResponseWriter, r *http.Request, chunks []string, withUsage bool) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	flusher := w.(http.Flusher)
+	for _, chunk := range chunks {
+		if chunk == "hang" {
+			<-r.Context().Done()
+			return
+		}
+		data, _ := json.Marshal(map[string]interface{}{
+			"choices": []map[string]interface{}{{"delta": map[string]string{"content": chunk}}},
+		})
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+	}
+	if withUsage {
+		fmt.Fprint(w, `data: {"choices":[],"usage":{"prompt_tokens":9,"completion_tokens":3,"total_tokens":12}}`+"\n\n")
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	flusher.Flush()
+}
+
+func testLLMRequest(text string) LLMRequest {
+	return LLMRequest{Messages: []ChatMessage{{Role: "user", Content: text}}, Temperature: 0.7}
+}
+
+func TestOpenAICompatibleProviderComplete(t *testing.T) {
+	srv := fakeOpenAIServer(t, http.StatusOK, 0, nil)
+	p := newOpenAICompatibleProvider(llmProviderConfig{
+		Name: "openai", BaseURL: srv.URL + "/", APIKey: "sk-user", Model: "gpt-test", Timeout: time.Second,
+	})
+
+	resp, err := p.Complete(context.Background(), testLLMRequest("hello"))
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if want := "gpt-test:Bearer sk-user:hello"; resp.Content != want {
+		t.Errorf("content = %q, want %q", resp.Content, want)
+	}
+	if resp.Provider != "openai" || resp.Model != "gpt-test" {
+		t.Errorf("provider/model = %s/%s", resp.Provider, resp.Model)
+	}
+	if resp.PromptTokens != 7 || resp.CompletionTokens != 5 || resp.TotalTokens != 12 {
+		t.Errorf("usage = %d/%d/%d", resp.PromptTokens, resp.CompletionTokens, resp.TotalTokens)
+	}
+}
+
+func TestLLMChainFallsBackAndOpensBreaker(t *testing.T) {
+	var badHits, goodHits int32
+	bad := fakeOpenAIServer(t, http.StatusBadGateway, 0, &badHits)
+	good := fakeOpenAIServer(t, http.StatusOK, 0, &goodHits)
+
+	chain := llmChain{
+		newOpenAICompatibleProvider(llmProviderConfig{Name: "openai", BaseURL: bad.URL, APIKey: "k", Model: "a", Timeout: time.Second}),
+		newOpenAICompatibleProvider(llmProviderConfig{Name: "deepseek", BaseURL: good.URL, APIKey: "k", Model: "b", Timeout: time.Second}),
+	}
+
+	for i := 0; i < llmBreakerThreshold+2; i++ {
+		resp, err := chain.Complete(context.Background(), testLLMRequest("hi"))
+		if err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+		if resp.Provider != "deepseek" {
+			t.Fatalf("call %d answered by %s", i, resp.Provider)
+		}
+	}
+
+	if got := atomic.LoadInt32(&badHits); got != llmBreakerThreshold {
+		t.Errorf("failing provider called %d times, want %d before the breaker opens", got, llmBreakerThreshold)
+	}
+	if got := atomic.LoadInt32(&goodHits); got != llmBreakerThreshold+2 {
+		t.Errorf("fallback provider called %d times", got)
+	}
+	if state := llmBreakerFor(chain[0].Key()).state(time.Now()); state != "open" {
+		t.Errorf("breaker state = %s, want open", state)
+	}
+}
+
+func TestLLMChainClientErrorDoesNotTripBreaker(t *testing.T) {
+	var hits int32
+	rejected := fakeOpenAIServer(t, http.StatusUnauthorized, 0, &hits)
+	good := fakeOpenAIServer(t, http.StatusOK, 0, nil)
+
+	chain := llmChain{
+		newOpenAICompatibleProvider(llmProviderConfig{Name: "openai", BaseURL: rejected.URL, APIKey: "bad", Model: "a", UserKey: true}),
+		newOpenAICompatibleProvider(llmProviderConfig{Name: "openai", BaseURL: good.URL, APIKey: "k", Model: "a"}),
+	}
+	for i := 0; i < llmBreakerThreshold+1; i++ {
+		if _, err := chain.Complete(context.Background(), testLLMRequest("hi")); err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+	}
+	if got := atomic.LoadInt32(&hits); got != llmBreakerThreshold+1 {
+		t.Errorf("rejected provider called %d times, 401 must not open the breaker", got)
+	}
+}
+
+func TestLLMProviderTimeout(t *testing.T) {
+	slow := fakeOpenAIServer(t, http.StatusOK, 500*time.Millisecond, nil)
+	good := fakeOpenAIServer(t, http.StatusOK, 0, nil)
+
+	chain := llmChain{
+		newOpenAICompatibleProvider(llmProviderConfig{Name: "openai", BaseURL: slow.URL, APIKey: "k", Model: "slow", Timeout: 50 * time.Millisecond}),
+		newOpenAICompatibleProvider(llmProviderConfig{Name: "ollama", BaseURL: good.URL, Model: "fast", Timeout: time.Second}),
+	}
+
+	start := time.Now()
+	resp, err := chain.Complete(context.Background(), testLLMRequest("hi"))
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if resp.Model != "fast" {
+		t.Errorf("answered by %s, want the fallback", resp.Model)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("timeout not enforced, took %s", elapsed)
+	}
+}
+
+func TestLLMChainStopsOnClientCancel(t *testing.T) {
+	var hits int32
+	slow := fakeOpenAIServer(t, http.StatusOK, time.Second, nil)
+	other := fakeOpenAIServer(t, http.StatusOK, 0, &hits)
+
+	chain := llmChain{
+		newOpenAICompatibleProvider(llmProviderConfig{Name: "openai", BaseURL: slow.URL, APIKey: "k", Model: "cancel"}),
+		newOpenAICompatibleProvider(llmProviderConfig{Name: "deepseek", BaseURL: other.URL, APIKey: "k", Model: "cancel"}),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := chain.Complete(ctx, testLLMRequest("hi")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context deadline", err)
+	}
+	if atomic.LoadInt32(&hits) != 0 {
+		t.Error("chain kept going after the client went away")
+	}
+}
+
+func TestBuildLLMChain(t *testing.T) {
+	saved := llmEnvConfig
+	t.Cleanup(func() { llmEnvConfig = saved })
+	t.Setenv("JARVIS_PROVIDER_ORDER", "")
+	llmEnvConfig = func(name string) []llmProviderConfig {
+		switch name {
+		case "deepseek":
+			return []llmProviderConfig{{Name: "deepseek", BaseURL: "http://deepseek", APIKey: "system", Model: "deepseek-chat"}}
+		case "ollama":
+			return []llmProviderConfig{{Name: "ollama", BaseURL: "http://ollama", Model: "llama"}}
+		case "openai":
+			return []llmProviderConfig{{Name: "openai", BaseURL: "http://openai", Model: "gpt"}}
+		}
+		return nil
+	}
+
+	settings := &Settings{DeepSeekKey: "mine"}
+
+	chain := buildLLMChain(settings, "")
+	var names []string
+	for _, p := range chain {
+		names = append(names, p.Name())
+	}
+	if len(chain) != 3 || names[0] != "deepseek" || names[1] != "deepseek" || names[2] != "ollama" {
+		t.Fatalf("default chain = %v", names)
+	}
+	if user := chain[0].(*openAICompatibleProvider); !user.UserKey || user.APIKey != "mine" {
+		t.Errorf("user key must come first, got %+v", user.llmProviderConfig)
+	}
+	if system := chain[1].(*openAICompatibleProvider); system.UserKey || system.APIKey != "system" {
+		t.Errorf("system key must follow, got %+v", system.llmProviderConfig)
+	}
+	if chain[0].Key() == chain[1].Key() {
+		t.Error("user and system keys must not share a circuit breaker")
+	}
+
+	if only := buildLLMChain(settings, "ollama"); len(only) != 1 || only[0].Name() != "ollama" {
+		t.Errorf("route-selected chain = %v", only)
+	}
+	if none := buildLLMChain(nil, "openai"); len(none) != 0 {
+		t.Errorf("openai without any key should be skipped, got %d providers", len(none))
+	}
+}
+
+func TestOpenAICompatibleProviderStream(t *testing.T) {
+	srv := fakeOpenAIServer(t, http.StatusOK, 0, nil)
+	p := newOpenAICompatibleProvider(llmProviderConfig{Name: "openai", BaseURL: srv.URL, APIKey: "k", Model: "gpt-test"})
+
+	var deltas []string
+	resp, err := p.Stream(context.Background(), testLLMRequest("world"), func(d string) error {
+		deltas = append(deltas, d)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+	if len(deltas) != 3 || resp.Content != "Hello, world" {
+		t.Errorf("deltas = %q, content = %q", deltas, resp.Content)
+	}
+	if resp.PromptTokens != 9 || resp.CompletionTokens != 3 || resp.TotalTokens != 12 {
+		t.Errorf("usage = %d/%d/%d, want the upstream's final usage", resp.PromptTokens, resp.CompletionTokens, resp.TotalTokens)
+	}
+}
+
+func TestLLMChainStreamCancelKeepsPartialUsage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeFakeOpenAIStream(w, r, []string{"partial answer", "hang"}, false)
+	}))
+	t.Cleanup(srv.Close)
+	chain := llmChain{newOpenAICompatibleProvider(llmProviderConfig{Name: "openai", BaseURL: srv.URL, APIKey: "k", Model: "stream-cancel"})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, err := chain.Stream(ctx, testLLMRequest("hi"), func(d string) error {
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if resp == nil || resp.Content != "partial answer" || resp.TotalTokens == 0 {
+		t.Fatalf("partial response = %+v, want the streamed text with estimated usage", resp)
+	}
+	if state := llmBreakerFor(chain[0].Key()).state(time.Now()); state != "closed" {
+		t.Errorf("client cancel must not count against the provider, breaker is %s", state)
+	}
+}
+
+func TestLLMChainStreamFallsBackBeforeFirstDelta(t *testing.T) {
+	bad := fakeOpenAIServer(t, http.StatusServiceUnavailable, 0, nil)
+	good := fakeOpenAIServer(t, http.StatusOK, 0, nil)
+	chain := llmChain{
+		newOpenAICompatibleProvider(llmProviderConfig{Name: "openai", BaseURL: bad.URL, APIKey: "k", Model: "stream-a"}),
+		newOpenAICompatibleProvider(llmProviderConfig{Name: "deepseek", BaseURL: good.URL, APIKey: "k", Model: "stream-b"}),
+	}
+
+	resp, err := chain.Stream(context.Background(), testLLMRequest("there"), func(string) error { return nil })
+	if err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+	if resp.Provider != "deepseek" || resp.Content != "Hello, there" {
+		t.Errorf("got %s %q", resp.Provider, resp.Content)
+	}
+}
+
+func TestOpenAICompatibleProviderToolCalls(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ChatCompletionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		last := req.Messages[len(req.Messages)-1]
+		message := map[string]interface{}{"role": "assistant", "content": ""}
+		switch {
+		case last.Role == "tool":
+			message["content"] = "result was " + last.Content + " for " + last.ToolCallID
+		case len(req.Tools) == 1 && req.Tools[0].Function.Name == "lookup":
+			message["tool_calls"] = []map[string]interface{}{{
+				"id": "call_1", "type": "function",
+				"function": map[string]string{"name": "lookup", "arguments": `{"q":"x"}`},
+			}}
+		default:
+			http.Error(w, "tools missing", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"choices": []map[string]interface{}{{"message": message}}})
+	}))
+	defer srv.Close()
+
+	p := newOpenAICompatibleProvider(llmProviderConfig{Name: "openai", BaseURL: srv.URL, APIKey: "k", Model: "m", Timeout: time.Second})
+	req := testLLMRequest("find x")
+	req.Tools = []ChatTool{{Type: "function", Function: ChatToolFunction{Name: "lookup", Parameters: json.RawMessage(`{"type":"object"}`)}}}
+
+	resp, err := p.Complete(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if len(resp.ToolCalls) != 1 || resp.ToolCalls[0].Function.Name != "lookup" || resp.ToolCalls[0].Function.Arguments != `{"q":"x"}` {
+		t.Fatalf("tool calls = %+v", resp.ToolCalls)
+	}
+
+	req.Messages = append(req.Messages,
+		ChatMessage{Role: "assistant", ToolCalls: resp.ToolCalls},
+		ChatMessage{Role: "tool", ToolCallID: "call_1", Content: "42"},
+	)
+	resp, err = p.Complete(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Complete with tool result: %v", err)
+	}
+	if want := "result was 42 for call_1"; resp.Content != want {
+		t.Errorf("content = %q, want %q", resp.Content, want)
+	}
+}
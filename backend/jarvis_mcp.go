@@ -1,39 +1,64 @@
 package main
 
 import (
-        "bufio"
+        "context"
         "encoding/json"
         "fmt"
-        "io"
         "net/http"
         "os"
-        "os/exec"
-        "sync"
+        "path/filepath"
+        "strings"
         "time"
 
         "github.com/gin-gonic/gin"
 )
 
-// JarvisMCP handles communication with the Jarvis MCP server
+// JarvisMCP is the bridge to the Jarvis MCP server. It is a thin layer over
+// mcpClient that applies the tool block list and keeps the old MCPResponse
+// shape for callers.
 type JarvisMCP struct {
-        cmd       *exec.Cmd
-        stdin     io.WriteCloser
-        stdout    *bufio.Scanner
-        mu        sync.Mutex
-        isRunning bool
+        client    *mcpClient
         cfg       MCPConfig
+        transport string
 }
 
+// MCPConfig selects the transport: URL for a streamable HTTP server,
+// otherwise BinaryPath is started as a stdio server. The stdio server inherits
+// the environment, so JARVIS_FETCH_ALLOWLIST, JARVIS_WRITE_DRY_RUN and the
+// size limits documented in jarvis/ reach it unchanged.
 type MCPConfig struct {
-        BinaryPath       string
+        BinaryPath         string
+        Args               []string
+        URL                string
+        Headers            map[string]string
         AllowedDirectories []string
-        BlockedCommands  []string
-        Timeout          time.Duration
+        BlockedCommands    []string
+        Timeout            time.Duration
+        // ToolRoles is the minimum role per tool; tools not listed need
+        // DefaultToolRole.
+        ToolRoles       map[string]string
+        DefaultToolRole string
+}
+
+var defaultMCPToolRoles = map[string]string{
+        "get-config":     "admin",
+        "list-directory": "admin",
+        "read-file":      "admin",
+        "fetch-url":      "admin",
+        "write-file":     "super_admin",
+}
+
+var mcpRoleRank = map[string]int{
+        "user":        0,
+        "moderator":   1,
+        "admin":       2,
+        "super_admin": 3,
 }
 
 var jarvisMCP *JarvisMCP
 
-// InitJarvisMCP initializes the Jarvis MCP bridge
+// InitJarvisMCP connects to the Jarvis MCP server. If the server is there but
+// the handshake fails, the bridge is still installed and keeps reconnecting.
 func InitJarvisMCP(cfg MCPConfig) error {
         if cfg.BinaryPath == "" {
                 cfg.BinaryPath = "./jarvis/jarvis" // relative to working directory
@@ -44,175 +69,179 @@ func InitJarvisMCP(cfg MCPConfig) error {
         if len(cfg.AllowedDirectories) == 0 {
                 cfg.AllowedDirectories = []string{"./uploads", "./jsvoice"}
         }
-
-        jm := &JarvisMCP{
-                cfg: cfg,
+        if cfg.ToolRoles == nil {
+                cfg.ToolRoles = defaultMCPToolRoles
         }
-
-        // Try to start Jarvis process
-        binaryPath := jm.cfg.BinaryPath
-        if _, err := os.Stat(binaryPath); os.IsNotExist(err) {
-                // Try absolute path if relative fails
-                if abs, err := os.Getwd(); err == nil {
-                        binaryPath = abs + "/" + jm.cfg.BinaryPath
-                }
+        if cfg.DefaultToolRole == "" {
+                cfg.DefaultToolRole = "super_admin"
         }
-        jm.cfg.BinaryPath = binaryPath
 
-        if err := jm.startProcess(); err != nil {
-                fmt.Printf("Warning: Failed to start Jarvis MCP: %v\n", err)
-                return err
-        }
-
-        jarvisMCP = jm
-        return nil
-}
-
-func (jm *JarvisMCP) startProcess() error {
-        jm.mu.Lock()
-        defer jm.mu.Unlock()
-
-        if jm.isRunning {
-                return nil
-        }
+        jm := &JarvisMCP{cfg: cfg}
+        if cfg.URL != "" {
+                jm.transport = "http"
+                jm.client = newMCPClient("jarvis", func() mcpTransport {
+                        return newMCPHTTPTransport(cfg.URL, cfg.Headers, nil)
+                })
+        } else {
+                binaryPath, err := filepath.Abs(cfg.BinaryPath)
+                if err != nil {
+                        return err
+                }
+                if _, err := os.Stat(binaryPath); err != nil {
+                        return fmt.Errorf("jarvis binary not found at %s: %w", binaryPath, err)
+                }
 
-        // Start Jarvis as MCP server over stdio
-        jm.cmd = exec.Command(jm.cfg.BinaryPath)
-        
-        stdin, err := jm.cmd.StdinPipe()
-        if err != nil {
-                return fmt.Errorf("failed to open stdin: %w", err)
-        }
-        jm.stdin = stdin
+                // The server confines its file tools to these directories
+                var dirs []string
+                for _, dir := range cfg.AllowedDirectories {
+                        if abs, err := filepath.Abs(dir); err == nil {
+                                dirs = append(dirs, abs)
+                        }
+                }
+                env := []string{"JARVIS_ALLOWED_DIRS=" + strings.Join(dirs, string(os.PathListSeparator))}
 
-        stdout, err := jm.cmd.StdoutPipe()
-        if err != nil {
-                return fmt.Errorf("failed to open stdout: %w", err)
+                jm.transport = "stdio"
+                jm.client = newMCPClient("jarvis", func() mcpTransport {
+                        return newMCPStdioTransport(binaryPath, cfg.Args, env)
+                })
         }
-        jm.stdout = bufio.NewScanner(stdout)
 
-        // Redirect stderr for debugging
-        jm.cmd.Stderr = os.Stderr
-
-        if err := jm.cmd.Start(); err != nil {
-                return fmt.Errorf("failed to start jarvis process: %w", err)
+        jarvisMCP = jm
+        ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+        defer cancel()
+        if err := jm.client.Start(ctx); err != nil {
+                return err
         }
-
-        jm.isRunning = true
         fmt.Println("Jarvis MCP bridge started successfully")
         return nil
 }
 
-func (jm *JarvisMCP) stopProcess() error {
-        jm.mu.Lock()
-        defer jm.mu.Unlock()
-
-        if !jm.isRunning {
-                return nil
-        }
-
-        if jm.stdin != nil {
-                jm.stdin.Close()
-        }
-
-        if jm.cmd.Process != nil {
-                jm.cmd.Process.Kill()
-        }
-
-        jm.isRunning = false
-        return jm.cmd.Wait()
+// Running reports whether the MCP handshake has completed.
+func (jm *JarvisMCP) Running() bool {
+        return jm != nil && jm.client.Connected()
 }
 
-// MCPRequest represents a request to Jarvis MCP
-type MCPRequest struct {
-        Tool   string                 `json:"tool"`
-        Input  map[string]interface{} `json:"input"`
+func (jm *JarvisMCP) Close() error {
+        return jm.client.Close()
 }
 
-// MCPResponse represents a response from Jarvis MCP
+// MCPResponse is the result of a tool call. Data holds the structured content,
+// or the text content decoded as JSON when possible.
 type MCPResponse struct {
-        Success bool                   `json:"success"`
-        Data    interface{}            `json:"data,omitempty"`
-        Error   string                 `json:"error,omitempty"`
+        Success bool        `json:"success"`
+        Data    interface{} `json:"data,omitempty"`
+        Error   string      `json:"error,omitempty"`
 }
 
-// ExecuteMCPTool safely executes a tool from Jarvis
+// ExecuteMCPTool calls a tool with the configured timeout.
 func (jm *JarvisMCP) ExecuteMCPTool(toolName string, input map[string]interface{}) (MCPResponse, error) {
-        jm.mu.Lock()
-        defer jm.mu.Unlock()
+        ctx, cancel := context.WithTimeout(context.Background(), jm.cfg.Timeout)
+        defer cancel()
+        return jm.ExecuteMCPToolContext(ctx, toolName, input)
+}
 
-        if !jm.isRunning {
+func (jm *JarvisMCP) ExecuteMCPToolContext(ctx context.Context, toolName string, input map[string]interface{}) (MCPResponse, error) {
+        if !jm.Running() {
                 return MCPResponse{}, fmt.Errorf("Jarvis MCP is not running")
         }
-
-        // Validate tool and input
         if !jm.isToolAllowed(toolName) {
                 return MCPResponse{Success: false, Error: "Tool not allowed"}, nil
         }
 
-        // Send request to Jarvis
-        req := MCPRequest{
-                Tool:  toolName,
-                Input: input,
-        }
-        reqBytes, _ := json.Marshal(req)
-        fmt.Fprintf(jm.stdin, "%s\n", reqBytes)
-
-        // Read response with timeout
-        done := make(chan MCPResponse, 1)
-        go func() {
-                var resp MCPResponse
-                if jm.stdout.Scan() {
-                        json.Unmarshal(jm.stdout.Bytes(), &resp)
-                        done <- resp
+        result, err := jm.client.CallTool(ctx, toolName, input)
+        if err != nil {
+                if ctx.Err() == context.DeadlineExceeded {
+                        return MCPResponse{}, fmt.Errorf("Jarvis MCP request timeout")
                 }
-        }()
+                return MCPResponse{}, err
+        }
 
-        select {
-        case resp := <-done:
-                return resp, nil
-        case <-time.After(jm.cfg.Timeout):
-                return MCPResponse{}, fmt.Errorf("Jarvis MCP request timeout")
+        text := result.Text()
+        if result.IsError {
+                return MCPResponse{Success: false, Error: text}, nil
+        }
+        resp := MCPResponse{Success: true, Data: text}
+        var data interface{}
+        if len(result.StructuredContent) > 0 && json.Unmarshal(result.StructuredContent, &data) == nil {
+                resp.Data = data
+        } else if json.Unmarshal([]byte(text), &data) == nil {
+                resp.Data = data
         }
+        return resp, nil
 }
 
+// isToolAllowed accepts tools the server advertises and the config does not
+// block.
 func (jm *JarvisMCP) isToolAllowed(toolName string) bool {
-        allowedTools := []string{
-                "read-file",
-                "write-file",
-                "list-directory",
-                "fetch-url",
-                "get-config",
-                "set-config",
-                "execute-command", // disabled by default for safety
+        for _, blocked := range jm.cfg.BlockedCommands {
+                if toolName == blocked {
+                        return false
+                }
         }
-
-        for _, allowed := range allowedTools {
-                if toolName == allowed {
-                        // Additional check: execute-command requires super_admin
-                        if toolName == "execute-command" {
-                                return false // Only allowed via explicit admin endpoints
-                        }
+        for _, tool := range jm.client.Tools() {
+                if tool.Name == toolName {
                         return true
                 }
         }
         return false
 }
 
+// RequiredRole is the minimum role needed to call toolName.
+func (jm *JarvisMCP) RequiredRole(toolName string) string {
+        if role, ok := jm.cfg.ToolRoles[toolName]; ok {
+                return role
+        }
+        return jm.cfg.DefaultToolRole
+}
+
+// RoleAllows reports whether a user with role may call toolName.
+func (jm *JarvisMCP) RoleAllows(toolName, role string) bool {
+        required, ok := mcpRoleRank[jm.RequiredRole(toolName)]
+        if !ok {
+                return false
+        }
+        return mcpRoleRank[role] >= required
+}
+
+// mcpEffectiveRole is the higher of the user's role and their global role
+// assignment.
+func mcpEffectiveRole(user User) string {
+        role := user.Role
+        var assignment GlobalRoleAssignment
+        if db.Where("user_id = ?", user.ID).First(&assignment).Error == nil && mcpRoleRank[assignment.Role] > mcpRoleRank[role] {
+                role = assignment.Role
+        }
+        return role
+}
+
+// Tools lists the advertised tools that are not blocked.
+func (jm *JarvisMCP) Tools() []mcpTool {
+        var tools []mcpTool
+        for _, tool := range jm.client.Tools() {
+                if jm.isToolAllowed(tool.Name) {
+                        tools = append(tools, tool)
+                }
+        }
+        return tools
+}
+
 // HTTP Handlers for Jarvis MCP
 
 func getMCPToolsHandler(c *gin.Context) {
-        // List available MCP tools
-        tools := []map[string]string{
-                {"name": "read-file", "description": "Read file contents"},
-                {"name": "write-file", "description": "Write to file"},
-                {"name": "list-directory", "description": "List directory contents"},
-                {"name": "fetch-url", "description": "Fetch content from URL"},
-                {"name": "get-config", "description": "Get configuration"},
+        tools := []gin.H{}
+        if jarvisMCP != nil {
+                for _, tool := range jarvisMCP.Tools() {
+                        tools = append(tools, gin.H{
+                                "name":          tool.Name,
+                                "description":   tool.Description,
+                                "input_schema":  tool.InputSchema,
+                                "required_role": jarvisMCP.RequiredRole(tool.Name),
+                        })
+                }
         }
         c.JSON(http.StatusOK, gin.H{
-                "tools": tools,
-                "status": map[string]bool{"available": jarvisMCP != nil && jarvisMCP.isRunning},
+                "tools":  tools,
+                "status": map[string]bool{"available": jarvisMCP.Running()},
         })
 }
 
@@ -223,16 +252,11 @@ func executeMCPToolHandler(c *gin.Context) {
                 return
         }
 
-        // Only allow admins to use MCP tools
         var user User
         if err := db.First(&user, userID).Error; err != nil {
                 c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
                 return
         }
-        if user.Role != "admin" && user.Role != "super_admin" {
-                c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
-                return
-        }
 
         var req struct {
                 Tool  string                 `json:"tool" binding:"required"`
@@ -249,7 +273,15 @@ func executeMCPToolHandler(c *gin.Context) {
                 return
         }
 
-        resp, err := jarvisMCP.ExecuteMCPTool(req.Tool, req.Input)
+        // Every tool has its own minimum role
+        if !jarvisMCP.RoleAllows(req.Tool, mcpEffectiveRole(user)) {
+                c.JSON(http.StatusForbidden, gin.H{"error": "This tool requires the " + jarvisMCP.RequiredRole(req.Tool) + " role"})
+                return
+        }
+
+        ctx, cancel := context.WithTimeout(c.Request.Context(), jarvisMCP.cfg.Timeout)
+        defer cancel()
+        resp, err := jarvisMCP.ExecuteMCPToolContext(ctx, req.Tool, req.Input)
         if err != nil {
                 c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
                 return
@@ -263,13 +295,21 @@ func executeMCPToolHandler(c *gin.Context) {
 
 func getMCPStatusHandler(c *gin.Context) {
         status := "unavailable"
-        if jarvisMCP != nil && jarvisMCP.isRunning {
-                status = "running"
+        body := gin.H{
+                "version":  "1.1",
+                "bridge":   "jarvis-mcp-v1.1",
+                "protocol": mcpProtocolVersion,
         }
+        if jarvisMCP != nil {
+                body["transport"] = jarvisMCP.transport
+                if jarvisMCP.Running() {
+                        status = "running"
+                        body["server"] = jarvisMCP.client.Server()
+                } else {
+                        status = "reconnecting"
+                }
+        }
+        body["status"] = status
 
-        c.JSON(http.StatusOK, gin.H{
-                "status": status,
-                "version": "1.0",
-                "bridge": "jarvis-mcp-v1.0",
-        })
+        c.JSON(http.StatusOK, body)
 }
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Jarvis quotas. Every model call is counted against the user's daily row
+// and, for organisation members, the organisation's daily row in
+// JarvisUsage. Limits come from the SubscriptionPlan of the user's org, the
+// legacy premium allowance or the free "start" plan; the org row is capped by
+// the plan's separate org pool, if it has one. Mentions in guild channels are
+// counted against the guild's own row with a fixed daily limit instead of any
+// member's allowance. When a limit is reached
+// and the plan has a matching OveragePricing entry the request goes through
+// and is counted as overage instead of being rejected.
+//
+// Requests are reserved under a row lock before the model is called; tokens
+// are only known afterwards, so concurrent requests may overshoot the token
+// limit by at most one reply each.
+
+const (
+	jarvisUnlimited = -1
+	// Plans seeded with 999 requests per day are advertised as unlimited.
+	jarvisUnlimitedThreshold = 999
+	jarvisFreeDailyLimit     = 3
+	jarvisPremiumDailyLimit  = 50
+	jarvisGuildDailyLimit    = 100
+	jarvisTokensPerRequest   = 4000
+
+	jarvisOverageRequestMetric = "jarvis_request_pack"
+	jarvisOverageTokenMetric   = "jarvis_token_pack"
+)
+
+// jarvisQuota is the resolved set of limits for one user, or for one guild
+// when GuildID is set.
+type jarvisQuota struct {
+	UserID      uint
+	GuildID     uint
+	OrgID       *int
+	Plan        *SubscriptionPlan
+	Requests    int
+	Tokens      int
+	OrgRequests int
+	OrgTokens   int
+	// Overage pricing per metric, nil when the plan has none.
+	RequestOverage *OveragePricing
+	TokenOverage   *OveragePricing
+}
+
+// jarvisQuotaError is returned when a limit is exhausted and no overage
+// pricing applies.
+type jarvisQuotaError struct {
+	Scope   string // user, org, guild
+	Metric  string // requests, tokens
+	Limit   int
+	Used    int
+	ResetAt time.Time
+}
+
+func (e *jarvisQuotaError) Error() string {
+	return fmt.Sprintf("jarvis %s %s limit reached (%d/%d)", e.Scope, e.Metric, e.Used, e.Limit)
+}
+
+// body is the structured 429 payload shared by HTTP, SSE and WebSocket.
+func (e *jarvisQuotaError) body() gin.H {
+	return gin.H{
+		"error":    "Jarvis daily limit reached",
+		"code":     "jarvis_quota_exceeded",
+		"scope":    e.Scope,
+		"metric":   e.Metric,
+		"limit":    e.Limit,
+		"used":     e.Used,
+		"reset_at": e.ResetAt,
+	}
+}
+
+// abortJarvisQuota writes err as a 429 with Retry-After.
+func abortJarvisQuota(c *gin.Context, err *jarvisQuotaError) {
+	retry := int(math.Ceil(time.Until(err.ResetAt).Seconds()))
+	if retry < 1 {
+		retry = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(retry))
+	c.JSON(http.StatusTooManyRequests, err.body())
+}
+
+// InitJarvisQuota backfills rows written before quotas were tracked per
+// subject and adds the unique index the upserts rely on. Duplicate rows left
+// by the old unguarded inserts are merged first. Without the index every
+// reservation would insert another row, so startup stops if it cannot be
+// created.
+func InitJarvisQuota() {
+	if db == nil {
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("UPDATE jarvis_usages SET scope = 'user', subject_id = user_id WHERE subject_id = 0 AND user_id <> 0").Error; err != nil {
+			return fmt.Errorf("backfill subjects: %w", err)
+		}
+		if err := mergeDuplicateJarvisUsage(tx); err != nil {
+			return fmt.Errorf("merge duplicates: %w", err)
+		}
+		if err := tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_jarvis_usage_subject ON jarvis_usages (scope, subject_id, date)").Error; err != nil {
+			return fmt.Errorf("create unique index: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("[JarvisQuota] %v", err)
+	}
+}
+
+// mergeDuplicateJarvisUsage folds rows sharing (scope, subject_id, date)
+// into the oldest one so the unique index can be built.
+func mergeDuplicateJarvisUsage(tx *gorm.DB) error {
+	merged := tx.Exec(`UPDATE jarvis_usages u SET
+		request_count = d.request_count,
+		token_count = d.token_count,
+		overage_requests = d.overage_requests,
+		overage_tokens = d.overage_tokens
+	FROM (
+		SELECT MIN(id) AS keep_id,
+			SUM(request_count) AS request_count,
+			SUM(token_count) AS token_count,
+			SUM(overage_requests) AS overage_requests,
+			SUM(overage_tokens) AS overage_tokens
+		FROM jarvis_usages
+		GROUP BY scope, subject_id, date
+		HAVING COUNT(*) > 1
+	) d
+	WHERE u.id = d.keep_id`)
+	if merged.Error != nil {
+		return merged.Error
+	}
+	deleted := tx.Exec(`DELETE FROM jarvis_usages u USING jarvis_usages k
+		WHERE u.scope = k.scope AND u.subject_id = k.subject_id AND u.date = k.date AND u.id > k.id`)
+	if deleted.Error != nil {
+		return deleted.Error
+	}
+	if deleted.RowsAffected > 0 {
+		log.Printf("[JarvisQuota] Merged %d duplicate usage rows", deleted.RowsAffected)
+	}
+	return nil
+}
+
+func jarvisQuotaDay(now time.Time) time.Time {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// resolveJarvisQuota looks up the plan that applies to uid.
+func resolveJarvisQuota(uid uint, now time.Time) *jarvisQuota {
+	q := &jarvisQuota{UserID: uid}
+
+	var member OrgMember
+	if err := db.Where("user_id = ? AND state = 'active'", uid).First(&member).Error; err == nil {
+		var sub OrgSubscription
+		if err := db.Where("org_id = ? AND status IN ?", member.OrgID, orgServingStatuses).Order("id DESC").First(&sub).Error; err == nil && dunningAccess(sub.Status) == "full" {
+			var plan SubscriptionPlan
+			if err := db.First(&plan, sub.PlanID).Error; err == nil {
+				q.OrgID = &member.OrgID
+				q.applyPlan(&plan)
+				q.OrgRequests, q.OrgTokens = jarvisOrgLimits(&plan)
+				return q
+			}
+		}
+	}
+
+	var premium UserPremium
+	if err := db.Where("user_id = ? AND status = 'active' AND current_period_end > ?", uid, now).First(&premium).Error; err == nil {
+		q.Requests = jarvisPremiumDailyLimit
+		q.Tokens = jarvisPremiumDailyLimit * jarvisTokensPerRequest
+		return q
+	}
+
+	var plan SubscriptionPlan
+	if err := db.Where("slug = ? AND is_active = true", "start").First(&plan).Error; err == nil {
+		q.applyPlan(&plan)
+		return q
+	}
+	q.Requests = jarvisFreeDailyLimit
+	q.Tokens = jarvisFreeDailyLimit * jarvisTokensPerRequest
+	return q
+}
+
+// guildJarvisQuota is the allowance shared by everyone mentioning Jarvis in
+// one guild.
+func guildJarvisQuota(guildID uint) *jarvisQuota {
+	return &jarvisQuota{
+		GuildID:  guildID,
+		Requests: jarvisGuildDailyLimit,
+		Tokens:   jarvisGuildDailyLimit * jarvisTokensPerRequest,
+	}
+}
+
+func (q *jarvisQuota) String() string {
+	if q.GuildID != 0 {
+		return fmt.Sprintf("guild %d", q.GuildID)
+	}
+	return fmt.Sprintf("user %d", q.UserID)
+}
+
+func (q *jarvisQuota) applyPlan(plan *SubscriptionPlan) {
+	q.Plan = plan
+	q.Requests = plan.JarvisDailyLimit
+	q.Tokens = plan.JarvisDailyTokenLimit
+	if q.Requests >= jarvisUnlimitedThreshold {
+		q.Requests, q.Tokens = jarvisUnlimited, jarvisUnlimited
+	} else if q.Tokens == 0 {
+		q.Tokens = q.Requests * jarvisTokensPerRequest
+	}
+	q.RequestOverage = jarvisOveragePricing(plan.ID, jarvisOverageRequestMetric)
+	q.TokenOverage = jarvisOveragePricing(plan.ID, jarvisOverageTokenMetric)
+}
+
+// jarvisOrgLimits is the pool shared by all members of an org. Plans without
+// an org limit only cap each member individually.
+func jarvisOrgLimits(plan *SubscriptionPlan) (requests, tokens int) {
+	if plan.JarvisOrgDailyLimit <= 0 || plan.JarvisOrgDailyLimit >= jarvisUnlimitedThreshold {
+		return jarvisUnlimited, jarvisUnlimited
+	}
+	tokens = plan.JarvisOrgDailyTokenLimit
+	if tokens == 0 {
+		tokens = plan.JarvisOrgDailyLimit * jarvisTokensPerRequest
+	}
+	return plan.JarvisOrgDailyLimit, tokens
+}
+
+func jarvisOveragePricing(planID int, metric string) *OveragePricing {
+	var pricing OveragePricing
+	if err := db.Where("plan_id = ? AND metric_type = ? AND is_active = true", planID, metric).First(&pricing).Error; err != nil {
+		return nil
+	}
+	return &pricing
+}
+
+// overagePackSize reads the pack size from the pricing unit ("50 запросов").
+func overagePackSize(pricing *OveragePricing) int {
+	fields := strings.Fields(pricing.Unit)
+	if len(fields) > 0 {
+		if n, err := strconv.Atoi(fields[0]); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 1
+}
+
+// overageCost prices used units in whole packs.
+func overageCost(pricing *OveragePricing, used int) float64 {
+	if pricing == nil || used <= 0 {
+		return 0
+	}
+	packs := math.Ceil(float64(used) / float64(overagePackSize(pricing)))
+	return packs * pricing.PriceRub
+}
+
+// jarvisQuotaTicket is a reserved request. Finish must be called once the
+// model call is over.
+type jarvisQuotaTicket struct {
+	quota   *jarvisQuota
+	day     time.Time
+	overage bool
+}
+
+// reserveJarvisRequest counts one request for uid, or returns a
+// *jarvisQuotaError when a user or org limit is exhausted.
+func reserveJarvisRequest(uid uint, now time.Time) (*jarvisQuotaTicket, error) {
+	return reserveJarvisQuota(resolveJarvisQuota(uid, now), now)
+}
+
+// reserveGuildJarvisRequest counts one request against the guild's own
+// allowance.
+func reserveGuildJarvisRequest(guildID uint, now time.Time) (*jarvisQuotaTicket, error) {
+	return reserveJarvisQuota(guildJarvisQuota(guildID), now)
+}
+
+func reserveJarvisQuota(q *jarvisQuota, now time.Time) (*jarvisQuotaTicket, error) {
+	ticket := &jarvisQuotaTicket{quota: q, day: jarvisQuotaDay(now)}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		rows, err := ticket.lockRows(tx)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if err := ticket.checkRow(row.usage, row.requests, row.tokens); err != nil {
+				return err
+			}
+		}
+		updates := map[string]interface{}{"request_count": gorm.Expr("request_count + 1"), "updated_at": now}
+		if ticket.overage {
+			updates["overage_requests"] = gorm.Expr("overage_requests + 1")
+		}
+		for _, row := range rows {
+			if err := tx.Model(&JarvisUsage{}).Where("id = ?", row.usage.ID).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ticket, nil
+}
+
+// Finish records the tokens a reply used. A request that failed before any
+// tokens were spent is refunded.
+func (t *jarvisQuotaTicket) Finish(tokens int, delivered bool) {
+	if !delivered && tokens == 0 {
+		updates := map[string]interface{}{"request_count": gorm.Expr("GREATEST(request_count - 1, 0)")}
+		if t.overage {
+			updates["overage_requests"] = gorm.Expr("GREATEST(overage_requests - 1, 0)")
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			rows, err := t.lockRows(tx)
+			if err != nil {
+				return err
+			}
+			for _, row := range rows {
+				if err := tx.Model(&JarvisUsage{}).Where("id = ?", row.usage.ID).Updates(updates).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("[JarvisQuota] Failed to refund request for %s: %v", t.quota, err)
+		}
+		return
+	}
+	t.addTokens(tokens)
+}
+
+// recordJarvisTokens counts tokens spent on uid's behalf outside of a chat
+// request, e.g. for conversation summaries.
+func recordJarvisTokens(uid uint, tokens int) {
+	if tokens <= 0 {
+		return
+	}
+	now := time.Now()
+	ticket := &jarvisQuotaTicket{quota: resolveJarvisQuota(uid, now), day: jarvisQuotaDay(now)}
+	ticket.addTokens(tokens)
+}
+
+func (t *jarvisQuotaTicket) addTokens(tokens int) {
+	if tokens <= 0 {
+		return
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		rows, err := t.lockRows(tx)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			// Only tokens past the limit are overage; without token pricing
+			// the overshoot is simply counted.
+			over := 0
+			if row.tokens != jarvisUnlimited && t.quota.TokenOverage != nil {
+				over = max(row.usage.TokenCount+tokens-max(row.tokens, row.usage.TokenCount), 0)
+			}
+			if err := tx.Model(&JarvisUsage{}).Where("id = ?", row.usage.ID).Updates(map[string]interface{}{
+				"token_count":    gorm.Expr("token_count + ?", tokens),
+				"overage_tokens": gorm.Expr("overage_tokens + ?", over),
+				"updated_at":     time.Now(),
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[JarvisQuota] Failed to record %d tokens for %s: %v", tokens, t.quota, err)
+	}
+	if t.quota.OrgID != nil {
+		uid := t.quota.UserID
+		if err := recordUsage(UsageEvent{
+			IdempotencyKey: newUsageKey("jarvis"),
+			OrgID:          t.quota.OrgID,
+			UserID:         &uid,
+			Metric:         usageJarvisTokens,
+			Quantity:       float64(tokens),
+			Source:         "jarvis",
+		}); err != nil {
+			log.Printf("[JarvisQuota] Failed to meter %d tokens for org %d: %v", tokens, *t.quota.OrgID, err)
+		}
+	}
+}
+
+type jarvisUsageRow struct {
+	usage    JarvisUsage
+	requests int
+	tokens   int
+}
+
+// lockRows creates the day's rows if needed and locks them, user row first.
+func (t *jarvisQuotaTicket) lockRows(tx *gorm.DB) ([]jarvisUsageRow, error) {
+	q := t.quota
+	subjects := []JarvisUsage{{Scope: "user", SubjectID: int(q.UserID), UserID: int(q.UserID), OrgID: q.OrgID, Date: t.day}}
+	if q.GuildID != 0 {
+		subjects = []JarvisUsage{{Scope: "guild", SubjectID: int(q.GuildID), Date: t.day}}
+	}
+	limits := [][2]int{{q.Requests, q.Tokens}}
+	if q.OrgID != nil {
+		subjects = append(subjects, JarvisUsage{Scope: "org", SubjectID: *q.OrgID, OrgID: q.OrgID, Date: t.day})
+		limits = append(limits, [2]int{q.OrgRequests, q.OrgTokens})
+	}
+
+	rows := make([]jarvisUsageRow, 0, len(subjects))
+	for i, subject := range subjects {
+		subject.CreatedAt, subject.UpdatedAt = time.Now(), time.Now()
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&subject).Error; err != nil {
+			return nil, err
+		}
+		var usage JarvisUsage
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("scope = ? AND subject_id = ? AND date = ?", subject.Scope, subject.SubjectID, t.day).
+			First(&usage).Error; err != nil {
+			return nil, err
+		}
+		rows = append(rows, jarvisUsageRow{usage: usage, requests: limits[i][0], tokens: limits[i][1]})
+	}
+	return rows, nil
+}
+
+func (t *jarvisQuotaTicket) checkRow(usage JarvisUsage, requests, tokens int) error {
+	resetAt := t.day.Add(24 * time.Hour)
+	if requests != jarvisUnlimited && usage.RequestCount >= requests {
+		if t.quota.RequestOverage == nil {
+			return &jarvisQuotaError{Scope: usage.Scope, Metric: "requests", Limit: requests, Used: usage.RequestCount, ResetAt: resetAt}
+		}
+		t.overage = true
+	}
+	if tokens != jarvisUnlimited && usage.TokenCount >= tokens && t.quota.TokenOverage == nil {
+		return &jarvisQuotaError{Scope: usage.Scope, Metric: "tokens", Limit: tokens, Used: usage.TokenCount, ResetAt: resetAt}
+	}
+	return nil
+}
+
+// jarvisQuotaSnapshot reports today's usage for uid without counting anything.
+func jarvisQuotaSnapshot(uid uint, now time.Time) gin.H {
+	q := resolveJarvisQuota(uid, now)
+	day := jarvisQuotaDay(now)
+
+	subject := func(scope string, id int, requests, tokens int) gin.H {
+		var usage JarvisUsage
+		db.Where("scope = ? AND subject_id = ? AND date = ?", scope, id, day).First(&usage)
+		return gin.H{
+			"requests":         jarvisQuotaMetric(usage.RequestCount, requests),
+			"tokens":           jarvisQuotaMetric(usage.TokenCount, tokens),
+			"overage_requests": usage.OverageRequests,
+			"overage_tokens":   usage.OverageTokens,
+			"overage_cost_rub": overageCost(q.RequestOverage, usage.OverageRequests) + overageCost(q.TokenOverage, usage.OverageTokens),
+			"can_use":          jarvisQuotaOpen(usage.RequestCount, requests, q.RequestOverage) && jarvisQuotaOpen(usage.TokenCount, tokens, q.TokenOverage),
+		}
+	}
+
+	snapshot := gin.H{
+		"date":     day,
+		"reset_at": day.Add(24 * time.Hour),
+		"user":     subject("user", int(uid), q.Requests, q.Tokens),
+		"overage_allowed": gin.H{
+			"requests": q.RequestOverage != nil,
+			"tokens":   q.TokenOverage != nil,
+		},
+	}
+	if q.Plan != nil {
+		snapshot["plan"] = q.Plan.Slug
+	}
+	if q.OrgID != nil {
+		snapshot["org_id"] = *q.OrgID
+		snapshot["org"] = subject("org", *q.OrgID, q.OrgRequests, q.OrgTokens)
+	}
+	return snapshot
+}
+
+func jarvisQuotaMetric(used, limit int) gin.H {
+	metric := gin.H{"used": used, "limit": jarvisLimitValue(limit), "remaining": nil}
+	if limit != jarvisUnlimited {
+		metric["remaining"] = max(limit-used, 0)
+	}
+	return metric
+}
+
+func jarvisQuotaOpen(used, limit int, overage *OveragePricing) bool {
+	return limit == jarvisUnlimited || used < limit || overage != nil
+}
+
+// jarvisLimitValue renders unlimited as null in JSON.
+func jarvisLimitValue(limit int) interface{} {
+	if limit == jarvisUnlimited {
+		return nil
+	}
+	return limit
+}
+
+// jarvisQuotaErrorFrom unwraps a quota error from a reservation failure.
+func jarvisQuotaErrorFrom(err error) (*jarvisQuotaError, bool) {
+	var quotaErr *jarvisQuotaError
+	ok := errors.As(err, &quotaErr)
+	return quotaErr, ok
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJarvisOrgLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		plan             SubscriptionPlan
+		requests, tokens int
+	}{
+		{"no pool", SubscriptionPlan{JarvisDailyLimit: 20}, jarvisUnlimited, jarvisUnlimited},
+		{"derived tokens", SubscriptionPlan{JarvisDailyLimit: 20, JarvisOrgDailyLimit: 200}, 200, 200 * jarvisTokensPerRequest},
+		{"explicit tokens", SubscriptionPlan{JarvisOrgDailyLimit: 200, JarvisOrgDailyTokenLimit: 50000}, 200, 50000},
+		{"unlimited", SubscriptionPlan{JarvisOrgDailyLimit: 999}, jarvisUnlimited, jarvisUnlimited},
+	} {
+		requests, tokens := jarvisOrgLimits(&tc.plan)
+		if requests != tc.requests || tokens != tc.tokens {
+			t.Errorf("%s: got %d/%d, want %d/%d", tc.name, requests, tokens, tc.requests, tc.tokens)
+		}
+	}
+}
+
+func TestOveragePackSize(t *testing.T) {
+	for unit, want := range map[string]int{
+		"50 запросов":  50,
+		"1000 tokens":  1000,
+		"":             1,
+		"pack":         1,
+		"0 запросов":   1,
+		"-5 запросов":  1,
+		"10k tokens":   1,
+		" 20  токенов": 20,
+	} {
+		if got := overagePackSize(&OveragePricing{Unit: unit}); got != want {
+			t.Errorf("pack size of %q = %d, want %d", unit, got, want)
+		}
+	}
+}
+
+func TestOverageCost(t *testing.T) {
+	pack := &OveragePricing{Unit: "50 запросов", PriceRub: 99}
+	for _, tc := range []struct {
+		pricing *OveragePricing
+		used    int
+		want    float64
+	}{
+		{nil, 10, 0},
+		{pack, 0, 0},
+		{pack, -3, 0},
+		{pack, 1, 99}, // a started pack is paid in full
+		{pack, 50, 99},
+		{pack, 51, 198},
+		{&OveragePricing{Unit: "штука", PriceRub: 2.5}, 3, 7.5},
+	} {
+		if got := overageCost(tc.pricing, tc.used); got != tc.want {
+			t.Errorf("cost of %d at %+v = %v, want %v", tc.used, tc.pricing, got, tc.want)
+		}
+	}
+}
+
+func TestJarvisCheckRow(t *testing.T) {
+	day := jarvisQuotaDay(time.Date(2026, 3, 1, 15, 0, 0, 0, time.UTC))
+	pricing := &OveragePricing{Unit: "50 запросов", PriceRub: 99}
+	for _, tc := range []struct {
+		name             string
+		quota            jarvisQuota
+		usage            JarvisUsage
+		requests, tokens int
+		metric           string // of the refusal, "" when allowed
+		overage          bool
+	}{
+		{name: "under both limits", usage: JarvisUsage{RequestCount: 2, TokenCount: 100}, requests: 3, tokens: 1000},
+		{name: "requests exhausted", usage: JarvisUsage{Scope: "user", RequestCount: 3}, requests: 3, tokens: 1000, metric: "requests"},
+		{name: "request overage", quota: jarvisQuota{RequestOverage: pricing}, usage: JarvisUsage{RequestCount: 3}, requests: 3, tokens: 1000, overage: true},
+		{name: "tokens exhausted", usage: JarvisUsage{Scope: "org", RequestCount: 1, TokenCount: 1000}, requests: 3, tokens: 1000, metric: "tokens"},
+		{name: "token overage", quota: jarvisQuota{TokenOverage: pricing}, usage: JarvisUsage{TokenCount: 5000}, requests: 3, tokens: 1000},
+		{name: "request overage does not cover tokens", quota: jarvisQuota{RequestOverage: pricing}, usage: JarvisUsage{RequestCount: 3, TokenCount: 1000}, requests: 3, tokens: 1000, metric: "tokens"},
+		{name: "unlimited", usage: JarvisUsage{RequestCount: 10000, TokenCount: 1 << 30}, requests: jarvisUnlimited, tokens: jarvisUnlimited},
+	} {
+		ticket := &jarvisQuotaTicket{quota: &tc.quota, day: day}
+		err := ticket.checkRow(tc.usage, tc.requests, tc.tokens)
+		if tc.metric == "" {
+			if err != nil {
+				t.Errorf("%s: refused: %v", tc.name, err)
+			}
+		} else {
+			quotaErr, ok := jarvisQuotaErrorFrom(err)
+			if !ok {
+				t.Errorf("%s: got %v, want a %s refusal", tc.name, err, tc.metric)
+				continue
+			}
+			if quotaErr.Metric != tc.metric || quotaErr.Scope != tc.usage.Scope || !quotaErr.ResetAt.Equal(day.Add(24*time.Hour)) {
+				t.Errorf("%s: refusal = %+v", tc.name, quotaErr)
+			}
+		}
+		if err == nil && ticket.overage != tc.overage {
+			t.Errorf("%s: overage = %t, want %t", tc.name, ticket.overage, tc.overage)
+		}
+	}
+}
+
+// jarvisQuotaTestDB adds the unique index InitJarvisQuota creates, which the
+// row upserts rely on.
+func jarvisQuotaTestDB(t *testing.T) {
+	t.Helper()
+	testDB(t, &JarvisUsage{})
+	if err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_jarvis_usage_subject ON jarvis_usages (scope, subject_id, date)").Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func jarvisUsageRowFor(t *testing.T, scope string, subject int, day time.Time) JarvisUsage {
+	t.Helper()
+	var usage JarvisUsage
+	if err := db.Where("scope = ? AND subject_id = ? AND date = ?", scope, subject, day).First(&usage).Error; err != nil {
+		t.Fatalf("%s %d: %v", scope, subject, err)
+	}
+	return usage
+}
+
+// Only the tokens past the limit are counted as overage, and only when the
+// plan prices token packs.
+func TestJarvisAddTokensOverage(t *testing.T) {
+	jarvisQuotaTestDB(t)
+	day := jarvisQuotaDay(time.Now())
+	pricing := &OveragePricing{Unit: "1000 tokens", PriceRub: 10}
+
+	priced := &jarvisQuotaTicket{quota: &jarvisQuota{UserID: 1, Requests: 10, Tokens: 1000, TokenOverage: pricing}, day: day}
+	for _, step := range []struct{ tokens, total, overage int }{
+		{600, 600, 0},
+		{600, 1200, 200}, // crosses the limit
+		{300, 1500, 500}, // entirely past it
+		{0, 1500, 500},
+	} {
+		priced.addTokens(step.tokens)
+		usage := jarvisUsageRowFor(t, "user", 1, day)
+		if usage.TokenCount != step.total || usage.OverageTokens != step.overage {
+			t.Fatalf("after %d tokens: %d used, %d overage; want %d and %d",
+				step.tokens, usage.TokenCount, usage.OverageTokens, step.total, step.overage)
+		}
+	}
+
+	for uid, quota := range map[int]*jarvisQuota{
+		2: {UserID: 2, Requests: 10, Tokens: 1000},                                                // no pricing
+		3: {UserID: 3, Requests: jarvisUnlimited, Tokens: jarvisUnlimited, TokenOverage: pricing}, // no limit
+	} {
+		ticket := &jarvisQuotaTicket{quota: quota, day: day}
+		ticket.addTokens(1500)
+		if usage := jarvisUsageRowFor(t, "user", uid, day); usage.TokenCount != 1500 || usage.OverageTokens != 0 {
+			t.Errorf("user %d: %d used, %d overage", uid, usage.TokenCount, usage.OverageTokens)
+		}
+	}
+}
+
+// A refusal by the org row leaves the user row as it was, and an overage
+// reservation is counted as such on every row.
+func TestReserveJarvisQuotaRollback(t *testing.T) {
+	jarvisQuotaTestDB(t)
+	now := time.Now()
+	day := jarvisQuotaDay(now)
+	org := 7
+	db.Create(&JarvisUsage{Scope: "org", SubjectID: org, OrgID: &org, Date: day, RequestCount: 5})
+
+	quota := &jarvisQuota{UserID: 1, OrgID: &org, Requests: 10, Tokens: jarvisUnlimited, OrgRequests: 5, OrgTokens: jarvisUnlimited}
+	ticket, err := reserveJarvisQuota(quota, now)
+	if quotaErr, ok := jarvisQuotaErrorFrom(err); !ok || ticket != nil || quotaErr.Scope != "org" || quotaErr.Used != 5 {
+		t.Fatalf("reserve = %v, %v; want an org refusal", ticket, err)
+	}
+	var userRows int64
+	db.Model(&JarvisUsage{}).Where("scope = ?", "user").Count(&userRows)
+	if userRows != 0 {
+		t.Errorf("the refused reservation left %d user rows", userRows)
+	}
+	if usage := jarvisUsageRowFor(t, "org", org, day); usage.RequestCount != 5 || usage.OverageRequests != 0 {
+		t.Errorf("org row after refusal = %+v", usage)
+	}
+
+	quota.RequestOverage = &OveragePricing{Unit: "50 запросов", PriceRub: 99}
+	ticket, err = reserveJarvisQuota(quota, now)
+	if err != nil || !ticket.overage {
+		t.Fatalf("overage reserve = %+v, %v", ticket, err)
+	}
+	user, orgRow := jarvisUsageRowFor(t, "user", 1, day), jarvisUsageRowFor(t, "org", org, day)
+	if user.RequestCount != 1 || user.OverageRequests != 1 || orgRow.RequestCount != 6 || orgRow.OverageRequests != 1 {
+		t.Errorf("after an overage reservation: user %+v, org %+v", user, orgRow)
+	}
+}
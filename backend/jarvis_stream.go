@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+// Streaming Jarvis chat. The same flow is served over SSE
+// (POST /api/jarvis/chat/stream) and over the /ws socket (type "jarvis-chat").
+// Events: delta {content}, done {provider, model, tokens_used, usage,
+// conversation_id} and error {error}.
+
+const (
+	jarvisMaxStreamsPerClient = 3
+	// jarvisStreamWriteWindow is how long one SSE write may wait, including
+	// the pause before the first token. The server's WriteTimeout would
+	// otherwise cut every reply at 15 seconds.
+	jarvisStreamWriteWindow = 2 * time.Minute
+)
+
+// errJarvisClientClosed stops a stream whose client has gone: the socket was
+// closed or an SSE write failed.
+var errJarvisClientClosed = errors.New("jarvis client closed")
+
+// streamJarvisChat runs one chat for uid and reports progress through emit.
+// Cancelling ctx aborts the upstream request; tokens spent up to that point
+// are still counted and the partial reply is kept in the conversation.
+func streamJarvisChat(ctx context.Context, uid uint, req *JarvisRequest, emit func(event string, data gin.H) error) {
+	turn, err := prepareJarvisTurn(uid, req)
+	if err != nil {
+		if errors.Is(err, errJarvisConversationNotFound) {
+			emit("error", gin.H{"error": "Conversation not found"})
+			return
+		}
+		emit("error", gin.H{"error": "Failed to start conversation"})
+		return
+	}
+
+	if reply, ok := jarvisShortcutReply(uid, req); ok {
+		turn.save(req.Message, reply.Response, reply.Provider, reply.Model, 0, nil)
+		if emit("delta", gin.H{"content": reply.Response}) == nil {
+			emit("done", gin.H{
+				"provider":        reply.Provider,
+				"model":           reply.Model,
+				"tokens_used":     0,
+				"reminder":        reply.Reminder,
+				"conversation_id": req.ConversationID,
+			})
+		}
+		return
+	}
+
+	ticket, err := reserveJarvisRequest(uid, time.Now())
+	if err != nil {
+		if quotaErr, ok := jarvisQuotaErrorFrom(err); ok {
+			emit("error", quotaErr.body())
+			return
+		}
+		log.Printf("[Jarvis] Failed to reserve quota for user %d: %v", uid, err)
+		emit("error", gin.H{"error": "Failed to check Jarvis quota"})
+		return
+	}
+
+	var settings Settings
+	db.Where("user_id = ?", uid).First(&settings)
+	only := ""
+	if isLLMProviderName(req.Provider) {
+		only = req.Provider
+	}
+
+	resp, err := buildLLMChain(&settings, only).Stream(ctx, LLMRequest{
+		Messages:    turn.Messages,
+		MaxTokens:   2048,
+		Temperature: 0.7,
+	}, func(delta string) error {
+		return emit("delta", gin.H{"content": delta})
+	})
+	if resp == nil {
+		ticket.Finish(0, false)
+	} else {
+		ticket.Finish(resp.TotalTokens, resp.Content != "")
+		turn.save(req.Message, resp.Content, resp.Provider, resp.Model, resp.TotalTokens, &settings)
+	}
+	if err != nil {
+		if ctx.Err() != nil || errors.Is(err, errJarvisClientClosed) {
+			log.Printf("[Jarvis] Stream for user %d cancelled by client", uid)
+			return
+		}
+		log.Printf("[Jarvis] Stream for user %d failed: %v", uid, err)
+		emit("error", gin.H{"error": "AI providers are unavailable, please try again later"})
+		return
+	}
+
+	emit("done", gin.H{
+		"provider":    resp.Provider,
+		"model":       resp.Model,
+		"tokens_used": resp.TotalTokens,
+		"usage": gin.H{
+			"prompt_tokens":     resp.PromptTokens,
+			"completion_tokens": resp.CompletionTokens,
+			"total_tokens":      resp.TotalTokens,
+		},
+		"conversation_id": req.ConversationID,
+	})
+}
+
+// HandleJarvisChatStream is the SSE variant of /api/jarvis/chat. Closing the
+// connection cancels the upstream call.
+func HandleJarvisChatStream(c *gin.Context) {
+	uid, ok := getUserIDFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req JarvisRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	rc := http.NewResponseController(c.Writer)
+	rc.SetWriteDeadline(time.Now().Add(jarvisStreamWriteWindow))
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	ctx := c.Request.Context()
+	streamJarvisChat(ctx, uid, &req, func(event string, data gin.H) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rc.SetWriteDeadline(time.Now().Add(jarvisStreamWriteWindow))
+		if err := sse.Encode(c.Writer, sse.Event{Event: event, Data: data}); err != nil {
+			return fmt.Errorf("%w: %v", errJarvisClientClosed, err)
+		}
+		if err := rc.Flush(); err != nil {
+			return fmt.Errorf("%w: %v", errJarvisClientClosed, err)
+		}
+		return nil
+	})
+}
+
+// WebSocket
+
+// startJarvisChat handles a "jarvis-chat" socket message. The client picks a
+// request_id that tags every reply and can be passed to "jarvis-chat-cancel".
+func (c *WSClient) startJarvisChat(msg map[string]interface{}) {
+	requestID := getStringFromMap(msg, "request_id")
+	if requestID == "" {
+		requestID = strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+
+	var req JarvisRequest
+	raw, _ := json.Marshal(msg)
+	json.Unmarshal(raw, &req)
+	uid, err := strconv.ParseUint(c.UserID, 10, 32)
+	if err != nil || req.Message == "" {
+		c.sendJarvisEvent(context.Background(), requestID, "error", gin.H{"error": "message is required"})
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.jarvisMu.Lock()
+	if c.jarvisStreams == nil {
+		c.jarvisStreams = make(map[string]context.CancelFunc)
+	}
+	_, duplicate := c.jarvisStreams[requestID]
+	if duplicate || len(c.jarvisStreams) >= jarvisMaxStreamsPerClient {
+		c.jarvisMu.Unlock()
+		cancel()
+		c.sendJarvisEvent(context.Background(), requestID, "error", gin.H{"error": "Too many concurrent Jarvis requests"})
+		return
+	}
+	c.jarvisStreams[requestID] = cancel
+	c.jarvisMu.Unlock()
+
+	go func() {
+		defer func() {
+			c.jarvisMu.Lock()
+			delete(c.jarvisStreams, requestID)
+			c.jarvisMu.Unlock()
+			cancel()
+		}()
+		streamJarvisChat(ctx, uint(uid), &req, func(event string, data gin.H) error {
+			return c.sendJarvisEvent(ctx, requestID, event, data)
+		})
+	}()
+}
+
+// cancelJarvisChat handles "jarvis-chat-cancel".
+func (c *WSClient) cancelJarvisChat(requestID string) {
+	c.jarvisMu.Lock()
+	cancel, ok := c.jarvisStreams[requestID]
+	c.jarvisMu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+// stopJarvisChats cancels all running streams and blocks further sends. It
+// must run before the hub closes the Send channel.
+func (c *WSClient) stopJarvisChats() {
+	c.jarvisMu.Lock()
+	for _, cancel := range c.jarvisStreams {
+		cancel()
+	}
+	c.jarvisMu.Unlock()
+
+	c.sendMu.Lock()
+	c.closed = true
+	c.sendMu.Unlock()
+}
+
+func (c *WSClient) sendJarvisEvent(ctx context.Context, requestID, event string, data gin.H) error {
+	payload := gin.H{"type": "jarvis-chat-" + event, "request_id": requestID}
+	for k, v := range data {
+		payload[k] = v
+	}
+
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.closed {
+		return errJarvisClientClosed
+	}
+	select {
+	case c.Send <- payload:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(writeWait):
+		return errJarvisClientClosed
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Function calling for Jarvis chat. The model is offered the built-in
+// platform tools plus the Jarvis MCP tools the caller's role allows. Tool
+// calls run with the caller's permissions, their results go back to the model
+// and the loop repeats until it answers in text or runs out of steps. Every
+// invocation is written to the extended audit log.
+
+const (
+	jarvisToolTimeout    = 20 * time.Second
+	jarvisToolMaxResult  = 8000
+	jarvisToolSearchMax  = 20
+	jarvisToolSnippetLen = 300
+)
+
+// jarvisToolMaxSteps is overridden by JARVIS_TOOL_STEPS.
+var jarvisToolMaxSteps = 5
+
+func init() {
+	if v, err := strconv.Atoi(os.Getenv("JARVIS_TOOL_STEPS")); err == nil && v >= 0 {
+		jarvisToolMaxSteps = v
+	}
+}
+
+// jarvisToolCaller is the user on whose behalf tools run.
+type jarvisToolCaller struct {
+	UserID    uint
+	Role      string
+	Timezone  string
+	IP        string
+	UserAgent string
+}
+
+type jarvisTool struct {
+	Name        string
+	Description string
+	Parameters  json.RawMessage
+	Run         func(ctx context.Context, caller *jarvisToolCaller, args json.RawMessage) (interface{}, error)
+}
+
+var jarvisBuiltinTools = []jarvisTool{
+	{
+		Name:        "search_my_messages",
+		Description: "Search the user's direct messages and the channel messages they wrote. Returns the newest matches first.",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"query":{"type":"string","description":"Text to look for"},"limit":{"type":"integer","minimum":1,"maximum":20}},"required":["query"]}`),
+		Run:         runSearchMyMessagesTool,
+	},
+	{
+		Name:        "create_reminder",
+		Description: "Create a reminder for the user. remind_at is RFC 3339 or \"YYYY-MM-DD HH:MM\" in the user's time zone.",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"text":{"type":"string"},"remind_at":{"type":"string"}},"required":["text","remind_at"]}`),
+		Run:         runCreateReminderTool,
+	},
+	{
+		Name:        "list_my_guild_channels",
+		Description: "List the servers (guilds) the user belongs to and the channels they can see.",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"guild_id":{"type":"integer","description":"Only this guild"}}}`),
+		Run:         runListMyGuildChannelsTool,
+	},
+}
+
+var jarvisToolNameRe = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// jarvisToolsFor returns the tools the caller may use.
+func jarvisToolsFor(caller *jarvisToolCaller) []jarvisTool {
+	tools := append([]jarvisTool(nil), jarvisBuiltinTools...)
+	if !jarvisMCP.Running() {
+		return tools
+	}
+	for _, t := range jarvisMCP.Tools() {
+		if !jarvisMCP.RoleAllows(t.Name, caller.Role) {
+			continue
+		}
+		name := t.Name
+		params := t.InputSchema
+		if len(params) == 0 {
+			params = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+		tools = append(tools, jarvisTool{
+			Name:        "mcp_" + jarvisToolNameRe.ReplaceAllString(name, "_"),
+			Description: t.Description,
+			Parameters:  params,
+			Run: func(ctx context.Context, _ *jarvisToolCaller, args json.RawMessage) (interface{}, error) {
+				var input map[string]interface{}
+				if err := json.Unmarshal(args, &input); err != nil {
+					return nil, err
+				}
+				resp, err := jarvisMCP.ExecuteMCPToolContext(ctx, name, input)
+				if err != nil {
+					return nil, err
+				}
+				if !resp.Success {
+					return nil, errors.New(resp.Error)
+				}
+				return resp.Data, nil
+			},
+		})
+	}
+	return tools
+}
+
+// runJarvisTools completes req, executing tool calls until the model answers
+// in text. The last round is sent without tools so the model has to answer.
+// Token counts cover all rounds, also when an error is returned.
+func runJarvisTools(ctx context.Context, chain llmChain, req LLMRequest, caller *jarvisToolCaller) (*LLMResponse, []string, error) {
+	tools := jarvisToolsFor(caller)
+	byName := make(map[string]jarvisTool, len(tools))
+	specs := make([]ChatTool, 0, len(tools))
+	for _, t := range tools {
+		byName[t.Name] = t
+		specs = append(specs, ChatTool{Type: "function", Function: ChatToolFunction{Name: t.Name, Description: t.Description, Parameters: t.Parameters}})
+	}
+
+	loc := jarvisLocation(caller.Timezone)
+	messages := append([]ChatMessage(nil), req.Messages...)
+	hint := ChatMessage{Role: "system", Content: fmt.Sprintf("Current time: %s (%s). Use the tools when the user asks about their messages, channels or reminders; never invent their results.", time.Now().In(loc).Format("2006-01-02 15:04 Monday"), loc)}
+	if len(messages) > 0 && messages[0].Role == "system" {
+		messages = append(messages[:1], append([]ChatMessage{hint}, messages[1:]...)...)
+	} else {
+		messages = append([]ChatMessage{hint}, messages...)
+	}
+
+	total := &LLMResponse{}
+	var used []string
+	for step := 0; ; step++ {
+		round := req
+		round.Messages = messages
+		round.Tools = nil
+		if step < jarvisToolMaxSteps && len(specs) > 0 {
+			round.Tools = specs
+		}
+
+		resp, err := chain.Complete(ctx, round)
+		if err != nil {
+			return total, used, err
+		}
+		total.Provider, total.Model = resp.Provider, resp.Model
+		total.PromptTokens += resp.PromptTokens
+		total.CompletionTokens += resp.CompletionTokens
+		total.TotalTokens += resp.TotalTokens
+
+		if len(resp.ToolCalls) == 0 || round.Tools == nil {
+			total.Content = resp.Content
+			return total, used, nil
+		}
+
+		messages = append(messages, ChatMessage{Role: "assistant", Content: resp.Content, ToolCalls: resp.ToolCalls})
+		for _, call := range resp.ToolCalls {
+			messages = append(messages, ChatMessage{
+				Role:       "tool",
+				ToolCallID: call.ID,
+				Content:    executeJarvisToolCall(ctx, caller, byName, call),
+			})
+			used = append(used, call.Function.Name)
+		}
+	}
+}
+
+// executeJarvisToolCall runs one call and returns what the model sees: the
+// JSON result, or a JSON error object.
+func executeJarvisToolCall(ctx context.Context, caller *jarvisToolCaller, tools map[string]jarvisTool, call ChatToolCall) string {
+	started := time.Now()
+	args := json.RawMessage(call.Function.Arguments)
+	if strings.TrimSpace(call.Function.Arguments) == "" {
+		args = json.RawMessage("{}")
+	}
+
+	var result interface{}
+	var err error
+	tool, ok := tools[call.Function.Name]
+	switch {
+	case !ok:
+		err = fmt.Errorf("unknown tool %q", call.Function.Name)
+	case !json.Valid(args):
+		err = errors.New("arguments are not valid JSON")
+	default:
+		toolCtx, cancel := context.WithTimeout(ctx, jarvisToolTimeout)
+		result, err = tool.Run(toolCtx, caller, args)
+		cancel()
+	}
+
+	var output string
+	if err != nil {
+		data, _ := json.Marshal(map[string]string{"error": err.Error()})
+		output = string(data)
+	} else if text, isText := result.(string); isText {
+		output = text
+	} else {
+		data, _ := json.Marshal(result)
+		output = string(data)
+	}
+	if len(output) > jarvisToolMaxResult {
+		output = truncateUTF8(output, jarvisToolMaxResult) + "…[truncated]"
+	}
+
+	details := map[string]interface{}{
+		"call_id":     call.ID,
+		"arguments":   truncateUTF8(string(args), 1000),
+		"ok":          err == nil,
+		"duration_ms": time.Since(started).Milliseconds(),
+	}
+	if err != nil {
+		details["error"] = err.Error()
+		log.Printf("[Jarvis] Tool %s for user %d failed: %v", call.Function.Name, caller.UserID, err)
+	}
+	detailsJSON, _ := json.Marshal(details)
+	logExtendedAudit(caller.UserID, "jarvis_tool_call", "jarvis_tool", call.Function.Name, "user", string(detailsJSON), caller.IP, caller.UserAgent)
+	return output
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// Built-in tools
+
+func runSearchMyMessagesTool(ctx context.Context, caller *jarvisToolCaller, raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		Query string `json:"query"`
+		Limit int    `json:"limit"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	args.Query = strings.TrimSpace(args.Query)
+	if args.Query == "" {
+		return nil, errors.New("query is required")
+	}
+	if args.Limit <= 0 || args.Limit > jarvisToolSearchMax {
+		args.Limit = jarvisToolSearchMax
+	}
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(args.Query) + "%"
+
+	type match struct {
+		Kind      string    `json:"kind"` // dm, channel
+		ID        uint      `json:"id"`
+		From      string    `json:"from"`
+		To        string    `json:"to,omitempty"`
+		ChannelID uint      `json:"channel_id,omitempty"`
+		Content   string    `json:"content"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	var matches []match
+
+	var dms []DirectMessage
+	db.WithContext(ctx).Where("(sender_id = ? OR receiver_id = ?) AND content ILIKE ?", caller.UserID, caller.UserID, pattern).
+		Order("created_at DESC").Limit(args.Limit).Find(&dms)
+	names := map[uint]string{}
+	userName := func(id uint) string {
+		if name, ok := names[id]; ok {
+			return name
+		}
+		var u User
+		db.WithContext(ctx).Select("id", "username").First(&u, id)
+		names[id] = u.Username
+		return u.Username
+	}
+	for _, m := range dms {
+		matches = append(matches, match{Kind: "dm", ID: m.ID, From: userName(m.SenderID), To: userName(m.ReceiverID), Content: truncateUTF8(m.Content, jarvisToolSnippetLen), CreatedAt: m.CreatedAt})
+	}
+
+	var own []Message
+	db.WithContext(ctx).Where("author_id = ? AND content ILIKE ?", caller.UserID, pattern).
+		Order("created_at DESC").Limit(args.Limit).Find(&own)
+	for _, m := range own {
+		matches = append(matches, match{Kind: "channel", ID: m.ID, From: userName(m.AuthorID), ChannelID: m.ChannelID, Content: truncateUTF8(m.Content, jarvisToolSnippetLen), CreatedAt: m.CreatedAt})
+	}
+
+	for i := 1; i < len(matches); i++ {
+		for j := i; j > 0 && matches[j].CreatedAt.After(matches[j-1].CreatedAt); j-- {
+			matches[j], matches[j-1] = matches[j-1], matches[j]
+		}
+	}
+	if len(matches) > args.Limit {
+		matches = matches[:args.Limit]
+	}
+	return map[string]interface{}{"matches": matches}, nil
+}
+
+func runCreateReminderTool(ctx context.Context, caller *jarvisToolCaller, raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		Text     string `json:"text"`
+		RemindAt string `json:"remind_at"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+
+	loc := jarvisLocation(caller.Timezone)
+	value := strings.TrimSpace(args.RemindAt)
+	remindAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		remindAt, err = time.ParseInLocation("2006-01-02 15:04", value, loc)
+	}
+	if err != nil {
+		return nil, errors.New(`remind_at must be RFC 3339 or "YYYY-MM-DD HH:MM"`)
+	}
+
+	reminder, err := createJarvisReminder(caller.UserID, strings.TrimSpace(args.Text), remindAt, "chat", time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"id":        reminder.ID,
+		"text":      reminder.Content,
+		"remind_at": reminder.RemindAt.In(loc).Format("2006-01-02 15:04 MST"),
+	}, nil
+}
+
+func runListMyGuildChannelsTool(ctx context.Context, caller *jarvisToolCaller, raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		GuildID uint `json:"guild_id"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+
+	query := db.WithContext(ctx).Where("owner_id = ? OR id IN (?)", caller.UserID,
+		db.Model(&GuildMember{}).Select("guild_id").Where("user_id = ?", caller.UserID))
+	if args.GuildID != 0 {
+		query = query.Where("id = ?", args.GuildID)
+	}
+	var guilds []Guild
+	if err := query.Order("id").Find(&guilds).Error; err != nil {
+		return nil, err
+	}
+
+	type channelInfo struct {
+		ID   uint   `json:"id"`
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+	type guildInfo struct {
+		ID       uint          `json:"id"`
+		Name     string        `json:"name"`
+		Channels []channelInfo `json:"channels"`
+	}
+	result := make([]guildInfo, 0, len(guilds))
+	for _, g := range guilds {
+		var channels []Channel
+		db.WithContext(ctx).Where("guild_id = ?", g.ID).Order("position, id").Find(&channels)
+		info := guildInfo{ID: g.ID, Name: g.Name, Channels: []channelInfo{}}
+		for _, ch := range channels {
+			if hasChannelAccess(caller.UserID, ch) {
+				info.Channels = append(info.Channels, channelInfo{ID: ch.ID, Name: ch.Name, Type: ch.Type})
+			}
+		}
+		result = append(result, info)
+	}
+	return map[string]interface{}{"guilds": result}, nil
+}
@@ -0,0 +1,762 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Ledger account types. Clearing and refunds carry debit balances, the
+// others credit balances.
+const (
+	ledgerUserWallet       = "user_wallet"
+	ledgerCreatorPayable   = "creator_payable"
+	ledgerPlatformRevenue  = "platform_revenue"
+	ledgerRefunds          = "refunds"
+	ledgerProviderClearing = "provider_clearing"
+)
+
+var errLedgerImmutable = errors.New("ledger records are immutable")
+
+// LedgerAccount is one account per type, owner (a user id or a provider
+// name) and currency.
+type LedgerAccount struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Code      string    `gorm:"uniqueIndex;size:120" json:"code"`
+	Type      string    `gorm:"size:30;index" json:"type"`
+	OwnerID   *uint     `gorm:"index" json:"owner_id,omitempty"`
+	Owner     string    `gorm:"size:60" json:"owner,omitempty"`
+	Currency  string    `gorm:"size:3;default:'RUB'" json:"currency"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LedgerEntry is a journal entry. Its lines always sum to zero, and the
+// idempotency key makes posting the same event twice a no-op.
+type LedgerEntry struct {
+	ID                uint         `gorm:"primaryKey" json:"id"`
+	IdempotencyKey    string       `gorm:"uniqueIndex;size:150" json:"idempotency_key"`
+	Kind              string       `gorm:"size:40;index" json:"kind"` // payment, refund, donation, donation_fee, donation_refund, payout, manual_payment
+	Description       string       `json:"description"`
+	SourceType        string       `gorm:"size:40;index:idx_ledger_entry_source" json:"source_type"`
+	SourceID          string       `gorm:"size:64;index:idx_ledger_entry_source" json:"source_id"`
+	Provider          string       `gorm:"size:30" json:"provider,omitempty"`
+	ProviderPaymentID string       `gorm:"size:64;index" json:"provider_payment_id,omitempty"`
+	AmountKopecks     int64        `json:"amount_kopecks"`
+	Currency          string       `gorm:"size:3;default:'RUB'" json:"currency"`
+	PostedAt          time.Time    `gorm:"index" json:"posted_at"`
+	CreatedAt         time.Time    `json:"created_at"`
+	Lines             []LedgerLine `gorm:"foreignKey:EntryID" json:"lines,omitempty"`
+}
+
+// LedgerLine debits (positive) or credits (negative) one account.
+type LedgerLine struct {
+	ID            uint           `gorm:"primaryKey" json:"id"`
+	EntryID       uint           `gorm:"index" json:"entry_id"`
+	AccountID     uint           `gorm:"index" json:"account_id"`
+	Account       *LedgerAccount `gorm:"foreignKey:AccountID" json:"account,omitempty"`
+	AmountKopecks int64          `json:"amount_kopecks"`
+	CreatedAt     time.Time      `json:"created_at"`
+}
+
+func (*LedgerEntry) BeforeUpdate(*gorm.DB) error { return errLedgerImmutable }
+func (*LedgerEntry) BeforeDelete(*gorm.DB) error { return errLedgerImmutable }
+func (*LedgerLine) BeforeUpdate(*gorm.DB) error  { return errLedgerImmutable }
+func (*LedgerLine) BeforeDelete(*gorm.DB) error  { return errLedgerImmutable }
+
+// ledgerAccountRef names an account before it exists.
+type ledgerAccountRef struct {
+	Type     string
+	OwnerID  uint
+	Owner    string
+	Currency string
+}
+
+func (r ledgerAccountRef) code() string {
+	parts := []string{r.Type}
+	if r.OwnerID != 0 {
+		parts = append(parts, strconv.FormatUint(uint64(r.OwnerID), 10))
+	} else if r.Owner != "" {
+		parts = append(parts, r.Owner)
+	}
+	return strings.Join(append(parts, ledgerCurrency(r.Currency)), ":")
+}
+
+func ledgerCurrency(currency string) string {
+	if currency == "" {
+		return "RUB"
+	}
+	return strings.ToUpper(currency)
+}
+
+func walletAccount(userID uint, currency string) ledgerAccountRef {
+	return ledgerAccountRef{Type: ledgerUserWallet, OwnerID: userID, Currency: currency}
+}
+
+func creatorPayableAccount(userID uint, currency string) ledgerAccountRef {
+	return ledgerAccountRef{Type: ledgerCreatorPayable, OwnerID: userID, Currency: currency}
+}
+
+func revenueAccount(currency string) ledgerAccountRef {
+	return ledgerAccountRef{Type: ledgerPlatformRevenue, Currency: currency}
+}
+
+func refundsAccount(currency string) ledgerAccountRef {
+	return ledgerAccountRef{Type: ledgerRefunds, Currency: currency}
+}
+
+func clearingAccount(provider, currency string) ledgerAccountRef {
+	if provider == "" {
+		provider = "unknown"
+	}
+	return ledgerAccountRef{Type: ledgerProviderClearing, Owner: provider, Currency: currency}
+}
+
+// ledgerNormalSign turns a raw debit-positive sum into the account's
+// natural balance.
+func ledgerNormalSign(accountType string) int64 {
+	switch accountType {
+	case ledgerProviderClearing, ledgerRefunds:
+		return 1
+	}
+	return -1
+}
+
+type ledgerPosting struct {
+	Account ledgerAccountRef
+	Amount  int64 // kopecks, debit positive
+}
+
+func validateLedgerPostings(postings []ledgerPosting) error {
+	if len(postings) < 2 {
+		return errors.New("a ledger entry needs at least two lines")
+	}
+	var sum int64
+	currency := ledgerCurrency(postings[0].Account.Currency)
+	for _, p := range postings {
+		if p.Amount == 0 {
+			return errors.New("ledger lines must not be zero")
+		}
+		if ledgerCurrency(p.Account.Currency) != currency {
+			return errors.New("a ledger entry must use a single currency")
+		}
+		sum += p.Amount
+	}
+	if sum != 0 {
+		return fmt.Errorf("ledger entry is unbalanced by %d", sum)
+	}
+	return nil
+}
+
+func ensureLedgerAccount(tx *gorm.DB, ref ledgerAccountRef) (*LedgerAccount, error) {
+	account := LedgerAccount{Code: ref.code(), Type: ref.Type, Owner: ref.Owner, Currency: ledgerCurrency(ref.Currency)}
+	if ref.OwnerID != 0 {
+		ownerID := ref.OwnerID
+		account.OwnerID = &ownerID
+	}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&account).Error; err != nil {
+		return nil, err
+	}
+	if account.ID == 0 {
+		if err := tx.Where("code = ?", account.Code).First(&account).Error; err != nil {
+			return nil, err
+		}
+	}
+	return &account, nil
+}
+
+// postLedgerEntry writes entry with its lines. An entry whose idempotency
+// key was already posted is left alone.
+// ledgerInsertCount keys an *int on a transaction's context that counts the
+// entries postLedgerEntry inserts, as opposed to ones already posted.
+type ledgerInsertCount struct{}
+
+func postLedgerEntry(tx *gorm.DB, entry LedgerEntry, postings []ledgerPosting) error {
+	if err := validateLedgerPostings(postings); err != nil {
+		return fmt.Errorf("%s: %w", entry.IdempotencyKey, err)
+	}
+	entry.Currency = ledgerCurrency(postings[0].Account.Currency)
+	if entry.PostedAt.IsZero() {
+		entry.PostedAt = time.Now()
+	}
+	if entry.AmountKopecks == 0 {
+		// Compound entries pass money through wallets, so the gross amount
+		// is the first leg rather than the sum of the debits
+		entry.AmountKopecks = postings[0].Amount
+		if entry.AmountKopecks < 0 {
+			entry.AmountKopecks = -entry.AmountKopecks
+		}
+	}
+
+	result := tx.Omit("Lines").Clauses(clause.OnConflict{DoNothing: true}).Create(&entry)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+	if inserted, ok := tx.Statement.Context.Value(ledgerInsertCount{}).(*int); ok {
+		*inserted++
+	}
+	lines := make([]LedgerLine, 0, len(postings))
+	for _, p := range postings {
+		account, err := ensureLedgerAccount(tx, p.Account)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, LedgerLine{EntryID: entry.ID, AccountID: account.ID, AmountKopecks: p.Amount})
+	}
+	return tx.Create(&lines).Error
+}
+
+func premiumLedgerKey(transactionID uint, event string) string {
+	return fmt.Sprintf("premium_tx:%d:%s", transactionID, event)
+}
+
+func transactionPostedAt(t *PremiumTransaction) time.Time {
+	if t.CompletedAt != nil {
+		return *t.CompletedAt
+	}
+	return time.Now()
+}
+
+// postPremiumPaymentLedger records a paid PremiumTransaction: the provider
+// collects the money for the user, who spends it on the platform.
+func postPremiumPaymentLedger(tx *gorm.DB, t *PremiumTransaction) error {
+	amount := rubToKopecks(t.AmountRub)
+	if amount <= 0 {
+		return nil
+	}
+	return postLedgerEntry(tx, LedgerEntry{
+		IdempotencyKey:    premiumLedgerKey(t.ID, "payment"),
+		Kind:              "payment",
+		Description:       t.Description,
+		SourceType:        "premium_transaction",
+		SourceID:          strconv.FormatUint(uint64(t.ID), 10),
+		Provider:          t.PaymentProvider,
+		ProviderPaymentID: t.ProviderPaymentID,
+		PostedAt:          transactionPostedAt(t),
+	}, []ledgerPosting{
+		{clearingAccount(t.PaymentProvider, t.Currency), amount},
+		{walletAccount(t.UserID, t.Currency), -amount},
+		{walletAccount(t.UserID, t.Currency), amount},
+		{revenueAccount(t.Currency), -amount},
+	})
+}
+
+// postPremiumRefundLedger reverses a payment through the refunds account so
+// revenue keeps its history.
+func postPremiumRefundLedger(tx *gorm.DB, t *PremiumTransaction, refundedAt time.Time) error {
+	amount := rubToKopecks(t.AmountRub)
+	if amount <= 0 {
+		return nil
+	}
+	return postLedgerEntry(tx, LedgerEntry{
+		IdempotencyKey:    premiumLedgerKey(t.ID, "refund"),
+		Kind:              "refund",
+		Description:       "Refund: " + t.Description,
+		SourceType:        "premium_transaction",
+		SourceID:          strconv.FormatUint(uint64(t.ID), 10),
+		Provider:          t.PaymentProvider,
+		ProviderPaymentID: t.ProviderPaymentID,
+		PostedAt:          refundedAt,
+	}, []ledgerPosting{
+		{refundsAccount(t.Currency), amount},
+		{walletAccount(t.UserID, t.Currency), -amount},
+		{walletAccount(t.UserID, t.Currency), amount},
+		{clearingAccount(t.PaymentProvider, t.Currency), -amount},
+	})
+}
+
+// postDonationLedger records a paid CreatorDonation as owed to the creator,
+// then takes the platform fee out of the creator's balance.
+func postDonationLedger(tx *gorm.DB, d *CreatorDonation, postedAt time.Time) error {
+	amount := rubToKopecks(d.AmountRub)
+	if amount <= 0 {
+		return nil
+	}
+	if err := postLedgerEntry(tx, LedgerEntry{
+		IdempotencyKey:    fmt.Sprintf("creator_donation:%d:payment", d.ID),
+		Kind:              "donation",
+		Description:       fmt.Sprintf("Donation to user %d", d.ToUserID),
+		SourceType:        "creator_donation",
+		SourceID:          strconv.FormatUint(uint64(d.ID), 10),
+		Provider:          "yookassa",
+		ProviderPaymentID: d.PaymentID,
+		PostedAt:          postedAt,
+	}, []ledgerPosting{
+		{clearingAccount("yookassa", "RUB"), amount},
+		{creatorPayableAccount(d.ToUserID, "RUB"), -amount},
+	}); err != nil {
+		return err
+	}
+
+	if d.PlatformFeeKopecks == 0 {
+		d.PlatformFeeKopecks = creatorPlatformFee(amount, creatorFeePercent)
+		if d.PlatformFeeKopecks == 0 {
+			return nil
+		}
+		if err := tx.Model(d).Update("platform_fee_kopecks", d.PlatformFeeKopecks).Error; err != nil {
+			return err
+		}
+	}
+	return postLedgerEntry(tx, LedgerEntry{
+		IdempotencyKey: fmt.Sprintf("creator_donation:%d:fee", d.ID),
+		Kind:           "donation_fee",
+		Description:    fmt.Sprintf("Platform fee on donation %d", d.ID),
+		SourceType:     "creator_donation",
+		SourceID:       strconv.FormatUint(uint64(d.ID), 10),
+		PostedAt:       postedAt,
+	}, []ledgerPosting{
+		{creatorPayableAccount(d.ToUserID, "RUB"), d.PlatformFeeKopecks},
+		{revenueAccount("RUB"), -d.PlatformFeeKopecks},
+	})
+}
+
+// postDonationRefundLedger returns a donation to the donor: the creator
+// gives back their share and the fee goes through refunds.
+func postDonationRefundLedger(tx *gorm.DB, d *CreatorDonation, refundedAt time.Time) error {
+	amount := rubToKopecks(d.AmountRub)
+	if amount <= 0 {
+		return nil
+	}
+	postings := []ledgerPosting{
+		{clearingAccount("yookassa", "RUB"), -amount},
+		{creatorPayableAccount(d.ToUserID, "RUB"), amount - d.PlatformFeeKopecks},
+	}
+	if d.PlatformFeeKopecks > 0 {
+		postings = append(postings, ledgerPosting{refundsAccount("RUB"), d.PlatformFeeKopecks})
+	}
+	return postLedgerEntry(tx, LedgerEntry{
+		IdempotencyKey:    fmt.Sprintf("creator_donation:%d:refund", d.ID),
+		Kind:              "donation_refund",
+		Description:       fmt.Sprintf("Refund of donation %d", d.ID),
+		SourceType:        "creator_donation",
+		SourceID:          strconv.FormatUint(uint64(d.ID), 10),
+		Provider:          "yookassa",
+		ProviderPaymentID: d.PaymentID,
+		PostedAt:          refundedAt,
+	}, postings)
+}
+
+// postCreatorPayoutLedger records money paid out to a creator.
+func postCreatorPayoutLedger(tx *gorm.DB, p *CreatorPayout, paidAt time.Time) error {
+	return postLedgerEntry(tx, LedgerEntry{
+		IdempotencyKey:    fmt.Sprintf("creator_payout:%d:paid", p.ID),
+		Kind:              "payout",
+		Description:       fmt.Sprintf("Payout to user %d", p.UserID),
+		SourceType:        "creator_payout",
+		SourceID:          strconv.FormatUint(uint64(p.ID), 10),
+		Provider:          p.Provider,
+		ProviderPaymentID: p.ProviderPayoutID,
+		PostedAt:          paidAt,
+	}, []ledgerPosting{
+		{creatorPayableAccount(p.UserID, p.Currency), p.AmountKopecks},
+		{clearingAccount(p.Provider, p.Currency), -p.AmountKopecks},
+	})
+}
+
+// postManualPaymentLedger records a verified card transfer.
+func postManualPaymentLedger(tx *gorm.DB, p *ManualPayment) error {
+	amount := rubToKopecks(p.Amount)
+	if amount <= 0 {
+		return nil
+	}
+	postedAt := time.Now()
+	if p.VerifiedAt != nil {
+		postedAt = *p.VerifiedAt
+	}
+	postings := []ledgerPosting{{clearingAccount("manual_transfer", "RUB"), amount}}
+	if p.UserID != nil {
+		wallet := walletAccount(uint(*p.UserID), "RUB")
+		postings = append(postings, ledgerPosting{wallet, -amount}, ledgerPosting{wallet, amount})
+	}
+	postings = append(postings, ledgerPosting{revenueAccount("RUB"), -amount})
+	return postLedgerEntry(tx, LedgerEntry{
+		IdempotencyKey: fmt.Sprintf("manual_payment:%d:payment", p.ID),
+		Kind:           "manual_payment",
+		Description:    "Manual transfer from " + p.PayerName,
+		SourceType:     "manual_payment",
+		SourceID:       strconv.Itoa(p.ID),
+		Provider:       "manual_transfer",
+		PostedAt:       postedAt,
+	}, postings)
+}
+
+// InitLedger posts entries for payments made before the ledger existed.
+// Idempotency keys make it safe to run on every start.
+func InitLedger() {
+	go func() {
+		posted, err := backfillLedger()
+		if err != nil {
+			log.Printf("[Ledger] Backfill failed: %v", err)
+			return
+		}
+		if posted > 0 {
+			log.Printf("[Ledger] Backfilled %d entries", posted)
+		}
+	}()
+}
+
+// backfillLedger returns the number of entries it inserted; records that are
+// already in the ledger are not counted.
+func backfillLedger() (int, error) {
+	posted := 0
+	db := db.WithContext(context.WithValue(context.Background(), ledgerInsertCount{}, &posted))
+	var transactions []PremiumTransaction
+	if err := db.Where("status IN ?", []string{"succeeded", "refunded"}).Find(&transactions).Error; err != nil {
+		return posted, err
+	}
+	for i := range transactions {
+		t := &transactions[i]
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := postPremiumPaymentLedger(tx, t); err != nil {
+				return err
+			}
+			if t.Status == "refunded" {
+				return postPremiumRefundLedger(tx, t, transactionPostedAt(t))
+			}
+			return nil
+		})
+		if err != nil {
+			return posted, err
+		}
+	}
+
+	var donations []CreatorDonation
+	if err := db.Where("status IN ?", []string{"succeeded", "refunding", "refunded"}).Find(&donations).Error; err != nil {
+		return posted, err
+	}
+	for i := range donations {
+		d := &donations[i]
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := postDonationLedger(tx, d, d.CreatedAt); err != nil {
+				return err
+			}
+			if d.Status == "refunded" && d.RefundedAt != nil {
+				return postDonationRefundLedger(tx, d, *d.RefundedAt)
+			}
+			return nil
+		})
+		if err != nil {
+			return posted, err
+		}
+	}
+
+	var manual []ManualPayment
+	if err := db.Where("status = ?", "verified").Find(&manual).Error; err != nil {
+		return posted, err
+	}
+	for i := range manual {
+		if err := postManualPaymentLedger(db, &manual[i]); err != nil {
+			return posted, err
+		}
+	}
+	return posted, nil
+}
+
+type ledgerBalance struct {
+	LedgerAccount
+	BalanceKopecks int64   `json:"balance_kopecks"`
+	BalanceRub     float64 `json:"balance_rub"`
+}
+
+// ledgerBalances returns accounts matching query with their natural
+// balances.
+func ledgerBalances(query *gorm.DB) ([]ledgerBalance, error) {
+	var accounts []LedgerAccount
+	if err := query.Order("code").Find(&accounts).Error; err != nil {
+		return nil, err
+	}
+	if len(accounts) == 0 {
+		return []ledgerBalance{}, nil
+	}
+	ids := make([]uint, len(accounts))
+	for i, a := range accounts {
+		ids[i] = a.ID
+	}
+	var sums []struct {
+		AccountID uint
+		Total     int64
+	}
+	if err := db.Model(&LedgerLine{}).Select("account_id, COALESCE(SUM(amount_kopecks), 0) AS total").
+		Where("account_id IN ?", ids).Group("account_id").Scan(&sums).Error; err != nil {
+		return nil, err
+	}
+	totals := make(map[uint]int64, len(sums))
+	for _, s := range sums {
+		totals[s.AccountID] = s.Total
+	}
+
+	out := make([]ledgerBalance, len(accounts))
+	for i, a := range accounts {
+		balance := totals[a.ID] * ledgerNormalSign(a.Type)
+		out[i] = ledgerBalance{LedgerAccount: a, BalanceKopecks: balance, BalanceRub: float64(balance) / 100}
+	}
+	return out, nil
+}
+
+// ledgerNetRevenue is revenue minus refunds posted since from, in minor
+// units of each currency.
+func ledgerNetRevenue(from time.Time) map[string]int64 {
+	var rows []struct {
+		Currency string
+		Total    int64
+	}
+	db.Model(&LedgerLine{}).
+		Joins("JOIN ledger_accounts ON ledger_accounts.id = ledger_lines.account_id").
+		Joins("JOIN ledger_entries ON ledger_entries.id = ledger_lines.entry_id").
+		Where("ledger_accounts.type IN ? AND ledger_entries.posted_at >= ?",
+			[]string{ledgerPlatformRevenue, ledgerRefunds}, from).
+		Group("ledger_accounts.currency").
+		Select("ledger_accounts.currency AS currency, COALESCE(SUM(ledger_lines.amount_kopecks), 0) AS total").
+		Scan(&rows)
+	out := make(map[string]int64, len(rows))
+	for _, r := range rows {
+		out[r.Currency] = -r.Total
+	}
+	return out
+}
+
+// getMyLedgerHandler shows the caller's wallet and creator balances with
+// recent movements.
+func getMyLedgerHandler(c *gin.Context) {
+	uid, ok := getUserIDFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	balances, err := ledgerBalances(db.Where("owner_id = ? AND type IN ?", uid, []string{ledgerUserWallet, ledgerCreatorPayable}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load balances"})
+		return
+	}
+
+	var lines []LedgerLine
+	db.Preload("Account").
+		Where("account_id IN (?)", db.Model(&LedgerAccount{}).Select("id").Where("owner_id = ?", uid)).
+		Order("id DESC").Limit(50).Find(&lines)
+	entryIDs := make([]uint, len(lines))
+	for i, l := range lines {
+		entryIDs[i] = l.EntryID
+	}
+	entries := map[uint]LedgerEntry{}
+	if len(entryIDs) > 0 {
+		var list []LedgerEntry
+		db.Where("id IN ?", entryIDs).Find(&list)
+		for _, e := range list {
+			entries[e.ID] = e
+		}
+	}
+	history := make([]gin.H, len(lines))
+	for i, l := range lines {
+		e := entries[l.EntryID]
+		history[i] = gin.H{
+			"entry_id":       l.EntryID,
+			"account":        l.Account.Code,
+			"amount_kopecks": l.AmountKopecks,
+			"kind":           e.Kind,
+			"description":    e.Description,
+			"posted_at":      e.PostedAt,
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"accounts": balances, "history": history})
+}
+
+func getLedgerAccountsHandler(c *gin.Context) {
+	query := db.Model(&LedgerAccount{})
+	if t := c.Query("type"); t != "" {
+		query = query.Where("type = ?", t)
+	}
+	if owner := c.Query("owner_id"); owner != "" {
+		query = query.Where("owner_id = ?", owner)
+	}
+	balances, err := ledgerBalances(query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load balances"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"accounts": balances})
+}
+
+func getLedgerEntriesHandler(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	query := db.Preload("Lines.Account").Order("id DESC").Limit(limit)
+	if code := c.Query("account"); code != "" {
+		query = query.Where("id IN (?)", db.Model(&LedgerLine{}).Select("entry_id").
+			Where("account_id IN (?)", db.Model(&LedgerAccount{}).Select("id").Where("code = ?", code)))
+	}
+	if sourceType := c.Query("source_type"); sourceType != "" {
+		query = query.Where("source_type = ? AND source_id = ?", sourceType, c.Query("source_id"))
+	}
+	var entries []LedgerEntry
+	query.Find(&entries)
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
+
+// reconciliationIssue is one disagreement between the ledger and the
+// records (or the provider) it was posted from.
+type reconciliationIssue struct {
+	Kind        string `json:"kind"` // missing_in_ledger, amount_mismatch, ledger_without_record, provider_mismatch
+	Key         string `json:"key"`
+	SourceType  string `json:"source_type"`
+	SourceID    string `json:"source_id"`
+	Expected    int64  `json:"expected_kopecks"`
+	Ledger      int64  `json:"ledger_kopecks"`
+	ProviderRef string `json:"provider_payment_id,omitempty"`
+	Detail      string `json:"detail,omitempty"`
+}
+
+// reconcileLedger compares expected entries with posted ones. expected maps
+// idempotency keys to amounts; posted are the entries in the same window.
+func reconcileLedger(expected map[string]reconciliationIssue, posted []LedgerEntry) []reconciliationIssue {
+	issues := []reconciliationIssue{}
+	seen := make(map[string]bool, len(posted))
+	for _, e := range posted {
+		seen[e.IdempotencyKey] = true
+		want, ok := expected[e.IdempotencyKey]
+		if !ok {
+			issues = append(issues, reconciliationIssue{
+				Kind: "ledger_without_record", Key: e.IdempotencyKey, SourceType: e.SourceType,
+				SourceID: e.SourceID, Ledger: e.AmountKopecks, ProviderRef: e.ProviderPaymentID,
+			})
+			continue
+		}
+		if want.Expected != e.AmountKopecks {
+			want.Kind = "amount_mismatch"
+			want.Ledger = e.AmountKopecks
+			issues = append(issues, want)
+		}
+	}
+	for key, want := range expected {
+		if !seen[key] {
+			want.Kind = "missing_in_ledger"
+			issues = append(issues, want)
+		}
+	}
+	return issues
+}
+
+const reconciliationProviderLimit = 100
+
+// getLedgerReconciliationHandler checks the ledger against payment records
+// created in [from, to). With provider=1 YooKassa payments are also fetched
+// from the API, up to reconciliationProviderLimit of them.
+func getLedgerReconciliationHandler(c *gin.Context) {
+	to := time.Now()
+	from := to.AddDate(0, 0, -30)
+	if v, err := time.Parse("2006-01-02", c.Query("from")); err == nil {
+		from = v
+	}
+	if v, err := time.Parse("2006-01-02", c.Query("to")); err == nil {
+		to = v.AddDate(0, 0, 1)
+	}
+
+	expected := map[string]reconciliationIssue{}
+	var transactions []PremiumTransaction
+	db.Where("status IN ? AND created_at >= ? AND created_at < ?", []string{"succeeded", "refunded"}, from, to).Find(&transactions)
+	for _, t := range transactions {
+		id := strconv.FormatUint(uint64(t.ID), 10)
+		amount := rubToKopecks(t.AmountRub)
+		issue := reconciliationIssue{SourceType: "premium_transaction", SourceID: id, Expected: amount, ProviderRef: t.ProviderPaymentID}
+		issue.Key = premiumLedgerKey(t.ID, "payment")
+		expected[issue.Key] = issue
+		if t.Status == "refunded" {
+			issue.Key = premiumLedgerKey(t.ID, "refund")
+			expected[issue.Key] = issue
+		}
+	}
+	var donations []CreatorDonation
+	db.Where("status IN ? AND created_at >= ? AND created_at < ?", []string{"succeeded", "refunding", "refunded"}, from, to).Find(&donations)
+	for _, d := range donations {
+		issue := reconciliationIssue{SourceType: "creator_donation", SourceID: strconv.FormatUint(uint64(d.ID), 10),
+			Expected: rubToKopecks(d.AmountRub), ProviderRef: d.PaymentID}
+		issue.Key = fmt.Sprintf("creator_donation:%d:payment", d.ID)
+		expected[issue.Key] = issue
+		if d.Status == "refunded" {
+			issue.Key = fmt.Sprintf("creator_donation:%d:refund", d.ID)
+			expected[issue.Key] = issue
+		}
+		if d.PlatformFeeKopecks > 0 {
+			issue.Key = fmt.Sprintf("creator_donation:%d:fee", d.ID)
+			issue.Expected, issue.ProviderRef = d.PlatformFeeKopecks, ""
+			expected[issue.Key] = issue
+		}
+	}
+	var payouts []CreatorPayout
+	db.Where("status = ? AND created_at >= ? AND created_at < ?", "paid", from, to).Find(&payouts)
+	for _, p := range payouts {
+		key := fmt.Sprintf("creator_payout:%d:paid", p.ID)
+		expected[key] = reconciliationIssue{Key: key, SourceType: "creator_payout", SourceID: strconv.FormatUint(uint64(p.ID), 10),
+			Expected: p.AmountKopecks, ProviderRef: p.ProviderPayoutID}
+	}
+	var manual []ManualPayment
+	db.Where("status = ? AND created_at >= ? AND created_at < ?", "verified", from, to).Find(&manual)
+	for _, p := range manual {
+		key := fmt.Sprintf("manual_payment:%d:payment", p.ID)
+		expected[key] = reconciliationIssue{Key: key, SourceType: "manual_payment", SourceID: strconv.Itoa(p.ID), Expected: rubToKopecks(p.Amount)}
+	}
+
+	// Entries are matched through their source records' window, so a late
+	// refund of an older payment is not reported as orphaned.
+	var posted []LedgerEntry
+	db.Where("(source_type = ? AND source_id IN (?)) OR (source_type = ? AND source_id IN (?)) OR (source_type = ? AND source_id IN (?)) OR (source_type = ? AND source_id IN (?))",
+		"premium_transaction", db.Model(&PremiumTransaction{}).Select("CAST(id AS TEXT)").Where("created_at >= ? AND created_at < ?", from, to),
+		"creator_donation", db.Model(&CreatorDonation{}).Select("CAST(id AS TEXT)").Where("created_at >= ? AND created_at < ?", from, to),
+		"manual_payment", db.Model(&ManualPayment{}).Select("CAST(id AS TEXT)").Where("created_at >= ? AND created_at < ?", from, to),
+		"creator_payout", db.Model(&CreatorPayout{}).Select("CAST(id AS TEXT)").Where("created_at >= ? AND created_at < ?", from, to),
+	).Find(&posted)
+
+	issues := reconcileLedger(expected, posted)
+
+	providerChecked := 0
+	if c.Query("provider") == "1" && len(paymentProviders) > 0 {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Minute)
+		defer cancel()
+		for _, t := range transactions {
+			provider := paymentProviders[t.PaymentProvider]
+			if provider == nil || t.ProviderPaymentID == "" {
+				continue
+			}
+			if providerChecked == reconciliationProviderLimit {
+				break
+			}
+			providerChecked++
+			issue := reconciliationIssue{Kind: "provider_mismatch", Key: premiumLedgerKey(t.ID, "payment"), SourceType: "premium_transaction",
+				SourceID: strconv.FormatUint(uint64(t.ID), 10), Expected: rubToKopecks(t.AmountRub), ProviderRef: t.ProviderPaymentID}
+			payment, err := provider.GetPayment(ctx, t.ProviderPaymentID)
+			if err != nil {
+				issue.Detail = err.Error()
+				issues = append(issues, issue)
+				continue
+			}
+			if err := checkPaymentAmount(payment, rubToKopecks(t.AmountRub), t.Currency); err != nil {
+				issue.Detail = err.Error()
+				issues = append(issues, issue)
+			} else if payment.Status != "succeeded" {
+				issue.Detail = "provider status is " + payment.Status
+				issues = append(issues, issue)
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"from":             from,
+		"to":               to,
+		"records":          len(expected),
+		"entries":          len(posted),
+		"provider_checked": providerChecked,
+		"issues":           issues,
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestValidateLedgerPostings(t *testing.T) {
+	tests := []struct {
+		name     string
+		postings []ledgerPosting
+		ok       bool
+	}{
+		{"balanced", []ledgerPosting{{clearingAccount("yookassa", "RUB"), 19900}, {revenueAccount(""), -19900}}, true},
+		{"compound", []ledgerPosting{
+			{clearingAccount("yookassa", "RUB"), 100}, {walletAccount(1, "RUB"), -100},
+			{walletAccount(1, "RUB"), 100}, {revenueAccount("RUB"), -100},
+		}, true},
+		{"unbalanced", []ledgerPosting{{clearingAccount("yookassa", "RUB"), 100}, {revenueAccount("RUB"), -99}}, false},
+		{"single line", []ledgerPosting{{clearingAccount("yookassa", "RUB"), 0}}, false},
+		{"zero line", []ledgerPosting{{clearingAccount("yookassa", "RUB"), 0}, {revenueAccount("RUB"), 0}}, false},
+		{"mixed currency", []ledgerPosting{{clearingAccount("yookassa", "USD"), 100}, {revenueAccount("RUB"), -100}}, false},
+	}
+	for _, tc := range tests {
+		if err := validateLedgerPostings(tc.postings); (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v", tc.name, err)
+		}
+	}
+}
+
+func TestLedgerAccountCodes(t *testing.T) {
+	for ref, want := range map[ledgerAccountRef]string{
+		walletAccount(42, ""):                  "user_wallet:42:RUB",
+		creatorPayableAccount(7, "rub"):        "creator_payable:7:RUB",
+		revenueAccount("RUB"):                  "platform_revenue:RUB",
+		clearingAccount("", "RUB"):             "provider_clearing:unknown:RUB",
+		clearingAccount("manual_transfer", ""): "provider_clearing:manual_transfer:RUB",
+	} {
+		if got := ref.code(); got != want {
+			t.Errorf("code() = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestReconcileLedger(t *testing.T) {
+	expected := map[string]reconciliationIssue{
+		"premium_tx:1:payment": {Key: "premium_tx:1:payment", Expected: 19900},
+		"premium_tx:2:payment": {Key: "premium_tx:2:payment", Expected: 50700},
+		"premium_tx:3:payment": {Key: "premium_tx:3:payment", Expected: 100},
+	}
+	posted := []LedgerEntry{
+		{IdempotencyKey: "premium_tx:1:payment", AmountKopecks: 19900},
+		{IdempotencyKey: "premium_tx:2:payment", AmountKopecks: 50000},
+		{IdempotencyKey: "premium_tx:9:payment", AmountKopecks: 300},
+	}
+	var got []string
+	for _, issue := range reconcileLedger(expected, posted) {
+		got = append(got, issue.Kind+" "+issue.Key)
+	}
+	sort.Strings(got)
+	want := []string{
+		"amount_mismatch premium_tx:2:payment",
+		"ledger_without_record premium_tx:9:payment",
+		"missing_in_ledger premium_tx:3:payment",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("issues = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("issues = %v, want %v", got, want)
+		}
+	}
+}
+
+// A second backfill finds everything posted and reports nothing new.
+func TestBackfillLedgerCountsInserts(t *testing.T) {
+	testDB(t, &LedgerAccount{}, &LedgerEntry{}, &LedgerLine{}, &PremiumTransaction{}, &CreatorDonation{}, &ManualPayment{})
+	completed := time.Now().Add(-time.Hour)
+	db.Create(&PremiumTransaction{UserID: 1, AmountRub: 199, Currency: "RUB", Status: "succeeded", PaymentProvider: "yookassa", CompletedAt: &completed})
+	db.Create(&PremiumTransaction{UserID: 2, AmountRub: 499, Currency: "RUB", Status: "refunded", PaymentProvider: "yookassa", CompletedAt: &completed})
+	db.Create(&PremiumTransaction{UserID: 3, AmountRub: 199, Currency: "RUB", Status: "pending", PaymentProvider: "yookassa"})
+
+	posted, err := backfillLedger()
+	if err != nil || posted != 3 {
+		t.Fatalf("first backfill = %d, %v; want a payment, a payment and its refund", posted, err)
+	}
+	posted, err = backfillLedger()
+	if err != nil || posted != 0 {
+		t.Errorf("second backfill = %d, %v; want nothing new", posted, err)
+	}
+	var entries int64
+	db.Model(&LedgerEntry{}).Count(&entries)
+	if entries != 3 {
+		t.Errorf("%d ledger entries, want 3", entries)
+	}
+}
+
+// Revenue is reported per currency, and each transaction carries its own.
+func TestAdminBillingStatsPerCurrency(t *testing.T) {
+	testDB(t, &User{}, &LedgerAccount{}, &LedgerEntry{}, &LedgerLine{}, &PremiumTransaction{}, &PremiumSubscription{},
+		&CreatorDonation{}, &ManualPayment{})
+	completed := time.Now()
+	db.Create(&PremiumTransaction{UserID: 1, AmountRub: 199, Currency: "RUB", Status: "succeeded", PaymentProvider: "yookassa", CompletedAt: &completed})
+	db.Create(&PremiumTransaction{UserID: 2, AmountRub: 499, Currency: "RUB", Status: "refunded", PaymentProvider: "yookassa", CompletedAt: &completed})
+	db.Create(&PremiumTransaction{UserID: 3, AmountRub: 4.99, Currency: "USD", Status: "succeeded", PaymentProvider: "stripe", CompletedAt: &completed})
+	if _, err := backfillLedger(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, w := testContext(http.MethodGet, "/api/admin/billing/stats", nil, 1)
+	getAdminBillingStatsHandler(c)
+	var resp struct {
+		MonthlyRevenue    float64 `json:"monthly_revenue"`
+		RevenueByCurrency []struct {
+			Currency       string  `json:"currency"`
+			MonthlyRevenue float64 `json:"monthly_revenue"`
+			TotalRevenue   float64 `json:"total_revenue"`
+		} `json:"revenue_by_currency"`
+		RecentTransactions []struct {
+			Amount   float64 `json:"amount"`
+			Currency string  `json:"currency"`
+		} `json:"recent_transactions"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.MonthlyRevenue != 199 {
+		t.Errorf("monthly_revenue = %v, want the rubles alone", resp.MonthlyRevenue)
+	}
+	revenue := map[string]float64{}
+	for _, r := range resp.RevenueByCurrency {
+		revenue[r.Currency] = r.TotalRevenue
+	}
+	if len(revenue) != 2 || revenue["RUB"] != 199 || revenue["USD"] != 4.99 {
+		t.Errorf("revenue by currency = %+v", resp.RevenueByCurrency)
+	}
+	currencies := map[string]int{}
+	for _, tx := range resp.RecentTransactions {
+		currencies[tx.Currency]++
+	}
+	if currencies["RUB"] != 2 || currencies["USD"] != 1 {
+		t.Errorf("transaction currencies = %v", currencies)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
         "context"
+        "errors"
         "log"
         "net/http"
         "os"
@@ -42,21 +43,45 @@ func main() {
         // Initialize Billing System
         InitBillingSystem()
         defer StopBillingSystem()
+        InitLedger()
+        InitOrgSubscriptionChanges()
+        InitDunning()
+        InitMetering()
+        InitCreatorPayouts()
+
+        // Initialize chat export jobs (TTL cleanup)
+        InitExportJobs()
+
+        // Initialize account deletion job (grace period expiry)
+        InitAccountDeletions()
+        InitScheduledMessages()
+        InitJarvisReminders()
+        InitJarvisQuota()
 
         // Initialize Jarvis MCP bridge
         log.Println("[*] Initializing Jarvis MCP bridge...")
         mcpCfg := MCPConfig{
                 BinaryPath:         "../jarvis/jarvis",
+                URL:                os.Getenv("JARVIS_MCP_URL"),
                 AllowedDirectories: []string{"./uploads", "./jsvoice", "./backend"},
                 BlockedCommands:    []string{"execute-command"},
                 Timeout:            30 * time.Second,
         }
-        if err := InitJarvisMCP(mcpCfg); err != nil {
+        if path := os.Getenv("JARVIS_MCP_COMMAND"); path != "" {
+                mcpCfg.BinaryPath = path
+        }
+        if token := os.Getenv("JARVIS_MCP_TOKEN"); token != "" {
+                mcpCfg.Headers = map[string]string{"Authorization": "Bearer " + token}
+        }
+        if err := InitJarvisMCP(mcpCfg); errors.Is(err, os.ErrNotExist) {
+                log.Printf("[!] ERROR: Jarvis MCP tools are DISABLED: %v", err)
+                log.Println("[!] ERROR: build the server with `make jarvis` (or run ./start.sh), or set JARVIS_MCP_URL")
+        } else if err != nil {
                 log.Printf("[!] Jarvis MCP failed to start (non-fatal): %v\n", err)
         }
         defer func() {
                 if jarvisMCP != nil {
-                        jarvisMCP.stopProcess()
+                        jarvisMCP.Close()
                 }
         }()
 
@@ -150,6 +175,7 @@ func main() {
         // LiveKit Voice Integration
         r.POST("/api/livekit/token", authMiddleware(), getLiveKitTokenHandler)
         r.POST("/api/livekit/leave/:channel_id", authMiddleware(), leaveLiveKitRoomHandler)
+        r.POST("/api/livekit/webhook", livekitWebhookHandler)
 
         // RTC/WebRTC Configuration
         r.GET("/api/rtc/ice-servers", authMiddleware(), getICEServersHandler)
@@ -184,11 +210,15 @@ func main() {
         r.GET("/api/messages/pinned/:user_id", authMiddleware(), getPinnedDirectMessagesHandler)
 
         // Jarvis AI routes
-        r.POST("/api/jarvis/chat/ollama", HandleJarvisChat) // Simplified mapping for now
-        r.POST("/api/jarvis/chat/deepseek", HandleJarvisChat)
-        r.POST("/api/jarvis/chat/auto", HandleJarvisChat)
-        r.POST("/api/jarvis/chat", HandleJarvisChat)
-        r.GET("/api/jarvis/status", HandleJarvisStatus)
+        r.POST("/api/jarvis/chat/ollama", authMiddleware(), jarvisChatHandler("ollama"))
+        r.POST("/api/jarvis/chat/deepseek", authMiddleware(), jarvisChatHandler("deepseek"))
+        r.POST("/api/jarvis/chat/auto", authMiddleware(), HandleJarvisChat)
+        r.POST("/api/jarvis/chat", authMiddleware(), HandleJarvisChat)
+        r.POST("/api/jarvis/chat/stream", authMiddleware(), HandleJarvisChatStream)
+        r.GET("/api/jarvis/status", optionalAuthMiddleware(), HandleJarvisStatus)
+        setupJarvisReminderRoutes(r, authMiddleware())
+        setupJarvisConversationRoutes(r, authMiddleware())
+        setupJarvisSummaryRoutes(r, authMiddleware())
 
         // Stories API
         r.GET("/api/stories", authMiddleware(), getStoriesHandler)
@@ -238,6 +268,7 @@ func main() {
         r.GET("/api/premium/plans", getPremiumPlansHandler)
         r.GET("/api/premium/subscription", authMiddleware(), getPremiumSubscriptionHandler)
         r.POST("/api/premium/checkout", authMiddleware(), checkoutPremiumHandler)
+        r.GET("/api/premium/payment-options", authMiddleware(), getPaymentOptionsHandler)
         r.POST("/api/premium/cancel", authMiddleware(), cancelPremiumHandler)
         r.GET("/api/premium/transactions", authMiddleware(), getPremiumTransactionsHandler)
         r.GET("/api/users/:id/premium", getUserPremiumHandler)
@@ -249,6 +280,8 @@ func main() {
         r.GET("/api/admin/promo-codes", authMiddleware(), getPromoCodesHandler)
         r.POST("/api/admin/promo-codes", authMiddleware(), createPromoCodeHandler)
         r.DELETE("/api/admin/promo-codes/:id", authMiddleware(), deletePromoCodeHandler)
+        r.GET("/api/admin/promo-codes/report", authMiddleware(), getPromoCampaignReportHandler)
+        r.GET("/api/admin/promo-codes/:id/report", authMiddleware(), getPromoCodeReportHandler)
         
         // Trial Period
         r.POST("/api/premium/trial", authMiddleware(), startTrialHandler)
@@ -266,6 +299,7 @@ func main() {
         
         // Billing webhooks (no auth - external service)
         r.POST("/api/billing/yookassa/webhook", yookassaWebhookHandler)
+        r.POST("/api/billing/webhooks/:provider", paymentWebhookHandler)
 
         // Presence & Status
         r.GET("/api/users/:id/presence", authMiddleware(), getUserPresenceHandler)
@@ -350,7 +384,19 @@ func main() {
         // Admin Billing
         r.POST("/api/admin/billing/refund", authMiddleware(), adminMiddleware(), refundPremiumHandler)
         r.GET("/api/admin/billing/stats", authMiddleware(), adminMiddleware(), getAdminBillingStatsHandler)
+        r.GET("/api/admin/billing/webhook-events", authMiddleware(), adminMiddleware(), getYooKassaWebhookEventsHandler)
+        r.POST("/api/admin/billing/webhook-events/:id/replay", authMiddleware(), adminMiddleware(), replayYooKassaWebhookEventHandler)
         r.GET("/api/billing/transactions/:id/status", authMiddleware(), getPaymentStatusHandler)
+        r.GET("/api/billing/ledger", authMiddleware(), getMyLedgerHandler)
+        r.GET("/api/creator/balance", authMiddleware(), getCreatorBalanceHandler)
+        r.GET("/api/creator/payouts", authMiddleware(), getCreatorPayoutsHandler)
+        r.POST("/api/creator/payouts", authMiddleware(), createCreatorPayoutHandler)
+        r.DELETE("/api/creator/payouts/:id", authMiddleware(), cancelCreatorPayoutHandler)
+        r.GET("/api/billing/notification-preferences", authMiddleware(), getBillingNotificationPreferencesHandler)
+        r.PUT("/api/billing/notification-preferences", authMiddleware(), updateBillingNotificationPreferencesHandler)
+        r.GET("/api/billing/invoices", authMiddleware(), getMyInvoicesHandler)
+        r.GET("/api/billing/invoices/:id/pdf", authMiddleware(), getInvoicePDFHandler)
+        r.POST("/api/metering/events", meteringServiceAuth(), recordUsageEventsHandler)
 
         // Content Filtering (Admin)
         r.GET("/api/admin/forbidden-words", authMiddleware(), adminMiddleware(), getForbiddenWordsHandler)
@@ -376,9 +422,9 @@ func main() {
         r.Static("/uploads", "./uploads")
 
         // Channel Tools (Board/Notebook)
-        r.POST("/api/channels/:channel_id/tools", authMiddleware(), HandleCreateChannelTool)
+        r.POST("/api/channels/:channel_id/tools", authMiddleware(), premiumReadOnlyGuard(), HandleCreateChannelTool)
         r.GET("/api/channels/:channel_id/tools", authMiddleware(), HandleGetChannelTools)
-        r.PUT("/api/channels/tools/:tool_id", authMiddleware(), HandleUpdateChannelTool)
+        r.PUT("/api/channels/tools/:tool_id", authMiddleware(), premiumReadOnlyGuard(), HandleUpdateChannelTool)
         r.DELETE("/api/channels/tools/:tool_id", authMiddleware(), HandleDeleteChannelTool)
 
         // Real-time Collaborative Editing (WebSocket)
@@ -393,9 +439,22 @@ func main() {
         r.PUT("/api/guilds/:id/roles/:role_id", authMiddleware(), updateGuildRoleHandler)
         r.DELETE("/api/guilds/:id/roles/:role_id", authMiddleware(), deleteGuildRoleHandler)
 
+        // Guild Template Export/Import
+        setupGuildTemplateRoutes(r, authMiddleware())
+        setupJarvisMentionRoutes(r, authMiddleware())
+
         // Organization Billing & Templates
         setupOrgBillingRoutes(r, authMiddleware())
 
+        // Chat Export (streaming download and background jobs)
+        setupExportRoutes(r, authMiddleware())
+
+        // Personal Data Export & Account Deletion
+        setupPrivacyRoutes(r, authMiddleware())
+
+        // Scheduled & Recurring Messages
+        setupScheduledMessageRoutes(r, authMiddleware())
+
         // Admin Organization & Billing Management
         setupAdminOrgRoutes(r, authMiddleware(), adminMiddleware())
 
@@ -0,0 +1,800 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Model Context Protocol client (JSON-RPC 2.0). One mcpClient talks to one
+// server over a transport: a child process on stdio or the streamable HTTP
+// transport. Calls are multiplexed by request id, so any number of them can
+// be in flight; cancelling a call's context sends notifications/cancelled.
+// When the connection drops, pending calls fail with errMCPDisconnected and
+// the client reconnects in the background with exponential backoff.
+
+const (
+	mcpProtocolVersion   = "2025-03-26"
+	mcpClientName        = "nemaks-backend"
+	mcpClientVersion     = "1.0"
+	mcpMaxMessageSize    = 16 << 20
+	mcpReconnectMin      = time.Second
+	mcpReconnectMax      = 30 * time.Second
+	mcpInitializeTimeout = 15 * time.Second
+)
+
+var (
+	errMCPDisconnected = errors.New("mcp server disconnected")
+	errMCPClosed       = errors.New("mcp client closed")
+)
+
+// JSON-RPC framing
+
+type jsonrpcMessage struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  json.RawMessage  `json:"result,omitempty"`
+	Error   *jsonrpcError    `json:"error,omitempty"`
+}
+
+type jsonrpcError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *jsonrpcError) Error() string {
+	return fmt.Sprintf("mcp error %d: %s", e.Code, e.Message)
+}
+
+const jsonrpcMethodNotFound = -32601
+
+// MCP types
+
+type mcpTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"inputSchema,omitempty"`
+}
+
+type mcpContent struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	Data     string `json:"data,omitempty"`
+	MimeType string `json:"mimeType,omitempty"`
+}
+
+type mcpToolResult struct {
+	Content           []mcpContent    `json:"content"`
+	StructuredContent json.RawMessage `json:"structuredContent,omitempty"`
+	IsError           bool            `json:"isError,omitempty"`
+}
+
+// Text joins the text parts of the result.
+func (r *mcpToolResult) Text() string {
+	var parts []string
+	for _, c := range r.Content {
+		if c.Type == "text" {
+			parts = append(parts, c.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+type mcpServerInfo struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Transports
+
+// mcpTransport moves whole JSON-RPC messages. Incoming messages arrive on
+// Messages, which is closed when the connection is gone.
+type mcpTransport interface {
+	Start(ctx context.Context) error
+	Send(ctx context.Context, msg []byte) error
+	Messages() <-chan []byte
+	Close() error
+}
+
+// mcpStdioTransport runs the server as a child process and exchanges
+// newline-delimited messages over its stdin and stdout.
+type mcpStdioTransport struct {
+	command string
+	args    []string
+	env     []string
+
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	writeMu  sync.Mutex
+	messages chan []byte
+}
+
+func newMCPStdioTransport(command string, args, env []string) *mcpStdioTransport {
+	return &mcpStdioTransport{command: command, args: args, env: env}
+}
+
+func (t *mcpStdioTransport) Start(ctx context.Context) error {
+	t.cmd = exec.Command(t.command, t.args...)
+	t.cmd.Env = append(os.Environ(), t.env...)
+	t.cmd.Stderr = os.Stderr
+
+	stdin, err := t.cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to open stdin: %w", err)
+	}
+	stdout, err := t.cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to open stdout: %w", err)
+	}
+	if err := t.cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", t.command, err)
+	}
+	t.stdin = stdin
+	t.messages = make(chan []byte, 16)
+
+	go func() {
+		defer close(t.messages)
+		reader := bufio.NewReaderSize(stdout, 64<<10)
+		for {
+			line, err := readMCPLine(reader)
+			if len(line) > 0 {
+				t.messages <- line
+			}
+			if err != nil {
+				if err != io.EOF {
+					log.Printf("[MCP] %s: %v", t.command, err)
+				}
+				t.cmd.Wait()
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// readMCPLine reads one newline-terminated message, rejecting oversized ones.
+func readMCPLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		line = append(line, chunk...)
+		if len(line) > mcpMaxMessageSize {
+			return nil, errors.New("message too large")
+		}
+		if err != nil || !isPrefix {
+			return bytes.TrimSpace(line), err
+		}
+	}
+}
+
+func (t *mcpStdioTransport) Send(_ context.Context, msg []byte) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if t.stdin == nil {
+		return errMCPDisconnected
+	}
+	if _, err := t.stdin.Write(append(msg, '\n')); err != nil {
+		return fmt.Errorf("%w: %v", errMCPDisconnected, err)
+	}
+	return nil
+}
+
+func (t *mcpStdioTransport) Messages() <-chan []byte { return t.messages }
+
+func (t *mcpStdioTransport) Close() error {
+	t.writeMu.Lock()
+	if t.stdin != nil {
+		t.stdin.Close()
+	}
+	t.writeMu.Unlock()
+	if t.cmd != nil && t.cmd.Process != nil {
+		// Give the server a moment to exit on EOF before killing it
+		done := make(chan struct{})
+		go func() {
+			for range t.messages {
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.cmd.Process.Kill()
+			<-done
+		}
+	}
+	return nil
+}
+
+// mcpHTTPTransport implements the streamable HTTP transport: every message is
+// POSTed to one endpoint and the answer comes back as JSON or as an SSE
+// stream in the response body.
+type mcpHTTPTransport struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+
+	mu        sync.Mutex
+	sessionID string
+	messages  chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	// inflight counts response readers; shuttingDown, set under mu, stops
+	// new ones from being added once shutdown waits for them.
+	inflight     sync.WaitGroup
+	shuttingDown bool
+}
+
+func newMCPHTTPTransport(url string, headers map[string]string, client *http.Client) *mcpHTTPTransport {
+	if client == nil {
+		client = &http.Client{}
+	}
+	return &mcpHTTPTransport{url: url, headers: headers, client: client}
+}
+
+func (t *mcpHTTPTransport) Start(context.Context) error {
+	t.messages = make(chan []byte, 16)
+	t.closed = make(chan struct{})
+	return nil
+}
+
+func (t *mcpHTTPTransport) Send(ctx context.Context, msg []byte) error {
+	select {
+	case <-t.closed:
+		return errMCPDisconnected
+	default:
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	t.setHeaders(req)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			// The server is unreachable; let the client reconnect
+			t.shutdown()
+		}
+		return err
+	}
+	if sid := resp.Header.Get("Mcp-Session-Id"); sid != "" {
+		t.mu.Lock()
+		t.sessionID = sid
+		t.mu.Unlock()
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound && t.session() != "":
+		// The server dropped our session; reconnecting starts a new one
+		resp.Body.Close()
+		t.shutdown()
+		return errMCPDisconnected
+	case resp.StatusCode == http.StatusAccepted:
+		resp.Body.Close()
+		return nil
+	case resp.StatusCode >= 300:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return fmt.Errorf("mcp http %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	t.mu.Lock()
+	if t.shuttingDown {
+		t.mu.Unlock()
+		resp.Body.Close()
+		return errMCPDisconnected
+	}
+	t.inflight.Add(1)
+	t.mu.Unlock()
+	go func() {
+		defer t.inflight.Done()
+		defer resp.Body.Close()
+		if mediaType == "text/event-stream" {
+			t.readEventStream(resp.Body)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, mcpMaxMessageSize))
+		if err == nil {
+			t.deliver(body)
+		}
+	}()
+	return nil
+}
+
+func (t *mcpHTTPTransport) readEventStream(body io.Reader) {
+	reader := bufio.NewReaderSize(body, 64<<10)
+	var data []byte
+	for {
+		line, err := readMCPLine(reader)
+		switch {
+		case len(line) == 0:
+			if len(data) > 0 {
+				t.deliver(data)
+				data = nil
+			}
+		case bytes.HasPrefix(line, []byte("data:")):
+			if len(data) > 0 {
+				data = append(data, '\n')
+			}
+			data = append(data, bytes.TrimSpace(line[5:])...)
+		}
+		if err != nil {
+			if len(data) > 0 {
+				t.deliver(data)
+			}
+			return
+		}
+	}
+}
+
+// deliver passes one message (or a JSON array batch) to the client.
+func (t *mcpHTTPTransport) deliver(body []byte) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return
+	}
+	msgs := [][]byte{body}
+	if body[0] == '[' {
+		var batch []json.RawMessage
+		if json.Unmarshal(body, &batch) == nil {
+			msgs = msgs[:0]
+			for _, m := range batch {
+				msgs = append(msgs, m)
+			}
+		}
+	}
+	for _, m := range msgs {
+		select {
+		case t.messages <- m:
+		case <-t.closed:
+			return
+		}
+	}
+}
+
+func (t *mcpHTTPTransport) session() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sessionID
+}
+
+func (t *mcpHTTPTransport) setHeaders(req *http.Request) {
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	if sid := t.session(); sid != "" {
+		req.Header.Set("Mcp-Session-Id", sid)
+	}
+	req.Header.Set("Mcp-Protocol-Version", mcpProtocolVersion)
+}
+
+func (t *mcpHTTPTransport) Messages() <-chan []byte { return t.messages }
+
+// shutdown closes the message channel once all response readers are done.
+func (t *mcpHTTPTransport) shutdown() {
+	t.closeOnce.Do(func() {
+		t.mu.Lock()
+		t.shuttingDown = true
+		t.mu.Unlock()
+		close(t.closed)
+		go func() {
+			t.inflight.Wait()
+			close(t.messages)
+		}()
+	})
+}
+
+func (t *mcpHTTPTransport) Close() error {
+	if sid := t.session(); sid != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if req, err := http.NewRequestWithContext(ctx, http.MethodDelete, t.url, nil); err == nil {
+			t.setHeaders(req)
+			if resp, err := t.client.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}
+	t.shutdown()
+	return nil
+}
+
+// Client
+
+type mcpClient struct {
+	name         string
+	newTransport func() mcpTransport
+
+	mu         sync.Mutex
+	transport  mcpTransport
+	connected  bool
+	closed     bool
+	connecting chan struct{} // closed when the current connect attempt ends
+	pending    map[string]chan *jsonrpcMessage
+	tools      []mcpTool
+	server     mcpServerInfo
+	lastErr    error
+
+	nextID atomic.Int64
+}
+
+func newMCPClient(name string, newTransport func() mcpTransport) *mcpClient {
+	return &mcpClient{name: name, newTransport: newTransport, pending: map[string]chan *jsonrpcMessage{}}
+}
+
+// Start connects and runs the handshake. On failure the client keeps
+// retrying in the background.
+func (c *mcpClient) Start(ctx context.Context) error {
+	if err := c.connect(ctx); err != nil {
+		go c.reconnectLoop()
+		return err
+	}
+	return nil
+}
+
+// Connected reports whether the handshake with the server has completed.
+func (c *mcpClient) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+// Tools returns the tools advertised by the server.
+func (c *mcpClient) Tools() []mcpTool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]mcpTool(nil), c.tools...)
+}
+
+func (c *mcpClient) Server() mcpServerInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.server
+}
+
+func (c *mcpClient) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	transport := c.transport
+	c.mu.Unlock()
+
+	if transport != nil {
+		return transport.Close()
+	}
+	return nil
+}
+
+func (c *mcpClient) connect(ctx context.Context) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return errMCPClosed
+	}
+	if c.connected {
+		c.mu.Unlock()
+		return nil
+	}
+	if wait := c.connecting; wait != nil {
+		c.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.connected {
+			return nil
+		}
+		if c.lastErr != nil {
+			return c.lastErr
+		}
+		return errMCPDisconnected
+	}
+	done := make(chan struct{})
+	c.connecting = done
+	c.mu.Unlock()
+
+	err := c.handshake(ctx)
+
+	c.mu.Lock()
+	c.connecting = nil
+	c.lastErr = err
+	c.mu.Unlock()
+	close(done)
+	return err
+}
+
+func (c *mcpClient) handshake(ctx context.Context) error {
+	transport := c.newTransport()
+	if err := transport.Start(ctx); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.transport = transport
+	c.mu.Unlock()
+	go c.readLoop(transport)
+
+	ctx, cancel := context.WithTimeout(ctx, mcpInitializeTimeout)
+	defer cancel()
+
+	var initResult struct {
+		ProtocolVersion string        `json:"protocolVersion"`
+		ServerInfo      mcpServerInfo `json:"serverInfo"`
+	}
+	raw, err := c.request(ctx, transport, "initialize", map[string]interface{}{
+		"protocolVersion": mcpProtocolVersion,
+		"capabilities":    map[string]interface{}{},
+		"clientInfo":      map[string]string{"name": mcpClientName, "version": mcpClientVersion},
+	})
+	if err == nil {
+		err = json.Unmarshal(raw, &initResult)
+	}
+	if err == nil {
+		err = c.notify(ctx, transport, "notifications/initialized", nil)
+	}
+	var tools []mcpTool
+	if err == nil {
+		tools, err = c.listTools(ctx, transport)
+	}
+	if err != nil {
+		transport.Close()
+		return fmt.Errorf("mcp %s: initialize: %w", c.name, err)
+	}
+
+	c.mu.Lock()
+	c.server = initResult.ServerInfo
+	c.tools = tools
+	c.connected = true
+	c.mu.Unlock()
+	log.Printf("[MCP] Connected to %s (%s %s, protocol %s, %d tools)", c.name, initResult.ServerInfo.Name, initResult.ServerInfo.Version, initResult.ProtocolVersion, len(tools))
+	return nil
+}
+
+func (c *mcpClient) listTools(ctx context.Context, transport mcpTransport) ([]mcpTool, error) {
+	var tools []mcpTool
+	cursor := ""
+	for {
+		var params interface{}
+		if cursor != "" {
+			params = map[string]string{"cursor": cursor}
+		}
+		raw, err := c.request(ctx, transport, "tools/list", params)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Tools      []mcpTool `json:"tools"`
+			NextCursor string    `json:"nextCursor"`
+		}
+		if err := json.Unmarshal(raw, &page); err != nil {
+			return nil, err
+		}
+		tools = append(tools, page.Tools...)
+		if page.NextCursor == "" || page.NextCursor == cursor {
+			return tools, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// CallTool invokes a tool. A tool that ran but failed is reported through
+// IsError, not as an error.
+func (c *mcpClient) CallTool(ctx context.Context, name string, args map[string]interface{}) (*mcpToolResult, error) {
+	if args == nil {
+		args = map[string]interface{}{}
+	}
+	raw, err := c.Call(ctx, "tools/call", map[string]interface{}{"name": name, "arguments": args})
+	if err != nil {
+		return nil, err
+	}
+	var result mcpToolResult
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return nil, fmt.Errorf("mcp %s: invalid tools/call result: %w", c.name, err)
+	}
+	return &result, nil
+}
+
+// Call sends a request, connecting first if needed.
+func (c *mcpClient) Call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	if err := c.connect(ctx); err != nil {
+		return nil, err
+	}
+	// The connection can drop between connect and here; the reader then
+	// clears the transport.
+	c.mu.Lock()
+	transport := c.transport
+	c.mu.Unlock()
+	if transport == nil {
+		return nil, errMCPDisconnected
+	}
+	return c.request(ctx, transport, method, params)
+}
+
+func (c *mcpClient) request(ctx context.Context, transport mcpTransport, method string, params interface{}) (json.RawMessage, error) {
+	id := c.nextID.Add(1)
+	idRaw := json.RawMessage(fmt.Sprintf("%d", id))
+	msg, err := c.encode(&idRaw, method, params)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := make(chan *jsonrpcMessage, 1)
+	key := string(idRaw)
+	c.mu.Lock()
+	c.pending[key] = reply
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, key)
+		c.mu.Unlock()
+	}()
+
+	if err := transport.Send(ctx, msg); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-reply:
+		if !ok {
+			return nil, errMCPDisconnected
+		}
+		if resp.Error != nil {
+			return nil, resp.Error
+		}
+		return resp.Result, nil
+	case <-ctx.Done():
+		// Tell the server to stop working on it; best effort
+		cancelCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		c.notify(cancelCtx, transport, "notifications/cancelled", map[string]interface{}{
+			"requestId": id,
+			"reason":    ctx.Err().Error(),
+		})
+		cancel()
+		return nil, ctx.Err()
+	}
+}
+
+func (c *mcpClient) notify(ctx context.Context, transport mcpTransport, method string, params interface{}) error {
+	msg, err := c.encode(nil, method, params)
+	if err != nil {
+		return err
+	}
+	return transport.Send(ctx, msg)
+}
+
+func (c *mcpClient) encode(id *json.RawMessage, method string, params interface{}) ([]byte, error) {
+	msg := jsonrpcMessage{JSONRPC: "2.0", ID: id, Method: method}
+	if params != nil {
+		raw, err := json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+		msg.Params = raw
+	}
+	return json.Marshal(msg)
+}
+
+// readLoop dispatches incoming messages until the transport goes away.
+func (c *mcpClient) readLoop(transport mcpTransport) {
+	for data := range transport.Messages() {
+		var msg jsonrpcMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Printf("[MCP] %s: invalid message: %v", c.name, err)
+			continue
+		}
+
+		switch {
+		case msg.Method == "" && msg.ID != nil:
+			c.mu.Lock()
+			reply := c.pending[string(*msg.ID)]
+			c.mu.Unlock()
+			if reply != nil {
+				select {
+				case reply <- &msg:
+				default: // duplicate response
+				}
+			}
+		case msg.Method != "" && msg.ID != nil:
+			go c.answerServerRequest(transport, &msg)
+		case msg.Method == "notifications/tools/list_changed":
+			go c.refreshTools(transport)
+		}
+	}
+
+	c.mu.Lock()
+	current := c.transport == transport
+	wasConnected := current && c.connected
+	if current {
+		c.connected = false
+		c.transport = nil
+		for key, reply := range c.pending {
+			close(reply)
+			delete(c.pending, key)
+		}
+	}
+	closed := c.closed
+	c.mu.Unlock()
+
+	// A failed handshake is retried by whoever started it
+	if wasConnected && !closed {
+		log.Printf("[MCP] %s disconnected, reconnecting", c.name)
+		go c.reconnectLoop()
+	}
+}
+
+// answerServerRequest replies to requests the server sends us. Only ping is
+// supported; we declare no client capabilities.
+func (c *mcpClient) answerServerRequest(transport mcpTransport, req *jsonrpcMessage) {
+	resp := jsonrpcMessage{JSONRPC: "2.0", ID: req.ID}
+	if req.Method == "ping" {
+		resp.Result = json.RawMessage("{}")
+	} else {
+		resp.Error = &jsonrpcError{Code: jsonrpcMethodNotFound, Message: "method not found: " + req.Method}
+	}
+	data, _ := json.Marshal(resp)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	transport.Send(ctx, data)
+}
+
+func (c *mcpClient) refreshTools(transport mcpTransport) {
+	ctx, cancel := context.WithTimeout(context.Background(), mcpInitializeTimeout)
+	defer cancel()
+	tools, err := c.listTools(ctx, transport)
+	if err != nil {
+		log.Printf("[MCP] %s: failed to refresh tools: %v", c.name, err)
+		return
+	}
+	c.mu.Lock()
+	c.tools = tools
+	c.mu.Unlock()
+}
+
+func (c *mcpClient) reconnectLoop() {
+	delay := mcpReconnectMin
+	for {
+		time.Sleep(delay)
+		c.mu.Lock()
+		done := c.closed || c.connected
+		c.mu.Unlock()
+		if done {
+			return
+		}
+
+		err := c.connect(context.Background())
+		if err == nil || errors.Is(err, errMCPClosed) {
+			return
+		}
+		log.Printf("[MCP] %s: reconnect failed: %v", c.name, err)
+		delay = min(delay*2, mcpReconnectMax)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMCPHTTPServer emulates a streamable HTTP MCP server with an "echo" tool
+// and a "slow" tool that only finishes when it is cancelled. tools/list is
+// answered over SSE, everything else with plain JSON.
+type fakeMCPHTTPServer struct {
+	mu        sync.Mutex
+	cancelled map[string]chan struct{}
+	noSession int
+}
+
+func (f *fakeMCPHTTPServer) cancelChan(id string) chan struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch, ok := f.cancelled[id]
+	if !ok {
+		ch = make(chan struct{})
+		f.cancelled[id] = ch
+	}
+	return ch
+}
+
+func (f *fakeMCPHTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		return
+	}
+	var msg jsonrpcMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if msg.Method != "initialize" && r.Header.Get("Mcp-Session-Id") != "session-1" {
+		f.mu.Lock()
+		f.noSession++
+		f.mu.Unlock()
+	}
+
+	if msg.ID == nil {
+		if msg.Method == "notifications/cancelled" {
+			var params struct {
+				RequestID json.RawMessage `json:"requestId"`
+			}
+			json.Unmarshal(msg.Params, &params)
+			close(f.cancelChan(string(params.RequestID)))
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	var result interface{}
+	switch msg.Method {
+	case "initialize":
+		w.Header().Set("Mcp-Session-Id", "session-1")
+		result = map[string]interface{}{
+			"protocolVersion": mcpProtocolVersion,
+			"serverInfo":      map[string]string{"name": "fake", "version": "0.1"},
+		}
+	case "tools/list":
+		data, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": msg.ID, "result": map[string]interface{}{
+			"tools": []map[string]string{{"name": "echo"}, {"name": "slow"}},
+		}})
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "event: message\ndata: %s\n\n", data)
+		return
+	case "tools/call":
+		var params struct {
+			Name      string            `json:"name"`
+			Arguments map[string]string `json:"arguments"`
+		}
+		json.Unmarshal(msg.Params, &params)
+		if params.Name == "slow" {
+			select {
+			case <-f.cancelChan(string(*msg.ID)):
+			case <-time.After(5 * time.Second):
+			}
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		result = map[string]interface{}{"content": []map[string]string{{"type": "text", "text": params.Arguments["text"]}}}
+	default:
+		json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": msg.ID, "error": map[string]interface{}{"code": jsonrpcMethodNotFound, "message": "not found"}})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": msg.ID, "result": result})
+}
+
+func TestMCPClientHTTPConcurrentCallsAndCancel(t *testing.T) {
+	fake := &fakeMCPHTTPServer{cancelled: map[string]chan struct{}{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	client := newMCPClient("fake", func() mcpTransport { return newMCPHTTPTransport(srv.URL, nil, srv.Client()) })
+	defer client.Close()
+	if err := client.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if got := client.Server().Name; got != "fake" {
+		t.Fatalf("server name = %q", got)
+	}
+	if tools := client.Tools(); len(tools) != 2 {
+		t.Fatalf("tools = %v, want echo and slow", tools)
+	}
+
+	// A call that never finishes must not hold up the others
+	slowCtx, cancelSlow := context.WithCancel(context.Background())
+	slowErr := make(chan error, 1)
+	go func() {
+		_, err := client.CallTool(slowCtx, "slow", nil)
+		slowErr <- err
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			want := fmt.Sprintf("hello %d", i)
+			result, err := client.CallTool(ctx, "echo", map[string]interface{}{"text": want})
+			if err != nil {
+				errs <- err
+				return
+			}
+			if result.Text() != want {
+				errs <- fmt.Errorf("echo %d returned %q", i, result.Text())
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	cancelSlow()
+	select {
+	case err := <-slowErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("slow call error = %v, want context.Canceled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("cancelled call did not return")
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.cancelled) != 1 {
+		t.Fatalf("server saw %d cancellations, want 1", len(fake.cancelled))
+	}
+	if fake.noSession != 0 {
+		t.Fatalf("%d requests were sent without the session id", fake.noSession)
+	}
+}
+
+func TestMCPClientMethodError(t *testing.T) {
+	srv := httptest.NewServer(&fakeMCPHTTPServer{cancelled: map[string]chan struct{}{}})
+	defer srv.Close()
+
+	client := newMCPClient("fake", func() mcpTransport { return newMCPHTTPTransport(srv.URL, nil, srv.Client()) })
+	defer client.Close()
+	_, err := client.Call(context.Background(), "resources/list", nil)
+	var rpcErr *jsonrpcError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != jsonrpcMethodNotFound {
+		t.Fatalf("err = %v, want method not found", err)
+	}
+}
+
+// TestMCPStdioHelperProcess is the stdio server used by the restart test. It
+// is a no-op unless started by that test.
+func TestMCPStdioHelperProcess(t *testing.T) {
+	if os.Getenv("MCP_TEST_HELPER") != "1" {
+		return
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var msg jsonrpcMessage
+		if json.Unmarshal(scanner.Bytes(), &msg) != nil || msg.ID == nil {
+			continue
+		}
+		var result interface{}
+		switch msg.Method {
+		case "initialize":
+			result = map[string]interface{}{"protocolVersion": mcpProtocolVersion, "serverInfo": map[string]string{"name": "helper"}}
+		case "tools/list":
+			result = map[string]interface{}{"tools": []map[string]string{{"name": "pid"}, {"name": "crash"}}}
+		case "tools/call":
+			var params struct {
+				Name string `json:"name"`
+			}
+			json.Unmarshal(msg.Params, &params)
+			if params.Name == "crash" {
+				os.Exit(3)
+			}
+			result = map[string]interface{}{"content": []map[string]string{{"type": "text", "text": fmt.Sprint(os.Getpid())}}}
+		}
+		data, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": msg.ID, "result": result})
+		fmt.Println(string(data))
+	}
+	os.Exit(0)
+}
+
+func TestMCPClientStdioRestartsAfterCrash(t *testing.T) {
+	client := newMCPClient("helper", func() mcpTransport {
+		return newMCPStdioTransport(os.Args[0], []string{"-test.run=^TestMCPStdioHelperProcess$"}, []string{"MCP_TEST_HELPER=1"})
+	})
+	defer client.Close()
+	if err := client.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	first, err := client.CallTool(ctx, "pid", nil)
+	if err != nil {
+		t.Fatalf("pid: %v", err)
+	}
+
+	if _, err := client.CallTool(ctx, "crash", nil); !errors.Is(err, errMCPDisconnected) {
+		t.Fatalf("crash error = %v, want errMCPDisconnected", err)
+	}
+
+	for !client.Connected() {
+		select {
+		case <-ctx.Done():
+			t.Fatal("client did not reconnect")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	second, err := client.CallTool(ctx, "pid", nil)
+	if err != nil {
+		t.Fatalf("pid after restart: %v", err)
+	}
+	if first.Text() == second.Text() {
+		t.Fatalf("server was not restarted (pid %s)", first.Text())
+	}
+}
+
+// The reader can clear the transport right after connect has returned; Call
+// must report the disconnect instead of using a nil transport.
+func TestMCPClientCallAfterTransportDropped(t *testing.T) {
+	c := newMCPClient("test", func() mcpTransport { t.Fatal("unexpected reconnect"); return nil })
+	c.connected = true
+
+	if _, err := c.Call(context.Background(), "tools/list", nil); !errors.Is(err, errMCPDisconnected) {
+		t.Fatalf("err = %v, want errMCPDisconnected", err)
+	}
+}
+
+// Sends racing a shutdown either hand their reply to a reader that finishes
+// before Messages is closed or are refused; the channel always closes.
+func TestMCPHTTPTransportSendDuringShutdown(t *testing.T) {
+	srv := httptest.NewServer(&fakeMCPHTTPServer{cancelled: map[string]chan struct{}{}})
+	defer srv.Close()
+
+	for round := 0; round < 20; round++ {
+		transport := newMCPHTTPTransport(srv.URL, nil, srv.Client())
+		transport.Start(context.Background())
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				msg := fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":"ping"}`, id)
+				if err := transport.Send(context.Background(), []byte(msg)); err != nil && !errors.Is(err, errMCPDisconnected) {
+					t.Errorf("send: %v", err)
+				}
+			}(i)
+		}
+		go transport.shutdown()
+
+		done := make(chan struct{})
+		go func() {
+			for range transport.Messages() {
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Messages was not closed after shutdown")
+		}
+		wg.Wait()
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Message delivery shared by the HTTP handlers and background senders
+// (scheduled messages, bots). Creation and fan-out are split so that callers
+// can insert inside their own transaction and publish only after commit.
+
+var errEmptyMessage = errors.New("content or voice message required")
+
+// forbiddenContentError is returned when the content filter rejects a message.
+type forbiddenContentError struct {
+	MatchedWords []string
+}
+
+func (e *forbiddenContentError) Error() string {
+	return "message contains forbidden content"
+}
+
+func filterMessageContent(content string, userID uint, context string) error {
+	if content == "" {
+		return nil
+	}
+	if result := checkContentFilter(content, userID, context); result.IsForbidden {
+		return &forbiddenContentError{MatchedWords: result.MatchedWords}
+	}
+	return nil
+}
+
+// createChannelMessage runs the content filter and stores a channel message.
+// replyToID is optional.
+func createChannelMessage(tx *gorm.DB, authorID uint, channel Channel, content string, replyToID *uint) (*Message, error) {
+	if content == "" {
+		return nil, errEmptyMessage
+	}
+	if err := filterMessageContent(content, authorID, "channel_message"); err != nil {
+		return nil, err
+	}
+
+	msg := Message{
+		ChannelID: channel.ID,
+		AuthorID:  authorID,
+		Content:   content,
+		ReplyToID: replyToID,
+	}
+	if err := tx.Create(&msg).Error; err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// publishChannelMessage pushes a stored channel message to connected clients.
+// Private channels only reach their members and the guild owner.
+func publishChannelMessage(channel Channel, msg *Message) {
+	if msg.Author.ID == 0 {
+		db.First(&msg.Author, msg.AuthorID)
+	}
+
+	payload := map[string]interface{}{
+		"type":       "channel-message",
+		"channel_id": channel.ID,
+		"message": map[string]interface{}{
+			"id":         msg.ID,
+			"channel_id": msg.ChannelID,
+			"author_id":  msg.AuthorID,
+			"author":     msg.Author,
+			"content":    msg.Content,
+			"created_at": msg.CreatedAt.Format(time.RFC3339),
+		},
+	}
+
+	if msg.ReplyToID != nil {
+		payload["message"].(map[string]interface{})["reply_to_id"] = *msg.ReplyToID
+	}
+
+	if !channel.IsPrivate {
+		hub.broadcast <- payload
+		return
+	}
+
+	var recipients []uint
+	db.Model(&ChannelMember{}).Where("channel_id = ?", channel.ID).Pluck("user_id", &recipients)
+	var guild Guild
+	if db.First(&guild, channel.GuildID).Error == nil {
+		recipients = append(recipients, guild.OwnerID)
+	}
+	recipients = append(recipients, msg.AuthorID)
+
+	seen := make(map[uint]bool, len(recipients))
+	for _, uid := range recipients {
+		if seen[uid] {
+			continue
+		}
+		seen[uid] = true
+		hub.sendToUser(strconv.FormatUint(uint64(uid), 10), payload)
+	}
+}
+
+// createDirectMessage runs the content filter and stores a direct message.
+func createDirectMessage(tx *gorm.DB, message *DirectMessage) error {
+	if message.Content == "" && message.VoiceURL == nil {
+		return errEmptyMessage
+	}
+	if err := filterMessageContent(message.Content, message.SenderID, "direct_message"); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	message.CreatedAt = now
+	message.UpdatedAt = now
+	return tx.Create(message).Error
+}
+
+// publishDirectMessage notifies the receiver of a stored direct message over
+// WebSocket and through the regular notification channel.
+func publishDirectMessage(message *DirectMessage) {
+	var sender User
+	db.First(&sender, message.SenderID)
+
+	// Include both camelCase and snake_case for compatibility
+	senderIDStr := strconv.FormatUint(uint64(message.SenderID), 10)
+	receiverIDStr := strconv.FormatUint(uint64(message.ReceiverID), 10)
+	wsMessage := map[string]interface{}{
+		"type":         "direct_message",
+		"id":           message.ID,
+		"content":      message.Content,
+		"fromUserId":   senderIDStr,
+		"from_user_id": senderIDStr,
+		"toUserId":     receiverIDStr,
+		"to_user_id":   receiverIDStr,
+		"createdAt":    message.CreatedAt.Format(time.RFC3339),
+		"created_at":   message.CreatedAt.Format(time.RFC3339),
+		"username":     sender.Username,
+		"sender_id":    message.SenderID,
+	}
+	if sender.Avatar != nil && *sender.Avatar != "" {
+		wsMessage["avatar"] = *sender.Avatar
+	}
+	if message.VoiceURL != nil && *message.VoiceURL != "" {
+		wsMessage["voice_url"] = *message.VoiceURL
+		wsMessage["voice_duration"] = message.VoiceDuration
+	}
+	if message.ReplyToID != nil {
+		wsMessage["reply_to_id"] = *message.ReplyToID
+	}
+	hub.sendToUser(receiverIDStr, wsMessage)
+
+	go createNotificationHandler(message.ReceiverID, "new_message", "New message from user")
+}
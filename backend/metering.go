@@ -0,0 +1,505 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/livekit/protocol/auth"
+	livekit "github.com/livekit/protocol/livekit"
+	"github.com/livekit/protocol/webhook"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Usage metering. Every billable use is a UsageEvent with an idempotency
+// key, so sources can resend safely. Events are summed per org and
+// billing period; when an org invoice for the next period is built, the
+// previous period is priced against the plan's OveragePricing, billed as
+// overage lines and closed with one OrgUsagePeriod row per metric.
+
+const (
+	usageStorageGBDays = "storage_gb_day"
+	usageVoiceMinutes  = "voice_minutes"
+	usageJarvisTokens  = "jarvis_tokens"
+	usageJarvisCalls   = "jarvis_requests"
+	usageExportJobs    = "export_jobs"
+)
+
+// usageMetric describes a metered quantity and the OveragePricing
+// metric_type it is billed under.
+type usageMetric struct {
+	Name          string
+	Unit          string
+	PricingMetric string
+}
+
+var usageMetrics = []usageMetric{
+	{usageStorageGBDays, "GB·день", "storage_gb_month"},
+	{usageVoiceMinutes, "мин", "voice_minutes"},
+	{usageJarvisTokens, "токены", jarvisOverageTokenMetric},
+	{usageJarvisCalls, "запросы", jarvisOverageRequestMetric},
+	{usageExportJobs, "шт.", "export_job"},
+}
+
+func findUsageMetric(name string) (usageMetric, bool) {
+	for _, m := range usageMetrics {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return usageMetric{}, false
+}
+
+type UsageEvent struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	IdempotencyKey string    `gorm:"uniqueIndex;size:191" json:"idempotency_key"`
+	OrgID          *int      `gorm:"index:idx_usage_org_metric_time" json:"org_id,omitempty"`
+	UserID         *uint     `gorm:"index" json:"user_id,omitempty"`
+	Metric         string    `gorm:"size:40;index:idx_usage_org_metric_time" json:"metric"`
+	Quantity       float64   `json:"quantity"`
+	Source         string    `gorm:"size:40" json:"source"`
+	OccurredAt     time.Time `gorm:"index:idx_usage_org_metric_time" json:"occurred_at"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// OrgUsagePeriod is a closed billing period of one metric for an org.
+type OrgUsagePeriod struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	OrgID         int       `gorm:"uniqueIndex:idx_org_usage_period" json:"org_id"`
+	Metric        string    `gorm:"size:40;uniqueIndex:idx_org_usage_period" json:"metric"`
+	PeriodStart   time.Time `gorm:"uniqueIndex:idx_org_usage_period" json:"period_start"`
+	PeriodEnd     time.Time `json:"period_end"`
+	Used          float64   `json:"used"`
+	Included      float64   `json:"included"`
+	Billable      float64   `json:"billable"`
+	AmountKopecks int64     `json:"amount_kopecks"`
+	InvoiceID     *uint     `json:"invoice_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// recordUsage stores an event once per idempotency key. Events without an
+// org are attributed to the user's active org membership.
+func recordUsage(ev UsageEvent) error {
+	if _, ok := findUsageMetric(ev.Metric); !ok {
+		return fmt.Errorf("unknown metric %q", ev.Metric)
+	}
+	if ev.Quantity <= 0 || math.IsInf(ev.Quantity, 0) || math.IsNaN(ev.Quantity) {
+		return errors.New("quantity must be positive")
+	}
+	if ev.IdempotencyKey == "" {
+		return errors.New("idempotency key is required")
+	}
+	if ev.OccurredAt.IsZero() {
+		ev.OccurredAt = time.Now()
+	}
+	if ev.OrgID == nil && ev.UserID != nil {
+		var member OrgMember
+		if db.Where("user_id = ? AND state = 'active'", *ev.UserID).First(&member).Error == nil {
+			ev.OrgID = &member.OrgID
+		}
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&ev).Error
+}
+
+func newUsageKey(prefix string) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return prefix + ":" + hex.EncodeToString(b)
+}
+
+// orgUsageLine is one metric of an org over a period.
+type orgUsageLine struct {
+	Metric           string  `json:"metric"`
+	Unit             string  `json:"unit"`
+	Used             float64 `json:"used"`
+	Included         float64 `json:"included"`
+	Billable         float64 `json:"billable"`
+	PricingUnit      string  `json:"pricing_unit,omitempty"`
+	UnitPriceKopecks int64   `json:"unit_price_kopecks"`
+	BilledQuantity   float64 `json:"billed_quantity"`
+	AmountKopecks    int64   `json:"amount_kopecks"`
+	Description      string  `json:"-"`
+}
+
+// priceUsage bills billable units: whole packs when the pricing unit names
+// a pack size ("50 запросов"), otherwise the quantity to three decimals.
+func priceUsage(billable float64, pricing *OveragePricing) (quantity float64, amountKopecks int64) {
+	if pricing == nil || billable <= 0 {
+		return 0, 0
+	}
+	if pack := overagePackSize(pricing); pack > 1 {
+		quantity = math.Ceil(billable / float64(pack))
+	} else {
+		quantity = math.Round(billable*1000) / 1000
+	}
+	return quantity, int64(math.Round(quantity * float64(rubToKopecks(pricing.PriceRub))))
+}
+
+func usageOveragePricing(planID int, metric string) *OveragePricing {
+	var pricing OveragePricing
+	if err := db.Where("(plan_id = ? OR plan_id IS NULL) AND metric_type = ? AND is_active = true", planID, metric).
+		Order("plan_id IS NULL").First(&pricing).Error; err != nil {
+		return nil
+	}
+	return &pricing
+}
+
+// computeOrgUsage sums the org's usage in [from, to) and prices what goes
+// beyond the plan's included quantities. Storage is billed in GB-months
+// and Jarvis by the overage its daily quota already counted.
+func computeOrgUsage(orgID int, plan SubscriptionPlan, from, to time.Time, months int) []orgUsageLine {
+	type sum struct {
+		Metric string
+		Total  float64
+	}
+	var sums []sum
+	db.Model(&UsageEvent{}).Select("metric, COALESCE(SUM(quantity), 0) AS total").
+		Where("org_id = ? AND occurred_at >= ? AND occurred_at < ?", orgID, from, to).
+		Group("metric").Scan(&sums)
+	used := map[string]float64{}
+	for _, s := range sums {
+		used[s.Metric] = s.Total
+	}
+
+	var jarvis struct {
+		Requests        float64
+		OverageRequests float64
+		OverageTokens   float64
+	}
+	db.Model(&JarvisUsage{}).
+		Select("COALESCE(SUM(request_count), 0) AS requests, COALESCE(SUM(overage_requests), 0) AS overage_requests, COALESCE(SUM(overage_tokens), 0) AS overage_tokens").
+		Where("scope = ? AND subject_id = ? AND date >= ? AND date < ?", "org", orgID, from, to).Scan(&jarvis)
+	used[usageJarvisCalls] = jarvis.Requests
+
+	days := to.Sub(from).Hours() / 24
+	lines := make([]orgUsageLine, 0, len(usageMetrics))
+	for _, m := range usageMetrics {
+		line := orgUsageLine{Metric: m.Name, Unit: m.Unit, Used: used[m.Name]}
+		pricing := usageOveragePricing(plan.ID, m.PricingMetric)
+		if m.Name == usageStorageGBDays && !plan.OverageStorageEnabled {
+			pricing = nil
+		}
+		if pricing != nil {
+			line.Included = pricing.IncludedQuantity * float64(months)
+			line.PricingUnit = pricing.Unit
+			line.UnitPriceKopecks = rubToKopecks(pricing.PriceRub)
+			line.Description = pricing.Description
+		}
+		switch m.Name {
+		case usageStorageGBDays:
+			// GB-days over the period become average GB held for a month
+			if days > 0 && pricing != nil {
+				line.Billable = math.Max(line.Used/days*float64(months)-line.Included, 0)
+			}
+		case usageJarvisTokens:
+			line.Billable = jarvis.OverageTokens
+		case usageJarvisCalls:
+			line.Billable = jarvis.OverageRequests
+		default:
+			line.Billable = math.Max(line.Used-line.Included, 0)
+		}
+		line.BilledQuantity, line.AmountKopecks = priceUsage(line.Billable, pricing)
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// orgUsageOverageLines turns priced usage into invoice lines.
+func orgUsageOverageLines(usage []orgUsageLine, from, to time.Time) []InvoiceLine {
+	var lines []InvoiceLine
+	for _, u := range usage {
+		if u.AmountKopecks <= 0 {
+			continue
+		}
+		description := u.Description
+		if description == "" {
+			description = "Превышение: " + u.Metric
+		}
+		lines = append(lines, InvoiceLine{
+			Kind:             "overage",
+			Description:      fmt.Sprintf("%s за %s – %s", description, from.Format("02.01.2006"), to.Add(-time.Second).Format("02.01.2006")),
+			Quantity:         u.BilledQuantity,
+			Unit:             u.PricingUnit,
+			UnitPriceKopecks: u.UnitPriceKopecks,
+			AmountKopecks:    u.AmountKopecks,
+		})
+	}
+	return lines
+}
+
+// closeOrgUsage records the billed period; the unique index makes a second
+// close of the same period fail, which rolls back a duplicate invoice.
+func closeOrgUsage(tx *gorm.DB, orgID int, from, to time.Time, usage []orgUsageLine, invoiceID uint) error {
+	for _, u := range usage {
+		row := OrgUsagePeriod{
+			OrgID:         orgID,
+			Metric:        u.Metric,
+			PeriodStart:   from,
+			PeriodEnd:     to,
+			Used:          u.Used,
+			Included:      u.Included,
+			Billable:      u.Billable,
+			AmountKopecks: u.AmountKopecks,
+			InvoiceID:     &invoiceID,
+		}
+		if err := tx.Create(&row).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func orgUsageClosed(orgID int, from time.Time) bool {
+	var count int64
+	db.Model(&OrgUsagePeriod{}).Where("org_id = ? AND period_start = ?", orgID, from).Count(&count)
+	return count > 0
+}
+
+func InitMetering() {
+	if db == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(6 * time.Hour)
+		defer ticker.Stop()
+		meterStorageOverage()
+		for range ticker.C {
+			meterStorageOverage()
+		}
+	}()
+}
+
+// meterStorageOverage turns the daily storage snapshots into GB-day events.
+func meterStorageOverage() {
+	var days []StorageOverageDaily
+	db.Where("date >= ? AND bytes_over_retention > 0", time.Now().AddDate(0, 0, -7)).Find(&days)
+	for _, d := range days {
+		orgID := d.OrgID
+		err := recordUsage(UsageEvent{
+			IdempotencyKey: fmt.Sprintf("storage:%d:%s", d.OrgID, d.Date.Format("2006-01-02")),
+			OrgID:          &orgID,
+			Metric:         usageStorageGBDays,
+			Quantity:       float64(d.BytesOverRetention) / (1 << 30),
+			Source:         "storage_snapshot",
+			OccurredAt:     d.Date,
+		})
+		if err != nil {
+			log.Printf("[Metering] Failed to meter storage of org %d on %s: %v", d.OrgID, d.Date.Format("2006-01-02"), err)
+		}
+	}
+}
+
+// meteringServiceAuth admits internal services presenting
+// METERING_API_TOKEN as a bearer token.
+func meteringServiceAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := os.Getenv("METERING_API_TOKEN")
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Metering API is not configured"})
+			return
+		}
+		got := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid metering token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// recordUsageEventsHandler accepts a batch of events. Each event reports
+// whether it was stored or rejected; replays of a known key are accepted.
+func recordUsageEventsHandler(c *gin.Context) {
+	var req struct {
+		Events []struct {
+			IdempotencyKey string    `json:"idempotency_key" binding:"required"`
+			OrgID          *int      `json:"org_id"`
+			UserID         *uint     `json:"user_id"`
+			Metric         string    `json:"metric" binding:"required"`
+			Quantity       float64   `json:"quantity"`
+			Source         string    `json:"source"`
+			OccurredAt     time.Time `json:"occurred_at"`
+		} `json:"events" binding:"required,max=1000,dive"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	results := make([]gin.H, 0, len(req.Events))
+	accepted := 0
+	for _, e := range req.Events {
+		if e.OrgID == nil && e.UserID == nil {
+			results = append(results, gin.H{"idempotency_key": e.IdempotencyKey, "error": "org_id or user_id is required"})
+			continue
+		}
+		source := e.Source
+		if source == "" {
+			source = "api"
+		}
+		err := recordUsage(UsageEvent{
+			IdempotencyKey: e.IdempotencyKey,
+			OrgID:          e.OrgID,
+			UserID:         e.UserID,
+			Metric:         e.Metric,
+			Quantity:       e.Quantity,
+			Source:         source,
+			OccurredAt:     e.OccurredAt,
+		})
+		if err != nil {
+			results = append(results, gin.H{"idempotency_key": e.IdempotencyKey, "error": err.Error()})
+			continue
+		}
+		accepted++
+		results = append(results, gin.H{"idempotency_key": e.IdempotencyKey, "status": "accepted"})
+	}
+	c.JSON(http.StatusOK, gin.H{"accepted": accepted, "results": results})
+}
+
+// livekitWebhookHandler meters voice minutes from participant_left events,
+// signed with the LiveKit API key.
+func livekitWebhookHandler(c *gin.Context) {
+	apiKey, apiSecret := os.Getenv("LIVEKIT_API_KEY"), os.Getenv("LIVEKIT_API_SECRET")
+	if apiKey == "" || apiSecret == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "LiveKit is not configured"})
+		return
+	}
+	event, err := webhook.ReceiveWebhookEvent(c.Request, auth.NewSimpleKeyProvider(apiKey, apiSecret))
+	if err != nil {
+		log.Printf("[Metering] Rejected LiveKit webhook: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid webhook"})
+		return
+	}
+	if ev, ok := voiceUsageFromWebhook(event); ok {
+		if err := recordUsage(ev); err != nil {
+			log.Printf("[Metering] Failed to meter voice for %s: %v", ev.IdempotencyKey, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record usage"})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// voiceUsageFromWebhook converts a participant_left event into minutes
+// spent in the room, rounded up. Participant identities are user ids.
+func voiceUsageFromWebhook(event *livekit.WebhookEvent) (UsageEvent, bool) {
+	p := event.GetParticipant()
+	if event.GetEvent() != webhook.EventParticipantLeft || p == nil || p.GetJoinedAt() == 0 {
+		return UsageEvent{}, false
+	}
+	userID, err := strconv.ParseUint(p.GetIdentity(), 10, 32)
+	if err != nil {
+		return UsageEvent{}, false
+	}
+	left := time.Unix(event.GetCreatedAt(), 0)
+	seconds := event.GetCreatedAt() - p.GetJoinedAt()
+	if seconds <= 0 {
+		return UsageEvent{}, false
+	}
+	uid := uint(userID)
+	return UsageEvent{
+		IdempotencyKey: fmt.Sprintf("voice:%s:%s:%d", event.GetRoom().GetName(), p.GetSid(), p.GetJoinedAt()),
+		UserID:         &uid,
+		Metric:         usageVoiceMinutes,
+		Quantity:       math.Ceil(float64(seconds) / 60),
+		Source:         "livekit",
+		OccurredAt:     left,
+	}, true
+}
+
+// getOrgUsageHandler is the usage dashboard: totals and overage for a
+// period (the current billing period by default), a daily series per
+// metric, and per-user totals when the plan includes traffic reports.
+func getOrgUsageHandler(c *gin.Context) {
+	uid, _ := getUserIDFromContext(c)
+	orgID := parseInt(c.Param("id"))
+	if !canManageOrgBilling(uid, orgID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Org admin access required"})
+		return
+	}
+	var sub OrgSubscription
+	if err := db.Where("org_id = ? AND status IN ?", orgID, orgServingStatuses).First(&sub).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No active subscription"})
+		return
+	}
+	var plan SubscriptionPlan
+	db.First(&plan, sub.PlanID)
+
+	from, to := sub.StartsAt, sub.EndsAt
+	if v := c.Query("from"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be YYYY-MM-DD"})
+			return
+		}
+		from = t
+	}
+	if v := c.Query("to"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be YYYY-MM-DD"})
+			return
+		}
+		to = t.AddDate(0, 0, 1)
+	}
+	if !to.After(from) || to.Sub(from) > 400*24*time.Hour {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid period"})
+		return
+	}
+
+	months := orgInvoiceMonths(sub.BillingPeriod)
+	usage := computeOrgUsage(orgID, plan, from, to, months)
+	var overage int64
+	for _, u := range usage {
+		overage += u.AmountKopecks
+	}
+
+	type dayRow struct {
+		Day    time.Time `json:"day"`
+		Metric string    `json:"metric"`
+		Total  float64   `json:"total"`
+	}
+	var daily []dayRow
+	db.Model(&UsageEvent{}).Select("DATE(occurred_at) AS day, metric, SUM(quantity) AS total").
+		Where("org_id = ? AND occurred_at >= ? AND occurred_at < ?", orgID, from, to).
+		Group("DATE(occurred_at), metric").Order("day").Scan(&daily)
+
+	var closed []OrgUsagePeriod
+	db.Where("org_id = ?", orgID).Order("period_start DESC, metric").Limit(60).Find(&closed)
+
+	resp := gin.H{
+		"period_start":    from,
+		"period_end":      to,
+		"metrics":         usage,
+		"overage_kopecks": overage,
+		"daily":           daily,
+		"closed_periods":  closed,
+		"traffic_reports": plan.TrafficReportsEnabled,
+	}
+
+	if plan.TrafficReportsEnabled {
+		type userRow struct {
+			UserID uint    `json:"user_id"`
+			Metric string  `json:"metric"`
+			Total  float64 `json:"total"`
+		}
+		var byUser []userRow
+		db.Model(&UsageEvent{}).Select("user_id, metric, SUM(quantity) AS total").
+			Where("org_id = ? AND user_id IS NOT NULL AND occurred_at >= ? AND occurred_at < ?", orgID, from, to).
+			Group("user_id, metric").Order("total DESC").Limit(200).Scan(&byUser)
+		resp["by_user"] = byUser
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	livekit "github.com/livekit/protocol/livekit"
+	"github.com/livekit/protocol/webhook"
+)
+
+func TestPriceUsage(t *testing.T) {
+	packs := &OveragePricing{PriceRub: 99, Unit: "1000 токенов"}
+	if q, amount := priceUsage(1001, packs); q != 2 || amount != 19800 {
+		t.Errorf("packs: quantity %v, amount %d", q, amount)
+	}
+	perUnit := &OveragePricing{PriceRub: 50, Unit: "ГБ·мес."}
+	if q, amount := priceUsage(1.23456, perUnit); q != 1.235 || amount != 6175 {
+		t.Errorf("per unit: quantity %v, amount %d", q, amount)
+	}
+	if q, amount := priceUsage(0, perUnit); q != 0 || amount != 0 {
+		t.Errorf("nothing billable: quantity %v, amount %d", q, amount)
+	}
+	if q, amount := priceUsage(10, nil); q != 0 || amount != 0 {
+		t.Errorf("no pricing: quantity %v, amount %d", q, amount)
+	}
+}
+
+func TestVoiceUsageFromWebhook(t *testing.T) {
+	event := &livekit.WebhookEvent{
+		Event:       webhook.EventParticipantLeft,
+		Room:        &livekit.Room{Name: "channel_7"},
+		Participant: &livekit.ParticipantInfo{Sid: "PA_1", Identity: "42", JoinedAt: 1_000_000},
+		CreatedAt:   1_000_000 + 125,
+	}
+	ev, ok := voiceUsageFromWebhook(event)
+	if !ok {
+		t.Fatal("participant_left was not metered")
+	}
+	if ev.Quantity != 3 || ev.UserID == nil || *ev.UserID != 42 || ev.Metric != usageVoiceMinutes {
+		t.Fatalf("usage = %+v", ev)
+	}
+	if ev.IdempotencyKey != "voice:channel_7:PA_1:1000000" {
+		t.Errorf("key = %s", ev.IdempotencyKey)
+	}
+
+	event.Event = webhook.EventParticipantJoined
+	if _, ok := voiceUsageFromWebhook(event); ok {
+		t.Error("participant_joined was metered")
+	}
+	event.Event = webhook.EventParticipantLeft
+	event.Participant.Identity = "guest"
+	if _, ok := voiceUsageFromWebhook(event); ok {
+		t.Error("non-user identity was metered")
+	}
+}
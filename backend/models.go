@@ -85,6 +85,7 @@ type Message struct {
         ChannelID uint      `json:"channel_id" gorm:"not null"`
         AuthorID  uint      `json:"author_id" gorm:"not null"`
         Content   string    `json:"content" gorm:"type:text"`
+        ReplyToID *uint     `json:"reply_to_id,omitempty" gorm:"index"`
         Edited    bool      `json:"edited" gorm:"default:false"`
         CreatedAt time.Time `json:"created_at"`
         UpdatedAt time.Time `json:"updated_at"`
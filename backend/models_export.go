@@ -0,0 +1,30 @@
+package main
+
+import "time"
+
+// Export Models
+
+// ExportJob tracks a background chat export. The generated file lives outside
+// the public uploads directory and is removed once ExpiresAt has passed.
+type ExportJob struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	UserID      uint       `json:"user_id" gorm:"index;not null"`
+	Scope       string     `json:"scope" gorm:"size:20;not null"` // channel, dm
+	ChannelID   *uint      `json:"channel_id,omitempty" gorm:"index"`
+	PeerID      *uint      `json:"peer_id,omitempty"`
+	Format      string     `json:"format" gorm:"size:10;not null"` // json, jsonl, csv, html
+	Bundle      bool       `json:"bundle" gorm:"default:false"`
+	From        *time.Time `json:"from,omitempty"`
+	To          *time.Time `json:"to,omitempty"`
+	Status      string     `json:"status" gorm:"size:20;default:'queued';index"` // queued, running, completed, failed, expired
+	Total       int64      `json:"total"`
+	Processed   int64      `json:"processed"`
+	FileName    string     `json:"file_name"`
+	FilePath    string     `json:"-"`
+	FileSize    int64      `json:"file_size"`
+	Error       string     `json:"error,omitempty" gorm:"type:text"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty" gorm:"index"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
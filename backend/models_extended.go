@@ -165,20 +165,38 @@ type JarvisCommand struct {
         Description string `json:"description"`
 }
 
+// JarvisContext is a long-term memory fact about the user. Facts are added
+// to every conversation's system prompt; the user can list and delete them.
 type JarvisContext struct {
-        ID        uint      `gorm:"primaryKey" json:"id"`
-        UserID    uint      `gorm:"index" json:"user_id"`
-        Content   string    `gorm:"type:text" json:"content"`
-        CreatedAt time.Time `json:"created_at"`
+        ID             uint      `gorm:"primaryKey" json:"id"`
+        UserID         uint      `gorm:"index" json:"user_id"`
+        Content        string    `gorm:"type:text" json:"content"`
+        Source         string    `gorm:"size:20;default:'api'" json:"source"` // api, chat
+        ConversationID *uint     `json:"conversation_id,omitempty"`
+        CreatedAt      time.Time `json:"created_at"`
 }
 
+// JarvisReminder is delivered by the reminder dispatcher once RemindAt has
+// passed. NotifiedAt and EmailedAt track the delivery channels separately so a
+// retry only repeats the ones that did not go through; LockedUntil is the
+// dispatcher's lease on the row.
 type JarvisReminder struct {
-        ID                  uint      `gorm:"primaryKey" json:"id"`
-        UserID              uint      `gorm:"index" json:"user_id"`
-        Content             string    `json:"content"`
-        RemindAt            time.Time `json:"remind_at"`
-        IsSent              bool      `gorm:"default:false" json:"is_sent"`
-        CreatedAt           time.Time `json:"created_at"`
+        ID                  uint       `gorm:"primaryKey" json:"id"`
+        UserID              uint       `gorm:"index" json:"user_id"`
+        Content             string     `json:"content"`
+        RemindAt            time.Time  `gorm:"index" json:"remind_at"`
+        IsSent              bool       `gorm:"default:false;index" json:"is_sent"`
+        Source              string     `gorm:"size:20;default:'api'" json:"source"` // api, chat
+        SnoozeCount         int        `gorm:"default:0" json:"snooze_count"`
+        Attempts            int        `gorm:"default:0" json:"attempts"`
+        LastError           string     `gorm:"type:text" json:"last_error,omitempty"`
+        LockedUntil         *time.Time `json:"-"`
+        NotifiedAt          *time.Time `json:"notified_at,omitempty"`
+        EmailedAt           *time.Time `json:"emailed_at,omitempty"`
+        SentAt              *time.Time `json:"sent_at,omitempty"`
+        DismissedAt         *time.Time `gorm:"index" json:"dismissed_at,omitempty"`
+        CreatedAt           time.Time  `json:"created_at"`
+        UpdatedAt           time.Time  `json:"updated_at"`
 }
 
 type JarvisSession struct {
@@ -482,6 +500,7 @@ type UserSettings struct {
         ID                    uint   `gorm:"primaryKey" json:"id"`
         UserID                uint   `gorm:"uniqueIndex" json:"user_id"`
         Language              string `gorm:"size:10;default:'ru'" json:"language"`
+        Country               string `gorm:"size:2" json:"country"` // ISO 3166 code, picks the payment currency
         Theme                 string `gorm:"size:20;default:'dark'" json:"theme"`
         NotificationsEnabled  bool   `gorm:"default:true" json:"notifications_enabled"`
         SoundEnabled          bool   `gorm:"default:true" json:"sound_enabled"`
@@ -621,8 +640,13 @@ type CreatorDonation struct {
         ToUserID    uint      `gorm:"index" json:"to_user_id"`
         AmountRub   float64   `json:"amount_rub"`
         Message     string    `gorm:"type:text" json:"message"`
-        Status      string    `gorm:"default:'pending'" json:"status"`
+        Status      string    `gorm:"default:'pending'" json:"status"` // pending, succeeded, failed, refunding, refunded
         PaymentID   string    `json:"payment_id"`
+        PlatformFeeKopecks int64 `gorm:"default:0" json:"platform_fee_kopecks"`
+        PaidAt      *time.Time `json:"paid_at,omitempty"`
+        RefundedAt  *time.Time `json:"refunded_at,omitempty"`
+        RefundReason string   `json:"refund_reason,omitempty"`
+        RefundStartedAt *time.Time `json:"refund_started_at,omitempty"` // when it went to refunding
         CreatedAt   time.Time `json:"created_at"`
 }
 
@@ -633,7 +657,7 @@ type PremiumSubscription struct {
         User                 User       `gorm:"foreignKey:UserID" json:"user,omitempty"`
         PlanID               uint       `json:"plan_id"`
         Plan                 PremiumPlan `gorm:"foreignKey:PlanID" json:"plan,omitempty"`
-        Status               string     `gorm:"size:20;default:'active'" json:"status"` // active, cancelled, expired, past_due, trialing
+        Status               string     `gorm:"size:20;default:'active'" json:"status"` // active, cancelled, expired, past_due, grace, trialing
         CurrentPeriodStart   time.Time  `json:"current_period_start"`
         CurrentPeriodEnd     time.Time  `json:"current_period_end"`
         TrialEnd             *time.Time `json:"trial_end,omitempty"`
@@ -641,8 +665,14 @@ type PremiumSubscription struct {
         AutoRenew            bool       `gorm:"default:true" json:"auto_renew"`
         CancelAtPeriodEnd    bool       `gorm:"default:false" json:"cancel_at_period_end"`
         CancelledAt          *time.Time `json:"cancelled_at,omitempty"`
-        PaymentMethodID      string     `json:"payment_method_id,omitempty"` // YooKassa saved payment method
+        PaymentMethodID      string     `json:"payment_method_id,omitempty"` // saved payment method at PaymentProvider
+        PaymentProvider      string     `gorm:"size:30" json:"payment_provider,omitempty"` // empty for yookassa
+        Currency             string     `gorm:"size:3;default:'RUB'" json:"currency"`
         GiftCodeID           *uint      `json:"gift_code_id,omitempty"`
+        PastDueSince         *time.Time `json:"past_due_since,omitempty"`
+        DunningAttempts      int        `gorm:"default:0" json:"dunning_attempts"`
+        NextRetryAt          *time.Time `json:"next_retry_at,omitempty"`
+        GraceUntil           *time.Time `json:"grace_until,omitempty"`
         CreatedAt            time.Time  `json:"created_at"`
         UpdatedAt            time.Time  `json:"updated_at"`
 }
@@ -654,12 +684,12 @@ type PremiumTransaction struct {
         User            User       `gorm:"foreignKey:UserID" json:"-"`
         SubscriptionID  *uint      `gorm:"index" json:"subscription_id,omitempty"`
         PlanID          uint       `json:"plan_id"`
-        AmountRub       float64    `json:"amount_rub"`
+        AmountRub       float64    `json:"amount_rub"` // in Currency
         DiscountRub     float64    `json:"discount_rub"`
         PromoCodeID     *uint      `json:"promo_code_id,omitempty"`
         Currency        string     `gorm:"size:3;default:'RUB'" json:"currency"`
         Status          string     `gorm:"size:20;default:'pending'" json:"status"` // pending, succeeded, failed, refunded
-        PaymentProvider string     `gorm:"size:30" json:"payment_provider"` // yookassa, manual_transfer
+        PaymentProvider string     `gorm:"size:30" json:"payment_provider"` // yookassa, stripe, manual_transfer
         ProviderPaymentID string   `json:"provider_payment_id,omitempty"`
         Description     string     `json:"description"`
         ConfirmationURL string     `json:"confirmation_url,omitempty"`
@@ -672,7 +702,7 @@ type PromoCode struct {
         ID              uint       `gorm:"primaryKey" json:"id"`
         Code            string     `gorm:"uniqueIndex;size:50" json:"code"`
         Description     string     `json:"description"`
-        DiscountType    string     `gorm:"size:20" json:"discount_type"` // percent, fixed
+        DiscountType    string     `gorm:"size:20" json:"discount_type"` // percent, fixed, free_months
         DiscountValue   float64    `json:"discount_value"`
         MaxUses         int        `json:"max_uses"`
         UsedCount       int        `gorm:"default:0" json:"used_count"`
@@ -680,6 +710,12 @@ type PromoCode struct {
         ValidFrom       time.Time  `json:"valid_from"`
         ValidUntil      time.Time  `json:"valid_until"`
         ApplicablePlans string     `gorm:"type:text" json:"applicable_plans"` // JSON array of plan IDs, empty = all
+        OrgPlans        string     `gorm:"type:text" json:"org_plans"` // JSON array of org plan slugs, empty = all
+        Products        string     `gorm:"size:100" json:"products"` // comma-separated premium, org_plan, seats, boost, gift; empty = premium
+        Campaign        string     `gorm:"size:100;index" json:"campaign"`
+        FirstPurchaseOnly bool     `json:"first_purchase_only"`
+        MaxUsesPerUser  int        `json:"max_uses_per_user"` // per user, or per org for org plans; 0 = once
+        ExcludesReferral bool      `json:"excludes_referral"` // purchases with the code earn the referrer no bonus
         IsActive        bool       `gorm:"default:true" json:"is_active"`
         CreatedBy       uint       `json:"created_by"`
         CreatedAt       time.Time  `json:"created_at"`
@@ -691,7 +727,12 @@ type PromoCodeUsage struct {
         PromoCodeID uint      `gorm:"index" json:"promo_code_id"`
         UserID      uint      `gorm:"index" json:"user_id"`
         TransactionID uint    `json:"transaction_id"`
-        DiscountRub float64   `json:"discount_rub"`
+        Product     string    `gorm:"size:20" json:"product"`
+        OrgID       *int      `gorm:"index" json:"org_id,omitempty"`
+        InvoiceID   *uint     `gorm:"index" json:"invoice_id,omitempty"`
+        DiscountRub float64   `json:"discount_rub"` // in Currency
+        AmountRub   float64   `json:"amount_rub"` // charged after the discount, in Currency
+        Currency    string    `gorm:"size:3;default:'RUB'" json:"currency"`
         CreatedAt   time.Time `json:"created_at"`
 }
 
@@ -771,6 +812,12 @@ type ModerationVerdict struct {
         VerdictType     string         `gorm:"size:30" json:"verdict_type"` // ban, warn, dismiss, escalate
         Reason          string         `gorm:"type:text" json:"reason"`
         ConfidenceScore float64        `json:"confidence_score"` // 0-1 AI confidence
+        Category        string         `gorm:"size:30" json:"category"` // none, spam, harassment, hate_speech, violence, sexual, self_harm, illegal, other
+        Severity        string         `gorm:"size:20" json:"severity"` // none, low, medium, high, critical
+        QuotedSpansJSON string         `gorm:"type:text" json:"quoted_spans_json"` // JSON array of offending fragments
+        Classifier      string         `gorm:"size:20" json:"classifier"` // llm, rules
+        PromptVersion   string         `gorm:"size:50" json:"prompt_version"`
+        ModelVersion    string         `gorm:"size:150" json:"model_version"` // provider/model, empty for rules
         PenaltyDuration *int           `json:"penalty_duration,omitempty"` // hours, null for permanent
         AudioResponseID *uint          `json:"audio_response_id,omitempty"`
         IsAutomatic     bool           `gorm:"default:true" json:"is_automatic"`
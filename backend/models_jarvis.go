@@ -0,0 +1,76 @@
+package main
+
+import "time"
+
+// Jarvis Conversation Models
+
+// JarvisConversation is a server-side chat thread. Turns that no longer fit
+// into the model's context window are folded into Summary; SummarizedUpTo is
+// the last message id covered by it.
+type JarvisConversation struct {
+	ID             uint       `json:"id" gorm:"primaryKey"`
+	UserID         uint       `json:"user_id" gorm:"index;not null"`
+	Title          string     `json:"title" gorm:"size:200"`
+	Summary        string     `json:"summary,omitempty" gorm:"type:text"`
+	SummarizedUpTo uint       `json:"-" gorm:"default:0"`
+	MessageCount   int        `json:"message_count" gorm:"default:0"`
+	LastMessageAt  *time.Time `json:"last_message_at,omitempty" gorm:"index"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+type JarvisConversationMessage struct {
+	ID             uint      `json:"id" gorm:"primaryKey"`
+	ConversationID uint      `json:"conversation_id" gorm:"index;not null"`
+	Role           string    `json:"role" gorm:"size:20;not null"` // user, assistant
+	Content        string    `json:"content" gorm:"type:text"`
+	Provider       string    `json:"provider,omitempty" gorm:"size:50"`
+	Model          string    `json:"model,omitempty" gorm:"size:100"`
+	Tokens         int       `json:"tokens" gorm:"default:0"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// GuildJarvisSettings turns @jarvis mentions on for a guild. Guilds without a
+// row have mentions switched off.
+type GuildJarvisSettings struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	GuildID   uint      `json:"guild_id" gorm:"uniqueIndex;not null"`
+	Enabled   bool      `json:"enabled" gorm:"default:false"`
+	UpdatedBy uint      `json:"updated_by"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ChannelJarvisPrompt replaces Jarvis' default persona in one channel.
+type ChannelJarvisPrompt struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	ChannelID    uint      `json:"channel_id" gorm:"uniqueIndex;not null"`
+	GuildID      uint      `json:"guild_id" gorm:"index;not null"`
+	SystemPrompt string    `json:"system_prompt" gorm:"type:text"`
+	UpdatedBy    uint      `json:"updated_by"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// JarvisSummary caches a "catch me up" summary of a message range. Channel
+// summaries are shared by everyone who can read the channel; DM summaries by
+// the two participants (UserAID < UserBID). Fingerprint covers message ids and
+// edit times, so edits inside the range invalidate the entry.
+type JarvisSummary struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	UserID        uint      `json:"user_id" gorm:"index"`                                               // who requested it
+	Scope         string    `json:"scope" gorm:"size:10;not null;uniqueIndex:idx_jarvis_summary_range"` // channel, dm
+	ChannelID     uint      `json:"channel_id,omitempty" gorm:"uniqueIndex:idx_jarvis_summary_range"`
+	UserAID       uint      `json:"user_a_id,omitempty" gorm:"uniqueIndex:idx_jarvis_summary_range"`
+	UserBID       uint      `json:"user_b_id,omitempty" gorm:"uniqueIndex:idx_jarvis_summary_range"`
+	FromMessageID uint      `json:"from_message_id" gorm:"uniqueIndex:idx_jarvis_summary_range"`
+	ToMessageID   uint      `json:"to_message_id" gorm:"uniqueIndex:idx_jarvis_summary_range"`
+	Fingerprint   string    `json:"-" gorm:"size:64;uniqueIndex:idx_jarvis_summary_range"`
+	MessageCount  int       `json:"message_count"`
+	Truncated     bool      `json:"truncated"`
+	Summary       string    `json:"summary" gorm:"type:text"`
+	Provider      string    `json:"provider" gorm:"size:50"`
+	Model         string    `json:"model" gorm:"size:100"`
+	Tokens        int       `json:"tokens"`
+	CreatedAt     time.Time `json:"created_at"`
+}
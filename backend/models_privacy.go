@@ -0,0 +1,24 @@
+package main
+
+import "time"
+
+// Privacy Models
+
+// AccountDeletion is a self-service deletion request. The account stays usable
+// until ScheduledFor so the user can change their mind; after that the
+// personal data is erased and authored content is left under an anonymous name.
+type AccountDeletion struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	UserID        uint       `json:"user_id" gorm:"index;not null"`
+	Status        string     `json:"status" gorm:"size:20;default:'pending';index"` // pending, cancelled, completed
+	Reason        string     `json:"reason" gorm:"type:text"`
+	ScheduledFor  time.Time  `json:"scheduled_for" gorm:"index"`
+	Attempts      int        `json:"attempts" gorm:"default:0"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"` // backoff after a failed erasure
+	CancelledAt   *time.Time `json:"cancelled_at,omitempty"`
+	CompletedAt   *time.Time `json:"completed_at,omitempty"`
+	Error         string     `json:"error,omitempty" gorm:"type:text"`
+	IPAddress     string     `json:"-"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
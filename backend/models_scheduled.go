@@ -0,0 +1,40 @@
+package main
+
+import "time"
+
+// Scheduled Message Models
+
+// ScheduledMessage is a message queued for later delivery to a channel or a
+// DM. One-off schedules set RunAt; recurring ones set CronExpr, which is
+// evaluated in Timezone. NextRunAt is the next due occurrence and doubles as
+// the claim token for the scheduler.
+type ScheduledMessage struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	UserID      uint       `json:"user_id" gorm:"index;not null"`
+	ChannelID   *uint      `json:"channel_id,omitempty" gorm:"index"`
+	RecipientID *uint      `json:"recipient_id,omitempty" gorm:"index"`
+	Content     string     `json:"content" gorm:"type:text;not null"`
+	RunAt       *time.Time `json:"run_at,omitempty"`
+	CronExpr    string     `json:"cron_expr,omitempty" gorm:"size:100"`
+	Timezone    string     `json:"timezone" gorm:"size:64;default:'UTC'"`
+	NextRunAt   *time.Time `json:"next_run_at,omitempty" gorm:"index"`
+	Status      string     `json:"status" gorm:"size:20;default:'active';index"` // active, completed, cancelled, failed
+	RunCount    int        `json:"run_count" gorm:"default:0"`
+	LastRunAt   *time.Time `json:"last_run_at,omitempty"`
+	LastError   string     `json:"last_error,omitempty" gorm:"type:text"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// ScheduledMessageRun records one occurrence of a schedule. The unique
+// (schedule_id, run_at) pair guarantees an occurrence is delivered at most once.
+type ScheduledMessageRun struct {
+	ID              uint      `json:"id" gorm:"primaryKey"`
+	ScheduleID      uint      `json:"schedule_id" gorm:"uniqueIndex:idx_scheduled_message_run;not null"`
+	RunAt           time.Time `json:"run_at" gorm:"uniqueIndex:idx_scheduled_message_run;not null"`
+	Status          string    `json:"status" gorm:"size:20"` // sent, skipped, failed
+	MessageID       *uint     `json:"message_id,omitempty"`
+	DirectMessageID *uint     `json:"direct_message_id,omitempty"`
+	Error           string    `json:"error,omitempty" gorm:"type:text"`
+	CreatedAt       time.Time `json:"created_at"`
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Moderation classifier behind jarvisReviewCaseHandler. The LLM is asked for
+// a JSON verdict that is validated against moderationVerdictSchema; when no
+// provider is configured, the call fails or the answer does not validate,
+// the deterministic rule-based classifier decides instead. Verdicts below
+// the confidence threshold are escalated to a human.
+
+const (
+	moderationPromptVersion = "moderation-llm-v1"
+	moderationRulesVersion  = "moderation-rules-v1"
+	moderationLLMTimeout    = 30 * time.Second
+	moderationMaxContent    = 6000
+)
+
+// moderationMinConfidence is overridden by MODERATION_MIN_CONFIDENCE.
+var moderationMinConfidence = 0.7
+
+var (
+	moderationCategories = map[string]bool{
+		"none": true, "spam": true, "harassment": true, "hate_speech": true, "violence": true,
+		"sexual": true, "self_harm": true, "illegal": true, "other": true,
+	}
+	moderationSeverities = map[string]bool{
+		"none": true, "low": true, "medium": true, "high": true, "critical": true,
+	}
+	errModerationSchema = errors.New("moderation verdict does not match the schema")
+)
+
+// moderationVerdictSchema is sent to the model verbatim.
+const moderationVerdictSchema = `{
+  "category":   one of "none", "spam", "harassment", "hate_speech", "violence", "sexual", "self_harm", "illegal", "other",
+  "severity":   one of "none", "low", "medium", "high", "critical",
+  "confidence": number between 0 and 1,
+  "rationale":  short explanation in Russian,
+  "spans":      array of exact quotes from the content that violate the rules (empty when category is "none")
+}`
+
+const moderationSystemPrompt = `You are the content moderator of a Russian-language community platform. Classify the reported content against the community rules. The report reason given by the reporter is a hint, not evidence; judge the content itself. Answer with a single JSON object and nothing else, following this schema:
+` + moderationVerdictSchema
+
+// moderationClassification is the validated outcome of either classifier.
+type moderationClassification struct {
+	Category      string
+	Severity      string
+	Confidence    float64
+	Rationale     string
+	Spans         []string
+	Classifier    string // llm, rules
+	PromptVersion string
+	ModelVersion  string
+}
+
+// VerdictType maps the classification onto ban, warn, dismiss or escalate.
+func (m *moderationClassification) VerdictType() string {
+	if m.Confidence < moderationMinConfidence {
+		return "escalate"
+	}
+	if m.Category == "none" || m.Severity == "none" {
+		return "dismiss"
+	}
+	switch m.Severity {
+	case "critical", "high":
+		return "ban"
+	default:
+		return "warn"
+	}
+}
+
+func init() {
+	if v, err := strconv.ParseFloat(os.Getenv("MODERATION_MIN_CONFIDENCE"), 64); err == nil && v >= 0 && v <= 1 {
+		moderationMinConfidence = v
+	}
+}
+
+// classifyModerationCase runs the LLM classifier when it is enabled and
+// falls back to the rules otherwise.
+func classifyModerationCase(ctx context.Context, reason, content string) *moderationClassification {
+	if os.Getenv("MODERATION_LLM") != "off" {
+		result, err := classifyModerationWithLLM(ctx, buildLLMChain(nil, ""), reason, content)
+		if err == nil {
+			return result
+		}
+		if !errors.Is(err, errNoLLMProviders) {
+			log.Printf("[Moderation] LLM classifier failed, using rules: %v", err)
+		}
+	}
+	return classifyModerationWithRules(reason, content)
+}
+
+func classifyModerationWithLLM(ctx context.Context, chain llmChain, reason, content string) (*moderationClassification, error) {
+	if len(chain) == 0 {
+		return nil, errNoLLMProviders
+	}
+	if len([]rune(content)) > moderationMaxContent {
+		content = string([]rune(content)[:moderationMaxContent])
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, moderationLLMTimeout)
+	defer cancel()
+	resp, err := chain.Complete(ctx, LLMRequest{
+		Messages: []ChatMessage{
+			{Role: "system", Content: moderationSystemPrompt},
+			{Role: "user", Content: fmt.Sprintf("Report reason: %s\n\nContent:\n<<<\n%s\n>>>", reason, content)},
+		},
+		MaxTokens:   500,
+		Temperature: 0,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := parseModerationVerdict(resp.Content, content)
+	if err != nil {
+		return nil, err
+	}
+	result.Classifier = "llm"
+	result.PromptVersion = moderationPromptVersion
+	result.ModelVersion = resp.Provider + "/" + resp.Model
+	return result, nil
+}
+
+// parseModerationVerdict extracts the JSON object from the model's answer and
+// checks it against the schema. Every span must be quoted from content.
+func parseModerationVerdict(answer, content string) (*moderationClassification, error) {
+	start, end := strings.Index(answer, "{"), strings.LastIndex(answer, "}")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("%w: no JSON object", errModerationSchema)
+	}
+
+	var raw struct {
+		Category   *string   `json:"category"`
+		Severity   *string   `json:"severity"`
+		Confidence *float64  `json:"confidence"`
+		Rationale  *string   `json:"rationale"`
+		Spans      *[]string `json:"spans"`
+	}
+	dec := json.NewDecoder(strings.NewReader(answer[start : end+1]))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%w: %v", errModerationSchema, err)
+	}
+
+	switch {
+	case raw.Category == nil || !moderationCategories[*raw.Category]:
+		return nil, fmt.Errorf("%w: invalid category", errModerationSchema)
+	case raw.Severity == nil || !moderationSeverities[*raw.Severity]:
+		return nil, fmt.Errorf("%w: invalid severity", errModerationSchema)
+	case raw.Confidence == nil || *raw.Confidence < 0 || *raw.Confidence > 1:
+		return nil, fmt.Errorf("%w: confidence must be between 0 and 1", errModerationSchema)
+	case raw.Rationale == nil || strings.TrimSpace(*raw.Rationale) == "":
+		return nil, fmt.Errorf("%w: rationale is required", errModerationSchema)
+	case raw.Spans == nil:
+		return nil, fmt.Errorf("%w: spans is required", errModerationSchema)
+	}
+	if (*raw.Category == "none") != (*raw.Severity == "none") {
+		return nil, fmt.Errorf("%w: category and severity disagree", errModerationSchema)
+	}
+
+	lowerContent := strings.ToLower(content)
+	spans := make([]string, 0, len(*raw.Spans))
+	for _, span := range *raw.Spans {
+		span = strings.TrimSpace(span)
+		if span == "" {
+			continue
+		}
+		if !strings.Contains(lowerContent, strings.ToLower(span)) {
+			return nil, fmt.Errorf("%w: span %q is not quoted from the content", errModerationSchema, span)
+		}
+		spans = append(spans, span)
+	}
+
+	return &moderationClassification{
+		Category:   *raw.Category,
+		Severity:   *raw.Severity,
+		Confidence: *raw.Confidence,
+		Rationale:  strings.TrimSpace(*raw.Rationale),
+		Spans:      spans,
+	}, nil
+}
+
+// Rules
+
+var moderationReasonCategories = map[string]string{
+	"spam":        "spam",
+	"harassment":  "harassment",
+	"hate_speech": "hate_speech",
+	"violence":    "violence",
+	"illegal":     "illegal",
+}
+
+// classifyModerationWithRules scores the content against the forbidden word
+// list. The report reason alone is never enough evidence, so reports without
+// a match end up below the confidence threshold.
+func classifyModerationWithRules(reason, content string) *moderationClassification {
+	var forbiddenWords []ForbiddenWord
+	db.Find(&forbiddenWords)
+	return classifyModerationWords(reason, content, forbiddenWords)
+}
+
+func classifyModerationWords(reason, content string, forbiddenWords []ForbiddenWord) *moderationClassification {
+	result := &moderationClassification{
+		Category:      "none",
+		Severity:      "none",
+		Classifier:    "rules",
+		PromptVersion: moderationRulesVersion,
+		Spans:         []string{},
+	}
+
+	score := 0.0
+	for _, fw := range forbiddenWords {
+		span, ok := matchModerationWord(content, fw)
+		if !ok {
+			continue
+		}
+		result.Spans = append(result.Spans, span)
+		category := fw.Category
+		switch category {
+		case "critical", "illegal":
+			score += 0.5
+			category = "illegal"
+		case "offensive", "harassment":
+			score += 0.3
+			category = "harassment"
+		case "spam":
+			score += 0.2
+		default:
+			score += 0.15
+			category = "other"
+		}
+		if result.Category == "none" || result.Category == "other" {
+			result.Category = category
+		}
+	}
+
+	if len(result.Spans) == 0 {
+		if category, ok := moderationReasonCategories[reason]; ok {
+			result.Rationale = "Запрещённых слов не найдено; жалоба (" + category + ") требует ручной проверки"
+			result.Confidence = 0.4
+			return result
+		}
+		result.Rationale = "Нарушений не обнаружено"
+		result.Confidence = 0.8
+		return result
+	}
+
+	if category, ok := moderationReasonCategories[reason]; ok && category == result.Category {
+		score += 0.2
+	}
+	switch {
+	case score >= 0.8:
+		result.Severity = "critical"
+	case score >= 0.5:
+		result.Severity = "high"
+	case score >= 0.3:
+		result.Severity = "medium"
+	default:
+		result.Severity = "low"
+	}
+	result.Confidence = min(0.6+0.1*float64(len(result.Spans)), 0.95)
+	result.Rationale = fmt.Sprintf("Найдены запрещённые выражения (%d)", len(result.Spans))
+	return result
+}
+
+// matchModerationWord reports the fragment of content that matches fw.
+func matchModerationWord(content string, fw ForbiddenWord) (string, bool) {
+	if content == "" || fw.Word == "" {
+		return "", false
+	}
+	if fw.IsRegex {
+		re, err := regexp.Compile("(?i)" + fw.Word)
+		if err != nil {
+			return "", false
+		}
+		if span := re.FindString(content); span != "" {
+			return span, true
+		}
+		return "", false
+	}
+
+	re := regexp.MustCompile(`(?i)(?:^|[^\p{L}\p{N}_])(` + regexp.QuoteMeta(fw.Word) + `)(?:$|[^\p{L}\p{N}_])`)
+	if m := re.FindStringSubmatch(content); m != nil {
+		return m[1], true
+	}
+	return "", false
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseModerationVerdict(t *testing.T) {
+	defer func(v float64) { moderationMinConfidence = v }(moderationMinConfidence)
+	moderationMinConfidence = 0.7
+
+	const content = "Лучшее КАЗИНО тут: http://win.ru"
+	for _, tc := range []struct {
+		name     string
+		answer   string
+		category string
+		spans    []string
+		verdict  string
+	}{
+		{"plain", `{"category":"spam","severity":"low","confidence":0.9,"rationale":"реклама","spans":["казино"]}`, "spam", []string{"казино"}, "warn"},
+		{"wrapped in prose and fences", "Вот ответ:\n```json\n{\"category\":\"spam\",\"severity\":\"high\",\"confidence\":0.95,\"rationale\":\" реклама \",\"spans\":[\"http://win.ru\"]}\n```", "spam", []string{"http://win.ru"}, "ban"},
+		{"clean", `{"category":"none","severity":"none","confidence":0.8,"rationale":"нарушений нет","spans":[]}`, "none", []string{}, "dismiss"},
+		{"blank spans dropped", `{"category":"spam","severity":"medium","confidence":0.75,"rationale":"реклама","spans":["  ","Казино"]}`, "spam", []string{"Казино"}, "warn"},
+		{"low confidence escalates", `{"category":"harassment","severity":"high","confidence":0.3,"rationale":"возможно","spans":[]}`, "harassment", []string{}, "escalate"},
+	} {
+		got, err := parseModerationVerdict(tc.answer, content)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got.Category != tc.category || !reflect.DeepEqual(got.Spans, tc.spans) || got.VerdictType() != tc.verdict {
+			t.Errorf("%s: got %s %q -> %s, want %s %q -> %s", tc.name, got.Category, got.Spans, got.VerdictType(), tc.category, tc.spans, tc.verdict)
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		answer string
+	}{
+		{"no json", "Это спам."},
+		{"empty", ""},
+		{"malformed", `{"category":"spam","severity":"low",}`},
+		{"truncated", `{"category":"spam","severity":"low","confidence":0.9`},
+		{"partial", `{"category":"spam","severity":"low"}`},
+		{"unknown category", `{"category":"scam","severity":"low","confidence":0.9,"rationale":"x","spans":[]}`},
+		{"unknown severity", `{"category":"spam","severity":"extreme","confidence":0.9,"rationale":"x","spans":[]}`},
+		{"unknown action field", `{"category":"spam","severity":"low","confidence":0.9,"rationale":"x","spans":[],"action":"ban"}`},
+		{"confidence above 1", `{"category":"spam","severity":"low","confidence":1.5,"rationale":"x","spans":[]}`},
+		{"negative confidence", `{"category":"spam","severity":"low","confidence":-0.1,"rationale":"x","spans":[]}`},
+		{"confidence as string", `{"category":"spam","severity":"low","confidence":"0.9","rationale":"x","spans":[]}`},
+		{"blank rationale", `{"category":"spam","severity":"low","confidence":0.9,"rationale":"  ","spans":[]}`},
+		{"missing spans", `{"category":"spam","severity":"low","confidence":0.9,"rationale":"x"}`},
+		{"span not in text", `{"category":"spam","severity":"low","confidence":0.9,"rationale":"x","spans":["покер"]}`},
+		{"none with severity", `{"category":"none","severity":"high","confidence":0.9,"rationale":"x","spans":[]}`},
+		{"violation without severity", `{"category":"spam","severity":"none","confidence":0.9,"rationale":"x","spans":[]}`},
+	} {
+		if got, err := parseModerationVerdict(tc.answer, content); !errors.Is(err, errModerationSchema) {
+			t.Errorf("%s: got %+v, %v; want a schema error", tc.name, got, err)
+		}
+	}
+}
+
+func TestClassifyModerationWords(t *testing.T) {
+	defer func(v float64) { moderationMinConfidence = v }(moderationMinConfidence)
+	moderationMinConfidence = 0.7
+
+	words := []ForbiddenWord{
+		{Word: "казино", Category: "spam"},
+		{Word: "убью", Category: "critical"},
+		{Word: "дурак", Category: "offensive"},
+		{Word: `https?://\S+\.ru`, Category: "spam", IsRegex: true},
+		{Word: "(", Category: "spam", IsRegex: true}, // invalid, ignored
+		{Word: "xyz", Category: "unlisted"},
+	}
+	for _, tc := range []struct {
+		name, reason, content string
+		category, severity    string
+		spans                 []string
+		verdict               string
+	}{
+		{"clean", "", "привет всем", "none", "none", []string{}, "dismiss"},
+		{"report without evidence", "spam", "привет всем", "none", "none", []string{}, "escalate"},
+		{"unknown reason without evidence", "bored", "привет всем", "none", "none", []string{}, "dismiss"},
+		{"whole words only", "", "казиноман", "none", "none", []string{}, "dismiss"},
+		{"single spam word", "other", "Лучшее КАЗИНО", "spam", "low", []string{"КАЗИНО"}, "warn"},
+		{"reason agrees", "spam", "Лучшее казино", "spam", "medium", []string{"казино"}, "warn"},
+		{"word and regex", "spam", "Заходи на http://win.ru в казино", "spam", "high", []string{"казино", "http://win.ru"}, "ban"},
+		{"threat first keeps category", "", "Я тебя убью, дурак", "illegal", "critical", []string{"убью", "дурак"}, "ban"},
+		{"unlisted category", "", "xyz", "other", "low", []string{"xyz"}, "warn"},
+	} {
+		got := classifyModerationWords(tc.reason, tc.content, words)
+		if got.Category != tc.category || got.Severity != tc.severity || !reflect.DeepEqual(got.Spans, tc.spans) || got.VerdictType() != tc.verdict {
+			t.Errorf("%s: got %s/%s %q -> %s (%.2f), want %s/%s %q -> %s", tc.name,
+				got.Category, got.Severity, got.Spans, got.VerdictType(), got.Confidence, tc.category, tc.severity, tc.spans, tc.verdict)
+		}
+		if got.Classifier != "rules" || got.PromptVersion != moderationRulesVersion || got.Rationale == "" {
+			t.Errorf("%s: missing metadata: %+v", tc.name, got)
+		}
+	}
+}
+
+func TestModerationVerdictType(t *testing.T) {
+	defer func(v float64) { moderationMinConfidence = v }(moderationMinConfidence)
+	moderationMinConfidence = 0.7
+
+	for _, tc := range []struct {
+		category, severity string
+		confidence         float64
+		want               string
+	}{
+		{"none", "none", 0.9, "dismiss"},
+		{"spam", "low", 0.9, "warn"},
+		{"harassment", "medium", 0.7, "warn"},
+		{"violence", "high", 0.9, "ban"},
+		{"illegal", "critical", 0.95, "ban"},
+		{"illegal", "critical", 0.69, "escalate"},
+		{"none", "none", 0.2, "escalate"},
+	} {
+		m := &moderationClassification{Category: tc.category, Severity: tc.severity, Confidence: tc.confidence}
+		if got := m.VerdictType(); got != tc.want {
+			t.Errorf("%s/%s at %.2f = %s, want %s", tc.category, tc.severity, tc.confidence, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// OrgSubscriptionChange records a plan or seat change of an org
+// subscription. Changes that raise the price apply at once and are
+// invoiced pro rata; the rest are scheduled for the end of the period.
+type OrgSubscriptionChange struct {
+	ID               uint       `gorm:"primaryKey" json:"id"`
+	OrgID            int        `gorm:"index" json:"org_id"`
+	SubscriptionID   int        `gorm:"index" json:"subscription_id"`
+	FromPlanID       int        `json:"from_plan_id"`
+	ToPlanID         int        `json:"to_plan_id"`
+	FromSeatsStudent int        `json:"from_seats_student_editor"`
+	ToSeatsStudent   int        `json:"to_seats_student_editor"`
+	FromSeatsStaff   int        `json:"from_seats_staff"`
+	ToSeatsStaff     int        `json:"to_seats_staff"`
+	Status           string     `gorm:"size:20;index" json:"status"` // applied, scheduled, cancelled
+	EffectiveAt      time.Time  `gorm:"index" json:"effective_at"`
+	CreditKopecks    int64      `json:"credit_kopecks"`
+	ChargeKopecks    int64      `json:"charge_kopecks"`
+	NetKopecks       int64      `json:"net_kopecks"`
+	InvoiceID        *uint      `json:"invoice_id,omitempty"`
+	RequestedBy      uint       `json:"requested_by"`
+	AppliedAt        *time.Time `json:"applied_at,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+// orgPriceState is what an org pays per month for a plan and seat counts.
+type orgPriceState struct {
+	PlanID             int    `json:"plan_id"`
+	PlanName           string `json:"plan_name"`
+	BaseKopecks        int64  `json:"base_kopecks"`
+	SeatsStudent       int    `json:"seats_student_editor"`
+	SeatsStaff         int    `json:"seats_staff"`
+	StudentSeatKopecks int64  `json:"student_seat_kopecks"`
+	StaffSeatKopecks   int64  `json:"staff_seat_kopecks"`
+	MinSeatsStudent    int    `json:"-"`
+	MinSeatsStaff      int    `json:"-"`
+}
+
+func (s orgPriceState) monthlyKopecks() int64 {
+	return s.BaseKopecks +
+		int64(max(s.SeatsStudent, s.MinSeatsStudent))*s.StudentSeatKopecks +
+		int64(max(s.SeatsStaff, s.MinSeatsStaff))*s.StaffSeatKopecks
+}
+
+// orgProration is the price of moving from one state to another at a
+// point inside the current billing period.
+type orgProration struct {
+	From              orgPriceState `json:"from"`
+	To                orgPriceState `json:"to"`
+	PeriodStart       time.Time     `json:"period_start"`
+	PeriodEnd         time.Time     `json:"period_end"`
+	EffectiveAt       time.Time     `json:"effective_at"`
+	Immediate         bool          `json:"immediate"`
+	RemainingFraction float64       `json:"remaining_fraction"`
+	PaidKopecks       int64         `json:"paid_kopecks"`   // charged for the current state
+	CreditKopecks     int64         `json:"credit_kopecks"` // unused part of what was paid
+	ChargeKopecks     int64         `json:"charge_kopecks"` // new price for the rest of the period
+	NetKopecks        int64         `json:"net_kopecks"`
+	NextPeriodKopecks int64         `json:"next_period_kopecks"`
+}
+
+// orgPaidPeriod is what was actually charged for the subscription's current
+// plan and seats, and the span that amount covers.
+type orgPaidPeriod struct {
+	Kopecks  int64
+	From, To time.Time
+}
+
+// prorateOrgChange credits the unused part of what was paid and charges the
+// new price from at until periodEnd, both rounded to the kopeck by remaining
+// seconds. A nil paid (nothing was invoiced) earns no credit. Changes that
+// would lower the list price (downgrades, seat removals) are not refunded:
+// they are scheduled for periodEnd instead.
+func prorateOrgChange(from, to orgPriceState, months int, periodStart, periodEnd, at time.Time, paid *orgPaidPeriod) orgProration {
+	p := orgProration{
+		From:              from,
+		To:                to,
+		PeriodStart:       periodStart,
+		PeriodEnd:         periodEnd,
+		NextPeriodKopecks: to.monthlyKopecks() * int64(months),
+	}
+	if p.NextPeriodKopecks < from.monthlyKopecks()*int64(months) {
+		p.EffectiveAt = periodEnd
+		return p
+	}
+
+	total := int64(periodEnd.Sub(periodStart) / time.Second)
+	remaining := min(max(int64(periodEnd.Sub(at)/time.Second), 0), total)
+	p.Immediate = true
+	p.EffectiveAt = at
+	if total > 0 {
+		p.RemainingFraction = float64(remaining) / float64(total)
+		p.ChargeKopecks = prorateKopecks(p.NextPeriodKopecks, remaining, total)
+	}
+	if paid != nil {
+		span := int64(paid.To.Sub(paid.From) / time.Second)
+		if span > 0 {
+			p.PaidKopecks = paid.Kopecks
+			p.CreditKopecks = prorateKopecks(paid.Kopecks, min(max(int64(paid.To.Sub(at)/time.Second), 0), span), span)
+		}
+	}
+	p.NetKopecks = p.ChargeKopecks - p.CreditKopecks
+	return p
+}
+
+// prorateKopecks is price × part / whole rounded half up.
+func prorateKopecks(price, part, whole int64) int64 {
+	return (price*part*2 + whole) / (2 * whole)
+}
+
+// loadOrgPaidPeriod finds what the org paid for sub's current plan and
+// seats: the charge of the last immediate change in this period, otherwise
+// the plan, seat and discount lines of the invoice covering at.
+func loadOrgPaidPeriod(sub *OrgSubscription, at time.Time) *orgPaidPeriod {
+	var change OrgSubscriptionChange
+	if db.Where("subscription_id = ? AND status = ? AND charge_kopecks > 0 AND effective_at >= ? AND effective_at <= ?",
+		sub.ID, "applied", sub.StartsAt, at).Order("effective_at DESC, id DESC").First(&change).Error == nil {
+		return &orgPaidPeriod{Kopecks: change.ChargeKopecks, From: change.EffectiveAt, To: sub.EndsAt}
+	}
+
+	var invoices []Invoice
+	db.Preload("Lines").Where("org_id = ? AND status IN ? AND period_start <= ? AND period_end >= ?",
+		sub.OrgID, []string{"issued", "paid"}, at, at).Order("period_start DESC, id DESC").Limit(5).Find(&invoices)
+	for _, inv := range invoices {
+		var paid int64
+		billed := false
+		for _, l := range inv.Lines {
+			switch l.Kind {
+			case "plan", "seat":
+				billed = true
+				paid += l.AmountKopecks
+			case "discount":
+				paid += l.AmountKopecks
+			}
+		}
+		if billed {
+			// Invoice periods end a second before the next one starts
+			return &orgPaidPeriod{Kopecks: max(paid, 0), From: *inv.PeriodStart, To: inv.PeriodEnd.Add(time.Second)}
+		}
+	}
+	return nil
+}
+
+func loadOrgPriceState(planID, seatsStudent, seatsStaff int) (orgPriceState, error) {
+	var plan SubscriptionPlan
+	if err := db.First(&plan, planID).Error; err != nil {
+		return orgPriceState{}, err
+	}
+	s := orgPriceState{
+		PlanID:       plan.ID,
+		PlanName:     plan.Name,
+		BaseKopecks:  rubToKopecks(plan.BasePriceRub),
+		SeatsStudent: seatsStudent,
+		SeatsStaff:   seatsStaff,
+	}
+	var seatPrices []SeatPricing
+	db.Where("plan_id = ? AND is_active = true AND is_billable = true", plan.ID).Find(&seatPrices)
+	for _, sp := range seatPrices {
+		switch sp.SeatType {
+		case "student_editor":
+			s.StudentSeatKopecks, s.MinSeatsStudent = rubToKopecks(sp.PricePerMonthRub), sp.MinSeats
+		case "staff":
+			s.StaffSeatKopecks, s.MinSeatsStaff = rubToKopecks(sp.PricePerMonthRub), sp.MinSeats
+		}
+	}
+	return s, nil
+}
+
+type orgSubscriptionChangeRequest struct {
+	PlanSlug     string `json:"plan_slug"`
+	SeatsStudent *int   `json:"seats_student_editor"`
+	SeatsStaff   *int   `json:"seats_staff"`
+	AutoRenew    *bool  `json:"auto_renew"`
+	// ExpectedNetKopecks is the net_kopecks of the preview the user
+	// confirmed; the change is refused if the price has moved since.
+	ExpectedNetKopecks *int64 `json:"expected_net_kopecks"`
+}
+
+// previewOrgSubscriptionChange prices req against the active subscription.
+// It returns a nil proration when req changes neither the plan nor seats.
+func previewOrgSubscriptionChange(sub *OrgSubscription, req *orgSubscriptionChangeRequest, at time.Time) (*orgProration, error) {
+	toPlanID, toStudent, toStaff := sub.PlanID, sub.SeatsStudentEditor, sub.SeatsStaff
+	if req.PlanSlug != "" {
+		var plan SubscriptionPlan
+		if err := db.Where("slug = ? AND is_active = true", req.PlanSlug).First(&plan).Error; err != nil {
+			return nil, errors.New("plan not found")
+		}
+		toPlanID = plan.ID
+	}
+	if req.SeatsStudent != nil {
+		toStudent = *req.SeatsStudent
+	}
+	if req.SeatsStaff != nil {
+		toStaff = *req.SeatsStaff
+	}
+	if toStudent < 0 || toStaff < 0 {
+		return nil, errors.New("seat counts cannot be negative")
+	}
+	if toPlanID == sub.PlanID && toStudent == sub.SeatsStudentEditor && toStaff == sub.SeatsStaff {
+		return nil, nil
+	}
+
+	from, err := loadOrgPriceState(sub.PlanID, sub.SeatsStudentEditor, sub.SeatsStaff)
+	if err != nil {
+		return nil, err
+	}
+	to, err := loadOrgPriceState(toPlanID, toStudent, toStaff)
+	if err != nil {
+		return nil, err
+	}
+	p := prorateOrgChange(from, to, orgInvoiceMonths(sub.BillingPeriod), sub.StartsAt, sub.EndsAt, at, loadOrgPaidPeriod(sub, at))
+	return &p, nil
+}
+
+func previewOrgSubscriptionChangeHandler(c *gin.Context) {
+	uid, _ := getUserIDFromContext(c)
+	orgID := parseInt(c.Param("id"))
+	if !canManageOrgBilling(uid, orgID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Org admin access required"})
+		return
+	}
+	var sub OrgSubscription
+	if err := db.Where("org_id = ? AND status = 'active'", orgID).First(&sub).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No active subscription"})
+		return
+	}
+	var req orgSubscriptionChangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p, err := previewOrgSubscriptionChange(&sub, &req, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if p == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Nothing to change"})
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+// applyOrgSubscriptionChange changes plan and seats of the active
+// subscription. It returns the recorded change and, for an immediate change
+// with a positive net amount, the invoice for it.
+func applyOrgSubscriptionChange(sub *OrgSubscription, p *orgProration, uid uint) (*OrgSubscriptionChange, *Invoice, error) {
+	change := &OrgSubscriptionChange{
+		OrgID:            sub.OrgID,
+		SubscriptionID:   sub.ID,
+		FromPlanID:       p.From.PlanID,
+		ToPlanID:         p.To.PlanID,
+		FromSeatsStudent: p.From.SeatsStudent,
+		ToSeatsStudent:   p.To.SeatsStudent,
+		FromSeatsStaff:   p.From.SeatsStaff,
+		ToSeatsStaff:     p.To.SeatsStaff,
+		Status:           "scheduled",
+		EffectiveAt:      p.EffectiveAt,
+		CreditKopecks:    p.CreditKopecks,
+		ChargeKopecks:    p.ChargeKopecks,
+		NetKopecks:       p.NetKopecks,
+		RequestedBy:      uid,
+	}
+	var inv *Invoice
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// A new request replaces whatever was waiting for the period end
+		if err := tx.Model(&OrgSubscriptionChange{}).Where("subscription_id = ? AND status = ?", sub.ID, "scheduled").
+			Update("status", "cancelled").Error; err != nil {
+			return err
+		}
+		if !p.Immediate {
+			return tx.Create(change).Error
+		}
+
+		now := time.Now()
+		change.Status, change.AppliedAt = "applied", &now
+		if err := tx.Model(sub).Updates(map[string]interface{}{
+			"plan_id":              p.To.PlanID,
+			"seats_student_editor": p.To.SeatsStudent,
+			"seats_staff":          p.To.SeatsStaff,
+			"updated_at":           now,
+		}).Error; err != nil {
+			return err
+		}
+		if p.NetKopecks > 0 {
+			inv = prorationInvoice(sub, p)
+			inv.UserID = &uid
+			if err := issueInvoice(tx, inv); err != nil {
+				return err
+			}
+			change.InvoiceID = &inv.ID
+		}
+		return tx.Create(change).Error
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return change, inv, nil
+}
+
+// prorationInvoice bills the net amount of an immediate change as a single
+// line so the invoice never carries negative amounts.
+func prorationInvoice(sub *OrgSubscription, p *orgProration) *Invoice {
+	description := fmt.Sprintf("Изменение подписки: %s → %s", p.From.PlanName, p.To.PlanName)
+	if p.From.PlanID == p.To.PlanID {
+		description = fmt.Sprintf("Изменение мест тарифа «%s»: %d → %d учеников, %d → %d сотрудников",
+			p.To.PlanName, p.From.SeatsStudent, p.To.SeatsStudent, p.From.SeatsStaff, p.To.SeatsStaff)
+	}
+	description += fmt.Sprintf(" с %s по %s, с зачётом неиспользованной части (%s руб.)",
+		p.EffectiveAt.Format("02.01.2006"), p.PeriodEnd.Format("02.01.2006"), formatRub(p.CreditKopecks))
+	orgID := sub.OrgID
+	start, end := p.EffectiveAt, p.PeriodEnd
+	due := time.Now().AddDate(0, 0, 10)
+	var org Org
+	db.Select("id", "name").First(&org, orgID)
+	return &Invoice{
+		OrgID:       &orgID,
+		Currency:    "RUB",
+		BuyerName:   org.Name,
+		PeriodStart: &start,
+		PeriodEnd:   &end,
+		DueAt:       &due,
+		Lines: []InvoiceLine{{
+			Kind:             "proration",
+			Description:      description,
+			Quantity:         1,
+			Unit:             "шт.",
+			UnitPriceKopecks: p.NetKopecks,
+		}},
+	}
+}
+
+// applyDueOrgSubscriptionChanges applies changes scheduled for the end of a
+// period that has now ended. Renewal applies them as well, under the same
+// row lock, so whichever runs first wins and the other skips the change.
+func applyDueOrgSubscriptionChanges() {
+	var due []OrgSubscriptionChange
+	db.Where("status = ? AND effective_at <= ?", "scheduled", time.Now()).Limit(100).Find(&due)
+	for _, change := range due {
+		var applied, planChanged bool
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var sub OrgSubscription
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&sub, change.SubscriptionID).Error; err != nil {
+				return err
+			}
+			if sub.Status != "active" {
+				return tx.Model(&change).Where("status = ?", "scheduled").Update("status", "cancelled").Error
+			}
+			planChanged = sub.PlanID != change.ToPlanID
+			var err error
+			applied, err = applyScheduledOrgChange(tx, &sub, &change, time.Now())
+			return err
+		})
+		if err != nil {
+			log.Printf("[Billing] Failed to apply scheduled change %d: %v", change.ID, err)
+			continue
+		}
+		if !applied {
+			continue
+		}
+		if planChanged {
+			var plan SubscriptionPlan
+			if db.First(&plan, change.ToPlanID).Error == nil {
+				grantOrgEntitlements(change.OrgID, &plan)
+			}
+		}
+		log.Printf("[Billing] Applied scheduled change %d for org %d", change.ID, change.OrgID)
+	}
+}
+
+// applyScheduledOrgChange moves sub, locked by the caller, to the plan and
+// seats of change. It reports false when the change was applied or
+// cancelled in the meantime.
+func applyScheduledOrgChange(tx *gorm.DB, sub *OrgSubscription, change *OrgSubscriptionChange, now time.Time) (bool, error) {
+	res := tx.Model(change).Where("status = ?", "scheduled").Updates(map[string]interface{}{"status": "applied", "applied_at": now})
+	if res.Error != nil || res.RowsAffected == 0 {
+		return false, res.Error
+	}
+	if err := tx.Model(sub).Updates(map[string]interface{}{
+		"plan_id":              change.ToPlanID,
+		"seats_student_editor": change.ToSeatsStudent,
+		"seats_staff":          change.ToSeatsStaff,
+		"updated_at":           now,
+	}).Error; err != nil {
+		return false, err
+	}
+	sub.PlanID, sub.SeatsStudentEditor, sub.SeatsStaff = change.ToPlanID, change.ToSeatsStudent, change.ToSeatsStaff
+	return true, nil
+}
+
+func InitOrgSubscriptionChanges() {
+	if db == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(1 * time.Hour)
+		defer ticker.Stop()
+		applyDueOrgSubscriptionChanges()
+		for range ticker.C {
+			applyDueOrgSubscriptionChanges()
+		}
+	}()
+}
+
+func getOrgSubscriptionChangesHandler(c *gin.Context) {
+	uid, _ := getUserIDFromContext(c)
+	orgID := parseInt(c.Param("id"))
+	if !canManageOrgBilling(uid, orgID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Org admin access required"})
+		return
+	}
+	var changes []OrgSubscriptionChange
+	db.Where("org_id = ?", orgID).Order("created_at DESC").Limit(50).Find(&changes)
+	c.JSON(http.StatusOK, gin.H{"changes": changes})
+}
+
+func cancelOrgSubscriptionChangeHandler(c *gin.Context) {
+	uid, _ := getUserIDFromContext(c)
+	orgID := parseInt(c.Param("id"))
+	if !canManageOrgBilling(uid, orgID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Org admin access required"})
+		return
+	}
+	res := db.Model(&OrgSubscriptionChange{}).
+		Where("id = ? AND org_id = ? AND status = ?", c.Param("changeId"), orgID, "scheduled").
+		Update("status", "cancelled")
+	if res.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No scheduled change"})
+		return
+	}
+	logExtendedAudit(uid, "org_subscription_change_cancel", "org_subscription_change", c.Param("changeId"), "org", strconv.Itoa(orgID), c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusOK, gin.H{"message": "Scheduled change cancelled"})
+}
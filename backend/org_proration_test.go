@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProrateOrgChange(t *testing.T) {
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0) // 31 days
+	basic := orgPriceState{PlanID: 1, BaseKopecks: 310000, SeatsStudent: 10, StudentSeatKopecks: 3100}
+	pro := orgPriceState{PlanID: 2, BaseKopecks: 620000, SeatsStudent: 10, StudentSeatKopecks: 3100}
+	paidList := &orgPaidPeriod{Kopecks: basic.monthlyKopecks(), From: start, To: end}
+
+	// Upgrade with 11 of 31 days left: credit 11/31 of 3410 ₽, charge 11/31 of 6510 ₽
+	at := end.AddDate(0, 0, -11)
+	p := prorateOrgChange(basic, pro, 1, start, end, at, paidList)
+	if !p.Immediate || !p.EffectiveAt.Equal(at) {
+		t.Fatalf("upgrade should apply now: %+v", p)
+	}
+	if p.CreditKopecks != 121000 || p.ChargeKopecks != 231000 || p.NetKopecks != 110000 {
+		t.Fatalf("credit %d, charge %d, net %d", p.CreditKopecks, p.ChargeKopecks, p.NetKopecks)
+	}
+
+	// Adding seats mid-period charges only the added seats for the rest of it
+	more := basic
+	more.SeatsStudent = 15
+	p = prorateOrgChange(basic, more, 1, start, end, at, paidList)
+	if p.NetKopecks != 5*3100*11/31 {
+		t.Fatalf("seat addition net = %d", p.NetKopecks)
+	}
+
+	// Downgrades and seat removals wait for the period end and are not credited
+	for name, to := range map[string]orgPriceState{
+		"downgrade": basic,
+		"fewer seats": func() orgPriceState {
+			s := pro
+			s.SeatsStudent = 2
+			return s
+		}(),
+	} {
+		p = prorateOrgChange(pro, to, 1, start, end, at, &orgPaidPeriod{Kopecks: pro.monthlyKopecks(), From: start, To: end})
+		if p.Immediate || !p.EffectiveAt.Equal(end) || p.NetKopecks != 0 || p.CreditKopecks != 0 {
+			t.Errorf("%s: %+v", name, p)
+		}
+		if p.NextPeriodKopecks != to.monthlyKopecks() {
+			t.Errorf("%s: next period = %d", name, p.NextPeriodKopecks)
+		}
+	}
+
+	// Minimum seats are billed even when fewer are reserved
+	floor := orgPriceState{SeatsStudent: 2, StudentSeatKopecks: 100, MinSeatsStudent: 5}
+	if got := floor.monthlyKopecks(); got != 500 {
+		t.Errorf("monthly with minimum seats = %d", got)
+	}
+
+	// Quarterly periods scale the price, and changes after the end are free
+	p = prorateOrgChange(basic, pro, 3, start, start.AddDate(0, 3, 0), start,
+		&orgPaidPeriod{Kopecks: 3 * basic.monthlyKopecks(), From: start, To: start.AddDate(0, 3, 0)})
+	if p.NetKopecks != 3*(pro.monthlyKopecks()-basic.monthlyKopecks()) {
+		t.Errorf("quarterly net at start = %d", p.NetKopecks)
+	}
+	p = prorateOrgChange(basic, pro, 1, start, end, end.Add(time.Hour), paidList)
+	if p.NetKopecks != 0 || !p.Immediate {
+		t.Errorf("after period end: %+v", p)
+	}
+}
+
+// The credit follows what was actually invoiced, not the list price.
+func TestProrateOrgChangeCreditsWhatWasPaid(t *testing.T) {
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0) // 31 days
+	at := end.AddDate(0, 0, -11)
+	basic := orgPriceState{PlanID: 1, BaseKopecks: 310000, SeatsStudent: 10, StudentSeatKopecks: 3100}
+	pro := orgPriceState{PlanID: 2, BaseKopecks: 620000, SeatsStudent: 10, StudentSeatKopecks: 3100}
+
+	// A 50% promo halved the invoice, so only half of the list price is credited
+	p := prorateOrgChange(basic, pro, 1, start, end, at, &orgPaidPeriod{Kopecks: 170500, From: start, To: end})
+	if p.PaidKopecks != 170500 || p.CreditKopecks != 60500 || p.ChargeKopecks != 231000 || p.NetKopecks != 170500 {
+		t.Errorf("discounted period: paid %d, credit %d, charge %d, net %d", p.PaidKopecks, p.CreditKopecks, p.ChargeKopecks, p.NetKopecks)
+	}
+
+	// Nothing invoiced, nothing credited
+	p = prorateOrgChange(basic, pro, 1, start, end, at, nil)
+	if p.CreditKopecks != 0 || p.NetKopecks != p.ChargeKopecks {
+		t.Errorf("unbilled period: credit %d, net %d", p.CreditKopecks, p.NetKopecks)
+	}
+
+	// After an earlier upgrade the state was paid from that change on: 11 of
+	// the 21 days it covered are left
+	earlier := end.AddDate(0, 0, -21)
+	p = prorateOrgChange(basic, pro, 1, start, end, at, &orgPaidPeriod{Kopecks: 210000, From: earlier, To: end})
+	if p.CreditKopecks != 110000 {
+		t.Errorf("credit after an earlier change = %d, want 110000", p.CreditKopecks)
+	}
+}
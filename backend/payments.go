@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
+)
+
+// paymentProvider is a payment service premium purchases, renewals and
+// refunds go through. Amounts are in minor units (kopecks, cents).
+type paymentProvider interface {
+	Name() string
+	// Supports reports whether the provider takes payments in currency.
+	Supports(currency string) bool
+	// CreatePayment starts a payment the customer confirms at
+	// ConfirmationURL.
+	CreatePayment(ctx context.Context, req *paymentRequest) (*providerPayment, error)
+	// ChargeSaved charges a method saved by an earlier payment without the
+	// customer being present.
+	ChargeSaved(ctx context.Context, req *paymentRequest, methodID string) (*providerPayment, error)
+	// Refund returns money from a payment. Errors that wrap
+	// errRefundDeclined mean nothing was refunded; after any other error
+	// the refund may still have gone through.
+	Refund(ctx context.Context, req *refundRequest) error
+	// GetPayment polls the payment's current state.
+	GetPayment(ctx context.Context, paymentID string) (*providerPayment, error)
+	// ParseWebhook authenticates a notification and names the payment it
+	// is about.
+	ParseWebhook(r *http.Request, body []byte) (*paymentNotification, error)
+}
+
+// paymentRequest is a payment for either a PremiumTransaction or a
+// CreatorDonation.
+type paymentRequest struct {
+	TransactionID uint
+	DonationID    uint
+	Amount        int64
+	Currency      string
+	Description   string
+	ReturnURL     string
+	SaveMethod    bool
+}
+
+// refundRequest returns Amount of a payment. Key is sent as the
+// idempotency key and must be the same for every attempt at one refund.
+type refundRequest struct {
+	PaymentID string
+	Amount    int64
+	Currency  string
+	Reason    string
+	Key       string
+}
+
+// providerPayment is a payment as the provider reports it. Status is one
+// of pending, succeeded or canceled.
+type providerPayment struct {
+	ID              string
+	Status          string
+	Paid            bool
+	Amount          int64
+	Currency        string
+	ConfirmationURL string
+	// MethodID is the saved method to charge for renewals, if any.
+	MethodID string
+	Metadata map[string]interface{}
+}
+
+// paymentNotification is what a webhook reports. Event is
+// payment.succeeded or payment.canceled for the events we act on.
+type paymentNotification struct {
+	Event     string
+	PaymentID string
+}
+
+// errPaymentRejected marks events that must not be retried: the payment
+// does not exist, does not match the notification or does not match what
+// was ordered.
+var errPaymentRejected = errors.New("payment event rejected")
+
+// errRefundDeclined marks refunds the provider refused outright or that
+// were never sent, so no money moved.
+var errRefundDeclined = errors.New("refund declined")
+
+// paymentAPIError is an error status from a provider's API.
+type paymentAPIError struct {
+	Provider   string
+	StatusCode int
+	Body       string
+}
+
+func (e *paymentAPIError) Error() string {
+	return fmt.Sprintf("%s error %d: %s", e.Provider, e.StatusCode, e.Body)
+}
+
+// declinedRefund marks err as a declined refund when the provider
+// answered with a client error. Timeouts, 5xx, 409 and 429 leave the
+// outcome open.
+func declinedRefund(err error) error {
+	var apiErr *paymentAPIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode >= 400 && apiErr.StatusCode < 500 &&
+		apiErr.StatusCode != http.StatusConflict && apiErr.StatusCode != http.StatusTooManyRequests {
+		return fmt.Errorf("%w: %w", errRefundDeclined, err)
+	}
+	return err
+}
+
+const paymentWebhookMaxBody = 1 << 20
+
+var paymentProviders = map[string]paymentProvider{}
+
+func registerPaymentProvider(p paymentProvider) {
+	paymentProviders[p.Name()] = p
+	log.Printf("[Payments] Provider %s enabled", p.Name())
+}
+
+// paymentProviderByName returns a configured provider. Records from before
+// providers were tracked have no name and went through YooKassa.
+func paymentProviderByName(name string) paymentProvider {
+	if name == "" {
+		name = "yookassa"
+	}
+	return paymentProviders[name]
+}
+
+// initPaymentProviders enables the providers other than YooKassa that are
+// configured.
+func initPaymentProviders() {
+	if key := os.Getenv("STRIPE_SECRET_KEY"); key != "" {
+		endpoint := os.Getenv("STRIPE_API_URL")
+		if endpoint == "" {
+			endpoint = "https://api.stripe.com"
+		}
+		registerPaymentProvider(&stripeProvider{
+			SecretKey:     key,
+			WebhookSecret: os.Getenv("STRIPE_WEBHOOK_SECRET"),
+			APIEndpoint:   strings.TrimRight(endpoint, "/"),
+			Currencies:    strings.Split(envOr("STRIPE_CURRENCIES", "USD,EUR"), ","),
+		})
+	}
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// Regions
+
+var euroRegions = []string{
+	"AT", "BE", "CY", "DE", "EE", "ES", "FI", "FR", "GR", "HR", "IE", "IT",
+	"LT", "LU", "LV", "MT", "NL", "PT", "SI", "SK",
+}
+
+// paymentRegion is the user's country: the one in their settings, else the
+// one the CDN puts in front of the request.
+func paymentRegion(c *gin.Context, uid uint) string {
+	var settings UserSettings
+	if db.Select("country").Where("user_id = ?", uid).First(&settings).Error == nil && settings.Country != "" {
+		return strings.ToUpper(settings.Country)
+	}
+	for _, header := range []string{"CF-IPCountry", "X-Country-Code"} {
+		if v := strings.ToUpper(strings.TrimSpace(c.GetHeader(header))); len(v) == 2 && v != "XX" {
+			return v
+		}
+	}
+	return ""
+}
+
+// isDomesticRegion is true for the regions that pay in rubles through
+// YooKassa first (PAYMENT_DOMESTIC_REGIONS, RU by default); everyone else
+// gets the international providers first.
+func isDomesticRegion(region string) bool {
+	return region == "" || slices.Contains(strings.Split(envOr("PAYMENT_DOMESTIC_REGIONS", "RU"), ","), region)
+}
+
+// regionCurrency is the currency prices are shown in for a region.
+func regionCurrency(region string) string {
+	switch {
+	case isDomesticRegion(region):
+		return "RUB"
+	case slices.Contains(euroRegions, region):
+		return "EUR"
+	}
+	return "USD"
+}
+
+// selectPaymentProvider picks the provider for a payment: the regional
+// preference order, skipping providers that do not take the currency.
+func selectPaymentProvider(region, currency string) paymentProvider {
+	order := []string{"yookassa", "stripe"}
+	if !isDomesticRegion(region) {
+		order = []string{"stripe", "yookassa"}
+	}
+	for _, name := range order {
+		if p := paymentProviders[name]; p != nil && p.Supports(currency) {
+			return p
+		}
+	}
+	return nil
+}
+
+// Prices
+
+// PlanPrice is a premium plan's price in a currency other than rubles;
+// the ruble price stays on the plan.
+type PlanPrice struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	PlanID    uint      `gorm:"uniqueIndex:idx_plan_price_currency" json:"plan_id"`
+	Currency  string    `gorm:"size:3;uniqueIndex:idx_plan_price_currency" json:"currency"`
+	Amount    int64     `json:"amount"` // minor units
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// premiumPlanPrice is what plan costs in currency, in minor units.
+func premiumPlanPrice(plan *PremiumPlan, currency string) (int64, bool) {
+	currency = ledgerCurrency(currency)
+	if currency == "RUB" {
+		return rubToKopecks(plan.PriceRub), true
+	}
+	var price PlanPrice
+	if db.Where("plan_id = ? AND currency = ?", plan.ID, currency).First(&price).Error != nil {
+		return 0, false
+	}
+	return price.Amount, true
+}
+
+// premiumPlanPrices lists every currency plan can be bought in.
+func premiumPlanPrices(plan *PremiumPlan) map[string]int64 {
+	prices := map[string]int64{"RUB": rubToKopecks(plan.PriceRub)}
+	var rows []PlanPrice
+	db.Where("plan_id = ?", plan.ID).Find(&rows)
+	for _, p := range rows {
+		prices[p.Currency] = p.Amount
+	}
+	return prices
+}
+
+// checkoutCurrency is the currency to charge in: the one asked for, else
+// the region's if the plan is priced in it and a provider takes it, else
+// rubles through YooKassa.
+func checkoutCurrency(plan *PremiumPlan, requested, region string) (string, int64, error) {
+	if requested != "" {
+		currency := ledgerCurrency(requested)
+		if currency != "RUB" && selectPaymentProvider(region, currency) == nil {
+			return "", 0, fmt.Errorf("payments in %s are not available", currency)
+		}
+		amount, ok := premiumPlanPrice(plan, currency)
+		if !ok {
+			return "", 0, fmt.Errorf("plan is not sold in %s", currency)
+		}
+		return currency, amount, nil
+	}
+	if currency := regionCurrency(region); selectPaymentProvider(region, currency) != nil {
+		if amount, ok := premiumPlanPrice(plan, currency); ok {
+			return currency, amount, nil
+		}
+	}
+	return "RUB", rubToKopecks(plan.PriceRub), nil
+}
+
+// checkPaymentAmount compares what was paid with what was ordered.
+func checkPaymentAmount(p *providerPayment, want int64, wantCurrency string) error {
+	if !strings.EqualFold(p.Currency, ledgerCurrency(wantCurrency)) {
+		return fmt.Errorf("%w: currency %s, expected %s", errPaymentRejected, p.Currency, ledgerCurrency(wantCurrency))
+	}
+	if p.Amount != want {
+		return fmt.Errorf("%w: amount %s, expected %s", errPaymentRejected, formatRub(p.Amount), formatRub(want))
+	}
+	return nil
+}
+
+// verifyProviderPayment polls the payment a notification names and checks
+// that its state matches the event.
+func verifyProviderPayment(ctx context.Context, provider paymentProvider, event, paymentID string) (*providerPayment, error) {
+	payment, err := provider.GetPayment(ctx, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	want := strings.TrimPrefix(event, "payment.")
+	if payment.Status != want {
+		return nil, fmt.Errorf("%w: event %s but payment %s is %s", errPaymentRejected, event, paymentID, payment.Status)
+	}
+	if want == "succeeded" && !payment.Paid {
+		return nil, fmt.Errorf("%w: payment %s is not paid", errPaymentRejected, paymentID)
+	}
+	return payment, nil
+}
+
+// paymentWebhookHandler takes notifications from every provider into the
+// same inbox and processing. Keys of events from providers other than
+// YooKassa are prefixed with the provider, as earlier YooKassa keys are not.
+func paymentWebhookHandler(c *gin.Context) {
+	name := c.Param("provider")
+	if name == "yookassa" {
+		yookassaWebhookHandler(c)
+		return
+	}
+	provider := paymentProviders[name]
+	if provider == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown provider"})
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, paymentWebhookMaxBody))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload"})
+		return
+	}
+	notification, err := provider.ParseWebhook(c.Request, body)
+	if err != nil {
+		log.Printf("[Payments] Rejected %s webhook: %v", name, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid signature"})
+		return
+	}
+	if notification == nil {
+		c.JSON(http.StatusOK, gin.H{"status": "ignored"})
+		return
+	}
+
+	event := YooKassaWebhookEvent{
+		EventKey: name + ":" + notification.Event + ":" + notification.PaymentID,
+		Provider: name,
+		Event:    notification.Event,
+		ObjectID: notification.PaymentID,
+		Payload:  string(body),
+		RemoteIP: c.ClientIP(),
+		Status:   "received",
+	}
+	receivePaymentEvent(c, &event)
+}
+
+// receivePaymentEvent stores an event in the inbox, then processes it.
+// Events that were already handled are acknowledged without doing
+// anything; a 500 makes the provider retry the ones that failed for
+// transient reasons.
+func receivePaymentEvent(c *gin.Context, event *YooKassaWebhookEvent) {
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(event).Error; err != nil {
+		log.Printf("[Billing] Failed to store webhook %s: %v", event.EventKey, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store event"})
+		return
+	}
+	if event.ID == 0 {
+		if err := db.Where("event_key = ?", event.EventKey).First(event).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load event"})
+			return
+		}
+		if event.Status != "received" && event.Status != "failed" {
+			c.JSON(http.StatusOK, gin.H{"status": "already_processed"})
+			return
+		}
+	}
+
+	if err := processPaymentEvent(c.Request.Context(), event); err != nil && !errors.Is(err, errPaymentRejected) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process event"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": event.Status})
+}
+
+// getPaymentOptionsHandler tells the checkout which currency and provider
+// the user will pay with, and the plan's prices.
+func getPaymentOptionsHandler(c *gin.Context) {
+	uid, _ := getUserIDFromContext(c)
+	var plan PremiumPlan
+	if err := db.First(&plan, c.Query("plan_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
+		return
+	}
+	region := paymentRegion(c, uid)
+	currency, amount, err := checkoutCurrency(&plan, c.Query("currency"), region)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	resp := gin.H{
+		"region":   region,
+		"currency": currency,
+		"amount":   amount,
+		"prices":   premiumPlanPrices(&plan),
+	}
+	if provider := selectPaymentProvider(region, currency); provider != nil {
+		resp["provider"] = provider.Name()
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// getPlanPricesHandler lists the foreign currency prices of premium plans.
+func getPlanPricesHandler(c *gin.Context) {
+	var prices []PlanPrice
+	query := db.Order("plan_id, currency")
+	if planID := c.Query("plan_id"); planID != "" {
+		query = query.Where("plan_id = ?", planID)
+	}
+	query.Find(&prices)
+	c.JSON(http.StatusOK, gin.H{"prices": prices})
+}
+
+// setPlanPriceHandler sets or, with a zero amount, removes a plan's price
+// in a currency.
+func setPlanPriceHandler(c *gin.Context) {
+	uid, _ := getUserIDFromContext(c)
+	var req struct {
+		PlanID   uint   `json:"plan_id" binding:"required"`
+		Currency string `json:"currency" binding:"required,len=3"`
+		Amount   int64  `json:"amount"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	currency := ledgerCurrency(req.Currency)
+	if currency == "RUB" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Ruble prices are set on the plan"})
+		return
+	}
+	if req.Amount < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Amount must not be negative"})
+		return
+	}
+	var plan PremiumPlan
+	if err := db.First(&plan, req.PlanID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
+		return
+	}
+
+	if req.Amount == 0 {
+		db.Where("plan_id = ? AND currency = ?", plan.ID, currency).Delete(&PlanPrice{})
+	} else {
+		price := PlanPrice{PlanID: plan.ID, Currency: currency, Amount: req.Amount}
+		err := db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "plan_id"}, {Name: "currency"}},
+			DoUpdates: clause.AssignmentColumns([]string{"amount", "updated_at"}),
+		}).Create(&price).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save price"})
+			return
+		}
+	}
+	logExtendedAudit(uid, "plan_price_update", "premium_plan", fmt.Sprint(plan.ID), "admin",
+		fmt.Sprintf("%s %d", currency, req.Amount), c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusOK, gin.H{"plan_id": plan.ID, "prices": premiumPlanPrices(&plan)})
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stripeProvider takes card payments in foreign currencies through Stripe
+// Checkout. Renewals charge the card saved by the first checkout off
+// session; the saved method is kept as "customer/payment_method".
+type stripeProvider struct {
+	SecretKey     string
+	WebhookSecret string
+	APIEndpoint   string
+	Currencies    []string
+}
+
+// stripeWebhookTolerance is how old a signed webhook may be, as in
+// Stripe's own libraries.
+const stripeWebhookTolerance = 5 * time.Minute
+
+func (p *stripeProvider) Name() string { return "stripe" }
+
+func (p *stripeProvider) Supports(currency string) bool {
+	currency = ledgerCurrency(currency)
+	return slices.ContainsFunc(p.Currencies, func(c string) bool {
+		return strings.EqualFold(strings.TrimSpace(c), currency)
+	})
+}
+
+type stripeCheckoutSession struct {
+	ID            string                 `json:"id"`
+	URL           string                 `json:"url"`
+	Status        string                 `json:"status"`
+	PaymentStatus string                 `json:"payment_status"`
+	AmountTotal   int64                  `json:"amount_total"`
+	Currency      string                 `json:"currency"`
+	Customer      string                 `json:"customer"`
+	PaymentIntent string                 `json:"payment_intent"`
+	Metadata      map[string]interface{} `json:"metadata"`
+}
+
+type stripePaymentIntent struct {
+	ID            string                 `json:"id"`
+	Status        string                 `json:"status"`
+	Amount        int64                  `json:"amount"`
+	AmountRecv    int64                  `json:"amount_received"`
+	Currency      string                 `json:"currency"`
+	Customer      string                 `json:"customer"`
+	PaymentMethod string                 `json:"payment_method"`
+	Metadata      map[string]interface{} `json:"metadata"`
+}
+
+func (p *stripeProvider) CreatePayment(ctx context.Context, req *paymentRequest) (*providerPayment, error) {
+	if !p.Supports(req.Currency) {
+		return nil, fmt.Errorf("stripe does not take %s", req.Currency)
+	}
+	form := url.Values{
+		"mode":                                   {"payment"},
+		"success_url":                            {req.ReturnURL},
+		"cancel_url":                             {req.ReturnURL},
+		"line_items[0][quantity]":                {"1"},
+		"line_items[0][price_data][currency]":    {strings.ToLower(req.Currency)},
+		"line_items[0][price_data][unit_amount]": {strconv.FormatInt(req.Amount, 10)},
+		"line_items[0][price_data][product_data][name]": {req.Description},
+	}
+	key := "transaction-" + strconv.FormatUint(uint64(req.TransactionID), 10)
+	if req.DonationID != 0 {
+		form.Set("metadata[donation_id]", strconv.FormatUint(uint64(req.DonationID), 10))
+		key = "donation-" + strconv.FormatUint(uint64(req.DonationID), 10)
+	} else {
+		form.Set("metadata[transaction_id]", strconv.FormatUint(uint64(req.TransactionID), 10))
+	}
+	if req.SaveMethod {
+		form.Set("customer_creation", "always")
+		form.Set("payment_intent_data[setup_future_usage]", "off_session")
+	}
+
+	var session stripeCheckoutSession
+	if err := p.call(ctx, http.MethodPost, "/v1/checkout/sessions", form, key, &session); err != nil {
+		return nil, err
+	}
+	return p.sessionPayment(ctx, &session)
+}
+
+// ChargeSaved confirms a payment intent off session. Metadata on the
+// intent lets its webhook settle the transaction if the card needs time.
+func (p *stripeProvider) ChargeSaved(ctx context.Context, req *paymentRequest, methodID string) (*providerPayment, error) {
+	if !p.Supports(req.Currency) {
+		return nil, fmt.Errorf("stripe does not take %s", req.Currency)
+	}
+	customer, method, ok := strings.Cut(methodID, "/")
+	if !ok || customer == "" || method == "" {
+		return nil, fmt.Errorf("invalid stripe payment method %q", methodID)
+	}
+	form := url.Values{
+		"amount":                   {strconv.FormatInt(req.Amount, 10)},
+		"currency":                 {strings.ToLower(req.Currency)},
+		"customer":                 {customer},
+		"payment_method":           {method},
+		"off_session":              {"true"},
+		"confirm":                  {"true"},
+		"description":              {req.Description},
+		"metadata[transaction_id]": {strconv.FormatUint(uint64(req.TransactionID), 10)},
+	}
+	var intent stripePaymentIntent
+	if err := p.call(ctx, http.MethodPost, "/v1/payment_intents", form, fmt.Sprintf("renewal-%d", req.TransactionID), &intent); err != nil {
+		return nil, err
+	}
+	return intent.payment(), nil
+}
+
+func (p *stripeProvider) Refund(ctx context.Context, req *refundRequest) error {
+	if !p.Supports(req.Currency) {
+		return fmt.Errorf("%w: stripe does not take %s", errRefundDeclined, req.Currency)
+	}
+	if req.Key == "" {
+		return fmt.Errorf("%w: refund without an idempotency key", errRefundDeclined)
+	}
+	intentID := req.PaymentID
+	if strings.HasPrefix(req.PaymentID, "cs_") {
+		var session stripeCheckoutSession
+		if err := p.call(ctx, http.MethodGet, "/v1/checkout/sessions/"+url.PathEscape(req.PaymentID), nil, "", &session); err != nil {
+			return fmt.Errorf("%w: %w", errRefundDeclined, err)
+		}
+		if session.PaymentIntent == "" {
+			return fmt.Errorf("%w: checkout session %s has no payment", errRefundDeclined, req.PaymentID)
+		}
+		intentID = session.PaymentIntent
+	}
+	form := url.Values{
+		"payment_intent":   {intentID},
+		"amount":           {strconv.FormatInt(req.Amount, 10)},
+		"reason":           {"requested_by_customer"},
+		"metadata[reason]": {req.Reason},
+	}
+	// A payment can be refunded in parts, so the key comes from the refund
+	// record rather than the payment
+	return declinedRefund(p.call(ctx, http.MethodPost, "/v1/refunds", form, req.Key, nil))
+}
+
+// GetPayment takes either a checkout session, for payments the customer
+// made, or a payment intent, for renewals.
+func (p *stripeProvider) GetPayment(ctx context.Context, paymentID string) (*providerPayment, error) {
+	switch {
+	case strings.HasPrefix(paymentID, "cs_"):
+		var session stripeCheckoutSession
+		if err := p.call(ctx, http.MethodGet, "/v1/checkout/sessions/"+url.PathEscape(paymentID), nil, "", &session); err != nil {
+			return nil, err
+		}
+		if session.ID != paymentID {
+			return nil, fmt.Errorf("%w: asked for session %s, got %s", errPaymentRejected, paymentID, session.ID)
+		}
+		return p.sessionPayment(ctx, &session)
+	case strings.HasPrefix(paymentID, "pi_"):
+		var intent stripePaymentIntent
+		if err := p.call(ctx, http.MethodGet, "/v1/payment_intents/"+url.PathEscape(paymentID), nil, "", &intent); err != nil {
+			return nil, err
+		}
+		if intent.ID != paymentID {
+			return nil, fmt.Errorf("%w: asked for payment intent %s, got %s", errPaymentRejected, paymentID, intent.ID)
+		}
+		return intent.payment(), nil
+	}
+	return nil, fmt.Errorf("%w: unknown stripe object %s", errPaymentRejected, paymentID)
+}
+
+// sessionPayment converts a checkout session. The method saved for
+// renewals is on the session's payment intent.
+func (p *stripeProvider) sessionPayment(ctx context.Context, session *stripeCheckoutSession) (*providerPayment, error) {
+	payment := &providerPayment{
+		ID:              session.ID,
+		Status:          "pending",
+		Paid:            session.PaymentStatus == "paid",
+		Amount:          session.AmountTotal,
+		Currency:        ledgerCurrency(session.Currency),
+		ConfirmationURL: session.URL,
+		Metadata:        session.Metadata,
+	}
+	switch {
+	case payment.Paid:
+		payment.Status = "succeeded"
+	case session.Status == "expired":
+		payment.Status = "canceled"
+	}
+	if payment.Paid && session.Customer != "" && session.PaymentIntent != "" {
+		var intent stripePaymentIntent
+		if err := p.call(ctx, http.MethodGet, "/v1/payment_intents/"+url.PathEscape(session.PaymentIntent), nil, "", &intent); err != nil {
+			return nil, err
+		}
+		if intent.PaymentMethod != "" {
+			payment.MethodID = session.Customer + "/" + intent.PaymentMethod
+		}
+	}
+	return payment, nil
+}
+
+func (pi *stripePaymentIntent) payment() *providerPayment {
+	payment := &providerPayment{
+		ID:       pi.ID,
+		Status:   "pending",
+		Amount:   pi.Amount,
+		Currency: ledgerCurrency(pi.Currency),
+		Metadata: pi.Metadata,
+	}
+	switch pi.Status {
+	case "succeeded":
+		payment.Status = "succeeded"
+		payment.Paid = pi.AmountRecv == pi.Amount
+	case "canceled", "requires_payment_method":
+		payment.Status = "canceled"
+	}
+	if pi.Customer != "" && pi.PaymentMethod != "" {
+		payment.MethodID = pi.Customer + "/" + pi.PaymentMethod
+	}
+	return payment
+}
+
+// ParseWebhook checks the Stripe-Signature header and maps the events that
+// settle payments. Payment intents created by checkout carry no metadata;
+// their session's events settle them instead.
+func (p *stripeProvider) ParseWebhook(r *http.Request, body []byte) (*paymentNotification, error) {
+	if err := verifyStripeSignature(r.Header.Get("Stripe-Signature"), body, p.WebhookSecret, time.Now()); err != nil {
+		return nil, err
+	}
+	var event struct {
+		Type string `json:"type"`
+		Data struct {
+			Object struct {
+				ID       string                 `json:"id"`
+				Metadata map[string]interface{} `json:"metadata"`
+			} `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil || event.Data.Object.ID == "" {
+		return nil, errors.New("invalid payload")
+	}
+	object := event.Data.Object
+	_, renewal := metadataID(object.Metadata, "transaction_id")
+	switch {
+	case event.Type == "checkout.session.completed", event.Type == "checkout.session.async_payment_succeeded":
+		return &paymentNotification{Event: "payment.succeeded", PaymentID: object.ID}, nil
+	case event.Type == "checkout.session.expired", event.Type == "checkout.session.async_payment_failed":
+		return &paymentNotification{Event: "payment.canceled", PaymentID: object.ID}, nil
+	case event.Type == "payment_intent.succeeded" && renewal:
+		return &paymentNotification{Event: "payment.succeeded", PaymentID: object.ID}, nil
+	case event.Type == "payment_intent.payment_failed" && renewal:
+		return &paymentNotification{Event: "payment.canceled", PaymentID: object.ID}, nil
+	}
+	return nil, nil
+}
+
+// verifyStripeSignature checks a "t=...,v1=..." header: an HMAC-SHA256 of
+// the timestamp and body under the endpoint secret.
+func verifyStripeSignature(header string, body []byte, secret string, now time.Time) error {
+	if secret == "" {
+		return errors.New("stripe webhook secret is not configured")
+	}
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			timestamp = v
+		case "v1":
+			signatures = append(signatures, v)
+		}
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return errors.New("malformed signature header")
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > stripeWebhookTolerance || age < -stripeWebhookTolerance {
+		return fmt.Errorf("signature timestamp is %s off", age.Round(time.Second))
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+	for _, sig := range signatures {
+		if got, err := hex.DecodeString(sig); err == nil && hmac.Equal(got, expected) {
+			return nil
+		}
+	}
+	return errors.New("signature mismatch")
+}
+
+// call makes a form-encoded API request. A missing object is a rejection;
+// other failures are worth retrying.
+func (p *stripeProvider) call(ctx context.Context, method, path string, form url.Values, idempotencyKey string, out interface{}) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.APIEndpoint+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.SecretKey)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, paymentWebhookMaxBody))
+	if resp.StatusCode == http.StatusNotFound && method == http.MethodGet {
+		return fmt.Errorf("%w: stripe object %s not found", errPaymentRejected, path)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &paymentAPIError{Provider: "stripe", StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeStripe serves the handful of Stripe endpoints the provider uses and
+// records the forms it was sent.
+type fakeStripe struct {
+	sessions map[string]map[string]interface{}
+	intents  map[string]map[string]interface{}
+	forms    map[string][]string
+	keys     []string
+}
+
+func (f *fakeStripe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer sk_test" {
+		http.Error(w, `{"error":{"type":"invalid_request_error"}}`, http.StatusUnauthorized)
+		return
+	}
+	r.ParseForm()
+	if r.Method == http.MethodPost {
+		f.forms[r.URL.Path] = append(f.forms[r.URL.Path], r.PostForm.Encode())
+		f.keys = append(f.keys, r.Header.Get("Idempotency-Key"))
+	}
+	var out map[string]interface{}
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/checkout/sessions":
+		out = map[string]interface{}{
+			"id": "cs_new", "url": "https://checkout.stripe.test/cs_new", "status": "open", "payment_status": "unpaid",
+			"amount_total": json.Number(r.PostForm.Get("line_items[0][price_data][unit_amount]")),
+			"currency":     r.PostForm.Get("line_items[0][price_data][currency]"),
+			"metadata":     map[string]string{"transaction_id": r.PostForm.Get("metadata[transaction_id]")},
+		}
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/payment_intents":
+		if r.PostForm.Get("payment_method") == "pm_declined" {
+			http.Error(w, `{"error":{"type":"card_error","code":"card_declined"}}`, http.StatusPaymentRequired)
+			return
+		}
+		out = map[string]interface{}{
+			"id": "pi_renewal", "status": "succeeded",
+			"amount": json.Number(r.PostForm.Get("amount")), "amount_received": json.Number(r.PostForm.Get("amount")),
+			"currency": r.PostForm.Get("currency"), "customer": r.PostForm.Get("customer"), "payment_method": r.PostForm.Get("payment_method"),
+		}
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/refunds":
+		out = map[string]interface{}{"id": "re_1", "status": "succeeded"}
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/checkout/sessions/"):
+		out = f.sessions[strings.TrimPrefix(r.URL.Path, "/v1/checkout/sessions/")]
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/payment_intents/"):
+		out = f.intents[strings.TrimPrefix(r.URL.Path, "/v1/payment_intents/")]
+	}
+	if out == nil {
+		http.Error(w, `{"error":{"type":"invalid_request_error","code":"resource_missing"}}`, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+func newFakeStripe(t *testing.T) (*fakeStripe, *stripeProvider) {
+	fake := &fakeStripe{
+		sessions: map[string]map[string]interface{}{
+			"cs_paid": {
+				"id": "cs_paid", "status": "complete", "payment_status": "paid", "amount_total": 499, "currency": "usd",
+				"customer": "cus_1", "payment_intent": "pi_paid", "metadata": map[string]string{"transaction_id": "42"},
+			},
+			"cs_expired": {"id": "cs_expired", "status": "expired", "payment_status": "unpaid", "amount_total": 499, "currency": "usd"},
+		},
+		intents: map[string]map[string]interface{}{
+			"pi_paid": {"id": "pi_paid", "status": "succeeded", "amount": 499, "amount_received": 499, "currency": "usd", "customer": "cus_1", "payment_method": "pm_card"},
+		},
+		forms: map[string][]string{},
+	}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	return fake, &stripeProvider{SecretKey: "sk_test", WebhookSecret: "whsec_test", APIEndpoint: srv.URL, Currencies: []string{"USD", "EUR"}}
+}
+
+func TestStripeProviderAgainstFakeAPI(t *testing.T) {
+	fake, stripe := newFakeStripe(t)
+	ctx := context.Background()
+
+	created, err := stripe.CreatePayment(ctx, &paymentRequest{
+		TransactionID: 42, Amount: 499, Currency: "USD", Description: "Premium", ReturnURL: "https://example.test/premium", SaveMethod: true,
+	})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if created.ID != "cs_new" || created.Status != "pending" || created.ConfirmationURL == "" || created.Amount != 499 || created.Currency != "USD" {
+		t.Errorf("created = %+v", created)
+	}
+	form := fake.forms["/v1/checkout/sessions"][0]
+	for _, want := range []string{"metadata%5Btransaction_id%5D=42", "payment_intent_data%5Bsetup_future_usage%5D=off_session", "currency%5D=usd"} {
+		if !strings.Contains(form, want) {
+			t.Errorf("checkout form %s lacks %s", form, want)
+		}
+	}
+	if _, err := stripe.CreatePayment(ctx, &paymentRequest{TransactionID: 43, Amount: 29900, Currency: "RUB"}); err == nil {
+		t.Error("created a payment in a currency the account does not take")
+	}
+
+	paid, err := verifyProviderPayment(ctx, stripe, "payment.succeeded", "cs_paid")
+	if err != nil {
+		t.Fatalf("paid session: %v", err)
+	}
+	if paid.MethodID != "cus_1/pm_card" {
+		t.Errorf("saved method = %q", paid.MethodID)
+	}
+	if id, ok := metadataID(paid.Metadata, "transaction_id"); !ok || id != 42 {
+		t.Errorf("transaction_id = %d, %v", id, ok)
+	}
+	if err := checkPaymentAmount(paid, 499, "USD"); err != nil {
+		t.Errorf("amount: %v", err)
+	}
+	if err := checkPaymentAmount(paid, 499, "EUR"); !errors.Is(err, errPaymentRejected) {
+		t.Errorf("currency mismatch: err = %v", err)
+	}
+	if _, err := verifyProviderPayment(ctx, stripe, "payment.canceled", "cs_expired"); err != nil {
+		t.Errorf("expired session: %v", err)
+	}
+	for _, id := range []string{"cs_expired", "cs_missing", "ch_other"} {
+		if _, err := verifyProviderPayment(ctx, stripe, "payment.succeeded", id); !errors.Is(err, errPaymentRejected) {
+			t.Errorf("%s: err = %v, want rejected", id, err)
+		}
+	}
+
+	renewal, err := stripe.ChargeSaved(ctx, &paymentRequest{TransactionID: 44, Amount: 499, Currency: "USD"}, "cus_1/pm_card")
+	if err != nil || renewal.Status != "succeeded" || !renewal.Paid || renewal.ID != "pi_renewal" {
+		t.Errorf("renewal = %+v, %v", renewal, err)
+	}
+	if _, err := stripe.ChargeSaved(ctx, &paymentRequest{TransactionID: 45, Amount: 499, Currency: "USD"}, "cus_1/pm_declined"); err == nil || errors.Is(err, errPaymentRejected) {
+		t.Errorf("declined renewal: err = %v", err)
+	}
+	if _, err := stripe.ChargeSaved(ctx, &paymentRequest{TransactionID: 46, Amount: 499, Currency: "USD"}, "pm_card"); err == nil {
+		t.Error("charged a method without a customer")
+	}
+
+	if err := stripe.Refund(ctx, &refundRequest{PaymentID: "cs_paid", Amount: 499, Currency: "USD", Reason: "duplicate", Key: "refund-tx-42-499"}); err != nil {
+		t.Fatalf("refund: %v", err)
+	}
+	if key := fake.keys[len(fake.keys)-1]; key != "refund-tx-42-499" {
+		t.Errorf("refund sent under key %q, want the refund record's", key)
+	}
+	refund := fake.forms["/v1/refunds"][0]
+	if !strings.Contains(refund, "payment_intent=pi_paid") || !strings.Contains(refund, "amount=499") {
+		t.Errorf("refund form = %s", refund)
+	}
+	for _, key := range fake.keys {
+		if key == "" {
+			t.Errorf("POST without an idempotency key: %v", fake.keys)
+		}
+	}
+}
+
+func signStripe(body []byte, secret string, at time.Time) string {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "." + string(body)))
+	return fmt.Sprintf("t=%s,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+}
+
+func TestVerifyStripeSignature(t *testing.T) {
+	body := []byte(`{"type":"checkout.session.completed"}`)
+	now := time.Now()
+	if err := verifyStripeSignature(signStripe(body, "whsec_test", now), body, "whsec_test", now); err != nil {
+		t.Fatalf("genuine: %v", err)
+	}
+	// Stripe sends one v1 per active secret while one is being rolled
+	rolled := signStripe(body, "whsec_old", now) + "," + strings.Split(signStripe(body, "whsec_test", now), ",")[1]
+	if err := verifyStripeSignature(rolled, body, "whsec_test", now); err != nil {
+		t.Errorf("rolled secret: %v", err)
+	}
+	for name, tc := range map[string]struct {
+		header string
+		body   []byte
+	}{
+		"tampered":     {signStripe(body, "whsec_test", now), []byte(`{"type":"checkout.session.completed","x":1}`)},
+		"wrong secret": {signStripe(body, "whsec_other", now), body},
+		"stale":        {signStripe(body, "whsec_test", now.Add(-10*time.Minute)), body},
+		"unsigned":     {"", body},
+		"no v1":        {"t=" + strconv.FormatInt(now.Unix(), 10), body},
+	} {
+		if err := verifyStripeSignature(tc.header, tc.body, "whsec_test", now); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	if err := verifyStripeSignature(signStripe(body, "", now), body, "", now); err == nil {
+		t.Error("accepted a webhook without a configured secret")
+	}
+}
+
+func TestStripeParseWebhook(t *testing.T) {
+	stripe := &stripeProvider{WebhookSecret: "whsec_test"}
+	parse := func(body string) (*paymentNotification, error) {
+		r := httptest.NewRequest(http.MethodPost, "/api/billing/webhooks/stripe", strings.NewReader(body))
+		r.Header.Set("Stripe-Signature", signStripe([]byte(body), "whsec_test", time.Now()))
+		return stripe.ParseWebhook(r, []byte(body))
+	}
+	for body, want := range map[string]*paymentNotification{
+		`{"type":"checkout.session.completed","data":{"object":{"id":"cs_1"}}}`:                                      {"payment.succeeded", "cs_1"},
+		`{"type":"checkout.session.expired","data":{"object":{"id":"cs_2"}}}`:                                        {"payment.canceled", "cs_2"},
+		`{"type":"payment_intent.succeeded","data":{"object":{"id":"pi_1","metadata":{"transaction_id":"7"}}}}`:      {"payment.succeeded", "pi_1"},
+		`{"type":"payment_intent.payment_failed","data":{"object":{"id":"pi_2","metadata":{"transaction_id":"7"}}}}`: {"payment.canceled", "pi_2"},
+		`{"type":"payment_intent.succeeded","data":{"object":{"id":"pi_3","metadata":{}}}}`:                          nil, // settled by its session
+		`{"type":"customer.created","data":{"object":{"id":"cus_1"}}}`:                                               nil,
+	} {
+		got, err := parse(body)
+		if err != nil {
+			t.Errorf("%s: %v", body, err)
+			continue
+		}
+		if (got == nil) != (want == nil) || (got != nil && *got != *want) {
+			t.Errorf("%s: got %+v, want %+v", body, got, want)
+		}
+	}
+	if _, err := parse(`{"type":"checkout.session.completed","data":{"object":{}}}`); err == nil {
+		t.Error("accepted an event without an object")
+	}
+}
+
+func TestSelectPaymentProvider(t *testing.T) {
+	saved := paymentProviders
+	t.Cleanup(func() { paymentProviders = saved })
+	paymentProviders = map[string]paymentProvider{
+		"yookassa": &yookassaProvider{},
+		"stripe":   &stripeProvider{Currencies: []string{"USD", "EUR"}},
+	}
+
+	for _, tc := range []struct {
+		region, currency, want string
+	}{
+		{"RU", "RUB", "yookassa"},
+		{"", "RUB", "yookassa"},
+		{"DE", "EUR", "stripe"},
+		{"US", "USD", "stripe"},
+		{"DE", "RUB", "yookassa"}, // a plan without a euro price falls back to rubles
+		{"RU", "USD", "stripe"},
+		{"US", "JPY", ""},
+	} {
+		got := ""
+		if p := selectPaymentProvider(tc.region, tc.currency); p != nil {
+			got = p.Name()
+		}
+		if got != tc.want {
+			t.Errorf("%s/%s: provider %q, want %q", tc.region, tc.currency, got, tc.want)
+		}
+	}
+
+	delete(paymentProviders, "stripe")
+	if p := selectPaymentProvider("US", "USD"); p != nil {
+		t.Errorf("picked %s for dollars without stripe", p.Name())
+	}
+	if p := paymentProviderByName(""); p == nil || p.Name() != "yookassa" {
+		t.Error("records without a provider do not resolve to yookassa")
+	}
+}
+
+// Without a provider for the region's currency the checkout falls back to
+// the ruble price before looking up foreign prices.
+func TestCheckoutCurrencyWithoutProvider(t *testing.T) {
+	saved := paymentProviders
+	t.Cleanup(func() { paymentProviders = saved })
+	paymentProviders = map[string]paymentProvider{"yookassa": &yookassaProvider{}}
+	plan := &PremiumPlan{PriceRub: 299}
+
+	for _, region := range []string{"US", "DE", "RU"} {
+		currency, amount, err := checkoutCurrency(plan, "", region)
+		if err != nil || currency != "RUB" || amount != 29900 {
+			t.Errorf("%s: %s %d, %v; want RUB 29900", region, currency, amount, err)
+		}
+	}
+	if _, _, err := checkoutCurrency(plan, "usd", "US"); err == nil {
+		t.Error("accepted dollars without a provider for them")
+	}
+	if currency, amount, err := checkoutCurrency(plan, "RUB", "US"); err != nil || currency != "RUB" || amount != 29900 {
+		t.Errorf("rubles asked for: %s %d, %v", currency, amount, err)
+	}
+}
+
+func TestRegionCurrency(t *testing.T) {
+	for region, want := range map[string]string{"RU": "RUB", "": "RUB", "DE": "EUR", "FR": "EUR", "US": "USD", "KZ": "USD", "GB": "USD"} {
+		if got := regionCurrency(region); got != want {
+			t.Errorf("regionCurrency(%q) = %s, want %s", region, got, want)
+		}
+	}
+}
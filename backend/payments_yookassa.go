@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// yookassaProvider puts YooKassaService behind paymentProvider. YooKassa
+// only takes rubles here; fiscal receipts are built for rubles only.
+type yookassaProvider struct {
+	svc *YooKassaService
+}
+
+func (p *yookassaProvider) Name() string { return "yookassa" }
+
+func (p *yookassaProvider) Supports(currency string) bool {
+	return ledgerCurrency(currency) == "RUB"
+}
+
+func (p *yookassaProvider) CreatePayment(ctx context.Context, req *paymentRequest) (*providerPayment, error) {
+	if !p.Supports(req.Currency) {
+		return nil, fmt.Errorf("yookassa does not take %s", req.Currency)
+	}
+	amount := float64(req.Amount) / 100
+	var payment *YooKassaPaymentResponse
+	var err error
+	if req.DonationID != 0 {
+		payment, err = p.svc.CreateDonationPayment(req.DonationID, amount, req.Description, req.ReturnURL)
+	} else {
+		payment, err = p.svc.CreatePayment(req.TransactionID, amount, req.Description, req.ReturnURL, req.SaveMethod)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return yookassaPayment(payment)
+}
+
+func (p *yookassaProvider) ChargeSaved(ctx context.Context, req *paymentRequest, methodID string) (*providerPayment, error) {
+	if !p.Supports(req.Currency) {
+		return nil, fmt.Errorf("yookassa does not take %s", req.Currency)
+	}
+	payment, err := p.svc.CreatePaymentWithSavedMethod(req.TransactionID, float64(req.Amount)/100, req.Description, methodID)
+	if err != nil {
+		return nil, err
+	}
+	return yookassaPayment(payment)
+}
+
+func (p *yookassaProvider) Refund(ctx context.Context, req *refundRequest) error {
+	if p.svc == nil {
+		return fmt.Errorf("%w: yookassa is not configured", errRefundDeclined)
+	}
+	if !p.Supports(req.Currency) {
+		return fmt.Errorf("%w: yookassa does not take %s", errRefundDeclined, req.Currency)
+	}
+	if req.Key == "" {
+		return fmt.Errorf("%w: refund without an idempotency key", errRefundDeclined)
+	}
+	return declinedRefund(p.svc.CreateRefund(ctx, req.PaymentID, float64(req.Amount)/100, req.Reason, req.Key))
+}
+
+func (p *yookassaProvider) GetPayment(ctx context.Context, paymentID string) (*providerPayment, error) {
+	if p.svc == nil {
+		return nil, errors.New("yookassa is not configured")
+	}
+	payment, err := p.svc.GetPayment(ctx, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	return yookassaPayment(payment)
+}
+
+// ParseWebhook only reads the notification. YooKassa does not sign them;
+// the payment is re-fetched from the API before anything is applied.
+func (p *yookassaProvider) ParseWebhook(r *http.Request, body []byte) (*paymentNotification, error) {
+	var notification yookassaNotification
+	if err := json.Unmarshal(body, &notification); err != nil || notification.Event == "" || notification.Object.ID == "" {
+		return nil, errors.New("invalid payload")
+	}
+	return &paymentNotification{Event: notification.Event, PaymentID: notification.Object.ID}, nil
+}
+
+// yookassaPayment converts an API payment. A payment waiting for capture
+// is still pending for us since we always capture immediately.
+func yookassaPayment(payment *YooKassaPaymentResponse) (*providerPayment, error) {
+	amount, err := parseYooKassaAmount(payment.Amount.Value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errPaymentRejected, err)
+	}
+	status := payment.Status
+	if status == "waiting_for_capture" {
+		status = "pending"
+	}
+	p := &providerPayment{
+		ID:              payment.ID,
+		Status:          status,
+		Paid:            payment.Paid,
+		Amount:          amount,
+		Currency:        ledgerCurrency(payment.Amount.Currency),
+		ConfirmationURL: payment.Confirmation.ConfirmationURL,
+		Metadata:        payment.Metadata,
+	}
+	if payment.PaymentMethod.Saved {
+		p.MethodID = payment.PaymentMethod.ID
+	}
+	return p, nil
+}
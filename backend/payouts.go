@@ -0,0 +1,745 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Creator payouts. Succeeded donations credit the creator_payable ledger
+// account and the platform fee is taken back out of it. A creator can
+// withdraw what is left once donations are past the refund hold:
+//
+//	available = balance - held donations - payouts in flight
+//
+// Payout requests wait for an admin. Approved payouts go to the payout
+// gateway when one is configured and are paid by hand otherwise; the
+// ledger is debited only when the money has actually left.
+var (
+	creatorFeePercent      = 10.0
+	creatorPayoutMinimum   = int64(50000)
+	creatorDonationHold    = 14 * 24 * time.Hour
+	creatorPayoutGateway   payoutGateway
+	creatorPayoutsInFlight = []string{"requested", "approved", "processing"}
+)
+
+// CreatorPayout is a creator's withdrawal of their donation balance.
+type CreatorPayout struct {
+	ID               uint       `gorm:"primaryKey" json:"id"`
+	UserID           uint       `gorm:"index" json:"user_id"`
+	AmountKopecks    int64      `json:"amount_kopecks"`
+	Currency         string     `gorm:"size:3;default:'RUB'" json:"currency"`
+	Status           string     `gorm:"size:20;index" json:"status"`     // requested, approved, processing, paid, rejected, failed, cancelled
+	DestinationType  string     `gorm:"size:20" json:"destination_type"` // bank_card, yoo_money
+	PayoutToken      string     `json:"-"`
+	AccountNumber    string     `gorm:"size:40" json:"-"`
+	Destination      string     `gorm:"size:60" json:"destination"` // masked for display
+	Provider         string     `gorm:"size:30" json:"provider,omitempty"`
+	ProviderPayoutID string     `gorm:"size:64;index" json:"provider_payout_id,omitempty"`
+	FailureReason    string     `json:"failure_reason,omitempty"`
+	ReviewedBy       *uint      `json:"reviewed_by,omitempty"`
+	ReviewedAt       *time.Time `json:"reviewed_at,omitempty"`
+	PaidAt           *time.Time `json:"paid_at,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+// payoutGatewayResult is the provider's view of a payout.
+type payoutGatewayResult struct {
+	ID     string
+	Status string // pending, succeeded, canceled
+	Reason string
+}
+
+// payoutGateway sends money to creators. Tests and environments without
+// payout credentials leave it nil, and approved payouts are paid by hand.
+type payoutGateway interface {
+	Name() string
+	CreatePayout(ctx context.Context, p *CreatorPayout) (*payoutGatewayResult, error)
+	GetPayout(ctx context.Context, id string) (*payoutGatewayResult, error)
+}
+
+func InitCreatorPayouts() {
+	if v, err := strconv.ParseFloat(os.Getenv("CREATOR_PLATFORM_FEE_PERCENT"), 64); err == nil && v >= 0 && v < 100 {
+		creatorFeePercent = v
+	}
+	if v, err := strconv.ParseFloat(os.Getenv("CREATOR_PAYOUT_MIN_RUB"), 64); err == nil && v > 0 {
+		creatorPayoutMinimum = rubToKopecks(v)
+	}
+	if days, err := strconv.Atoi(os.Getenv("CREATOR_PAYOUT_HOLD_DAYS")); err == nil && days >= 0 {
+		creatorDonationHold = time.Duration(days) * 24 * time.Hour
+	}
+	agentID, secret := os.Getenv("YOOKASSA_PAYOUT_AGENT_ID"), os.Getenv("YOOKASSA_PAYOUT_SECRET_KEY")
+	if agentID != "" && secret != "" {
+		endpoint := os.Getenv("YOOKASSA_API_URL")
+		if endpoint == "" {
+			endpoint = "https://api.yookassa.ru/v3"
+		}
+		creatorPayoutGateway = &yookassaPayouts{AgentID: agentID, SecretKey: secret, APIEndpoint: strings.TrimRight(endpoint, "/")}
+	} else {
+		log.Println("[Payouts] YooKassa payout credentials not configured, approved payouts are paid manually")
+	}
+
+	if db == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(15 * time.Minute)
+		defer ticker.Stop()
+		syncProcessingPayouts()
+		reconcileDonationRefunds(time.Now())
+		for now := range ticker.C {
+			syncProcessingPayouts()
+			reconcileDonationRefunds(now)
+		}
+	}()
+}
+
+// creatorPlatformFee is the platform's share of a donation, rounded half
+// up to the kopeck.
+func creatorPlatformFee(amountKopecks int64, percent float64) int64 {
+	if amountKopecks <= 0 || percent <= 0 {
+		return 0
+	}
+	return int64(math.Floor(float64(amountKopecks)*percent/100 + 0.5))
+}
+
+// creatorBalance is a creator's payout position in kopecks.
+type creatorBalance struct {
+	BalanceKopecks   int64 `json:"balance_kopecks"`
+	HeldKopecks      int64 `json:"held_kopecks"`
+	InFlightKopecks  int64 `json:"in_flight_kopecks"`
+	AvailableKopecks int64 `json:"available_kopecks"`
+}
+
+func (b *creatorBalance) settle() {
+	b.AvailableKopecks = max(b.BalanceKopecks-b.HeldKopecks-b.InFlightKopecks, 0)
+}
+
+// loadCreatorBalance reads uid's balance through tx. exclude leaves one
+// payout out of the in-flight sum, for re-checking it at approval.
+func loadCreatorBalance(tx *gorm.DB, uid uint, exclude uint, now time.Time) creatorBalance {
+	var b creatorBalance
+	tx.Model(&LedgerLine{}).
+		Joins("JOIN ledger_accounts ON ledger_accounts.id = ledger_lines.account_id").
+		Where("ledger_accounts.code = ?", creatorPayableAccount(uid, "RUB").code()).
+		Select("COALESCE(-SUM(ledger_lines.amount_kopecks), 0)").Scan(&b.BalanceKopecks)
+
+	// Donations being refunded are held whatever their age
+	var held []CreatorDonation
+	tx.Where("to_user_id = ? AND ((status = ? AND COALESCE(paid_at, created_at) > ?) OR status = ?)",
+		uid, "succeeded", now.Add(-creatorDonationHold), "refunding").Find(&held)
+	for _, d := range held {
+		b.HeldKopecks += rubToKopecks(d.AmountRub) - d.PlatformFeeKopecks
+	}
+
+	tx.Model(&CreatorPayout{}).Where("user_id = ? AND status IN ? AND id <> ?", uid, creatorPayoutsInFlight, exclude).
+		Select("COALESCE(SUM(amount_kopecks), 0)").Scan(&b.InFlightKopecks)
+	b.settle()
+	return b
+}
+
+// lockCreatorPayable serializes balance changes of one creator.
+func lockCreatorPayable(tx *gorm.DB, uid uint) error {
+	account, err := ensureLedgerAccount(tx, creatorPayableAccount(uid, "RUB"))
+	if err != nil {
+		return err
+	}
+	return tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&LedgerAccount{}, account.ID).Error
+}
+
+var (
+	yooMoneyAccountPattern = regexp.MustCompile(`^41001\d{6,15}$`)
+	errPayoutTooSmall      = errors.New("payout is below the minimum")
+	errPayoutOverBalance   = errors.New("payout exceeds the available balance")
+)
+
+func maskPayoutDestination(destinationType, account string) string {
+	switch destinationType {
+	case "yoo_money":
+		if len(account) > 4 {
+			return "ЮMoney •••• " + account[len(account)-4:]
+		}
+		return "ЮMoney"
+	default:
+		return "Банковская карта"
+	}
+}
+
+func getCreatorBalanceHandler(c *gin.Context) {
+	uid, ok := getUserIDFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"balance":         loadCreatorBalance(db, uid, 0, time.Now()),
+		"currency":        "RUB",
+		"minimum_kopecks": creatorPayoutMinimum,
+		"fee_percent":     creatorFeePercent,
+		"hold_days":       int(creatorDonationHold / (24 * time.Hour)),
+	})
+}
+
+func getCreatorPayoutsHandler(c *gin.Context) {
+	uid, ok := getUserIDFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	var payouts []CreatorPayout
+	db.Where("user_id = ?", uid).Order("created_at DESC").Limit(100).Find(&payouts)
+	c.JSON(http.StatusOK, gin.H{"payouts": payouts})
+}
+
+// createCreatorPayoutHandler requests a withdrawal. bank_card needs a payout
+// token from the YooKassa payout widget, yoo_money a wallet number.
+func createCreatorPayoutHandler(c *gin.Context) {
+	uid, ok := getUserIDFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	var req struct {
+		AmountRub       float64 `json:"amount_rub" binding:"required,gt=0"`
+		DestinationType string  `json:"destination_type" binding:"required,oneof=bank_card yoo_money"`
+		PayoutToken     string  `json:"payout_token"`
+		AccountNumber   string  `json:"account_number"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	switch req.DestinationType {
+	case "bank_card":
+		if req.PayoutToken == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "payout_token is required for bank_card"})
+			return
+		}
+		req.AccountNumber = ""
+	case "yoo_money":
+		if !yooMoneyAccountPattern.MatchString(req.AccountNumber) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid YooMoney wallet number"})
+			return
+		}
+		req.PayoutToken = ""
+	}
+
+	payout := CreatorPayout{
+		UserID:          uid,
+		AmountKopecks:   rubToKopecks(req.AmountRub),
+		Currency:        "RUB",
+		Status:          "requested",
+		DestinationType: req.DestinationType,
+		PayoutToken:     req.PayoutToken,
+		AccountNumber:   req.AccountNumber,
+		Destination:     maskPayoutDestination(req.DestinationType, req.AccountNumber),
+	}
+	var balance creatorBalance
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := lockCreatorPayable(tx, uid); err != nil {
+			return err
+		}
+		balance = loadCreatorBalance(tx, uid, 0, time.Now())
+		if payout.AmountKopecks < creatorPayoutMinimum {
+			return errPayoutTooSmall
+		}
+		if payout.AmountKopecks > balance.AvailableKopecks {
+			return errPayoutOverBalance
+		}
+		return tx.Create(&payout).Error
+	})
+	switch {
+	case errors.Is(err, errPayoutTooSmall):
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Minimum payout is %s", formatRub(creatorPayoutMinimum))})
+		return
+	case errors.Is(err, errPayoutOverBalance):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Amount exceeds the available balance", "balance": balance})
+		return
+	case err != nil:
+		log.Printf("[Payouts] Failed to create payout for user %d: %v", uid, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payout"})
+		return
+	}
+	c.JSON(http.StatusCreated, payout)
+}
+
+func cancelCreatorPayoutHandler(c *gin.Context) {
+	uid, ok := getUserIDFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	result := db.Model(&CreatorPayout{}).Where("id = ? AND user_id = ? AND status = ?", c.Param("id"), uid, "requested").
+		Updates(map[string]interface{}{"status": "cancelled", "payout_token": ""})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel payout"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No pending payout request with this id"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "cancelled"})
+}
+
+// getAdminPayoutsHandler is the approval queue; status defaults to
+// requested.
+func getAdminPayoutsHandler(c *gin.Context) {
+	status := c.DefaultQuery("status", "requested")
+	var payouts []CreatorPayout
+	query := db.Order("created_at").Limit(200)
+	if status != "all" {
+		query = query.Where("status = ?", status)
+	}
+	query.Find(&payouts)
+
+	type queued struct {
+		CreatorPayout
+		Username string         `json:"username"`
+		Balance  creatorBalance `json:"balance"`
+	}
+	now := time.Now()
+	out := make([]queued, len(payouts))
+	for i, p := range payouts {
+		var user User
+		db.Select("id", "username").First(&user, p.UserID)
+		out[i] = queued{CreatorPayout: p, Username: user.Username, Balance: loadCreatorBalance(db, p.UserID, p.ID, now)}
+	}
+	c.JSON(http.StatusOK, gin.H{"payouts": out, "gateway": creatorPayoutGateway != nil})
+}
+
+// approveCreatorPayoutHandler re-checks the balance and sends the payout.
+// Approving again after a gateway error retries with the same
+// idempotence key.
+func approveCreatorPayoutHandler(c *gin.Context) {
+	adminID, _ := getUserIDFromContext(c)
+	if !isBillingAdmin(adminID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Billing admin access required"})
+		return
+	}
+	var payout CreatorPayout
+	now := time.Now()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&payout, c.Param("id")).Error; err != nil {
+			return err
+		}
+		if payout.Status != "requested" && payout.Status != "approved" {
+			return fmt.Errorf("payout is %s", payout.Status)
+		}
+		if err := lockCreatorPayable(tx, payout.UserID); err != nil {
+			return err
+		}
+		if balance := loadCreatorBalance(tx, payout.UserID, payout.ID, now); payout.AmountKopecks > balance.AvailableKopecks {
+			return errPayoutOverBalance
+		}
+		payout.Status = "approved"
+		payout.ReviewedBy, payout.ReviewedAt = &adminID, &now
+		return tx.Model(&payout).Updates(map[string]interface{}{"status": payout.Status, "reviewed_by": adminID, "reviewed_at": now}).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payout not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	logExtendedAudit(adminID, "payout_approve", "creator_payout", strconv.FormatUint(uint64(payout.ID), 10), "admin",
+		fmt.Sprintf("%s to user %d", formatRub(payout.AmountKopecks), payout.UserID), c.ClientIP(), c.Request.UserAgent())
+
+	if creatorPayoutGateway == nil {
+		c.JSON(http.StatusOK, payout)
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+	result, err := creatorPayoutGateway.CreatePayout(ctx, &payout)
+	if err != nil {
+		log.Printf("[Payouts] Gateway error for payout %d: %v", payout.ID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Payout gateway error, approve again to retry", "payout": payout})
+		return
+	}
+	if err := applyPayoutResult(&payout, creatorPayoutGateway.Name(), result); err != nil {
+		log.Printf("[Payouts] Failed to record gateway result for payout %d: %v", payout.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record payout"})
+		return
+	}
+	c.JSON(http.StatusOK, payout)
+}
+
+func rejectCreatorPayoutHandler(c *gin.Context) {
+	adminID, _ := getUserIDFromContext(c)
+	if !isBillingAdmin(adminID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Billing admin access required"})
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	c.ShouldBindJSON(&req)
+
+	var payout CreatorPayout
+	if err := db.First(&payout, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payout not found"})
+		return
+	}
+	now := time.Now()
+	result := db.Model(&CreatorPayout{}).Where("id = ? AND status IN ?", payout.ID, []string{"requested", "approved"}).
+		Updates(map[string]interface{}{"status": "rejected", "failure_reason": req.Reason, "reviewed_by": adminID, "reviewed_at": now, "payout_token": ""})
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only requested or approved payouts can be rejected"})
+		return
+	}
+	logExtendedAudit(adminID, "payout_reject", "creator_payout", strconv.FormatUint(uint64(payout.ID), 10), "admin", req.Reason, c.ClientIP(), c.Request.UserAgent())
+	notifyCreatorPayout(&payout, "rejected", req.Reason)
+	db.First(&payout, payout.ID)
+	c.JSON(http.StatusOK, payout)
+}
+
+// markCreatorPayoutPaidHandler records an approved payout that was sent
+// outside the gateway.
+func markCreatorPayoutPaidHandler(c *gin.Context) {
+	adminID, _ := getUserIDFromContext(c)
+	if !isBillingAdmin(adminID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Billing admin access required"})
+		return
+	}
+	var req struct {
+		Reference string `json:"reference"`
+	}
+	c.ShouldBindJSON(&req)
+
+	var payout CreatorPayout
+	if err := db.First(&payout, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payout not found"})
+		return
+	}
+	if payout.Status != "approved" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only approved payouts can be marked paid"})
+		return
+	}
+	err := applyPayoutResult(&payout, "manual_transfer", &payoutGatewayResult{ID: req.Reference, Status: "succeeded"})
+	if err != nil {
+		log.Printf("[Payouts] Failed to mark payout %d paid: %v", payout.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record payout"})
+		return
+	}
+	logExtendedAudit(adminID, "payout_mark_paid", "creator_payout", strconv.FormatUint(uint64(payout.ID), 10), "admin", req.Reference, c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusOK, payout)
+}
+
+// applyPayoutResult moves a payout to the gateway's status. Paying posts
+// the ledger entry in the same transaction.
+func applyPayoutResult(payout *CreatorPayout, provider string, result *payoutGatewayResult) error {
+	var event string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(payout, payout.ID).Error; err != nil {
+			return err
+		}
+		if payout.Status == "paid" || payout.Status == "failed" {
+			return nil
+		}
+		updates := map[string]interface{}{"provider": provider}
+		if result.ID != "" {
+			updates["provider_payout_id"] = result.ID
+		}
+		switch result.Status {
+		case "succeeded":
+			now := time.Now()
+			updates["status"], updates["paid_at"], updates["payout_token"] = "paid", now, ""
+			event = "paid"
+		case "canceled":
+			updates["status"], updates["failure_reason"], updates["payout_token"] = "failed", result.Reason, ""
+			event = "failed"
+		default:
+			updates["status"] = "processing"
+		}
+		if err := tx.Model(payout).Updates(updates).Error; err != nil {
+			return err
+		}
+		if err := tx.First(payout, payout.ID).Error; err != nil {
+			return err
+		}
+		if event == "paid" {
+			return postCreatorPayoutLedger(tx, payout, *payout.PaidAt)
+		}
+		return nil
+	})
+	if err == nil && event != "" {
+		notifyCreatorPayout(payout, event, result.Reason)
+	}
+	return err
+}
+
+// syncProcessingPayouts polls the gateway for payouts it has not settled.
+func syncProcessingPayouts() {
+	if creatorPayoutGateway == nil {
+		return
+	}
+	var payouts []CreatorPayout
+	db.Where("status = ? AND provider_payout_id <> ''", "processing").Find(&payouts)
+	for i := range payouts {
+		p := &payouts[i]
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		result, err := creatorPayoutGateway.GetPayout(ctx, p.ProviderPayoutID)
+		cancel()
+		if err != nil {
+			log.Printf("[Payouts] Failed to check payout %d: %v", p.ID, err)
+			continue
+		}
+		if result.Status == "pending" {
+			continue
+		}
+		if err := applyPayoutResult(p, creatorPayoutGateway.Name(), result); err != nil {
+			log.Printf("[Payouts] Failed to settle payout %d: %v", p.ID, err)
+		}
+	}
+}
+
+func notifyCreatorPayout(p *CreatorPayout, event, reason string) {
+	switch event {
+	case "paid", "failed", "rejected":
+	default:
+		return
+	}
+	go notifyBilling(p.UserID, "payout_"+event, map[string]interface{}{
+		"Amount": p.AmountKopecks, "Destination": p.Destination, "Reason": reason,
+	}, fmt.Sprintf("payout_%s:%d", event, p.ID))
+}
+
+// donationRefundRetryWindow is how long a refund in an unknown state is
+// retried under its idempotency key; the providers keep keys for a day.
+const donationRefundRetryWindow = 23 * time.Hour
+
+// donationRefundKey is the same for every attempt at refunding d, so a
+// retry after an unclear failure cannot refund it twice.
+func donationRefundKey(d *CreatorDonation) string {
+	return fmt.Sprintf("refund-donation-%d-%d", d.ID, rubToKopecks(d.AmountRub))
+}
+
+func sendDonationRefund(ctx context.Context, provider paymentProvider, d *CreatorDonation) error {
+	return provider.Refund(ctx, &refundRequest{
+		PaymentID: d.PaymentID, Amount: rubToKopecks(d.AmountRub), Currency: "RUB", Reason: d.RefundReason,
+		Key: donationRefundKey(d),
+	})
+}
+
+// finishDonationRefund records a refund the provider has made.
+func finishDonationRefund(d *CreatorDonation, now time.Time) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(d).Where("status = ?", "refunding").Updates(map[string]interface{}{"status": "refunded", "refunded_at": now})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("donation %d is no longer being refunded", d.ID)
+		}
+		return postDonationRefundLedger(tx, d, now)
+	})
+	if err != nil {
+		return err
+	}
+	if d.FromUserID != nil {
+		go notifyBilling(*d.FromUserID, "refund_issued", map[string]interface{}{
+			"Amount": rubToKopecks(d.AmountRub), "Description": "Донат автору", "Reason": d.RefundReason,
+		}, fmt.Sprintf("refund_issued:donation:%d", d.ID))
+	}
+	return nil
+}
+
+// releaseDonationRefund puts back a donation whose refund was declined.
+func releaseDonationRefund(d *CreatorDonation) {
+	db.Model(&CreatorDonation{}).Where("id = ? AND status = ?", d.ID, "refunding").
+		Updates(map[string]interface{}{"status": "succeeded", "refund_reason": "", "refund_started_at": nil})
+}
+
+// refundCreatorDonationHandler returns a donation to the donor. Donations
+// still on hold are refunded out of money the creator cannot withdraw yet.
+func refundCreatorDonationHandler(c *gin.Context) {
+	adminID, _ := getUserIDFromContext(c)
+	if !isBillingAdmin(adminID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Billing admin access required"})
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	c.ShouldBindJSON(&req)
+
+	var donation CreatorDonation
+	if err := db.First(&donation, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Donation not found"})
+		return
+	}
+	if donation.Status != "succeeded" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Can only refund successful donations"})
+		return
+	}
+	provider := paymentProviderByName("yookassa")
+	if provider == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Payment provider is not configured"})
+		return
+	}
+	if donation.PaymentID == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Donation has no provider payment to refund"})
+		return
+	}
+
+	// The donation is claimed before the provider is called, so a second
+	// refund request running at the same time finds it taken.
+	now := time.Now()
+	claim := db.Model(&CreatorDonation{}).Where("id = ? AND status = ?", donation.ID, "succeeded").
+		Updates(map[string]interface{}{"status": "refunding", "refund_reason": req.Reason, "refund_started_at": now})
+	if claim.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start refund"})
+		return
+	}
+	if claim.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Donation is already being refunded"})
+		return
+	}
+	donation.Status, donation.RefundReason, donation.RefundStartedAt = "refunding", req.Reason, &now
+	logExtendedAudit(adminID, "donation_refund", "creator_donation", strconv.FormatUint(uint64(donation.ID), 10), "admin", req.Reason, c.ClientIP(), c.Request.UserAgent())
+
+	if err := sendDonationRefund(c.Request.Context(), provider, &donation); err != nil {
+		log.Printf("[Payouts] Refund API error for donation %d: %v", donation.ID, err)
+		if errors.Is(err, errRefundDeclined) {
+			releaseDonationRefund(&donation)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Refund failed at the payment provider"})
+			return
+		}
+		// The refund may have gone through; it stays "refunding" and
+		// reconcileDonationRefunds retries it under the same key.
+		c.JSON(http.StatusAccepted, gin.H{"status": "refunding"})
+		return
+	}
+
+	if err := finishDonationRefund(&donation, time.Now()); err != nil {
+		// The money is already returned; the donation stays "refunding",
+		// held out of payouts, until the reconciliation records it.
+		log.Printf("[Payouts] Failed to record refund of donation %d: %v", donation.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record refund"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "refunded"})
+}
+
+// reconcileDonationRefunds settles refunds left "refunding" by a timeout or
+// a failed write. Resending under the same key returns the first result,
+// so within the providers' key window this is safe; older ones need a
+// person.
+func reconcileDonationRefunds(now time.Time) {
+	provider := paymentProviderByName("yookassa")
+	var stuck []CreatorDonation
+	db.Where("status = ? AND (refund_started_at IS NULL OR refund_started_at <= ?)", "refunding", now.Add(-5*time.Minute)).
+		Find(&stuck)
+	for i := range stuck {
+		d := &stuck[i]
+		if provider == nil || d.RefundStartedAt == nil || now.Sub(*d.RefundStartedAt) > donationRefundRetryWindow {
+			log.Printf("[Payouts] ALERT: refund of donation %d is unresolved and must be checked by hand", d.ID)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := sendDonationRefund(ctx, provider, d)
+		cancel()
+		switch {
+		case errors.Is(err, errRefundDeclined):
+			log.Printf("[Payouts] Refund of donation %d declined: %v", d.ID, err)
+			releaseDonationRefund(d)
+		case err != nil:
+			log.Printf("[Payouts] Refund of donation %d still unresolved: %v", d.ID, err)
+		default:
+			if err := finishDonationRefund(d, now); err != nil {
+				log.Printf("[Payouts] Failed to record refund of donation %d: %v", d.ID, err)
+			}
+		}
+	}
+}
+
+// yookassaPayouts calls the YooKassa payouts API with the payout agent's
+// credentials, which are separate from the shop's.
+type yookassaPayouts struct {
+	AgentID     string
+	SecretKey   string
+	APIEndpoint string
+}
+
+type yookassaPayoutResponse struct {
+	ID                  string `json:"id"`
+	Status              string `json:"status"`
+	CancellationDetails struct {
+		Party  string `json:"party"`
+		Reason string `json:"reason"`
+	} `json:"cancellation_details"`
+}
+
+func (y *yookassaPayouts) Name() string { return "yookassa" }
+
+func (y *yookassaPayouts) CreatePayout(ctx context.Context, p *CreatorPayout) (*payoutGatewayResult, error) {
+	body := map[string]interface{}{
+		"amount":      map[string]string{"value": fmt.Sprintf("%d.%02d", p.AmountKopecks/100, p.AmountKopecks%100), "currency": ledgerCurrency(p.Currency)},
+		"description": fmt.Sprintf("Выплата автору №%d", p.ID),
+		"metadata":    map[string]string{"payout_id": strconv.FormatUint(uint64(p.ID), 10)},
+	}
+	if p.DestinationType == "yoo_money" {
+		body["payout_destination_data"] = map[string]string{"type": "yoo_money", "account_number": p.AccountNumber}
+	} else {
+		body["payout_token"] = p.PayoutToken
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, y.APIEndpoint+"/payouts", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Idempotence-Key", fmt.Sprintf("creator-payout-%d", p.ID))
+	return y.do(req)
+}
+
+func (y *yookassaPayouts) GetPayout(ctx context.Context, id string) (*payoutGatewayResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, y.APIEndpoint+"/payouts/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	return y.do(req)
+}
+
+func (y *yookassaPayouts) do(req *http.Request) (*payoutGatewayResult, error) {
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(y.AgentID+":"+y.SecretKey)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request error: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("yookassa payout error %d: %s", resp.StatusCode, string(body))
+	}
+	var payout yookassaPayoutResponse
+	if err := json.Unmarshal(body, &payout); err != nil {
+		return nil, err
+	}
+	reason := payout.CancellationDetails.Reason
+	return &payoutGatewayResult{ID: payout.ID, Status: payout.Status, Reason: reason}, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCreatorPlatformFee(t *testing.T) {
+	for _, tc := range []struct {
+		amount  int64
+		percent float64
+		want    int64
+	}{
+		{10000, 10, 1000},
+		{1005, 10, 101}, // 100.5 rounds half up
+		{1004, 10, 100},
+		{10000, 0, 0},
+		{0, 10, 0},
+		{33333, 7.5, 2500},
+	} {
+		if got := creatorPlatformFee(tc.amount, tc.percent); got != tc.want {
+			t.Errorf("creatorPlatformFee(%d, %v) = %d, want %d", tc.amount, tc.percent, got, tc.want)
+		}
+	}
+}
+
+func TestCreatorBalanceSettle(t *testing.T) {
+	b := creatorBalance{BalanceKopecks: 100000, HeldKopecks: 30000, InFlightKopecks: 50000}
+	b.settle()
+	if b.AvailableKopecks != 20000 {
+		t.Errorf("available = %d", b.AvailableKopecks)
+	}
+	// A refund after a payout can leave the balance below what is held
+	b = creatorBalance{BalanceKopecks: 10000, HeldKopecks: 30000}
+	b.settle()
+	if b.AvailableKopecks != 0 {
+		t.Errorf("available = %d, want 0", b.AvailableKopecks)
+	}
+}
+
+func TestYooKassaPayoutsCreate(t *testing.T) {
+	var got map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "agent" || pass != "secret" {
+			t.Errorf("basic auth = %q %q", user, pass)
+		}
+		if key := r.Header.Get("Idempotence-Key"); key != "creator-payout-7" {
+			t.Errorf("idempotence key = %q", key)
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Write([]byte(`{"id":"po-1","status":"canceled","cancellation_details":{"party":"yoo_money","reason":"one_time_limit_exceeded"}}`))
+	}))
+	defer srv.Close()
+
+	gw := &yookassaPayouts{AgentID: "agent", SecretKey: "secret", APIEndpoint: srv.URL}
+	result, err := gw.CreatePayout(context.Background(), &CreatorPayout{
+		ID: 7, AmountKopecks: 123405, Currency: "RUB", DestinationType: "yoo_money", AccountNumber: "4100116075156746",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ID != "po-1" || result.Status != "canceled" || result.Reason != "one_time_limit_exceeded" {
+		t.Errorf("result = %+v", result)
+	}
+	amount := got["amount"].(map[string]interface{})
+	if amount["value"] != "1234.05" || amount["currency"] != "RUB" {
+		t.Errorf("amount = %v", amount)
+	}
+	dest, _ := got["payout_destination_data"].(map[string]interface{})
+	if dest["type"] != "yoo_money" || dest["account_number"] != "4100116075156746" || got["payout_token"] != nil {
+		t.Errorf("destination = %v, token = %v", dest, got["payout_token"])
+	}
+}
+
+func TestDeclinedRefund(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		declined bool
+	}{
+		{&paymentAPIError{Provider: "yookassa", StatusCode: http.StatusBadRequest}, true},
+		{&paymentAPIError{Provider: "stripe", StatusCode: http.StatusNotFound}, true},
+		{&paymentAPIError{Provider: "stripe", StatusCode: http.StatusConflict}, false},
+		{&paymentAPIError{Provider: "stripe", StatusCode: http.StatusTooManyRequests}, false},
+		{&paymentAPIError{Provider: "yookassa", StatusCode: http.StatusInternalServerError}, false},
+		{context.DeadlineExceeded, false},
+	} {
+		if got := errors.Is(declinedRefund(tc.err), errRefundDeclined); got != tc.declined {
+			t.Errorf("%v: declined = %t", tc.err, got)
+		}
+	}
+}
+
+// A refund whose outcome is unknown stays "refunding" and is resent under
+// the same key; one that can't be sent or is declined leaves the donation
+// as it was.
+func TestRefundCreatorDonation(t *testing.T) {
+	testDB(t, &User{}, &CreatorDonation{}, &LedgerAccount{}, &LedgerEntry{}, &LedgerLine{}, &ExtendedAuditLog{},
+		&BillingNotificationLog{}, &UserSettings{}, &TelegramNotification{})
+	saved := paymentProviders
+	t.Cleanup(func() { paymentProviders = saved })
+	stub := &stubPaymentProvider{payments: map[string]*providerPayment{}}
+
+	admin := User{Username: "admin", Password: "x", Role: "admin"}
+	db.Create(&admin)
+	donate := func(paymentID string) CreatorDonation {
+		d := CreatorDonation{ToUserID: 7, AmountRub: 500, Status: "succeeded", PaymentID: paymentID, PlatformFeeKopecks: 5000}
+		db.Create(&d)
+		return d
+	}
+	refund := func(d CreatorDonation) (int, string) {
+		c, w := testContext(http.MethodPost, "/", strings.NewReader(`{"reason":"duplicate"}`), admin.ID)
+		c.Params = gin.Params{{Key: "id", Value: strconv.FormatUint(uint64(d.ID), 10)}}
+		refundCreatorDonationHandler(c)
+		var fresh CreatorDonation
+		db.First(&fresh, d.ID)
+		return w.Code, fresh.Status
+	}
+
+	paymentProviders = map[string]paymentProvider{}
+	if code, status := refund(donate("pay_1")); code != http.StatusServiceUnavailable || status != "succeeded" {
+		t.Errorf("without a provider: %d, %s", code, status)
+	}
+	paymentProviders = map[string]paymentProvider{"yookassa": stub}
+	if code, status := refund(donate("")); code != http.StatusConflict || status != "succeeded" {
+		t.Errorf("without a payment: %d, %s", code, status)
+	}
+
+	stub.refundErr = declinedRefund(&paymentAPIError{Provider: "yookassa", StatusCode: http.StatusBadRequest})
+	if code, status := refund(donate("pay_2")); code != http.StatusBadGateway || status != "succeeded" {
+		t.Errorf("declined: %d, %s", code, status)
+	}
+
+	stub.refundErr = &paymentAPIError{Provider: "yookassa", StatusCode: http.StatusBadGateway}
+	unclear := donate("pay_3")
+	if code, status := refund(unclear); code != http.StatusAccepted || status != "refunding" {
+		t.Fatalf("unclear outcome: %d, %s", code, status)
+	}
+	reconcileDonationRefunds(time.Now()) // too recent to retry
+	stub.refundErr = nil
+	reconcileDonationRefunds(time.Now().Add(10 * time.Minute))
+	var fresh CreatorDonation
+	db.First(&fresh, unclear.ID)
+	if fresh.Status != "refunded" || fresh.RefundedAt == nil {
+		t.Errorf("reconciled donation = %+v", fresh)
+	}
+	var entries int64
+	db.Model(&LedgerEntry{}).Where("idempotency_key = ?", fmt.Sprintf("creator_donation:%d:refund", unclear.ID)).Count(&entries)
+	if entries != 1 {
+		t.Errorf("%d refund ledger entries", entries)
+	}
+
+	want := fmt.Sprintf("refund-donation-%d-50000", unclear.ID)
+	var sent []refundRequest
+	for _, r := range stub.refunds {
+		if r.PaymentID == "pay_3" {
+			sent = append(sent, r)
+		}
+	}
+	if len(sent) != 2 || sent[0].Key != want || sent[1] != sent[0] || sent[0].Reason != "duplicate" {
+		t.Errorf("refunds sent for the unclear donation: %+v, want two with key %s", sent, want)
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// promoProducts are the purchases a promo code can discount. Codes created
+// before campaigns have no products and apply to premium only.
+var promoProducts = []string{"premium", "org_plan", "seats", "boost", "gift"}
+
+var promoDiscountTypes = []string{"percent", "fixed", "free_months"}
+
+var (
+	errPromoNotFound      = errors.New("Invalid promo code")
+	errPromoExpired       = errors.New("Promo code expired")
+	errPromoExhausted     = errors.New("Promo code usage limit reached")
+	errPromoAlreadyUsed   = errors.New("Promo code already used")
+	errPromoNotApplicable = errors.New("Promo code does not apply to this purchase")
+	errPromoFirstPurchase = errors.New("Promo code is only valid on a first purchase")
+	errPromoMinPurchase   = errors.New("Minimum purchase not met")
+	errPromoCurrency      = errors.New("Promo code is only valid for ruble payments")
+)
+
+// promoPurchase is what a code is being applied to. Org subscriptions are
+// "org_plan" purchases; a code for either org_plan or seats fits them.
+type promoPurchase struct {
+	Product       string
+	UserID        uint // 0 skips the per-buyer checks
+	OrgID         int
+	PremiumPlanID uint
+	OrgPlanSlug   string
+	AmountKopecks int64  // in Currency's minor units
+	Currency      string // empty for rubles
+	Months        int    // the period the amount pays for; 0 for one-off purchases
+}
+
+func (p *PromoCode) productList() []string {
+	if strings.TrimSpace(p.Products) == "" {
+		return []string{"premium"}
+	}
+	var products []string
+	for _, product := range strings.Split(p.Products, ",") {
+		if product = strings.TrimSpace(product); product != "" {
+			products = append(products, product)
+		}
+	}
+	return products
+}
+
+func (p *PromoCode) appliesTo(pp promoPurchase) bool {
+	products := p.productList()
+	switch {
+	case pp.Product == "org_plan":
+		if !slices.Contains(products, "org_plan") && !slices.Contains(products, "seats") {
+			return false
+		}
+	case !slices.Contains(products, pp.Product):
+		return false
+	}
+	if pp.Product == "boost" {
+		return true
+	}
+	if pp.Product == "org_plan" {
+		var slugs []string
+		if json.Unmarshal([]byte(p.OrgPlans), &slugs) != nil || len(slugs) == 0 {
+			return true
+		}
+		return slices.Contains(slugs, pp.OrgPlanSlug)
+	}
+	var planIDs []uint
+	if json.Unmarshal([]byte(p.ApplicablePlans), &planIDs) != nil || len(planIDs) == 0 {
+		return true
+	}
+	return slices.Contains(planIDs, pp.PremiumPlanID)
+}
+
+// promoDiscount is the discount on amount. Free months cover that many
+// months of a period of the given length, and do not apply to one-off
+// purchases.
+func promoDiscount(p *PromoCode, amount int64, months int) int64 {
+	var discount int64
+	switch p.DiscountType {
+	case "percent":
+		discount = int64(math.Round(float64(amount) * p.DiscountValue / 100))
+	case "fixed":
+		discount = rubToKopecks(p.DiscountValue)
+	case "free_months":
+		if months <= 0 {
+			return 0
+		}
+		free := min(int(p.DiscountValue), months)
+		discount = int64(math.Round(float64(amount) * float64(free) / float64(months)))
+	}
+	return max(0, min(discount, amount))
+}
+
+// findPromoCode looks up a code that is active and not used up.
+func findPromoCode(code string) (*PromoCode, error) {
+	var promo PromoCode
+	if code == "" || db.Where("code = ? AND is_active = ?", code, true).First(&promo).RowsAffected == 0 {
+		return nil, errPromoNotFound
+	}
+	now := time.Now()
+	if now.Before(promo.ValidFrom) || now.After(promo.ValidUntil) {
+		return nil, errPromoExpired
+	}
+	if promo.MaxUses > 0 && promo.UsedCount >= promo.MaxUses {
+		return nil, errPromoExhausted
+	}
+	return &promo, nil
+}
+
+// checkPromoCode applies the campaign's targeting and limits to a purchase
+// and returns the discount.
+func checkPromoCode(promo *PromoCode, pp promoPurchase) (int64, error) {
+	if !promo.appliesTo(pp) || (promo.DiscountType == "free_months" && pp.Months == 0) {
+		return 0, errPromoNotApplicable
+	}
+	// Fixed discounts and minimums are set in rubles
+	if ledgerCurrency(pp.Currency) != "RUB" {
+		if promo.DiscountType == "fixed" {
+			return 0, errPromoCurrency
+		}
+	} else if pp.AmountKopecks < rubToKopecks(promo.MinPurchase) {
+		return 0, errPromoMinPurchase
+	}
+	if pp.Product == "org_plan" && pp.OrgID != 0 {
+		var used int64
+		db.Model(&PromoCodeUsage{}).Where("promo_code_id = ? AND org_id = ?", promo.ID, pp.OrgID).Count(&used)
+		if used >= int64(max(promo.MaxUsesPerUser, 1)) {
+			return 0, errPromoAlreadyUsed
+		}
+		if promo.FirstPurchaseOnly {
+			var subs int64
+			db.Model(&OrgSubscription{}).Where("org_id = ?", pp.OrgID).Count(&subs)
+			if subs > 0 {
+				return 0, errPromoFirstPurchase
+			}
+		}
+	} else if pp.UserID != 0 {
+		var used int64
+		db.Model(&PromoCodeUsage{}).Where("promo_code_id = ? AND user_id = ? AND org_id IS NULL", promo.ID, pp.UserID).Count(&used)
+		if used >= int64(max(promo.MaxUsesPerUser, 1)) {
+			return 0, errPromoAlreadyUsed
+		}
+		if promo.FirstPurchaseOnly {
+			var paid int64
+			db.Model(&PremiumTransaction{}).Where("user_id = ? AND status IN ?", pp.UserID, []string{"succeeded", "refunded"}).Count(&paid)
+			if paid > 0 {
+				return 0, errPromoFirstPurchase
+			}
+		}
+	}
+	return promoDiscount(promo, pp.AmountKopecks, pp.Months), nil
+}
+
+// applyPromoCode finds code and prices it against a purchase.
+func applyPromoCode(code string, pp promoPurchase) (*PromoCode, int64, error) {
+	promo, err := findPromoCode(code)
+	if err != nil {
+		return nil, 0, err
+	}
+	discount, err := checkPromoCode(promo, pp)
+	if err != nil {
+		return nil, 0, err
+	}
+	return promo, discount, nil
+}
+
+// redeemPromoCode records a use of promo. The promo row stays locked while
+// the global and the per-user or per-org limits are checked again and the
+// use is counted, so concurrent checkouts cannot overshoot either.
+func redeemPromoCode(tx *gorm.DB, promo *PromoCode, usage *PromoCodeUsage) error {
+	return tx.Transaction(func(tx *gorm.DB) error {
+		var locked PromoCode
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&locked, promo.ID).Error; err != nil {
+			return err
+		}
+		if locked.MaxUses > 0 && locked.UsedCount >= locked.MaxUses {
+			return errPromoExhausted
+		}
+		used := tx.Model(&PromoCodeUsage{}).Where("promo_code_id = ?", promo.ID)
+		if usage.OrgID != nil {
+			used = used.Where("org_id = ?", *usage.OrgID)
+		} else {
+			used = used.Where("user_id = ? AND org_id IS NULL", usage.UserID)
+		}
+		var count int64
+		if err := used.Count(&count).Error; err != nil {
+			return err
+		}
+		if count >= int64(max(locked.MaxUsesPerUser, 1)) {
+			return errPromoAlreadyUsed
+		}
+		if err := tx.Model(&locked).Update("used_count", gorm.Expr("used_count + 1")).Error; err != nil {
+			return err
+		}
+		usage.PromoCodeID = promo.ID
+		return tx.Create(usage).Error
+	})
+}
+
+// promoAllowsReferralBonus reports whether a purchase made with the given
+// code may also earn the buyer's referrer a bonus.
+func promoAllowsReferralBonus(promoCodeID *uint) bool {
+	if promoCodeID == nil {
+		return true
+	}
+	var promo PromoCode
+	if db.Select("id", "excludes_referral").First(&promo, *promoCodeID).Error != nil {
+		return true
+	}
+	return !promo.ExcludesReferral
+}
+
+// pendingOrgPromo is a code redeemed by the org that no invoice has used yet.
+func pendingOrgPromo(orgID int) (*PromoCodeUsage, *PromoCode) {
+	var usage PromoCodeUsage
+	if db.Where("org_id = ? AND invoice_id IS NULL", orgID).Order("id").Limit(1).Find(&usage); usage.ID == 0 {
+		return nil, nil
+	}
+	var promo PromoCode
+	if db.First(&promo, usage.PromoCodeID).Error != nil {
+		return nil, nil
+	}
+	return &usage, &promo
+}
+
+// orgPromoLine is the discount line for the plan and seat lines the code
+// targets. Free months count against the invoice's period only.
+func orgPromoLine(promo *PromoCode, lines []InvoiceLine, months int) (InvoiceLine, bool) {
+	products := promo.productList()
+	var eligible int64
+	for _, l := range lines {
+		if (l.Kind == "plan" && slices.Contains(products, "org_plan")) || (l.Kind == "seat" && slices.Contains(products, "seats")) {
+			eligible += int64(math.Round(float64(l.UnitPriceKopecks) * l.Quantity))
+		}
+	}
+	discount := promoDiscount(promo, eligible, months)
+	if discount == 0 {
+		return InvoiceLine{}, false
+	}
+	return InvoiceLine{
+		Kind:             "discount",
+		Description:      fmt.Sprintf("Скидка по промокоду %s", promo.Code),
+		Quantity:         1,
+		Unit:             "шт.",
+		UnitPriceKopecks: -discount,
+		AmountKopecks:    -discount,
+	}, true
+}
+
+// promoReport sums up the uses of a code or a campaign. Only paid
+// purchases count towards revenue and discount given, which are kept per
+// currency in its minor units.
+type promoReport struct {
+	Campaign    string                        `json:"campaign,omitempty"`
+	Codes       []string                      `json:"codes"`
+	Redemptions int                           `json:"redemptions"`
+	Paid        int                           `json:"paid"`
+	Buyers      int                           `json:"buyers"`
+	Revenue     map[string]int64              `json:"revenue"`
+	Discount    map[string]int64              `json:"discount"`
+	ByProduct   map[string]*promoReportTotals `json:"by_product"`
+
+	buyers map[string]bool
+}
+
+type promoReportTotals struct {
+	Redemptions int              `json:"redemptions"`
+	Paid        int              `json:"paid"`
+	Revenue     map[string]int64 `json:"revenue"`
+	Discount    map[string]int64 `json:"discount"`
+}
+
+func (r *promoReport) add(u PromoCodeUsage, paid bool) {
+	if r.ByProduct == nil {
+		r.ByProduct, r.buyers = map[string]*promoReportTotals{}, map[string]bool{}
+	}
+	if r.Revenue == nil {
+		r.Revenue, r.Discount = map[string]int64{}, map[string]int64{}
+	}
+	product := u.Product
+	if product == "" {
+		product = "premium"
+	}
+	totals := r.ByProduct[product]
+	if totals == nil {
+		totals = &promoReportTotals{Revenue: map[string]int64{}, Discount: map[string]int64{}}
+		r.ByProduct[product] = totals
+	}
+	r.Redemptions++
+	totals.Redemptions++
+	buyer := "user:" + strconv.FormatUint(uint64(u.UserID), 10)
+	if u.OrgID != nil {
+		buyer = "org:" + strconv.Itoa(*u.OrgID)
+	}
+	r.buyers[buyer] = true
+	r.Buyers = len(r.buyers)
+	if !paid {
+		return
+	}
+	currency := ledgerCurrency(u.Currency)
+	revenue, discount := rubToKopecks(u.AmountRub), rubToKopecks(u.DiscountRub)
+	r.Paid++
+	r.Revenue[currency] += revenue
+	r.Discount[currency] += discount
+	totals.Paid++
+	totals.Revenue[currency] += revenue
+	totals.Discount[currency] += discount
+}
+
+// buildPromoReport reports on the uses of the given codes.
+func buildPromoReport(promos []PromoCode) *promoReport {
+	report := &promoReport{
+		Codes:     []string{},
+		Revenue:   map[string]int64{},
+		Discount:  map[string]int64{},
+		ByProduct: map[string]*promoReportTotals{},
+		buyers:    map[string]bool{},
+	}
+	if len(promos) == 0 {
+		return report
+	}
+	ids := make([]uint, 0, len(promos))
+	for _, p := range promos {
+		ids = append(ids, p.ID)
+		report.Codes = append(report.Codes, p.Code)
+	}
+	sort.Strings(report.Codes)
+
+	var usages []PromoCodeUsage
+	db.Where("promo_code_id IN ?", ids).Find(&usages)
+	var transactionIDs, invoiceIDs []uint
+	for _, u := range usages {
+		if u.InvoiceID != nil {
+			invoiceIDs = append(invoiceIDs, *u.InvoiceID)
+		} else if u.TransactionID != 0 {
+			transactionIDs = append(transactionIDs, u.TransactionID)
+		}
+	}
+	paidTransactions, paidInvoices := map[uint]bool{}, map[uint]bool{}
+	if len(transactionIDs) > 0 {
+		var paid []uint
+		db.Model(&PremiumTransaction{}).Where("id IN ? AND status = ?", transactionIDs, "succeeded").Pluck("id", &paid)
+		for _, id := range paid {
+			paidTransactions[id] = true
+		}
+	}
+	if len(invoiceIDs) > 0 {
+		var paid []uint
+		db.Model(&Invoice{}).Where("id IN ? AND status = ?", invoiceIDs, "paid").Pluck("id", &paid)
+		for _, id := range paid {
+			paidInvoices[id] = true
+		}
+	}
+	for _, u := range usages {
+		paid := paidTransactions[u.TransactionID]
+		if u.InvoiceID != nil {
+			paid = paidInvoices[*u.InvoiceID]
+		}
+		report.add(u, paid)
+	}
+	return report
+}
+
+// getPromoCodeReportHandler reports on one code.
+func getPromoCodeReportHandler(c *gin.Context) {
+	uid, _ := getUserIDFromContext(c)
+	if !isBillingAdmin(uid) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Billing admin access required"})
+		return
+	}
+	var promo PromoCode
+	if err := db.First(&promo, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Promo code not found"})
+		return
+	}
+	report := buildPromoReport([]PromoCode{promo})
+	report.Campaign = promo.Campaign
+	c.JSON(http.StatusOK, gin.H{"promo_code": promo, "report": report})
+}
+
+// getPromoCampaignReportHandler reports on every code of a campaign, or on
+// each campaign when none is given.
+func getPromoCampaignReportHandler(c *gin.Context) {
+	uid, _ := getUserIDFromContext(c)
+	if !isBillingAdmin(uid) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Billing admin access required"})
+		return
+	}
+	if campaign := c.Query("campaign"); campaign != "" {
+		var promos []PromoCode
+		db.Where("campaign = ?", campaign).Find(&promos)
+		if len(promos) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Campaign not found"})
+			return
+		}
+		report := buildPromoReport(promos)
+		report.Campaign = campaign
+		c.JSON(http.StatusOK, report)
+		return
+	}
+
+	var promos []PromoCode
+	db.Order("campaign, code").Find(&promos)
+	byCampaign := map[string][]PromoCode{}
+	for _, p := range promos {
+		byCampaign[p.Campaign] = append(byCampaign[p.Campaign], p)
+	}
+	reports := make([]*promoReport, 0, len(byCampaign))
+	for campaign, codes := range byCampaign {
+		report := buildPromoReport(codes)
+		report.Campaign = campaign
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Campaign < reports[j].Campaign })
+	c.JSON(http.StatusOK, gin.H{"campaigns": reports})
+}
+
+// releasePromoCode gives back the code used by a checkout that never
+// reached the payment provider.
+func releasePromoCode(transactionID uint) {
+	var usage PromoCodeUsage
+	if db.Where("transaction_id = ? AND invoice_id IS NULL", transactionID).Limit(1).Find(&usage); usage.ID == 0 {
+		return
+	}
+	db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&usage).Error; err != nil {
+			return err
+		}
+		return tx.Model(&PromoCode{}).Where("id = ? AND used_count > 0", usage.PromoCodeID).
+			Update("used_count", gorm.Expr("used_count - 1")).Error
+	})
+}
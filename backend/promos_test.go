@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPromoDiscount(t *testing.T) {
+	for _, tc := range []struct {
+		promo  PromoCode
+		amount int64
+		months int
+		want   int64
+	}{
+		{PromoCode{DiscountType: "percent", DiscountValue: 15}, 29900, 1, 4485},
+		{PromoCode{DiscountType: "percent", DiscountValue: 100}, 29900, 1, 29900},
+		{PromoCode{DiscountType: "fixed", DiscountValue: 100}, 29900, 1, 10000},
+		{PromoCode{DiscountType: "fixed", DiscountValue: 500}, 29900, 1, 29900}, // capped at the price
+		{PromoCode{DiscountType: "free_months", DiscountValue: 2}, 299000, 12, 49833},
+		{PromoCode{DiscountType: "free_months", DiscountValue: 3}, 29900, 1, 29900},
+		{PromoCode{DiscountType: "free_months", DiscountValue: 1}, 9900, 0, 0}, // one-off purchase
+	} {
+		if got := promoDiscount(&tc.promo, tc.amount, tc.months); got != tc.want {
+			t.Errorf("%s %v on %d over %d months = %d, want %d", tc.promo.DiscountType, tc.promo.DiscountValue, tc.amount, tc.months, got, tc.want)
+		}
+	}
+}
+
+func TestPromoAppliesTo(t *testing.T) {
+	legacy := &PromoCode{ApplicablePlans: "[2, 3]"}
+	if !legacy.appliesTo(promoPurchase{Product: "premium", PremiumPlanID: 3}) {
+		t.Error("legacy code does not apply to a listed premium plan")
+	}
+	if legacy.appliesTo(promoPurchase{Product: "premium", PremiumPlanID: 1}) {
+		t.Error("legacy code applies to an unlisted plan")
+	}
+	if legacy.appliesTo(promoPurchase{Product: "boost"}) {
+		t.Error("legacy code applies to boosts")
+	}
+
+	seats := &PromoCode{Products: "seats, boost", OrgPlans: `["pro"]`}
+	if !seats.appliesTo(promoPurchase{Product: "org_plan", OrgPlanSlug: "pro"}) {
+		t.Error("seat code does not apply to an org subscription")
+	}
+	if seats.appliesTo(promoPurchase{Product: "org_plan", OrgPlanSlug: "school"}) {
+		t.Error("seat code applies to an unlisted org plan")
+	}
+	if !seats.appliesTo(promoPurchase{Product: "boost"}) || seats.appliesTo(promoPurchase{Product: "gift"}) {
+		t.Error("products not respected")
+	}
+}
+
+func TestOrgPromoLine(t *testing.T) {
+	lines := []InvoiceLine{
+		{Kind: "plan", Quantity: 3, UnitPriceKopecks: 100000},
+		{Kind: "seat", Quantity: 30, UnitPriceKopecks: 3500},
+		{Kind: "overage", Quantity: 1, UnitPriceKopecks: 5000},
+	}
+	line, ok := orgPromoLine(&PromoCode{Code: "SEATS50", Products: "seats", DiscountType: "percent", DiscountValue: 50}, lines, 3)
+	if !ok || line.Kind != "discount" || line.AmountKopecks != -52500 {
+		t.Errorf("seat discount = %+v", line)
+	}
+	line, ok = orgPromoLine(&PromoCode{Products: "org_plan", DiscountType: "free_months", DiscountValue: 1}, lines, 3)
+	if !ok || line.AmountKopecks != -100000 {
+		t.Errorf("free month = %+v", line)
+	}
+	if _, ok := orgPromoLine(&PromoCode{Products: "gift", DiscountType: "percent", DiscountValue: 10}, lines, 3); ok {
+		t.Error("discounted lines the code does not target")
+	}
+}
+
+func TestPromoReportAdd(t *testing.T) {
+	var r promoReport
+	org := 5
+	r.add(PromoCodeUsage{UserID: 1, Product: "premium", AmountRub: 254.15, DiscountRub: 44.85}, true)
+	r.add(PromoCodeUsage{UserID: 1, Product: "gift", AmountRub: 254.15, DiscountRub: 44.85}, false)
+	r.add(PromoCodeUsage{UserID: 2, OrgID: &org, Product: "org_plan", AmountRub: 1000, DiscountRub: 500}, true)
+	if r.Redemptions != 3 || r.Paid != 2 || r.Buyers != 2 {
+		t.Errorf("counts = %d redemptions, %d paid, %d buyers", r.Redemptions, r.Paid, r.Buyers)
+	}
+	if r.Revenue["RUB"] != 125415 || r.Discount["RUB"] != 54485 {
+		t.Errorf("revenue %v, discount %v", r.Revenue, r.Discount)
+	}
+	if gift := r.ByProduct["gift"]; gift == nil || gift.Redemptions != 1 || gift.Paid != 0 {
+		t.Errorf("gift totals = %+v", gift)
+	}
+}
+
+// Dollar and euro purchases must not be summed into rubles.
+func TestPromoReportAddCurrencies(t *testing.T) {
+	var r promoReport
+	r.add(PromoCodeUsage{UserID: 1, Product: "premium", AmountRub: 299, DiscountRub: 50}, true)
+	r.add(PromoCodeUsage{UserID: 2, Product: "premium", Currency: "USD", AmountRub: 4.49, DiscountRub: 0.5}, true)
+	r.add(PromoCodeUsage{UserID: 3, Product: "premium", Currency: "eur", AmountRub: 3.99, DiscountRub: 1}, true)
+	r.add(PromoCodeUsage{UserID: 4, Product: "premium", Currency: "USD", AmountRub: 4.49, DiscountRub: 0.5}, false)
+
+	want := map[string][2]int64{"RUB": {29900, 5000}, "USD": {449, 50}, "EUR": {399, 100}}
+	premium := r.ByProduct["premium"]
+	for currency, w := range want {
+		if r.Revenue[currency] != w[0] || r.Discount[currency] != w[1] {
+			t.Errorf("%s: revenue %d, discount %d; want %v", currency, r.Revenue[currency], r.Discount[currency], w)
+		}
+		if premium.Revenue[currency] != w[0] || premium.Discount[currency] != w[1] {
+			t.Errorf("premium %s: revenue %d, discount %d", currency, premium.Revenue[currency], premium.Discount[currency])
+		}
+	}
+	if len(r.Revenue) != len(want) || r.Paid != 3 || premium.Redemptions != 4 {
+		t.Errorf("report = %+v", r)
+	}
+}
+
+// Concurrent redemptions by one buyer stop at the per-user limit, and an
+// org's uses are counted apart from its admin's own.
+func TestRedeemPromoCodeLimits(t *testing.T) {
+	testDB(t, &PromoCode{}, &PromoCodeUsage{})
+	promo := PromoCode{Code: "TWICE", DiscountType: "percent", DiscountValue: 10, MaxUsesPerUser: 2, IsActive: true}
+	db.Create(&promo)
+
+	var wg sync.WaitGroup
+	results := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- redeemPromoCode(db, &promo, &PromoCodeUsage{UserID: 1, Product: "premium"})
+		}()
+	}
+	wg.Wait()
+	close(results)
+	redeemed := 0
+	for err := range results {
+		switch {
+		case err == nil:
+			redeemed++
+		case !errors.Is(err, errPromoAlreadyUsed):
+			t.Errorf("redeem: %v", err)
+		}
+	}
+	if redeemed != 2 {
+		t.Errorf("%d concurrent redemptions went through, want 2", redeemed)
+	}
+
+	org := 5
+	if err := redeemPromoCode(db, &promo, &PromoCodeUsage{UserID: 1, OrgID: &org, Product: "org_plan"}); err != nil {
+		t.Errorf("org redemption: %v", err)
+	}
+	db.First(&promo, promo.ID)
+	if promo.UsedCount != 3 {
+		t.Errorf("used_count = %d, want 3", promo.UsedCount)
+	}
+
+	single := PromoCode{Code: "ONCE", DiscountType: "percent", DiscountValue: 10, MaxUses: 1, IsActive: true}
+	db.Create(&single)
+	if err := redeemPromoCode(db, &single, &PromoCodeUsage{UserID: 1, Product: "premium"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := redeemPromoCode(db, &single, &PromoCodeUsage{UserID: 2, Product: "premium"}); !errors.Is(err, errPromoExhausted) {
+		t.Errorf("past the global limit: %v", err)
+	}
+	var usages int64
+	db.Model(&PromoCodeUsage{}).Where("promo_code_id = ?", single.ID).Count(&usages)
+	if usages != 1 {
+		t.Errorf("%d usages of a single-use code", usages)
+	}
+}
+
+// A free checkout reuses the row dunning left behind; user_id is unique.
+func TestCheckoutFreePromoReusesSubscription(t *testing.T) {
+	testDB(t, &User{}, &UserSettings{}, &PremiumPlan{}, &PlanPrice{}, &PremiumSubscription{}, &PremiumTransaction{},
+		&PromoCode{}, &PromoCodeUsage{})
+	saved := paymentProviders
+	t.Cleanup(func() { paymentProviders = saved })
+	paymentProviders = map[string]paymentProvider{}
+
+	user := User{Username: "alice", Password: "x"}
+	db.Create(&user)
+	plan := PremiumPlan{Slug: "pro", Name: "Pro", PriceRub: 299, BillingCycle: "monthly", IsActive: true}
+	db.Create(&plan)
+	ended := time.Now().AddDate(0, -1, 0)
+	old := PremiumSubscription{UserID: user.ID, PlanID: plan.ID, Status: "expired", CurrentPeriodEnd: ended,
+		PastDueSince: &ended, DunningAttempts: 3, GraceUntil: &ended}
+	db.Create(&old)
+	db.Create(&PromoCode{Code: "FREE", DiscountType: "percent", DiscountValue: 100, IsActive: true,
+		ValidFrom: time.Now().Add(-time.Hour), ValidUntil: time.Now().Add(time.Hour)})
+
+	body := fmt.Sprintf(`{"plan_id":%d,"promo_code":"FREE"}`, plan.ID)
+	c, w := testContext(http.MethodPost, "/api/premium/checkout", strings.NewReader(body), user.ID)
+	checkoutPremiumHandler(c)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "free_with_promo") {
+		t.Fatalf("checkout: %d %s", w.Code, w.Body)
+	}
+
+	var subs []PremiumSubscription
+	db.Where("user_id = ?", user.ID).Find(&subs)
+	if len(subs) != 1 || subs[0].ID != old.ID {
+		t.Fatalf("subscriptions = %+v", subs)
+	}
+	sub := subs[0]
+	if sub.Status != "active" || sub.DunningAttempts != 0 || sub.GraceUntil != nil || !sub.CurrentPeriodEnd.After(time.Now()) {
+		t.Errorf("reused subscription = %+v", sub)
+	}
+	var tx PremiumTransaction
+	db.Where("user_id = ?", user.ID).First(&tx)
+	if tx.Status != "succeeded" || tx.SubscriptionID == nil || *tx.SubscriptionID != old.ID {
+		t.Errorf("transaction = %+v", tx)
+	}
+}
@@ -41,6 +41,7 @@ func seedSubscriptionPlans() {
                         LogsRetentionDays:     60,
                         BoardsPersistFlag:     false,
                         JarvisDailyLimit:      20,
+                        JarvisOrgDailyLimit:   200,
                         OverageStorageEnabled: true,
                         TrafficReportsEnabled: false,
                         IsActive:              true,
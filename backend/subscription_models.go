@@ -15,6 +15,9 @@ type SubscriptionPlan struct {
         LogsRetentionDays       int       `json:"logs_retention_days"`
         BoardsPersistFlag       bool      `json:"boards_persist_flag"`
         JarvisDailyLimit        int       `json:"jarvis_daily_limit"`
+        JarvisDailyTokenLimit   int       `json:"jarvis_daily_token_limit"` // 0 derives it from JarvisDailyLimit
+        JarvisOrgDailyLimit     int       `json:"jarvis_org_daily_limit"` // shared by all org members, 0 means no pool
+        JarvisOrgDailyTokenLimit int      `json:"jarvis_org_daily_token_limit"` // 0 derives it from JarvisOrgDailyLimit
         OverageStorageEnabled   bool      `json:"overage_storage_enabled"`
         TrafficReportsEnabled   bool      `json:"traffic_reports_enabled"`
         IsActive                bool      `json:"is_active"`
@@ -44,6 +47,7 @@ type OveragePricing struct {
         MetricType  string    `json:"metric_type"`
         PriceRub    float64   `json:"price_rub"`
         Unit        string    `json:"unit"`
+        IncludedQuantity float64 `gorm:"default:0" json:"included_quantity"` // free units per month before overage
         Description string    `json:"description"`
         IsActive    bool      `json:"is_active"`
         CreatedAt   time.Time `json:"created_at"`
@@ -69,10 +73,13 @@ type OrgSubscription struct {
         StartsAt             time.Time `json:"starts_at"`
         EndsAt               time.Time `json:"ends_at"`
         GraceUntil           *time.Time `json:"grace_until"`
+        PastDueSince         *time.Time `json:"past_due_since"`
+        DunningAttempts      int       `gorm:"default:0" json:"dunning_attempts"`
+        NextRetryAt          *time.Time `json:"next_retry_at"`
         AutoRenew            bool      `json:"auto_renew"`
         PaymentProvider      string    `json:"payment_provider"`
         BillingPeriod        string    `json:"billing_period"`
-        Status               string    `json:"status"`
+        Status               string    `json:"status"` // active, pending_payment, past_due, grace, expired, cancelled
         CreatedAt            time.Time `json:"created_at"`
         UpdatedAt            time.Time `json:"updated_at"`
 }
@@ -170,6 +177,10 @@ type GuildTemplate struct {
         RequiredPlan   string    `gorm:"size:30" json:"required_plan"` // free, edu_basic, edu_pro
         IsActive       bool      `gorm:"default:true" json:"is_active"`
         UsageCount     int       `gorm:"default:0" json:"usage_count"`
+        OwnerID        *uint     `gorm:"index" json:"owner_id,omitempty"` // nil for platform templates
+        SourceGuildID  *uint     `json:"source_guild_id,omitempty"`
+        Version        int       `gorm:"default:0" json:"version"` // GuildTemplateDocument version, 0 for legacy templates
+        DocumentJSON   string    `gorm:"type:text" json:"-"` // full GuildTemplateDocument snapshot
         CreatedAt      time.Time `json:"created_at"`
         UpdatedAt      time.Time `json:"updated_at"`
 }
@@ -220,13 +231,20 @@ type OnlineNotebook struct {
         UpdatedAt   time.Time  `json:"updated_at"`
 }
 
-// JarvisUsage - использование Jarvis AI
+// JarvisUsage - использование Jarvis AI за день (UTC). Для каждого
+// пользователя и каждой организации ведётся отдельная строка: Scope + SubjectID
+// + Date уникальны (см. InitJarvisQuota).
 type JarvisUsage struct {
         ID         int       `gorm:"primaryKey" json:"id"`
         OrgID      *int      `gorm:"index" json:"org_id"` // nil for individual users
-        UserID     int       `gorm:"index" json:"user_id"`
+        UserID     int       `gorm:"index" json:"user_id"` // 0 for org and guild rows
+        Scope      string    `gorm:"size:10;default:'user'" json:"scope"` // user, org, guild
+        SubjectID  int       `gorm:"default:0" json:"subject_id"` // user, org or guild id
         Date       time.Time `gorm:"index" json:"date"`
         RequestCount int     `json:"request_count"`
+        TokenCount   int     `gorm:"default:0" json:"token_count"`
+        OverageRequests int  `gorm:"default:0" json:"overage_requests"`
+        OverageTokens   int  `gorm:"default:0" json:"overage_tokens"`
         CreatedAt  time.Time `json:"created_at"`
         UpdatedAt  time.Time `json:"updated_at"`
 }
@@ -236,6 +254,7 @@ type ManualPayment struct {
         ID             int        `gorm:"primaryKey" json:"id"`
         OrgID          *int       `gorm:"index" json:"org_id"`
         UserID         *int       `gorm:"index" json:"user_id"`
+        InvoiceID      *uint      `gorm:"index" json:"invoice_id"`
         Amount         float64    `json:"amount"`
         Last4Digits    string     `gorm:"size:4" json:"last_4_digits"`
         CardNumber     string     `json:"card_number"` // display card number for transfer
@@ -1,6 +1,7 @@
 package main
 
 import (
+        "context"
         "fmt"
         "log"
         "net/http"
@@ -35,6 +36,12 @@ type WSClient struct {
         Conn   *websocket.Conn
         Send   chan interface{}
         UserID string
+
+        // Jarvis streams started from this connection, by request id
+        jarvisMu      sync.Mutex
+        jarvisStreams map[string]context.CancelFunc
+        sendMu        sync.Mutex
+        closed        bool
 }
 
 type WSDirectMessage struct {
@@ -234,7 +241,8 @@ func (h *WSHub) run() {
                         if isFirstConnection {
                                 go func(userID string) {
                                         now := time.Now()
-                                        db.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+                                        // Presence must not overwrite the mark of an erased account.
+                                        db.Model(&User{}).Where("id = ? AND status <> ?", userID, "deleted").Updates(map[string]interface{}{
                                                 "last_seen": now,
                                                 "status":    "online",
                                         })
@@ -263,7 +271,7 @@ func (h *WSHub) run() {
                         if shouldSetOffline {
                                 go func(userID string) {
                                         now := time.Now()
-                                        db.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+                                        db.Model(&User{}).Where("id = ? AND status <> ?", userID, "deleted").Updates(map[string]interface{}{
                                                 "last_seen": now,
                                                 "status":    "offline",
                                         })
@@ -304,9 +312,22 @@ func (h *WSHub) sendToUser(targetUserID string, message interface{}) {
         }
 }
 
+// disconnectUser closes every connection of the user; the read pumps then
+// unregister them.
+func (h *WSHub) disconnectUser(userID string) {
+        h.mu.RLock()
+        defer h.mu.RUnlock()
+        for client := range h.clients {
+                if client.UserID == userID {
+                        client.Conn.Close()
+                }
+        }
+}
+
 func (c *WSClient) readPump() {
         defer func() {
                 voiceRoster.RemoveUser(c.UserID)
+                c.stopJarvisChats()
                 hub.unregister <- c
                 c.Conn.Close()
         }()
@@ -392,6 +413,12 @@ func (c *WSClient) readPump() {
                                 log.Printf("Voice state update: user %s in channel %s", c.UserID, channelID)
                                 hub.broadcast <- msg
                                 continue
+                        case "jarvis-chat":
+                                c.startJarvisChat(msg)
+                                continue
+                        case "jarvis-chat-cancel":
+                                c.cancelJarvisChat(getStringFromMap(msg, "request_id"))
+                                continue
                         case "ping":
                                 // Handle client-side ping
                                 c.Send <- map[string]string{"type": "pong"}
@@ -477,6 +504,11 @@ func handleWSConnection(c *gin.Context) {
                 c.AbortWithStatus(401)
                 return
         }
+        if accountErased(uint(uid)) {
+                log.Printf("WebSocket connection rejected: account %d was deleted", uint(uid))
+                c.AbortWithStatus(401)
+                return
+        }
 
         userID = strconv.Itoa(int(uid))
 
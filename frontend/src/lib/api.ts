@@ -603,14 +603,22 @@ export interface BillingStats {
   new_subscriptions: number;
   cancelled_subscriptions: number;
   churn_rate: number;
+  revenue_by_currency: CurrencyRevenue[];
   recent_transactions: BillingTransaction[];
 }
 
+export interface CurrencyRevenue {
+  currency: string;
+  monthly_revenue: number;
+  total_revenue: number;
+}
+
 export interface BillingTransaction {
   id: number;
   user_id: number;
   username: string;
-  amount_rub: number;
+  amount: number;
+  currency: string;
   status: string;
   created_at: string;
   completed_at: string | null;
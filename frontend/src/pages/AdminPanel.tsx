@@ -642,6 +642,13 @@ export default function AdminPanel() {
                     <div className="text-4xl font-bold text-purple-500">
                       {billingStats.monthly_revenue.toLocaleString()} ₽
                     </div>
+                    {billingStats.revenue_by_currency
+                      ?.filter((r) => r.currency !== 'RUB')
+                      .map((r) => (
+                        <div key={r.currency} className="text-xl font-semibold text-purple-400">
+                          {r.monthly_revenue.toLocaleString(undefined, { style: 'currency', currency: r.currency })}
+                        </div>
+                      ))}
                     <p className="text-muted-foreground mt-2">
                       Ежемесячный регулярный доход
                     </p>
@@ -681,7 +688,7 @@ export default function AdminPanel() {
                             </div>
                           </div>
                           <div className="text-right">
-                            <p className="font-semibold">{tx.amount_rub.toLocaleString()} ₽</p>
+                            <p className="font-semibold">{tx.amount.toLocaleString(undefined, { style: 'currency', currency: tx.currency || 'RUB' })}</p>
                             <p className={cn(
                               "text-sm",
                               tx.status === 'succeeded' ? "text-green-500" : tx.status === 'pending' ? "text-yellow-500" : "text-red-500"
@@ -184,8 +184,8 @@ interface Capability {
 interface JarvisStatus {
   deepseek_available: boolean
   huggingface_available: boolean
-  tokens_used: number
-  token_limit: number
+  tokens_used?: number
+  token_limit?: number | null
   active_provider: string
 }
 
@@ -359,7 +359,10 @@ export default function JarvisPage() {
 
   const fetchAiStatus = async () => {
     try {
-      const response = await fetch(`${API_BASE}/api/jarvis/status`)
+      const token = localStorage.getItem('token')
+      const response = await fetch(`${API_BASE}/api/jarvis/status`, {
+        headers: token ? { 'Authorization': `Bearer ${token}` } : {}
+      })
       if (response.ok) {
         const data = await response.json()
         setAiStatus(data)
@@ -1079,7 +1082,7 @@ export default function JarvisPage() {
                   HuggingFace
                 </div>
                 <div className="ml-auto">
-                  Tokens: {aiStatus.tokens_used?.toLocaleString()} / {aiStatus.token_limit?.toLocaleString()}
+                  Tokens: {aiStatus.tokens_used?.toLocaleString()} / {aiStatus.token_limit?.toLocaleString() ?? '∞'}
                 </div>
               </div>
             )}
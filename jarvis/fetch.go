@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// fetcher implements fetch-url. Only hosts on JARVIS_FETCH_ALLOWLIST
+// (comma-separated, "*.example.com" for subdomains) can be fetched, and the
+// address actually dialled must be public, which also covers DNS rebinding
+// and redirects to internal services.
+type fetcher struct {
+	allow    []string
+	maxBytes int64
+	client   *http.Client
+}
+
+const fetchMaxRedirects = 3
+
+var blockedPrefixes = func() []netip.Prefix {
+	var out []netip.Prefix
+	for _, p := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+		"::/128", "::1/128", "64:ff9b::/96", "fc00::/7", "fe80::/10", "ff00::/8",
+	} {
+		out = append(out, netip.MustParsePrefix(p))
+	}
+	return out
+}()
+
+func newFetcher() *fetcher {
+	f := &fetcher{maxBytes: envInt64("JARVIS_MAX_FETCH_BYTES", 1<<20)}
+	for _, host := range strings.Split(os.Getenv("JARVIS_FETCH_ALLOWLIST"), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			f.allow = append(f.allow, host)
+		}
+	}
+
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			addr, err := netip.ParseAddr(host)
+			if err != nil || !publicAddr(addr) {
+				return fmt.Errorf("address %s is not allowed", host)
+			}
+			return nil
+		},
+	}
+	f.client = &http.Client{
+		Timeout: 20 * time.Second,
+		Transport: &http.Transport{
+			Proxy:                 nil, // a proxy would hide the real destination
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 15 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= fetchMaxRedirects {
+				return errors.New("too many redirects")
+			}
+			return f.checkURL(req.URL)
+		},
+	}
+	return f
+}
+
+func (f *fetcher) enabled() bool {
+	return len(f.allow) > 0
+}
+
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsMulticast() {
+		return false
+	}
+	for _, p := range blockedPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fetcher) hostAllowed(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, allowed := range f.allow {
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fetcher) checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme %q is not allowed", u.Scheme)
+	}
+	if u.User != nil {
+		return errors.New("credentials in URLs are not allowed")
+	}
+	if !f.hostAllowed(u.Hostname()) {
+		return fmt.Errorf("host %s is not on the allowlist", u.Hostname())
+	}
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil && !publicAddr(addr) {
+		return fmt.Errorf("address %s is not allowed", addr)
+	}
+	return nil
+}
+
+func (f *fetcher) fetch(ctx context.Context, args map[string]interface{}) (string, error) {
+	if !f.enabled() {
+		return "", errors.New("fetch-url is disabled: no hosts are allowed")
+	}
+	raw, _ := args["url"].(string)
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", errors.New("a valid absolute url is required")
+	}
+	if err := f.checkURL(u); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "Jarvis-MCP/1.1")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !textMediaType(mediaType) {
+		return "", fmt.Errorf("content type %q is not supported", mediaType)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, f.maxBytes+1))
+	if err != nil {
+		return "", err
+	}
+	truncated := int64(len(body)) > f.maxBytes
+	if truncated {
+		body = body[:f.maxBytes]
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{
+		"url":          resp.Request.URL.String(),
+		"status":       resp.StatusCode,
+		"content_type": mediaType,
+		"truncated":    truncated,
+		"body":         string(body),
+	})
+	return string(data), nil
+}
+
+func textMediaType(mediaType string) bool {
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case mediaType == "application/json", mediaType == "application/xml", mediaType == "application/javascript",
+		strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPublicAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"8.8.8.8":                true,
+		"93.184.216.34":          true,
+		"2606:4700:4700::1111":   true,
+		"127.0.0.1":              false,
+		"127.1.2.3":              false,
+		"::1":                    false,
+		"0.0.0.0":                false,
+		"::":                     false,
+		"10.0.0.5":               false,
+		"172.16.0.1":             false,
+		"172.31.255.255":         false,
+		"192.168.1.1":            false,
+		"100.64.0.1":             false,
+		"169.254.169.254":        false, // cloud metadata
+		"fc00::1":                false,
+		"fd12:3456::1":           false,
+		"fe80::1":                false,
+		"::ffff:127.0.0.1":       false, // IPv4-mapped loopback
+		"::ffff:10.0.0.1":        false,
+		"::ffff:169.254.169.254": false,
+		"64:ff9b::7f00:1":        false, // NAT64 of 127.0.0.1
+		"224.0.0.1":              false,
+		"255.255.255.255":        false,
+		"172.32.0.1":             true,
+		"::ffff:8.8.8.8":         true,
+	} {
+		if got := publicAddr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("publicAddr(%s) = %t, want %t", addr, got, want)
+		}
+	}
+}
+
+func TestFetcherCheckURL(t *testing.T) {
+	t.Setenv("JARVIS_FETCH_ALLOWLIST", "docs.example.com, *.wiki.example, 127.0.0.1, [::ffff:10.0.0.1], ::ffff:10.0.0.1")
+	f := newFetcher()
+
+	for raw, ok := range map[string]bool{
+		"https://docs.example.com/page":     true,
+		"http://DOCS.example.com./page":     true,
+		"https://en.wiki.example/x":         true,
+		"https://wiki.example/x":            false, // the wildcard needs a subdomain
+		"https://docs.example.com.evil.io/": false,
+		"https://evil.io/?docs.example.com": false,
+		"ftp://docs.example.com/file":       false,
+		"file:///etc/passwd":                false,
+		"https://user:pw@docs.example.com/": false,
+		"http://127.0.0.1/":                 false, // allowlisted but loopback
+		"http://[::ffff:10.0.0.1]/":         false, // allowlisted but private
+		"http://169.254.169.254/latest/":    false,
+	} {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.checkURL(u); (err == nil) != ok {
+			t.Errorf("checkURL(%s) = %v, want allowed=%t", raw, err, ok)
+		}
+	}
+}
+
+func TestFetcherDisabledWithoutAllowlist(t *testing.T) {
+	t.Setenv("JARVIS_FETCH_ALLOWLIST", "")
+	f := newFetcher()
+	if f.enabled() {
+		t.Fatal("fetcher enabled without an allowlist")
+	}
+	if _, err := f.fetch(context.Background(), map[string]interface{}{"url": "https://example.com"}); err == nil {
+		t.Fatal("fetch succeeded without an allowlist")
+	}
+}
+
+// TestFetcherRedirects serves docs.example.com from a local test server and
+// pretends that internal.example.com resolves to the same loopback address.
+// The first host bypasses the address guard so the test can reach it at all;
+// everything else goes through the real dialer.
+func TestFetcherRedirects(t *testing.T) {
+	var secretHits int32
+	var loopbackURL string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte("public page"))
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("\x89PNG"))
+		case "/to-loopback":
+			http.Redirect(w, r, loopbackURL+"/secret", http.StatusFound)
+		case "/to-ip":
+			http.Redirect(w, r, "http://127.0.0.1/secret", http.StatusFound)
+		case "/to-mapped":
+			http.Redirect(w, r, "http://[::ffff:127.0.0.1]/secret", http.StatusFound)
+		case "/to-internal":
+			http.Redirect(w, r, "http://internal.example.com/secret", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/secret":
+			atomic.AddInt32(&secretHits, 1)
+			w.Write([]byte("metadata credentials"))
+		}
+	}))
+	defer srv.Close()
+	loopbackURL = srv.URL
+
+	t.Setenv("JARVIS_FETCH_ALLOWLIST", "*.example.com")
+	f := newFetcher()
+	transport := f.client.Transport.(*http.Transport)
+	guarded := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		switch addr {
+		case "docs.example.com:80":
+			var d net.Dialer
+			return d.DialContext(ctx, network, srv.Listener.Addr().String())
+		case "internal.example.com:80":
+			return guarded(ctx, network, srv.Listener.Addr().String())
+		}
+		return guarded(ctx, network, addr)
+	}
+
+	out, err := f.fetch(context.Background(), map[string]interface{}{"url": "http://docs.example.com/page"})
+	if err != nil || !strings.Contains(out, "public page") {
+		t.Fatalf("fetch public page = %s, %v", out, err)
+	}
+	if _, err := f.fetch(context.Background(), map[string]interface{}{"url": "http://docs.example.com/image"}); err == nil {
+		t.Error("fetched a binary content type")
+	}
+
+	for _, path := range []string{"/to-loopback", "/to-ip", "/to-mapped", "/to-internal", "/loop"} {
+		if out, err := f.fetch(context.Background(), map[string]interface{}{"url": "http://docs.example.com" + path}); err == nil {
+			t.Errorf("redirect %s was followed: %s", path, out)
+		}
+	}
+	if hits := atomic.LoadInt32(&secretHits); hits != 0 {
+		t.Errorf("the internal endpoint was reached %d times", hits)
+	}
+}
@@ -2,56 +2,247 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"sync"
 )
 
-type MCPRequest struct {
-	Tool  string                 `json:"tool"`
-	Input map[string]interface{} `json:"input"`
+// Jarvis MCP server. Speaks the Model Context Protocol (JSON-RPC 2.0) over
+// stdio, one message per line. File tools are confined to the directories
+// listed in JARVIS_ALLOWED_DIRS (separated by the OS path list separator)
+// and refuse every path when it is empty, see sandbox.go; fetch-url is
+// described in fetch.go.
+
+const (
+	protocolVersion = "2025-03-26"
+	maxMessageSize  = 16 << 20
+)
+
+type message struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  interface{}      `json:"result,omitempty"`
+	Error   *rpcError        `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type tool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"inputSchema"`
+}
+
+var tools = []tool{
+	{
+		Name:        "get-config",
+		Description: "Get the Jarvis server configuration",
+		InputSchema: json.RawMessage(`{"type":"object","properties":{}}`),
+	},
+	{
+		Name:        "list-directory",
+		Description: "List the entries of an allowed directory",
+		InputSchema: json.RawMessage(`{"type":"object","properties":{"path":{"type":"string"}}}`),
+	},
+	{
+		Name:        "read-file",
+		Description: "Read a text file inside an allowed directory",
+		InputSchema: json.RawMessage(`{"type":"object","properties":{"path":{"type":"string"}},"required":["path"]}`),
+	},
+	{
+		Name:        "write-file",
+		Description: "Create or replace a text file inside an allowed directory. With dry_run nothing is written.",
+		InputSchema: json.RawMessage(`{"type":"object","properties":{"path":{"type":"string"},"content":{"type":"string"},"dry_run":{"type":"boolean"}},"required":["path","content"]}`),
+	},
 }
 
-type MCPResponse struct {
-	Success bool                   `json:"success"`
-	Data    interface{}            `json:"data,omitempty"`
-	Error   string                 `json:"error,omitempty"`
+var fetchTool = tool{
+	Name:        "fetch-url",
+	Description: "Fetch a text document over HTTP(S) from an allowed host",
+	InputSchema: json.RawMessage(`{"type":"object","properties":{"url":{"type":"string"}},"required":["url"]}`),
+}
+
+type server struct {
+	out      *bufio.Writer
+	writeMu  sync.Mutex
+	sandbox  *sandbox
+	fetcher  *fetcher
+	mu       sync.Mutex
+	inflight map[string]context.CancelFunc
 }
 
 func main() {
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		var req MCPRequest
-		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
-			sendResponse(MCPResponse{Success: false, Error: "Invalid request"})
-			continue
-		}
-
-		switch req.Tool {
-		case "get-config":
-			sendResponse(MCPResponse{Success: true, Data: map[string]string{"version": "1.0", "name": "Jarvis"}})
-		case "list-directory":
-			path := "."
-			if p, ok := req.Input["path"].(string); ok {
-				path = p
-			}
-			files, err := os.ReadDir(path)
-			if err != nil {
-				sendResponse(MCPResponse{Success: false, Error: err.Error()})
-				continue
-			}
-			var names []string
-			for _, f := range files {
-				names = append(names, f.Name())
+	s := &server{
+		out:      bufio.NewWriter(os.Stdout),
+		sandbox:  newSandbox(),
+		fetcher:  newFetcher(),
+		inflight: map[string]context.CancelFunc{},
+	}
+
+	reader := bufio.NewReaderSize(os.Stdin, 64<<10)
+	var wg sync.WaitGroup
+	for {
+		line, err := readLine(reader)
+		if len(line) > 0 {
+			var msg message
+			if jsonErr := json.Unmarshal(line, &msg); jsonErr != nil {
+				s.send(message{JSONRPC: "2.0", ID: rawNull(), Error: &rpcError{Code: -32700, Message: "parse error"}})
+			} else {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					s.handle(&msg)
+				}()
 			}
-			sendResponse(MCPResponse{Success: true, Data: names})
-		default:
-			sendResponse(MCPResponse{Success: false, Error: "Unknown tool"})
 		}
+		if err != nil {
+			break
+		}
+	}
+	wg.Wait()
+}
+
+func readLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		line = append(line, chunk...)
+		if len(line) > maxMessageSize {
+			return nil, errors.New("message too large")
+		}
+		if err != nil || !isPrefix {
+			return line, err
+		}
+	}
+}
+
+func rawNull() *json.RawMessage {
+	null := json.RawMessage("null")
+	return &null
+}
+
+func (s *server) send(msg message) {
+	msg.JSONRPC = "2.0"
+	data, _ := json.Marshal(msg)
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.out.Write(data)
+	s.out.WriteByte('\n')
+	s.out.Flush()
+}
+
+func (s *server) handle(msg *message) {
+	if msg.ID == nil {
+		s.handleNotification(msg)
+		return
+	}
+
+	reply := message{ID: msg.ID}
+	switch msg.Method {
+	case "initialize":
+		reply.Result = map[string]interface{}{
+			"protocolVersion": protocolVersion,
+			"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}},
+			"serverInfo":      map[string]string{"name": "jarvis", "version": "1.1"},
+		}
+	case "ping":
+		reply.Result = map[string]interface{}{}
+	case "tools/list":
+		list := tools
+		if s.fetcher.enabled() {
+			list = append(append([]tool(nil), tools...), fetchTool)
+		}
+		reply.Result = map[string]interface{}{"tools": list}
+	case "tools/call":
+		var params struct {
+			Name      string                 `json:"name"`
+			Arguments map[string]interface{} `json:"arguments"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			reply.Error = &rpcError{Code: -32602, Message: "invalid params"}
+			break
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		key := string(*msg.ID)
+		s.mu.Lock()
+		s.inflight[key] = cancel
+		s.mu.Unlock()
+		result, err := s.callTool(ctx, params.Name, params.Arguments)
+		s.mu.Lock()
+		delete(s.inflight, key)
+		s.mu.Unlock()
+		cancelled := ctx.Err() != nil
+		cancel()
+
+		if cancelled {
+			// Cancelled requests get no response
+			return
+		}
+		if err != nil {
+			reply.Result = toolResult(err.Error(), true)
+		} else {
+			reply.Result = toolResult(result, false)
+		}
+	default:
+		reply.Error = &rpcError{Code: -32601, Message: "method not found: " + msg.Method}
+	}
+	s.send(reply)
+}
+
+func (s *server) handleNotification(msg *message) {
+	if msg.Method != "notifications/cancelled" {
+		return
+	}
+	var params struct {
+		RequestID json.RawMessage `json:"requestId"`
+	}
+	if json.Unmarshal(msg.Params, &params) != nil {
+		return
+	}
+	s.mu.Lock()
+	cancel := s.inflight[string(params.RequestID)]
+	s.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+func toolResult(text string, isError bool) map[string]interface{} {
+	return map[string]interface{}{
+		"content": []map[string]string{{"type": "text", "text": text}},
+		"isError": isError,
 	}
 }
 
-func sendResponse(resp MCPResponse) {
-	bytes, _ := json.Marshal(resp)
-	fmt.Println(string(bytes))
+func (s *server) callTool(ctx context.Context, name string, args map[string]interface{}) (string, error) {
+	switch name {
+	case "get-config":
+		data, _ := json.Marshal(map[string]interface{}{
+			"version":             "1.1",
+			"name":                "Jarvis",
+			"allowed_directories": s.sandbox.roots,
+			"write_dry_run":       s.sandbox.dryRun,
+			"fetch_allowlist":     s.fetcher.allow,
+		})
+		return string(data), nil
+	case "list-directory":
+		return s.sandbox.listDirectory(args)
+	case "read-file":
+		return s.sandbox.readFile(args)
+	case "write-file":
+		return s.sandbox.writeFile(args)
+	case "fetch-url":
+		return s.fetcher.fetch(ctx, args)
+	default:
+		return "", fmt.Errorf("unknown tool: %s", name)
+	}
 }
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sandbox confines the file tools to the allowed roots. Paths are resolved
+// through symlinks before the check, files are re-checked after opening so a
+// symlink swapped in meanwhile is caught, and writes go through a temporary
+// file that is renamed into place.
+type sandbox struct {
+	roots      []string // symlink-free absolute paths
+	maxRead    int64
+	maxWrite   int64
+	maxEntries int
+	dryRun     bool // JARVIS_WRITE_DRY_RUN forces dry runs for every write
+}
+
+func newSandbox() *sandbox {
+	s := &sandbox{
+		maxRead:    envInt64("JARVIS_MAX_READ_BYTES", 256<<10),
+		maxWrite:   envInt64("JARVIS_MAX_WRITE_BYTES", 1<<20),
+		maxEntries: int(envInt64("JARVIS_MAX_DIR_ENTRIES", 1000)),
+		dryRun:     os.Getenv("JARVIS_WRITE_DRY_RUN") == "1",
+	}
+	// Without allowed directories every file tool call is refused; falling
+	// back to the working directory would expose whatever the process was
+	// started in.
+	for _, dir := range filepath.SplitList(os.Getenv("JARVIS_ALLOWED_DIRS")) {
+		if dir == "" {
+			continue
+		}
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+		// Roots that do not exist yet are skipped rather than trusted
+		real, err := filepath.EvalSymlinks(abs)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "jarvis: skipping allowed directory %s: %v\n", dir, err)
+			continue
+		}
+		s.roots = append(s.roots, real)
+	}
+	if len(s.roots) == 0 {
+		fmt.Fprintln(os.Stderr, "jarvis: no allowed directories, file tools are disabled")
+	}
+	return s
+}
+
+func envInt64(key string, def int64) int64 {
+	if v, err := strconv.ParseInt(os.Getenv(key), 10, 64); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+// resolve maps path onto the real file system location and checks that it
+// lies under a root. Relative paths are taken from the first root. The path
+// does not have to exist; its deepest existing ancestor is resolved instead.
+func (s *sandbox) resolve(path string) (string, error) {
+	if len(s.roots) == 0 {
+		return "", errors.New("no allowed directories configured")
+	}
+	if strings.ContainsRune(path, 0) {
+		return "", errors.New("invalid path")
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(s.roots[0], path)
+	}
+	path = filepath.Clean(path)
+
+	existing, rest := path, ""
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return "", fmt.Errorf("access denied: %s", path)
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	real = filepath.Join(real, rest)
+
+	for _, root := range s.roots {
+		if real == root || strings.HasPrefix(real, root+string(filepath.Separator)) {
+			return real, nil
+		}
+	}
+	return "", fmt.Errorf("access denied: %s is outside the allowed directories", path)
+}
+
+// open opens a resolved path and makes sure it is still the regular file
+// that was checked.
+func (s *sandbox) open(path string) (*os.File, os.FileInfo, error) {
+	before, err := os.Lstat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !before.Mode().IsRegular() {
+		return nil, nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	after, err := f.Stat()
+	if err != nil || !os.SameFile(before, after) {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s changed while opening", path)
+	}
+	return f, after, nil
+}
+
+func (s *sandbox) listDirectory(args map[string]interface{}) (string, error) {
+	path, _ := args["path"].(string)
+	if path == "" {
+		path = "."
+	}
+	resolved, err := s.resolve(path)
+	if err != nil {
+		return "", err
+	}
+	dir, err := os.Open(resolved)
+	if err != nil {
+		return "", err
+	}
+	defer dir.Close()
+	entries, err := dir.ReadDir(s.maxEntries + 1)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	names := make([]string, 0, len(entries))
+	for i, e := range entries {
+		if i == s.maxEntries {
+			names = append(names, fmt.Sprintf("… (more than %d entries)", s.maxEntries))
+			break
+		}
+		name := e.Name()
+		if e.IsDir() {
+			name += "/"
+		}
+		names = append(names, name)
+	}
+	data, _ := json.Marshal(names)
+	return string(data), nil
+}
+
+func (s *sandbox) readFile(args map[string]interface{}) (string, error) {
+	path, _ := args["path"].(string)
+	if path == "" {
+		return "", errors.New("path is required")
+	}
+	resolved, err := s.resolve(path)
+	if err != nil {
+		return "", err
+	}
+	f, info, err := s.open(resolved)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, s.maxRead))
+	if err != nil {
+		return "", err
+	}
+	if bytes.IndexByte(data, 0) >= 0 {
+		return "", errors.New("binary files are not supported")
+	}
+	text := string(data)
+	if info.Size() > s.maxRead {
+		text += fmt.Sprintf("\n…[truncated: showing %d of %d bytes]", s.maxRead, info.Size())
+	}
+	return text, nil
+}
+
+// writeFile replaces or creates a file. With dry_run it only reports what
+// would happen.
+func (s *sandbox) writeFile(args map[string]interface{}) (string, error) {
+	path, _ := args["path"].(string)
+	content, ok := args["content"].(string)
+	if path == "" || !ok {
+		return "", errors.New("path and content are required")
+	}
+	if int64(len(content)) > s.maxWrite {
+		return "", fmt.Errorf("content is larger than %d bytes", s.maxWrite)
+	}
+	dryRun, _ := args["dry_run"].(bool)
+	dryRun = dryRun || s.dryRun
+
+	resolved, err := s.resolve(path)
+	if err != nil {
+		return "", err
+	}
+	for _, root := range s.roots {
+		if resolved == root {
+			return "", errors.New("cannot write to an allowed directory itself")
+		}
+	}
+	parent := filepath.Dir(resolved)
+	if info, err := os.Stat(parent); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("directory %s does not exist", parent)
+	}
+
+	action := "create"
+	if info, err := os.Lstat(resolved); err == nil {
+		if !info.Mode().IsRegular() {
+			return "", fmt.Errorf("%s is not a regular file", resolved)
+		}
+		action = "overwrite"
+	}
+
+	result := map[string]interface{}{"path": resolved, "bytes": len(content), "action": action, "dry_run": dryRun}
+	if !dryRun {
+		tmp, err := os.CreateTemp(parent, ".jarvis-write-*")
+		if err != nil {
+			return "", err
+		}
+		_, err = tmp.WriteString(content)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Chmod(tmp.Name(), 0o644)
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), resolved)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return "", err
+		}
+	}
+	data, _ := json.Marshal(result)
+	return string(data), nil
+}
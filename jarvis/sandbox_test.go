@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testSandbox allows a fresh root and returns it together with a sibling
+// directory outside the sandbox that holds a secret file.
+func testSandbox(t *testing.T) (s *sandbox, root, outside string) {
+	t.Helper()
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, outside = filepath.Join(base, "root"), filepath.Join(base, "outside")
+	for _, dir := range []string{root, outside, filepath.Join(root, "docs")} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, filepath.Join(outside, "secret.txt"), "top secret")
+	writeTestFile(t, filepath.Join(root, "docs", "note.txt"), "hello")
+
+	t.Setenv("JARVIS_ALLOWED_DIRS", root)
+	t.Setenv("JARVIS_WRITE_DRY_RUN", "")
+	return newSandbox(), root, outside
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSandboxRequiresAllowedDirs(t *testing.T) {
+	t.Setenv("JARVIS_ALLOWED_DIRS", "")
+	wd, _ := os.Getwd()
+	s := newSandbox()
+	if len(s.roots) != 0 {
+		t.Fatalf("roots = %v, want none", s.roots)
+	}
+	for _, path := range []string{".", "sandbox.go", filepath.Join(wd, "sandbox.go")} {
+		if _, err := s.readFile(map[string]interface{}{"path": path}); err == nil {
+			t.Errorf("read %q without allowed directories", path)
+		}
+	}
+	if _, err := s.listDirectory(map[string]interface{}{}); err == nil {
+		t.Error("listed the working directory without allowed directories")
+	}
+}
+
+func TestSandboxReadConfinement(t *testing.T) {
+	s, root, outside := testSandbox(t)
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "secret-link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{
+		"docs/note.txt",
+		filepath.Join(root, "docs", "note.txt"),
+		"docs/../docs/./note.txt",
+	} {
+		if got, err := s.readFile(map[string]interface{}{"path": path}); err != nil || got != "hello" {
+			t.Errorf("read %q = %q, %v", path, got, err)
+		}
+	}
+
+	for _, path := range []string{
+		"../outside/secret.txt",
+		"docs/../../outside/secret.txt",
+		filepath.Join(outside, "secret.txt"),
+		filepath.Join(root, "..", "outside", "secret.txt"),
+		"/etc/passwd",
+		"escape/secret.txt",    // symlinked parent directory
+		"secret-link.txt",      // symlinked file
+		"escape/missing/x.txt", // not existing below a symlinked parent
+		"docs/note.txt\x00.png",
+	} {
+		if got, err := s.readFile(map[string]interface{}{"path": path}); err == nil {
+			t.Errorf("read %q escaped the sandbox: %q", path, got)
+		}
+	}
+	if _, err := s.listDirectory(map[string]interface{}{"path": "escape"}); err == nil {
+		t.Error("listed a symlinked directory outside the sandbox")
+	}
+}
+
+// A symlink swapped in after resolve must be caught when the file is opened.
+func TestSandboxOpenRejectsSwappedSymlink(t *testing.T) {
+	s, root, outside := testSandbox(t)
+	resolved, err := s.resolve("docs/note.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(resolved); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret.txt"), resolved); err != nil {
+		t.Fatal(err)
+	}
+
+	if f, _, err := s.open(resolved); err == nil {
+		f.Close()
+		t.Fatal("opened a symlink swapped in after the check")
+	}
+	if _, err := s.readFile(map[string]interface{}{"path": filepath.Join(root, "docs", "note.txt")}); err == nil {
+		t.Fatal("read through a swapped symlink")
+	}
+}
+
+func TestSandboxWriteConfinement(t *testing.T) {
+	s, root, outside := testSandbox(t)
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "secret-link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{
+		"escape/new.txt",    // new file under a symlinked parent
+		"escape/secret.txt", // overwrite through a symlinked parent
+		"secret-link.txt",   // overwrite a symlink pointing outside
+		"../outside/new.txt",
+		filepath.Join(outside, "new.txt"),
+		".",
+		root,
+	} {
+		if _, err := s.writeFile(map[string]interface{}{"path": path, "content": "pwned"}); err == nil {
+			t.Errorf("write %q escaped the sandbox", path)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new.txt")); !os.IsNotExist(err) {
+		t.Error("a file was created outside the sandbox")
+	}
+	if data, _ := os.ReadFile(filepath.Join(outside, "secret.txt")); string(data) != "top secret" {
+		t.Errorf("secret was overwritten: %q", data)
+	}
+
+	out, err := s.writeFile(map[string]interface{}{"path": "docs/new.txt", "content": "fresh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result struct {
+		Path   string `json:"path"`
+		Action string `json:"action"`
+		DryRun bool   `json:"dry_run"`
+	}
+	json.Unmarshal([]byte(out), &result)
+	if result.Action != "create" || result.DryRun || result.Path != filepath.Join(root, "docs", "new.txt") {
+		t.Errorf("write result = %s", out)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "docs", "new.txt")); string(data) != "fresh" {
+		t.Errorf("new.txt = %q", data)
+	}
+	entries, _ := os.ReadDir(filepath.Join(root, "docs"))
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".jarvis-write-") {
+			t.Errorf("temporary file %s left behind", e.Name())
+		}
+	}
+}
+
+func TestSandboxWriteDryRun(t *testing.T) {
+	s, root, _ := testSandbox(t)
+	note, created := filepath.Join(root, "docs", "note.txt"), filepath.Join(root, "docs", "created.txt")
+
+	for _, path := range []string{note, created} {
+		out, err := s.writeFile(map[string]interface{}{"path": path, "content": "changed", "dry_run": true})
+		if err != nil {
+			t.Fatalf("dry run %s: %v", path, err)
+		}
+		if !strings.Contains(out, `"dry_run":true`) {
+			t.Errorf("dry run %s reported %s", path, out)
+		}
+	}
+
+	s.dryRun = true // JARVIS_WRITE_DRY_RUN=1 overrides the argument
+	if _, err := s.writeFile(map[string]interface{}{"path": note, "content": "changed", "dry_run": false}); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := os.ReadFile(note); string(data) != "hello" {
+		t.Errorf("dry run changed note.txt to %q", data)
+	}
+	if _, err := os.Stat(created); !os.IsNotExist(err) {
+		t.Error("dry run created a file")
+	}
+	entries, _ := os.ReadDir(filepath.Join(root, "docs"))
+	if len(entries) != 1 {
+		t.Errorf("dry run left %d entries in docs", len(entries))
+	}
+}
@@ -65,6 +65,20 @@ if %errorlevel% neq 0 (
 echo [92mGo dependencies installed successfully[0m
 cd ..
 
+:: Build the Jarvis MCP server the backend starts for its tools
+echo Building Jarvis MCP server...
+cd jarvis
+set GO111MODULE=off
+go build -o jarvis.exe .
+if %errorlevel% neq 0 (
+    echo [91mERROR: Failed to build the Jarvis MCP server, Jarvis tools will be disabled[0m
+) else (
+    set JARVIS_MCP_COMMAND=%CD%\jarvis.exe
+    echo [92mJarvis MCP server built successfully[0m
+)
+set GO111MODULE=
+cd ..
+
 :: Install frontend dependencies
 echo Installing Node.js dependencies...
 cd frontend
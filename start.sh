@@ -59,6 +59,15 @@ if [ $? -ne 0 ]; then
 fi
 cd ..
 
+# Build the Jarvis MCP server; the backend runs it from jarvis/jarvis
+echo "Building Jarvis MCP server..."
+cd jarvis
+go build -o jarvis *.go
+if [ $? -ne 0 ]; then
+    echo -e "${RED}ERROR: Failed to build the Jarvis MCP server, Jarvis tools will be disabled${NC}"
+fi
+cd ..
+
 # Install frontend dependencies
 echo "Installing Node.js dependencies..."
 cd frontend